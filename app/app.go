@@ -0,0 +1,420 @@
+// Package app builds the running server out of a configuration: the
+// database connection, the server with its stores and settings, the router
+// and the schema. The commands in package main and the integration tests
+// start the server the same way through it.
+package app
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"main/bankfile"
+	"main/cache"
+	"main/config"
+	"main/directory"
+	"main/fieldcrypt"
+	"main/fxrates"
+	"main/mailer"
+	"main/oidc"
+	"main/printer"
+	"main/ratelimit"
+	"main/server"
+	"main/tracing"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/lib/pq"
+)
+
+// OpenDB opens the database with the configured pool settings and waits for
+// it to answer, retrying with backoff for up to cfg.DBConnectTimeout so the
+// server survives starting alongside a database that is still coming up.
+// With tracing configured, queries are traced under their requests.
+func OpenDB(cfg config.Config) (*sql.DB, error) {
+	connector, err := pq.NewConnector(cfg.DatabaseURL)
+	if err != nil {
+		return nil, err
+	}
+	var db *sql.DB
+	if cfg.OTLPEndpoint != "" {
+		db = sql.OpenDB(tracing.Connector(connector))
+	} else {
+		db = sql.OpenDB(connector)
+	}
+	db.SetMaxOpenConns(cfg.DBMaxOpenConns)
+	db.SetMaxIdleConns(cfg.DBMaxIdleConns)
+	db.SetConnMaxLifetime(cfg.DBConnMaxLifetime)
+	db.SetConnMaxIdleTime(cfg.DBConnMaxIdleTime)
+
+	deadline := time.Now().Add(cfg.DBConnectTimeout)
+	backoff := 500 * time.Millisecond
+	for {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		err = db.PingContext(ctx)
+		cancel()
+		if err == nil {
+			return db, nil
+		}
+		if time.Now().Add(backoff).After(deadline) {
+			db.Close()
+			return nil, err
+		}
+		log.Printf("Database not reachable, retrying in %s: %v", backoff, err)
+		time.Sleep(backoff)
+		backoff = min(2*backoff, 10*time.Second)
+	}
+}
+
+// NewServer configures a server. reload, when not nil, loads the
+// configuration again for SIGHUP and POST /admin/config/reload; only the
+// settings in server.Settings take effect without a restart.
+func NewServer(db *sql.DB, cfg config.Config, reload func() (config.Config, error)) *server.Server {
+	jwtSecret := []byte(cfg.JWTSecret)
+	if len(jwtSecret) == 0 {
+		// Tokens will not survive a restart, which is fine for local development
+		log.Println("JWT_SECRET not set, using a random secret")
+		jwtSecret = make([]byte, 32)
+		rand.Read(jwtSecret)
+	}
+
+	// Exchange rates are synced daily from a provider, or kept by hand
+	var rateProvider fxrates.Provider
+	switch cfg.ExchangeRateProvider {
+	case "ecb":
+		rateProvider = fxrates.ECB{}
+	case "openexchangerates":
+		rateProvider = fxrates.OpenExchangeRates{AppID: cfg.OpenExchangeRatesAppID}
+	}
+
+	s := &server.Server{
+		DB:         db,
+		JWTSecret:  jwtSecret,
+		SessionTTL: cfg.SessionTTL,
+		LoginLockout: server.LoginLockoutPolicy{
+			Threshold: cfg.LoginLockoutThreshold,
+			Duration:  cfg.LoginLockoutDuration,
+		},
+		// Raw expense request payloads are only kept when a window is configured
+		PayloadRetention: time.Duration(cfg.PayloadRetentionDays) * 24 * time.Hour,
+		Events:           server.NewEventBroker(),
+		BaseCurrency:     cfg.BaseCurrency,
+		FiscalYearStart:  time.Month(cfg.FiscalYearStart),
+		RateProvider:     rateProvider,
+		Users:            server.PostgresUserStore{DB: db},
+		Budgets:          server.PostgresBudgetStore{DB: db},
+		Expenses:         server.PostgresExpenseStore{DB: db},
+		CORS: server.CORSPolicy{
+			Origins:          cfg.CORSOrigins,
+			Methods:          cfg.CORSMethods,
+			Headers:          cfg.CORSHeaders,
+			AllowCredentials: cfg.CORSAllowCredentials,
+			MaxAge:           cfg.CORSMaxAge,
+		},
+		PaymentDebtor: bankfile.Account{
+			Name: cfg.PaymentDebtorName,
+			IBAN: bankfile.NormalizeIBAN(cfg.PaymentDebtorIBAN),
+			BIC:  cfg.PaymentDebtorBIC,
+		},
+		PaymentCSVColumns: cfg.PaymentCSVColumns,
+	}
+
+	// Sensitive columns are encrypted once keys are configured
+	keys, err := cfg.FieldKeys()
+	if err != nil {
+		log.Fatal("Field encryption keys: ", err)
+	}
+	if len(keys) > 0 {
+		if s.FieldKeys, err = fieldcrypt.New(keys...); err != nil {
+			log.Fatal("Field encryption keys: ", err)
+		}
+	}
+
+	// Rate limits are shared through Redis when several instances run
+	if cfg.RateLimitRedisURL != "" {
+		store, err := ratelimit.NewRedis(cfg.RateLimitRedisURL)
+		if err != nil {
+			log.Fatal("Rate limit store: ", err)
+		}
+		s.RateLimiter = store
+	} else {
+		s.RateLimiter = &ratelimit.Memory{}
+	}
+
+	// So is reference data, so a write on one instance is seen by all
+	if cfg.ReferenceCacheTTL > 0 {
+		s.ReferenceCacheTTL = cfg.ReferenceCacheTTL
+		if cfg.CacheRedisURL != "" {
+			store, err := cache.NewRedis(cfg.CacheRedisURL)
+			if err != nil {
+				log.Fatal("Cache store: ", err)
+			}
+			s.Cache = store
+		} else {
+			s.Cache = &cache.Memory{}
+		}
+	}
+
+	// Requests are traced when a collector is configured
+	if cfg.OTLPEndpoint != "" {
+		headers := map[string]string{}
+		for _, header := range cfg.OTLPHeaders {
+			name, value, _ := config.SplitHeader(header)
+			headers[name] = value
+		}
+		s.Tracer = tracing.New(tracing.Options{
+			Endpoint:    cfg.OTLPEndpoint,
+			Headers:     headers,
+			ServiceName: cfg.TraceServiceName,
+			SampleRatio: cfg.TraceSampleRatio,
+		})
+	}
+
+	// Logins are checked against the directory first when one is configured
+	if cfg.LDAPURL != "" {
+		var attributes []string
+		if cfg.LDAPUnitAttribute != "" {
+			attributes = []string{cfg.LDAPUnitAttribute}
+		}
+		s.Directory = directory.LDAP{
+			URL:          cfg.LDAPURL,
+			StartTLS:     cfg.LDAPStartTLS,
+			BindDN:       cfg.LDAPBindDN,
+			BindPassword: cfg.LDAPBindPassword,
+			BaseDN:       cfg.LDAPBaseDN,
+			UserFilter:   cfg.LDAPUserFilter,
+			Attributes:   attributes,
+		}
+		s.DirectoryRules = server.ProvisioningRules{
+			Roles:         groupRules(cfg.LDAPRoleRules),
+			DefaultRole:   server.UserRole(cfg.LDAPDefaultRole),
+			Units:         groupRules(cfg.LDAPUnitRules),
+			UnitAttribute: cfg.LDAPUnitAttribute,
+			DefaultUnit:   cfg.LDAPDefaultUnit,
+		}
+	}
+
+	// Single sign-on through an OpenID Connect provider
+	if cfg.OIDCIssuer != "" {
+		s.OIDC = &oidc.Provider{
+			Issuer:       cfg.OIDCIssuer,
+			ClientID:     cfg.OIDCClientID,
+			ClientSecret: cfg.OIDCClientSecret,
+			RedirectURL:  cfg.OIDCRedirectURL,
+			Scopes:       cfg.OIDCScopes,
+		}
+		s.OIDCMapping = server.OIDCMapping{
+			NameClaim:   cfg.OIDCNameClaim,
+			GroupsClaim: cfg.OIDCGroupsClaim,
+			Rules: server.ProvisioningRules{
+				Roles:         groupRules(cfg.OIDCRoleRules),
+				DefaultRole:   server.UserRole(cfg.OIDCDefaultRole),
+				Units:         groupRules(cfg.OIDCUnitRules),
+				UnitAttribute: cfg.OIDCUnitClaim,
+				DefaultUnit:   cfg.OIDCDefaultUnit,
+			},
+			PostLoginURL: cfg.OIDCPostLoginURL,
+		}
+	}
+
+	if reload != nil {
+		s.LoadSettings = func() (server.Settings, error) {
+			cfg, err := reload()
+			if err != nil {
+				return server.Settings{}, err
+			}
+			return settingsFrom(cfg), nil
+		}
+	}
+	s.ApplySettings(settingsFrom(cfg))
+	return s
+}
+
+// groupRules parses validated group=value rules.
+func groupRules(rules []string) []server.GroupRule {
+	parsed := make([]server.GroupRule, 0, len(rules))
+	for _, rule := range rules {
+		group, value, _ := config.SplitRule(rule)
+		parsed = append(parsed, server.GroupRule{Group: group, Value: value})
+	}
+	return parsed
+}
+
+// settingsFrom picks the settings that can change while the server runs
+// out of a validated configuration.
+func settingsFrom(cfg config.Config) server.Settings {
+	settings := server.Settings{
+		ReceiptHosts:      cfg.ReceiptHosts,
+		RequestTimeout:    cfg.RequestTimeout,
+		InboundEmailToken: cfg.InboundEmailToken,
+		FreezeNotice:      cfg.FreezeNotice,
+		Features:          map[string]bool{},
+		RateLimits: server.RateLimits{
+			Read:  ratelimit.PerMinute(cfg.RateLimitReads, cfg.RateLimitReadBurst),
+			Write: ratelimit.PerMinute(cfg.RateLimitWrites, cfg.RateLimitWriteBurst),
+		},
+	}
+	for _, feature := range cfg.Features {
+		settings.Features[feature] = true
+	}
+
+	// Notification email goes through SendGrid when a key is set, otherwise
+	// through an SMTP relay when one is configured
+	if cfg.SendGridAPIKey != "" {
+		settings.Mailer = mailer.SendGrid{APIKey: cfg.SendGridAPIKey, From: cfg.MailFrom}
+	} else if cfg.SMTPAddr != "" {
+		settings.Mailer = mailer.SMTP{Addr: cfg.SMTPAddr, Username: cfg.SMTPUsername, Password: cfg.SMTPPassword, From: cfg.MailFrom}
+	}
+
+	// Dossiers print on an IPP printer, or land in a spool directory when
+	// only that is configured
+	if cfg.PrinterIPPURL != "" {
+		settings.Printer = printer.IPP{URL: cfg.PrinterIPPURL}
+	} else if cfg.PrintDropDir != "" {
+		settings.Printer = printer.FileDrop{Dir: cfg.PrintDropDir}
+	}
+	return settings
+}
+
+// NewRouter registers every route with its middleware, under
+// server.APIPrefix and, while the old paths are deprecated, at the root.
+func NewRouter(s *server.Server) http.Handler {
+	r := mux.NewRouter()
+	for _, route := range s.Routes() {
+		var handler http.Handler = route.Handler
+		if !route.Unversioned && !route.Stream {
+			handler = s.EnvelopeMiddleware(handler)
+		}
+		handler = server.LegacyQueryMiddleware(route.Query, handler)
+		if route.Idempotent {
+			handler = s.IdempotencyMiddleware(handler)
+		}
+		if !route.Stream {
+			// Streams stay open until the client leaves
+			handler = s.RequestTimeoutMiddleware(handler)
+		}
+		if !route.Unlimited {
+			handler = s.RateLimitMiddleware(handler)
+		}
+		handler = s.APIKeyMiddleware(route, handler)
+		handler = s.MetricsMiddleware(route, handler)
+		handler = s.TracingMiddleware(route, handler)
+		if route.Unversioned {
+			r.Handle(route.Path, handler).Methods(route.Method)
+			continue
+		}
+		r.Handle(server.APIPrefix+route.Path, handler).Methods(route.Method)
+		// The root path stays an alias until the legacy routes' sunset
+		r.Handle(route.Path, server.LegacyRouteMiddleware(handler)).Methods(route.Method)
+	}
+	return s.CORSMiddleware(server.APIVersionMiddleware(r))
+}
+
+// NewGRPCServer serves the gRPC API on cfg.GRPCAddr. gRPC needs HTTP/2,
+// which it speaks without TLS, as internal services call it directly. Calls
+// are not bound by the REST timeouts; clients send their own deadlines.
+func NewGRPCServer(s *server.Server, cfg config.Config) *http.Server {
+	var protocols http.Protocols
+	protocols.SetUnencryptedHTTP2(true)
+	return &http.Server{
+		Addr:        cfg.GRPCAddr,
+		Handler:     s.GRPC(),
+		Protocols:   &protocols,
+		IdleTimeout: cfg.IdleTimeout,
+	}
+}
+
+// TableCreator creates a table and brings an existing one up to date.
+type TableCreator interface {
+	CreateTableIfNotExists(*server.Server)
+}
+
+// CreateTables creates every table that does not exist yet and migrates
+// the others, exiting on failure.
+func CreateTables(s *server.Server) {
+	creators := []TableCreator{
+		server.Currency{},
+		server.ExchangeRate{},
+		server.RoundingRule{},
+		server.User{},
+		server.SetupToken{},
+		server.Session{},
+		server.LoginFailure{},
+		server.APIKey{},
+		server.Delegation{},
+		server.ApprovalPolicy{},
+		server.ExpenseApproval{},
+		server.UserLimit{},
+		server.ExpenseComment{},
+		server.PaymentBatch{},
+		server.BankAccount{},
+		server.Vendor{},
+		server.TaxRate{},
+		server.OIDCLoginState{},
+		server.Unit{},
+		server.FiscalYear{},
+		server.ExpenseCategory{},
+		server.ExpenseRequest{},
+		server.ExpenseLine{},
+		server.ExpenseActivity{},
+		server.PaidExpense{},
+		server.Budget{},
+		server.BudgetAllocation{},
+		server.BudgetRevision{},
+		server.BudgetAlert{},
+		server.Announcement{},
+		server.AnnouncementRead{},
+		server.CollectionChange{},
+		server.ExpenseRequestPayload{},
+		server.Attachment{},
+		server.ExpenseDraft{},
+		server.BudgetFreeze{},
+		server.TableStat{},
+		server.OutboxEmail{},
+		server.Job{},
+		server.Webhook{},
+		server.WebhookDelivery{},
+		server.AuditEntry{},
+		server.IdempotencyKey{},
+		server.NotificationPreferences{},
+		server.PrintJob{},
+		// After the tables whose changes it records
+		server.ChangeLog{},
+		// Last, once the tables it encrypts are up to date
+		server.FieldEncryption{},
+	}
+
+	for _, c := range creators {
+		c.CreateTableIfNotExists(s)
+	}
+}
+
+// SeedDemo fills an empty database with demo data, and leaves one that is
+// already in use alone. It exits on failure.
+func SeedDemo(s *server.Server) {
+	summary, err := server.SeedDemo(context.Background(), s.DB)
+	switch {
+	case errors.Is(err, server.ErrNotEmpty):
+		log.Println("Not seeding demo data:", err)
+	case err != nil:
+		log.Fatal("Seeding demo data failed: ", err)
+	default:
+		log.Printf("Seeded demo data: %+v", summary)
+		s.DropReferenceCache(context.Background())
+	}
+}
+
+// BootstrapSetup prints a one-time setup token to stdout while there is no
+// Admin, for creating the first one with POST /setup. It exits on failure.
+func BootstrapSetup(s *server.Server) {
+	token, err := s.BootstrapSetup(context.Background())
+	if err != nil {
+		log.Fatal("Issuing a setup token failed: ", err)
+	}
+	if token != "" {
+		fmt.Printf("No Admin exists yet. Create the first one with POST /setup and this one-time token:\n\n    %s\n\nor run the create-admin command.\n", token)
+	}
+}
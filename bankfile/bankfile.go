@@ -0,0 +1,273 @@
+// Package bankfile writes credit transfer files that bank portals accept for
+// upload: SEPA pain.001.001.03 XML, and CSV in a layout chosen by column.
+package bankfile
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"main/money"
+	"math/big"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Account is a party to a transfer.
+type Account struct {
+	Name string
+	IBAN string
+	BIC  string // optional within SEPA
+}
+
+// Payment is one credit transfer from the debtor to Creditor.
+type Payment struct {
+	Creditor   Account
+	Amount     money.Amount
+	Currency   string
+	Reference  string // unstructured remittance information shown to the creditor
+	EndToEndID string // travels with the transfer back to the debtor's statement
+}
+
+// Columns are the fields a CSV layout may list.
+var Columns = []string{"name", "iban", "bic", "amount", "currency", "reference", "endToEndID"}
+
+var (
+	ibanPattern = regexp.MustCompile(`^[A-Z]{2}[0-9]{2}[A-Z0-9]{11,30}$`)
+	bicPattern  = regexp.MustCompile(`^[A-Z]{6}[A-Z0-9]{2}([A-Z0-9]{3})?$`)
+)
+
+// NormalizeIBAN removes the spaces IBANs are usually printed with and
+// upper-cases the rest.
+func NormalizeIBAN(iban string) string {
+	return strings.ToUpper(strings.ReplaceAll(iban, " ", ""))
+}
+
+// ValidIBAN reports whether a normalized IBAN is well-formed and passes its
+// ISO 7064 mod 97 check.
+func ValidIBAN(iban string) bool {
+	if !ibanPattern.MatchString(iban) {
+		return false
+	}
+	var digits strings.Builder
+	for _, c := range iban[4:] + iban[:4] {
+		if c >= 'A' && c <= 'Z' {
+			digits.WriteString(strconv.Itoa(int(c-'A') + 10))
+		} else {
+			digits.WriteRune(c)
+		}
+	}
+	n, _ := new(big.Int).SetString(digits.String(), 10)
+	return new(big.Int).Mod(n, big.NewInt(97)).Int64() == 1
+}
+
+// ValidBIC reports whether bic is an 8 or 11 character business identifier
+// code.
+func ValidBIC(bic string) bool {
+	return bicPattern.MatchString(bic)
+}
+
+// ErrNotSEPA is returned for payments SEPA cannot carry.
+var ErrNotSEPA = errors.New("SEPA credit transfers must be in EUR")
+
+// Pain001 writes a SEPA credit transfer initiation paying every payment from
+// debtor on executionDate. messageID must be unique per file the debtor's
+// bank receives.
+func Pain001(messageID string, created time.Time, executionDate time.Time, debtor Account, payments []Payment) ([]byte, error) {
+	var total money.Amount
+	transfers := make([]creditTransfer, len(payments))
+	for i, p := range payments {
+		if p.Currency != "EUR" {
+			return nil, ErrNotSEPA
+		}
+		total += p.Amount
+		t := creditTransfer{
+			EndToEndID: sepaText(p.EndToEndID, 35),
+			Amount:     instructedAmount{Currency: p.Currency, Value: p.Amount.String()},
+			Creditor:   party{Name: sepaText(p.Creditor.Name, 70)},
+			Account:    account{IBAN: p.Creditor.IBAN},
+			Remittance: sepaText(p.Reference, 140),
+		}
+		if t.EndToEndID == "" {
+			t.EndToEndID = "NOTPROVIDED"
+		}
+		if p.Creditor.BIC != "" {
+			t.Agent = &agent{BIC: p.Creditor.BIC}
+		}
+		transfers[i] = t
+	}
+
+	count := strconv.Itoa(len(payments))
+	doc := document{
+		Namespace: "urn:iso:std:iso:20022:tech:xsd:pain.001.001.03",
+		Initiation: initiation{
+			Header: groupHeader{
+				MessageID:   sepaText(messageID, 35),
+				Created:     created.UTC().Format("2006-01-02T15:04:05"),
+				Count:       count,
+				Sum:         total.String(),
+				InitiatedBy: party{Name: sepaText(debtor.Name, 70)},
+			},
+			Info: paymentInfo{
+				ID:            sepaText(messageID, 35),
+				Method:        "TRF",
+				Count:         count,
+				Sum:           total.String(),
+				ServiceLevel:  "SEPA",
+				ExecutionDate: executionDate.Format(time.DateOnly),
+				Debtor:        party{Name: sepaText(debtor.Name, 70)},
+				Account:       account{IBAN: debtor.IBAN},
+				Agent:         debtorAgent(debtor.BIC),
+				ChargeBearer:  "SLEV",
+				Transfers:     transfers,
+			},
+		},
+	}
+
+	var buf bytes.Buffer
+	buf.WriteString(xml.Header)
+	encoder := xml.NewEncoder(&buf)
+	encoder.Indent("", "  ")
+	if err := encoder.Encode(doc); err != nil {
+		return nil, err
+	}
+	buf.WriteByte('\n')
+	return buf.Bytes(), nil
+}
+
+// CSV writes one row per payment with the given columns, after a header
+// row naming them.
+func CSV(columns []string, payments []Payment) ([]byte, error) {
+	var buf bytes.Buffer
+	w := csv.NewWriter(&buf)
+	w.Write(columns)
+	for _, p := range payments {
+		row := make([]string, len(columns))
+		for i, column := range columns {
+			switch column {
+			case "name":
+				row[i] = p.Creditor.Name
+			case "iban":
+				row[i] = p.Creditor.IBAN
+			case "bic":
+				row[i] = p.Creditor.BIC
+			case "amount":
+				row[i] = p.Amount.String()
+			case "currency":
+				row[i] = p.Currency
+			case "reference":
+				row[i] = p.Reference
+			case "endToEndID":
+				row[i] = p.EndToEndID
+			default:
+				return nil, fmt.Errorf("unknown column %q", column)
+			}
+		}
+		w.Write(row)
+	}
+	w.Flush()
+	return buf.Bytes(), w.Error()
+}
+
+// transliterations spell common accented letters in the SEPA character set.
+var transliterations = strings.NewReplacer(
+	"ä", "ae", "ö", "oe", "ü", "ue", "Ä", "Ae", "Ö", "Oe", "Ü", "Ue", "ß", "ss",
+	"à", "a", "á", "a", "â", "a", "ç", "c", "è", "e", "é", "e", "ê", "e", "ë", "e",
+	"ı", "i", "í", "i", "î", "i", "ñ", "n", "ó", "o", "ô", "o", "ş", "s", "ğ", "g",
+	"ú", "u", "û", "u", "İ", "I", "Ç", "C", "É", "E", "Ş", "S", "Ğ", "G",
+)
+
+// sepaText keeps to the Latin character set SEPA requires of free text,
+// spelling out accented letters and replacing what is left outside it, and
+// cuts it to max characters.
+func sepaText(s string, max int) string {
+	var b strings.Builder
+	n := 0
+	for _, c := range transliterations.Replace(s) {
+		if n == max {
+			break
+		}
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9', strings.ContainsRune("/-?:().,'+ ", c):
+			b.WriteRune(c)
+		default:
+			b.WriteRune('.')
+		}
+		n++
+	}
+	return b.String()
+}
+
+func debtorAgent(bic string) agent {
+	if bic == "" {
+		return agent{Other: &other{ID: "NOTPROVIDED"}}
+	}
+	return agent{BIC: bic}
+}
+
+type document struct {
+	XMLName    xml.Name   `xml:"Document"`
+	Namespace  string     `xml:"xmlns,attr"`
+	Initiation initiation `xml:"CstmrCdtTrfInitn"`
+}
+
+type initiation struct {
+	Header groupHeader `xml:"GrpHdr"`
+	Info   paymentInfo `xml:"PmtInf"`
+}
+
+type groupHeader struct {
+	MessageID   string `xml:"MsgId"`
+	Created     string `xml:"CreDtTm"`
+	Count       string `xml:"NbOfTxs"`
+	Sum         string `xml:"CtrlSum"`
+	InitiatedBy party  `xml:"InitgPty"`
+}
+
+type paymentInfo struct {
+	ID            string           `xml:"PmtInfId"`
+	Method        string           `xml:"PmtMtd"`
+	Count         string           `xml:"NbOfTxs"`
+	Sum           string           `xml:"CtrlSum"`
+	ServiceLevel  string           `xml:"PmtTpInf>SvcLvl>Cd"`
+	ExecutionDate string           `xml:"ReqdExctnDt"`
+	Debtor        party            `xml:"Dbtr"`
+	Account       account          `xml:"DbtrAcct"`
+	Agent         agent            `xml:"DbtrAgt"`
+	ChargeBearer  string           `xml:"ChrgBr"`
+	Transfers     []creditTransfer `xml:"CdtTrfTxInf"`
+}
+
+type creditTransfer struct {
+	EndToEndID string           `xml:"PmtId>EndToEndId"`
+	Amount     instructedAmount `xml:"Amt>InstdAmt"`
+	Agent      *agent           `xml:"CdtrAgt,omitempty"`
+	Creditor   party            `xml:"Cdtr"`
+	Account    account          `xml:"CdtrAcct"`
+	Remittance string           `xml:"RmtInf>Ustrd,omitempty"`
+}
+
+type party struct {
+	Name string `xml:"Nm"`
+}
+
+type account struct {
+	IBAN string `xml:"Id>IBAN"`
+}
+
+type agent struct {
+	BIC   string `xml:"FinInstnId>BIC,omitempty"`
+	Other *other `xml:"FinInstnId>Othr,omitempty"`
+}
+
+type other struct {
+	ID string `xml:"Id"`
+}
+
+type instructedAmount struct {
+	Currency string `xml:"Ccy,attr"`
+	Value    string `xml:",chardata"`
+}
@@ -0,0 +1,139 @@
+// Package budgetrules holds the financial rules applied when paying expenses
+// against a budget. It does no I/O: callers load the figures, all in one
+// currency, and decide what to do with the result.
+package budgetrules
+
+import "main/money"
+
+// Status places an amount spent relative to a budget's limit and its
+// tolerated overrun.
+type Status string
+
+const (
+	WithinBudget  Status = "within_budget"  // at or below the limit
+	OverLimit     Status = "over_limit"     // above the limit but within the threshold
+	OverThreshold Status = "over_threshold" // above limit plus threshold
+)
+
+// Budget is a yearly limit for one unit and category. ThresholdRatio is the
+// tolerated overrun as a fraction of Limit, e.g. 0.1 for 10%.
+type Budget struct {
+	Limit          money.Amount
+	ThresholdRatio float64
+}
+
+// Max is the most that may be spent, limit plus threshold.
+func (b Budget) Max() money.Amount {
+	return b.Limit + b.Limit.Mul(b.ThresholdRatio)
+}
+
+// Classify tells where spent stands against the budget.
+func (b Budget) Classify(spent money.Amount) Status {
+	switch {
+	case spent <= b.Limit:
+		return WithinBudget
+	case spent <= b.Max():
+		return OverLimit
+	default:
+		return OverThreshold
+	}
+}
+
+// Headroom is the state of a budget after spending.
+type Headroom struct {
+	Limit  money.Amount
+	Max    money.Amount
+	Spent  money.Amount
+	Rest   money.Amount // left before the limit, negative once over it
+	Status Status
+}
+
+// Rounder rounds a computed amount. A nil Rounder leaves amounts unchanged.
+type Rounder func(money.Amount) money.Amount
+
+func (r Rounder) apply(v money.Amount) money.Amount {
+	if r == nil {
+		return v
+	}
+	return r(v)
+}
+
+// Compute returns the headroom of a budget given the amount spent so far.
+// Inputs are rounded before use so the figures add up as displayed.
+func Compute(b Budget, spent money.Amount, round Rounder) Headroom {
+	b.Limit = round.apply(b.Limit)
+	spent = round.apply(spent)
+	return Headroom{
+		Limit:  b.Limit,
+		Max:    round.apply(b.Max()),
+		Spent:  spent,
+		Rest:   round.apply(b.Limit - spent),
+		Status: b.Classify(spent),
+	}
+}
+
+// Payment is an amount about to be paid against a budget and a request.
+type Payment struct {
+	Amount     money.Amount // amount of this payment
+	Requested  money.Amount // amount of the expense request
+	PaidBefore money.Amount // already paid on the request
+	Spent      money.Amount // already spent from the budget, excluding Amount
+}
+
+// Decision is the outcome of checking a payment.
+type Decision struct {
+	Before  Headroom
+	After   Headroom
+	Allowed bool // the payment keeps spending within limit plus threshold
+	// Crossed is true when this payment is the one that takes spending over
+	// the limit or over the threshold.
+	Crossed bool
+	// Partial is true when the request stays partially paid afterwards.
+	Partial bool
+	// Overpaid is true when the payment exceeds what the request still owes.
+	Overpaid bool
+	// Outstanding is what the request still owes after the payment.
+	Outstanding money.Amount
+}
+
+// Decide checks a payment against a budget and the request it settles.
+func Decide(b Budget, p Payment, round Rounder) Decision {
+	before := Compute(b, p.Spent, round)
+	after := Compute(b, p.Spent+p.Amount, round)
+	paid := round.apply(p.PaidBefore + p.Amount)
+	requested := round.apply(p.Requested)
+	outstanding := round.apply(requested - paid)
+	if outstanding < 0 {
+		outstanding = 0
+	}
+	return Decision{
+		Before:      before,
+		After:       after,
+		Allowed:     after.Status != OverThreshold,
+		Crossed:     after.Status != before.Status,
+		Partial:     paid < requested,
+		Overpaid:    paid > requested,
+		Outstanding: outstanding,
+	}
+}
+
+// Alert is a level of spending against a budget that its owners are told
+// about once it is reached.
+type Alert string
+
+const (
+	AlertExhausted     Alert = "exhausted"      // the limit is used up
+	AlertOverThreshold Alert = "over_threshold" // spending is above limit plus threshold
+)
+
+// Alerts are the levels the headroom has reached, lowest first.
+func (h Headroom) Alerts() []Alert {
+	var alerts []Alert
+	if h.Spent > 0 && h.Rest <= 0 {
+		alerts = append(alerts, AlertExhausted)
+	}
+	if h.Status == OverThreshold {
+		alerts = append(alerts, AlertOverThreshold)
+	}
+	return alerts
+}
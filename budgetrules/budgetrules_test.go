@@ -0,0 +1,276 @@
+package budgetrules
+
+import (
+	"main/money"
+	"slices"
+	"testing"
+)
+
+// toUnits rounds to whole currency units, as a rounding rule with an
+// increment of 1 would.
+func toUnits(a money.Amount) money.Amount { return a.Round(100) }
+
+func TestCompute(t *testing.T) {
+	tests := []struct {
+		name   string
+		budget Budget
+		spent  money.Amount
+		round  Rounder
+		want   Headroom
+	}{
+		{
+			name:   "within the limit",
+			budget: Budget{Limit: 100000, ThresholdRatio: 0.1},
+			spent:  40000,
+			want:   Headroom{Limit: 100000, Max: 110000, Spent: 40000, Rest: 60000, Status: WithinBudget},
+		},
+		{
+			name:   "at the limit",
+			budget: Budget{Limit: 100000, ThresholdRatio: 0.1},
+			spent:  100000,
+			want:   Headroom{Limit: 100000, Max: 110000, Spent: 100000, Rest: 0, Status: WithinBudget},
+		},
+		{
+			name:   "over the limit within the threshold",
+			budget: Budget{Limit: 100000, ThresholdRatio: 0.1},
+			spent:  105000,
+			want:   Headroom{Limit: 100000, Max: 110000, Spent: 105000, Rest: -5000, Status: OverLimit},
+		},
+		{
+			name:   "at the threshold",
+			budget: Budget{Limit: 100000, ThresholdRatio: 0.1},
+			spent:  110000,
+			want:   Headroom{Limit: 100000, Max: 110000, Spent: 110000, Rest: -10000, Status: OverLimit},
+		},
+		{
+			name:   "a cent over the threshold",
+			budget: Budget{Limit: 100000, ThresholdRatio: 0.1},
+			spent:  110001,
+			want:   Headroom{Limit: 100000, Max: 110000, Spent: 110001, Rest: -10001, Status: OverThreshold},
+		},
+		{
+			name:   "no threshold",
+			budget: Budget{Limit: 100000},
+			spent:  100001,
+			want:   Headroom{Limit: 100000, Max: 100000, Spent: 100001, Rest: -1, Status: OverThreshold},
+		},
+		{
+			name:   "inputs are rounded first",
+			budget: Budget{Limit: 100049, ThresholdRatio: 0.1},
+			spent:  50050,
+			round:  toUnits,
+			want:   Headroom{Limit: 100000, Max: 110000, Spent: 50100, Rest: 49900, Status: WithinBudget},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := Compute(tt.budget, tt.spent, tt.round); got != tt.want {
+				t.Errorf("Compute() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDecide(t *testing.T) {
+	budget := Budget{Limit: 100000, ThresholdRatio: 0.1}
+	tests := []struct {
+		name    string
+		budget  Budget
+		payment Payment
+		want    Decision
+	}{
+		{
+			name:    "within the limit",
+			budget:  budget,
+			payment: Payment{Amount: 20000, Requested: 20000, Spent: 80000},
+			want: Decision{
+				Before:  Headroom{Limit: 100000, Max: 110000, Spent: 80000, Rest: 20000, Status: WithinBudget},
+				After:   Headroom{Limit: 100000, Max: 110000, Spent: 100000, Rest: 0, Status: WithinBudget},
+				Allowed: true,
+			},
+		},
+		{
+			name:    "exactly the headroom up to the threshold",
+			budget:  budget,
+			payment: Payment{Amount: 20000, Requested: 20000, Spent: 90000},
+			want: Decision{
+				Before:  Headroom{Limit: 100000, Max: 110000, Spent: 90000, Rest: 10000, Status: WithinBudget},
+				After:   Headroom{Limit: 100000, Max: 110000, Spent: 110000, Rest: -10000, Status: OverLimit},
+				Allowed: true,
+				Crossed: true,
+			},
+		},
+		{
+			name:    "a cent over the threshold",
+			budget:  budget,
+			payment: Payment{Amount: 20001, Requested: 20001, Spent: 90000},
+			want: Decision{
+				Before:  Headroom{Limit: 100000, Max: 110000, Spent: 90000, Rest: 10000, Status: WithinBudget},
+				After:   Headroom{Limit: 100000, Max: 110000, Spent: 110001, Rest: -10001, Status: OverThreshold},
+				Crossed: true,
+			},
+		},
+		{
+			name:    "already over the threshold",
+			budget:  Budget{Limit: 100000},
+			payment: Payment{Amount: 1000, Requested: 1000, Spent: 120000},
+			want: Decision{
+				Before: Headroom{Limit: 100000, Max: 100000, Spent: 120000, Rest: -20000, Status: OverThreshold},
+				After:  Headroom{Limit: 100000, Max: 100000, Spent: 121000, Rest: -21000, Status: OverThreshold},
+			},
+		},
+		{
+			name:    "partial payment",
+			budget:  budget,
+			payment: Payment{Amount: 3000, Requested: 10000, PaidBefore: 2000},
+			want: Decision{
+				Before:      Headroom{Limit: 100000, Max: 110000, Spent: 0, Rest: 100000, Status: WithinBudget},
+				After:       Headroom{Limit: 100000, Max: 110000, Spent: 3000, Rest: 97000, Status: WithinBudget},
+				Allowed:     true,
+				Partial:     true,
+				Outstanding: 5000,
+			},
+		},
+		{
+			name:    "payment settling the rest",
+			budget:  budget,
+			payment: Payment{Amount: 8000, Requested: 10000, PaidBefore: 2000, Spent: 2000},
+			want: Decision{
+				Before:  Headroom{Limit: 100000, Max: 110000, Spent: 2000, Rest: 98000, Status: WithinBudget},
+				After:   Headroom{Limit: 100000, Max: 110000, Spent: 10000, Rest: 90000, Status: WithinBudget},
+				Allowed: true,
+			},
+		},
+		{
+			name:    "overpayment",
+			budget:  budget,
+			payment: Payment{Amount: 9000, Requested: 10000, PaidBefore: 2000, Spent: 2000},
+			want: Decision{
+				Before:   Headroom{Limit: 100000, Max: 110000, Spent: 2000, Rest: 98000, Status: WithinBudget},
+				After:    Headroom{Limit: 100000, Max: 110000, Spent: 11000, Rest: 89000, Status: WithinBudget},
+				Allowed:  true,
+				Overpaid: true,
+			},
+		},
+		{
+			name:    "missing budget",
+			payment: Payment{Amount: 1, Requested: 1},
+			want: Decision{
+				Before:  Headroom{Status: WithinBudget},
+				After:   Headroom{Spent: 1, Rest: -1, Status: OverThreshold},
+				Crossed: true,
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := Decide(tt.budget, tt.payment, nil); got != tt.want {
+				t.Errorf("Decide() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAlerts(t *testing.T) {
+	budget := Budget{Limit: 100000, ThresholdRatio: 0.1}
+	tests := []struct {
+		name   string
+		budget Budget
+		spent  money.Amount
+		want   []Alert
+	}{
+		{name: "nothing spent from an empty budget", spent: 0},
+		{name: "within the limit", budget: budget, spent: 99999},
+		{name: "limit used up", budget: budget, spent: 100000, want: []Alert{AlertExhausted}},
+		{name: "over the limit", budget: budget, spent: 105000, want: []Alert{AlertExhausted}},
+		{name: "over the threshold", budget: budget, spent: 110001, want: []Alert{AlertExhausted, AlertOverThreshold}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := Compute(tt.budget, tt.spent, nil).Alerts(); !slices.Equal(got, tt.want) {
+				t.Errorf("Alerts() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestForecast(t *testing.T) {
+	tests := []struct {
+		name        string
+		budget      Budget
+		monthly     [12]money.Amount
+		elapsed     float64
+		spent       money.Amount
+		runRate     money.Amount
+		projected   money.Amount
+		bands       []Band
+		overrun     Overrun
+		cumulative  [12]money.Amount
+		exhaustedIn int
+	}{
+		{
+			name:    "before the year starts",
+			budget:  Budget{Limit: 500000},
+			bands:   []Band{{Confidence: 0.8}, {Confidence: 0.95}},
+			overrun: OverrunUnlikely,
+		},
+		{
+			name:        "steady spending over the limit",
+			budget:      Budget{Limit: 500000},
+			monthly:     [12]money.Amount{100000, 100000, 100000},
+			elapsed:     3,
+			spent:       300000,
+			runRate:     100000,
+			projected:   1200000,
+			bands:       []Band{{0.8, 1200000, 1200000}, {0.95, 1200000, 1200000}},
+			overrun:     OverrunExpected,
+			cumulative:  [12]money.Amount{100000, 200000, 300000, 400000, 500000, 600000, 700000, 800000, 900000, 1000000, 1100000, 1200000},
+			exhaustedIn: 6,
+		},
+		{
+			name:       "varying spending with a band over the limit",
+			budget:     Budget{Limit: 300000},
+			monthly:    [12]money.Amount{10000, 30000},
+			elapsed:    2,
+			spent:      40000,
+			runRate:    20000,
+			projected:  240000,
+			bands:      []Band{{0.8, 182685, 297315}, {0.95, 152346, 327654}},
+			overrun:    OverrunPossible,
+			cumulative: [12]money.Amount{10000, 40000, 60000, 80000, 100000, 120000, 140000, 160000, 180000, 200000, 220000, 240000},
+		},
+		{
+			name:       "a whole year within the limit",
+			budget:     Budget{Limit: 500000},
+			monthly:    [12]money.Amount{10000, 10000, 10000, 10000, 10000, 10000, 10000, 10000, 10000, 10000, 10000, 10000},
+			elapsed:    12,
+			spent:      120000,
+			runRate:    10000,
+			projected:  120000,
+			bands:      []Band{{0.8, 120000, 120000}, {0.95, 120000, 120000}},
+			overrun:    OverrunUnlikely,
+			cumulative: [12]money.Amount{10000, 20000, 30000, 40000, 50000, 60000, 70000, 80000, 90000, 100000, 110000, 120000},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := Forecast(tt.budget, tt.monthly, tt.elapsed, nil)
+			if p.Spent != tt.spent || p.RunRate != tt.runRate || p.Projected != tt.projected {
+				t.Errorf("spent, run rate, projected = %s, %s, %s, want %s, %s, %s",
+					p.Spent, p.RunRate, p.Projected, tt.spent, tt.runRate, tt.projected)
+			}
+			if !slices.Equal(p.Bands, tt.bands) {
+				t.Errorf("Bands = %+v, want %+v", p.Bands, tt.bands)
+			}
+			if p.Overrun != tt.overrun {
+				t.Errorf("Overrun = %s, want %s", p.Overrun, tt.overrun)
+			}
+			if p.Cumulative != tt.cumulative {
+				t.Errorf("Cumulative = %v, want %v", p.Cumulative, tt.cumulative)
+			}
+			if p.ExhaustedIn != tt.exhaustedIn {
+				t.Errorf("ExhaustedIn = %d, want %d", p.ExhaustedIn, tt.exhaustedIn)
+			}
+		})
+	}
+}
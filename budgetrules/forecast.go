@@ -0,0 +1,120 @@
+package budgetrules
+
+import (
+	"main/money"
+	"math"
+)
+
+// Overrun is how likely a budget is to end the year over its limit.
+type Overrun string
+
+const (
+	OverrunUnlikely Overrun = "unlikely" // even the upper 95% band stays within the limit
+	OverrunPossible Overrun = "possible" // the projection is within the limit, its 95% band is not
+	OverrunExpected Overrun = "expected" // the projection is over the limit
+)
+
+// Band is a range the year's spending ends in with the given confidence.
+type Band struct {
+	Confidence float64
+	Low        money.Amount
+	High       money.Amount
+}
+
+// bandScores are the normal scores of the two-sided bands a projection
+// reports.
+var bandScores = []struct{ confidence, z float64 }{
+	{0.8, 1.2816},
+	{0.95, 1.96},
+}
+
+// Projection is where a budget's spending is headed by the end of the year.
+type Projection struct {
+	Spent     money.Amount
+	RunRate   money.Amount // spent per month so far
+	Projected money.Amount // spending at the end of the year
+	Bands     []Band
+	Overrun   Overrun
+	// Cumulative is the spending at the end of each month, actual for the
+	// months gone by and projected at the run rate after them.
+	Cumulative [12]money.Amount
+	// ExhaustedIn is the month, 1 to 12, in which spending goes over the
+	// limit, or 0 when it is not expected to.
+	ExhaustedIn int
+}
+
+// Forecast projects a year's spending from what was spent in each month
+// so far. elapsed is how much of the year has passed in months, e.g. 9.5
+// in the middle of October, and months after it are expected to be empty.
+// The year is expected to continue at the run rate; the bands widen with
+// the months left and with how much monthly spending varied. With fewer
+// than two whole months behind it that variation is taken to be the run
+// rate itself.
+func Forecast(b Budget, monthly [12]money.Amount, elapsed float64, round Rounder) Projection {
+	elapsed = min(max(elapsed, 0), 12)
+	// Projecting divides, so the statistics run on float cents and are
+	// rounded back to amounts at the end
+	var spent, runRate float64
+	for _, v := range monthly {
+		spent += float64(v)
+	}
+	if elapsed > 0 {
+		runRate = spent / elapsed
+	}
+	left := 12 - elapsed
+	projected := spent + runRate*left
+
+	whole := int(elapsed)
+	spread := runRate
+	if whole >= 2 {
+		var sum float64
+		for _, v := range monthly[:whole] {
+			sum += (float64(v) - runRate) * (float64(v) - runRate)
+		}
+		spread = math.Sqrt(sum / float64(whole-1))
+	}
+	var p Projection
+	for _, score := range bandScores {
+		width := score.z * spread * math.Sqrt(left)
+		p.Bands = append(p.Bands, Band{
+			Confidence: score.confidence,
+			Low:        round.apply(cents(max(projected-width, spent))),
+			High:       round.apply(cents(projected + width)),
+		})
+	}
+
+	limit := round.apply(b.Limit)
+	switch {
+	case round.apply(cents(projected)) > limit:
+		p.Overrun = OverrunExpected
+	case p.Bands[len(p.Bands)-1].High > limit:
+		p.Overrun = OverrunPossible
+	default:
+		p.Overrun = OverrunUnlikely
+	}
+
+	var actual money.Amount
+	for i := range p.Cumulative {
+		end := float64(i + 1)
+		if end <= elapsed {
+			actual += monthly[i]
+			p.Cumulative[i] = actual
+		} else {
+			p.Cumulative[i] = cents(spent + runRate*(end-elapsed))
+		}
+		if p.ExhaustedIn == 0 && p.Cumulative[i] > b.Limit {
+			p.ExhaustedIn = i + 1
+		}
+		p.Cumulative[i] = round.apply(p.Cumulative[i])
+	}
+
+	p.Spent = round.apply(cents(spent))
+	p.RunRate = round.apply(cents(runRate))
+	p.Projected = round.apply(cents(projected))
+	return p
+}
+
+// cents rounds a statistic in cents to an amount.
+func cents(v float64) money.Amount {
+	return money.Amount(math.Round(v))
+}
@@ -0,0 +1,111 @@
+// Package cache keeps values that are expensive to read and change rarely,
+// in memory for a single instance or in Redis when several instances
+// share them.
+package cache
+
+import (
+	"context"
+	"errors"
+	"main/redis"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Store holds values by key until they expire or are deleted.
+type Store interface {
+	// Get returns the value under key and whether there was one
+	Get(ctx context.Context, key string) ([]byte, bool, error)
+	Set(ctx context.Context, key string, value []byte, ttl time.Duration) error
+	Delete(ctx context.Context, keys ...string) error
+}
+
+type entry struct {
+	value   []byte
+	expires time.Time
+}
+
+// Memory keeps the values in this process. The zero value is ready to use.
+type Memory struct {
+	mu      sync.Mutex
+	entries map[string]entry
+}
+
+func (m *Memory) Get(ctx context.Context, key string) ([]byte, bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	e, ok := m.entries[key]
+	if !ok || time.Now().After(e.expires) {
+		return nil, false, nil
+	}
+	return e.value, true, nil
+}
+
+func (m *Memory) Set(ctx context.Context, key string, value []byte, ttl time.Duration) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.entries == nil {
+		m.entries = map[string]entry{}
+	}
+	m.entries[key] = entry{value: value, expires: time.Now().Add(ttl)}
+	return nil
+}
+
+func (m *Memory) Delete(ctx context.Context, keys ...string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, key := range keys {
+		delete(m.entries, key)
+	}
+	return nil
+}
+
+// redisKeyPrefix keeps the cached values apart from anything else in the
+// database.
+const redisKeyPrefix = "ems:cache:"
+
+// Redis keeps the values in Redis, so a write on one instance invalidates
+// them for all.
+type Redis struct {
+	client *redis.Client
+}
+
+// NewRedis connects to the server at rawURL, e.g.
+// redis://:password@localhost:6379/0. No connection is made until the first
+// call.
+func NewRedis(rawURL string) (*Redis, error) {
+	client, err := redis.NewClient(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	return &Redis{client: client}, nil
+}
+
+func (r *Redis) Get(ctx context.Context, key string) ([]byte, bool, error) {
+	reply, err := r.client.Do(ctx, "GET", redisKeyPrefix+key)
+	if err != nil || reply == nil {
+		return nil, false, err
+	}
+	value, ok := reply.(string)
+	if !ok {
+		return nil, false, errors.New("unexpected redis reply to GET")
+	}
+	return []byte(value), true, nil
+}
+
+func (r *Redis) Set(ctx context.Context, key string, value []byte, ttl time.Duration) error {
+	_, err := r.client.Do(ctx, "SET", redisKeyPrefix+key, string(value), "PX", strconv.FormatInt(ttl.Milliseconds(), 10))
+	return err
+}
+
+func (r *Redis) Delete(ctx context.Context, keys ...string) error {
+	if len(keys) == 0 {
+		return nil
+	}
+	args := []string{"DEL"}
+	for _, key := range keys {
+		args = append(args, redisKeyPrefix+key)
+	}
+	_, err := r.client.Do(ctx, args...)
+	return err
+}
@@ -0,0 +1,114 @@
+// Command jsontags rewrites the json struct tags in the given package
+// directories so every field is named by naming.Wire. Tags with
+// naming:"external" keep their name, for formats defined elsewhere such as
+// JWT claims. With -check it only lists the tags that are out of date and
+// fails if there are any.
+//
+//	go run ./cmd/jsontags server
+package main
+
+import (
+	"flag"
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"log"
+	"main/naming"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// edit replaces the tag literal at offset.
+type edit struct {
+	offset, end int
+	tag         string
+}
+
+func main() {
+	check := flag.Bool("check", false, "list outdated tags instead of rewriting them")
+	flag.Parse()
+
+	outdated := 0
+	for _, dir := range flag.Args() {
+		files, err := filepath.Glob(filepath.Join(dir, "*.go"))
+		if err != nil {
+			log.Fatal(err)
+		}
+		for _, path := range files {
+			n, err := rewrite(path, *check)
+			if err != nil {
+				log.Fatal(err)
+			}
+			outdated += n
+		}
+	}
+	if *check && outdated > 0 {
+		os.Exit(1)
+	}
+}
+
+// rewrite fixes the tags of one file and returns how many were outdated.
+func rewrite(path string, check bool) (int, error) {
+	src, err := os.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+	fset := token.NewFileSet()
+	file, err := parser.ParseFile(fset, path, src, parser.ParseComments)
+	if err != nil {
+		return 0, err
+	}
+
+	var edits []edit
+	ast.Inspect(file, func(n ast.Node) bool {
+		st, ok := n.(*ast.StructType)
+		if !ok {
+			return true
+		}
+		for _, field := range st.Fields.List {
+			if field.Tag == nil || len(field.Names) != 1 {
+				continue
+			}
+			raw, err := strconv.Unquote(field.Tag.Value)
+			if err != nil {
+				continue
+			}
+			tag := reflect.StructTag(raw)
+			json, ok := tag.Lookup("json")
+			if !ok || tag.Get("naming") == "external" {
+				continue
+			}
+			name, options, _ := strings.Cut(json, ",")
+			want := naming.Wire(field.Names[0].Name)
+			if name == "" || name == "-" || name == want {
+				continue
+			}
+
+			pos := fset.Position(field.Tag.Pos())
+			if check {
+				fmt.Printf("%s:%d: %s is %q, want %q\n", path, pos.Line, field.Names[0].Name, name, want)
+			}
+			if options != "" {
+				want += "," + options
+			}
+			fixed := strings.Replace(raw, `json:"`+json+`"`, `json:"`+want+`"`, 1)
+			edits = append(edits, edit{pos.Offset, fset.Position(field.Tag.End()).Offset, "`" + fixed + "`"})
+		}
+		return true
+	})
+	if check || len(edits) == 0 {
+		return len(edits), nil
+	}
+
+	// Apply from the end so earlier offsets stay valid
+	sort.Slice(edits, func(i, j int) bool { return edits[i].offset > edits[j].offset })
+	for _, e := range edits {
+		src = append(src[:e.offset], append([]byte(e.tag), src[e.end:]...)...)
+	}
+	return len(edits), os.WriteFile(path, src, 0o644)
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"log"
+	"main/app"
+	"main/config"
+	"main/server"
+	"os"
+)
+
+// commandServer loads the configuration from CONFIG_FILE and the
+// environment and connects to the database, for the commands that work on
+// it without serving HTTP. edit, when not nil, adjusts the configuration
+// before it is validated. On failure it logs why and returns the exit code;
+// otherwise the caller closes s.DB.
+func commandServer(edit func(*config.Config)) (*server.Server, int) {
+	cfg, err := config.Load(os.Getenv("CONFIG_FILE"))
+	if err != nil {
+		log.Println(err)
+		return nil, 2
+	}
+	if edit != nil {
+		edit(&cfg)
+	}
+	if err := cfg.Validate(); err != nil {
+		log.Print("Invalid configuration:\n", err)
+		return nil, 2
+	}
+
+	db, err := app.OpenDB(cfg)
+	if err != nil {
+		log.Println("Database unreachable:", err)
+		return nil, 1
+	}
+	return app.NewServer(db, cfg, nil), 0
+}
@@ -0,0 +1,539 @@
+// Package config loads the server's configuration from defaults, the
+// environment and an optional YAML file, in that order of precedence, and
+// validates it.
+package config
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"main/bankfile"
+	"main/fieldcrypt"
+	"net"
+	"net/url"
+	"os"
+	"reflect"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Config is everything the server can be configured with. Each field can be
+// set in the YAML file under its yaml key or through the environment
+// variable in its env tag; lists are comma separated in the environment.
+type Config struct {
+	ListenAddr      string        `yaml:"listenAddr" env:"HTTP_ADDR"`
+	ReadTimeout     time.Duration `yaml:"readTimeout" env:"HTTP_READ_TIMEOUT"`
+	WriteTimeout    time.Duration `yaml:"writeTimeout" env:"HTTP_WRITE_TIMEOUT"`
+	IdleTimeout     time.Duration `yaml:"idleTimeout" env:"HTTP_IDLE_TIMEOUT"`
+	ShutdownTimeout time.Duration `yaml:"shutdownTimeout" env:"SHUTDOWN_TIMEOUT"`
+	RequestTimeout  time.Duration `yaml:"requestTimeout" env:"REQUEST_TIMEOUT"`
+
+	// The gRPC API is served on a listener of its own; off when empty
+	GRPCAddr string `yaml:"grpcAddr" env:"GRPC_ADDR"`
+
+	// Cross-origin browser clients; CORS is off without origins
+	CORSOrigins          []string      `yaml:"corsOrigins" env:"CORS_ORIGINS"`
+	CORSMethods          []string      `yaml:"corsMethods" env:"CORS_METHODS"`
+	CORSHeaders          []string      `yaml:"corsHeaders" env:"CORS_HEADERS"`
+	CORSAllowCredentials bool          `yaml:"corsAllowCredentials" env:"CORS_ALLOW_CREDENTIALS"`
+	CORSMaxAge           time.Duration `yaml:"corsMaxAge" env:"CORS_MAX_AGE"` // how long browsers may cache a preflight
+
+	// Requests per minute and burst per user, or per address before login;
+	// 0 requests lifts the limit
+	RateLimitReads      int    `yaml:"rateLimitReads" env:"RATE_LIMIT_READS"`
+	RateLimitReadBurst  int    `yaml:"rateLimitReadBurst" env:"RATE_LIMIT_READ_BURST"`
+	RateLimitWrites     int    `yaml:"rateLimitWrites" env:"RATE_LIMIT_WRITES"`
+	RateLimitWriteBurst int    `yaml:"rateLimitWriteBurst" env:"RATE_LIMIT_WRITE_BURST"`
+	RateLimitRedisURL   string `yaml:"rateLimitRedisURL" env:"RATE_LIMIT_REDIS_URL"` // shares the limits between instances
+
+	// Units and expense categories are cached for ReferenceCacheTTL, in
+	// memory or in the Redis server CacheRedisURL names
+	ReferenceCacheTTL time.Duration `yaml:"referenceCacheTTL" env:"REFERENCE_CACHE_TTL"`
+	CacheRedisURL     string        `yaml:"cacheRedisURL" env:"CACHE_REDIS_URL"`
+
+	// Traces go to an OpenTelemetry collector over OTLP/HTTP; off when
+	// OTLPEndpoint is empty
+	OTLPEndpoint     string   `yaml:"otlpEndpoint" env:"OTEL_EXPORTER_OTLP_ENDPOINT"` // e.g. http://localhost:4318
+	OTLPHeaders      []string `yaml:"otlpHeaders" env:"OTEL_EXPORTER_OTLP_HEADERS"`   // e.g. x-api-key=secret
+	TraceServiceName string   `yaml:"traceServiceName" env:"OTEL_SERVICE_NAME"`
+	TraceSampleRatio float64  `yaml:"traceSampleRatio" env:"OTEL_TRACES_SAMPLER_ARG"` // share of new traces recorded, 0 to 1
+
+	DatabaseURL       string        `yaml:"databaseURL" env:"POSTGRES_URL"`
+	DBMaxOpenConns    int           `yaml:"dbMaxOpenConns" env:"DB_MAX_OPEN_CONNS"` // 0 for unlimited
+	DBMaxIdleConns    int           `yaml:"dbMaxIdleConns" env:"DB_MAX_IDLE_CONNS"`
+	DBConnMaxLifetime time.Duration `yaml:"dbConnMaxLifetime" env:"DB_CONN_MAX_LIFETIME"`  // 0 keeps connections forever
+	DBConnMaxIdleTime time.Duration `yaml:"dbConnMaxIdleTime" env:"DB_CONN_MAX_IDLE_TIME"` // 0 keeps idle connections forever
+	DBConnectTimeout  time.Duration `yaml:"dbConnectTimeout" env:"DB_CONNECT_TIMEOUT"`     // how long startup retries an unreachable database
+
+	JWTSecret  string        `yaml:"jwtSecret" env:"JWT_SECRET"`   // random when empty
+	SessionTTL time.Duration `yaml:"sessionTTL" env:"SESSION_TTL"` // how long a refresh token works after login
+
+	// Failed logins in a row that lock a login name, and for how long;
+	// 0 failures disables the lockout
+	LoginLockoutThreshold int           `yaml:"loginLockoutThreshold" env:"LOGIN_LOCKOUT_THRESHOLD"`
+	LoginLockoutDuration  time.Duration `yaml:"loginLockoutDuration" env:"LOGIN_LOCKOUT_DURATION"`
+
+	// IBANs and receipt files are encrypted with the first of these keys,
+	// each written as id:base64 of 32 bytes; the others only decrypt. The
+	// file holds more, one per line, as a KMS or secret manager agent
+	// writes them, and goes first. Off without keys.
+	FieldEncryptionKeys    []string `yaml:"fieldEncryptionKeys" env:"FIELD_ENCRYPTION_KEYS"`
+	FieldEncryptionKeyFile string   `yaml:"fieldEncryptionKeyFile" env:"FIELD_ENCRYPTION_KEY_FILE"`
+
+	// Optional LDAP or Active Directory login. Rules are group=value, where
+	// group is a group's CN or DN, and the first matching rule wins
+	LDAPURL           string   `yaml:"ldapURL" env:"LDAP_URL"` // ldap:// or ldaps://; empty disables LDAP
+	LDAPStartTLS      bool     `yaml:"ldapStartTLS" env:"LDAP_START_TLS"`
+	LDAPBindDN        string   `yaml:"ldapBindDN" env:"LDAP_BIND_DN"` // the account that looks users up
+	LDAPBindPassword  string   `yaml:"ldapBindPassword" env:"LDAP_BIND_PASSWORD"`
+	LDAPBaseDN        string   `yaml:"ldapBaseDN" env:"LDAP_BASE_DN"`
+	LDAPUserFilter    string   `yaml:"ldapUserFilter" env:"LDAP_USER_FILTER"`       // %s is the login name
+	LDAPRoleRules     []string `yaml:"ldapRoleRules" env:"LDAP_ROLE_RULES"`         // e.g. EMS Accountants=Accountant
+	LDAPDefaultRole   string   `yaml:"ldapDefaultRole" env:"LDAP_DEFAULT_ROLE"`     // empty refuses users no rule matches
+	LDAPUnitRules     []string `yaml:"ldapUnitRules" env:"LDAP_UNIT_RULES"`         // e.g. EMS Finance=Finance
+	LDAPUnitAttribute string   `yaml:"ldapUnitAttribute" env:"LDAP_UNIT_ATTRIBUTE"` // e.g. department, when no unit rule matches
+	LDAPDefaultUnit   string   `yaml:"ldapDefaultUnit" env:"LDAP_DEFAULT_UNIT"`
+
+	// Optional OpenID Connect single sign-on, such as Keycloak or Azure AD.
+	// Rules are value=role or value=unit for values of the groups claim
+	OIDCIssuer       string   `yaml:"oidcIssuer" env:"OIDC_ISSUER"` // empty disables single sign-on
+	OIDCClientID     string   `yaml:"oidcClientID" env:"OIDC_CLIENT_ID"`
+	OIDCClientSecret string   `yaml:"oidcClientSecret" env:"OIDC_CLIENT_SECRET"`
+	OIDCRedirectURL  string   `yaml:"oidcRedirectURL" env:"OIDC_REDIRECT_URL"` // the public URL of /oidc/callback
+	OIDCScopes       []string `yaml:"oidcScopes" env:"OIDC_SCOPES"`
+	OIDCNameClaim    string   `yaml:"oidcNameClaim" env:"OIDC_NAME_CLAIM"`
+	OIDCGroupsClaim  string   `yaml:"oidcGroupsClaim" env:"OIDC_GROUPS_CLAIM"` // dots reach into objects, as in realm_access.roles
+	OIDCRoleRules    []string `yaml:"oidcRoleRules" env:"OIDC_ROLE_RULES"`     // e.g. ems-accountants=Accountant
+	OIDCDefaultRole  string   `yaml:"oidcDefaultRole" env:"OIDC_DEFAULT_ROLE"` // empty refuses users no rule matches
+	OIDCUnitRules    []string `yaml:"oidcUnitRules" env:"OIDC_UNIT_RULES"`
+	OIDCUnitClaim    string   `yaml:"oidcUnitClaim" env:"OIDC_UNIT_CLAIM"` // e.g. department, when no unit rule matches
+	OIDCDefaultUnit  string   `yaml:"oidcDefaultUnit" env:"OIDC_DEFAULT_UNIT"`
+	OIDCPostLoginURL string   `yaml:"oidcPostLoginURL" env:"OIDC_POST_LOGIN_URL"` // the front end page that takes the tokens; empty answers with JSON
+
+	// Features switches optional behaviour on by name.
+	Features []string `yaml:"features" env:"FEATURES"`
+
+	BaseCurrency         string        `yaml:"baseCurrency" env:"BASE_CURRENCY"`
+	FiscalYearStart      int           `yaml:"fiscalYearStart" env:"FISCAL_YEAR_START"`           // month, 1 for January to 12; units may set their own
+	PayloadRetentionDays int           `yaml:"payloadRetentionDays" env:"PAYLOAD_RETENTION_DAYS"` // 0 disables payload storage
+	ReceiptHosts         []string      `yaml:"receiptHosts" env:"RECEIPT_URL_ALLOWLIST"`
+	InboundEmailToken    string        `yaml:"inboundEmailToken" env:"INBOUND_EMAIL_TOKEN"`
+	FreezeNotice         time.Duration `yaml:"freezeNotice" env:"FREEZE_NOTICE"`
+	TableStatsInterval   time.Duration `yaml:"tableStatsInterval" env:"TABLE_STATS_INTERVAL"`
+	JobWorkers           int           `yaml:"jobWorkers" env:"JOB_WORKERS"`            // background jobs run at once per instance
+	BudgetCheckHour      int           `yaml:"budgetCheckHour" env:"BUDGET_CHECK_HOUR"` // local hour of the nightly budget check
+
+	MailFrom       string `yaml:"mailFrom" env:"MAIL_FROM"`
+	SendGridAPIKey string `yaml:"sendGridAPIKey" env:"SENDGRID_API_KEY"`
+	SMTPAddr       string `yaml:"smtpAddr" env:"SMTP_ADDR"`
+	SMTPUsername   string `yaml:"smtpUsername" env:"SMTP_USERNAME"`
+	SMTPPassword   string `yaml:"smtpPassword" env:"SMTP_PASSWORD"`
+
+	PrinterIPPURL string `yaml:"printerIPPURL" env:"PRINTER_IPP_URL"`
+	PrintDropDir  string `yaml:"printDropDir" env:"PRINT_DROP_DIR"`
+
+	ExchangeRateProvider     string        `yaml:"exchangeRateProvider" env:"EXCHANGE_RATE_PROVIDER"` // manual, ecb or openexchangerates
+	OpenExchangeRatesAppID   string        `yaml:"openExchangeRatesAppID" env:"OPENEXCHANGERATES_APP_ID"`
+	ExchangeRateSyncInterval time.Duration `yaml:"exchangeRateSyncInterval" env:"EXCHANGE_RATE_SYNC_INTERVAL"`
+
+	// The account payment batches are paid from, for their bank files
+	PaymentDebtorName string   `yaml:"paymentDebtorName" env:"PAYMENT_DEBTOR_NAME"`
+	PaymentDebtorIBAN string   `yaml:"paymentDebtorIBAN" env:"PAYMENT_DEBTOR_IBAN"` // empty disables SEPA files
+	PaymentDebtorBIC  string   `yaml:"paymentDebtorBIC" env:"PAYMENT_DEBTOR_BIC"`
+	PaymentCSVColumns []string `yaml:"paymentCSVColumns" env:"PAYMENT_CSV_COLUMNS"`
+}
+
+// Default is the configuration used for everything left unset.
+func Default() Config {
+	return Config{
+		ListenAddr:               "0.0.0.0:8080",
+		ReadTimeout:              15 * time.Second,
+		WriteTimeout:             30 * time.Second,
+		IdleTimeout:              60 * time.Second,
+		ShutdownTimeout:          20 * time.Second,
+		RequestTimeout:           10 * time.Second,
+		CORSMethods:              []string{"GET", "POST", "PUT", "PATCH", "DELETE"},
+		CORSHeaders:              []string{"Authorization", "Content-Type", "If-Match", "If-None-Match", "If-Modified-Since", "Idempotency-Key", "API-Version", "traceparent"},
+		CORSMaxAge:               10 * time.Minute,
+		RateLimitReads:           600,
+		RateLimitReadBurst:       100,
+		RateLimitWrites:          120,
+		RateLimitWriteBurst:      20,
+		ReferenceCacheTTL:        5 * time.Minute,
+		TraceServiceName:         "ems-backend",
+		TraceSampleRatio:         1,
+		DBMaxIdleConns:           2,
+		DBConnMaxIdleTime:        5 * time.Minute,
+		DBConnectTimeout:         time.Minute,
+		SessionTTL:               7 * 24 * time.Hour,
+		LoginLockoutThreshold:    10,
+		LoginLockoutDuration:     30 * time.Minute,
+		LDAPUserFilter:           "(&(objectClass=user)(sAMAccountName=%s))",
+		LDAPDefaultRole:          "Personnel",
+		OIDCScopes:               []string{"openid", "profile", "email"},
+		OIDCNameClaim:            "preferred_username",
+		OIDCGroupsClaim:          "groups",
+		OIDCDefaultRole:          "Personnel",
+		BaseCurrency:             "USD",
+		FiscalYearStart:          1,
+		PaymentCSVColumns:        []string{"name", "iban", "bic", "amount", "currency", "reference"},
+		FreezeNotice:             7 * 24 * time.Hour,
+		TableStatsInterval:       time.Hour,
+		JobWorkers:               4,
+		BudgetCheckHour:          2,
+		ExchangeRateProvider:     "manual",
+		ExchangeRateSyncInterval: 24 * time.Hour,
+	}
+}
+
+// Load reads the configuration: defaults, overridden by the environment,
+// overridden by the YAML file at path when path is not empty. The result is
+// not validated yet, so callers can adjust it first.
+func Load(path string) (Config, error) {
+	c := Default()
+	if err := c.applyEnv(os.LookupEnv); err != nil {
+		return c, err
+	}
+	if path == "" {
+		return c, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return c, err
+	}
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(&c); err != nil && !errors.Is(err, io.EOF) {
+		return c, fmt.Errorf("%s: %w", path, err)
+	}
+	return c, nil
+}
+
+var durationType = reflect.TypeOf(time.Duration(0))
+
+// applyEnv sets every field whose variable is set in the environment.
+func (c *Config) applyEnv(lookup func(string) (string, bool)) error {
+	v := reflect.ValueOf(c).Elem()
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		name := t.Field(i).Tag.Get("env")
+		value, ok := lookup(name)
+		if name == "" || !ok || value == "" {
+			continue
+		}
+
+		field := v.Field(i)
+		switch {
+		case field.Type() == durationType:
+			d, err := time.ParseDuration(value)
+			if err != nil {
+				return fmt.Errorf("%s must be a duration such as 30s", name)
+			}
+			field.SetInt(int64(d))
+		case field.Kind() == reflect.Bool:
+			b, err := strconv.ParseBool(value)
+			if err != nil {
+				return fmt.Errorf("%s must be true or false", name)
+			}
+			field.SetBool(b)
+		case field.Kind() == reflect.Int:
+			n, err := strconv.Atoi(value)
+			if err != nil {
+				return fmt.Errorf("%s must be an integer", name)
+			}
+			field.SetInt(int64(n))
+		case field.Kind() == reflect.Float64:
+			f, err := strconv.ParseFloat(value, 64)
+			if err != nil {
+				return fmt.Errorf("%s must be a number", name)
+			}
+			field.SetFloat(f)
+		case field.Kind() == reflect.Slice:
+			var items []string
+			for _, item := range strings.Split(value, ",") {
+				if item = strings.TrimSpace(item); item != "" {
+					items = append(items, item)
+				}
+			}
+			field.Set(reflect.ValueOf(items))
+		default:
+			field.SetString(value)
+		}
+	}
+	return nil
+}
+
+var currencyCode = regexp.MustCompile(`^[A-Z]{3}$`)
+
+// Validate reports every problem with the configuration at once.
+func (c Config) Validate() error {
+	var errs []error
+	if _, _, err := net.SplitHostPort(c.ListenAddr); err != nil {
+		errs = append(errs, errors.New("listenAddr must be host:port, such as 0.0.0.0:8080"))
+	}
+	if c.GRPCAddr != "" {
+		if _, _, err := net.SplitHostPort(c.GRPCAddr); err != nil {
+			errs = append(errs, errors.New("grpcAddr must be host:port, such as 0.0.0.0:9090"))
+		} else if c.GRPCAddr == c.ListenAddr {
+			errs = append(errs, errors.New("grpcAddr must differ from listenAddr"))
+		}
+	}
+	if c.DatabaseURL == "" {
+		errs = append(errs, errors.New("databaseURL (POSTGRES_URL) must be set"))
+	}
+	durations := []struct {
+		name  string
+		value time.Duration
+	}{
+		{"readTimeout", c.ReadTimeout}, {"writeTimeout", c.WriteTimeout}, {"idleTimeout", c.IdleTimeout},
+		{"shutdownTimeout", c.ShutdownTimeout}, {"requestTimeout", c.RequestTimeout},
+		{"freezeNotice", c.FreezeNotice}, {"dbConnMaxLifetime", c.DBConnMaxLifetime}, {"corsMaxAge", c.CORSMaxAge},
+		{"dbConnMaxIdleTime", c.DBConnMaxIdleTime}, {"dbConnectTimeout", c.DBConnectTimeout},
+	}
+	for _, d := range durations {
+		if d.value < 0 {
+			errs = append(errs, fmt.Errorf("%s must not be negative", d.name))
+		}
+	}
+	if c.TableStatsInterval <= 0 || c.ExchangeRateSyncInterval <= 0 {
+		errs = append(errs, errors.New("tableStatsInterval and exchangeRateSyncInterval must be positive"))
+	}
+	if c.JobWorkers < 1 {
+		errs = append(errs, errors.New("jobWorkers must be at least 1"))
+	}
+	if c.FiscalYearStart < 1 || c.FiscalYearStart > 12 {
+		errs = append(errs, errors.New("fiscalYearStart must be a month from 1 to 12"))
+	}
+	if c.BudgetCheckHour < 0 || c.BudgetCheckHour > 23 {
+		errs = append(errs, errors.New("budgetCheckHour must be between 0 and 23"))
+	}
+	if c.SessionTTL <= 0 {
+		errs = append(errs, errors.New("sessionTTL must be positive"))
+	}
+	if keys, err := c.FieldKeys(); err != nil {
+		errs = append(errs, fmt.Errorf("fieldEncryptionKeys: %w", err))
+	} else if _, err := fieldcrypt.New(keys...); err != nil && len(keys) > 0 {
+		errs = append(errs, fmt.Errorf("fieldEncryptionKeys: %w", err))
+	}
+	if c.LoginLockoutThreshold < 0 {
+		errs = append(errs, errors.New("loginLockoutThreshold must not be negative"))
+	}
+	if c.LoginLockoutThreshold > 0 && c.LoginLockoutDuration <= 0 {
+		errs = append(errs, errors.New("loginLockoutDuration must be positive when the lockout is on"))
+	}
+	if c.DBMaxOpenConns < 0 || c.DBMaxIdleConns < 0 {
+		errs = append(errs, errors.New("dbMaxOpenConns and dbMaxIdleConns must not be negative"))
+	}
+	if c.RateLimitReads < 0 || c.RateLimitWrites < 0 {
+		errs = append(errs, errors.New("rateLimitReads and rateLimitWrites must not be negative"))
+	}
+	if (c.RateLimitReads > 0 && c.RateLimitReadBurst < 1) || (c.RateLimitWrites > 0 && c.RateLimitWriteBurst < 1) {
+		errs = append(errs, errors.New("rateLimitReadBurst and rateLimitWriteBurst must be at least 1 when the limit is on"))
+	}
+	if u, err := url.Parse(c.RateLimitRedisURL); c.RateLimitRedisURL != "" && (err != nil || u.Scheme != "redis" || u.Host == "") {
+		errs = append(errs, errors.New("rateLimitRedisURL must look like redis://host:6379/0"))
+	}
+	if c.ReferenceCacheTTL < 0 {
+		errs = append(errs, errors.New("referenceCacheTTL must not be negative"))
+	}
+	if u, err := url.Parse(c.CacheRedisURL); c.CacheRedisURL != "" && (err != nil || u.Scheme != "redis" || u.Host == "") {
+		errs = append(errs, errors.New("cacheRedisURL must look like redis://host:6379/0"))
+	}
+	if c.OTLPEndpoint != "" {
+		if u, err := url.Parse(c.OTLPEndpoint); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			errs = append(errs, errors.New("otlpEndpoint must be the collector's OTLP/HTTP URL, such as http://localhost:4318"))
+		}
+		if c.TraceServiceName == "" {
+			errs = append(errs, errors.New("traceServiceName must be set when otlpEndpoint is"))
+		}
+	}
+	for _, header := range c.OTLPHeaders {
+		if _, _, ok := SplitHeader(header); !ok {
+			errs = append(errs, fmt.Errorf("otlpHeaders entry %q must be name=value, the value percent-encoded", header))
+		}
+	}
+	if c.TraceSampleRatio < 0 || c.TraceSampleRatio > 1 {
+		errs = append(errs, errors.New("traceSampleRatio must be between 0 and 1"))
+	}
+	if c.PayloadRetentionDays < 0 {
+		errs = append(errs, errors.New("payloadRetentionDays must not be negative"))
+	}
+	for _, origin := range c.CORSOrigins {
+		if u, err := url.Parse(origin); origin != "*" && (err != nil || u.Scheme == "" || u.Host == "" || u.Path != "") {
+			errs = append(errs, fmt.Errorf("corsOrigins entry %q must be * or a scheme and host such as https://app.example.com", origin))
+		}
+	}
+	if c.CORSAllowCredentials && slices.Contains(c.CORSOrigins, "*") {
+		errs = append(errs, errors.New("corsOrigins must list the origins when corsAllowCredentials is set, not *"))
+	}
+	if !currencyCode.MatchString(c.BaseCurrency) {
+		errs = append(errs, errors.New("baseCurrency must be a three-letter ISO 4217 code such as EUR"))
+	}
+	if (c.SendGridAPIKey != "" || c.SMTPAddr != "") && c.MailFrom == "" {
+		errs = append(errs, errors.New("mailFrom must be set when email is configured"))
+	}
+	if c.PrintDropDir != "" && c.PrinterIPPURL == "" {
+		if info, err := os.Stat(c.PrintDropDir); err != nil || !info.IsDir() {
+			errs = append(errs, errors.New("printDropDir must be an existing directory"))
+		}
+	}
+	if c.LDAPURL != "" {
+		errs = append(errs, c.validateLDAP()...)
+	}
+	if c.OIDCIssuer != "" {
+		errs = append(errs, c.validateOIDC()...)
+	}
+	if c.PaymentDebtorIBAN != "" {
+		if !bankfile.ValidIBAN(bankfile.NormalizeIBAN(c.PaymentDebtorIBAN)) {
+			errs = append(errs, errors.New("paymentDebtorIBAN is not a valid IBAN"))
+		}
+		if c.PaymentDebtorName == "" {
+			errs = append(errs, errors.New("paymentDebtorName must be set with paymentDebtorIBAN"))
+		}
+	}
+	if c.PaymentDebtorBIC != "" && !bankfile.ValidBIC(c.PaymentDebtorBIC) {
+		errs = append(errs, errors.New("paymentDebtorBIC must be an 8 or 11 character BIC"))
+	}
+	if len(c.PaymentCSVColumns) == 0 {
+		errs = append(errs, errors.New("paymentCSVColumns must name at least one column"))
+	}
+	for _, column := range c.PaymentCSVColumns {
+		if !slices.Contains(bankfile.Columns, column) {
+			errs = append(errs, fmt.Errorf("paymentCSVColumns entry %q must be one of %s", column, strings.Join(bankfile.Columns, ", ")))
+		}
+	}
+	switch c.ExchangeRateProvider {
+	case "", "manual", "ecb":
+	case "openexchangerates":
+		if c.OpenExchangeRatesAppID == "" {
+			errs = append(errs, errors.New("openExchangeRatesAppID must be set for the openexchangerates provider"))
+		}
+	default:
+		errs = append(errs, fmt.Errorf("exchangeRateProvider must be manual, ecb or openexchangerates, not %q", c.ExchangeRateProvider))
+	}
+	return errors.Join(errs...)
+}
+
+// roles are the user roles LDAP and OIDC rules may assign.
+var roles = []string{"Admin", "Personnel", "Manager", "Accountant"}
+
+// FieldKeys reads the field encryption keys, those of
+// FieldEncryptionKeyFile first.
+func (c Config) FieldKeys() ([]fieldcrypt.Key, error) {
+	specs := slices.Clone(c.FieldEncryptionKeys)
+	if c.FieldEncryptionKeyFile != "" {
+		data, err := os.ReadFile(c.FieldEncryptionKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		var lines []string
+		for _, line := range strings.Split(string(data), "\n") {
+			if line = strings.TrimSpace(line); line != "" && !strings.HasPrefix(line, "#") {
+				lines = append(lines, line)
+			}
+		}
+		specs = append(lines, specs...)
+	}
+	keys := make([]fieldcrypt.Key, 0, len(specs))
+	for _, spec := range specs {
+		key, err := fieldcrypt.ParseKey(spec)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+func (c Config) validateLDAP() []error {
+	var errs []error
+	if u, err := url.Parse(c.LDAPURL); err != nil || (u.Scheme != "ldap" && u.Scheme != "ldaps") || u.Host == "" {
+		errs = append(errs, errors.New("ldapURL must look like ldaps://dc.example.com or ldap://dc.example.com:389"))
+	} else if u.Scheme == "ldaps" && c.LDAPStartTLS {
+		errs = append(errs, errors.New("ldapStartTLS is for ldap:// URLs; ldaps:// is encrypted already"))
+	}
+	if c.LDAPBaseDN == "" {
+		errs = append(errs, errors.New("ldapBaseDN must be set when ldapURL is"))
+	}
+	if strings.Count(c.LDAPUserFilter, "%s") != 1 {
+		errs = append(errs, errors.New("ldapUserFilter must contain %s once, for the login name"))
+	}
+	for _, rule := range c.LDAPRoleRules {
+		if _, role, ok := SplitRule(rule); !ok || !slices.Contains(roles, role) {
+			errs = append(errs, fmt.Errorf("ldapRoleRules entry %q must be group=role with a role of %s", rule, strings.Join(roles, ", ")))
+		}
+	}
+	if c.LDAPDefaultRole != "" && !slices.Contains(roles, c.LDAPDefaultRole) {
+		errs = append(errs, fmt.Errorf("ldapDefaultRole must be empty or one of %s", strings.Join(roles, ", ")))
+	}
+	for _, rule := range c.LDAPUnitRules {
+		if _, _, ok := SplitRule(rule); !ok {
+			errs = append(errs, fmt.Errorf("ldapUnitRules entry %q must be group=unit", rule))
+		}
+	}
+	return errs
+}
+
+func (c Config) validateOIDC() []error {
+	var errs []error
+	if u, err := url.Parse(c.OIDCIssuer); err != nil || u.Scheme != "https" || u.Host == "" {
+		errs = append(errs, errors.New("oidcIssuer must be an https:// URL such as https://login.microsoftonline.com/<tenant>/v2.0"))
+	}
+	if c.OIDCClientID == "" {
+		errs = append(errs, errors.New("oidcClientID must be set when oidcIssuer is"))
+	}
+	if u, err := url.Parse(c.OIDCRedirectURL); err != nil || !u.IsAbs() || !strings.HasSuffix(u.Path, "/oidc/callback") {
+		errs = append(errs, errors.New("oidcRedirectURL must be the absolute URL of /oidc/callback"))
+	}
+	if c.OIDCPostLoginURL != "" {
+		if u, err := url.Parse(c.OIDCPostLoginURL); err != nil || !u.IsAbs() || u.Fragment != "" {
+			errs = append(errs, errors.New("oidcPostLoginURL must be an absolute URL without a fragment"))
+		}
+	}
+	if c.OIDCNameClaim == "" {
+		errs = append(errs, errors.New("oidcNameClaim must be set when oidcIssuer is"))
+	}
+	for _, rule := range c.OIDCRoleRules {
+		if _, role, ok := SplitRule(rule); !ok || !slices.Contains(roles, role) {
+			errs = append(errs, fmt.Errorf("oidcRoleRules entry %q must be value=role with a role of %s", rule, strings.Join(roles, ", ")))
+		}
+	}
+	if c.OIDCDefaultRole != "" && !slices.Contains(roles, c.OIDCDefaultRole) {
+		errs = append(errs, fmt.Errorf("oidcDefaultRole must be empty or one of %s", strings.Join(roles, ", ")))
+	}
+	for _, rule := range c.OIDCUnitRules {
+		if _, _, ok := SplitRule(rule); !ok {
+			errs = append(errs, fmt.Errorf("oidcUnitRules entry %q must be value=unit", rule))
+		}
+	}
+	return errs
+}
+
+// SplitRule splits an LDAP or OIDC mapping rule at its last "=", since the group
+// may be a DN full of them.
+func SplitRule(rule string) (group, value string, ok bool) {
+	i := strings.LastIndex(rule, "=")
+	if i <= 0 || i == len(rule)-1 {
+		return "", "", false
+	}
+	return strings.TrimSpace(rule[:i]), strings.TrimSpace(rule[i+1:]), true
+}
+
+// SplitHeader splits an otlpHeaders entry into its name and value. Values
+// are percent-encoded, as in OTEL_EXPORTER_OTLP_HEADERS, and may contain =.
+func SplitHeader(header string) (name, value string, ok bool) {
+	name, value, found := strings.Cut(header, "=")
+	name = strings.TrimSpace(name)
+	value, err := url.PathUnescape(strings.TrimSpace(value))
+	if !found || name == "" || err != nil {
+		return "", "", false
+	}
+	return name, value, true
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"main/server"
+	"maps"
+	"os"
+	"slices"
+	"strings"
+
+	"golang.org/x/term"
+)
+
+// createAdmin creates an Admin user, e.g. `main create-admin -name alice`,
+// and returns the process exit code. The password is prompted for twice on
+// a terminal and read from the first line of stdin otherwise, so it never
+// shows up in the shell history or the process list.
+func createAdmin(args []string) int {
+	flags := flag.NewFlagSet("create-admin", flag.ContinueOnError)
+	name := flags.String("name", "", "login `name` of the new Admin")
+	unit := flags.String("unit", "Executive Management", "`unit` the new Admin belongs to")
+	email := flags.String("email", "", "email `address` of the new Admin")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if *name == "" {
+		log.Println("-name is required")
+		return 2
+	}
+
+	password, err := readPassword()
+	if err != nil {
+		log.Println(err)
+		return 2
+	}
+
+	s, code := commandServer(nil)
+	if s == nil {
+		return code
+	}
+	defer s.DB.Close()
+
+	user, errs, err := s.CreateAdmin(context.Background(), server.User{
+		Name:     *name,
+		UnitID:   *unit,
+		Password: password,
+		Email:    *email,
+	})
+	if err != nil {
+		log.Println("Creating the Admin failed:", err)
+		return 1
+	}
+	if len(errs) > 0 {
+		for _, field := range slices.Sorted(maps.Keys(errs)) {
+			log.Println(field, errs[field])
+		}
+		return 2
+	}
+	log.Printf("Created Admin %s with ID %d", user.Name, user.ID)
+	return 0
+}
+
+// readPassword prompts for the password and its confirmation on a
+// terminal, or reads one line from stdin when it is not a terminal.
+func readPassword() (string, error) {
+	fd := int(os.Stdin.Fd())
+	if !term.IsTerminal(fd) {
+		line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		if err != nil && !errors.Is(err, io.EOF) {
+			return "", err
+		}
+		return strings.TrimRight(line, "\r\n"), nil
+	}
+
+	fmt.Fprint(os.Stderr, "Password: ")
+	password, err := term.ReadPassword(fd)
+	fmt.Fprintln(os.Stderr)
+	if err != nil {
+		return "", err
+	}
+	fmt.Fprint(os.Stderr, "Repeat password: ")
+	repeated, err := term.ReadPassword(fd)
+	fmt.Fprintln(os.Stderr)
+	if err != nil {
+		return "", err
+	}
+	if string(password) != string(repeated) {
+		return "", errors.New("the passwords do not match")
+	}
+	return string(password), nil
+}
@@ -0,0 +1,138 @@
+// Package directory checks passwords against LDAP or Active Directory and
+// reads the groups and attributes the server maps to roles and units.
+package directory
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/go-ldap/ldap/v3"
+)
+
+// ErrInvalidCredentials is returned for an unknown login name or a wrong
+// password, which the directory does not tell apart.
+var ErrInvalidCredentials = errors.New("invalid credentials")
+
+// defaultTimeout bounds a login when the context has no deadline.
+const defaultTimeout = 10 * time.Second
+
+// Entry is the directory's record of a user who logged in.
+type Entry struct {
+	DN         string
+	Email      string
+	Groups     []string          // DNs of the groups the user is a member of
+	Attributes map[string]string // first value of each requested attribute
+}
+
+// Authenticator checks a login name and password.
+type Authenticator interface {
+	Authenticate(ctx context.Context, name, password string) (Entry, error)
+}
+
+// LDAP looks the user up with a service account, then binds as the user to
+// check the password. ldap:// connections are upgraded with StartTLS when
+// StartTLS is set.
+type LDAP struct {
+	URL          string
+	StartTLS     bool
+	BindDN       string // empty binds anonymously for the lookup
+	BindPassword string
+	BaseDN       string
+	UserFilter   string   // %s is replaced by the escaped login name
+	Attributes   []string // extra attributes to return in Entry.Attributes
+}
+
+func (l LDAP) Authenticate(ctx context.Context, name, password string) (Entry, error) {
+	// An empty password would be an unauthenticated bind, which succeeds
+	// for any DN on many servers
+	if name == "" || password == "" {
+		return Entry{}, ErrInvalidCredentials
+	}
+
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Now().Add(defaultTimeout)
+	}
+	conn, err := ldap.DialURL(l.URL, ldap.DialWithDialer(&net.Dialer{Deadline: deadline}))
+	if err != nil {
+		return Entry{}, err
+	}
+	defer conn.Close()
+	conn.SetTimeout(time.Until(deadline))
+
+	if l.StartTLS {
+		u, err := url.Parse(l.URL)
+		if err != nil {
+			return Entry{}, err
+		}
+		if err := conn.StartTLS(&tls.Config{ServerName: u.Hostname()}); err != nil {
+			return Entry{}, fmt.Errorf("StartTLS: %w", err)
+		}
+	}
+
+	if l.BindDN != "" {
+		err = conn.Bind(l.BindDN, l.BindPassword)
+	} else {
+		err = conn.UnauthenticatedBind("")
+	}
+	if err != nil {
+		return Entry{}, fmt.Errorf("service account bind: %w", err)
+	}
+
+	attributes := append([]string{"mail", "memberOf"}, l.Attributes...)
+	result, err := conn.Search(ldap.NewSearchRequest(
+		l.BaseDN, ldap.ScopeWholeSubtree, ldap.NeverDerefAliases,
+		2, int(time.Until(deadline).Seconds())+1, false,
+		strings.Replace(l.UserFilter, "%s", ldap.EscapeFilter(name), 1),
+		attributes, nil,
+	))
+	if ldap.IsErrorWithCode(err, ldap.LDAPResultSizeLimitExceeded) {
+		return Entry{}, ErrInvalidCredentials
+	}
+	if err != nil {
+		return Entry{}, fmt.Errorf("user search: %w", err)
+	}
+	// A name matching several entries is as good as unknown
+	if len(result.Entries) != 1 {
+		return Entry{}, ErrInvalidCredentials
+	}
+	found := result.Entries[0]
+
+	if err := conn.Bind(found.DN, password); ldap.IsErrorWithCode(err, ldap.LDAPResultInvalidCredentials) {
+		return Entry{}, ErrInvalidCredentials
+	} else if err != nil {
+		return Entry{}, fmt.Errorf("user bind: %w", err)
+	}
+
+	entry := Entry{
+		DN:         found.DN,
+		Email:      found.GetAttributeValue("mail"),
+		Groups:     found.GetAttributeValues("memberOf"),
+		Attributes: map[string]string{},
+	}
+	for _, attribute := range l.Attributes {
+		entry.Attributes[attribute] = found.GetAttributeValue(attribute)
+	}
+	return entry, nil
+}
+
+// GroupCN returns the common name of a group DN such as
+// "CN=EMS Accountants,OU=Groups,DC=example,DC=com", or "" when it has none.
+func GroupCN(dn string) string {
+	parsed, err := ldap.ParseDN(dn)
+	if err != nil || len(parsed.RDNs) == 0 {
+		return ""
+	}
+	for _, attribute := range parsed.RDNs[0].Attributes {
+		if strings.EqualFold(attribute.Type, "CN") {
+			return attribute.Value
+		}
+	}
+	return ""
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"main/app"
+	"main/config"
+	"main/server"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// exportPaths are the exports of the export command by name.
+var exportPaths = map[string]string{
+	"expense_requests": server.APIPrefix + "/expense_requests",
+	"paid_expenses":    server.APIPrefix + "/paid_expenses",
+	"accruals":         server.APIPrefix + "/reports/accruals",
+}
+
+// export writes a list as CSV or NDJSON, e.g.
+// `main export -o paid.csv paid_expenses year=2025 unitID=Sales`, and
+// returns the process exit code. The arguments after the name are the
+// list's query parameters. The request runs in-process as the oldest Admin,
+// through the same handler and checks as GET ...?format=csv.
+func export(args []string) int {
+	flags := flag.NewFlagSet("export", flag.ContinueOnError)
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "Usage: main export [-o file] [-format csv|ndjson] expense_requests|paid_expenses|accruals [name=value ...]")
+		flags.PrintDefaults()
+	}
+	output := flags.String("o", "", "write to `file` instead of stdout")
+	format := flags.String("format", "csv", "csv, or ndjson for one JSON object per line")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if *format != "csv" && *format != "ndjson" {
+		log.Printf("Unknown format %q; use csv or ndjson", *format)
+		return 2
+	}
+	if flags.NArg() == 0 {
+		flags.Usage()
+		return 2
+	}
+	path, ok := exportPaths[flags.Arg(0)]
+	if !ok {
+		log.Printf("Unknown export %q; use expense_requests, paid_expenses or accruals", flags.Arg(0))
+		return 2
+	}
+	params := url.Values{}
+	for _, arg := range flags.Args()[1:] {
+		name, value, ok := strings.Cut(arg, "=")
+		if !ok || name == "" {
+			log.Printf("Invalid parameter %q; use name=value", arg)
+			return 2
+		}
+		params.Add(name, value)
+	}
+	params.Set("format", *format)
+
+	s, code := commandServer(func(cfg *config.Config) {
+		// An export runs as long as it takes and is not a client to limit
+		cfg.RequestTimeout = 0
+		cfg.RateLimitReads, cfg.RateLimitWrites, cfg.RateLimitRedisURL = 0, 0, ""
+	})
+	if s == nil {
+		return code
+	}
+	defer s.DB.Close()
+
+	ctx := context.Background()
+	token, err := s.OperatorToken(ctx)
+	if err != nil {
+		log.Println(err)
+		return 1
+	}
+	r, err := http.NewRequestWithContext(ctx, http.MethodGet, path+"?"+params.Encode(), nil)
+	if err != nil {
+		log.Println(err)
+		return 2
+	}
+	r.Header.Set("Authorization", "Bearer "+token)
+	r.RemoteAddr = "127.0.0.1:0"
+
+	var out io.Writer = os.Stdout
+	if *output != "" {
+		f, err := os.Create(*output)
+		if err != nil {
+			log.Println(err)
+			return 1
+		}
+		defer f.Close()
+		out = f
+	}
+
+	w := &exportWriter{header: http.Header{}, out: out}
+	app.NewRouter(s).ServeHTTP(w, r)
+	if w.err != nil {
+		log.Println("Writing the export failed:", w.err)
+		return 1
+	}
+	if w.status != http.StatusOK {
+		log.Printf("Export failed with status %d: %s", w.status, strings.TrimSpace(w.failure.String()))
+		if *output != "" {
+			os.Remove(*output)
+		}
+		return 1
+	}
+	return 0
+}
+
+// exportWriter is the http.ResponseWriter of an export. It copies a 200
+// body to out as the handler streams it, and keeps any other for the error
+// message.
+type exportWriter struct {
+	header  http.Header
+	out     io.Writer
+	status  int
+	failure bytes.Buffer
+	err     error
+}
+
+func (w *exportWriter) Header() http.Header { return w.header }
+
+func (w *exportWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+}
+
+func (w *exportWriter) Write(p []byte) (int, error) {
+	w.WriteHeader(http.StatusOK)
+	if w.status != http.StatusOK {
+		return w.failure.Write(p)
+	}
+	n, err := w.out.Write(p)
+	if err != nil && w.err == nil {
+		w.err = err
+	}
+	return n, err
+}
@@ -0,0 +1,356 @@
+// Package fieldcrypt encrypts sensitive columns, such as IBANs and receipt
+// files, with AES-256-GCM before they reach the database. Values name the
+// key they were sealed with, so keys can be rotated: the first key of a
+// Keyring seals, and every key opens. Values are bound to the table, column
+// and row they are stored in, so a sealed value copied elsewhere does not
+// open. Values written before encryption was turned on are read as they
+// are.
+package fieldcrypt
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// ErrNoKey is returned when a value was sealed with a key the keyring does
+// not hold, or when there is no keyring at all.
+var ErrNoKey = errors.New("fieldcrypt: value is sealed with an unknown key")
+
+// ErrUnbound is returned when a value was sealed before values were bound
+// to their field, and has not been sealed again since; see Reseal.
+var ErrUnbound = errors.New("fieldcrypt: value is not bound to its field")
+
+// Sealed strings are StringMarker, the key ID, a colon and the base64 of
+// nonce and ciphertext. Sealed bytes start with BytesMarker, whose zero
+// byte no PDF, PNG or JPEG file starts with, then the key ID, a colon,
+// nonce and ciphertext. Values sealed before they were bound to their
+// field start with the unbound markers instead.
+const (
+	StringMarker = "enc2:"
+	BytesMarker  = "\x00enc2:"
+
+	UnboundStringMarker = "enc:"
+	UnboundBytesMarker  = "\x00enc:"
+)
+
+// Field is where a value is stored: its table, its column and the key of
+// its row. A value is sealed for one field and opens only there.
+type Field struct {
+	Table, Column string
+	Row           int
+}
+
+// aad is the additional data a value of f is sealed with. Table and column
+// names hold no zero bytes, so no two fields share it.
+func (f Field) aad() []byte {
+	return []byte(f.Table + "\x00" + f.Column + "\x00" + strconv.Itoa(f.Row))
+}
+
+var keyIDPattern = regexp.MustCompile(`^[A-Za-z0-9_-]{1,32}$`)
+
+// Key is an AES-256 key and the ID values sealed with it carry.
+type Key struct {
+	ID     string
+	Secret []byte // 32 bytes
+}
+
+// ParseKey reads a key written as "<id>:<32 bytes in base64>", e.g. as
+// generated with `echo "k1:$(openssl rand -base64 32)"`.
+func ParseKey(spec string) (Key, error) {
+	id, secret, ok := strings.Cut(strings.TrimSpace(spec), ":")
+	if !ok {
+		return Key{}, errors.New("fieldcrypt: a key must be written as id:base64")
+	}
+	if !keyIDPattern.MatchString(id) {
+		return Key{}, fmt.Errorf("fieldcrypt: key ID %q must be 1 to 32 letters, digits, - or _", id)
+	}
+	b, err := base64.StdEncoding.DecodeString(secret)
+	if err != nil {
+		return Key{}, fmt.Errorf("fieldcrypt: key %s is not valid base64", id)
+	}
+	if len(b) != 32 {
+		return Key{}, fmt.Errorf("fieldcrypt: key %s must be 32 bytes, not %d", id, len(b))
+	}
+	return Key{ID: id, Secret: b}, nil
+}
+
+// Keyring seals with its first key and opens with any. A nil Keyring
+// stores values in the clear and opens only those.
+type Keyring struct {
+	primary string
+	aeads   map[string]cipher.AEAD
+}
+
+// New returns a keyring sealing with keys[0].
+func New(keys ...Key) (*Keyring, error) {
+	if len(keys) == 0 {
+		return nil, errors.New("fieldcrypt: no keys")
+	}
+	k := &Keyring{primary: keys[0].ID, aeads: map[string]cipher.AEAD{}}
+	for _, key := range keys {
+		if _, dup := k.aeads[key.ID]; dup {
+			return nil, fmt.Errorf("fieldcrypt: key ID %s is used twice", key.ID)
+		}
+		block, err := aes.NewCipher(key.Secret)
+		if err != nil {
+			return nil, fmt.Errorf("fieldcrypt: key %s: %w", key.ID, err)
+		}
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			return nil, err
+		}
+		k.aeads[key.ID] = aead
+	}
+	return k, nil
+}
+
+// KeyID is the ID of the key the keyring seals with.
+func (k *Keyring) KeyID() string {
+	return k.primary
+}
+
+// StringPrefix starts every string the keyring seals, for finding values
+// that are in the clear or sealed with an older key.
+func (k *Keyring) StringPrefix() string {
+	return StringMarker + k.primary + ":"
+}
+
+// BytesPrefix is StringPrefix for sealed bytes.
+func (k *Keyring) BytesPrefix() []byte {
+	return []byte(BytesMarker + k.primary + ":")
+}
+
+func (k *Keyring) seal(plaintext, aad []byte) ([]byte, error) {
+	aead := k.aeads[k.primary]
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, plaintext, aad), nil
+}
+
+// open opens a value sealed with key id and aad, which is nil for unbound
+// values.
+func (k *Keyring) open(id string, sealed, aad []byte) ([]byte, error) {
+	if k == nil {
+		return nil, ErrNoKey
+	}
+	aead, ok := k.aeads[id]
+	if !ok {
+		return nil, ErrNoKey
+	}
+	if len(sealed) < aead.NonceSize() {
+		return nil, errors.New("fieldcrypt: sealed value is truncated")
+	}
+	nonce, ciphertext := sealed[:aead.NonceSize()], sealed[aead.NonceSize():]
+	plaintext, err := aead.Open(nil, nonce, ciphertext, aad)
+	if err != nil {
+		return nil, fmt.Errorf("fieldcrypt: value sealed with key %s does not open: %w", id, err)
+	}
+	return plaintext, nil
+}
+
+// EncryptString seals s for f. Empty strings stay empty, so that checks
+// for a missing value keep working in SQL.
+func (k *Keyring) EncryptString(f Field, s string) (string, error) {
+	if k == nil || s == "" {
+		return s, nil
+	}
+	sealed, err := k.seal([]byte(s), f.aad())
+	if err != nil {
+		return "", err
+	}
+	return k.StringPrefix() + base64.RawStdEncoding.EncodeToString(sealed), nil
+}
+
+// DecryptString opens a string EncryptString sealed for f, and returns any
+// other as it is. Unbound values are an ErrUnbound.
+func (k *Keyring) DecryptString(f Field, s string) (string, error) {
+	if strings.HasPrefix(s, UnboundStringMarker) {
+		return "", ErrUnbound
+	}
+	return k.decryptString(s, StringMarker, f.aad())
+}
+
+func (k *Keyring) decryptString(s, marker string, aad []byte) (string, error) {
+	rest, ok := strings.CutPrefix(s, marker)
+	if !ok {
+		return s, nil
+	}
+	id, encoded, ok := strings.Cut(rest, ":")
+	if !ok {
+		return s, nil
+	}
+	sealed, err := base64.RawStdEncoding.DecodeString(encoded)
+	if err != nil {
+		return "", errors.New("fieldcrypt: sealed value is not valid base64")
+	}
+	plaintext, err := k.open(id, sealed, aad)
+	return string(plaintext), err
+}
+
+// Encrypt seals b for f. Empty values stay empty.
+func (k *Keyring) Encrypt(f Field, b []byte) ([]byte, error) {
+	if k == nil || len(b) == 0 {
+		return b, nil
+	}
+	sealed, err := k.seal(b, f.aad())
+	if err != nil {
+		return nil, err
+	}
+	return append(k.BytesPrefix(), sealed...), nil
+}
+
+// Decrypt opens bytes Encrypt sealed for f, and returns any others as they
+// are. Unbound values are an ErrUnbound.
+func (k *Keyring) Decrypt(f Field, b []byte) ([]byte, error) {
+	if bytes.HasPrefix(b, []byte(UnboundBytesMarker)) {
+		return nil, ErrUnbound
+	}
+	return k.decrypt(b, BytesMarker, f.aad())
+}
+
+func (k *Keyring) decrypt(b []byte, marker string, aad []byte) ([]byte, error) {
+	rest, ok := bytes.CutPrefix(b, []byte(marker))
+	if !ok {
+		return b, nil
+	}
+	id, sealed, ok := bytes.Cut(rest, []byte(":"))
+	if !ok {
+		return b, nil
+	}
+	return k.open(string(id), sealed, aad)
+}
+
+// ResealString opens a string of f that is in the clear, unbound, or
+// sealed with any key, and seals it for f with the first key. It brings
+// stored values up to date; reads go through DecryptString.
+func (k *Keyring) ResealString(f Field, s string) (string, error) {
+	var plaintext string
+	var err error
+	if strings.HasPrefix(s, UnboundStringMarker) {
+		plaintext, err = k.decryptString(s, UnboundStringMarker, nil)
+	} else {
+		plaintext, err = k.DecryptString(f, s)
+	}
+	if err != nil {
+		return "", err
+	}
+	return k.EncryptString(f, plaintext)
+}
+
+// Reseal is ResealString for bytes.
+func (k *Keyring) Reseal(f Field, b []byte) ([]byte, error) {
+	var plaintext []byte
+	var err error
+	if bytes.HasPrefix(b, []byte(UnboundBytesMarker)) {
+		plaintext, err = k.decrypt(b, UnboundBytesMarker, nil)
+	} else {
+		plaintext, err = k.Decrypt(f, b)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return k.Encrypt(f, plaintext)
+}
+
+// Seal is s as a query argument for f, encrypted when it is sent.
+func (k *Keyring) Seal(f Field, s string) driver.Valuer {
+	return sealedString{k, f, s}
+}
+
+// SealBytes is b as a query argument for f, encrypted when it is sent.
+func (k *Keyring) SealBytes(f Field, b []byte) driver.Valuer {
+	return sealedBytes{k, f, b}
+}
+
+// Open is a scan target decrypting a text column of f into dst. NULL scans
+// as the empty string.
+func (k *Keyring) Open(f Field, dst *string) sql.Scanner {
+	return openString{k, f, dst}
+}
+
+// OpenBytes is a scan target decrypting a bytea column of f into dst.
+func (k *Keyring) OpenBytes(f Field, dst *[]byte) sql.Scanner {
+	return openBytes{k, f, dst}
+}
+
+type sealedString struct {
+	k *Keyring
+	f Field
+	s string
+}
+
+func (v sealedString) Value() (driver.Value, error) {
+	return v.k.EncryptString(v.f, v.s)
+}
+
+type sealedBytes struct {
+	k *Keyring
+	f Field
+	b []byte
+}
+
+func (v sealedBytes) Value() (driver.Value, error) {
+	return v.k.Encrypt(v.f, v.b)
+}
+
+type openString struct {
+	k   *Keyring
+	f   Field
+	dst *string
+}
+
+func (t openString) Scan(src any) error {
+	var s string
+	switch v := src.(type) {
+	case nil:
+	case string:
+		s = v
+	case []byte:
+		s = string(v)
+	default:
+		return fmt.Errorf("fieldcrypt: cannot scan %T into a string", src)
+	}
+	plaintext, err := t.k.DecryptString(t.f, s)
+	if err != nil {
+		return err
+	}
+	*t.dst = plaintext
+	return nil
+}
+
+type openBytes struct {
+	k   *Keyring
+	f   Field
+	dst *[]byte
+}
+
+func (t openBytes) Scan(src any) error {
+	var b []byte
+	switch v := src.(type) {
+	case nil:
+	case []byte:
+		b = bytes.Clone(v)
+	case string:
+		b = []byte(v)
+	default:
+		return fmt.Errorf("fieldcrypt: cannot scan %T into bytes", src)
+	}
+	plaintext, err := t.k.Decrypt(t.f, b)
+	if err != nil {
+		return err
+	}
+	*t.dst = plaintext
+	return nil
+}
@@ -0,0 +1,229 @@
+package fieldcrypt
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func testKey(t *testing.T, id string, fill byte) Key {
+	t.Helper()
+	key, err := ParseKey(id + ":" + base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{fill}, 32)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func testKeyring(t *testing.T, keys ...Key) *Keyring {
+	t.Helper()
+	k, err := New(keys...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return k
+}
+
+var iban = Field{Table: "vendor", Column: "iban", Row: 7}
+
+func TestParseKey(t *testing.T) {
+	secret := base64.StdEncoding.EncodeToString(make([]byte, 32))
+	tests := []struct {
+		spec string
+		ok   bool
+	}{
+		{"k1:" + secret, true},
+		{" k1:" + secret + "\n", true},
+		{secret, false},
+		{"k 1:" + secret, false},
+		{"k1:not base64", false},
+		{"k1:" + base64.StdEncoding.EncodeToString(make([]byte, 16)), false},
+	}
+	for _, tc := range tests {
+		if _, err := ParseKey(tc.spec); (err == nil) != tc.ok {
+			t.Errorf("ParseKey(%q) = %v, want ok %v", tc.spec, err, tc.ok)
+		}
+	}
+}
+
+func TestRoundTrip(t *testing.T) {
+	k := testKeyring(t, testKey(t, "k1", 1))
+
+	sealed, err := k.EncryptString(iban, "DE89370400440532013000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(sealed, "enc2:k1:") || strings.Contains(sealed, "DE89") {
+		t.Errorf("sealed %q", sealed)
+	}
+	if got, err := k.DecryptString(iban, sealed); err != nil || got != "DE89370400440532013000" {
+		t.Errorf("DecryptString = %q, %v", got, err)
+	}
+
+	receipt := Field{Table: "expense_attachment", Column: "data", Row: 3}
+	data := []byte("%PDF-1.4 receipt")
+	sealedData, err := k.Encrypt(receipt, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasPrefix(sealedData, k.BytesPrefix()) {
+		t.Errorf("sealed bytes start with %q", sealedData[:8])
+	}
+	if got, err := k.Decrypt(receipt, sealedData); err != nil || !bytes.Equal(got, data) {
+		t.Errorf("Decrypt = %q, %v", got, err)
+	}
+
+	// Empty values stay empty, and values in the clear are read as they are
+	if sealed, _ := k.EncryptString(iban, ""); sealed != "" {
+		t.Errorf("sealed the empty string as %q", sealed)
+	}
+	if got, err := k.DecryptString(iban, "DE89370400440532013000"); err != nil || got != "DE89370400440532013000" {
+		t.Errorf("DecryptString of a clear value = %q, %v", got, err)
+	}
+
+	// Without a keyring values are stored in the clear
+	var none *Keyring
+	if got, err := none.EncryptString(iban, "DE89"); err != nil || got != "DE89" {
+		t.Errorf("nil keyring sealed %q, %v", got, err)
+	}
+	if _, err := none.DecryptString(iban, sealed); !errors.Is(err, ErrNoKey) {
+		t.Errorf("nil keyring opened a sealed value: %v", err)
+	}
+}
+
+func TestScanAndValue(t *testing.T) {
+	k := testKeyring(t, testKey(t, "k1", 1))
+
+	v, err := k.Seal(iban, "DE89").Value()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got string
+	if err := k.Open(iban, &got).Scan([]byte(v.(string))); err != nil || got != "DE89" {
+		t.Errorf("Open scanned %q, %v", got, err)
+	}
+	got = "stale"
+	if err := k.Open(iban, &got).Scan(nil); err != nil || got != "" {
+		t.Errorf("Open scanned NULL as %q, %v", got, err)
+	}
+}
+
+func TestKeyRotation(t *testing.T) {
+	old, current := testKey(t, "k1", 1), testKey(t, "k2", 2)
+	before := testKeyring(t, old)
+	sealed, err := before.EncryptString(iban, "DE89")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	after := testKeyring(t, current, old)
+	if got, err := after.DecryptString(iban, sealed); err != nil || got != "DE89" {
+		t.Errorf("the old key no longer opens: %q, %v", got, err)
+	}
+	resealed, err := after.ResealString(iban, sealed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(resealed, after.StringPrefix()) {
+		t.Errorf("resealed as %q, want it under %s", resealed, after.KeyID())
+	}
+
+	// Once the old key is dropped only resealed values open
+	latest := testKeyring(t, current)
+	if got, err := latest.DecryptString(iban, resealed); err != nil || got != "DE89" {
+		t.Errorf("DecryptString = %q, %v", got, err)
+	}
+	if _, err := latest.DecryptString(iban, sealed); !errors.Is(err, ErrNoKey) {
+		t.Errorf("a value under a dropped key gave %v, want ErrNoKey", err)
+	}
+
+	if _, err := New(old, old); err == nil {
+		t.Error("a keyring took the same key ID twice")
+	}
+}
+
+func TestWrongKey(t *testing.T) {
+	sealed, err := testKeyring(t, testKey(t, "k1", 1)).EncryptString(iban, "DE89")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Same ID, other secret
+	if _, err := testKeyring(t, testKey(t, "k1", 9)).DecryptString(iban, sealed); err == nil || errors.Is(err, ErrNoKey) {
+		t.Errorf("another secret gave %v, want a failure to open", err)
+	}
+	if _, err := testKeyring(t, testKey(t, "k2", 1)).DecryptString(iban, sealed); !errors.Is(err, ErrNoKey) {
+		t.Errorf("an unknown key ID gave %v, want ErrNoKey", err)
+	}
+}
+
+func TestTamper(t *testing.T) {
+	k := testKeyring(t, testKey(t, "k1", 1))
+	sealed, err := k.EncryptString(iban, "DE89")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	raw, err := base64.RawStdEncoding.DecodeString(strings.TrimPrefix(sealed, k.StringPrefix()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw[len(raw)-1] ^= 1
+	flipped := k.StringPrefix() + base64.RawStdEncoding.EncodeToString(raw)
+	if _, err := k.DecryptString(iban, flipped); err == nil {
+		t.Error("a changed ciphertext opened")
+	}
+	if _, err := k.DecryptString(iban, k.StringPrefix()+"AAAA"); err == nil {
+		t.Error("a truncated value opened")
+	}
+
+	// A value copied to another row or column does not open there
+	for _, f := range []Field{
+		{Table: "vendor", Column: "iban", Row: 8},
+		{Table: "vendor", Column: "bic", Row: 7},
+		{Table: "bank_account", Column: "iban", Row: 7},
+	} {
+		if _, err := k.DecryptString(f, sealed); err == nil {
+			t.Errorf("the value of %+v opened as %+v", iban, f)
+		}
+	}
+}
+
+func TestUnbound(t *testing.T) {
+	k := testKeyring(t, testKey(t, "k1", 1))
+	// As sealed before values were bound to their field
+	raw, err := k.seal([]byte("DE89"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	unbound := UnboundStringMarker + "k1:" + base64.RawStdEncoding.EncodeToString(raw)
+
+	if _, err := k.DecryptString(iban, unbound); !errors.Is(err, ErrUnbound) {
+		t.Errorf("an unbound value gave %v, want ErrUnbound", err)
+	}
+	resealed, err := k.ResealString(iban, unbound)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := k.DecryptString(iban, resealed); err != nil || got != "DE89" {
+		t.Errorf("resealed value opened as %q, %v", got, err)
+	}
+
+	unboundBytes := append([]byte(UnboundBytesMarker+"k1:"), raw...)
+	if _, err := k.Decrypt(iban, unboundBytes); !errors.Is(err, ErrUnbound) {
+		t.Errorf("unbound bytes gave %v, want ErrUnbound", err)
+	}
+	resealedBytes, err := k.Reseal(iban, unboundBytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := k.Decrypt(iban, resealedBytes); err != nil || string(got) != "DE89" {
+		t.Errorf("resealed bytes opened as %q, %v", got, err)
+	}
+
+	// Values in the clear are sealed by Reseal too
+	if resealed, err := k.ResealString(iban, "DE89"); err != nil || !strings.HasPrefix(resealed, k.StringPrefix()) {
+		t.Errorf("ResealString of a clear value = %q, %v", resealed, err)
+	}
+}
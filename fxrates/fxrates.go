@@ -0,0 +1,148 @@
+// Package fxrates fetches daily reference exchange rates from public
+// providers.
+package fxrates
+
+import (
+	"context"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Quote is one day's rates against a base currency. Rates[c] is how many
+// units of the base currency one unit of c is worth.
+type Quote struct {
+	Date  time.Time
+	Rates map[string]float64
+}
+
+// Provider fetches the latest published rates. An error means the fetch may
+// be retried later.
+type Provider interface {
+	Name() string
+	Latest(ctx context.Context, base string) (Quote, error)
+}
+
+// rebase turns rates quoted as units of c per one unit of anchor into rates
+// against base. The anchor itself is worth 1.
+func rebase(anchor string, perAnchor map[string]float64, base string) (map[string]float64, error) {
+	perAnchor[anchor] = 1
+	inBase, ok := perAnchor[base]
+	if !ok || inBase <= 0 {
+		return nil, fmt.Errorf("no rate published for %s", base)
+	}
+	rates := map[string]float64{}
+	for code, rate := range perAnchor {
+		if code == base || rate <= 0 {
+			continue
+		}
+		rates[code] = inBase / rate
+	}
+	return rates, nil
+}
+
+func get(ctx context.Context, client *http.Client, url string) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		detail, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return nil, fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(detail)))
+	}
+	return io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+}
+
+const ecbURL = "https://www.ecb.europa.eu/stats/eurofxref/eurofxref-daily.xml"
+
+// ECB reads the European Central Bank's euro foreign exchange reference
+// rates, published on TARGET working days around 16:00 CET.
+type ECB struct {
+	Client *http.Client // http.DefaultClient when nil
+}
+
+func (ECB) Name() string { return "ecb" }
+
+func (e ECB) Latest(ctx context.Context, base string) (Quote, error) {
+	body, err := get(ctx, e.Client, ecbURL)
+	if err != nil {
+		return Quote{}, fmt.Errorf("ecb: %w", err)
+	}
+
+	var doc struct {
+		Days []struct {
+			Time  string `xml:"time,attr"`
+			Rates []struct {
+				Currency string  `xml:"currency,attr"`
+				Rate     float64 `xml:"rate,attr"`
+			} `xml:"Cube"`
+		} `xml:"Cube>Cube"`
+	}
+	if err := xml.Unmarshal(body, &doc); err != nil {
+		return Quote{}, fmt.Errorf("ecb: %w", err)
+	}
+	if len(doc.Days) == 0 {
+		return Quote{}, fmt.Errorf("ecb: no rates in response")
+	}
+
+	day := doc.Days[0]
+	date, err := time.Parse(time.DateOnly, day.Time)
+	if err != nil {
+		return Quote{}, fmt.Errorf("ecb: %w", err)
+	}
+	perEuro := map[string]float64{}
+	for _, r := range day.Rates {
+		perEuro[r.Currency] = r.Rate
+	}
+	rates, err := rebase("EUR", perEuro, base)
+	if err != nil {
+		return Quote{}, fmt.Errorf("ecb: %w", err)
+	}
+	return Quote{Date: date, Rates: rates}, nil
+}
+
+const openExchangeRatesURL = "https://openexchangerates.org/api/latest.json"
+
+// OpenExchangeRates reads openexchangerates.org. Rates are requested against
+// USD, which every plan supports, and converted to the base locally.
+type OpenExchangeRates struct {
+	AppID  string
+	Client *http.Client // http.DefaultClient when nil
+}
+
+func (OpenExchangeRates) Name() string { return "openexchangerates" }
+
+func (o OpenExchangeRates) Latest(ctx context.Context, base string) (Quote, error) {
+	body, err := get(ctx, o.Client, openExchangeRatesURL+"?app_id="+url.QueryEscape(o.AppID))
+	if err != nil {
+		return Quote{}, fmt.Errorf("openexchangerates: %w", err)
+	}
+
+	var doc struct {
+		Timestamp int64              `json:"timestamp"`
+		Base      string             `json:"base"`
+		Rates     map[string]float64 `json:"rates"`
+	}
+	if err := json.Unmarshal(body, &doc); err != nil {
+		return Quote{}, fmt.Errorf("openexchangerates: %w", err)
+	}
+	rates, err := rebase(doc.Base, doc.Rates, base)
+	if err != nil {
+		return Quote{}, fmt.Errorf("openexchangerates: %w", err)
+	}
+	date := time.Unix(doc.Timestamp, 0).UTC()
+	return Quote{Date: time.Date(date.Year(), date.Month(), date.Day(), 0, 0, 0, 0, time.UTC), Rates: rates}, nil
+}
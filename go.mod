@@ -5,3 +5,18 @@ go 1.24.2
 require github.com/lib/pq v1.10.9
 
 require github.com/gorilla/mux v1.8.1
+
+require (
+	github.com/go-ldap/ldap/v3 v3.4.11
+	golang.org/x/crypto v0.36.0
+	golang.org/x/crypto v0.36.0
+	golang.org/x/term v0.32.0
+	gopkg.in/yaml.v3 v3.0.1
+)
+
+require (
+	github.com/Azure/go-ntlmssp v0.0.0-20221128193559-754e69321358 // indirect
+	github.com/go-asn1-ber/asn1-ber v1.5.8-0.20250403174932-29230038a667 // indirect
+	github.com/google/uuid v1.6.0 // indirect
+	golang.org/x/sys v0.33.0 // indirect
+)
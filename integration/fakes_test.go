@@ -0,0 +1,115 @@
+//go:build integration
+
+package integration
+
+import (
+	"context"
+	"errors"
+	"main/directory"
+	"main/oidc"
+	"main/server"
+	"net/url"
+	"sync"
+)
+
+// fakeDirectory stands in for LDAP in ldap.yaml. Names it does not know are
+// invalid credentials, so the other scenarios log in with local passwords.
+type fakeDirectory map[string]directoryAccount
+
+type directoryAccount struct {
+	password string
+	entry    directory.Entry
+	err      error // returned instead, as when the server is unreachable
+}
+
+func (d fakeDirectory) Authenticate(ctx context.Context, name, password string) (directory.Entry, error) {
+	account, ok := d[name]
+	if !ok {
+		return directory.Entry{}, directory.ErrInvalidCredentials
+	}
+	if account.err != nil {
+		return directory.Entry{}, account.err
+	}
+	if password == "" || password != account.password {
+		return directory.Entry{}, directory.ErrInvalidCredentials
+	}
+	return account.entry, nil
+}
+
+var testDirectory = fakeDirectory{
+	"dana": {password: "dana-ldap", entry: directory.Entry{
+		DN:         "uid=dana,ou=people,dc=example,dc=com",
+		Email:      "dana@example.com",
+		Groups:     []string{"cn=ems-managers,ou=groups,dc=example,dc=com"},
+		Attributes: map[string]string{"department": "Operations"},
+	}},
+	"erin": {password: "erin-ldap", entry: directory.Entry{
+		DN:         "uid=erin,ou=people,dc=example,dc=com",
+		Attributes: map[string]string{"department": "Warehouse"},
+	}},
+	"frank": {password: "frank-ldap", entry: directory.Entry{
+		DN:         "uid=frank,ou=people,dc=example,dc=com",
+		Attributes: map[string]string{"department": "Operations"},
+	}},
+	"gina": {err: errors.New("dial tcp: connection refused")},
+}
+
+var testDirectoryRules = server.ProvisioningRules{
+	Roles:         []server.GroupRule{{Group: "ems-managers", Value: string(server.Manager)}},
+	DefaultRole:   server.FieldPersonnel,
+	UnitAttribute: "department",
+}
+
+// fakeProvider stands in for the OpenID Connect provider in sso.yaml. Each
+// code signs in the user whose claims it maps to, once, and only with a
+// nonce the provider handed out.
+type fakeProvider struct {
+	claims map[string]oidc.Claims
+
+	mu     sync.Mutex
+	nonces map[string]bool
+}
+
+func (p *fakeProvider) AuthCodeURL(ctx context.Context, state, nonce, verifier string) (string, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.nonces == nil {
+		p.nonces = map[string]bool{}
+	}
+	p.nonces[nonce] = true
+	return "https://sso.example.com/auth?" + url.Values{"state": {state}, "nonce": {nonce}}.Encode(), nil
+}
+
+func (p *fakeProvider) Exchange(ctx context.Context, code, nonce, verifier string) (oidc.Claims, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	claims, ok := p.claims[code]
+	if !ok || !p.nonces[nonce] || verifier == "" {
+		return nil, errors.New("invalid_grant")
+	}
+	delete(p.nonces, nonce)
+	return claims, nil
+}
+
+func newTestProvider() *fakeProvider {
+	return &fakeProvider{claims: map[string]oidc.Claims{
+		"accountant-code": {
+			"iss": "https://sso.example.com", "sub": "1001",
+			"preferred_username": "hale", "email": "hale@example.com", "email_verified": true,
+			"groups": []any{"finance"},
+		},
+		"guest-code": {
+			"iss": "https://sso.example.com", "sub": "1002",
+			"preferred_username": "guest", "groups": []any{"visitors"},
+		},
+	}}
+}
+
+var testOIDCMapping = server.OIDCMapping{
+	NameClaim:   "preferred_username",
+	GroupsClaim: "groups",
+	Rules: server.ProvisioningRules{
+		Roles: []server.GroupRule{{Group: "finance", Value: string(server.Accounter)}},
+		Units: []server.GroupRule{{Group: "finance", Value: "Operations"}},
+	},
+}
@@ -0,0 +1,182 @@
+//go:build integration
+
+package integration
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io"
+	"main/app"
+	"main/config"
+	"main/rpc"
+	"main/server"
+	"net"
+	"net/http"
+	"strconv"
+	"testing"
+)
+
+// grpcClient calls the gRPC API over HTTP/2 without TLS, as the internal
+// services do.
+type grpcClient struct {
+	t      *testing.T
+	url    string
+	client *http.Client
+}
+
+func newGRPCClient(t *testing.T, s *server.Server) *grpcClient {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := app.NewGRPCServer(s, config.Default())
+	go srv.Serve(ln)
+	t.Cleanup(func() { srv.Close() })
+
+	var protocols http.Protocols
+	protocols.SetUnencryptedHTTP2(true)
+	return &grpcClient{
+		t:      t,
+		url:    "http://" + ln.Addr().String(),
+		client: &http.Client{Transport: &http.Transport{Protocols: &protocols}},
+	}
+}
+
+// call runs a unary method and returns its response message and status.
+func (c *grpcClient) call(method, token string, in []byte) ([]byte, rpc.Code) {
+	c.t.Helper()
+	body := make([]byte, 5, 5+len(in))
+	binary.BigEndian.PutUint32(body[1:], uint32(len(in)))
+	req, err := http.NewRequestWithContext(context.Background(), "POST", c.url+method, bytes.NewReader(append(body, in...)))
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "application/grpc")
+	req.Header.Set("TE", "trailers")
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		c.t.Fatalf("%s: %v", method, err)
+	}
+	defer resp.Body.Close()
+	out, err := io.ReadAll(resp.Body)
+	if err != nil {
+		c.t.Fatalf("%s: %v", method, err)
+	}
+	if resp.ProtoMajor != 2 {
+		c.t.Fatalf("%s was answered over %s", method, resp.Proto)
+	}
+
+	// A failed call answers with the status in its headers alone
+	status := resp.Header.Get("Grpc-Status")
+	if status == "" {
+		status = resp.Trailer.Get("Grpc-Status")
+	}
+	code, err := strconv.Atoi(status)
+	if err != nil {
+		c.t.Fatalf("%s answered without a status: %q", method, status)
+	}
+	if len(out) >= 5 {
+		out = out[5:]
+	}
+	return out, rpc.Code(code)
+}
+
+// TestGRPC calls the users service over HTTP/2 and checks it shares the
+// REST API's store and checks.
+func TestGRPC(t *testing.T) {
+	s := emptyServer(t, nil)
+	router := app.NewRouter(s)
+	ctx := context.Background()
+	if _, errs, err := s.CreateAdmin(ctx, server.User{Name: "root", UnitID: "Executive Management", Password: "root-password"}); err != nil || len(errs) > 0 {
+		t.Fatalf("Creating the Admin failed: %v %v", errs, err)
+	}
+	adminToken := login(t, router, "root", "root-password")
+	client := newGRPCClient(t, s)
+
+	var e rpc.Encoder
+	e.String(2, "pat")
+	e.String(3, "Executive Management")
+	e.String(4, string(server.FieldPersonnel))
+	e.String(5, "pat@example.com")
+	e.String(6, "pat-password")
+	newUser := e.Bytes()
+
+	if _, code := client.call("/ems.v1.UserService/CreateUser", "", newUser); code != rpc.Unauthenticated {
+		t.Errorf("An anonymous call answered %d, want Unauthenticated", code)
+	}
+
+	var invalid rpc.Encoder
+	invalid.String(2, "nobody")
+	invalid.String(3, "Warehouse")
+	invalid.String(4, string(server.FieldPersonnel))
+	if _, code := client.call("/ems.v1.UserService/CreateUser", adminToken, invalid.Bytes()); code != rpc.InvalidArgument {
+		t.Errorf("A user of no unit answered %d, want InvalidArgument", code)
+	}
+
+	out, code := client.call("/ems.v1.UserService/CreateUser", adminToken, newUser)
+	if code != rpc.OK {
+		t.Fatalf("Creating a user answered %d", code)
+	}
+	created := decodeTestUser(t, out)
+	if created.ID == 0 || created.Name != "pat" || created.RoleID != server.FieldPersonnel {
+		t.Errorf("Created %+v", created)
+	}
+
+	// The user is the REST API's too, and logs in with the password given
+	var got server.User
+	if code := call(t, router, "GET", "/users/"+strconv.Itoa(created.ID), adminToken, nil, &got); code != http.StatusOK || got.Email != "pat@example.com" {
+		t.Errorf("REST answered %d with %+v", code, got)
+	}
+	patToken := login(t, router, "pat", "pat-password")
+
+	var id rpc.Encoder
+	id.Int(1, int64(created.ID))
+	out, code = client.call("/ems.v1.UserService/GetUser", patToken, id.Bytes())
+	if code != rpc.OK {
+		t.Fatalf("Getting the user answered %d", code)
+	}
+	if fetched := decodeTestUser(t, out); fetched != created {
+		t.Errorf("Got %+v, want %+v", fetched, created)
+	}
+
+	if _, code := client.call("/ems.v1.UserService/DeleteUser", patToken, id.Bytes()); code != rpc.PermissionDenied {
+		t.Errorf("Personnel deleting a user answered %d, want PermissionDenied", code)
+	}
+	if _, code := client.call("/ems.v1.UserService/DeleteUser", adminToken, id.Bytes()); code != rpc.OK {
+		t.Errorf("Deleting the user answered %d", code)
+	}
+	if _, code := client.call("/ems.v1.UserService/GetUser", adminToken, id.Bytes()); code != rpc.NotFound {
+		t.Errorf("Getting a deleted user answered %d, want NotFound", code)
+	}
+}
+
+// decodeTestUser reads a User message of proto/ems.proto.
+func decodeTestUser(t *testing.T, in []byte) server.User {
+	t.Helper()
+	var u server.User
+	d := rpc.NewDecoder(in)
+	for d.Next() {
+		switch d.Field() {
+		case 1:
+			u.ID = int(d.Int())
+		case 2:
+			u.Name = d.String()
+		case 3:
+			u.UnitID = d.String()
+		case 4:
+			u.RoleID = server.UserRole(d.String())
+		case 5:
+			u.Email = d.String()
+		case 7:
+			u.Version = int(d.Int())
+		}
+	}
+	if err := d.Err(); err != nil {
+		t.Fatal("Decoding a user failed: ", err)
+	}
+	return u
+}
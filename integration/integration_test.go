@@ -0,0 +1,282 @@
+//go:build integration
+
+// Package integration replays the scenarios in ../scenarios and testdata
+// against the real router and a Postgres started in a container, e.g.
+//
+//	go test -tags integration ./integration
+//
+// Set INTEGRATION_POSTGRES_URL to use a running database instead; its
+// tables are emptied before every scenario. -update rewrites the golden
+// files from the responses.
+package integration
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"main/app"
+	"main/config"
+	"main/scenario"
+	"main/server"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+var update = flag.Bool("update", false, "rewrite golden files with the responses")
+
+var databaseURL string
+
+func TestMain(m *testing.M) {
+	flag.Parse()
+
+	databaseURL = os.Getenv("INTEGRATION_POSTGRES_URL")
+	stop := func() {}
+	if databaseURL == "" {
+		var err error
+		databaseURL, stop, err = startPostgres()
+		if err != nil {
+			log.Println("Starting Postgres failed:", err)
+			os.Exit(1)
+		}
+	}
+
+	code := m.Run()
+	stop()
+	os.Exit(code)
+}
+
+// startPostgres runs a throwaway Postgres container on a free local port
+// and returns its URL and a function removing it.
+func startPostgres() (string, func(), error) {
+	out, err := exec.Command("docker", "run", "--detach", "--rm",
+		"--env", "POSTGRES_PASSWORD=ems", "--env", "POSTGRES_DB=ems_test",
+		"--publish", "127.0.0.1::5432", "postgres:16").Output()
+	if err != nil {
+		return "", nil, fmt.Errorf("docker run: %w", err)
+	}
+	id := strings.TrimSpace(string(out))
+	stop := func() { exec.Command("docker", "rm", "--force", id).Run() }
+
+	out, err = exec.Command("docker", "port", id, "5432/tcp").Output()
+	if err != nil {
+		stop()
+		return "", nil, fmt.Errorf("docker port: %w", err)
+	}
+	addr, _, _ := strings.Cut(strings.TrimSpace(string(out)), "\n")
+	return "postgres://postgres:ems@" + addr + "/ems_test?sslmode=disable", stop, nil
+}
+
+// newServer starts the server the way main does, minus everything that
+// reaches outside the process. configure, if not nil, adjusts the
+// configuration first.
+func newServer(t *testing.T, configure func(*config.Config)) *server.Server {
+	cfg := config.Default()
+	cfg.DatabaseURL = databaseURL
+	cfg.JWTSecret = "integration"
+	cfg.DBConnectTimeout = time.Minute
+	cfg.RateLimitReads, cfg.RateLimitWrites = 0, 0
+	// Each scenario starts from emptied tables, which a cache would not see
+	cfg.ReferenceCacheTTL = 0
+	// IBANs and receipts go through field encryption, as they do in production
+	cfg.FieldEncryptionKeys = []string{"integration:" + base64.StdEncoding.EncodeToString(make([]byte, 32))}
+	// Payloads are kept, print jobs queue for a drop folder no worker
+	// empties, and the mail provider's webhook is on
+	cfg.PayloadRetentionDays = 30
+	cfg.PrintDropDir = t.TempDir()
+	cfg.InboundEmailToken = "integration-inbound"
+	if configure != nil {
+		configure(&cfg)
+	}
+	if err := cfg.Validate(); err != nil {
+		t.Fatal("Invalid configuration: ", err)
+	}
+
+	db, err := app.OpenDB(cfg)
+	if err != nil {
+		t.Fatal("Database unreachable: ", err)
+	}
+	t.Cleanup(func() { db.Close() })
+	// Reloading finds the configuration unchanged
+	reload := func() (config.Config, error) { return cfg, nil }
+	return app.NewServer(db, cfg, reload)
+}
+
+// emptyServer is newServer on tables emptied and created afresh, for the
+// tests that run outside a scenario.
+func emptyServer(t *testing.T, configure func(*config.Config)) *server.Server {
+	s := newServer(t, configure)
+	if err := scenario.Reset(context.Background(), s.DB); err != nil {
+		t.Fatal("Resetting the database failed: ", err)
+	}
+	app.CreateTables(s)
+	return s
+}
+
+// call sends a JSON request to handler, with token as the bearer token
+// unless it is empty, and decodes the response body into out unless it is
+// nil. It returns the status code.
+func call(t *testing.T, handler http.Handler, method, path, token string, body, out any) int {
+	t.Helper()
+	var reader io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		reader = bytes.NewReader(b)
+	}
+	r := httptest.NewRequest(method, path, reader)
+	r.Header.Set("Content-Type", "application/json")
+	if token != "" {
+		r.Header.Set("Authorization", "Bearer "+token)
+	}
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	if out != nil && w.Code < 300 {
+		if err := json.Unmarshal(w.Body.Bytes(), out); err != nil {
+			t.Fatalf("%s %s: decoding the response: %v", method, path, err)
+		}
+	}
+	return w.Code
+}
+
+// login logs a user in through handler and returns their access token.
+func login(t *testing.T, handler http.Handler, name, password string) string {
+	t.Helper()
+	var session struct{ Token string }
+	credentials := map[string]string{"name": name, "password": password}
+	if code := call(t, handler, "POST", "/login", "", credentials, &session); code != http.StatusOK {
+		t.Fatalf("Logging in as %s answered %d", name, code)
+	}
+	return session.Token
+}
+
+// unexercised lists the routes no scenario can call, and why. Every other
+// route must be called by at least one scenario.
+var unexercised = map[string]string{
+	"GET /events":                     "streams until the client disconnects",
+	"GET /units/{name}/budget_ticker": "streams until the client disconnects",
+}
+
+func TestScenarios(t *testing.T) {
+	s := newServer(t, nil)
+	s.Directory, s.DirectoryRules = testDirectory, testDirectoryRules
+	s.OIDC, s.OIDCMapping = newTestProvider(), testOIDCMapping
+	app.CreateTables(s)
+	coverage := newRouteCoverage(s.Routes())
+	router := coverage.wrap(app.NewRouter(s))
+
+	var paths []string
+	for _, pattern := range []string{"../scenarios/*.yaml", "testdata/*.yaml"} {
+		matches, err := filepath.Glob(pattern)
+		if err != nil {
+			t.Fatal(err)
+		}
+		paths = append(paths, matches...)
+	}
+
+	ctx := context.Background()
+	for _, path := range paths {
+		sc, err := scenario.Load(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sc.UpdateGolden = *update
+
+		t.Run(strings.TrimSuffix(filepath.Base(path), ".yaml"), func(t *testing.T) {
+			if err := scenario.Reset(ctx, s.DB); err != nil {
+				t.Fatal("Resetting the database failed: ", err)
+			}
+			// Recreates seed rows such as the base currency
+			app.CreateTables(s)
+			token, err := s.BootstrapSetup(ctx)
+			if err != nil {
+				t.Fatal("Issuing a setup token failed: ", err)
+			}
+			sc.Vars = map[string]any{"setupToken": token}
+
+			if err := scenario.Run(ctx, router, sc); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+
+	if t.Failed() {
+		return
+	}
+	var missed []string
+	for _, key := range coverage.missed() {
+		if _, ok := unexercised[key]; !ok {
+			missed = append(missed, key)
+		}
+	}
+	if len(missed) > 0 {
+		t.Errorf("%d routes are not exercised by any scenario:\n\t%s", len(missed), strings.Join(missed, "\n\t"))
+	}
+	for key := range unexercised {
+		if coverage.hit[key] {
+			t.Errorf("%s is exercised by a scenario; remove it from unexercised", key)
+		}
+	}
+}
+
+// routeCoverage records which routes the scenarios call.
+type routeCoverage struct {
+	routes  []server.Route
+	matcher *mux.Router
+
+	mu  sync.Mutex
+	hit map[string]bool
+}
+
+func newRouteCoverage(routes []server.Route) *routeCoverage {
+	c := &routeCoverage{routes: routes, matcher: mux.NewRouter(), hit: map[string]bool{}}
+	for _, route := range routes {
+		key := route.Method + " " + route.Path
+		c.matcher.Handle(route.Path, http.NotFoundHandler()).Methods(route.Method).Name(key)
+		if !route.Unversioned {
+			c.matcher.Handle(server.APIPrefix+route.Path, http.NotFoundHandler()).Methods(route.Method).Name(key)
+		}
+	}
+	return c
+}
+
+func (c *routeCoverage) wrap(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var match mux.RouteMatch
+		if c.matcher.Match(r, &match) && match.Route != nil {
+			c.mu.Lock()
+			c.hit[match.Route.GetName()] = true
+			c.mu.Unlock()
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (c *routeCoverage) missed() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var missed []string
+	for _, route := range c.routes {
+		if key := route.Method + " " + route.Path; !c.hit[key] {
+			missed = append(missed, key)
+		}
+	}
+	slices.Sort(missed)
+	return missed
+}
@@ -0,0 +1,101 @@
+//go:build integration
+
+package integration
+
+import (
+	"context"
+	"errors"
+	"main/app"
+	"main/server"
+	"net/http"
+	"testing"
+)
+
+// TestSeedDemo seeds an empty database as `main seed` does, and leaves one
+// that is in use alone.
+func TestSeedDemo(t *testing.T) {
+	s := emptyServer(t, nil)
+	router := app.NewRouter(s)
+	ctx := context.Background()
+
+	summary, err := server.SeedDemo(ctx, s.DB)
+	if err != nil {
+		t.Fatal("Seeding failed: ", err)
+	}
+	if summary.Units == 0 || summary.Users == 0 || summary.Budgets == 0 ||
+		summary.ExpenseRequests == 0 || summary.Activities == 0 || summary.Payments == 0 {
+		t.Errorf("Seeding created %+v, want some of everything", summary)
+	}
+
+	if _, err := server.SeedDemo(ctx, s.DB); !errors.Is(err, server.ErrNotEmpty) {
+		t.Errorf("Seeding again returned %v, want ErrNotEmpty", err)
+	}
+
+	// Demo users log in with the shared password
+	var users []server.User
+	token := login(t, router, "Demo Admin", "demo")
+	if code := call(t, router, "GET", "/users?name=Elif", token, nil, &users); code != http.StatusOK {
+		t.Fatalf("Listing users answered %d", code)
+	}
+	if len(users) != 1 || users[0].RoleID != server.Manager || users[0].UnitID != "Finance" {
+		t.Errorf("Finance's demo manager is %+v", users)
+	}
+	login(t, router, "Elif Yildiz", "demo")
+
+	var expenses []server.ExpenseRequest
+	if code := call(t, router, "GET", "/expense_requests?limit=10", token, nil, &expenses); code != http.StatusOK || len(expenses) != 10 {
+		t.Errorf("Listing seeded expense requests answered %d with %d", code, len(expenses))
+	}
+}
+
+// TestCreateAdmin creates the first Admin as `main create-admin` does, and
+// issues the operator token the export command calls the API with.
+func TestCreateAdmin(t *testing.T) {
+	s := emptyServer(t, nil)
+	router := app.NewRouter(s)
+	ctx := context.Background()
+
+	if _, err := s.OperatorToken(ctx); !errors.Is(err, server.ErrNoAdmin) {
+		t.Errorf("Operator token without an Admin returned %v, want ErrNoAdmin", err)
+	}
+
+	_, errs, err := s.CreateAdmin(ctx, server.User{Name: "root", UnitID: "Executive Management", Password: "short"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := errs["password"]; !ok || len(errs) != 1 {
+		t.Errorf("A short password gave %v, want a password error", errs)
+	}
+
+	admin, errs, err := s.CreateAdmin(ctx, server.User{Name: "root", UnitID: "Executive Management", Password: "root-password"})
+	if err != nil || len(errs) > 0 {
+		t.Fatalf("Creating the Admin failed: %v %v", errs, err)
+	}
+	if admin.ID == 0 || admin.RoleID != server.Admin {
+		t.Errorf("Created %+v, want an Admin", admin)
+	}
+
+	// Login looks users up by name, so an Admin's must be unique
+	_, errs, err = s.CreateAdmin(ctx, server.User{Name: "root", UnitID: "Executive Management", Password: "other-password"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := errs["name"]; !ok {
+		t.Errorf("A taken name gave %v, want a name error", errs)
+	}
+
+	login(t, router, "root", "root-password")
+
+	// With an Admin in place no setup token is issued
+	if token, err := s.BootstrapSetup(ctx); err != nil || token != "" {
+		t.Errorf("Setup after create-admin returned %q, %v", token, err)
+	}
+
+	token, err := s.OperatorToken(ctx)
+	if err != nil {
+		t.Fatal("Issuing an operator token failed: ", err)
+	}
+	if code := call(t, router, "GET", "/webhooks", token, nil, nil); code != http.StatusOK {
+		t.Errorf("The operator token answered %d on an Admin-only route", code)
+	}
+}
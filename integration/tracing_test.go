@@ -0,0 +1,163 @@
+//go:build integration
+
+package integration
+
+import (
+	"context"
+	"encoding/json"
+	"main/app"
+	"main/config"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// collectedSpan is the part of an exported OTLP span the test reads.
+type collectedSpan struct {
+	TraceID      string `json:"traceId"`
+	SpanID       string `json:"spanId"`
+	ParentSpanID string `json:"parentSpanId"`
+	Name         string `json:"name"`
+	Kind         int    `json:"kind"`
+	Attributes   []struct {
+		Key   string         `json:"key"`
+		Value map[string]any `json:"value"`
+	} `json:"attributes"`
+}
+
+func (s collectedSpan) attribute(key string) any {
+	for _, a := range s.Attributes {
+		if a.Key == key {
+			for _, v := range a.Value {
+				return v
+			}
+		}
+	}
+	return nil
+}
+
+// collector receives spans as an OpenTelemetry collector does over
+// OTLP/HTTP.
+type collector struct {
+	mu       sync.Mutex
+	services []string
+	spans    []collectedSpan
+}
+
+func (c *collector) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" || r.URL.Path != "/v1/traces" {
+		http.NotFound(w, r)
+		return
+	}
+	var export struct {
+		ResourceSpans []struct {
+			Resource struct {
+				Attributes []struct {
+					Key   string            `json:"key"`
+					Value map[string]string `json:"value"`
+				} `json:"attributes"`
+			} `json:"resource"`
+			ScopeSpans []struct {
+				Spans []collectedSpan `json:"spans"`
+			} `json:"scopeSpans"`
+		} `json:"resourceSpans"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&export); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, rs := range export.ResourceSpans {
+		for _, a := range rs.Resource.Attributes {
+			if a.Key == "service.name" {
+				c.services = append(c.services, a.Value["stringValue"])
+			}
+		}
+		for _, ss := range rs.ScopeSpans {
+			c.spans = append(c.spans, ss.Spans...)
+		}
+	}
+}
+
+// TestTracing continues a caller's trace through a request and its
+// queries, and exports the spans to the configured collector.
+func TestTracing(t *testing.T) {
+	spans := &collector{}
+	collectorServer := httptest.NewServer(spans)
+	defer collectorServer.Close()
+
+	s := emptyServer(t, func(cfg *config.Config) {
+		cfg.OTLPEndpoint = collectorServer.URL
+		cfg.TraceServiceName = "ems-integration"
+	})
+	router := app.NewRouter(s)
+
+	const traceID, parentID = "4bf92f3577b34da6a3ce929d0e0e4736", "00f067aa0ba902b7"
+	r := httptest.NewRequest("GET", "/units", nil)
+	r.Header.Set("traceparent", "00-"+traceID+"-"+parentID+"-01")
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("GET /units answered %d", w.Code)
+	}
+
+	// The caller did not sample this one, so nothing of it is recorded
+	r = httptest.NewRequest("GET", "/expense_categories", nil)
+	r.Header.Set("traceparent", "00-"+traceID+"-"+parentID+"-00")
+	router.ServeHTTP(httptest.NewRecorder(), r)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := s.Tracer.Shutdown(ctx); err != nil {
+		t.Fatal("Flushing the spans failed: ", err)
+	}
+
+	spans.mu.Lock()
+	defer spans.mu.Unlock()
+	for _, service := range spans.services {
+		if service != "ems-integration" {
+			t.Errorf("Spans were exported for service %q", service)
+		}
+	}
+	var request *collectedSpan
+	for i, span := range spans.spans {
+		if span.TraceID != traceID {
+			t.Errorf("Span %s is of trace %s, want the caller's", span.Name, span.TraceID)
+		}
+		if span.Kind == 2 {
+			if request != nil {
+				t.Errorf("Exported a second server span %s", span.Name)
+			}
+			request = &spans.spans[i]
+		}
+	}
+	if request == nil {
+		t.Fatalf("No server span among %+v", spans.spans)
+	}
+	if request.Name != "GET /units" || request.ParentSpanID != parentID {
+		t.Errorf("The request's span is %s under %s, want GET /units under the caller's", request.Name, request.ParentSpanID)
+	}
+	if code := request.attribute("http.response.status_code"); code != "200" {
+		t.Errorf("The request's span has status code %v", code)
+	}
+
+	queries := 0
+	for _, span := range spans.spans {
+		if span.Kind != 3 {
+			continue
+		}
+		queries++
+		if span.ParentSpanID != request.SpanID {
+			t.Errorf("Query span %s is under %s, want the request's", span.Name, span.ParentSpanID)
+		}
+		if span.attribute("db.system.name") != "postgresql" || span.attribute("db.query.text") == nil {
+			t.Errorf("Query span %s lacks its database attributes", span.Name)
+		}
+	}
+	if queries == 0 {
+		t.Error("The request's queries were not traced")
+	}
+}
@@ -0,0 +1,152 @@
+// Package mailer delivers plain-text email through SMTP or the SendGrid API.
+package mailer
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"net/smtp"
+	"strings"
+	"time"
+)
+
+type Message struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+// Sender delivers one message. An error means it may be retried.
+type Sender interface {
+	Send(ctx context.Context, m Message) error
+}
+
+// Checker is implemented by senders that can tell whether their server is
+// reachable without sending anything.
+type Checker interface {
+	Check(ctx context.Context) error
+}
+
+// SMTP sends through a relay such as a local MTA or a provider's submission
+// port. The connection is upgraded with STARTTLS when the server offers it;
+// credentials are only sent over TLS or to localhost.
+type SMTP struct {
+	Addr     string // host:port
+	Username string // empty for relays that need no authentication
+	Password string
+	From     string
+}
+
+func (s SMTP) Send(ctx context.Context, m Message) error {
+	host, _, err := net.SplitHostPort(s.Addr)
+	if err != nil {
+		return err
+	}
+	var auth smtp.Auth
+	if s.Username != "" {
+		auth = smtp.PlainAuth("", s.Username, s.Password, host)
+	}
+
+	// net/smtp has no context support; bound the exchange by the deadline
+	// instead so a stuck relay cannot hold the outbox forever
+	done := make(chan error, 1)
+	go func() {
+		done <- smtp.SendMail(s.Addr, auth, s.From, []string{m.To}, compose(s.From, m))
+	}()
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Check connects to the relay and reads its greeting.
+func (s SMTP) Check(ctx context.Context) error {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", s.Addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	host, _, _ := net.SplitHostPort(s.Addr)
+	c, err := smtp.NewClient(conn, host)
+	if err != nil {
+		return err
+	}
+	return c.Quit()
+}
+
+// compose renders m as an RFC 5322 message.
+func compose(from string, m Message) []byte {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "From: %s\r\n", from)
+	fmt.Fprintf(&b, "To: %s\r\n", m.To)
+	fmt.Fprintf(&b, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", m.Subject))
+	fmt.Fprintf(&b, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	b.WriteString("MIME-Version: 1.0\r\n")
+	b.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+	b.WriteString("Content-Transfer-Encoding: 8bit\r\n\r\n")
+	b.WriteString(strings.ReplaceAll(strings.ReplaceAll(m.Body, "\r\n", "\n"), "\n", "\r\n"))
+	return b.Bytes()
+}
+
+const sendGridURL = "https://api.sendgrid.com/v3/mail/send"
+
+// SendGrid sends through the SendGrid v3 API.
+type SendGrid struct {
+	APIKey string
+	From   string
+	Client *http.Client // http.DefaultClient when nil
+}
+
+func (s SendGrid) Send(ctx context.Context, m Message) error {
+	type address struct {
+		Email string `json:"email"`
+	}
+	type content struct {
+		Type  string `json:"type"`
+		Value string `json:"value"`
+	}
+	payload := map[string]any{
+		"personalizations": []map[string]any{{"to": []address{{Email: m.To}}}},
+		"from":             address{Email: s.From},
+		"subject":          m.Subject,
+		"content":          []content{{Type: "text/plain", Value: m.Body}},
+	}
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, sendGridURL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+s.APIKey)
+	req.Header.Set("Content-Type", "application/json")
+
+	client := s.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		detail, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("sendgrid: %s: %s", resp.Status, strings.TrimSpace(string(detail)))
+	}
+	return nil
+}
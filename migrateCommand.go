@@ -0,0 +1,60 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"log"
+	"main/app"
+	"main/server"
+)
+
+// migrate creates the tables and brings existing ones up to date, then
+// builds the query indexes, e.g. `main migrate`, so a deployment can
+// migrate before it starts new servers. serve does the same at startup.
+func migrate(args []string) int {
+	flags := flag.NewFlagSet("migrate", flag.ContinueOnError)
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+
+	s, code := commandServer(nil)
+	if s == nil {
+		return code
+	}
+	defer s.DB.Close()
+
+	app.CreateTables(s)
+	s.CreateQueryIndexes(context.Background())
+	log.Println("Migration finished")
+	return 0
+}
+
+// migrateStates rewrites activities stored with the old Payed and
+// PartiallyPayed spellings, e.g. `main migrate-states -batch 500`, and
+// returns the process exit code. It is safe to run while the server is up
+// and to run again.
+func migrateStates(args []string) int {
+	flags := flag.NewFlagSet("migrate-states", flag.ContinueOnError)
+	batch := flags.Int("batch", 1000, "rows rewritten per statement")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if *batch <= 0 {
+		log.Println("-batch must be positive")
+		return 2
+	}
+
+	s, code := commandServer(nil)
+	if s == nil {
+		return code
+	}
+	defer s.DB.Close()
+
+	migrated, err := server.MigrateLegacyStates(context.Background(), s.DB, *batch)
+	log.Printf("Rewrote %d expense activities", migrated)
+	if err != nil {
+		log.Println("Migration failed:", err)
+		return 1
+	}
+	return 0
+}
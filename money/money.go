@@ -0,0 +1,139 @@
+// Package money holds amounts of money as a whole number of cents, so that
+// sums and comparisons are exact. The database keeps them in NUMERIC
+// columns with two decimal places, and the API sends them as JSON numbers
+// with two decimals, as it always has.
+package money
+
+import (
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"math"
+	"math/big"
+	"strings"
+)
+
+// Amount is an amount of money in hundredths of its currency's unit.
+type Amount int64
+
+// Max is the largest amount the NUMERIC(15,2) amount columns hold.
+const Max Amount = 999_999_999_999_999
+
+// FromFloat rounds f, in currency units, to the nearest cent; halves round
+// away from zero. It is for figures computed with rates and ratios, never
+// for amounts a client or the database sent.
+func FromFloat(f float64) Amount {
+	return Amount(math.Round(f * 100))
+}
+
+// Float64 is the amount in currency units, for ratios and statistics.
+func (a Amount) Float64() float64 {
+	return float64(a) / 100
+}
+
+// Mul multiplies the amount by a rate or ratio, rounding to the nearest
+// cent.
+func (a Amount) Mul(f float64) Amount {
+	return Amount(math.Round(float64(a) * f))
+}
+
+// Parse reads a decimal amount such as "1234.5", "-0.07" or "1e3". Digits
+// past the cents round to the nearest cent, halves away from zero, as the
+// NUMERIC columns round them.
+func Parse(s string) (Amount, error) {
+	s = strings.TrimSpace(s)
+	if s == "" || strings.ContainsRune(s, '/') {
+		return 0, fmt.Errorf("money: invalid amount %q", s)
+	}
+	r, ok := new(big.Rat).SetString(s)
+	if !ok {
+		return 0, fmt.Errorf("money: invalid amount %q", s)
+	}
+	r.Mul(r, big.NewRat(100, 1))
+	// Round half away from zero: truncate |r| + 1/2
+	neg := r.Sign() < 0
+	r.Abs(r).Add(r, big.NewRat(1, 2))
+	cents := new(big.Int).Quo(r.Num(), r.Denom())
+	if !cents.IsInt64() {
+		return 0, fmt.Errorf("money: amount %q is out of range", s)
+	}
+	if neg {
+		return Amount(-cents.Int64()), nil
+	}
+	return Amount(cents.Int64()), nil
+}
+
+// String formats the amount with two decimals, e.g. "1234.50".
+func (a Amount) String() string {
+	sign := ""
+	cents := int64(a)
+	if cents < 0 {
+		sign = "-"
+		cents = -cents
+	}
+	return fmt.Sprintf("%s%d.%02d", sign, cents/100, cents%100)
+}
+
+func (a Amount) MarshalJSON() ([]byte, error) {
+	return []byte(a.String()), nil
+}
+
+func (a *Amount) UnmarshalJSON(b []byte) error {
+	if string(b) == "null" {
+		return nil
+	}
+	if len(b) == 0 || b[0] == '"' {
+		return errors.New("money: amount must be a JSON number")
+	}
+	v, err := Parse(string(b))
+	if err != nil {
+		return err
+	}
+	*a = v
+	return nil
+}
+
+// Scan reads a NUMERIC column, which the driver sends as text.
+func (a *Amount) Scan(src any) error {
+	switch v := src.(type) {
+	case []byte:
+		return a.parse(string(v))
+	case string:
+		return a.parse(v)
+	case int64:
+		*a = Amount(v * 100)
+		return nil
+	case float64:
+		*a = FromFloat(v)
+		return nil
+	}
+	return fmt.Errorf("money: cannot scan %T into an Amount", src)
+}
+
+func (a *Amount) parse(s string) error {
+	v, err := Parse(s)
+	if err != nil {
+		return err
+	}
+	*a = v
+	return nil
+}
+
+// Value sends the amount as decimal text, which NUMERIC takes exactly.
+func (a Amount) Value() (driver.Value, error) {
+	return a.String(), nil
+}
+
+// Round rounds the amount to the nearest multiple of step, halves away
+// from zero, e.g. to whole units with a step of 100. A step below a cent
+// leaves it unchanged.
+func (a Amount) Round(step Amount) Amount {
+	if step <= 1 {
+		return a
+	}
+	half := step / 2
+	if a < 0 {
+		return -((-a + half) / step * step)
+	}
+	return (a + half) / step * step
+}
@@ -0,0 +1,158 @@
+package money
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		in   string
+		want Amount
+		ok   bool
+	}{
+		{"0", 0, true},
+		{"1234.5", 123450, true},
+		{" 12.34 ", 1234, true},
+		{"-0.07", -7, true},
+		{"0.005", 1, true},
+		{"0.0049", 0, true},
+		{"2.675", 268, true},
+		{"-0.005", -1, true},
+		{"-2.675", -268, true},
+		{"1e3", 100000, true},
+		{"1.5E2", 15000, true},
+		{"1e-2", 1, true},
+		{"-2.5e-3", 0, true},
+		// Amounts past Max are for validation to refuse; Parse only refuses
+		// what an Amount cannot hold
+		{"9999999999999.99", Max, true},
+		{"10000000000000", Max + 1, true},
+		{"92233720368547758.07", 9223372036854775807, true},
+		{"92233720368547758.08", 0, false},
+		{"1e20", 0, false},
+		{"", 0, false},
+		{"abc", 0, false},
+		{"1/3", 0, false},
+		{"1,5", 0, false},
+	}
+	for _, tc := range tests {
+		got, err := Parse(tc.in)
+		if (err == nil) != tc.ok {
+			t.Errorf("Parse(%q) error = %v, want ok %v", tc.in, err, tc.ok)
+			continue
+		}
+		if tc.ok && got != tc.want {
+			t.Errorf("Parse(%q) = %d, want %d", tc.in, got, tc.want)
+		}
+	}
+}
+
+func TestString(t *testing.T) {
+	tests := []struct {
+		in   Amount
+		want string
+	}{
+		{0, "0.00"},
+		{5, "0.05"},
+		{-7, "-0.07"},
+		{123450, "1234.50"},
+		{Max, "9999999999999.99"},
+	}
+	for _, tc := range tests {
+		if got := tc.in.String(); got != tc.want {
+			t.Errorf("Amount(%d).String() = %q, want %q", tc.in, got, tc.want)
+		}
+	}
+}
+
+func TestRound(t *testing.T) {
+	// The steps of a cent, ten cents, half a unit and a whole unit, as the
+	// rounding rules and budget rollover use them
+	tests := []struct {
+		in, step, want Amount
+	}{
+		{1234, 1, 1234},
+		{1234, 0, 1234},
+		{1234, 10, 1230},
+		{1235, 10, 1240},
+		{-1235, 10, -1240},
+		{1224, 50, 1200},
+		{1225, 50, 1250},
+		{1275, 50, 1300},
+		{-1225, 50, -1250},
+		{1249, 100, 1200},
+		{1250, 100, 1300},
+		{-1250, 100, -1300},
+		{-1249, 100, -1200},
+		{0, 100, 0},
+	}
+	for _, tc := range tests {
+		if got := tc.in.Round(tc.step); got != tc.want {
+			t.Errorf("Amount(%d).Round(%d) = %d, want %d", tc.in, tc.step, got, tc.want)
+		}
+	}
+}
+
+func TestScan(t *testing.T) {
+	tests := []struct {
+		src  any
+		want Amount
+		ok   bool
+	}{
+		{[]byte("1234.50"), 123450, true},
+		{"-0.07", -7, true},
+		{int64(12), 1200, true},
+		{int64(-3), -300, true},
+		{float64(12.345), 1235, true},
+		{float64(0.1) + float64(0.2), 30, true},
+		{"not a number", 0, false},
+		{nil, 0, false},
+		{true, 0, false},
+	}
+	for _, tc := range tests {
+		var got Amount
+		err := got.Scan(tc.src)
+		if (err == nil) != tc.ok {
+			t.Errorf("Scan(%#v) error = %v, want ok %v", tc.src, err, tc.ok)
+			continue
+		}
+		if tc.ok && got != tc.want {
+			t.Errorf("Scan(%#v) = %d, want %d", tc.src, got, tc.want)
+		}
+	}
+}
+
+func TestJSON(t *testing.T) {
+	b, err := json.Marshal(struct {
+		Amount Amount `json:"amount"`
+	}{123450})
+	if err != nil || string(b) != `{"amount":1234.50}` {
+		t.Errorf("Marshal = %s, %v", b, err)
+	}
+
+	tests := []struct {
+		in   string
+		want Amount
+		ok   bool
+	}{
+		{`1234.5`, 123450, true},
+		{`-0.07`, -7, true},
+		{`1e3`, 100000, true},
+		{`null`, 42, true},
+		{`"1234.5"`, 0, false},
+		{`""`, 0, false},
+		{`true`, 0, false},
+	}
+	for _, tc := range tests {
+		got := Amount(42)
+		err := json.Unmarshal([]byte(tc.in), &got)
+		if (err == nil) != tc.ok {
+			t.Errorf("Unmarshal(%s) error = %v, want ok %v", tc.in, err, tc.ok)
+			continue
+		}
+		if tc.ok && got != tc.want {
+			t.Errorf("Unmarshal(%s) = %d, want %d", tc.in, got, tc.want)
+		}
+	}
+}
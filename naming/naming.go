@@ -0,0 +1,42 @@
+// Package naming is the API's naming policy. JSON fields and query
+// parameters are named after the Go field they map to in lower camel case,
+// keeping initialisms whole: UnitID is unitID, SourceURL is sourceURL and
+// IncludeSubunits is includeSubunits. The json tags in the server package
+// are generated from Wire by cmd/jsontags.
+package naming
+
+import (
+	"strings"
+	"unicode"
+)
+
+// Wire is the JSON field or query parameter name of a Go field.
+func Wire(goName string) string {
+	r := []rune(goName)
+	// Lower the leading run of capitals, except for the one starting the
+	// next word: URLPath is urlPath, ID is id
+	n := 0
+	for n < len(r) && unicode.IsUpper(r[n]) {
+		n++
+	}
+	if n > 1 && n < len(r) {
+		n--
+	}
+	return strings.ToLower(string(r[:n])) + string(r[n:])
+}
+
+// Legacy is the snake_case name the API used for a query parameter before
+// the policy, e.g. unit_id for unitID and dry_run for dryRun.
+func Legacy(wire string) string {
+	var b strings.Builder
+	r := []rune(wire)
+	for i, c := range r {
+		// A capital starts a word unless it continues an initialism; the
+		// plural s of an initialism (expenseIDs) stays in its word
+		if unicode.IsUpper(c) && i > 0 && (!unicode.IsUpper(r[i-1]) || i+1 < len(r) && unicode.IsLower(r[i+1]) && r[i+1] != 's') {
+			b.WriteByte('_')
+		}
+		b.WriteRune(unicode.ToLower(c))
+	}
+	return b.String()
+}
@@ -0,0 +1,239 @@
+// Package pdf writes simple text-and-table A4 documents using the standard
+// Helvetica fonts, which every PDF reader ships, so no font files are needed.
+package pdf
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+)
+
+const (
+	pageWidth  = 595.28
+	pageHeight = 841.89
+	margin     = 50.0
+
+	bodySize = 10.0
+
+	// avgCharWidth approximates Helvetica's glyph width as a fraction of the
+	// font size. It is only used for wrapping and column truncation.
+	avgCharWidth = 0.52
+)
+
+// Document lays out content top to bottom, starting a new page when the
+// current one is full.
+type Document struct {
+	pages []*bytes.Buffer
+	y     float64
+}
+
+func New() *Document {
+	d := &Document{}
+	d.newPage()
+	return d
+}
+
+func (d *Document) newPage() {
+	d.pages = append(d.pages, &bytes.Buffer{})
+	d.y = pageHeight - margin
+}
+
+func (d *Document) page() *bytes.Buffer {
+	return d.pages[len(d.pages)-1]
+}
+
+// ensure starts a new page unless height points still fit on this one.
+func (d *Document) ensure(height float64) {
+	if d.y-height < margin {
+		d.newPage()
+	}
+}
+
+func (d *Document) text(x, size float64, bold bool, s string) {
+	font := "F1"
+	if bold {
+		font = "F2"
+	}
+	fmt.Fprintf(d.page(), "BT /%s %.1f Tf %.2f %.2f Td (%s) Tj ET\n", font, size, x, d.y, escape(s))
+}
+
+// Heading writes a large bold line.
+func (d *Document) Heading(s string) {
+	d.ensure(24)
+	d.y -= 18
+	d.text(margin, 16, true, s)
+	d.y -= 8
+}
+
+// Subheading writes a bold section title.
+func (d *Document) Subheading(s string) {
+	d.ensure(30)
+	d.y -= 18
+	d.text(margin, 12, true, s)
+	d.y -= 6
+}
+
+// Text writes a paragraph, wrapping it to the page width.
+func (d *Document) Text(s string) {
+	for _, line := range wrap(s, bodySize, pageWidth-2*margin) {
+		d.ensure(14)
+		d.y -= 14
+		d.text(margin, bodySize, false, line)
+	}
+}
+
+// Field writes a bold label followed by its value on one line.
+func (d *Document) Field(label, value string) {
+	d.ensure(14)
+	d.y -= 14
+	d.text(margin, bodySize, true, label)
+	d.text(margin+120, bodySize, false, value)
+}
+
+// Table writes a header row and rows. widths are fractions of the usable
+// page width; cells that do not fit are truncated. The header is repeated
+// on every page the table spans.
+func (d *Document) Table(widths []float64, header []string, rows [][]string) {
+	usable := pageWidth - 2*margin
+	row := func(cells []string, bold bool) {
+		x := margin
+		for i, cell := range cells {
+			width := widths[i] * usable
+			d.text(x, bodySize, bold, truncate(cell, bodySize, width-6))
+			x += width
+		}
+	}
+	writeHeader := func() {
+		d.y -= 14
+		row(header, true)
+		d.y -= 4
+		d.rule()
+	}
+
+	d.ensure(32)
+	writeHeader()
+	for _, cells := range rows {
+		if d.y-14 < margin {
+			d.newPage()
+			writeHeader()
+		}
+		d.y -= 14
+		row(cells, false)
+	}
+}
+
+// Space adds vertical space.
+func (d *Document) Space(points float64) {
+	d.y -= points
+}
+
+// SignatureLine draws a line to sign on with a caption underneath.
+func (d *Document) SignatureLine(caption string) {
+	d.ensure(50)
+	d.y -= 34
+	fmt.Fprintf(d.page(), "%.2f %.2f m %.2f %.2f l S\n", margin, d.y, margin+220, d.y)
+	d.y -= 12
+	d.text(margin, 8, false, caption)
+}
+
+func (d *Document) rule() {
+	fmt.Fprintf(d.page(), "0.5 w %.2f %.2f m %.2f %.2f l S 1 w\n", margin, d.y, pageWidth-margin, d.y)
+	d.y -= 2
+}
+
+// Bytes renders the document.
+func (d *Document) Bytes() []byte {
+	var out bytes.Buffer
+	offsets := []int{}
+	obj := func(body string) {
+		offsets = append(offsets, out.Len())
+		fmt.Fprintf(&out, "%d 0 obj\n%s\nendobj\n", len(offsets), body)
+	}
+
+	out.WriteString("%PDF-1.4\n%\xe2\xe3\xcf\xd3\n")
+
+	// Objects 1-4 are fixed; each page then takes a page and a content object
+	kids := make([]string, len(d.pages))
+	for i := range d.pages {
+		kids[i] = fmt.Sprintf("%d 0 R", 5+2*i)
+	}
+	obj("<< /Type /Catalog /Pages 2 0 R >>")
+	obj(fmt.Sprintf("<< /Type /Pages /Kids [%s] /Count %d >>", strings.Join(kids, " "), len(d.pages)))
+	obj("<< /Type /Font /Subtype /Type1 /BaseFont /Helvetica /Encoding /WinAnsiEncoding >>")
+	obj("<< /Type /Font /Subtype /Type1 /BaseFont /Helvetica-Bold /Encoding /WinAnsiEncoding >>")
+
+	for i, content := range d.pages {
+		footer := fmt.Sprintf("BT /F1 8 Tf %.2f %.2f Td (Page %d of %d) Tj ET\n", pageWidth-margin-50, margin/2, i+1, len(d.pages))
+		stream := content.String() + footer
+		obj(fmt.Sprintf("<< /Type /Page /Parent 2 0 R /MediaBox [0 0 %.2f %.2f] /Resources << /Font << /F1 3 0 R /F2 4 0 R >> >> /Contents %d 0 R >>",
+			pageWidth, pageHeight, 6+2*i))
+		obj(fmt.Sprintf("<< /Length %d >>\nstream\n%sendstream", len(stream), stream))
+	}
+
+	xref := out.Len()
+	fmt.Fprintf(&out, "xref\n0 %d\n0000000000 65535 f \n", len(offsets)+1)
+	for _, offset := range offsets {
+		fmt.Fprintf(&out, "%010d 00000 n \n", offset)
+	}
+	fmt.Fprintf(&out, "trailer\n<< /Size %d /Root 1 0 R >>\nstartxref\n%d\n%%%%EOF\n", len(offsets)+1, xref)
+	return out.Bytes()
+}
+
+// escape encodes s as the body of a PDF string in WinAnsiEncoding. Runes the
+// encoding cannot represent are replaced with '?'.
+func escape(s string) string {
+	var b strings.Builder
+	for _, r := range s {
+		switch {
+		case r == '(' || r == ')' || r == '\\':
+			b.WriteByte('\\')
+			b.WriteRune(r)
+		case r >= 0x20 && r < 0x7f:
+			b.WriteRune(r)
+		case r >= 0xa0 && r <= 0xff:
+			fmt.Fprintf(&b, "\\%03o", r)
+		case r == '€':
+			b.WriteString("\\200")
+		default:
+			b.WriteByte('?')
+		}
+	}
+	return b.String()
+}
+
+func maxChars(size, width float64) int {
+	return int(width / (size * avgCharWidth))
+}
+
+func truncate(s string, size, width float64) string {
+	n := maxChars(size, width)
+	runes := []rune(s)
+	if len(runes) <= n {
+		return s
+	}
+	if n <= 3 {
+		return string(runes[:n])
+	}
+	return string(runes[:n-3]) + "..."
+}
+
+func wrap(s string, size, width float64) []string {
+	n := maxChars(size, width)
+	lines := []string{}
+	for _, paragraph := range strings.Split(s, "\n") {
+		line := ""
+		for _, word := range strings.Fields(paragraph) {
+			switch {
+			case line == "":
+				line = word
+			case len([]rune(line))+1+len([]rune(word)) <= n:
+				line += " " + word
+			default:
+				lines = append(lines, line)
+				line = word
+			}
+		}
+		lines = append(lines, truncate(line, size, width))
+	}
+	return lines
+}
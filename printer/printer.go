@@ -0,0 +1,151 @@
+// Package printer sends PDF documents to a network printer over IPP, or
+// drops them into a spool directory for a print server to pick up.
+package printer
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// Job is one document to print.
+type Job struct {
+	Name     string // shown in the printer's queue and used for the file name
+	User     string // who asked for the print
+	Document []byte // application/pdf
+}
+
+// Printer prints one job. An error means it may be retried.
+type Printer interface {
+	Print(ctx context.Context, job Job) error
+}
+
+// IPP prints with an IPP Print-Job request, which CUPS and most network
+// printers accept directly.
+type IPP struct {
+	URL    string       // e.g. ipp://printer.local/ipp/print; ipps:// for TLS
+	Client *http.Client // http.DefaultClient when nil
+}
+
+// IPP value tags and operation codes used by Print-Job.
+const (
+	ippOperationAttributes = 0x01
+	ippEndOfAttributes     = 0x03
+	ippName                = 0x42
+	ippURI                 = 0x45
+	ippCharset             = 0x47
+	ippNaturalLanguage     = 0x48
+	ippMimeMediaType       = 0x49
+	ippPrintJob            = 0x0002
+)
+
+func (p IPP) Print(ctx context.Context, job Job) error {
+	target, err := url.Parse(p.URL)
+	if err != nil {
+		return err
+	}
+	// IPP is carried over HTTP on port 631 unless the URL says otherwise
+	endpoint := *target
+	switch target.Scheme {
+	case "ipp":
+		endpoint.Scheme = "http"
+	case "ipps":
+		endpoint.Scheme = "https"
+	case "http", "https":
+	default:
+		return fmt.Errorf("unsupported printer URL scheme %q", target.Scheme)
+	}
+	if target.Port() == "" && (target.Scheme == "ipp" || target.Scheme == "ipps") {
+		endpoint.Host = target.Hostname() + ":631"
+	}
+
+	var body bytes.Buffer
+	body.Write([]byte{1, 1}) // IPP/1.1
+	binary.Write(&body, binary.BigEndian, uint16(ippPrintJob))
+	binary.Write(&body, binary.BigEndian, uint32(1)) // request-id
+	body.WriteByte(ippOperationAttributes)
+	ippAttribute(&body, ippCharset, "attributes-charset", "utf-8")
+	ippAttribute(&body, ippNaturalLanguage, "attributes-natural-language", "en")
+	ippAttribute(&body, ippURI, "printer-uri", p.URL)
+	ippAttribute(&body, ippName, "requesting-user-name", job.User)
+	ippAttribute(&body, ippName, "job-name", job.Name)
+	ippAttribute(&body, ippMimeMediaType, "document-format", "application/pdf")
+	body.WriteByte(ippEndOfAttributes)
+	body.Write(job.Document)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint.String(), &body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/ipp")
+
+	client := p.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("printer answered %s", resp.Status)
+	}
+
+	// The response starts with the version and the IPP status code, where
+	// anything from 0x0100 up is an error
+	var header [4]byte
+	if _, err := io.ReadFull(resp.Body, header[:]); err != nil {
+		return fmt.Errorf("reading printer response: %w", err)
+	}
+	if status := binary.BigEndian.Uint16(header[2:]); status >= 0x0100 {
+		return fmt.Errorf("printer refused the job with IPP status 0x%04x", status)
+	}
+	return nil
+}
+
+func ippAttribute(b *bytes.Buffer, tag byte, name, value string) {
+	b.WriteByte(tag)
+	binary.Write(b, binary.BigEndian, uint16(len(name)))
+	b.WriteString(name)
+	binary.Write(b, binary.BigEndian, uint16(len(value)))
+	b.WriteString(value)
+}
+
+// FileDrop writes each job as a PDF into Dir, for a print server or an
+// operator to print from. Files appear whole: they are written under a
+// temporary name first.
+type FileDrop struct {
+	Dir string
+}
+
+var unsafeFileChars = regexp.MustCompile(`[^A-Za-z0-9._-]+`)
+
+func (f FileDrop) Print(ctx context.Context, job Job) error {
+	name := strings.Trim(unsafeFileChars.ReplaceAllString(job.Name, "-"), "-.")
+	if name == "" {
+		name = "job"
+	}
+
+	tmp, err := os.CreateTemp(f.Dir, ".print-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(job.Document); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), filepath.Join(f.Dir, name+".pdf"))
+}
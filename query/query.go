@@ -0,0 +1,168 @@
+// Package query builds SQL statements for Postgres a piece at a time, so
+// optional filters, sorting and pagination compose without anyone counting
+// placeholders, and binds column lists to the struct fields they scan into.
+package query
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Select is a SELECT statement under construction. Conditions are written
+// with ? for each argument; SQL numbers them $1, $2, ... in the order they
+// were added. Conditions must not contain a literal ?, but the columns,
+// FROM clause and sort terms may, e.g. for the jsonb ? operator.
+type Select struct {
+	columns string
+	from    string
+	where   []string
+	args    []any
+	orderBy []string
+	limit   int
+	offset  int
+}
+
+// From starts a statement selecting columns from a table, or from any
+// FROM clause such as a join.
+func From(from, columns string) *Select {
+	return &Select{columns: columns, from: from}
+}
+
+// Where adds a condition, joined to the others with AND. It panics when
+// the number of ? does not match args, which is always a programming error.
+func (q *Select) Where(condition string, args ...any) *Select {
+	if n := strings.Count(condition, "?"); n != len(args) {
+		panic(fmt.Sprintf("query: %q has %d placeholders for %d arguments", condition, n, len(args)))
+	}
+	q.where = append(q.where, condition)
+	q.args = append(q.args, args...)
+	return q
+}
+
+// WhereIf adds the condition only when ok, for optional filters.
+func (q *Select) WhereIf(ok bool, condition string, args ...any) *Select {
+	if ok {
+		q.Where(condition, args...)
+	}
+	return q
+}
+
+// OrderBy appends sort terms such as "created_at DESC".
+func (q *Select) OrderBy(terms ...string) *Select {
+	q.orderBy = append(q.orderBy, terms...)
+	return q
+}
+
+// Page limits the result to limit rows after skipping offset. A zero limit
+// returns every row.
+func (q *Select) Page(limit, offset int) *Select {
+	q.limit, q.offset = limit, offset
+	return q
+}
+
+// SQL returns the statement and its arguments.
+func (q *Select) SQL() (string, []any) {
+	var b strings.Builder
+	b.WriteString("SELECT " + q.columns + " FROM " + q.from)
+	// Capped, so that adding LIMIT and OFFSET never writes into q.args
+	args := Args(q.args[:len(q.args):len(q.args)])
+	if len(q.where) > 0 {
+		conditions := make([]string, len(q.where))
+		n := 0
+		for i, condition := range q.where {
+			conditions[i] = numbered(condition, &n)
+		}
+		b.WriteString(" WHERE " + strings.Join(conditions, " AND "))
+	}
+	if len(q.orderBy) > 0 {
+		b.WriteString(" ORDER BY " + strings.Join(q.orderBy, ", "))
+	}
+	if q.limit > 0 {
+		b.WriteString(" LIMIT " + args.Add(q.limit))
+	}
+	if q.offset > 0 {
+		b.WriteString(" OFFSET " + args.Add(q.offset))
+	}
+	return b.String(), args
+}
+
+// Args collects the arguments of a statement written by hand, handing out
+// the placeholder of each as it is added:
+//
+//	args := query.Args{year}
+//	filter := "year = $1 AND unit_id = " + args.Add(unitID)
+type Args []any
+
+// Add appends v and returns its placeholder.
+func (a *Args) Add(v any) string {
+	*a = append(*a, v)
+	return placeholder(len(*a))
+}
+
+// placeholder is the Postgres placeholder of the nth argument.
+func placeholder(n int) string {
+	return "$" + strconv.Itoa(n)
+}
+
+// numbered replaces each ? of a condition with the next Postgres
+// placeholder, counting on from n.
+func numbered(condition string, n *int) string {
+	var b strings.Builder
+	for _, r := range condition {
+		if r != '?' {
+			b.WriteRune(r)
+			continue
+		}
+		*n++
+		b.WriteString(placeholder(*n))
+	}
+	return b.String()
+}
+
+// Field binds a column to the struct field it is read into.
+type Field struct {
+	Column string
+	Target any // pointer passed to Scan
+}
+
+// Columns is the comma-separated column list of fields.
+func Columns(fields []Field) string {
+	columns := make([]string, len(fields))
+	for i, f := range fields {
+		columns[i] = f.Column
+	}
+	return strings.Join(columns, ", ")
+}
+
+// Targets are the Scan destinations of fields, in the order of Columns.
+func Targets(fields []Field) []any {
+	targets := make([]any, len(fields))
+	for i, f := range fields {
+		targets[i] = f.Target
+	}
+	return targets
+}
+
+// ParseSort turns a sort parameter such as "-createdAt,amount" into ORDER
+// BY terms. Each name must be a key of sortable, which maps the names
+// clients use to columns; a leading - sorts descending.
+func ParseSort(param string, sortable map[string]string) ([]string, error) {
+	var terms []string
+	for _, name := range strings.Split(param, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		direction := "ASC"
+		if rest, ok := strings.CutPrefix(name, "-"); ok {
+			name, direction = rest, "DESC"
+		}
+		column, ok := sortable[name]
+		if !ok {
+			return nil, fmt.Errorf("cannot sort by %q", name)
+		}
+		terms = append(terms, column+" "+direction)
+	}
+	return terms, nil
+}
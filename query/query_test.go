@@ -0,0 +1,126 @@
+package query
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSQL(t *testing.T) {
+	tests := []struct {
+		name string
+		q    *Select
+		want string
+		args []any
+	}{
+		{
+			name: "bare",
+			q:    From("users", "id, name"),
+			want: "SELECT id, name FROM users",
+		},
+		{
+			name: "conditions, sort and page",
+			q: From("expense_request", "id").
+				Where("unit_id = ?", "Sales").
+				WhereIf(false, "user_id = ?", 7).
+				Where("amount BETWEEN ? AND ?", 10, 20).
+				OrderBy("created_at DESC", "id").
+				Page(50, 100),
+			want: "SELECT id FROM expense_request WHERE unit_id = $1 AND amount BETWEEN $2 AND $3 ORDER BY created_at DESC, id LIMIT $4 OFFSET $5",
+			args: []any{"Sales", 10, 20, 50, 100},
+		},
+		{
+			name: "offset without a limit",
+			q:    From("users", "id").Page(0, 20),
+			want: "SELECT id FROM users OFFSET $1",
+			args: []any{20},
+		},
+		{
+			name: "a ? outside the conditions is left alone",
+			q: From("announcement a", "a.id, a.audience ? 'units'").
+				Where("a.created_by = ?", 3).
+				OrderBy("a.audience ? 'roles' DESC").
+				Page(10, 0),
+			want: "SELECT a.id, a.audience ? 'units' FROM announcement a WHERE a.created_by = $1 ORDER BY a.audience ? 'roles' DESC LIMIT $2",
+			args: []any{3, 10},
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			got, args := tc.q.SQL()
+			if got != tc.want {
+				t.Errorf("SQL() = %q, want %q", got, tc.want)
+			}
+			if len(args) != len(tc.args) || (len(args) > 0 && !reflect.DeepEqual(args, tc.args)) {
+				t.Errorf("args = %v, want %v", args, tc.args)
+			}
+		})
+	}
+}
+
+func TestSQLTwice(t *testing.T) {
+	q := From("users", "id").Where("unit_id = ?", "Sales").Page(10, 0)
+	first, _ := q.SQL()
+	second, args := q.SQL()
+	if first != second || len(args) != 2 {
+		t.Errorf("the second SQL() is %q with %v, want %q with 2 arguments", second, args, first)
+	}
+}
+
+func TestWherePanicsOnMismatch(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Error("Where took 2 placeholders for 1 argument")
+		}
+	}()
+	From("users", "id").Where("id = ? OR id = ?", 1)
+}
+
+func TestArgsAdd(t *testing.T) {
+	args := Args{2025}
+	filter := "year = $1 AND unit_id = " + args.Add("Sales") + " AND category = " + args.Add("Travel")
+	if want := "year = $1 AND unit_id = $2 AND category = $3"; filter != want {
+		t.Errorf("filter = %q, want %q", filter, want)
+	}
+	if want := (Args{2025, "Sales", "Travel"}); !reflect.DeepEqual(args, want) {
+		t.Errorf("args = %v, want %v", args, want)
+	}
+}
+
+func TestParseSort(t *testing.T) {
+	sortable := map[string]string{"name": "name", "createdAt": "created_at"}
+	tests := []struct {
+		param string
+		want  []string
+		ok    bool
+	}{
+		{"", nil, true},
+		{"name", []string{"name ASC"}, true},
+		{"-createdAt,name", []string{"created_at DESC", "name ASC"}, true},
+		{" name , ,-createdAt ", []string{"name ASC", "created_at DESC"}, true},
+		{"amount", nil, false},
+		{"created_at", nil, false},
+		{"--name", nil, false},
+	}
+	for _, tc := range tests {
+		got, err := ParseSort(tc.param, sortable)
+		if (err == nil) != tc.ok {
+			t.Errorf("ParseSort(%q) error = %v, want ok %v", tc.param, err, tc.ok)
+			continue
+		}
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("ParseSort(%q) = %q, want %q", tc.param, got, tc.want)
+		}
+	}
+}
+
+func TestColumnsAndTargets(t *testing.T) {
+	var id int
+	var name string
+	fields := []Field{{Column: "id", Target: &id}, {Column: "name", Target: &name}}
+	if got := Columns(fields); got != "id, name" {
+		t.Errorf("Columns = %q", got)
+	}
+	if got := Targets(fields); len(got) != 2 || got[0] != &id || got[1] != &name {
+		t.Errorf("Targets = %v", got)
+	}
+}
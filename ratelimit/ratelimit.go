@@ -0,0 +1,94 @@
+// Package ratelimit keeps token buckets for rate limiting, in memory for a
+// single instance or in Redis when several instances share the limits.
+package ratelimit
+
+import (
+	"context"
+	"math"
+	"sync"
+	"time"
+)
+
+// Limit is a token bucket: it holds up to Burst requests and refills at
+// Rate requests per second. A zero Rate means no limit.
+type Limit struct {
+	Rate  float64
+	Burst int
+}
+
+// PerMinute is a limit of n requests a minute with bursts of up to burst.
+func PerMinute(n, burst int) Limit {
+	return Limit{Rate: float64(n) / 60, Burst: burst}
+}
+
+// Result is the outcome of taking a token.
+type Result struct {
+	Allowed    bool
+	Remaining  int           // whole tokens left in the bucket
+	RetryAfter time.Duration // until the next token when not allowed
+}
+
+// Store takes tokens from buckets identified by key.
+type Store interface {
+	Take(ctx context.Context, key string, limit Limit) (Result, error)
+}
+
+// retryAfter is how long a bucket holding tokens takes to refill to one.
+func retryAfter(tokens float64, limit Limit) time.Duration {
+	return time.Duration(math.Ceil((1 - tokens) / limit.Rate * float64(time.Second)))
+}
+
+type bucket struct {
+	tokens float64
+	at     time.Time
+	full   time.Time // when the bucket will have refilled
+}
+
+// Memory keeps the buckets in this process. The zero value is ready to use.
+type Memory struct {
+	mu      sync.Mutex
+	buckets map[string]*bucket
+	swept   time.Time
+}
+
+// memorySweepInterval is how often full buckets are forgotten, so the map
+// does not grow with every address that ever called.
+const memorySweepInterval = time.Minute
+
+func (m *Memory) Take(ctx context.Context, key string, limit Limit) (Result, error) {
+	now := time.Now()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.buckets == nil {
+		m.buckets = map[string]*bucket{}
+		m.swept = now
+	}
+	if now.Sub(m.swept) > memorySweepInterval {
+		m.sweep(now)
+	}
+
+	b := m.buckets[key]
+	if b == nil {
+		b = &bucket{tokens: float64(limit.Burst), at: now}
+		m.buckets[key] = b
+	}
+	b.tokens = min(float64(limit.Burst), b.tokens+now.Sub(b.at).Seconds()*limit.Rate)
+	b.at = now
+	if b.tokens < 1 {
+		return Result{RetryAfter: retryAfter(b.tokens, limit)}, nil
+	}
+	b.tokens--
+	b.full = now.Add(time.Duration((float64(limit.Burst) - b.tokens) / limit.Rate * float64(time.Second)))
+	return Result{Allowed: true, Remaining: int(b.tokens)}, nil
+}
+
+// sweep drops the buckets that have refilled, since a fresh bucket is
+// indistinguishable from those.
+func (m *Memory) sweep(now time.Time) {
+	m.swept = now
+	for key, b := range m.buckets {
+		if now.After(b.full) {
+			delete(m.buckets, key)
+		}
+	}
+}
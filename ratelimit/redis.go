@@ -0,0 +1,74 @@
+package ratelimit
+
+import (
+	"context"
+	"fmt"
+	"main/redis"
+	"strconv"
+)
+
+// takeScript refills and takes from a bucket stored as a hash in one
+// atomic step, using the Redis clock so instances need not agree on time.
+// Idle buckets expire once they would have refilled.
+const takeScript = `
+local rate = tonumber(ARGV[1])
+local burst = tonumber(ARGV[2])
+local t = redis.call('TIME')
+local now = tonumber(t[1]) + tonumber(t[2]) / 1000000
+local b = redis.call('HMGET', KEYS[1], 'tokens', 'at')
+local tokens = tonumber(b[1]) or burst
+local at = tonumber(b[2]) or now
+tokens = math.min(burst, tokens + (now - at) * rate)
+local allowed = 0
+if tokens >= 1 then
+	tokens = tokens - 1
+	allowed = 1
+end
+redis.call('HSET', KEYS[1], 'tokens', tostring(tokens), 'at', tostring(now))
+redis.call('EXPIRE', KEYS[1], math.ceil((burst - tokens) / rate) + 1)
+return {allowed, tostring(tokens)}
+`
+
+// redisKeyPrefix keeps the buckets apart from anything else in the
+// database.
+const redisKeyPrefix = "ems:ratelimit:"
+
+// Redis keeps the buckets in Redis, so every instance of the server shares
+// them.
+type Redis struct {
+	client *redis.Client
+}
+
+// NewRedis connects to the server at rawURL, e.g.
+// redis://:password@localhost:6379/0. No connection is made until the first
+// Take.
+func NewRedis(rawURL string) (*Redis, error) {
+	client, err := redis.NewClient(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	return &Redis{client: client}, nil
+}
+
+func (r *Redis) Take(ctx context.Context, key string, limit Limit) (Result, error) {
+	reply, err := r.client.Do(ctx, "EVAL", takeScript, "1", redisKeyPrefix+key,
+		strconv.FormatFloat(limit.Rate, 'g', -1, 64), strconv.Itoa(limit.Burst))
+	if err != nil {
+		return Result{}, err
+	}
+
+	values, ok := reply.([]any)
+	if !ok || len(values) != 2 {
+		return Result{}, fmt.Errorf("unexpected redis reply %v", reply)
+	}
+	allowed, _ := values[0].(int64)
+	text, _ := values[1].(string)
+	tokens, err := strconv.ParseFloat(text, 64)
+	if err != nil {
+		return Result{}, fmt.Errorf("unexpected redis reply %v", reply)
+	}
+	if allowed != 1 {
+		return Result{RetryAfter: retryAfter(tokens, limit)}, nil
+	}
+	return Result{Allowed: true, Remaining: int(tokens)}, nil
+}
@@ -0,0 +1,232 @@
+package rpc
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Code is a gRPC status code.
+type Code int
+
+const (
+	OK                 Code = 0
+	Canceled           Code = 1
+	Unknown            Code = 2
+	InvalidArgument    Code = 3
+	DeadlineExceeded   Code = 4
+	NotFound           Code = 5
+	AlreadyExists      Code = 6
+	PermissionDenied   Code = 7
+	ResourceExhausted  Code = 8
+	FailedPrecondition Code = 9
+	Aborted            Code = 10
+	Unimplemented      Code = 12
+	Internal           Code = 13
+	Unavailable        Code = 14
+	Unauthenticated    Code = 16
+)
+
+// Status is the outcome of a failed call, as sent to the client.
+type Status struct {
+	Code    Code
+	Message string
+}
+
+func (s *Status) Error() string {
+	return fmt.Sprintf("rpc error: code = %d desc = %s", s.Code, s.Message)
+}
+
+// Errorf returns a *Status with code and a formatted message.
+func Errorf(code Code, format string, args ...any) error {
+	return &Status{Code: code, Message: fmt.Sprintf(format, args...)}
+}
+
+// maxMessageSize bounds a request message, as gRPC's default does.
+const maxMessageSize = 4 << 20
+
+// Handler runs one unary method with the encoded request message and
+// returns the encoded response. The request carries the call's metadata in
+// its headers. An error that is not a *Status is logged and sent as
+// Internal, so its detail stays on the server.
+type Handler func(ctx context.Context, r *http.Request, in []byte) ([]byte, error)
+
+// Server dispatches gRPC calls to the handlers of their methods. It is an
+// http.Handler for a server speaking HTTP/2, which gRPC requires; see
+// http.Protocols.SetUnencryptedHTTP2 for serving it without TLS.
+type Server struct {
+	methods map[string]Handler
+}
+
+func NewServer() *Server {
+	return &Server{methods: map[string]Handler{}}
+}
+
+// Register serves the method with its full name, e.g.
+// "/ems.v1.UserService/GetUser".
+func (s *Server) Register(method string, h Handler) {
+	s.methods[method] = h
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.ProtoMajor < 2 {
+		http.Error(w, "gRPC requires HTTP/2", http.StatusHTTPVersionNotSupported)
+		return
+	}
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	contentType := r.Header.Get("Content-Type")
+	if contentType != "application/grpc" && !strings.HasPrefix(contentType, "application/grpc+proto") &&
+		!strings.HasPrefix(contentType, "application/grpc;") {
+		http.Error(w, "Content-Type must be application/grpc", http.StatusUnsupportedMediaType)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/grpc")
+	out, err := s.call(r)
+	if err != nil {
+		// A trailers-only response: the status goes out with the headers
+		st := statusOf(r.URL.Path, err)
+		w.Header().Set("Grpc-Status", strconv.Itoa(int(st.Code)))
+		w.Header().Set("Grpc-Message", encodeMessage(st.Message))
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	w.Header().Set("Trailer", "Grpc-Status")
+	w.WriteHeader(http.StatusOK)
+	frame := make([]byte, 5, 5+len(out))
+	binary.BigEndian.PutUint32(frame[1:], uint32(len(out)))
+	if _, err := w.Write(append(frame, out...)); err != nil {
+		return
+	}
+	w.Header().Set("Grpc-Status", "0")
+}
+
+// call reads the request message and runs the method's handler with the
+// call's deadline.
+func (s *Server) call(r *http.Request) (out []byte, err error) {
+	handler, ok := s.methods[r.URL.Path]
+	if !ok {
+		return nil, Errorf(Unimplemented, "unknown method %s", r.URL.Path)
+	}
+	if encoding := r.Header.Get("Grpc-Encoding"); encoding != "" && encoding != "identity" {
+		return nil, Errorf(Unimplemented, "compression %s is not supported", encoding)
+	}
+
+	ctx := r.Context()
+	if timeout := r.Header.Get("Grpc-Timeout"); timeout != "" {
+		d, ok := parseTimeout(timeout)
+		if !ok {
+			return nil, Errorf(Internal, "malformed grpc-timeout %q", timeout)
+		}
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, d)
+		defer cancel()
+		r = r.WithContext(ctx)
+	}
+
+	in, err := readMessage(r.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	defer func() {
+		if p := recover(); p != nil {
+			log.Printf("gRPC %s panic: %v", r.URL.Path, p)
+			out, err = nil, Errorf(Internal, "internal error")
+		}
+	}()
+	out, err = handler(ctx, r, in)
+	if err != nil {
+		var st *Status
+		switch {
+		case errors.As(err, &st):
+		case errors.Is(ctx.Err(), context.DeadlineExceeded):
+			err = Errorf(DeadlineExceeded, "deadline exceeded")
+		case errors.Is(ctx.Err(), context.Canceled):
+			err = Errorf(Canceled, "call canceled")
+		}
+	}
+	return out, err
+}
+
+// readMessage reads the single length-prefixed message of a unary call.
+func readMessage(body io.Reader) ([]byte, error) {
+	var prefix [5]byte
+	if _, err := io.ReadFull(body, prefix[:]); err != nil {
+		return nil, Errorf(InvalidArgument, "reading the request message: %v", err)
+	}
+	if prefix[0] != 0 {
+		return nil, Errorf(Unimplemented, "compressed messages are not supported")
+	}
+	size := binary.BigEndian.Uint32(prefix[1:])
+	if size > maxMessageSize {
+		return nil, Errorf(ResourceExhausted, "request message is larger than %d bytes", maxMessageSize)
+	}
+	in := make([]byte, size)
+	if _, err := io.ReadFull(body, in); err != nil {
+		return nil, Errorf(InvalidArgument, "reading the request message: %v", err)
+	}
+	if n, _ := body.Read(prefix[:1]); n > 0 {
+		return nil, Errorf(InvalidArgument, "unary methods take one request message")
+	}
+	return in, nil
+}
+
+// statusOf is the status a method's error is sent with.
+func statusOf(method string, err error) *Status {
+	var st *Status
+	if errors.As(err, &st) {
+		return st
+	}
+	log.Printf("gRPC %s error: %v", method, err)
+	return &Status{Code: Internal, Message: "internal error"}
+}
+
+// parseTimeout reads a grpc-timeout value: at most eight digits and a unit.
+func parseTimeout(s string) (time.Duration, bool) {
+	if len(s) < 2 || len(s) > 9 {
+		return 0, false
+	}
+	n, err := strconv.ParseInt(s[:len(s)-1], 10, 64)
+	if err != nil || n < 0 {
+		return 0, false
+	}
+	units := map[byte]time.Duration{
+		'H': time.Hour, 'M': time.Minute, 'S': time.Second,
+		'm': time.Millisecond, 'u': time.Microsecond, 'n': time.Nanosecond,
+	}
+	unit, ok := units[s[len(s)-1]]
+	if !ok {
+		return 0, false
+	}
+	if unit > time.Second && n > int64(time.Duration(1<<63-1)/unit) {
+		return 1<<63 - 1, true
+	}
+	return time.Duration(n) * unit, true
+}
+
+// encodeMessage percent-encodes a status message for grpc-message, which
+// carries printable ASCII only.
+func encodeMessage(msg string) string {
+	var b strings.Builder
+	for i := 0; i < len(msg); i++ {
+		c := msg[i]
+		if c < ' ' || c > '~' || c == '%' {
+			fmt.Fprintf(&b, "%%%02X", c)
+		} else {
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,195 @@
+package rpc
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// frame prefixes a message as a unary call carries it.
+func frame(msg []byte) []byte {
+	b := make([]byte, 5, 5+len(msg))
+	binary.BigEndian.PutUint32(b[1:], uint32(len(msg)))
+	return append(b, msg...)
+}
+
+func newCall(method string, body []byte) *http.Request {
+	r := httptest.NewRequest("POST", method, bytes.NewReader(body))
+	r.ProtoMajor, r.ProtoMinor = 2, 0
+	r.Header.Set("Content-Type", "application/grpc")
+	return r
+}
+
+func testServer() *Server {
+	s := NewServer()
+	s.Register("/test.Echo/Echo", func(ctx context.Context, r *http.Request, in []byte) ([]byte, error) {
+		return in, nil
+	})
+	s.Register("/test.Echo/NotFound", func(ctx context.Context, r *http.Request, in []byte) ([]byte, error) {
+		return nil, Errorf(NotFound, "no such échantillon: 100%%")
+	})
+	s.Register("/test.Echo/Fail", func(ctx context.Context, r *http.Request, in []byte) ([]byte, error) {
+		return nil, errors.New(`pq: relation "secret_table" does not exist`)
+	})
+	s.Register("/test.Echo/Panic", func(ctx context.Context, r *http.Request, in []byte) ([]byte, error) {
+		panic("boom")
+	})
+	s.Register("/test.Echo/Slow", func(ctx context.Context, r *http.Request, in []byte) ([]byte, error) {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	})
+	return s
+}
+
+func TestServeUnary(t *testing.T) {
+	var e Encoder
+	e.String(1, "ping")
+	w := httptest.NewRecorder()
+	testServer().ServeHTTP(w, newCall("/test.Echo/Echo", frame(e.Bytes())))
+
+	res := w.Result()
+	if res.StatusCode != http.StatusOK || res.Header.Get("Content-Type") != "application/grpc" {
+		t.Fatalf("status %d, Content-Type %q", res.StatusCode, res.Header.Get("Content-Type"))
+	}
+	if got := res.Trailer.Get("Grpc-Status"); got != "0" {
+		t.Errorf("grpc-status trailer = %q, want 0", got)
+	}
+	if want := frame(e.Bytes()); !bytes.Equal(w.Body.Bytes(), want) {
+		t.Errorf("body % x, want % x", w.Body.Bytes(), want)
+	}
+}
+
+func TestServeErrors(t *testing.T) {
+	tests := []struct {
+		name        string
+		method      string
+		body        []byte
+		header      map[string]string
+		wantCode    Code
+		wantMessage string
+	}{
+		{"unknown method", "/test.Echo/Missing", frame(nil), nil, Unimplemented, "unknown method /test.Echo/Missing"},
+		{"status error", "/test.Echo/NotFound", frame(nil), nil, NotFound, "no such %C3%A9chantillon: 100%25"},
+		{"other error", "/test.Echo/Fail", frame(nil), nil, Internal, "internal error"},
+		{"panic", "/test.Echo/Panic", frame(nil), nil, Internal, "internal error"},
+		{"deadline", "/test.Echo/Slow", frame(nil), map[string]string{"Grpc-Timeout": "1m"}, DeadlineExceeded, "deadline exceeded"},
+		{"malformed timeout", "/test.Echo/Echo", frame(nil), map[string]string{"Grpc-Timeout": "soon"}, Internal, `malformed grpc-timeout "soon"`},
+		{"compression", "/test.Echo/Echo", frame(nil), map[string]string{"Grpc-Encoding": "gzip"}, Unimplemented, "compression gzip is not supported"},
+		{"compressed message", "/test.Echo/Echo", []byte{1, 0, 0, 0, 0}, nil, Unimplemented, "compressed messages are not supported"},
+		{"truncated message", "/test.Echo/Echo", []byte{0, 0, 0, 0, 9, 1}, nil, InvalidArgument, "reading the request message: unexpected EOF"},
+		{"two messages", "/test.Echo/Echo", append(frame(nil), frame(nil)...), nil, InvalidArgument, "unary methods take one request message"},
+		{"too large", "/test.Echo/Echo", []byte{0, 0xff, 0xff, 0xff, 0xff}, nil, ResourceExhausted, "request message is larger than 4194304 bytes"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := newCall(tt.method, tt.body)
+			for k, v := range tt.header {
+				r.Header.Set(k, v)
+			}
+			w := httptest.NewRecorder()
+			testServer().ServeHTTP(w, r)
+
+			if w.Code != http.StatusOK {
+				t.Fatalf("HTTP status %d, want 200", w.Code)
+			}
+			if got := w.Header().Get("Grpc-Status"); got != strconv.Itoa(int(tt.wantCode)) {
+				t.Errorf("grpc-status = %s, want %d", got, tt.wantCode)
+			}
+			if got := w.Header().Get("Grpc-Message"); got != tt.wantMessage {
+				t.Errorf("grpc-message = %q, want %q", got, tt.wantMessage)
+			}
+			if w.Body.Len() != 0 {
+				t.Errorf("a trailers-only response has a body: % x", w.Body.Bytes())
+			}
+		})
+	}
+}
+
+func TestServeRejectsNonGRPC(t *testing.T) {
+	http1 := newCall("/test.Echo/Echo", frame(nil))
+	http1.ProtoMajor, http1.ProtoMinor = 1, 1
+	get := newCall("/test.Echo/Echo", nil)
+	get.Method = "GET"
+	json := newCall("/test.Echo/Echo", frame(nil))
+	json.Header.Set("Content-Type", "application/json")
+
+	tests := []struct {
+		name string
+		r    *http.Request
+		want int
+	}{
+		{"HTTP/1.1", http1, http.StatusHTTPVersionNotSupported},
+		{"GET", get, http.StatusMethodNotAllowed},
+		{"JSON", json, http.StatusUnsupportedMediaType},
+	}
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		testServer().ServeHTTP(w, tt.r)
+		if w.Code != tt.want {
+			t.Errorf("%s: status %d, want %d", tt.name, w.Code, tt.want)
+		}
+	}
+}
+
+func TestStatusOf(t *testing.T) {
+	st := statusOf("/test.Echo/Echo", fmt.Errorf("loading: %w", Errorf(NotFound, "not found")))
+	if st.Code != NotFound || st.Message != "not found" {
+		t.Errorf("wrapped status = %+v", st)
+	}
+	st = statusOf("/test.Echo/Echo", errors.New("dial tcp 10.0.0.5:5432: connection refused"))
+	if st.Code != Internal || st.Message != "internal error" {
+		t.Errorf("other error = %+v, want Internal without its detail", st)
+	}
+}
+
+func TestParseTimeout(t *testing.T) {
+	tests := []struct {
+		in   string
+		want time.Duration
+		ok   bool
+	}{
+		{"1H", time.Hour, true},
+		{"30M", 30 * time.Minute, true},
+		{"5S", 5 * time.Second, true},
+		{"250m", 250 * time.Millisecond, true},
+		{"7u", 7 * time.Microsecond, true},
+		{"99999999n", 99999999, true},
+		{"0S", 0, true},
+		{"99999999H", 1<<63 - 1, true},
+		{"", 0, false},
+		{"S", 0, false},
+		{"100000000S", 0, false},
+		{"5s", 0, false},
+		{"-1S", 0, false},
+		{"1.5S", 0, false},
+	}
+	for _, tt := range tests {
+		got, ok := parseTimeout(tt.in)
+		if got != tt.want || ok != tt.ok {
+			t.Errorf("parseTimeout(%q) = %v, %v; want %v, %v", tt.in, got, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestEncodeMessage(t *testing.T) {
+	tests := []struct{ in, want string }{
+		{"not found", "not found"},
+		{"100%", "100%25"},
+		{"é", "%C3%A9"},
+		{"line\nbreak", "line%0Abreak"},
+		{"~", "~"},
+		{"\x7f", "%7F"},
+	}
+	for _, tt := range tests {
+		if got := encodeMessage(tt.in); got != tt.want {
+			t.Errorf("encodeMessage(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,258 @@
+// Package rpc serves unary gRPC calls over HTTP/2 and reads and writes the
+// protobuf messages they carry. It covers what the API's messages use, so
+// the server needs neither generated code nor a gRPC library: scalars,
+// strings, embedded messages and repeated fields, written field by field.
+package rpc
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+)
+
+// Wire types of the protobuf encoding. Groups are not supported.
+const (
+	wireVarint  = 0
+	wireFixed64 = 1
+	wireBytes   = 2
+	wireFixed32 = 5
+)
+
+// Encoder appends the fields of one message. Scalar fields left at their
+// zero value are not written, as proto3 does; the Optional methods write
+// fields with explicit presence whenever they are set.
+type Encoder struct {
+	buf []byte
+}
+
+// Bytes returns the encoded message.
+func (e *Encoder) Bytes() []byte {
+	return e.buf
+}
+
+func (e *Encoder) key(field, wire int) {
+	e.buf = binary.AppendUvarint(e.buf, uint64(field)<<3|uint64(wire))
+}
+
+// Int writes an int32 or int64 field.
+func (e *Encoder) Int(field int, v int64) {
+	if v != 0 {
+		e.key(field, wireVarint)
+		e.buf = binary.AppendUvarint(e.buf, uint64(v))
+	}
+}
+
+// Bool writes a bool field.
+func (e *Encoder) Bool(field int, v bool) {
+	if v {
+		e.key(field, wireVarint)
+		e.buf = append(e.buf, 1)
+	}
+}
+
+// Double writes a double field.
+func (e *Encoder) Double(field int, v float64) {
+	if v != 0 {
+		e.key(field, wireFixed64)
+		e.buf = binary.LittleEndian.AppendUint64(e.buf, math.Float64bits(v))
+	}
+}
+
+// String writes a string field.
+func (e *Encoder) String(field int, v string) {
+	if v != "" {
+		e.key(field, wireBytes)
+		e.buf = binary.AppendUvarint(e.buf, uint64(len(v)))
+		e.buf = append(e.buf, v...)
+	}
+}
+
+// Strings writes a repeated string field, empty strings included.
+func (e *Encoder) Strings(field int, vs []string) {
+	for _, v := range vs {
+		e.key(field, wireBytes)
+		e.buf = binary.AppendUvarint(e.buf, uint64(len(v)))
+		e.buf = append(e.buf, v...)
+	}
+}
+
+// Message writes an embedded message, as encoded by another Encoder. It is
+// written even when empty, so it reads as present.
+func (e *Encoder) Message(field int, m []byte) {
+	e.key(field, wireBytes)
+	e.buf = binary.AppendUvarint(e.buf, uint64(len(m)))
+	e.buf = append(e.buf, m...)
+}
+
+// OptionalInt writes an optional int32 or int64 field when v is not nil.
+func (e *Encoder) OptionalInt(field int, v *int) {
+	if v != nil {
+		e.key(field, wireVarint)
+		e.buf = binary.AppendUvarint(e.buf, uint64(int64(*v)))
+	}
+}
+
+// OptionalDouble writes an optional double field when v is not nil.
+func (e *Encoder) OptionalDouble(field int, v *float64) {
+	if v != nil {
+		e.key(field, wireFixed64)
+		e.buf = binary.LittleEndian.AppendUint64(e.buf, math.Float64bits(*v))
+	}
+}
+
+// OptionalString writes an optional string field when v is not nil.
+func (e *Encoder) OptionalString(field int, v *string) {
+	if v != nil {
+		e.Message(field, []byte(*v))
+	}
+}
+
+var errTruncated = errors.New("message is truncated")
+
+// Decoder reads the fields of a message in the order they were written:
+//
+//	d := rpc.NewDecoder(in)
+//	for d.Next() {
+//		switch d.Field() {
+//		case 1:
+//			m.ID = int(d.Int())
+//		}
+//	}
+//	if err := d.Err(); err != nil {
+//
+// Fields the reader does not ask for are skipped, so messages from newer
+// clients still decode.
+type Decoder struct {
+	buf   []byte
+	field int
+	wire  int
+	n     uint64 // value of a varint or fixed field
+	b     []byte // value of a length-delimited field
+	err   error
+}
+
+func NewDecoder(b []byte) *Decoder {
+	return &Decoder{buf: b}
+}
+
+func (d *Decoder) varint() (uint64, bool) {
+	v, n := binary.Uvarint(d.buf)
+	if n <= 0 {
+		d.err = errTruncated
+		return 0, false
+	}
+	d.buf = d.buf[n:]
+	return v, true
+}
+
+func (d *Decoder) fixed(size int) (uint64, bool) {
+	if len(d.buf) < size {
+		d.err = errTruncated
+		return 0, false
+	}
+	var v uint64
+	if size == 8 {
+		v = binary.LittleEndian.Uint64(d.buf)
+	} else {
+		v = uint64(binary.LittleEndian.Uint32(d.buf))
+	}
+	d.buf = d.buf[size:]
+	return v, true
+}
+
+// Next reads the next field. It returns false at the end of the message or
+// on malformed input, which Err then reports.
+func (d *Decoder) Next() bool {
+	if d.err != nil || len(d.buf) == 0 {
+		return false
+	}
+	key, ok := d.varint()
+	if !ok {
+		return false
+	}
+	if key>>3 == 0 || key>>3 > math.MaxInt32 {
+		d.err = fmt.Errorf("invalid field number %d", key>>3)
+		return false
+	}
+	d.field, d.wire = int(key>>3), int(key&7)
+
+	switch d.wire {
+	case wireVarint:
+		d.n, ok = d.varint()
+	case wireFixed64:
+		d.n, ok = d.fixed(8)
+	case wireFixed32:
+		d.n, ok = d.fixed(4)
+	case wireBytes:
+		var size uint64
+		if size, ok = d.varint(); ok {
+			if size > uint64(len(d.buf)) {
+				d.err, ok = errTruncated, false
+			} else {
+				d.b, d.buf = d.buf[:size], d.buf[size:]
+			}
+		}
+	default:
+		d.err, ok = fmt.Errorf("field %d has unsupported wire type %d", d.field, d.wire), false
+	}
+	return ok
+}
+
+// Field is the number of the field Next read.
+func (d *Decoder) Field() int {
+	return d.field
+}
+
+// Err is the first problem found in the message, if any.
+func (d *Decoder) Err() error {
+	return d.err
+}
+
+func (d *Decoder) want(wire int) bool {
+	if d.wire != wire {
+		if d.err == nil {
+			d.err = fmt.Errorf("field %d has wire type %d, want %d", d.field, d.wire, wire)
+		}
+		return false
+	}
+	return true
+}
+
+// Int is the value of an int32 or int64 field.
+func (d *Decoder) Int() int64 {
+	if !d.want(wireVarint) {
+		return 0
+	}
+	return int64(d.n)
+}
+
+// Bool is the value of a bool field.
+func (d *Decoder) Bool() bool {
+	return d.want(wireVarint) && d.n != 0
+}
+
+// Double is the value of a double field.
+func (d *Decoder) Double() float64 {
+	if !d.want(wireFixed64) {
+		return 0
+	}
+	return math.Float64frombits(d.n)
+}
+
+// String is the value of a string field.
+func (d *Decoder) String() string {
+	if !d.want(wireBytes) {
+		return ""
+	}
+	return string(d.b)
+}
+
+// Message is the encoding of an embedded message field, for a Decoder of
+// its own.
+func (d *Decoder) Message() []byte {
+	if !d.want(wireBytes) {
+		return nil
+	}
+	return d.b
+}
@@ -0,0 +1,166 @@
+package rpc
+
+import (
+	"bytes"
+	"math"
+	"slices"
+	"testing"
+)
+
+func TestEncoderKnownBytes(t *testing.T) {
+	// Encodings from the protobuf documentation and protoc
+	tests := []struct {
+		name   string
+		encode func(e *Encoder)
+		want   []byte
+	}{
+		{"int 150", func(e *Encoder) { e.Int(1, 150) }, []byte{0x08, 0x96, 0x01}},
+		{"negative int", func(e *Encoder) { e.Int(1, -1) }, []byte{0x08, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x01}},
+		{"string", func(e *Encoder) { e.String(2, "testing") }, []byte{0x12, 0x07, 't', 'e', 's', 't', 'i', 'n', 'g'}},
+		{"bool", func(e *Encoder) { e.Bool(3, true) }, []byte{0x18, 0x01}},
+		{"double", func(e *Encoder) { e.Double(4, 1) }, []byte{0x21, 0, 0, 0, 0, 0, 0, 0xf0, 0x3f}},
+		{"high field number", func(e *Encoder) { e.Int(16, 1) }, []byte{0x80, 0x01, 0x01}},
+		{"zero values are not written", func(e *Encoder) {
+			e.Int(1, 0)
+			e.String(2, "")
+			e.Bool(3, false)
+			e.Double(4, 0)
+		}, nil},
+		{"optional zero values are written", func(e *Encoder) {
+			zero, none, empty := 0, 0.0, ""
+			e.OptionalInt(1, &zero)
+			e.OptionalDouble(2, &none)
+			e.OptionalString(3, &empty)
+		}, []byte{0x08, 0x00, 0x11, 0, 0, 0, 0, 0, 0, 0, 0, 0x1a, 0x00}},
+		{"unset optionals are not written", func(e *Encoder) {
+			e.OptionalInt(1, nil)
+			e.OptionalDouble(2, nil)
+			e.OptionalString(3, nil)
+		}, nil},
+		{"empty message", func(e *Encoder) { e.Message(5, nil) }, []byte{0x2a, 0x00}},
+		{"repeated strings", func(e *Encoder) { e.Strings(6, []string{"a", ""}) }, []byte{0x32, 0x01, 'a', 0x32, 0x00}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var e Encoder
+			tt.encode(&e)
+			if !bytes.Equal(e.Bytes(), tt.want) {
+				t.Errorf("encoded % x, want % x", e.Bytes(), tt.want)
+			}
+		})
+	}
+}
+
+func TestRoundTrip(t *testing.T) {
+	var inner Encoder
+	inner.String(1, "inner")
+	inner.Int(2, 7)
+
+	var e Encoder
+	e.Int(1, math.MaxInt64)
+	e.Int(2, -42)
+	e.Bool(3, true)
+	e.Double(4, -12.5)
+	e.String(5, "héllo")
+	e.Strings(6, []string{"a", "", "c"})
+	e.Message(7, inner.Bytes())
+	e.Int(100000, 1)
+
+	var (
+		big, negative, flag int64
+		double              float64
+		str                 string
+		strs                []string
+		name                string
+		count               int64
+	)
+	d := NewDecoder(e.Bytes())
+	for d.Next() {
+		switch d.Field() {
+		case 1:
+			big = d.Int()
+		case 2:
+			negative = d.Int()
+		case 3:
+			if d.Bool() {
+				flag = 1
+			}
+		case 4:
+			double = d.Double()
+		case 5:
+			str = d.String()
+		case 6:
+			strs = append(strs, d.String())
+		case 7:
+			m := NewDecoder(d.Message())
+			for m.Next() {
+				switch m.Field() {
+				case 1:
+					name = m.String()
+				case 2:
+					count = m.Int()
+				}
+			}
+			if err := m.Err(); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if err := d.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if big != math.MaxInt64 || negative != -42 || flag != 1 || double != -12.5 || str != "héllo" {
+		t.Errorf("decoded %d, %d, %d, %g, %q", big, negative, flag, double, str)
+	}
+	if !slices.Equal(strs, []string{"a", "", "c"}) {
+		t.Errorf("repeated field = %q", strs)
+	}
+	if name != "inner" || count != 7 {
+		t.Errorf("embedded message = %q, %d", name, count)
+	}
+}
+
+func TestDecoderSkipsUnknownFields(t *testing.T) {
+	// A fixed32 field (5) is skipped when not asked for
+	in := []byte{0x0d, 1, 2, 3, 4, 0x10, 0x05}
+	d := NewDecoder(in)
+	var got int64
+	for d.Next() {
+		if d.Field() == 2 {
+			got = d.Int()
+		}
+	}
+	if err := d.Err(); err != nil || got != 5 {
+		t.Errorf("got %d, %v; want 5", got, err)
+	}
+}
+
+func TestDecoderErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		in   []byte
+		read func(d *Decoder)
+	}{
+		{"truncated varint", []byte{0x08, 0x96}, nil},
+		{"truncated key", []byte{0x80}, nil},
+		{"truncated fixed64", []byte{0x21, 0, 0}, nil},
+		{"truncated fixed32", []byte{0x25, 0}, nil},
+		{"length past the end", []byte{0x12, 0x05, 'a'}, nil},
+		{"field number 0", []byte{0x00, 0x01}, nil},
+		{"group", []byte{0x0b}, nil},
+		{"wrong wire type", []byte{0x08, 0x01}, func(d *Decoder) { _ = d.String() }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := NewDecoder(tt.in)
+			for d.Next() {
+				if tt.read != nil {
+					tt.read(d)
+				}
+			}
+			if d.Err() == nil {
+				t.Error("no error")
+			}
+		})
+	}
+}
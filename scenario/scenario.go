@@ -0,0 +1,550 @@
+// Package scenario replays scripted sequences of API calls from YAML
+// fixtures, such as submitting, approving and partly paying a request, and
+// checks every response. Scenarios run against the real router in-process,
+// so they exercise the same handlers, validation and database as clients do.
+package scenario
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Scenario is one fixture file. Steps run in order and stop at the first
+// failure.
+type Scenario struct {
+	Name  string `yaml:"name"`
+	Steps []Step `yaml:"steps"`
+
+	// Dir is where golden files are looked up, the fixture's directory
+	// when loaded from a file.
+	Dir string `yaml:"-"`
+	// UpdateGolden writes every response with a golden file to that file
+	// instead of comparing them.
+	UpdateGolden bool `yaml:"-"`
+	// Vars are variables the runner sets before the first step, such as
+	// setupToken.
+	Vars map[string]any `yaml:"-"`
+}
+
+// Step is one API call. Strings anywhere in Request, Token, Headers, Body
+// and Upload may refer to values saved by earlier steps as ${name}, to
+// ${year}, the current year, and to the scenario's Vars.
+type Step struct {
+	Name    string            `yaml:"name"`
+	Request string            `yaml:"request"` // e.g. "POST /expense_requests"
+	Token   string            `yaml:"token"`   // sent as a bearer token
+	Headers map[string]string `yaml:"headers"`
+	// Body is sent as JSON, except for a string when Headers set a
+	// Content-Type, which is sent as it is, e.g. a CSV file.
+	Body   any     `yaml:"body"`
+	Upload *Upload `yaml:"upload"` // sent as a multipart form instead of Body
+	Expect Expect  `yaml:"expect"`
+
+	// Save stores values from the response for later steps, by variable
+	// name. Values are a dotted path into the JSON body such as "user.id"
+	// or "items.0.id", "header:ETag" for a response header, or
+	// "header:Location?state" for a query parameter of the URL in one.
+	Save map[string]string `yaml:"save"`
+
+	// Parallel makes the step a group of steps that are sent at the same
+	// time, for races such as two payments from one budget, instead of a
+	// request of its own. They cannot save values. Which of them wins is up
+	// to the server, so the group's Expect.Statuses counts their statuses,
+	// and a later step checks the outcome.
+	Parallel []Step `yaml:"parallel"`
+}
+
+// Upload is a file sent as a multipart form field.
+type Upload struct {
+	Field    string `yaml:"field"` // "file" when empty
+	Filename string `yaml:"filename"`
+	Content  string `yaml:"content"`
+}
+
+// Expect is what a step's response must look like. Only the fields given in
+// Body are compared, so responses may carry more than the fixture lists; an
+// NDJSON response is compared as a list of its lines. Golden names a JSON
+// file the whole body must equal instead, with every timestamp written as
+// "<time>"; it may refer to variables too.
+type Expect struct {
+	Status  int               `yaml:"status"`
+	Headers map[string]string `yaml:"headers"` // each must equal the response header of the same name
+	Body    any               `yaml:"body"`
+	Golden  string            `yaml:"golden"`
+
+	// Statuses counts the responses of a parallel step by status, e.g.
+	// {201: 1, 422: 1} for two payments of which only one may pass.
+	Statuses map[int]int `yaml:"statuses"`
+}
+
+// Load reads a scenario from a YAML file.
+func Load(path string) (Scenario, error) {
+	var sc Scenario
+	f, err := os.Open(path)
+	if err != nil {
+		return sc, err
+	}
+	defer f.Close()
+
+	decoder := yaml.NewDecoder(f)
+	decoder.KnownFields(true)
+	if err := decoder.Decode(&sc); err != nil {
+		return sc, fmt.Errorf("%s: %w", path, err)
+	}
+	if sc.Name == "" {
+		sc.Name = path
+	}
+	sc.Dir = filepath.Dir(path)
+	return sc, nil
+}
+
+// Run executes the scenario's steps against h. The error names the step
+// that failed and why.
+func Run(ctx context.Context, h http.Handler, sc Scenario) error {
+	vars := map[string]any{"year": time.Now().Year()}
+	maps.Copy(vars, sc.Vars)
+	for i, step := range sc.Steps {
+		var err error
+		if len(step.Parallel) > 0 {
+			err = runParallel(ctx, h, sc, step, vars)
+		} else {
+			_, err = runStep(ctx, h, sc, step, vars)
+		}
+		if err != nil {
+			return fmt.Errorf("step %d (%s): %w", i+1, step.name(), err)
+		}
+	}
+	return nil
+}
+
+func (step Step) name() string {
+	if step.Name == "" {
+		return step.Request
+	}
+	return step.Name
+}
+
+// runParallel sends the steps of a parallel step at once and checks their
+// statuses when they are all done.
+func runParallel(ctx context.Context, h http.Handler, sc Scenario, step Step, vars map[string]any) error {
+	if step.Request != "" {
+		return errors.New("a parallel step sends no request of its own")
+	}
+	for i, sub := range step.Parallel {
+		// vars is only read while they run
+		if len(sub.Save) > 0 || len(sub.Parallel) > 0 {
+			return fmt.Errorf("parallel step %d (%s) cannot save values or have parallel steps", i+1, sub.name())
+		}
+	}
+
+	statuses := make([]int, len(step.Parallel))
+	errs := make([]error, len(step.Parallel))
+	var wg sync.WaitGroup
+	for i, sub := range step.Parallel {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			statuses[i], errs[i] = runStep(ctx, h, sc, sub, vars)
+			if errs[i] != nil {
+				errs[i] = fmt.Errorf("parallel step %d (%s): %w", i+1, sub.name(), errs[i])
+			}
+		}()
+	}
+	wg.Wait()
+	if err := errors.Join(errs...); err != nil {
+		return err
+	}
+
+	if step.Expect.Statuses != nil {
+		got := map[int]int{}
+		for _, status := range statuses {
+			got[status]++
+		}
+		if !maps.Equal(got, step.Expect.Statuses) {
+			return fmt.Errorf("got statuses %v, want %v", got, step.Expect.Statuses)
+		}
+	}
+	return nil
+}
+
+// runStep sends one request and checks its response. It returns the
+// response status.
+func runStep(ctx context.Context, h http.Handler, sc Scenario, step Step, vars map[string]any) (int, error) {
+	req, err := newRequest(ctx, step, vars)
+	if err != nil {
+		return 0, err
+	}
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	res := rec.Result()
+
+	got, err := decodeBody(res.Header.Get("Content-Type"), rec.Body.Bytes())
+	if err != nil {
+		return res.StatusCode, err
+	}
+	return res.StatusCode, check(sc, step, vars, res, rec.Body.String(), got)
+}
+
+// newRequest builds the request of a step.
+func newRequest(ctx context.Context, step Step, vars map[string]any) (*http.Request, error) {
+	request, err := substitute(step.Request, vars)
+	if err != nil {
+		return nil, err
+	}
+	method, path, ok := strings.Cut(request.(string), " ")
+	if !ok {
+		return nil, fmt.Errorf("request must be a method and a path, not %q", step.Request)
+	}
+
+	headers := map[string]string{}
+	for name, value := range step.Headers {
+		v, err := substitute(value, vars)
+		if err != nil {
+			return nil, err
+		}
+		headers[http.CanonicalHeaderKey(name)] = fmt.Sprint(v)
+	}
+
+	var body io.Reader
+	switch {
+	case step.Upload != nil:
+		var upload [3]string
+		for i, v := range []string{step.Upload.Field, step.Upload.Filename, step.Upload.Content} {
+			s, err := substitute(v, vars)
+			if err != nil {
+				return nil, err
+			}
+			upload[i] = fmt.Sprint(s)
+		}
+		field, filename, content := upload[0], upload[1], upload[2]
+		if field == "" {
+			field = "file"
+		}
+		var form bytes.Buffer
+		writer := multipart.NewWriter(&form)
+		part, err := writer.CreateFormFile(field, filename)
+		if err != nil {
+			return nil, err
+		}
+		io.WriteString(part, content)
+		if err := writer.Close(); err != nil {
+			return nil, err
+		}
+		body = &form
+		headers["Content-Type"] = writer.FormDataContentType()
+	case step.Body != nil:
+		b, err := substitute(step.Body, vars)
+		if err != nil {
+			return nil, err
+		}
+		if raw, ok := b.(string); ok && headers["Content-Type"] != "" {
+			body = strings.NewReader(raw)
+			break
+		}
+		data, err := json.Marshal(b)
+		if err != nil {
+			return nil, err
+		}
+		body = bytes.NewReader(data)
+		if headers["Content-Type"] == "" {
+			headers["Content-Type"] = "application/json"
+		}
+	}
+
+	req := httptest.NewRequestWithContext(ctx, method, strings.TrimSpace(path), body)
+	if step.Token != "" {
+		token, err := substitute(step.Token, vars)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Authorization", "Bearer "+fmt.Sprint(token))
+	}
+	for name, value := range headers {
+		req.Header.Set(name, value)
+	}
+	return req, nil
+}
+
+// decodeBody decodes a JSON response body, or an NDJSON one into a list of
+// its lines. Other bodies decode to nil.
+func decodeBody(contentType string, body []byte) (any, error) {
+	if len(body) == 0 {
+		return nil, nil
+	}
+	switch {
+	case strings.HasPrefix(contentType, "application/json"):
+		var got any
+		if err := json.Unmarshal(body, &got); err != nil {
+			return nil, fmt.Errorf("response is not valid JSON: %w", err)
+		}
+		return got, nil
+	case strings.HasPrefix(contentType, "application/x-ndjson"):
+		lines := []any{}
+		decoder := json.NewDecoder(bytes.NewReader(body))
+		for {
+			var line any
+			err := decoder.Decode(&line)
+			if err == io.EOF {
+				return lines, nil
+			} else if err != nil {
+				return nil, fmt.Errorf("response line %d is not valid JSON: %w", len(lines)+1, err)
+			}
+			lines = append(lines, line)
+		}
+	}
+	return nil, nil
+}
+
+// check compares a response with what the step expects and saves the
+// values the step asks for.
+func check(sc Scenario, step Step, vars map[string]any, res *http.Response, body string, got any) error {
+	if step.Expect.Status != 0 && res.StatusCode != step.Expect.Status {
+		return fmt.Errorf("got status %d, want %d: %s", res.StatusCode, step.Expect.Status, strings.TrimSpace(body))
+	}
+	for name, value := range step.Expect.Headers {
+		want, err := substitute(value, vars)
+		if err != nil {
+			return err
+		}
+		if got := res.Header.Get(name); got != fmt.Sprint(want) {
+			return fmt.Errorf("%s header: got %q, want %q", name, got, want)
+		}
+	}
+	if step.Expect.Body != nil {
+		want, err := substitute(step.Expect.Body, vars)
+		if err != nil {
+			return err
+		}
+		if err := match("body", normalize(want), got); err != nil {
+			return err
+		}
+	}
+	if step.Expect.Golden != "" {
+		if err := checkGolden(filepath.Join(sc.Dir, step.Expect.Golden), sc.UpdateGolden, got, vars); err != nil {
+			return err
+		}
+	}
+
+	for name, from := range step.Save {
+		if header, ok := strings.CutPrefix(from, "header:"); ok {
+			header, param, inURL := strings.Cut(header, "?")
+			value := res.Header.Get(header)
+			if value == "" {
+				return fmt.Errorf("cannot save %s: no %s header", name, header)
+			}
+			if inURL {
+				u, err := url.Parse(value)
+				if err != nil {
+					return fmt.Errorf("cannot save %s: %w", name, err)
+				}
+				if value = u.Query().Get(param); value == "" {
+					return fmt.Errorf("cannot save %s: no %s in the %s header", name, param, header)
+				}
+			}
+			vars[name] = value
+			continue
+		}
+		value, err := lookup(got, from)
+		if err != nil {
+			return fmt.Errorf("cannot save %s: %w", name, err)
+		}
+		vars[name] = value
+	}
+	return nil
+}
+
+// checkGolden compares a response body with the golden file at path, or
+// writes the body there when update is set.
+func checkGolden(path string, update bool, got any, vars map[string]any) error {
+	got = maskTimes(got)
+	var actual bytes.Buffer
+	encoder := json.NewEncoder(&actual)
+	encoder.SetEscapeHTML(false)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(got); err != nil {
+		return err
+	}
+	if update {
+		return os.WriteFile(path, actual.Bytes(), 0o644)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var want any
+	if err := json.Unmarshal(data, &want); err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	want, err = substitute(want, vars)
+	if err != nil {
+		return err
+	}
+	if want = normalize(want); !reflect.DeepEqual(want, got) {
+		return fmt.Errorf("body differs from %s, got %s", path, actual.Bytes())
+	}
+	return nil
+}
+
+var timestamp = regexp.MustCompile(`^\d{4}-\d{2}-\d{2}T\d{2}:\d{2}:\d{2}`)
+
+// maskTimes replaces every timestamp in a decoded JSON value with "<time>",
+// as they differ between runs.
+func maskTimes(v any) any {
+	switch v := v.(type) {
+	case string:
+		if timestamp.MatchString(v) {
+			return "<time>"
+		}
+	case map[string]any:
+		for key, value := range v {
+			v[key] = maskTimes(value)
+		}
+	case []any:
+		for i, value := range v {
+			v[i] = maskTimes(value)
+		}
+	}
+	return v
+}
+
+var variable = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+
+// substitute replaces ${name} in every string within v. A string that is
+// nothing but one variable takes the variable's value and type, so saved
+// IDs stay numbers.
+func substitute(v any, vars map[string]any) (any, error) {
+	switch v := v.(type) {
+	case string:
+		if m := variable.FindStringSubmatch(v); m != nil && m[0] == v {
+			value, ok := vars[m[1]]
+			if !ok {
+				return nil, fmt.Errorf("variable %s is not set", m[1])
+			}
+			return value, nil
+		}
+		var missing string
+		out := variable.ReplaceAllStringFunc(v, func(ref string) string {
+			name := ref[2 : len(ref)-1]
+			value, ok := vars[name]
+			if !ok {
+				missing = name
+			}
+			return fmt.Sprint(value)
+		})
+		if missing != "" {
+			return nil, fmt.Errorf("variable %s is not set", missing)
+		}
+		return out, nil
+	case map[string]any:
+		out := make(map[string]any, len(v))
+		for key, value := range v {
+			s, err := substitute(value, vars)
+			if err != nil {
+				return nil, err
+			}
+			out[key] = s
+		}
+		return out, nil
+	case []any:
+		out := make([]any, len(v))
+		for i, value := range v {
+			s, err := substitute(value, vars)
+			if err != nil {
+				return nil, err
+			}
+			out[i] = s
+		}
+		return out, nil
+	}
+	return v, nil
+}
+
+// normalize gives a fixture value the types encoding/json decodes into, so
+// YAML's 201 compares equal to JSON's 201.
+func normalize(v any) any {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return v
+	}
+	var out any
+	if err := json.Unmarshal(data, &out); err != nil {
+		return v
+	}
+	return out
+}
+
+// match checks that got contains everything in want.
+func match(path string, want, got any) error {
+	switch want := want.(type) {
+	case map[string]any:
+		obj, ok := got.(map[string]any)
+		if !ok {
+			return fmt.Errorf("%s: got %v, want an object", path, got)
+		}
+		for key, value := range want {
+			if err := match(path+"."+key, value, obj[key]); err != nil {
+				return err
+			}
+		}
+		return nil
+	case []any:
+		list, ok := got.([]any)
+		if !ok || len(list) != len(want) {
+			return fmt.Errorf("%s: got %v, want a list of %d", path, got, len(want))
+		}
+		for i := range want {
+			if err := match(path+"."+strconv.Itoa(i), want[i], list[i]); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if !reflect.DeepEqual(want, got) {
+		return fmt.Errorf("%s: got %v, want %v", path, got, want)
+	}
+	return nil
+}
+
+// lookup follows a dotted path of object keys and list indexes.
+func lookup(v any, path string) (any, error) {
+	for _, part := range strings.Split(path, ".") {
+		switch node := v.(type) {
+		case map[string]any:
+			value, ok := node[part]
+			if !ok {
+				return nil, fmt.Errorf("%s: no field %q", path, part)
+			}
+			v = value
+		case []any:
+			i, err := strconv.Atoi(part)
+			if err != nil || i < 0 || i >= len(node) {
+				return nil, fmt.Errorf("%s: no element %q", path, part)
+			}
+			v = node[i]
+		default:
+			return nil, fmt.Errorf("%s: %q is not an object or list", path, part)
+		}
+	}
+	return v, nil
+}
@@ -0,0 +1,137 @@
+package scenario
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// testAPI is a tiny API for the runner to talk to.
+func testAPI() http.Handler {
+	var mu sync.Mutex
+	taken := false
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /seats", func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		if taken {
+			http.Error(w, "taken", http.StatusConflict)
+			return
+		}
+		taken = true
+		w.WriteHeader(http.StatusCreated)
+	})
+	mux.HandleFunc("GET /login", func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "https://sso.example.com/authorize?state=abc&client_id=ems", http.StatusFound)
+	})
+	mux.HandleFunc("POST /echo", func(w http.ResponseWriter, r *http.Request) {
+		echo := map[string]string{"contentType": r.Header.Get("Content-Type")}
+		if file, header, err := r.FormFile("file"); err == nil {
+			data, _ := io.ReadAll(file)
+			echo["filename"], echo["body"] = header.Filename, string(data)
+		} else {
+			data, _ := io.ReadAll(r.Body)
+			echo["body"] = string(data)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(echo)
+	})
+	mux.HandleFunc("GET /rows", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		io.WriteString(w, "{\"id\":1}\n{\"id\":2}\n")
+	})
+	return mux
+}
+
+func TestRun(t *testing.T) {
+	sc := Scenario{Steps: []Step{
+		{
+			Name:    "a redirect's state",
+			Request: "GET /login",
+			Expect:  Expect{Status: http.StatusFound},
+			Save:    map[string]string{"state": "header:Location?state"},
+		},
+		{
+			Request: "POST /echo",
+			Headers: map[string]string{"Content-Type": "text/csv"},
+			Body:    "name\n${state}\n",
+			Expect:  Expect{Body: map[string]any{"contentType": "text/csv", "body": "name\nabc\n"}},
+		},
+		{
+			Request: "POST /echo",
+			Body:    map[string]any{"state": "${state}"},
+			Expect:  Expect{Body: map[string]any{"contentType": "application/json", "body": "{\"state\":\"abc\"}"}},
+		},
+		{
+			Request: "POST /echo",
+			Upload:  &Upload{Filename: "${state}.pdf", Content: "%PDF-1.4"},
+			Expect:  Expect{Body: map[string]any{"filename": "abc.pdf", "body": "%PDF-1.4"}},
+		},
+		{
+			Request: "GET /rows",
+			Expect: Expect{
+				Headers: map[string]string{"Content-Type": "application/x-ndjson"},
+				Body:    []any{map[string]any{"id": 1}, map[string]any{"id": 2}},
+			},
+		},
+		{
+			Name: "one of three takes the seat",
+			Parallel: []Step{
+				{Request: "POST /seats"},
+				{Request: "POST /seats"},
+				{Request: "POST /seats"},
+			},
+			Expect: Expect{Statuses: map[int]int{http.StatusCreated: 1, http.StatusConflict: 2}},
+		},
+	}}
+	if err := Run(context.Background(), testAPI(), sc); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRunFailures(t *testing.T) {
+	tests := []struct {
+		name string
+		step Step
+		want string
+	}{
+		{
+			"status",
+			Step{Request: "POST /seats", Expect: Expect{Status: http.StatusOK}},
+			"got status 201, want 200",
+		},
+		{
+			"header",
+			Step{Request: "GET /rows", Expect: Expect{Headers: map[string]string{"Content-Type": "application/json"}}},
+			`Content-Type header: got "application/x-ndjson"`,
+		},
+		{
+			"missing query parameter",
+			Step{Request: "GET /login", Save: map[string]string{"code": "header:Location?code"}},
+			"no code in the Location header",
+		},
+		{
+			"parallel statuses",
+			Step{
+				Parallel: []Step{{Request: "POST /seats"}, {Request: "POST /seats"}},
+				Expect:   Expect{Statuses: map[int]int{http.StatusCreated: 2}},
+			},
+			"got statuses map[201:1 409:1]",
+		},
+		{
+			"parallel step that saves",
+			Step{Parallel: []Step{{Request: "GET /login", Save: map[string]string{"state": "header:Location?state"}}}},
+			"cannot save values",
+		},
+	}
+	for _, tt := range tests {
+		err := Run(context.Background(), testAPI(), Scenario{Steps: []Step{tt.step}})
+		if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%s: got %v, want an error containing %q", tt.name, err, tt.want)
+		}
+	}
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"main/app"
+	"main/config"
+	"main/scenario"
+	"os"
+	"path/filepath"
+)
+
+// runScenarios replays scenario fixtures, e.g. `main scenario scenarios/`,
+// and returns the process exit code. Every scenario starts from an empty
+// database, so the database is taken from SCENARIO_POSTGRES_URL and never
+// from POSTGRES_URL.
+func runScenarios(args []string) int {
+	dsn := os.Getenv("SCENARIO_POSTGRES_URL")
+	if dsn == "" {
+		log.Println("SCENARIO_POSTGRES_URL must point at a test database; its tables are emptied before every scenario")
+		return 2
+	}
+	if len(args) == 0 {
+		args = []string{"scenarios"}
+	}
+
+	var paths []string
+	for _, arg := range args {
+		info, err := os.Stat(arg)
+		if err != nil {
+			log.Println(err)
+			return 2
+		}
+		if !info.IsDir() {
+			paths = append(paths, arg)
+			continue
+		}
+		matches, err := filepath.Glob(filepath.Join(arg, "*.yaml"))
+		if err != nil {
+			log.Println(err)
+			return 2
+		}
+		paths = append(paths, matches...)
+	}
+
+	cfg, err := config.Load(os.Getenv("CONFIG_FILE"))
+	if err != nil {
+		log.Println(err)
+		return 2
+	}
+	cfg.DatabaseURL = dsn
+	// Scenarios must not send email, print or fetch rates, and replay
+	// faster than any client is allowed to. The tables are emptied between
+	// them, which a cache would not notice.
+	cfg.SendGridAPIKey, cfg.SMTPAddr = "", ""
+	cfg.PrinterIPPURL, cfg.PrintDropDir = "", ""
+	cfg.ExchangeRateProvider = "manual"
+	cfg.RateLimitReads, cfg.RateLimitWrites, cfg.RateLimitRedisURL = 0, 0, ""
+	cfg.ReferenceCacheTTL, cfg.CacheRedisURL = 0, ""
+	if err := cfg.Validate(); err != nil {
+		log.Println("Invalid configuration:", err)
+		return 2
+	}
+
+	db, err := sql.Open("postgres", dsn)
+	if err != nil {
+		log.Println(err)
+		return 2
+	}
+	defer db.Close()
+
+	s := app.NewServer(db, cfg, nil)
+	router := app.NewRouter(s)
+
+	ctx := context.Background()
+	failed := 0
+	for _, path := range paths {
+		sc, err := scenario.Load(path)
+		if err != nil {
+			log.Println(err)
+			return 2
+		}
+
+		if err := scenario.Reset(ctx, db); err != nil {
+			log.Println("Resetting the database failed:", err)
+			return 2
+		}
+		// Recreates seed rows such as the base currency
+		app.CreateTables(s)
+		token, err := s.BootstrapSetup(ctx)
+		if err != nil {
+			log.Println("Issuing a setup token failed:", err)
+			return 2
+		}
+		sc.Vars = map[string]any{"setupToken": token}
+
+		if err := scenario.Run(ctx, router, sc); err != nil {
+			failed++
+			fmt.Printf("FAIL %s: %v\n", sc.Name, err)
+			continue
+		}
+		fmt.Printf("ok   %s\n", sc.Name)
+	}
+
+	fmt.Printf("%d of %d scenarios passed\n", len(paths)-failed, len(paths))
+	if failed > 0 {
+		return 1
+	}
+	return 0
+}
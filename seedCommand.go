@@ -0,0 +1,25 @@
+package main
+
+import (
+	"flag"
+	"main/app"
+)
+
+// seedDemo creates the tables and fills an empty database with demo data,
+// e.g. `main seed`, like `main serve -seed` but without serving.
+func seedDemo(args []string) int {
+	flags := flag.NewFlagSet("seed", flag.ContinueOnError)
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+
+	s, code := commandServer(nil)
+	if s == nil {
+		return code
+	}
+	defer s.DB.Close()
+
+	app.CreateTables(s)
+	app.SeedDemo(s)
+	return 0
+}
@@ -0,0 +1,209 @@
+package server
+
+import (
+	"encoding/json"
+	"log"
+	"main/money"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// AccrualLine is one request that was approved but not fully paid at year
+// end. Amounts are in the request's currency; AccruedBase converts what is
+// still owed at the year-end rate and is nil when no rate is known.
+type AccrualLine struct {
+	ExpenseID   int           `json:"expenseID"`
+	DocNumber   string        `json:"docNumber"`
+	Reference   string        `json:"reference"`
+	UnitID      string        `json:"unitID"`
+	Category    string        `json:"category"`
+	State       ExpenseState  `json:"state"`
+	Currency    string        `json:"currency"`
+	Amount      money.Amount  `json:"amount"`
+	Paid        money.Amount  `json:"paid"`
+	Accrued     money.Amount  `json:"accrued"`
+	AccruedBase *money.Amount `json:"accruedBase"`
+}
+
+// AccrualTotal is what a unit owes in one category, in the base currency.
+type AccrualTotal struct {
+	UnitID      string       `json:"unitID"`
+	Category    string       `json:"category"`
+	Requests    int          `json:"requests"`
+	Accrued     money.Amount `json:"accrued"`
+	Unconverted int          `json:"unconverted"`
+}
+
+// AccrualReport lists what was owed at the end of a fiscal year. The position is
+// rebuilt from the activity history and payment dates, so activity after
+// the year end does not change it.
+type AccrualReport struct {
+	Year         int            `json:"year"`
+	AsOf         string         `json:"asOf"`
+	BaseCurrency string         `json:"baseCurrency"`
+	TotalAccrued money.Amount   `json:"totalAccrued"`
+	Unconverted  int            `json:"unconverted"`
+	Totals       []AccrualTotal `json:"totals"`
+	Lines        []AccrualLine  `json:"lines"`
+}
+
+// AccrualsReport serves GET /reports/accruals. format=csv returns the lines
+// as a spreadsheet for booking.
+func (s *Server) AccrualsReport(w http.ResponseWriter, r *http.Request) {
+	if _, ok := s.requireRole(w, r, Accounter, Admin); !ok {
+		return
+	}
+
+	queryParams := r.URL.Query()
+	year, err := strconv.Atoi(queryParams.Get("year"))
+	if err != nil {
+		http.Error(w, "Missing or invalid year parameter", http.StatusBadRequest)
+		return
+	}
+	format, ok := listFormat(w, r)
+	if !ok {
+		return
+	}
+
+	// Everything before the first moment of the next fiscal year counts, the
+	// unit's when the report is for one and the organisation's otherwise
+	unitID := queryParams.Get("unitID")
+	_, next, err := fiscalYearBounds(r.Context(), s.DB, year, unitID)
+	if err != nil {
+		log.Println("Fiscal year lookup error:", err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	cutoff := next.Format(time.DateOnly)
+	report := AccrualReport{
+		Year:         year,
+		AsOf:         next.AddDate(0, 0, -1).Format(time.DateOnly),
+		BaseCurrency: s.BaseCurrency,
+		Totals:       []AccrualTotal{},
+		Lines:        []AccrualLine{},
+	}
+
+	args := []any{cutoff, report.AsOf, pq.Array(stateSpellings(Approved, PartiallyPaid))}
+	unitFilter := ""
+	if unitID != "" {
+		args = append(args, unitID)
+		unitFilter = " AND er.unit_id = $4"
+	}
+
+	rows, err := s.DB.QueryContext(r.Context(), `
+		SELECT er.id, er.doc_number, er.reference, er.unit_id, er.category, st.current_state, er.currency, er.amount,
+			COALESCE((SELECT SUM(pe.amount) FROM paid_expense pe WHERE pe.expense_id = er.id AND pe.created_at < $1), 0),
+			`+s.inBaseCurrency("1", "er.currency", "$2::date")+`
+		FROM expense_request er
+		CROSS JOIN LATERAL (
+			SELECT ea.current_state
+			FROM expense_activity ea
+			WHERE ea.expense_id = er.id AND ea.created_at < $1
+			ORDER BY ea.created_at DESC, ea.id DESC
+			LIMIT 1
+		) st
+		WHERE er.created_at < $1 AND st.current_state = ANY($3)`+unitFilter+`
+		ORDER BY er.unit_id, er.category, er.id
+	`, args...)
+	if err != nil {
+		log.Println("AccrualsReport query error:", err)
+		http.Error(w, "Database query failed", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	round := s.conversionRounding(r.Context()).Round
+	for rows.Next() {
+		var line AccrualLine
+		var rate *float64
+		if err := rows.Scan(&line.ExpenseID, &line.DocNumber, &line.Reference, &line.UnitID, &line.Category, &line.State,
+			&line.Currency, &line.Amount, &line.Paid, &rate); err != nil {
+			log.Println("Row scan error:", err)
+			http.Error(w, "Failed to read report data", http.StatusInternalServerError)
+			return
+		}
+		line.Accrued = line.Amount - line.Paid
+		if line.Accrued <= 0 {
+			continue
+		}
+
+		n := len(report.Totals)
+		if n == 0 || report.Totals[n-1].UnitID != line.UnitID || report.Totals[n-1].Category != line.Category {
+			report.Totals = append(report.Totals, AccrualTotal{UnitID: line.UnitID, Category: line.Category})
+			n++
+		}
+		total := &report.Totals[n-1]
+		total.Requests++
+		if rate != nil {
+			base := round(line.Accrued.Mul(*rate))
+			line.AccruedBase = &base
+			total.Accrued += base
+			report.TotalAccrued += base
+		} else {
+			total.Unconverted++
+			report.Unconverted++
+		}
+		report.Lines = append(report.Lines, line)
+	}
+	if err := rows.Err(); err != nil {
+		log.Println("Row iteration error:", err)
+		http.Error(w, "Error reading results", http.StatusInternalServerError)
+		return
+	}
+
+	for i := range report.Totals {
+		report.Totals[i].Accrued = round(report.Totals[i].Accrued)
+	}
+	report.TotalAccrued = round(report.TotalAccrued)
+
+	if format == "csv" {
+		export := newCSVExport(w, "accruals-"+strconv.Itoa(year),
+			[]string{"asOf", "unitID", "category", "expenseID", "docNumber", "reference", "state", "currency", "amount", "paid", "accrued", "accruedBase", "baseCurrency"})
+		for _, line := range report.Lines {
+			err := export.write([]string{
+				report.AsOf,
+				csvText(line.UnitID),
+				csvText(line.Category),
+				strconv.Itoa(line.ExpenseID),
+				line.DocNumber,
+				line.Reference,
+				string(line.State),
+				line.Currency,
+				line.Amount.String(),
+				line.Paid.String(),
+				line.Accrued.String(),
+				csvOptional(line.AccruedBase, money.Amount.String),
+				s.BaseCurrency,
+			})
+			if err != nil {
+				log.Println("CSV write error:", err)
+				return
+			}
+		}
+		if err := export.close(); err != nil {
+			log.Println("CSV write error:", err)
+		}
+		return
+	}
+
+	if format == "ndjson" {
+		// One line per request; the totals are left to the reader
+		stream := newNDJSONExport(w)
+		for _, line := range report.Lines {
+			if err := stream.write(line); err != nil {
+				log.Println("NDJSON write error:", err)
+				return
+			}
+		}
+		stream.close()
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	if err := json.NewEncoder(w).Encode(report); err != nil {
+		log.Println("JSON encoding error:", err)
+	}
+}
@@ -0,0 +1,198 @@
+package server
+
+import (
+	"encoding/json"
+	"log"
+	"main/money"
+	"net/http"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// agingBuckets are the age ranges, in days since approval, unpaid requests
+// are grouped into. The last one is open ended.
+var agingBuckets = []struct {
+	label   string
+	maxDays int
+}{
+	{"0-7", 7},
+	{"8-30", 30},
+	{"31+", -1},
+}
+
+// agingBucket is the index of the bucket a request of the given age falls
+// in.
+func agingBucket(days int) int {
+	for i, b := range agingBuckets {
+		if b.maxDays < 0 || days <= b.maxDays {
+			return i
+		}
+	}
+	return len(agingBuckets) - 1
+}
+
+// AgingBucket is what is owed on requests approved within an age range.
+// Outstanding is in the base currency; requests in a currency with no known
+// exchange rate are counted but left out of it.
+type AgingBucket struct {
+	Label       string       `json:"label"` // 0-7, 8-30 or 31+ days
+	Requests    int          `json:"requests"`
+	Outstanding money.Amount `json:"outstanding"`
+	Unconverted int          `json:"unconverted"`
+}
+
+func newAgingBuckets() []AgingBucket {
+	buckets := make([]AgingBucket, len(agingBuckets))
+	for i, b := range agingBuckets {
+		buckets[i].Label = b.label
+	}
+	return buckets
+}
+
+func (b *AgingBucket) add(line AgingLine) {
+	b.Requests++
+	if line.OutstandingBase != nil {
+		b.Outstanding += *line.OutstandingBase
+	} else {
+		b.Unconverted++
+	}
+}
+
+type AgingUnit struct {
+	UnitID  string        `json:"unitID"`
+	Buckets []AgingBucket `json:"buckets"`
+}
+
+// AgingLine is one approved request that is not fully paid. Outstanding is
+// in the request's currency; OutstandingBase converts it at today's rate
+// and is nil when no rate is known.
+type AgingLine struct {
+	ExpenseID       int           `json:"expenseID"`
+	DocNumber       string        `json:"docNumber"`
+	Reference       string        `json:"reference"`
+	UnitID          string        `json:"unitID"`
+	Category        string        `json:"category"`
+	State           ExpenseState  `json:"state"`
+	Currency        string        `json:"currency"`
+	Amount          money.Amount  `json:"amount"`
+	Paid            money.Amount  `json:"paid"`
+	Outstanding     money.Amount  `json:"outstanding"`
+	OutstandingBase *money.Amount `json:"outstandingBase"`
+	ApprovedAt      time.Time     `json:"approvedAt"`
+	AgeDays         int           `json:"ageDays"`
+	Bucket          string        `json:"bucket"`
+}
+
+// AgingReport groups what approved requests still owe by how long ago they
+// were approved, per unit and overall. Lines are by unit, oldest first.
+type AgingReport struct {
+	AsOf         time.Time     `json:"asOf"`
+	BaseCurrency string        `json:"baseCurrency"`
+	Totals       []AgingBucket `json:"totals"`
+	Units        []AgingUnit   `json:"units"`
+	Lines        []AgingLine   `json:"lines"`
+}
+
+// GetAgingReport serves GET /reports/aging. A request's age counts from its
+// latest approval in the activity history, so one approved again after a
+// change of category is as old as that second approval.
+func (s *Server) GetAgingReport(w http.ResponseWriter, r *http.Request) {
+	if _, ok := s.requireRole(w, r, Accounter, Admin); !ok {
+		return
+	}
+
+	report := AgingReport{
+		AsOf:         time.Now().UTC(),
+		BaseCurrency: s.BaseCurrency,
+		Totals:       newAgingBuckets(),
+		Units:        []AgingUnit{},
+		Lines:        []AgingLine{},
+	}
+
+	args := []any{pq.Array(stateSpellings(Approved, PartiallyPaid)), pq.Array(stateSpellings(Approved))}
+	unitFilter := ""
+	if unitID := r.URL.Query().Get("unitID"); unitID != "" {
+		args = append(args, unitID)
+		unitFilter = " AND er.unit_id = $3"
+	}
+
+	rows, err := s.DB.QueryContext(r.Context(), `
+		SELECT er.id, er.doc_number, er.reference, er.unit_id, er.category, st.current_state, er.currency, er.amount,
+			COALESCE((SELECT SUM(pe.amount) FROM paid_expense pe WHERE pe.expense_id = er.id), 0),
+			`+s.inBaseCurrency("1", "er.currency", "CURRENT_DATE")+`,
+			approval.created_at
+		FROM expense_request er
+		CROSS JOIN LATERAL (
+			SELECT ea.current_state
+			FROM expense_activity ea
+			WHERE ea.expense_id = er.id
+			ORDER BY ea.created_at DESC, ea.id DESC
+			LIMIT 1
+		) st
+		CROSS JOIN LATERAL (
+			SELECT MAX(ea.created_at) AS created_at
+			FROM expense_activity ea
+			WHERE ea.expense_id = er.id AND ea.current_state = ANY($2)
+		) approval
+		WHERE st.current_state = ANY($1) AND approval.created_at IS NOT NULL`+unitFilter+`
+		ORDER BY er.unit_id, approval.created_at, er.id
+	`, args...)
+	if err != nil {
+		log.Println("AgingReport query error:", err)
+		http.Error(w, "Database query failed", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	round := s.conversionRounding(r.Context()).Round
+	for rows.Next() {
+		var line AgingLine
+		var rate *float64
+		if err := rows.Scan(&line.ExpenseID, &line.DocNumber, &line.Reference, &line.UnitID, &line.Category, &line.State,
+			&line.Currency, &line.Amount, &line.Paid, &rate, &line.ApprovedAt); err != nil {
+			log.Println("Row scan error:", err)
+			http.Error(w, "Failed to read report data", http.StatusInternalServerError)
+			return
+		}
+		line.Outstanding = line.Amount - line.Paid
+		if line.Outstanding <= 0 {
+			continue
+		}
+		if rate != nil {
+			base := round(line.Outstanding.Mul(*rate))
+			line.OutstandingBase = &base
+		}
+		line.AgeDays = max(int(report.AsOf.Sub(line.ApprovedAt).Hours()/24), 0)
+		bucket := agingBucket(line.AgeDays)
+		line.Bucket = agingBuckets[bucket].label
+
+		n := len(report.Units)
+		if n == 0 || report.Units[n-1].UnitID != line.UnitID {
+			report.Units = append(report.Units, AgingUnit{UnitID: line.UnitID, Buckets: newAgingBuckets()})
+			n++
+		}
+		report.Units[n-1].Buckets[bucket].add(line)
+		report.Totals[bucket].add(line)
+		report.Lines = append(report.Lines, line)
+	}
+	if err := rows.Err(); err != nil {
+		log.Println("Row iteration error:", err)
+		http.Error(w, "Error reading results", http.StatusInternalServerError)
+		return
+	}
+
+	for i := range report.Totals {
+		report.Totals[i].Outstanding = round(report.Totals[i].Outstanding)
+	}
+	for _, unit := range report.Units {
+		for i := range unit.Buckets {
+			unit.Buckets[i].Outstanding = round(unit.Buckets[i].Outstanding)
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	if err := json.NewEncoder(w).Encode(report); err != nil {
+		log.Println("JSON encoding error:", err)
+	}
+}
@@ -1,23 +1,80 @@
 package server
 
 import (
+	"context"
 	"database/sql"
 	"encoding/json"
+	"fmt"
 	"log"
+	"main/query"
 	"net/http"
 	"strconv"
-	"strings"
 	"time"
 
 	"github.com/gorilla/mux"
 )
 
+// Announcement is a message to one user, to the members of a unit, to the
+// holders of a role, to the holders of a role within a unit, or with
+// Broadcast to everyone.
 type Announcement struct {
-	ID         int       `json:"id,omitempty"`
-	Message    string    `json:"message"`
-	ReceiverID int       `json:"receiverID"`
-	CreatedBy  int       `json:"createdBy"`
-	CreatedAt  time.Time `json:"createdAt"`
+	ID           int        `json:"id,omitempty"`
+	Message      string     `json:"message"`
+	ReceiverID   int        `json:"receiverID"`
+	ReceiverUnit string     `json:"receiverUnit"`
+	ReceiverRole UserRole   `json:"receiverRole"`
+	Broadcast    bool       `json:"broadcast"`
+	CreatedBy    int        `json:"createdBy"`
+	CreatedAt    time.Time  `json:"createdAt"`
+	ReadAt       *time.Time `json:"readAt,omitempty"` // when the caller read it, on the caller's own lists
+	// Mandatory announcements are emailed at once, ignoring the receiver's
+	// quiet hours and digest preferences
+	Mandatory bool `json:"mandatory"`
+}
+
+// announcementFields binds the announcement columns to the fields of a.
+func announcementFields(a *Announcement) []query.Field {
+	return []query.Field{
+		{Column: "id", Target: &a.ID},
+		{Column: "message", Target: &a.Message},
+		{Column: "receiver_id", Target: &a.ReceiverID},
+		{Column: "receiver_unit", Target: &a.ReceiverUnit},
+		{Column: "receiver_role", Target: &a.ReceiverRole},
+		{Column: "broadcast", Target: &a.Broadcast},
+		{Column: "created_by", Target: &a.CreatedBy},
+		{Column: "created_at", Target: &a.CreatedAt},
+		{Column: "mandatory", Target: &a.Mandatory},
+	}
+}
+
+var announcementColumns = query.Columns(announcementFields(&Announcement{}))
+
+func scanAnnouncement(row rowScanner) (Announcement, error) {
+	var a Announcement
+	err := row.Scan(query.Targets(announcementFields(&a))...)
+	return a, err
+}
+
+// visibleTo reports whether u is among the receivers of a.
+func (a Announcement) visibleTo(u User) bool {
+	switch {
+	case a.Broadcast:
+		return true
+	case a.ReceiverID != 0:
+		return a.ReceiverID == u.ID
+	case a.ReceiverUnit == "" && a.ReceiverRole == "":
+		return false
+	}
+	return (a.ReceiverUnit == "" || a.ReceiverUnit == u.UnitID) && (a.ReceiverRole == "" || a.ReceiverRole == u.RoleID)
+}
+
+// announcementVisibleTo is the SQL condition visibleTo checks, for the
+// announcement row alias and the user whose ID, unit and role are the
+// parameters id, unit and role.
+func announcementVisibleTo(alias, id, unit, role string) string {
+	return fmt.Sprintf(`(%[1]s.broadcast OR %[1]s.receiver_id = %[2]s OR
+		((%[1]s.receiver_unit <> '' OR %[1]s.receiver_role <> '') AND
+			%[1]s.receiver_unit IN ('', %[3]s) AND %[1]s.receiver_role IN ('', %[4]s)))`, alias, id, unit, role)
 }
 
 // type AAAnnouncement struct {
@@ -42,6 +99,72 @@ func (Announcement) CreateTableIfNotExists(s *Server) {
 	if err != nil {
 		log.Fatal(err)
 	}
+
+	_, err = s.DB.Exec(`ALTER TABLE announcement
+		ADD COLUMN IF NOT EXISTS mandatory BOOLEAN NOT NULL DEFAULT FALSE,
+		ADD COLUMN IF NOT EXISTS receiver_unit VARCHAR(256) NOT NULL DEFAULT '',
+		ADD COLUMN IF NOT EXISTS receiver_role VARCHAR(64) NOT NULL DEFAULT '',
+		ADD COLUMN IF NOT EXISTS broadcast BOOLEAN NOT NULL DEFAULT FALSE`)
+
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// Announcements without a receiver used to reach everyone's live stream
+	_, err = s.DB.Exec(`UPDATE announcement SET receiver_id = 0 WHERE receiver_id IS NULL;
+	UPDATE announcement SET broadcast = TRUE
+		WHERE receiver_id = 0 AND receiver_unit = '' AND receiver_role = '' AND NOT broadcast`)
+
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// Indexed for /search
+	_, err = s.DB.Exec(`ALTER TABLE announcement ADD COLUMN IF NOT EXISTS search_vector tsvector
+		GENERATED ALWAYS AS (to_tsvector('` + searchConfig + `', message)) STORED;
+	CREATE INDEX IF NOT EXISTS announcement_search_vector_idx ON announcement USING GIN (search_vector)`)
+
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+func (a Announcement) Validate(ctx context.Context, s *Server) (FieldErrors, error) {
+	errs := FieldErrors{}
+	if a.Message == "" {
+		errs.add("message", "is required")
+	}
+	group := a.ReceiverUnit != "" || a.ReceiverRole != ""
+	switch {
+	case a.Broadcast && (a.ReceiverID != 0 || group):
+		errs.add("broadcast", "cannot be combined with receiverID, receiverUnit or receiverRole")
+	case a.ReceiverID != 0 && group:
+		errs.add("receiverID", "cannot be combined with receiverUnit or receiverRole")
+	case !a.Broadcast && a.ReceiverID == 0 && !group:
+		errs.add("receiverID", "receiverID, receiverUnit, receiverRole or broadcast is required")
+	}
+	if a.ReceiverID != 0 {
+		if err := s.checkExists(ctx, errs, "receiverID", "user does not exist",
+			"SELECT 1 FROM users WHERE id = $1", a.ReceiverID); err != nil {
+			return nil, err
+		}
+	}
+	if a.ReceiverUnit != "" {
+		if err := s.checkExists(ctx, errs, "receiverUnit", "unit does not exist",
+			"SELECT 1 FROM unit WHERE name = $1", a.ReceiverUnit); err != nil {
+			return nil, err
+		}
+	}
+	if a.ReceiverRole != "" && !a.ReceiverRole.IsValid() {
+		errs.add("receiverRole", "must be one of Admin, Personnel, Manager, Accountant")
+	}
+	if a.CreatedBy != 0 {
+		if err := s.checkExists(ctx, errs, "createdBy", "user does not exist",
+			"SELECT 1 FROM users WHERE id = $1", a.CreatedBy); err != nil {
+			return nil, err
+		}
+	}
+	return errs, nil
 }
 
 func (s *Server) CreateAnnouncement(w http.ResponseWriter, r *http.Request) {
@@ -55,30 +178,105 @@ func (s *Server) CreateAnnouncement(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Validate required fields
-	if a.Message == "" || a.CreatedBy == 0 {
-		http.Error(w, "Missing required fields", http.StatusBadRequest)
-		log.Printf("asda:")
+	if !s.validate(w, r, a) {
+		return
+	}
+	if a.CreatedBy == 0 {
+		writeValidationErrors(w, FieldErrors{"createdBy": "is required"})
 		return
 	}
 
 	// Insert the announcement into the database
 	query := `
-		INSERT INTO announcement (message, receiver_id, created_by)
-		VALUES ($1, $2, $3)
+		INSERT INTO announcement (message, receiver_id, receiver_unit, receiver_role, broadcast, created_by, mandatory)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
 		RETURNING id, created_at
 	`
-	err := s.DB.QueryRow(query, a.Message, a.ReceiverID, a.CreatedBy).
+	err := s.DB.QueryRowContext(r.Context(), query, a.Message, a.ReceiverID, a.ReceiverUnit, a.ReceiverRole, a.Broadcast, a.CreatedBy, a.Mandatory).
 		Scan(&a.ID, &a.CreatedAt)
 	if err != nil {
 		log.Printf("CreateAnnouncement DB error: %v", err)
 		http.Error(w, "Database insert failed", http.StatusInternalServerError)
 		return
 	}
+	s.publish(Event{Type: EventAnnouncement, UserID: a.ReceiverID, UnitID: a.ReceiverUnit, Data: a})
+	kind := EmailAnnouncement
+	if a.Mandatory {
+		kind = EmailMandatoryAnnouncement
+	}
+	// A unit, role or everyone can be many receivers, so their emails are
+	// queued by a background job
+	if a.ReceiverID != 0 {
+		err = s.queueEmail(r.Context(), s.DB, a.ReceiverID, kind, a.Message)
+	} else {
+		_, err = enqueueJob(r.Context(), s.DB, JobAnnouncementEmail, announcementEmailJob{a.ID, kind}, time.Time{})
+	}
+	if err != nil {
+		log.Printf("CreateAnnouncement email error: %v", err)
+	}
 	// Respond with the newly created announcement
 	w.Header().Set("Content-Type", "application/json; charset=utf-8")
 	json.NewEncoder(w).Encode(a)
 }
 
+// announcementEmailJob is the payload of a JobAnnouncementEmail job.
+type announcementEmailJob struct {
+	AnnouncementID int    `json:"announcementID"`
+	Kind           string `json:"kind"` // EmailAnnouncement or EmailMandatoryAnnouncement
+}
+
+// runAnnouncementEmailJob queues an email to every receiver of a unit, role
+// or broadcast announcement. The emails are queued in one transaction, so
+// a failed attempt queues none and its retry emails nobody twice.
+func (s *Server) runAnnouncementEmailJob(ctx context.Context, payload json.RawMessage) error {
+	var job announcementEmailJob
+	if err := json.Unmarshal(payload, &job); err != nil {
+		return err
+	}
+	a, err := scanAnnouncement(s.DB.QueryRowContext(ctx,
+		"SELECT "+announcementColumns+" FROM announcement WHERE id = $1", job.AnnouncementID))
+	if err == sql.ErrNoRows {
+		// Deleted before it was sent
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	rows, err := s.DB.QueryContext(ctx, `
+		SELECT u.id FROM users u, announcement a
+		WHERE a.id = $1 AND `+announcementVisibleTo("a", "u.id", "u.unit_id", "u.role_id")+`
+		ORDER BY u.id
+	`, a.ID)
+	if err != nil {
+		return err
+	}
+	var receivers []int
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return err
+		}
+		receivers = append(receivers, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	tx, err := s.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for _, id := range receivers {
+		if err := s.queueEmail(ctx, tx, id, job.Kind, a.Message); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
 func (s *Server) GetAnnouncement(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	idStr := vars["id"]
@@ -88,19 +286,8 @@ func (s *Server) GetAnnouncement(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	var a Announcement
-	query := `
-		SELECT id, message, receiver_id, created_by, created_at
-		FROM announcement
-		WHERE id = $1
-	`
-	err = s.DB.QueryRow(query, id).Scan(
-		&a.ID,
-		&a.Message,
-		&a.ReceiverID,
-		&a.CreatedBy,
-		&a.CreatedAt,
-	)
+	a, err := scanAnnouncement(s.DB.QueryRowContext(r.Context(),
+		"SELECT "+announcementColumns+" FROM announcement WHERE id = $1", id))
 	if err == sql.ErrNoRows {
 		http.Error(w, "Announcement not found", http.StatusNotFound)
 		return
@@ -129,12 +316,16 @@ func (s *Server) UpdateAnnouncement(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if !s.validate(w, r, a) {
+		return
+	}
+
 	query := `
 		UPDATE announcement
-		SET message = $1, receiver_id = $2
-		WHERE id = $3
+		SET message = $1, receiver_id = $2, receiver_unit = $3, receiver_role = $4, broadcast = $5
+		WHERE id = $6
 	`
-	result, err := s.DB.Exec(query, a.Message, a.ReceiverID, id)
+	result, err := s.DB.ExecContext(r.Context(), query, a.Message, a.ReceiverID, a.ReceiverUnit, a.ReceiverRole, a.Broadcast, id)
 	if err != nil {
 		log.Printf("UpdateAnnouncement error: %v", err)
 		http.Error(w, "Database error", http.StatusInternalServerError)
@@ -154,6 +345,80 @@ func (s *Server) UpdateAnnouncement(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(http.StatusNoContent)
 }
 
+var announcementPatchFields = map[string]patchField{
+	"message":      patchAs[string]("message"),
+	"receiverID":   patchAs[int]("receiver_id"),
+	"receiverUnit": patchAs[string]("receiver_unit"),
+	"receiverRole": patchAs[string]("receiver_role"),
+	"broadcast":    patchAs[bool]("broadcast"),
+	"mandatory":    patchAs[bool]("mandatory"),
+}
+
+// announcementAudience are the fields that together name the receivers of
+// an announcement, with their values when not set.
+var announcementAudience = map[string]json.RawMessage{
+	"receiverID":   json.RawMessage("0"),
+	"receiverUnit": json.RawMessage(`""`),
+	"receiverRole": json.RawMessage(`""`),
+	"broadcast":    json.RawMessage("false"),
+}
+
+func (s *Server) PatchAnnouncement(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	idStr := vars["id"]
+	id, err := strconv.Atoi(idStr)
+	if err != nil {
+		http.Error(w, "Invalid ID", http.StatusBadRequest)
+		return
+	}
+
+	// Decode only the fields the client sent
+	var fields map[string]json.RawMessage
+	if err := json.NewDecoder(r.Body).Decode(&fields); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+	// A patch that changes the receivers replaces them as a whole, so the
+	// audience fields it leaves out are cleared
+	for field := range announcementAudience {
+		if _, ok := fields[field]; !ok {
+			continue
+		}
+		for field, unset := range announcementAudience {
+			if _, ok := fields[field]; !ok {
+				fields[field] = unset
+			}
+		}
+		break
+	}
+
+	set, args, err := buildPatch(fields, announcementPatchFields)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if !s.validatePatch(w, r, fields, &Announcement{}) {
+		return
+	}
+
+	query := "UPDATE announcement SET " + set + " WHERE id = " + args.Add(id) +
+		" RETURNING " + announcementColumns
+
+	a, err := scanAnnouncement(s.DB.QueryRowContext(r.Context(), query, args...))
+	if err == sql.ErrNoRows {
+		http.Error(w, "Announcement not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		log.Printf("PatchAnnouncement error: %v", err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(a)
+}
+
 func (s *Server) DeleteAnnouncement(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	idStr := vars["id"]
@@ -163,7 +428,7 @@ func (s *Server) DeleteAnnouncement(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	result, err := s.DB.Exec("DELETE FROM announcement WHERE id = $1", id)
+	result, err := s.DB.ExecContext(r.Context(), "DELETE FROM announcement WHERE id = $1", id)
 	if err != nil {
 		log.Printf("DeleteAnnouncement error: %v", err)
 		http.Error(w, "Database error", http.StatusInternalServerError)
@@ -183,40 +448,59 @@ func (s *Server) DeleteAnnouncement(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(http.StatusNoContent)
 }
 
+// ListAnnouncements lists announcements by their fields. visibleTo lists
+// those a user receives, whichever way they are addressed.
 func (s *Server) ListAnnouncements(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodGet {
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
 
-	filters := []string{}
-	args := []any{}
-	idx := 1
-
 	// Optional query parameters
-	if receiverID := r.URL.Query().Get("receiver_id"); receiverID != "" {
-		filters = append(filters, "receiver_id = $"+strconv.Itoa(idx))
-		args = append(args, receiverID)
-		idx++
-	}
-	if createdBy := r.URL.Query().Get("created_by"); createdBy != "" {
-		filters = append(filters, "created_by = $"+strconv.Itoa(idx))
-		args = append(args, createdBy)
-		idx++
+	params := r.URL.Query()
+	var receiver *User
+	if v := params.Get("visibleTo"); v != "" {
+		id, err := strconv.Atoi(v)
+		if err != nil {
+			http.Error(w, "Invalid visibleTo parameter", http.StatusBadRequest)
+			return
+		}
+		u, err := s.Users.Get(r.Context(), id)
+		if err != nil {
+			writeStoreError(w, err, "User not found")
+			return
+		}
+		receiver = &u
 	}
-	if message := r.URL.Query().Get("message"); message != "" {
-		filters = append(filters, "message ILIKE $"+strconv.Itoa(idx))
-		args = append(args, "%"+message+"%")
-		idx++
+
+	// Who receives an announcement also depends on the receiver's unit and
+	// role, which collection_change does not follow, so a visibleTo list
+	// is only validated by its ETag
+	var modified time.Time
+	if receiver == nil {
+		var err error
+		if modified, err = s.collectionModified(r.Context(), "announcement"); err != nil {
+			log.Println("Collection change lookup error:", err)
+		}
+		if notModifiedSince(r, modified) {
+			setLastModified(w, modified)
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
 	}
 
-	query := "SELECT id, message, receiver_id, created_by, created_at FROM announcement"
-	if len(filters) > 0 {
-		query += " WHERE " + strings.Join(filters, " AND ")
+	q := query.From("announcement a", announcementColumns).
+		WhereIf(params.Get("receiverID") != "", "receiver_id = ?", params.Get("receiverID")).
+		WhereIf(params.Get("receiverUnit") != "", "receiver_unit = ?", params.Get("receiverUnit")).
+		WhereIf(params.Get("receiverRole") != "", "receiver_role = ?", params.Get("receiverRole")).
+		WhereIf(params.Get("createdBy") != "", "created_by = ?", params.Get("createdBy")).
+		WhereIf(params.Get("message") != "", "message ILIKE ?", "%"+params.Get("message")+"%")
+	if receiver != nil {
+		q.Where(announcementVisibleTo("a", "?", "?", "?"), receiver.ID, receiver.UnitID, receiver.RoleID)
 	}
-	query += " ORDER BY created_at DESC"
+	statement, args := q.OrderBy("created_at DESC", "id DESC").SQL()
 
-	rows, err := s.DB.Query(query, args...)
+	rows, err := s.DB.QueryContext(r.Context(), statement, args...)
 	if err != nil {
 		http.Error(w, "Database query failed", http.StatusInternalServerError)
 		log.Println("ListAnnouncements error:", err)
@@ -226,8 +510,8 @@ func (s *Server) ListAnnouncements(w http.ResponseWriter, r *http.Request) {
 
 	var announcements []Announcement
 	for rows.Next() {
-		var a Announcement
-		if err := rows.Scan(&a.ID, &a.Message, &a.ReceiverID, &a.CreatedBy, &a.CreatedAt); err != nil {
+		a, err := scanAnnouncement(rows)
+		if err != nil {
 			http.Error(w, "Failed to scan announcement", http.StatusInternalServerError)
 			log.Println("Scan error:", err)
 			return
@@ -241,9 +525,5 @@ func (s *Server) ListAnnouncements(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	w.Header().Set("Content-Type", "application/json; charset=utf-8")
-	if err := json.NewEncoder(w).Encode(announcements); err != nil {
-		http.Error(w, "Encoding error", http.StatusInternalServerError)
-		log.Println("Encoding error:", err)
-	}
+	writeConditional(w, r, announcements, modified)
 }
@@ -0,0 +1,342 @@
+package server
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// APIKeyScope is what the requests of an API key may do, on top of what its
+// user's role allows.
+type APIKeyScope string
+
+const (
+	APIKeyRead     APIKeyScope = "read"     // GET requests only
+	APIKeyPayments APIKeyScope = "payments" // reads, and the writes of routes with this Scope: payments
+	APIKeyFull     APIKeyScope = "full"     // everything its user may do
+
+	// APIKeyNone is the Scope of routes no key may call; keys are never
+	// issued with it
+	APIKeyNone APIKeyScope = "none"
+)
+
+var apiKeyScopes = []APIKeyScope{APIKeyRead, APIKeyPayments, APIKeyFull}
+
+// apiKeyPrefix starts every key, so a leaked one is easy to spot in logs
+// and by secret scanners.
+const apiKeyPrefix = "ems_"
+
+// APIKey lets an integration call the API as a user, usually a service
+// account, without logging in. Key is only shown when the key is issued;
+// Prefix, its first characters, tells keys apart afterwards.
+type APIKey struct {
+	ID         int         `json:"id,omitempty"`
+	Name       string      `json:"name"`
+	UserID     int         `json:"userID"`
+	Scope      APIKeyScope `json:"scope"`
+	Key        string      `json:"key,omitempty"`
+	Prefix     string      `json:"prefix"`
+	ExpiresAt  *time.Time  `json:"expiresAt,omitempty"`
+	LastUsedAt *time.Time  `json:"lastUsedAt,omitempty"`
+	RevokedAt  *time.Time  `json:"revokedAt,omitempty"`
+	CreatedBy  int         `json:"createdBy"`
+	CreatedAt  time.Time   `json:"createdAt"`
+}
+
+func (APIKey) CreateTableIfNotExists(s *Server) {
+	query := `CREATE TABLE IF NOT EXISTS api_key (
+		id SERIAL PRIMARY KEY,
+		name VARCHAR(128) NOT NULL,
+		user_id INT NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+		scope VARCHAR(16) NOT NULL,
+		key_hash CHAR(64) NOT NULL UNIQUE,
+		prefix VARCHAR(16) NOT NULL,
+		expires_at TIMESTAMPTZ,
+		last_used_at TIMESTAMPTZ,
+		revoked_at TIMESTAMPTZ,
+		created_by INT NOT NULL,
+		created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+	)`
+
+	_, err := s.DB.Exec(query)
+
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+func (k APIKey) Validate(ctx context.Context, s *Server) (FieldErrors, error) {
+	errs := FieldErrors{}
+	if k.Name == "" {
+		errs.add("name", "is required")
+	} else if len(k.Name) > 128 {
+		errs.add("name", "must be at most 128 characters")
+	}
+	if !slices.Contains(apiKeyScopes, k.Scope) {
+		errs.add("scope", "must be read, payments or full")
+	}
+	if k.ExpiresAt != nil && !k.ExpiresAt.After(time.Now()) {
+		errs.add("expiresAt", "must be in the future")
+	}
+	if _, err := s.Users.Get(ctx, k.UserID); errors.Is(err, errNotFound) {
+		errs.add("userID", "no such user")
+	} else if err != nil {
+		return nil, err
+	}
+	return errs, nil
+}
+
+// scope is the narrowest API key scope that may call r.
+func (r Route) scope() APIKeyScope {
+	switch {
+	case r.Scope != "":
+		return r.Scope
+	case r.Method == http.MethodGet || r.Method == http.MethodHead:
+		return APIKeyRead
+	}
+	return APIKeyFull
+}
+
+// acceptsAPIKeys reports whether a route may be called with an API key.
+// Logins and the keys themselves are for people only, so a leaked key
+// cannot be used to issue more.
+func acceptsAPIKeys(route Route) bool {
+	return route.scope() != APIKeyNone
+}
+
+// allows reports whether a key of the scope may call route: scopes are
+// ordered as apiKeyScopes lists them, each allowing what the ones before
+// it do.
+func (scope APIKeyScope) allows(route Route) bool {
+	if !acceptsAPIKeys(route) {
+		return false
+	}
+	have := slices.Index(apiKeyScopes, scope)
+	return have >= 0 && have >= slices.Index(apiKeyScopes, route.scope())
+}
+
+type apiKeyContextKey struct{}
+
+// requestAPIKey returns the API key the request was authenticated with.
+func requestAPIKey(r *http.Request) (APIKey, bool) {
+	key, ok := r.Context().Value(apiKeyContextKey{}).(APIKey)
+	return key, ok
+}
+
+// useAPIKey looks up a key that is neither revoked nor expired, noting its
+// use.
+func (s *Server) useAPIKey(ctx context.Context, key string) (APIKey, error) {
+	k, err := scanAPIKey(s.DB.QueryRowContext(ctx, `
+		UPDATE api_key SET last_used_at = NOW()
+		WHERE key_hash = $1 AND revoked_at IS NULL AND (expires_at IS NULL OR expires_at > NOW())
+		RETURNING `+apiKeyColumns, hashToken(key)))
+	if err == sql.ErrNoRows {
+		return k, errUnauthorized
+	}
+	return k, err
+}
+
+// APIKeyMiddleware authenticates requests carrying an X-API-Key header and
+// refuses those the key's scope does not cover. authenticate then resolves
+// the key's user as it does the user of a bearer token.
+func (s *Server) APIKeyMiddleware(route Route, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get("X-API-Key")
+		if key == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if r.Header.Get("Authorization") != "" {
+			http.Error(w, "Send either an API key or a bearer token", http.StatusBadRequest)
+			return
+		}
+
+		apiKey, err := s.useAPIKey(r.Context(), key)
+		if errors.Is(err, errUnauthorized) {
+			http.Error(w, "Invalid API key", http.StatusUnauthorized)
+			return
+		} else if err != nil {
+			log.Println("API key error:", err)
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		if !apiKey.Scope.allows(route) {
+			http.Error(w, "API key scope does not allow this request", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), apiKeyContextKey{}, apiKey)))
+	})
+}
+
+const apiKeyColumns = "id, name, user_id, scope, prefix, expires_at, last_used_at, revoked_at, created_by, created_at"
+
+func scanAPIKey(row rowScanner) (APIKey, error) {
+	var k APIKey
+	var expiresAt, lastUsedAt, revokedAt sql.NullTime
+	err := row.Scan(&k.ID, &k.Name, &k.UserID, &k.Scope, &k.Prefix, &expiresAt, &lastUsedAt, &revokedAt, &k.CreatedBy, &k.CreatedAt)
+	if expiresAt.Valid {
+		k.ExpiresAt = &expiresAt.Time
+	}
+	if lastUsedAt.Valid {
+		k.LastUsedAt = &lastUsedAt.Time
+	}
+	if revokedAt.Valid {
+		k.RevokedAt = &revokedAt.Time
+	}
+	return k, err
+}
+
+// CreateAPIKey issues a key for a user. The key itself is only returned
+// here; the database keeps its hash.
+func (s *Server) CreateAPIKey(w http.ResponseWriter, r *http.Request) {
+	caller, ok := s.requireRole(w, r, Admin)
+	if !ok {
+		return
+	}
+
+	var k APIKey
+	if err := json.NewDecoder(r.Body).Decode(&k); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+	if !s.validate(w, r, k) {
+		return
+	}
+
+	token, err := newOpaqueToken()
+	if err != nil {
+		log.Println("API key error:", err)
+		http.Error(w, "Failed to issue API key", http.StatusInternalServerError)
+		return
+	}
+	key := apiKeyPrefix + token
+
+	tx, err := s.DB.BeginTx(r.Context(), nil)
+	if err != nil {
+		log.Println("Begin transaction error:", err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	k, err = scanAPIKey(tx.QueryRowContext(r.Context(), `
+		INSERT INTO api_key (name, user_id, scope, key_hash, prefix, expires_at, created_by)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
+		RETURNING `+apiKeyColumns,
+		k.Name, k.UserID, k.Scope, hashToken(key), key[:len(apiKeyPrefix)+8], k.ExpiresAt, caller.ID))
+	if err != nil {
+		log.Println("Insert API key error:", err)
+		http.Error(w, "Failed to issue API key", http.StatusInternalServerError)
+		return
+	}
+	if err := audit(r.Context(), tx, caller.ID, "api_keys.create",
+		map[string]any{"apiKeyID": k.ID, "userID": k.UserID, "scope": k.Scope}); err != nil {
+		log.Println("Audit error:", err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		log.Println("Commit error:", err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	k.Key = key
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(k)
+}
+
+// ListAPIKeys lists the keys issued, revoked ones included, newest first.
+func (s *Server) ListAPIKeys(w http.ResponseWriter, r *http.Request) {
+	if _, ok := s.requireRole(w, r, Admin); !ok {
+		return
+	}
+
+	rows, err := s.DB.QueryContext(r.Context(), "SELECT "+apiKeyColumns+" FROM api_key ORDER BY id DESC")
+	if err != nil {
+		log.Println("ListAPIKeys query error:", err)
+		http.Error(w, "Database query failed", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	keys := []APIKey{}
+	for rows.Next() {
+		k, err := scanAPIKey(rows)
+		if err != nil {
+			log.Println("Row scan error:", err)
+			http.Error(w, "Failed to read API key", http.StatusInternalServerError)
+			return
+		}
+		keys = append(keys, k)
+	}
+	if err := rows.Err(); err != nil {
+		log.Println("Row iteration error:", err)
+		http.Error(w, "Error reading results", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(keys)
+}
+
+// RevokeAPIKey stops a key from working. It stays listed, with when it was
+// revoked.
+func (s *Server) RevokeAPIKey(w http.ResponseWriter, r *http.Request) {
+	caller, ok := s.requireRole(w, r, Admin)
+	if !ok {
+		return
+	}
+
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid ID", http.StatusBadRequest)
+		return
+	}
+
+	tx, err := s.DB.BeginTx(r.Context(), nil)
+	if err != nil {
+		log.Println("Begin transaction error:", err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	result, err := tx.ExecContext(r.Context(),
+		"UPDATE api_key SET revoked_at = NOW() WHERE id = $1 AND revoked_at IS NULL", id)
+	if err != nil {
+		log.Println("RevokeAPIKey error:", err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		http.Error(w, "Error checking affected rows", http.StatusInternalServerError)
+		return
+	}
+	if rowsAffected == 0 {
+		http.Error(w, "API key not found", http.StatusNotFound)
+		return
+	}
+	if err := audit(r.Context(), tx, caller.ID, "api_keys.revoke", map[string]any{"apiKeyID": id}); err != nil {
+		log.Println("Audit error:", err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		log.Println("Commit error:", err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
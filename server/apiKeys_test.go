@@ -0,0 +1,56 @@
+package server
+
+import (
+	"net/http"
+	"slices"
+	"testing"
+)
+
+func TestAPIKeyScopeAllows(t *testing.T) {
+	read := Route{Method: "GET", Path: "/budgets"}
+	write := Route{Method: "POST", Path: "/budgets"}
+	payment := Route{Method: "POST", Path: "/paid_expenses", Scope: APIKeyPayments}
+	login := Route{Method: "POST", Path: "/login", Scope: APIKeyNone}
+	oidc := Route{Method: "GET", Path: "/oidc/login", Scope: APIKeyNone}
+
+	tests := []struct {
+		scope APIKeyScope
+		route Route
+		want  bool
+	}{
+		{APIKeyRead, read, true},
+		{APIKeyRead, write, false},
+		{APIKeyRead, payment, false},
+		{APIKeyPayments, read, true},
+		{APIKeyPayments, write, false},
+		{APIKeyPayments, payment, true},
+		{APIKeyFull, read, true},
+		{APIKeyFull, write, true},
+		{APIKeyFull, payment, true},
+		{APIKeyFull, login, false},
+		{APIKeyRead, oidc, false},
+		{APIKeyNone, read, false},
+		{"admin", read, false},
+	}
+	for _, tt := range tests {
+		if got := tt.scope.allows(tt.route); got != tt.want {
+			t.Errorf("%q allows %s %s = %v, want %v", tt.scope, tt.route.Method, tt.route.Path, got, tt.want)
+		}
+	}
+}
+
+func TestRouteScopes(t *testing.T) {
+	s := &Server{}
+	for _, route := range s.Routes() {
+		if route.Scope != "" && route.Scope != APIKeyNone && !slices.Contains(apiKeyScopes, route.Scope) {
+			t.Errorf("%s %s has an unknown scope %q", route.Method, route.Path, route.Scope)
+		}
+		if (route.Method == http.MethodGet || route.Method == http.MethodHead) && route.Scope != "" && route.Scope != APIKeyNone {
+			t.Errorf("%s %s narrows a read to %q, which every scope may do", route.Method, route.Path, route.Scope)
+		}
+		// Keys cannot sign in or manage keys, so a leaked one cannot issue more
+		if (route.Tag == "auth" || route.Tag == "api keys") && acceptsAPIKeys(route) {
+			t.Errorf("%s %s accepts API keys", route.Method, route.Path)
+		}
+	}
+}
@@ -0,0 +1,60 @@
+package server
+
+import (
+	"net/http"
+	"strings"
+	"time"
+)
+
+// APIVersion is the version of the REST API this server speaks, and
+// APIPrefix the path its routes are served under. A change that breaks
+// clients gets a new version next to this one rather than replacing it.
+const (
+	APIVersion = "1"
+	APIPrefix  = "/api/v1"
+)
+
+// legacyRoutesSunset ends the deprecation window in which the routes are
+// still served at the root, where they were before APIPrefix.
+var legacyRoutesSunset = time.Date(2027, time.April, 1, 0, 0, 0, 0, time.UTC)
+
+// APIVersionMiddleware answers every response with the API-Version header.
+// A client may send API-Version with the version it was written against;
+// one this server does not speak is refused with 400 rather than answered
+// in a shape the client does not expect.
+func APIVersionMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("API-Version", APIVersion)
+		if v := r.Header.Get("API-Version"); v != "" && strings.TrimPrefix(v, "v") != APIVersion {
+			http.Error(w, "Unsupported API-Version "+v+"; this server speaks "+APIVersion, http.StatusBadRequest)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// LegacyRouteMiddleware serves a route at its old root path until
+// legacyRoutesSunset, as an alias of the route under APIPrefix. Responses
+// carry Deprecation and Sunset headers and a successor-version Link to the
+// new path; after the sunset the alias answers 410 with the same Link.
+func LegacyRouteMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		successor := APIPrefix + r.URL.EscapedPath()
+		w.Header().Set("Link", "<"+successor+`>; rel="successor-version"`)
+		w.Header().Set("Deprecation", "true")
+		w.Header().Set("Sunset", legacyRoutesSunset.Format(http.TimeFormat))
+		if time.Now().After(legacyRoutesSunset) {
+			http.Error(w, "This route moved to "+successor, http.StatusGone)
+			return
+		}
+
+		// The handlers see the new path, so both spellings share an
+		// idempotency scope and log alike
+		r2 := r.Clone(r.Context())
+		r2.URL.Path = APIPrefix + r.URL.Path
+		if r2.URL.RawPath != "" {
+			r2.URL.RawPath = APIPrefix + r2.URL.RawPath
+		}
+		next.ServeHTTP(w, r2)
+	})
+}
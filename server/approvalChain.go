@@ -0,0 +1,404 @@
+package server
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"log"
+	"main/money"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/lib/pq"
+)
+
+// Approvers named by the steps of an approval policy. Admins may take any
+// step, and nobody takes two steps of the same chain.
+const (
+	approverUnitManager = "unitManager" // a Manager of the request's unit or their delegate
+	approverUnitPrefix  = "unit:"       // a Manager of the named unit, e.g. unit:Executive Management
+	approverRolePrefix  = "role:"       // anyone with the role, e.g. role:Accountant
+)
+
+// defaultApprovalSteps is the chain of requests no policy covers.
+var defaultApprovalSteps = []string{approverUnitManager}
+
+// ApprovalPolicy requires the approvals in Steps, in any order, for
+// requests of at least MinAmount in the base currency. An empty UnitID covers every
+// unit. The policy with the highest MinAmount a request reaches applies,
+// a unit's own winning over one for every unit at the same amount.
+type ApprovalPolicy struct {
+	ID        int          `json:"id,omitempty"`
+	UnitID    string       `json:"unitID"`
+	MinAmount money.Amount `json:"minAmount"`
+	Steps     []string     `json:"steps"`
+	CreatedAt *time.Time   `json:"createdAt,omitempty"`
+}
+
+func (ApprovalPolicy) CreateTableIfNotExists(s *Server) {
+	query := `CREATE TABLE IF NOT EXISTS approval_policy (
+		id SERIAL PRIMARY KEY,
+		unit_id VARCHAR(256) NOT NULL DEFAULT '',
+		min_amount NUMERIC(15,2) NOT NULL,
+		steps TEXT[] NOT NULL,
+		created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+		UNIQUE (unit_id, min_amount)
+	)`
+
+	_, err := s.DB.Exec(query)
+
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	widenAmountColumns(s, "approval_policy", "min_amount")
+}
+
+func (p ApprovalPolicy) Validate(ctx context.Context, s *Server) (FieldErrors, error) {
+	errs := FieldErrors{}
+	if p.MinAmount < 0 {
+		errs.add("minAmount", "must not be negative")
+	}
+	if len(p.Steps) == 0 {
+		errs.add("steps", "must name at least one approver")
+	}
+	for i, step := range p.Steps {
+		if err := s.checkApprover(ctx, errs, "steps."+strconv.Itoa(i), step); err != nil {
+			return nil, err
+		}
+	}
+	if p.UnitID != "" {
+		if err := s.checkExists(ctx, errs, "unitID", "unit does not exist",
+			"SELECT 1 FROM unit WHERE name = $1", p.UnitID); err != nil {
+			return nil, err
+		}
+	}
+	if err := s.checkUnique(ctx, errs, "minAmount", "a policy for this unit and amount exists already",
+		"SELECT 1 FROM approval_policy WHERE unit_id = $1 AND min_amount = $2", p.UnitID, p.MinAmount); err != nil {
+		return nil, err
+	}
+	return errs, nil
+}
+
+// checkApprover adds a field error unless step names an approver.
+func (s *Server) checkApprover(ctx context.Context, errs FieldErrors, field, step string) error {
+	switch {
+	case step == approverUnitManager:
+	case strings.HasPrefix(step, approverUnitPrefix):
+		return s.checkExists(ctx, errs, field, "unit does not exist",
+			"SELECT 1 FROM unit WHERE name = $1", strings.TrimPrefix(step, approverUnitPrefix))
+	case strings.HasPrefix(step, approverRolePrefix):
+		if !UserRole(strings.TrimPrefix(step, approverRolePrefix)).IsValid() {
+			errs.add(field, "names an unknown role")
+		}
+	default:
+		errs.add(field, "must be unitManager, unit:<unit> or role:<role>")
+	}
+	return nil
+}
+
+// ExpenseApproval records that a user took a step of a request's chain.
+// Approver is the step's approver at the time, so approvals stop counting
+// when a policy change puts someone else at that step.
+type ExpenseApproval struct{}
+
+func (ExpenseApproval) CreateTableIfNotExists(s *Server) {
+	query := `CREATE TABLE IF NOT EXISTS expense_approval (
+		expense_id INT NOT NULL,
+		step INT NOT NULL,
+		approver VARCHAR(300) NOT NULL,
+		approved_by INT NOT NULL,
+		created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+		PRIMARY KEY (expense_id, step, approver)
+	)`
+
+	_, err := s.DB.Exec(query)
+
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// ApprovalStep is one approval a request needs, taken or still pending.
+type ApprovalStep struct {
+	Approver   string     `json:"approver"`
+	ApprovedBy *int       `json:"approvedBy"` // nil while pending
+	ApprovedAt *time.Time `json:"approvedAt,omitempty"`
+}
+
+// ApprovalChain is where a request stands in the approvals it needs. The
+// request moves to Approved with the last of them.
+type ApprovalChain struct {
+	ExpenseID int            `json:"expenseID"`
+	PolicyID  *int           `json:"policyID"` // nil when no policy covers the request
+	Steps     []ApprovalStep `json:"steps"`
+	Complete  bool           `json:"complete"`
+
+	unitID string
+}
+
+// approvalChains loads the chains of the given requests, leaving out those
+// that do not exist.
+func (s *Server) approvalChains(ctx context.Context, db dbtx, ids []int) (map[int]*ApprovalChain, error) {
+	chains := map[int]*ApprovalChain{}
+	if len(ids) == 0 {
+		return chains, nil
+	}
+
+	rows, err := db.QueryContext(ctx, `
+		SELECT er.id, er.unit_id, p.id, COALESCE(p.steps, $2)
+		FROM expense_request er
+		LEFT JOIN LATERAL (
+			SELECT ap.id, ap.steps
+			FROM approval_policy ap
+			WHERE (ap.unit_id = er.unit_id OR ap.unit_id = '')
+				AND ap.min_amount <= COALESCE(`+s.inBaseCurrency("er.amount", "er.currency", "er.created_at::date")+`, er.amount)
+			ORDER BY ap.min_amount DESC, ap.unit_id DESC
+			LIMIT 1
+		) p ON true
+		WHERE er.id = ANY($1)
+	`, pq.Array(ids), pq.Array(defaultApprovalSteps))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		chain := &ApprovalChain{}
+		var steps []string
+		if err := rows.Scan(&chain.ExpenseID, &chain.unitID, &chain.PolicyID, pq.Array(&steps)); err != nil {
+			return nil, err
+		}
+		for _, approver := range steps {
+			chain.Steps = append(chain.Steps, ApprovalStep{Approver: approver})
+		}
+		chains[chain.ExpenseID] = chain
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	// Requests over their requester's limit need its escalation approver
+	// too, after the policy's steps
+	escalations, err := s.limitEscalations(ctx, db, ids)
+	if err != nil {
+		return nil, err
+	}
+	for id, approvers := range escalations {
+		chain := chains[id]
+		for _, approver := range approvers {
+			if !slices.ContainsFunc(chain.Steps, func(step ApprovalStep) bool { return step.Approver == approver }) {
+				chain.Steps = append(chain.Steps, ApprovalStep{Approver: approver})
+			}
+		}
+	}
+
+	rows, err = db.QueryContext(ctx, `
+		SELECT expense_id, step, approver, approved_by, created_at
+		FROM expense_approval
+		WHERE expense_id = ANY($1)
+	`, pq.Array(ids))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var expenseID, step, approvedBy int
+		var approver string
+		var approvedAt time.Time
+		if err := rows.Scan(&expenseID, &step, &approver, &approvedBy, &approvedAt); err != nil {
+			return nil, err
+		}
+		chain := chains[expenseID]
+		if chain != nil && step < len(chain.Steps) && chain.Steps[step].Approver == approver {
+			chain.Steps[step].ApprovedBy = &approvedBy
+			chain.Steps[step].ApprovedAt = &approvedAt
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	for _, chain := range chains {
+		chain.Complete = chain.nextStep(nil, nil) < 0
+	}
+	return chains, nil
+}
+
+// mayApprove reports whether user may take the step of a request of unit,
+// holding approvals of the units in delegated.
+func mayApprove(user User, step, unit string, delegated []string) bool {
+	switch {
+	case user.RoleID == Admin:
+		return true
+	case step == approverUnitManager:
+		return mayEnter(user, unit, Approved, delegated)
+	case strings.HasPrefix(step, approverUnitPrefix):
+		approving := strings.TrimPrefix(step, approverUnitPrefix)
+		return (user.RoleID == Manager && user.UnitID == approving) || slices.Contains(delegated, approving)
+	case strings.HasPrefix(step, approverRolePrefix):
+		return string(user.RoleID) == strings.TrimPrefix(step, approverRolePrefix)
+	}
+	return false
+}
+
+// nextStep returns the first pending step user may take, or -1. A nil user
+// takes any step, so nextStep(nil, nil) finds the first pending one.
+func (c *ApprovalChain) nextStep(user *User, delegated []string) int {
+	for _, step := range c.Steps {
+		if user != nil && step.ApprovedBy != nil && *step.ApprovedBy == user.ID {
+			return -1
+		}
+	}
+	for i, step := range c.Steps {
+		if step.ApprovedBy == nil && (user == nil || mayApprove(*user, step.Approver, c.unitID, delegated)) {
+			return i
+		}
+	}
+	return -1
+}
+
+// recordApproval has user take the step of the chain and reports whether it
+// was the last one pending.
+func recordApproval(ctx context.Context, db dbtx, chain *ApprovalChain, step int, user User) (bool, error) {
+	_, err := db.ExecContext(ctx, `
+		INSERT INTO expense_approval (expense_id, step, approver, approved_by)
+		VALUES ($1, $2, $3, $4)
+		ON CONFLICT (expense_id, step, approver) DO NOTHING
+	`, chain.ExpenseID, step, chain.Steps[step].Approver, user.ID)
+	if err != nil {
+		return false, err
+	}
+	now := time.Now()
+	chain.Steps[step].ApprovedBy, chain.Steps[step].ApprovedAt = &user.ID, &now
+	chain.Complete = chain.nextStep(nil, nil) < 0
+	return chain.Complete, nil
+}
+
+// GetExpenseApprovals shows which approvals a request has and which are
+// still pending.
+func (s *Server) GetExpenseApprovals(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid ID", http.StatusBadRequest)
+		return
+	}
+	if !s.readableExpenseRequest(w, r, id) {
+		return
+	}
+
+	chains, err := s.approvalChains(r.Context(), s.DB, []int{id})
+	if err != nil {
+		log.Println("Approval chain query error:", err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	chain, ok := chains[id]
+	if !ok {
+		http.Error(w, "Expense request not found", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(chain)
+}
+
+func (s *Server) ListApprovalPolicies(w http.ResponseWriter, r *http.Request) {
+	rows, err := s.DB.QueryContext(r.Context(), `
+		SELECT id, unit_id, min_amount, steps, created_at
+		FROM approval_policy
+		ORDER BY unit_id, min_amount
+	`)
+	if err != nil {
+		log.Println("Approval policy query error:", err)
+		http.Error(w, "Database query failed", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	policies := []ApprovalPolicy{}
+	for rows.Next() {
+		var p ApprovalPolicy
+		if err := rows.Scan(&p.ID, &p.UnitID, &p.MinAmount, pq.Array(&p.Steps), &p.CreatedAt); err != nil {
+			log.Println("Row scan error:", err)
+			http.Error(w, "Failed to scan approval policy", http.StatusInternalServerError)
+			return
+		}
+		policies = append(policies, p)
+	}
+	if err := rows.Err(); err != nil {
+		log.Println("Row iteration error:", err)
+		http.Error(w, "Row iteration error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(policies)
+}
+
+func (s *Server) CreateApprovalPolicy(w http.ResponseWriter, r *http.Request) {
+	caller, ok := s.requireRole(w, r, Admin)
+	if !ok {
+		return
+	}
+
+	var p ApprovalPolicy
+	if err := json.NewDecoder(r.Body).Decode(&p); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+	if !s.validate(w, r, p) {
+		return
+	}
+
+	err := s.DB.QueryRowContext(r.Context(), `
+		INSERT INTO approval_policy (unit_id, min_amount, steps)
+		VALUES ($1, $2, $3)
+		RETURNING id, created_at
+	`, p.UnitID, p.MinAmount, pq.Array(p.Steps)).Scan(&p.ID, &p.CreatedAt)
+	if err != nil {
+		log.Println("Insert approval policy error:", err)
+		http.Error(w, "Failed to create approval policy", http.StatusInternalServerError)
+		return
+	}
+	if err := audit(r.Context(), s.DB, caller.ID, "approval_policies.create", p); err != nil {
+		log.Println("Audit error:", err)
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(p)
+}
+
+func (s *Server) DeleteApprovalPolicy(w http.ResponseWriter, r *http.Request) {
+	caller, ok := s.requireRole(w, r, Admin)
+	if !ok {
+		return
+	}
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid ID", http.StatusBadRequest)
+		return
+	}
+
+	var p ApprovalPolicy
+	err = s.DB.QueryRowContext(r.Context(), `
+		DELETE FROM approval_policy WHERE id = $1
+		RETURNING id, unit_id, min_amount, steps, created_at
+	`, id).Scan(&p.ID, &p.UnitID, &p.MinAmount, pq.Array(&p.Steps), &p.CreatedAt)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Approval policy not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		log.Println("Delete approval policy error:", err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	if err := audit(r.Context(), s.DB, caller.ID, "approval_policies.delete", p); err != nil {
+		log.Println("Audit error:", err)
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
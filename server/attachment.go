@@ -0,0 +1,252 @@
+package server
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// maxAttachmentSize caps receipts at 10 MiB regardless of where they come from.
+const maxAttachmentSize = 10 << 20
+
+// allowedAttachmentTypes are the sniffed content types accepted as receipts.
+var allowedAttachmentTypes = []string{"application/pdf", "image/png", "image/jpeg"}
+
+var (
+	errAttachmentTooLarge = errors.New("Attachment exceeds 10 MiB")
+	errAttachmentType     = errors.New("Attachment must be a PDF, PNG or JPEG file")
+
+	// ErrAttachmentRejected should be wrapped by scanners that refuse a file.
+	ErrAttachmentRejected = errors.New("Attachment rejected by scanner")
+)
+
+// AttachmentScanner inspects attachment content before it is stored, e.g. by
+// handing it to an antivirus engine. Returning an error rejects the file.
+type AttachmentScanner interface {
+	Scan(filename string, data []byte) error
+}
+
+// NoopScanner accepts every file; it is the default when no scanner is wired in.
+type NoopScanner struct{}
+
+func (NoopScanner) Scan(string, []byte) error { return nil }
+
+type Attachment struct {
+	ID          int        `json:"id"`
+	ExpenseID   int        `json:"expenseID"`
+	Filename    string     `json:"filename"`
+	ContentType string     `json:"contentType"`
+	Size        int        `json:"size"`
+	SourceURL   string     `json:"sourceURL,omitempty"`
+	CreatedAt   *time.Time `json:"createdAt,omitempty"`
+}
+
+func (Attachment) CreateTableIfNotExists(s *Server) {
+	query := `CREATE TABLE IF NOT EXISTS expense_attachment (
+		id SERIAL PRIMARY KEY,
+		expense_id INT NOT NULL,
+		filename VARCHAR(256) NOT NULL,
+		content_type VARCHAR(128) NOT NULL,
+		size INT NOT NULL,
+		data BYTEA NOT NULL,
+		source_url TEXT NOT NULL DEFAULT '',
+		created_at timestamp DEFAULT NOW()
+	)`
+
+	_, err := s.DB.Exec(query)
+
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// checkAttachment is the gate every receipt goes through before storage: size
+// and type checks, then the configured scanner. It returns the sniffed
+// content type.
+func (s *Server) checkAttachment(filename string, data []byte) (string, error) {
+	if len(data) > maxAttachmentSize {
+		return "", errAttachmentTooLarge
+	}
+	contentType := http.DetectContentType(data)
+	if !slices.Contains(allowedAttachmentTypes, contentType) {
+		return "", errAttachmentType
+	}
+
+	scanner := s.Scanner
+	if scanner == nil {
+		scanner = NoopScanner{}
+	}
+	if err := scanner.Scan(filename, data); err != nil {
+		return "", err
+	}
+	return contentType, nil
+}
+
+// saveAttachment checks a receipt and stores it against an expense request.
+// db may be a transaction so callers can store the receipt atomically with
+// the request itself.
+func (s *Server) saveAttachment(ctx context.Context, db dbtx, expenseID int, filename string, data []byte, sourceURL string) (Attachment, error) {
+	a := Attachment{ExpenseID: expenseID, Filename: filename, Size: len(data), SourceURL: sourceURL}
+
+	contentType, err := s.checkAttachment(filename, data)
+	if err != nil {
+		return a, err
+	}
+	a.ContentType = contentType
+
+	if a.ID, err = nextID(ctx, db, "expense_attachment"); err != nil {
+		return a, err
+	}
+	err = db.QueryRowContext(ctx, `
+		INSERT INTO expense_attachment (id, expense_id, filename, content_type, size, data, source_url)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
+		RETURNING created_at
+	`, a.ID, a.ExpenseID, a.Filename, a.ContentType, a.Size, s.FieldKeys.SealBytes(attachmentData.field(a.ID), data), a.SourceURL).Scan(&a.CreatedAt)
+	return a, err
+}
+
+// writeAttachmentError maps pipeline rejections to 4xx and everything else to 500.
+func writeAttachmentError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, errAttachmentTooLarge):
+		http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+	case errors.Is(err, errAttachmentType):
+		http.Error(w, err.Error(), http.StatusUnsupportedMediaType)
+	case errors.Is(err, ErrAttachmentRejected):
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+	default:
+		log.Println("Attachment insert error:", err)
+		http.Error(w, "Failed to store attachment", http.StatusInternalServerError)
+	}
+}
+
+// UploadAttachment attaches a receipt to an expense request. Only its
+// requester or an Admin may.
+func (s *Server) UploadAttachment(w http.ResponseWriter, r *http.Request) {
+	expenseID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid ID", http.StatusBadRequest)
+		return
+	}
+	v, expense, ok := s.readExpenseRequestAs(w, r, expenseID)
+	if !ok {
+		return
+	}
+	if v.user.ID != expense.UserID && v.user.RoleID != Admin {
+		http.Error(w, "Only the requester may attach receipts to the expense request", http.StatusForbidden)
+		return
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, maxAttachmentSize+1<<20)
+	file, header, err := r.FormFile("file")
+	if err != nil {
+		http.Error(w, "Expected a multipart upload with a \"file\" field", http.StatusBadRequest)
+		return
+	}
+	defer file.Close()
+
+	data, err := io.ReadAll(io.LimitReader(file, maxAttachmentSize+1))
+	if err != nil {
+		http.Error(w, "Failed to read upload", http.StatusBadRequest)
+		return
+	}
+
+	a, err := s.saveAttachment(r.Context(), s.DB, expenseID, header.Filename, data, "")
+	if err != nil {
+		writeAttachmentError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(a)
+}
+
+func (s *Server) ListAttachments(w http.ResponseWriter, r *http.Request) {
+	expenseID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid ID", http.StatusBadRequest)
+		return
+	}
+	if !s.readableExpenseRequest(w, r, expenseID) {
+		return
+	}
+
+	rows, err := s.DB.QueryContext(r.Context(), `
+		SELECT id, expense_id, filename, content_type, size, source_url, created_at
+		FROM expense_attachment
+		WHERE expense_id = $1
+		ORDER BY created_at
+	`, expenseID)
+	if err != nil {
+		log.Println("ListAttachments query error:", err)
+		http.Error(w, "Database query failed", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	attachments := []Attachment{}
+	for rows.Next() {
+		var a Attachment
+		if err := rows.Scan(&a.ID, &a.ExpenseID, &a.Filename, &a.ContentType, &a.Size, &a.SourceURL, &a.CreatedAt); err != nil {
+			log.Println("Row scan error:", err)
+			http.Error(w, "Failed to scan attachment", http.StatusInternalServerError)
+			return
+		}
+		attachments = append(attachments, a)
+	}
+	if err := rows.Err(); err != nil {
+		log.Println("Row iteration error:", err)
+		http.Error(w, "Row iteration error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(attachments)
+}
+
+func (s *Server) DownloadAttachment(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	expenseID, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		http.Error(w, "Invalid ID", http.StatusBadRequest)
+		return
+	}
+	attachmentID, err := strconv.Atoi(vars["attachmentID"])
+	if err != nil {
+		http.Error(w, "Invalid attachment ID", http.StatusBadRequest)
+		return
+	}
+	if !s.readableExpenseRequest(w, r, expenseID) {
+		return
+	}
+
+	var filename, contentType string
+	var data []byte
+	err = s.DB.QueryRowContext(r.Context(), `
+		SELECT filename, content_type, data
+		FROM expense_attachment
+		WHERE id = $1 AND expense_id = $2
+	`, attachmentID, expenseID).Scan(&filename, &contentType, s.FieldKeys.OpenBytes(attachmentData.field(attachmentID), &data))
+	if err == sql.ErrNoRows {
+		http.Error(w, "Attachment not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		log.Println("DownloadAttachment query error:", err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", "attachment; filename="+strconv.Quote(filename))
+	w.Write(data)
+}
@@ -0,0 +1,97 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"main/query"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// AuditEntry records an administrative action and who performed it.
+type AuditEntry struct {
+	ID        int             `json:"id"`
+	ActorID   int             `json:"actorID"`
+	Action    string          `json:"action"`
+	Detail    json.RawMessage `json:"detail"`
+	CreatedAt time.Time       `json:"createdAt"`
+}
+
+func (AuditEntry) CreateTableIfNotExists(s *Server) {
+	query := `CREATE TABLE IF NOT EXISTS audit_log (
+		id SERIAL PRIMARY KEY,
+		actor_id INT NOT NULL,
+		action VARCHAR(64) NOT NULL,
+		detail JSONB NOT NULL DEFAULT '{}',
+		created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+	);
+	CREATE INDEX IF NOT EXISTS audit_log_action_idx ON audit_log (action, created_at)`
+
+	_, err := s.DB.Exec(query)
+
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// audit records an action, in the caller's transaction if db is one, so the
+// entry is only kept when the action itself commits.
+func audit(ctx context.Context, db dbtx, actorID int, action string, detail any) error {
+	body, err := json.Marshal(detail)
+	if err != nil {
+		return err
+	}
+	_, err = db.ExecContext(ctx,
+		"INSERT INTO audit_log (actor_id, action, detail) VALUES ($1, $2, $3)", actorID, action, body)
+	return err
+}
+
+func (s *Server) ListAuditLog(w http.ResponseWriter, r *http.Request) {
+	if _, ok := s.requireRole(w, r, Admin); !ok {
+		return
+	}
+
+	queryParams := r.URL.Query()
+	q := query.From("audit_log", "id, actor_id, action, detail, created_at").
+		WhereIf(queryParams.Get("action") != "", "action = ?", queryParams.Get("action"))
+	if actorID := queryParams.Get("actorID"); actorID != "" {
+		id, err := strconv.Atoi(actorID)
+		if err != nil {
+			http.Error(w, "Invalid actor_id parameter", http.StatusBadRequest)
+			return
+		}
+		q.Where("actor_id = ?", id)
+	}
+	statement, args := q.OrderBy("created_at DESC", "id DESC").Page(500, 0).SQL()
+
+	rows, err := s.DB.QueryContext(r.Context(), statement, args...)
+	if err != nil {
+		log.Println("ListAuditLog query error:", err)
+		http.Error(w, "Database query failed", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	entries := []AuditEntry{}
+	for rows.Next() {
+		var e AuditEntry
+		var detail []byte
+		if err := rows.Scan(&e.ID, &e.ActorID, &e.Action, &detail, &e.CreatedAt); err != nil {
+			log.Println("Row scan error:", err)
+			http.Error(w, "Failed to read audit entry", http.StatusInternalServerError)
+			return
+		}
+		e.Detail = detail
+		entries = append(entries, e)
+	}
+	if err := rows.Err(); err != nil {
+		log.Println("Row iteration error:", err)
+		http.Error(w, "Error reading results", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(entries)
+}
@@ -0,0 +1,274 @@
+package server
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// tokenTTL is how long an access token issued by Login or RefreshToken
+// stays valid. Clients renew it with their refresh token; see session.go.
+const tokenTTL = time.Hour
+
+var errUnauthorized = errors.New("unauthorized")
+
+// tokenClaims are registered JWT claims, so they keep the names RFC 7519
+// and the IANA claims registry give them. SessionID is zero for tokens that
+// do not belong to a login session, such as OperatorToken's.
+type tokenClaims struct {
+	Subject   string `json:"sub" naming:"external"`
+	Role      string `json:"role"`
+	ExpiresAt int64  `json:"exp" naming:"external"`
+	SessionID int    `json:"sid,omitempty" naming:"external"`
+}
+
+type loginRequest struct {
+	Name     string `json:"name"`
+	Password string `json:"password"`
+	Device   string `json:"device"` // shown in the session list; defaults to the User-Agent
+}
+
+type loginResponse struct {
+	Token            string    `json:"token"`
+	ExpiresAt        time.Time `json:"expiresAt"`
+	RefreshToken     string    `json:"refreshToken"`
+	RefreshExpiresAt time.Time `json:"refreshExpiresAt"`
+	SessionID        int       `json:"sessionID"`
+	User             User      `json:"user"`
+}
+
+var jwtHeader = base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"HS256","typ":"JWT"}`))
+
+// signToken issues an HS256 JWT for the given user and login session.
+func (s *Server) signToken(user User, sessionID int, expiresAt time.Time) (string, error) {
+	claims, err := json.Marshal(tokenClaims{
+		Subject:   strconv.Itoa(user.ID),
+		Role:      string(user.RoleID),
+		ExpiresAt: expiresAt.Unix(),
+		SessionID: sessionID,
+	})
+	if err != nil {
+		return "", err
+	}
+
+	unsigned := jwtHeader + "." + base64.RawURLEncoding.EncodeToString(claims)
+	mac := hmac.New(sha256.New, s.JWTSecret)
+	mac.Write([]byte(unsigned))
+	return unsigned + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil)), nil
+}
+
+// newOpaqueToken returns a random token for the secrets that are looked up
+// by their hash instead of being verified by a signature, such as refresh
+// tokens.
+func newOpaqueToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// hashToken is what is stored of an opaque token, so a leaked table does
+// not leak working tokens.
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// parseToken verifies the signature and expiry of a token and returns its claims.
+func (s *Server) parseToken(token string) (tokenClaims, error) {
+	var claims tokenClaims
+
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 || parts[0] != jwtHeader {
+		return claims, errUnauthorized
+	}
+
+	mac := hmac.New(sha256.New, s.JWTSecret)
+	mac.Write([]byte(parts[0] + "." + parts[1]))
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil || !hmac.Equal(signature, mac.Sum(nil)) {
+		return claims, errUnauthorized
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return claims, errUnauthorized
+	}
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return claims, errUnauthorized
+	}
+	if time.Now().Unix() >= claims.ExpiresAt {
+		return claims, errUnauthorized
+	}
+	return claims, nil
+}
+
+// bearerClaims returns the verified claims of the request's bearer token.
+func (s *Server) bearerClaims(r *http.Request) (tokenClaims, error) {
+	header := r.Header.Get("Authorization")
+	token, ok := strings.CutPrefix(header, "Bearer ")
+	if !ok || token == "" {
+		return tokenClaims{}, errUnauthorized
+	}
+	return s.parseToken(token)
+}
+
+// authenticate resolves the user behind the request's bearer token. The user
+// is re-read from the database so role and unit changes apply immediately,
+// and a token of a session that was logged out or has expired is refused.
+// Requests APIKeyMiddleware let through act as the user of their key.
+func (s *Server) authenticate(r *http.Request) (User, error) {
+	var user User
+
+	if key, ok := requestAPIKey(r); ok {
+		user, err := scanUser(s.DB.QueryRowContext(r.Context(), "SELECT "+userColumns+" FROM users WHERE id = $1", key.UserID))
+		if err == sql.ErrNoRows {
+			return user, errUnauthorized
+		}
+		return user, err
+	}
+
+	claims, err := s.bearerClaims(r)
+	if err != nil {
+		return user, err
+	}
+	id, err := strconv.Atoi(claims.Subject)
+	if err != nil {
+		return user, errUnauthorized
+	}
+
+	user, err = scanUser(s.DB.QueryRowContext(r.Context(), "SELECT "+userColumns+` FROM users
+		WHERE id = $1 AND ($2::int = 0 OR EXISTS (
+			SELECT 1 FROM session
+			WHERE session.id = $2 AND session.user_id = users.id
+				AND session.revoked_at IS NULL AND session.expires_at > NOW()
+		))`, id, claims.SessionID))
+	if err == sql.ErrNoRows {
+		return user, errUnauthorized
+	}
+	return user, err
+}
+
+// requireCaller authenticates the request and writes a 401 when it fails.
+func (s *Server) requireCaller(w http.ResponseWriter, r *http.Request) (User, bool) {
+	user, err := s.authenticate(r)
+	if errors.Is(err, errUnauthorized) {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return user, false
+	} else if err != nil {
+		log.Println("Authentication error:", err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return user, false
+	}
+	return user, true
+}
+
+// requireRole authenticates the request and writes a 403 unless the caller
+// holds one of the given roles.
+func (s *Server) requireRole(w http.ResponseWriter, r *http.Request, roles ...UserRole) (User, bool) {
+	user, ok := s.requireCaller(w, r)
+	if !ok {
+		return user, false
+	}
+	if !slices.Contains(roles, user.RoleID) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return user, false
+	}
+	return user, true
+}
+
+func (s *Server) Login(w http.ResponseWriter, r *http.Request) {
+	var req loginRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+
+	// Throttled attempts are turned away before the password is checked
+	address := clientAddress(r)
+	attempt, wait, locked, err := s.claimLoginAttempt(r.Context(), req.Name, address)
+	if err != nil {
+		log.Println("Login throttle error:", err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	if wait > 0 {
+		writeLoginBlocked(w, wait, locked)
+		return
+	}
+
+	// The attempt is settled even when the client has gone
+	settle := context.WithoutCancel(r.Context())
+	user, err := s.checkCredentials(r.Context(), req.Name, req.Password)
+	if errors.Is(err, errUnauthorized) {
+		if err := s.loginFailed(settle, attempt); err != nil {
+			log.Println("Login throttle error:", err)
+		}
+		http.Error(w, "Invalid credentials", http.StatusUnauthorized)
+		return
+	} else if err != nil {
+		if err := s.releaseLoginAttempt(settle, attempt); err != nil {
+			log.Println("Login throttle error:", err)
+		}
+		if errors.Is(err, errDirectoryUnavailable) {
+			http.Error(w, "Directory unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		log.Println("Login query error:", err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	if err := s.loginSucceeded(settle, attempt); err != nil {
+		log.Println("Login throttle error:", err)
+	}
+
+	response, err := s.issueLogin(r, user, req.Device)
+	if err != nil {
+		log.Println("Login error:", err)
+		http.Error(w, "Failed to issue token", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(response)
+}
+
+// issueLogin starts a session for user and signs its first access token.
+func (s *Server) issueLogin(r *http.Request, user User, device string) (loginResponse, error) {
+	session, refreshToken, err := s.startSession(r, user.ID, device)
+	if err != nil {
+		return loginResponse{}, fmt.Errorf("starting session: %w", err)
+	}
+
+	expiresAt := time.Now().Add(tokenTTL)
+	token, err := s.signToken(user, session.ID, expiresAt)
+	if err != nil {
+		return loginResponse{}, fmt.Errorf("signing token: %w", err)
+	}
+
+	// Never echo the password back
+	user.Password = ""
+
+	return loginResponse{
+		Token:            token,
+		ExpiresAt:        expiresAt,
+		RefreshToken:     refreshToken,
+		RefreshExpiresAt: session.ExpiresAt,
+		SessionID:        session.ID,
+		User:             user,
+	}, nil
+}
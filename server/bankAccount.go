@@ -0,0 +1,274 @@
+package server
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"main/bankfile"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// BankAccount is where a user's expenses are paid to. It is kept apart from
+// the user so that only its owner, Admins and the bank files see it.
+type BankAccount struct {
+	UserID    int        `json:"userID"`
+	Holder    string     `json:"holder"` // the user's name when empty
+	IBAN      string     `json:"iban"`
+	BIC       string     `json:"bic"`
+	UpdatedAt *time.Time `json:"updatedAt,omitempty"`
+}
+
+func (BankAccount) CreateTableIfNotExists(s *Server) {
+	query := `CREATE TABLE IF NOT EXISTS bank_account (
+		user_id INT PRIMARY KEY,
+		holder VARCHAR(140) NOT NULL DEFAULT '',
+		iban TEXT NOT NULL,
+		bic VARCHAR(11) NOT NULL DEFAULT '',
+		updated_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+	)`
+
+	_, err := s.DB.Exec(query)
+
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+func (a BankAccount) Validate(ctx context.Context, s *Server) (FieldErrors, error) {
+	errs := FieldErrors{}
+	if a.IBAN == "" {
+		errs.add("iban", "is required")
+	} else if !bankfile.ValidIBAN(a.IBAN) {
+		errs.add("iban", "is not a valid IBAN")
+	}
+	if a.BIC != "" && !bankfile.ValidBIC(a.BIC) {
+		errs.add("bic", "must be an 8 or 11 character BIC")
+	}
+	if len(a.Holder) > 140 {
+		errs.add("holder", "must be at most 140 characters")
+	}
+	return errs, nil
+}
+
+func (s *Server) GetBankAccount(w http.ResponseWriter, r *http.Request) {
+	_, userID, ok := s.selfOrAdmin(w, r)
+	if !ok {
+		return
+	}
+
+	a := BankAccount{UserID: userID}
+	err := s.DB.QueryRowContext(r.Context(),
+		"SELECT holder, iban, bic, updated_at FROM bank_account WHERE user_id = $1", userID,
+	).Scan(&a.Holder, s.FieldKeys.Open(bankAccountIBAN.field(userID), &a.IBAN), &a.BIC, &a.UpdatedAt)
+	if err == sql.ErrNoRows {
+		http.Error(w, "No bank account on file", http.StatusNotFound)
+		return
+	} else if err != nil {
+		log.Println("Bank account query error:", err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(a)
+}
+
+// PutBankAccount sets the account a user's expenses are paid to.
+func (s *Server) PutBankAccount(w http.ResponseWriter, r *http.Request) {
+	caller, userID, ok := s.selfOrAdmin(w, r)
+	if !ok {
+		return
+	}
+
+	var a BankAccount
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&a); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+	a.UserID = userID
+	a.IBAN = bankfile.NormalizeIBAN(a.IBAN)
+	a.BIC = strings.ToUpper(strings.TrimSpace(a.BIC))
+	if !s.validate(w, r, a) {
+		return
+	}
+	if _, err := s.Users.Get(r.Context(), userID); err != nil {
+		writeStoreError(w, err, "User not found")
+		return
+	}
+
+	err := s.DB.QueryRowContext(r.Context(), `
+		INSERT INTO bank_account (user_id, holder, iban, bic)
+		VALUES ($1, $2, $3, $4)
+		ON CONFLICT (user_id) DO UPDATE SET holder = $2, iban = $3, bic = $4, updated_at = NOW()
+		RETURNING updated_at
+	`, a.UserID, a.Holder, s.FieldKeys.Seal(bankAccountIBAN.field(a.UserID), a.IBAN), a.BIC).Scan(&a.UpdatedAt)
+	if err != nil {
+		log.Println("Bank account upsert error:", err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	// The audit trail records that the account changed, not the account
+	detail := map[string]any{"userID": userID, "iban": maskIBAN(a.IBAN)}
+	if err := audit(r.Context(), s.DB, caller.ID, "bank_accounts.update", detail); err != nil {
+		log.Println("Audit error:", err)
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(a)
+}
+
+// maskIBAN keeps the country and the last four characters of an IBAN.
+func maskIBAN(iban string) string {
+	if len(iban) <= 6 {
+		return iban
+	}
+	return iban[:2] + strings.Repeat("*", len(iban)-6) + iban[len(iban)-4:]
+}
+
+// errMissingAccounts lists the payees of a batch without a bank account.
+type errMissingAccounts []string
+
+func (e errMissingAccounts) Error() string {
+	return "no bank account on file for " + strings.Join(e, ", ")
+}
+
+// bankAccounts returns the accounts on file for the keys query selects
+// with, keyed by its first column. iban is the column of the IBANs.
+func (s *Server) bankAccounts(ctx context.Context, query string, iban sealedColumn, ids []int) (map[int]bankfile.Account, error) {
+	rows, err := s.DB.QueryContext(ctx, query, pq.Array(ids))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	accounts := map[int]bankfile.Account{}
+	for rows.Next() {
+		var id int
+		var a bankfile.Account
+		var sealed string
+		if err := rows.Scan(&id, &a.Name, &sealed, &a.BIC); err != nil {
+			return nil, err
+		}
+		if a.IBAN, err = s.FieldKeys.DecryptString(iban.field(id), sealed); err != nil {
+			return nil, err
+		}
+		accounts[id] = a
+	}
+	return accounts, rows.Err()
+}
+
+// bankPayments turns the payments of a batch into transfers to the bank
+// accounts of their vendors, or of their requesters when they have none.
+func (s *Server) bankPayments(ctx context.Context, batch PaymentBatch) ([]bankfile.Payment, error) {
+	var userIDs, vendorIDs []int
+	for _, item := range batch.Items {
+		if item.VendorID != nil {
+			vendorIDs = append(vendorIDs, *item.VendorID)
+		} else {
+			userIDs = append(userIDs, item.RequesterID)
+		}
+	}
+	users, err := s.bankAccounts(ctx, "SELECT user_id, holder, iban, bic FROM bank_account WHERE user_id = ANY($1)", bankAccountIBAN, userIDs)
+	if err != nil {
+		return nil, err
+	}
+	// Vendors are kept without an account until one is needed
+	vendors, err := s.bankAccounts(ctx, "SELECT id, name, iban, bic FROM vendor WHERE id = ANY($1) AND iban <> ''", vendorIBAN, vendorIDs)
+	if err != nil {
+		return nil, err
+	}
+
+	var missing errMissingAccounts
+	payments := make([]bankfile.Payment, len(batch.Items))
+	for i, item := range batch.Items {
+		var account bankfile.Account
+		var ok bool
+		if item.VendorID != nil {
+			if account, ok = vendors[*item.VendorID]; !ok {
+				missing = append(missing, fmt.Sprintf("%s (vendor %d)", item.VendorName, *item.VendorID))
+				continue
+			}
+		} else if account, ok = users[item.RequesterID]; !ok {
+			missing = append(missing, fmt.Sprintf("%s (user %d)", item.RequesterName, item.RequesterID))
+			continue
+		}
+		if account.Name == "" {
+			account.Name = item.RequesterName
+		}
+		payments[i] = bankfile.Payment{
+			Creditor:   account,
+			Amount:     item.Amount,
+			Currency:   item.Currency,
+			Reference:  "Expense request " + item.DocNumber,
+			EndToEndID: item.DocNumber,
+		}
+	}
+	if len(missing) > 0 {
+		return nil, missing
+	}
+	return payments, nil
+}
+
+// ExportPaymentBatch writes a batch as a file for the bank: SEPA pain.001
+// XML by default, or CSV in the configured layout with format=csv.
+func (s *Server) ExportPaymentBatch(w http.ResponseWriter, r *http.Request) {
+	format := r.URL.Query().Get("format")
+	switch format {
+	case "":
+		format = "pain.001"
+	case "pain.001", "csv":
+	default:
+		http.Error(w, "format must be pain.001 or csv", http.StatusBadRequest)
+		return
+	}
+	if format == "pain.001" && s.PaymentDebtor.IBAN == "" {
+		http.Error(w, "No debtor account is configured for SEPA files", http.StatusConflict)
+		return
+	}
+
+	batch, ok := s.paymentBatchFromPath(w, r)
+	if !ok {
+		return
+	}
+	payments, err := s.bankPayments(r.Context(), batch)
+	var missing errMissingAccounts
+	if errors.As(err, &missing) {
+		http.Error(w, "Cannot export: "+missing.Error(), http.StatusConflict)
+		return
+	} else if err != nil {
+		log.Println("Bank account query error:", err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	var body []byte
+	var contentType, extension string
+	if format == "csv" {
+		body, err = bankfile.CSV(s.PaymentCSVColumns, payments)
+		contentType, extension = "text/csv; charset=utf-8", "csv"
+	} else {
+		messageID := fmt.Sprintf("EMS-BATCH-%d", batch.ID)
+		body, err = bankfile.Pain001(messageID, batch.CreatedAt, time.Now(), s.PaymentDebtor, payments)
+		contentType, extension = "application/xml", "xml"
+	}
+	if errors.Is(err, bankfile.ErrNotSEPA) {
+		http.Error(w, "Cannot export: "+err.Error(), http.StatusConflict)
+		return
+	} else if err != nil {
+		log.Println("Bank file error:", err)
+		http.Error(w, "Failed to write bank file", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="payment-batch-%d.%s"`, batch.ID, extension))
+	w.Write(body)
+}
@@ -1,22 +1,52 @@
 package server
 
 import (
-	"database/sql"
+	"context"
 	"encoding/json"
 	"log"
+	"main/money"
+	"main/query"
 	"net/http"
+	"net/url"
 	"strconv"
-	"strings"
 
 	"github.com/gorilla/mux"
+	"github.com/lib/pq"
 )
 
 type Budget struct {
-	UnitID         string  `json:"unitID"`
-	Category       string  `json:"category"`
-	Year           int     `json:"year"`
-	BudgetLimit    float64 `json:"budgetLimit"`
-	ThresholdRatio float64 `json:"thresholdRatio"`
+	UnitID         string       `json:"unitID"`
+	Category       string       `json:"category"`
+	Year           int          `json:"year"`
+	BudgetLimit    money.Amount `json:"budgetLimit"`
+	Currency       string       `json:"currency"`
+	ThresholdRatio float64      `json:"thresholdRatio"`
+	Period         BudgetPeriod `json:"period,omitempty"`  // set through its allocations; see budgetAllocation.go
+	Version        int          `json:"version,omitempty"` // sent as the ETag; see concurrency.go
+}
+
+// budgetFields binds the budget columns to the fields of b.
+func budgetFields(b *Budget) []query.Field {
+	return []query.Field{
+		{Column: "unit_id", Target: &b.UnitID},
+		{Column: "expense_category", Target: &b.Category},
+		{Column: "year", Target: &b.Year},
+		{Column: "budget_limit", Target: &b.BudgetLimit},
+		{Column: "threshold_ratio", Target: &b.ThresholdRatio},
+		{Column: "currency", Target: &b.Currency},
+		{Column: "period", Target: &b.Period},
+		{Column: "version", Target: &b.Version},
+	}
+}
+
+// budgetColumns is the column list every budget query selects, in the order
+// scanBudget expects.
+var budgetColumns = query.Columns(budgetFields(&Budget{}))
+
+func scanBudget(row rowScanner) (Budget, error) {
+	var b Budget
+	err := row.Scan(query.Targets(budgetFields(&b))...)
+	return b, err
 }
 
 func (Budget) CreateTableIfNotExists(s *Server) {
@@ -35,37 +65,129 @@ func (Budget) CreateTableIfNotExists(s *Server) {
 	if err != nil {
 		log.Fatal(err)
 	}
+
+	_, err = s.DB.Exec("ALTER TABLE budget ADD COLUMN IF NOT EXISTS currency CHAR(3) NOT NULL DEFAULT " + pq.QuoteLiteral(s.BaseCurrency))
+
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	_, err = s.DB.Exec("ALTER TABLE budget ADD COLUMN IF NOT EXISTS version INT NOT NULL DEFAULT 1")
+
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	_, err = s.DB.Exec("ALTER TABLE budget ADD COLUMN IF NOT EXISTS period VARCHAR(8) NOT NULL DEFAULT ''")
+
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+const (
+	minBudgetYear = 2000
+	maxBudgetYear = 2100
+)
+
+func (b Budget) Validate(ctx context.Context, s *Server) (FieldErrors, error) {
+	errs := FieldErrors{}
+	if b.Year < minBudgetYear || b.Year > maxBudgetYear {
+		errs.add("year", "must be between 2000 and 2100")
+	}
+	if b.BudgetLimit <= 0 || b.BudgetLimit > money.Max {
+		errs.add("budgetLimit", "must be greater than 0 and at most "+money.Max.String())
+	}
+	if b.ThresholdRatio < 0 || b.ThresholdRatio > 1 {
+		errs.add("thresholdRatio", "must be between 0 and 1")
+	}
+
+	if err := s.checkExists(ctx, errs, "unitID", "unit does not exist",
+		"SELECT 1 FROM unit WHERE name = $1", b.UnitID); err != nil {
+		return nil, err
+	}
+	if err := s.checkExists(ctx, errs, "category", "category does not exist",
+		"SELECT 1 FROM expense_category WHERE name = $1", b.Category); err != nil {
+		return nil, err
+	}
+	if err := s.checkCurrency(ctx, errs, "currency", b.Currency); err != nil {
+		return nil, err
+	}
+	return errs, nil
+}
+
+// createBudget validates and creates a budget, recording its limit as its
+// first revision.
+func (s *Server) createBudget(ctx context.Context, budget Budget, reason string, approvedBy int) (Budget, error) {
+	if err := s.checkValid(ctx, budget); err != nil {
+		return budget, err
+	}
+	budget, err := s.Budgets.Create(ctx, budget)
+	if err != nil {
+		return budget, err
+	}
+	key := BudgetKey{budget.UnitID, budget.Category, budget.Year}
+	if err := recordBudgetRevision(ctx, s.DB, key, nil, &budget.BudgetLimit, budget.Currency, reason, approvedBy); err != nil {
+		log.Println("Budget revision insert error:", err)
+	}
+	s.publish(Event{Type: EventBudgetChanged, UnitID: budget.UnitID, Data: budget})
+	return budget, nil
+}
+
+// updateBudget validates and replaces the budget at key, which budget may
+// move, recording a change of its limit as a revision.
+func (s *Server) updateBudget(ctx context.Context, key BudgetKey, budget Budget, reason string, versions []int64, approvedBy int) (Budget, error) {
+	if err := s.checkValid(ctx, budget); err != nil {
+		return budget, err
+	}
+	before, err := s.Budgets.Get(ctx, key)
+	if err != nil {
+		return budget, err
+	}
+	budget, err = s.Budgets.Update(ctx, key, budget, pinVersion(versions, before.Version))
+	if err != nil {
+		return budget, err
+	}
+	s.reviseBudget(ctx, before, budget, reason, approvedBy)
+	s.publish(Event{Type: EventBudgetChanged, Data: budget})
+	return budget, nil
+}
+
+// deleteBudget deletes the budget at key, recording the removal of its
+// limit as a revision.
+func (s *Server) deleteBudget(ctx context.Context, key BudgetKey, reason string, approvedBy int) error {
+	before, err := s.Budgets.Get(ctx, key)
+	if err != nil {
+		return err
+	}
+	if err := s.Budgets.Delete(ctx, key); err != nil {
+		return err
+	}
+	if err := recordBudgetRevision(ctx, s.DB, key, &before.BudgetLimit, nil, before.Currency, reason, approvedBy); err != nil {
+		log.Println("Budget revision insert error:", err)
+	}
+	s.publish(Event{Type: EventBudgetChanged, UnitID: key.UnitID})
+	return nil
 }
 
 func (s *Server) CreateBudget(w http.ResponseWriter, r *http.Request) {
 	// Decode JSON request body into Budget struct
-	var budget Budget
-	if err := json.NewDecoder(r.Body).Decode(&budget); err != nil {
+	var change budgetChange
+	if err := json.NewDecoder(r.Body).Decode(&change); err != nil {
 		http.Error(w, "Invalid JSON", http.StatusBadRequest)
 		return
 	}
+	budget := change.Budget
+	budget.Currency = s.currencyOrBase(budget.Currency)
 
-	// Insert into database
-	query := `
-		INSERT INTO budget (unit_id, expense_category, year, budget_limit, threshold_ratio)
-		VALUES ($1, $2, $3, $4, $5)
-	`
-
-	_, err := s.DB.Exec(
-		query,
-		budget.UnitID,
-		budget.Category,
-		budget.Year,
-		budget.BudgetLimit,
-		budget.ThresholdRatio,
-	)
+	budget, err := s.createBudget(r.Context(), budget, change.Reason, s.callerID(r))
 	if err != nil {
-		log.Println("Insert budget error:", err)
-		http.Error(w, "Failed to create budget", http.StatusInternalServerError)
+		writeStoreError(w, err, "Budget not found")
 		return
 	}
 
 	// Respond with 201 Created
+	setVersionETag(w, budget.Version)
 	w.WriteHeader(http.StatusCreated)
 	w.Header().Set("Content-Type", "application/json; charset=utf-8")
 	json.NewEncoder(w).Encode(budget)
@@ -74,7 +196,7 @@ func (s *Server) CreateBudget(w http.ResponseWriter, r *http.Request) {
 func (s *Server) GetBudget(w http.ResponseWriter, r *http.Request) {
 	// Parse query parameters
 	vars := mux.Vars(r)
-	unitID := vars["unit_id"]
+	unitID := vars["unitID"]
 	category := vars["category"]
 	yearStr := vars["year"]
 	// unitID := r.URL.Query().Get("unit_id")
@@ -92,36 +214,51 @@ func (s *Server) GetBudget(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	var budget Budget
-	query := `
-		SELECT unit_id, expense_category, year, budget_limit, threshold_ratio
-		FROM budget
-		WHERE unit_id = $1 AND expense_category = $2 AND year = $3
-	`
-	err = s.DB.QueryRow(query, unitID, category, year).Scan(
-		&budget.UnitID,
-		&budget.Category,
-		&budget.Year,
-		&budget.BudgetLimit,
-		&budget.ThresholdRatio,
-	)
-
-	if err == sql.ErrNoRows {
-		http.Error(w, "Budget not found", http.StatusNotFound)
+	asOf, ok := asOfParam(w, r)
+	if !ok {
 		return
-	} else if err != nil {
-		log.Println("Get budget error:", err)
-		http.Error(w, "Database error", http.StatusInternalServerError)
+	}
+
+	budget, err := s.Budgets.Get(r.Context(), BudgetKey{unitID, category, year})
+	if err != nil {
+		writeStoreError(w, err, "Budget not found")
+		return
+	}
+	env := envelopeOf(r)
+	self := "/budgets/" + url.PathEscape(unitID) + "/" + url.PathEscape(category) + "/" + yearStr
+	env.link("revisions", self+"/revisions")
+	env.link("forecast", self+"/forecast")
+	env.link("allocations", self+"/allocations")
+	env.link("expenseRequests", "/expense_requests?"+url.Values{"unitID": {unitID}, "category": {category}}.Encode())
+	if asOf != nil {
+		var limit *money.Amount
+		err := s.DB.QueryRowContext(r.Context(), "SELECT "+budgetLimitAsOf("b", "$4")+`
+			FROM budget b WHERE b.unit_id = $1 AND b.expense_category = $2 AND b.year = $3
+		`, unitID, category, year, *asOf).Scan(&limit)
+		if err != nil {
+			log.Println("Budget revision query error:", err)
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		if limit == nil {
+			http.Error(w, "Budget did not exist at asOf", http.StatusNotFound)
+			return
+		}
+		// A past state is not something to write back to
+		budget.BudgetLimit = *limit
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		json.NewEncoder(w).Encode(budget)
 		return
 	}
 
+	setVersionETag(w, budget.Version)
 	w.Header().Set("Content-Type", "application/json; charset=utf-8")
 	json.NewEncoder(w).Encode(budget)
 }
 
 func (s *Server) UpdateBudget(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
-	unitID := vars["unit_id"]
+	unitID := vars["unitID"]
 	category := vars["category"]
 	yearStr := vars["year"]
 	year, err := strconv.Atoi(yearStr)
@@ -129,12 +266,18 @@ func (s *Server) UpdateBudget(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Invalid year", http.StatusBadRequest)
 		return
 	}
+	versions, ok := ifMatchVersions(w, r)
+	if !ok {
+		return
+	}
 	// Decode the JSON body
-	var budget Budget
-	if err := json.NewDecoder(r.Body).Decode(&budget); err != nil {
+	var change budgetChange
+	if err := json.NewDecoder(r.Body).Decode(&change); err != nil {
 		http.Error(w, "Invalid JSON", http.StatusBadRequest)
 		return
 	}
+	budget := change.Budget
+	budget.Currency = s.currencyOrBase(budget.Currency)
 
 	// Ensure all required fields are present
 	if unitID == "" || category == "" || year == 0 {
@@ -142,48 +285,83 @@ func (s *Server) UpdateBudget(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Check if budget record exists
-	var exists bool
-	checkQuery := `
-		SELECT EXISTS (
-			SELECT 1 FROM budget
-			WHERE unit_id = $1 AND expense_category = $2 AND year = $3
-		)
-	`
-	err = s.DB.QueryRow(checkQuery, unitID, category, year).Scan(&exists)
+	budget, err = s.updateBudget(r.Context(), BudgetKey{unitID, category, year}, budget, change.Reason, versions, s.callerID(r))
 	if err != nil {
-		log.Println("Error checking existence:", err)
-		http.Error(w, "Database error", http.StatusInternalServerError)
+		writeStoreError(w, err, "Budget record not found")
 		return
 	}
-	if !exists {
-		http.Error(w, "Budget record not found", http.StatusNotFound)
+
+	// Respond with updated budget
+	setVersionETag(w, budget.Version)
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(budget)
+}
+
+var budgetPatchFields = map[string]patchField{
+	"unitID":         patchAs[string]("unit_id"),
+	"category":       patchAs[string]("expense_category"),
+	"year":           patchAs[int]("year"),
+	"budgetLimit":    patchAs[money.Amount]("budget_limit"),
+	"thresholdRatio": patchAs[float64]("threshold_ratio"),
+	"currency":       patchAs[string]("currency"),
+}
+
+func (s *Server) PatchBudget(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	unitID := vars["unitID"]
+	category := vars["category"]
+	yearStr := vars["year"]
+	year, err := strconv.Atoi(yearStr)
+	if err != nil {
+		http.Error(w, "Invalid year", http.StatusBadRequest)
+		return
+	}
+	versions, ok := ifMatchVersions(w, r)
+	if !ok {
+		return
+	}
+
+	// Decode only the fields the client sent
+	var fields map[string]json.RawMessage
+	if err := json.NewDecoder(r.Body).Decode(&fields); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
 		return
 	}
+	// The reason goes to the revision, not the budget
+	var reason string
+	if raw, ok := fields["reason"]; ok {
+		if err := json.Unmarshal(raw, &reason); err != nil {
+			http.Error(w, "Invalid value for field \"reason\"", http.StatusBadRequest)
+			return
+		}
+		delete(fields, "reason")
+	}
 
-	// Perform the update
-	updateQuery := `
-		UPDATE budget
-		SET unit_id = $1, expense_category = $2, year = $3, budget_limit = $4, threshold_ratio = $5
-		WHERE unit_id = $6 AND expense_category = $7 AND year = $8
-	`
-	_, err = s.DB.Exec(updateQuery,
-		budget.UnitID,
-		budget.Category,
-		budget.Year,
-		budget.BudgetLimit,
-		budget.ThresholdRatio,
-		unitID,
-		category,
-		year,
-	)
+	set, args, err := buildPatch(fields, budgetPatchFields)
 	if err != nil {
-		log.Println("Update error:", err)
-		http.Error(w, "Failed to update budget", http.StatusInternalServerError)
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
-	// Respond with updated budget
+	if !s.validatePatch(w, r, fields, &Budget{}) {
+		return
+	}
+
+	key := BudgetKey{unitID, category, year}
+	before, err := s.Budgets.Get(r.Context(), key)
+	if err != nil {
+		writeStoreError(w, err, "Budget record not found")
+		return
+	}
+	budget, err := s.Budgets.Patch(r.Context(), key, Patch{Set: set, Args: args}, pinVersion(versions, before.Version))
+	if err != nil {
+		writeStoreError(w, err, "Budget record not found")
+		return
+	}
+	s.reviseBudget(r.Context(), before, budget, reason, s.callerID(r))
+	s.publish(Event{Type: EventBudgetChanged, Data: budget})
+
+	setVersionETag(w, budget.Version)
 	w.Header().Set("Content-Type", "application/json; charset=utf-8")
 	json.NewEncoder(w).Encode(budget)
 }
@@ -194,7 +372,7 @@ func (s *Server) DeleteBudget(w http.ResponseWriter, r *http.Request) {
 	// category := r.URL.Query().Get("category")
 	// yearStr := r.URL.Query().Get("year")
 	vars := mux.Vars(r)
-	unitID := vars["unit_id"]
+	unitID := vars["unitID"]
 	category := vars["category"]
 	yearStr := vars["year"]
 
@@ -209,25 +387,8 @@ func (s *Server) DeleteBudget(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Execute the DELETE query
-	result, err := s.DB.Exec(`
-		DELETE FROM budget
-		WHERE unit_id = $1 AND expense_category = $2 AND year = $3
-	`, unitID, category, year)
-	if err != nil {
-		log.Println("Delete error:", err)
-		http.Error(w, "Failed to delete budget", http.StatusInternalServerError)
-		return
-	}
-
-	// Check if any rows were affected
-	rowsAffected, err := result.RowsAffected()
-	if err != nil {
-		http.Error(w, "Failed to determine deletion result", http.StatusInternalServerError)
-		return
-	}
-	if rowsAffected == 0 {
-		http.Error(w, "Budget record not found", http.StatusNotFound)
+	if err := s.deleteBudget(r.Context(), BudgetKey{unitID, category, year}, r.URL.Query().Get("reason"), s.callerID(r)); err != nil {
+		writeStoreError(w, err, "Budget record not found")
 		return
 	}
 
@@ -241,64 +402,43 @@ func (s *Server) ListBudgets(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Build dynamic filters
-	filters := []string{}
-	args := []any{}
-	idx := 1
-
-	if unitID := r.URL.Query().Get("unit_id"); unitID != "" {
-		filters = append(filters, "unit_id = $"+strconv.Itoa(idx))
-		args = append(args, unitID)
-		idx++
+	subunits, ok := includeSubunits(w, r)
+	if !ok {
+		return
+	}
+	opts, ok := listOptions(w, r, budgetSortable)
+	if !ok {
+		return
 	}
-	if category := r.URL.Query().Get("category"); category != "" {
-		filters = append(filters, "expense_category = $"+strconv.Itoa(idx))
-		args = append(args, category)
-		idx++
+	filter := BudgetFilter{
+		UnitID:          r.URL.Query().Get("unitID"),
+		IncludeSubunits: subunits,
+		Category:        r.URL.Query().Get("category"),
+		ListOptions:     opts,
 	}
 	if yearStr := r.URL.Query().Get("year"); yearStr != "" {
-		if year, err := strconv.Atoi(yearStr); err == nil {
-			filters = append(filters, "year = $"+strconv.Itoa(idx))
-			args = append(args, year)
-			idx++
-		} else {
+		year, err := strconv.Atoi(yearStr)
+		if err != nil {
 			http.Error(w, "Invalid year", http.StatusBadRequest)
 			return
 		}
+		filter.Year = year
 	}
 
-	// Construct query
-	query := `SELECT unit_id, expense_category, year, budget_limit, threshold_ratio FROM budget`
-	if len(filters) > 0 {
-		query += " WHERE " + strings.Join(filters, " AND ")
-	}
-
-	// Execute query
-	rows, err := s.DB.Query(query, args...)
+	budgets, err := s.Budgets.List(r.Context(), filter)
 	if err != nil {
 		log.Println("ListBudgets query error:", err)
 		http.Error(w, "Database query failed", http.StatusInternalServerError)
 		return
 	}
-	defer rows.Close()
-
-	// Parse results
-	var budgets []Budget
-	for rows.Next() {
-		var b Budget
-		err := rows.Scan(&b.UnitID, &b.Category, &b.Year, &b.BudgetLimit, &b.ThresholdRatio)
+	if env := envelopeOf(r); env != nil {
+		total, err := s.Budgets.Count(r.Context(), filter)
 		if err != nil {
-			log.Println("Row scan error:", err)
-			http.Error(w, "Failed to read data", http.StatusInternalServerError)
+			log.Println("ListBudgets count error:", err)
+			http.Error(w, "Database query failed", http.StatusInternalServerError)
 			return
 		}
-		budgets = append(budgets, b)
-	}
-
-	if err := rows.Err(); err != nil {
-		log.Println("Row iteration error:", err)
-		http.Error(w, "Error reading results", http.StatusInternalServerError)
-		return
+		env.page(opts, total)
 	}
 
 	// Return results as JSON
@@ -0,0 +1,309 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"main/budgetrules"
+	"main/money"
+	"main/query"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// BudgetAlert records that a budget's owners were told its spending reached
+// a level. A level is announced once: it is only announced again after the
+// budget dropped below it, e.g. because its limit was raised, and crossed
+// it anew.
+type BudgetAlert struct {
+	UnitID    string            `json:"unitID"`
+	Category  string            `json:"category"`
+	Year      int               `json:"year"`
+	Level     budgetrules.Alert `json:"level"`
+	Spent     money.Amount      `json:"spent"` // in the base currency when it was raised
+	Limit     money.Amount      `json:"limit"`
+	CreatedAt time.Time         `json:"createdAt"`
+}
+
+func (BudgetAlert) CreateTableIfNotExists(s *Server) {
+	// Alerts follow their budget through renames and go with it
+	query := `CREATE TABLE IF NOT EXISTS budget_alert (
+		unit_id VARCHAR(256) NOT NULL,
+		category VARCHAR(256) NOT NULL,
+		year INT NOT NULL,
+		level VARCHAR(32) NOT NULL,
+		spent NUMERIC NOT NULL,
+		budget_limit NUMERIC NOT NULL,
+		created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+
+		PRIMARY KEY (unit_id, category, year, level),
+		FOREIGN KEY (unit_id, category, year) REFERENCES budget (unit_id, expense_category, year)
+			ON UPDATE CASCADE ON DELETE CASCADE
+	)`
+
+	_, err := s.DB.Exec(query)
+
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// raiseBudgetAlerts brings the alerts of a budget in line with its headroom:
+// levels it fell below are cleared, and its owners are told about the
+// highest level it newly reached.
+func (s *Server) raiseBudgetAlerts(ctx context.Context, key BudgetKey, h budgetrules.Headroom, senderID int) error {
+	levels := h.Alerts()
+	reached := make([]string, len(levels))
+	for i, level := range levels {
+		reached[i] = string(level)
+	}
+	_, err := s.DB.ExecContext(ctx, `
+		DELETE FROM budget_alert
+		WHERE unit_id = $1 AND category = $2 AND year = $3 AND NOT level = ANY($4)
+	`, key.UnitID, key.Category, key.Year, pq.Array(reached))
+	if err != nil {
+		return err
+	}
+
+	var raised budgetrules.Alert
+	for _, level := range levels {
+		result, err := s.DB.ExecContext(ctx, `
+			INSERT INTO budget_alert (unit_id, category, year, level, spent, budget_limit)
+			VALUES ($1, $2, $3, $4, $5, $6)
+			ON CONFLICT DO NOTHING
+		`, key.UnitID, key.Category, key.Year, level, h.Spent, h.Limit)
+		if err != nil {
+			return err
+		}
+		if n, err := result.RowsAffected(); err == nil && n > 0 {
+			raised = level
+		}
+	}
+	if raised != "" {
+		s.sendBudgetAlert(ctx, key, h, raised, senderID)
+	}
+	return nil
+}
+
+// sendBudgetAlert tells the unit's managers and the accountants, and the
+// webhooks, that a budget reached level. Failures are only logged.
+func (s *Server) sendBudgetAlert(ctx context.Context, key BudgetKey, h budgetrules.Headroom, level budgetrules.Alert, senderID int) {
+	s.emitWebhook(ctx, WebhookBudgetThresholdExceeded, BudgetThresholdEvent{
+		UnitID:   key.UnitID,
+		Category: key.Category,
+		Year:     key.Year,
+		Alert:    level,
+		Status:   h.Status,
+		Spent:    h.Spent,
+		Limit:    h.Limit,
+		Max:      h.Max,
+		Currency: s.BaseCurrency,
+	})
+
+	reached := "has used up its limit"
+	if level == budgetrules.AlertOverThreshold {
+		reached = "is now over its limit plus threshold"
+	}
+	message := fmt.Sprintf("Spending on %s for unit %s in %d %s: %s of %s %s spent.",
+		key.Category, key.UnitID, key.Year, reached, h.Spent, h.Limit, s.BaseCurrency)
+
+	rows, err := s.DB.QueryContext(ctx, `
+		SELECT id FROM users
+		WHERE (unit_id = $1 AND role_id = $2) OR role_id = $3
+	`, key.UnitID, Manager, Accounter)
+	if err != nil {
+		log.Println("Budget threshold recipients error:", err)
+		return
+	}
+	var receivers []int
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			log.Println("Row scan error:", err)
+			rows.Close()
+			return
+		}
+		receivers = append(receivers, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		log.Println("Row iteration error:", err)
+		return
+	}
+
+	for _, id := range receivers {
+		if err := s.sendAnnouncement(ctx, s.DB, senderID, id, message, EmailBudgetThreshold); err != nil {
+			log.Println("Notification insert error:", err)
+		}
+	}
+}
+
+// budgetCheckJob is the payload of a JobBudgetCheck job.
+type budgetCheckJob struct {
+	Date string `json:"date"` // the night it was scheduled for, or empty when run by hand
+}
+
+// runBudgetCheckJob recomputes the spending of every budget and raises or
+// clears its alerts. Alerts already raised are not sent again, so the job
+// may be retried, or run twice, safely.
+func (s *Server) runBudgetCheckJob(ctx context.Context, payload json.RawMessage) error {
+	rows, err := s.DB.QueryContext(ctx, `
+		SELECT b.unit_id, b.expense_category, b.year,
+			`+s.inBaseCurrency("b.budget_limit", "b.currency", "CURRENT_DATE")+`, b.threshold_ratio,
+			COALESCE(SUM(`+s.inBaseCurrency("pe.amount", "pe.currency", "pe.created_at::date")+`), 0)
+		FROM budget b
+		LEFT JOIN paid_expense pe
+			ON pe.unit_id = b.unit_id
+			AND pe.category = b.expense_category
+			AND fiscal_year(pe.created_at, pe.unit_id) = b.year
+		GROUP BY b.unit_id, b.expense_category, b.year, b.budget_limit, b.currency, b.threshold_ratio
+		ORDER BY b.year, b.unit_id, b.expense_category
+	`)
+	if err != nil {
+		return err
+	}
+	type checked struct {
+		key   BudgetKey
+		limit *money.Amount
+		ratio float64
+		spent money.Amount
+	}
+	var budgets []checked
+	for rows.Next() {
+		var c checked
+		if err := rows.Scan(&c.key.UnitID, &c.key.Category, &c.key.Year, &c.limit, &c.ratio, &c.spent); err != nil {
+			rows.Close()
+			return err
+		}
+		budgets = append(budgets, c)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	// One budget failing does not hold up the others; the retry goes over
+	// them all again
+	round := s.conversionRounding(ctx).Round
+	var firstErr error
+	for _, c := range budgets {
+		if c.limit == nil {
+			// No rate to compare against
+			continue
+		}
+		h := budgetrules.Compute(budgetrules.Budget{Limit: *c.limit, ThresholdRatio: c.ratio}, c.spent, round)
+		if err := s.raiseBudgetAlerts(ctx, c.key, h, systemSender); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// nextBudgetCheck is the first time at hour o'clock after now, in now's
+// location.
+func nextBudgetCheck(now time.Time, hour int) time.Time {
+	next := time.Date(now.Year(), now.Month(), now.Day(), hour, 0, 0, 0, now.Location())
+	if !next.After(now) {
+		next = next.AddDate(0, 0, 1)
+	}
+	return next
+}
+
+// RunBudgetCheckScheduler queues the budget check every night at hour
+// o'clock, local time, until ctx is cancelled. Every instance schedules it,
+// and the night's date keeps it to one job.
+func (s *Server) RunBudgetCheckScheduler(ctx context.Context, hour int) {
+	for {
+		next := nextBudgetCheck(time.Now(), hour)
+		timer := time.NewTimer(time.Until(next))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+
+		date := next.Format(time.DateOnly)
+		_, err := enqueueJobOnce(ctx, s.DB, JobBudgetCheck, JobBudgetCheck+":"+date, budgetCheckJob{Date: date}, time.Time{})
+		if err != nil && ctx.Err() == nil {
+			log.Println("Budget check scheduling error:", err)
+		}
+	}
+}
+
+// CheckBudgets queues a budget check to run now rather than at night.
+func (s *Server) CheckBudgets(w http.ResponseWriter, r *http.Request) {
+	caller, ok := s.requireRole(w, r, Admin)
+	if !ok {
+		return
+	}
+
+	id, err := enqueueJob(r.Context(), s.DB, JobBudgetCheck, budgetCheckJob{}, time.Time{})
+	if err != nil {
+		log.Println("Budget check queue error:", err)
+		http.Error(w, "Failed to queue the budget check", http.StatusInternalServerError)
+		return
+	}
+	job, err := scanJob(s.DB.QueryRowContext(r.Context(), "SELECT "+jobColumns+" FROM job WHERE id = $1", id))
+	if err != nil {
+		log.Println("Job fetch error:", err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	if err := audit(r.Context(), s.DB, caller.ID, "budgets.check", map[string]int{"jobID": id}); err != nil {
+		log.Println("Audit error:", err)
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(job)
+}
+
+// ListBudgetAlerts returns the alerts standing against budgets, newest
+// first.
+func (s *Server) ListBudgetAlerts(w http.ResponseWriter, r *http.Request) {
+	queryParams := r.URL.Query()
+	q := query.From("budget_alert", "unit_id, category, year, level, spent, budget_limit, created_at").
+		WhereIf(queryParams.Get("unitID") != "", "unit_id = ?", queryParams.Get("unitID")).
+		WhereIf(queryParams.Get("category") != "", "category = ?", queryParams.Get("category"))
+	if year := queryParams.Get("year"); year != "" {
+		y, err := strconv.Atoi(year)
+		if err != nil {
+			http.Error(w, "Invalid year parameter", http.StatusBadRequest)
+			return
+		}
+		q.Where("year = ?", y)
+	}
+	statement, args := q.OrderBy("created_at DESC", "unit_id", "category", "year", "level").SQL()
+
+	rows, err := s.DB.QueryContext(r.Context(), statement, args...)
+	if err != nil {
+		log.Println("ListBudgetAlerts query error:", err)
+		http.Error(w, "Database query failed", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	alerts := []BudgetAlert{}
+	for rows.Next() {
+		var a BudgetAlert
+		if err := rows.Scan(&a.UnitID, &a.Category, &a.Year, &a.Level, &a.Spent, &a.Limit, &a.CreatedAt); err != nil {
+			log.Println("Row scan error:", err)
+			http.Error(w, "Failed to read budget alert", http.StatusInternalServerError)
+			return
+		}
+		alerts = append(alerts, a)
+	}
+	if err := rows.Err(); err != nil {
+		log.Println("Row iteration error:", err)
+		http.Error(w, "Error reading results", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(alerts)
+}
@@ -0,0 +1,474 @@
+package server
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"main/money"
+	"math"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+)
+
+// BudgetPeriod is the granularity a budget's limit is enforced at. An
+// annual budget only caps the year; a quarterly or monthly one also caps
+// each fiscal quarter or month at its allocation.
+type BudgetPeriod string
+
+const (
+	AnnualBudget    BudgetPeriod = ""
+	QuarterlyBudget BudgetPeriod = "quarter"
+	MonthlyBudget   BudgetPeriod = "month"
+)
+
+// periods is how many periods a fiscal year has, or 0 for an annual budget.
+func (p BudgetPeriod) periods() int {
+	switch p {
+	case QuarterlyBudget:
+		return 4
+	case MonthlyBudget:
+		return 12
+	}
+	return 0
+}
+
+// BudgetAllocation is the share of a budget's limit one period of its
+// fiscal year may spend, in the budget's currency. Period counts from 1,
+// the quarter or month the fiscal year starts with.
+type BudgetAllocation struct {
+	Period      int          `json:"period"`
+	BudgetLimit money.Amount `json:"budgetLimit"`
+}
+
+// BudgetAllocations is how a budget's limit is split across its periods.
+type BudgetAllocations struct {
+	UnitID      string             `json:"unitID"`
+	Category    string             `json:"category"`
+	Year        int                `json:"year"`
+	Period      BudgetPeriod       `json:"period"`
+	Currency    string             `json:"currency"`
+	Allocations []BudgetAllocation `json:"allocations"`
+}
+
+// budgetDistribution asks for a budget's limit to be split across the
+// periods of its fiscal year: evenly, or in proportion to Weights.
+type budgetDistribution struct {
+	Period  BudgetPeriod `json:"period"`
+	Weights []float64    `json:"weights,omitempty"`
+}
+
+func (BudgetAllocation) CreateTableIfNotExists(s *Server) {
+	// kind is the budget's period the allocation was made for; allocations
+	// of another kind than the budget's are left alone until replaced.
+	// fiscal_period(at, unit, kind) is the quarter or month of the unit's
+	// fiscal year a time falls in, counting from 1
+	query := `CREATE TABLE IF NOT EXISTS budget_allocation (
+		unit_id VARCHAR(256) NOT NULL,
+		expense_category VARCHAR(256) NOT NULL,
+		year INT NOT NULL,
+		kind VARCHAR(8) NOT NULL,
+		period INT NOT NULL,
+		budget_limit NUMERIC NOT NULL,
+
+		PRIMARY KEY (unit_id, expense_category, year, kind, period),
+		FOREIGN KEY (unit_id, expense_category, year) REFERENCES budget (unit_id, expense_category, year)
+			ON UPDATE CASCADE ON DELETE CASCADE
+	);
+	CREATE OR REPLACE FUNCTION fiscal_period(moment TIMESTAMPTZ, unit_name VARCHAR, kind VARCHAR) RETURNS INT AS $$
+		SELECT CASE kind WHEN 'month' THEN m + 1 WHEN 'quarter' THEN m / 3 + 1 END
+		FROM (SELECT (EXTRACT(MONTH FROM moment)::int - fiscal_year_start(unit_name) + 12) % 12 AS m) f
+	$$ LANGUAGE sql STABLE`
+
+	_, err := s.DB.Exec(query)
+
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// budgetKeyOf reads the budget a request's path names.
+func budgetKeyOf(w http.ResponseWriter, r *http.Request) (BudgetKey, bool) {
+	vars := mux.Vars(r)
+	year, err := strconv.Atoi(vars["year"])
+	if err != nil {
+		http.Error(w, "Invalid year", http.StatusBadRequest)
+		return BudgetKey{}, false
+	}
+	return BudgetKey{vars["unitID"], vars["category"], year}, true
+}
+
+// budgetAllocations reads the allocations of budget b for its period.
+func budgetAllocations(ctx context.Context, db dbtx, b Budget) (BudgetAllocations, error) {
+	a := BudgetAllocations{
+		UnitID:      b.UnitID,
+		Category:    b.Category,
+		Year:        b.Year,
+		Period:      b.Period,
+		Currency:    b.Currency,
+		Allocations: []BudgetAllocation{},
+	}
+	rows, err := db.QueryContext(ctx, `
+		SELECT period, budget_limit FROM budget_allocation
+		WHERE unit_id = $1 AND expense_category = $2 AND year = $3 AND kind = $4
+		ORDER BY period
+	`, b.UnitID, b.Category, b.Year, b.Period)
+	if err != nil {
+		return a, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var alloc BudgetAllocation
+		if err := rows.Scan(&alloc.Period, &alloc.BudgetLimit); err != nil {
+			return a, err
+		}
+		a.Allocations = append(a.Allocations, alloc)
+	}
+	return a, rows.Err()
+}
+
+// checkAllocations reports what keeps allocations from splitting the limit
+// of budget b by period.
+func checkAllocations(b Budget, period BudgetPeriod, allocations []BudgetAllocation) FieldErrors {
+	errs := FieldErrors{}
+	n := period.periods()
+	if n == 0 {
+		errs.add("period", "must be quarter or month")
+		return errs
+	}
+	if len(allocations) != n {
+		errs.add("allocations", "must list each of the "+strconv.Itoa(n)+" periods once")
+		return errs
+	}
+	seen := make(map[int]bool, n)
+	var total money.Amount
+	for _, a := range allocations {
+		if a.Period < 1 || a.Period > n || seen[a.Period] {
+			errs.add("allocations", "must list each of the "+strconv.Itoa(n)+" periods once")
+		}
+		seen[a.Period] = true
+		if a.BudgetLimit < 0 || a.BudgetLimit > money.Max {
+			errs.add("allocations", "limits must be at least 0 and at most "+money.Max.String())
+		}
+		total += a.BudgetLimit
+	}
+	if len(errs) == 0 && total != b.BudgetLimit {
+		errs.add("allocations", "must add up to the budget limit of "+b.BudgetLimit.String())
+	}
+	return errs
+}
+
+// distribute splits limit across periods in proportion to weights, or
+// evenly without them. Each share is rounded down to a multiple of step,
+// and what rounding leaves over goes to the last period.
+func distribute(limit money.Amount, periods int, weights []float64, step money.Amount) []BudgetAllocation {
+	if len(weights) == 0 {
+		weights = make([]float64, periods)
+		for i := range weights {
+			weights[i] = 1
+		}
+	}
+	var sum float64
+	for _, w := range weights {
+		sum += w
+	}
+
+	allocations := make([]BudgetAllocation, periods)
+	rest := limit
+	for i := range allocations {
+		share := rest
+		if i < periods-1 {
+			share = limit.Mul(weights[i] / sum)
+			if step > 1 {
+				share -= share % step
+			}
+		}
+		allocations[i] = BudgetAllocation{Period: i + 1, BudgetLimit: share}
+		rest -= share
+	}
+	return allocations
+}
+
+// allocateBudget replaces the allocations of the budget at key with those
+// of period, within tx, and moves the budget to period.
+func allocateBudget(ctx context.Context, tx *sql.Tx, key BudgetKey, period BudgetPeriod, allocations []BudgetAllocation) (Budget, error) {
+	_, err := tx.ExecContext(ctx, `
+		DELETE FROM budget_allocation
+		WHERE unit_id = $1 AND expense_category = $2 AND year = $3
+	`, key.UnitID, key.Category, key.Year)
+	if err != nil {
+		return Budget{}, err
+	}
+	for _, a := range allocations {
+		_, err := tx.ExecContext(ctx, `
+			INSERT INTO budget_allocation (unit_id, expense_category, year, kind, period, budget_limit)
+			VALUES ($1, $2, $3, $4, $5, $6)
+		`, key.UnitID, key.Category, key.Year, period, a.Period, a.BudgetLimit)
+		if err != nil {
+			return Budget{}, err
+		}
+	}
+	budget, err := scanBudget(tx.QueryRowContext(ctx, `
+		UPDATE budget SET period = $4, version = version + 1
+		WHERE unit_id = $1 AND expense_category = $2 AND year = $3
+		RETURNING `+budgetColumns,
+		key.UnitID, key.Category, key.Year, period))
+	if err == sql.ErrNoRows {
+		return budget, errNotFound
+	}
+	return budget, err
+}
+
+// lockBudget reads the budget at key, locking it for the rest of tx.
+func lockBudget(ctx context.Context, tx *sql.Tx, key BudgetKey) (Budget, error) {
+	budget, err := scanBudget(tx.QueryRowContext(ctx, `
+		SELECT `+budgetColumns+` FROM budget
+		WHERE unit_id = $1 AND expense_category = $2 AND year = $3
+		FOR UPDATE
+	`, key.UnitID, key.Category, key.Year))
+	if err == sql.ErrNoRows {
+		return budget, errNotFound
+	}
+	return budget, err
+}
+
+// periodPosition is where the period a payment falls in stands against
+// its allocation, both in the base currency.
+type periodPosition struct {
+	period BudgetPeriod
+	index  int
+	limit  *money.Amount
+	spent  money.Amount
+}
+
+func (p periodPosition) String() string {
+	return fmt.Sprintf("%s %d", p.period, p.index)
+}
+
+// periodPositionOf is the position of the period of budget key that a
+// payment made now falls in, or nil when the budget is annual or has no
+// allocation for now. Every payment is checked against it; see
+// checkCharge.
+func (s *Server) periodPositionOf(ctx context.Context, tx *sql.Tx, key BudgetKey) (*periodPosition, error) {
+	var p periodPosition
+	err := tx.QueryRowContext(ctx, `
+		SELECT b.period, a.period, `+s.inBaseCurrency("a.budget_limit", "b.currency", "CURRENT_DATE")+`,
+			(SELECT COALESCE(SUM(`+s.inBaseCurrency("pe.amount", "pe.currency", "pe.created_at::date")+`), 0)
+				FROM paid_expense pe
+				WHERE pe.unit_id = b.unit_id AND pe.category = b.expense_category
+					AND fiscal_year(pe.created_at, pe.unit_id) = b.year
+					AND fiscal_period(pe.created_at, pe.unit_id, b.period) = a.period)
+		FROM budget b
+		JOIN budget_allocation a ON a.unit_id = b.unit_id AND a.expense_category = b.expense_category
+			AND a.year = b.year AND a.kind = b.period
+		WHERE b.unit_id = $1 AND b.expense_category = $2 AND b.year = $3
+			AND fiscal_year(NOW(), b.unit_id) = b.year AND a.period = fiscal_period(NOW(), b.unit_id, b.period)
+	`, key.UnitID, key.Category, key.Year).Scan(&p.period, &p.index, &p.limit, &p.spent)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &p, nil
+}
+
+func (s *Server) GetBudgetAllocations(w http.ResponseWriter, r *http.Request) {
+	key, ok := budgetKeyOf(w, r)
+	if !ok {
+		return
+	}
+	budget, err := s.Budgets.Get(r.Context(), key)
+	if err != nil {
+		writeStoreError(w, err, "Budget not found")
+		return
+	}
+	allocations, err := budgetAllocations(r.Context(), s.DB, budget)
+	if err != nil {
+		log.Println("Budget allocation query error:", err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(allocations)
+}
+
+// PutBudgetAllocations splits a budget's limit across its quarters or
+// months as the caller lists, replacing any earlier split.
+func (s *Server) PutBudgetAllocations(w http.ResponseWriter, r *http.Request) {
+	caller, ok := s.requireRole(w, r, Accounter, Admin)
+	if !ok {
+		return
+	}
+	key, ok := budgetKeyOf(w, r)
+	if !ok {
+		return
+	}
+	var body BudgetAllocations
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+
+	s.allocate(w, r, caller, key, body.Period, func(b Budget) ([]BudgetAllocation, FieldErrors, error) {
+		return body.Allocations, checkAllocations(b, body.Period, body.Allocations), nil
+	})
+}
+
+// DistributeBudget splits a budget's limit across its quarters or months
+// evenly, or in proportion to the weights given, replacing any earlier
+// split.
+func (s *Server) DistributeBudget(w http.ResponseWriter, r *http.Request) {
+	caller, ok := s.requireRole(w, r, Accounter, Admin)
+	if !ok {
+		return
+	}
+	key, ok := budgetKeyOf(w, r)
+	if !ok {
+		return
+	}
+	var body budgetDistribution
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+
+	s.allocate(w, r, caller, key, body.Period, func(b Budget) ([]BudgetAllocation, FieldErrors, error) {
+		errs := FieldErrors{}
+		n := body.Period.periods()
+		if n == 0 {
+			errs.add("period", "must be quarter or month")
+			return nil, errs, nil
+		}
+		if body.Weights != nil {
+			var sum float64
+			for _, weight := range body.Weights {
+				if weight < 0 || math.IsInf(weight, 0) || math.IsNaN(weight) {
+					errs.add("weights", "must not be negative")
+				}
+				sum += weight
+			}
+			if len(body.Weights) != n {
+				errs.add("weights", "must give one weight for each of the "+strconv.Itoa(n)+" periods")
+			} else if sum <= 0 {
+				errs.add("weights", "must not all be 0")
+			}
+		}
+		if len(errs) > 0 {
+			return nil, errs, nil
+		}
+
+		// Shares are whole minor units of the budget's currency
+		minorUnits := 2
+		err := s.DB.QueryRowContext(r.Context(), "SELECT minor_units FROM currency WHERE code = $1", b.Currency).Scan(&minorUnits)
+		if err != nil && err != sql.ErrNoRows {
+			return nil, nil, err
+		}
+		step := money.Amount(math.Pow10(2 - min(minorUnits, 2)))
+		return distribute(b.BudgetLimit, n, body.Weights, step), nil, nil
+	})
+}
+
+// allocate locks the budget at key, has split work out its allocations
+// for period and stores them, answering with the budget's new split.
+func (s *Server) allocate(w http.ResponseWriter, r *http.Request, caller User, key BudgetKey, period BudgetPeriod, split func(Budget) ([]BudgetAllocation, FieldErrors, error)) {
+	ctx := r.Context()
+	tx, err := s.DB.BeginTx(ctx, nil)
+	if err != nil {
+		log.Println("Begin transaction error:", err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	budget, err := lockBudget(ctx, tx, key)
+	if err != nil {
+		writeStoreError(w, err, "Budget not found")
+		return
+	}
+	allocations, errs, err := split(budget)
+	if err != nil {
+		log.Println("Budget allocation error:", err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	if len(errs) > 0 {
+		writeValidationErrors(w, errs)
+		return
+	}
+
+	budget, err = allocateBudget(ctx, tx, key, period, allocations)
+	if err != nil {
+		log.Println("Budget allocation error:", err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	detail := map[string]any{"unitID": key.UnitID, "category": key.Category, "year": key.Year, "period": period, "allocations": allocations}
+	if err := audit(ctx, tx, caller.ID, "budgets.allocate", detail); err != nil {
+		log.Println("Audit insert error:", err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	result, err := budgetAllocations(ctx, tx, budget)
+	if err != nil {
+		log.Println("Budget allocation query error:", err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		log.Println("Commit error:", err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	s.publish(Event{Type: EventBudgetChanged, UnitID: budget.UnitID, Data: budget})
+
+	setVersionETag(w, budget.Version)
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(result)
+}
+
+// DeleteBudgetAllocations drops a budget's split, leaving only its annual
+// limit to enforce.
+func (s *Server) DeleteBudgetAllocations(w http.ResponseWriter, r *http.Request) {
+	caller, ok := s.requireRole(w, r, Accounter, Admin)
+	if !ok {
+		return
+	}
+	key, ok := budgetKeyOf(w, r)
+	if !ok {
+		return
+	}
+	ctx := r.Context()
+	tx, err := s.DB.BeginTx(ctx, nil)
+	if err != nil {
+		log.Println("Begin transaction error:", err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	budget, err := allocateBudget(ctx, tx, key, AnnualBudget, nil)
+	if err != nil {
+		writeStoreError(w, err, "Budget not found")
+		return
+	}
+	detail := map[string]any{"unitID": key.UnitID, "category": key.Category, "year": key.Year}
+	if err := audit(ctx, tx, caller.ID, "budgets.deallocate", detail); err != nil {
+		log.Println("Audit insert error:", err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		log.Println("Commit error:", err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	s.publish(Event{Type: EventBudgetChanged, UnitID: budget.UnitID, Data: budget})
+
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,175 @@
+package server
+
+import (
+	"database/sql"
+	"encoding/json"
+	"log"
+	"main/budgetrules"
+	"main/money"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+type ForecastBand struct {
+	Confidence float64      `json:"confidence"` // 0.8 or 0.95
+	Low        money.Amount `json:"low"`
+	High       money.Amount `json:"high"`
+}
+
+// ForecastMonth is a month of the fiscal year, numbered as in the calendar;
+// the months of a forecast are in the order of its fiscal year.
+type ForecastMonth struct {
+	Month      int          `json:"month"`
+	Spent      money.Amount `json:"spent"`      // paid within the month
+	Cumulative money.Amount `json:"cumulative"` // paid by its end, projected for months to come
+	Projected  bool         `json:"projected"`
+}
+
+// BudgetForecast projects a budget's spending to the end of its year from
+// the monthly run rate of its payments. Amounts are in the base currency;
+// payments in a currency with no known exchange rate are left out and
+// counted.
+type BudgetForecast struct {
+	UnitID        string              `json:"unitID"`
+	Category      string              `json:"category"`
+	Year          int                 `json:"year"`
+	BaseCurrency  string              `json:"baseCurrency"`
+	Limit         money.Amount        `json:"limit"`
+	MonthsElapsed float64             `json:"monthsElapsed"`
+	Spent         money.Amount        `json:"spent"`
+	RunRate       money.Amount        `json:"runRate"` // per month
+	Projected     money.Amount        `json:"projected"`
+	Bands         []ForecastBand      `json:"bands"`
+	Overrun       budgetrules.Overrun `json:"overrun"`
+	ExhaustedIn   int                 `json:"exhaustedIn,omitempty"` // month the limit is expected to be overrun in
+	Unconverted   int                 `json:"unconverted"`
+	Months        []ForecastMonth     `json:"months"`
+}
+
+// monthsElapsed is how much of the fiscal year starting at start has
+// passed at now, in months.
+func monthsElapsed(start, now time.Time) float64 {
+	switch {
+	case !now.Before(start.AddDate(1, 0, 0)):
+		return 12
+	case now.Before(start):
+		return 0
+	}
+	months := (now.Year()-start.Year())*12 + int(now.Month()) - int(start.Month())
+	days := time.Date(now.Year(), now.Month()+1, 0, 0, 0, 0, 0, time.UTC).Day()
+	return float64(months) + float64(now.Day())/float64(days)
+}
+
+// GetBudgetForecast projects a budget's spending to the end of the year
+// and tells how likely it is to overrun.
+func (s *Server) GetBudgetForecast(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	year, err := strconv.Atoi(vars["year"])
+	if err != nil {
+		http.Error(w, "Invalid year", http.StatusBadRequest)
+		return
+	}
+	key := BudgetKey{vars["unitID"], vars["category"], year}
+
+	start, _, err := fiscalYearBounds(r.Context(), s.DB, year, key.UnitID)
+	if err != nil {
+		log.Println("Fiscal year lookup error:", err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	forecast := BudgetForecast{
+		UnitID:        key.UnitID,
+		Category:      key.Category,
+		Year:          year,
+		BaseCurrency:  s.BaseCurrency,
+		MonthsElapsed: monthsElapsed(start, time.Now()),
+		Bands:         []ForecastBand{},
+		Months:        []ForecastMonth{},
+	}
+
+	var limit *money.Amount
+	err = s.DB.QueryRowContext(r.Context(), `
+		SELECT `+s.inBaseCurrency("b.budget_limit", "b.currency", "CURRENT_DATE")+`
+		FROM budget b
+		WHERE b.unit_id = $1 AND b.expense_category = $2 AND b.year = $3
+	`, key.UnitID, key.Category, key.Year).Scan(&limit)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Budget not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		log.Println("Budget fetch error:", err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	if limit == nil {
+		http.Error(w, "No exchange rate known for the budget's currency", http.StatusConflict)
+		return
+	}
+
+	// Payments convert at the rate of their day, as in the expense report.
+	// Months count from the first of the fiscal year
+	rows, err := s.DB.QueryContext(r.Context(), `
+		SELECT month, COALESCE(SUM(amount), 0), COUNT(*) - COUNT(amount)
+		FROM (
+			SELECT (EXTRACT(MONTH FROM pe.created_at)::int - $4 + 12) % 12 + 1 AS month,
+				`+s.inBaseCurrency("pe.amount", "pe.currency", "pe.created_at::date")+` AS amount
+			FROM paid_expense pe
+			WHERE pe.unit_id = $1 AND pe.category = $2 AND fiscal_year(pe.created_at, pe.unit_id) = $3
+		) p
+		GROUP BY month
+	`, key.UnitID, key.Category, key.Year, int(start.Month()))
+	if err != nil {
+		log.Println("Forecast query error:", err)
+		http.Error(w, "Database query failed", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	var monthly [12]money.Amount
+	for rows.Next() {
+		var month, unconverted int
+		var spent money.Amount
+		if err := rows.Scan(&month, &spent, &unconverted); err != nil {
+			log.Println("Row scan error:", err)
+			http.Error(w, "Failed to read forecast data", http.StatusInternalServerError)
+			return
+		}
+		monthly[month-1] = spent
+		forecast.Unconverted += unconverted
+	}
+	if err := rows.Err(); err != nil {
+		log.Println("Row iteration error:", err)
+		http.Error(w, "Error reading results", http.StatusInternalServerError)
+		return
+	}
+
+	round := s.conversionRounding(r.Context()).Round
+	budget := budgetrules.Budget{Limit: *limit}
+	p := budgetrules.Forecast(budget, monthly, forecast.MonthsElapsed, round)
+	forecast.Limit = round(*limit)
+	forecast.Spent, forecast.RunRate, forecast.Projected = p.Spent, p.RunRate, p.Projected
+	forecast.Overrun = p.Overrun
+	if p.ExhaustedIn > 0 {
+		forecast.ExhaustedIn = int(start.AddDate(0, p.ExhaustedIn-1, 0).Month())
+	}
+	for _, band := range p.Bands {
+		forecast.Bands = append(forecast.Bands, ForecastBand(band))
+	}
+	for i, cumulative := range p.Cumulative {
+		forecast.Months = append(forecast.Months, ForecastMonth{
+			Month:      int(start.AddDate(0, i, 0).Month()),
+			Spent:      round(monthly[i]),
+			Cumulative: cumulative,
+			Projected:  float64(i+1) > forecast.MonthsElapsed,
+		})
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	if err := json.NewEncoder(w).Encode(forecast); err != nil {
+		log.Println("JSON encoding error:", err)
+	}
+}
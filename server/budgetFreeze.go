@@ -0,0 +1,354 @@
+package server
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"main/query"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// freezeCheckInterval is how often upcoming freezes are looked up for
+// announcement.
+const freezeCheckInterval = 15 * time.Minute
+
+// BudgetFreeze blocks new expense requests, approvals and payments for a unit
+// from StartsAt on. An empty Category freezes every category of the unit.
+type BudgetFreeze struct {
+	ID          int        `json:"id,omitempty"`
+	UnitID      string     `json:"unitID"`
+	Category    string     `json:"category"`
+	StartsAt    time.Time  `json:"startsAt"`
+	Reason      string     `json:"reason"`
+	CreatedBy   int        `json:"createdBy"`
+	AnnouncedAt *time.Time `json:"announcedAt,omitempty"`
+	CreatedAt   *time.Time `json:"createdAt,omitempty"`
+}
+
+func (BudgetFreeze) CreateTableIfNotExists(s *Server) {
+	query := `CREATE TABLE IF NOT EXISTS budget_freeze (
+		id SERIAL PRIMARY KEY,
+		unit_id VARCHAR(256) NOT NULL,
+		category VARCHAR(256) NOT NULL DEFAULT '',
+		starts_at TIMESTAMPTZ NOT NULL,
+		reason TEXT NOT NULL DEFAULT '',
+		created_by INT NOT NULL,
+		announced_at TIMESTAMPTZ,
+		created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+	)`
+
+	_, err := s.DB.Exec(query)
+
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+func (f BudgetFreeze) Validate(ctx context.Context, s *Server) (FieldErrors, error) {
+	errs := FieldErrors{}
+	if f.StartsAt.IsZero() {
+		errs.add("startsAt", "is required")
+	}
+
+	if err := s.checkExists(ctx, errs, "unitID", "unit does not exist",
+		"SELECT 1 FROM unit WHERE name = $1", f.UnitID); err != nil {
+		return nil, err
+	}
+	if f.Category != "" {
+		if err := s.checkExists(ctx, errs, "category", "category does not exist",
+			"SELECT 1 FROM expense_category WHERE name = $1", f.Category); err != nil {
+			return nil, err
+		}
+	}
+	return errs, nil
+}
+
+const budgetFreezeColumns = "id, unit_id, category, starts_at, reason, created_by, announced_at, created_at"
+
+func scanBudgetFreeze(row rowScanner) (BudgetFreeze, error) {
+	var f BudgetFreeze
+	err := row.Scan(&f.ID, &f.UnitID, &f.Category, &f.StartsAt, &f.Reason, &f.CreatedBy, &f.AnnouncedAt, &f.CreatedAt)
+	return f, err
+}
+
+// activeFreeze returns the freeze in force for the unit and category, if any.
+func activeFreeze(ctx context.Context, db dbtx, unitID, category string) (*BudgetFreeze, error) {
+	f, err := scanBudgetFreeze(db.QueryRowContext(ctx, `
+		SELECT `+budgetFreezeColumns+`
+		FROM budget_freeze
+		WHERE unit_id = $1 AND (category = '' OR category = $2) AND starts_at <= NOW()
+		ORDER BY starts_at
+		LIMIT 1
+	`, unitID, category))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &f, nil
+}
+
+// checkFrozen returns a conflictError when the unit and category are
+// frozen.
+func checkFrozen(ctx context.Context, db dbtx, unitID, category string) error {
+	freeze, err := activeFreeze(ctx, db, unitID, category)
+	if err != nil || freeze == nil {
+		return err
+	}
+	msg := fmt.Sprintf("Budget for unit %q is frozen since %s", unitID, freeze.StartsAt.Format("2006-01-02"))
+	if freeze.Reason != "" {
+		msg += ": " + freeze.Reason
+	}
+	return conflictError(msg)
+}
+
+// checkNotFrozen writes a 409 when the unit and category are frozen. It
+// returns false when the handler should stop.
+func (s *Server) checkNotFrozen(w http.ResponseWriter, r *http.Request, db dbtx, unitID, category string) bool {
+	if err := checkFrozen(r.Context(), db, unitID, category); err != nil {
+		writeStoreError(w, err, "")
+		return false
+	}
+	return true
+}
+
+func freezeAnnouncement(f BudgetFreeze) string {
+	scope := "all categories"
+	if f.Category != "" {
+		scope = "category " + f.Category
+	}
+	msg := fmt.Sprintf("Budget freeze: from %s, new expense requests, approvals and payments for unit %s (%s) will be blocked.",
+		f.StartsAt.Format("2006-01-02 15:04 MST"), f.UnitID, scope)
+	if f.Reason != "" {
+		msg += " Reason: " + f.Reason
+	}
+	return msg
+}
+
+// AnnounceUpcomingFreezes sends an announcement to every member of a unit
+// once its freeze is within FreezeNotice of starting.
+func (s *Server) AnnounceUpcomingFreezes(ctx context.Context) error {
+	rows, err := s.DB.QueryContext(ctx, `
+		SELECT `+budgetFreezeColumns+`
+		FROM budget_freeze
+		WHERE announced_at IS NULL AND starts_at <= NOW() + $1 * INTERVAL '1 second'
+	`, s.Settings().FreezeNotice.Seconds())
+	if err != nil {
+		return err
+	}
+	var due []BudgetFreeze
+	for rows.Next() {
+		f, err := scanBudgetFreeze(rows)
+		if err != nil {
+			rows.Close()
+			return err
+		}
+		due = append(due, f)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, f := range due {
+		if err := s.announceFreeze(ctx, f); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *Server) announceFreeze(ctx context.Context, f BudgetFreeze) error {
+	tx, err := s.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// Claim the freeze first so concurrent runs do not announce it twice
+	result, err := tx.ExecContext(ctx,
+		"UPDATE budget_freeze SET announced_at = NOW() WHERE id = $1 AND announced_at IS NULL", f.ID)
+	if err != nil {
+		return err
+	}
+	if n, err := result.RowsAffected(); err != nil || n == 0 {
+		return err
+	}
+
+	message := freezeAnnouncement(f)
+	rows, err := tx.QueryContext(ctx, `
+		INSERT INTO announcement (message, receiver_id, created_by)
+		SELECT $1, id, $2 FROM users WHERE unit_id = $3
+		RETURNING id, receiver_id, created_at
+	`, message, f.CreatedBy, f.UnitID)
+	if err != nil {
+		return err
+	}
+	var sent []Announcement
+	for rows.Next() {
+		a := Announcement{Message: message, CreatedBy: f.CreatedBy}
+		if err := rows.Scan(&a.ID, &a.ReceiverID, &a.CreatedAt); err != nil {
+			rows.Close()
+			return err
+		}
+		sent = append(sent, a)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, a := range sent {
+		if err := s.queueEmail(ctx, tx, a.ReceiverID, EmailAnnouncement, message); err != nil {
+			return err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	for _, a := range sent {
+		s.publish(Event{Type: EventAnnouncement, UserID: a.ReceiverID, Data: a})
+	}
+	return nil
+}
+
+// RunFreezeAnnouncer announces upcoming freezes periodically until ctx is
+// cancelled.
+func (s *Server) RunFreezeAnnouncer(ctx context.Context) {
+	ticker := time.NewTicker(freezeCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		if err := s.AnnounceUpcomingFreezes(ctx); err != nil && ctx.Err() == nil {
+			log.Println("Budget freeze announcement error:", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (s *Server) CreateBudgetFreeze(w http.ResponseWriter, r *http.Request) {
+	caller, ok := s.requireRole(w, r, Admin, Accounter)
+	if !ok {
+		return
+	}
+
+	var freeze BudgetFreeze
+	if err := json.NewDecoder(r.Body).Decode(&freeze); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+	freeze.CreatedBy = caller.ID
+
+	if !s.validate(w, r, freeze) {
+		return
+	}
+
+	err := s.DB.QueryRowContext(r.Context(), `
+		INSERT INTO budget_freeze (unit_id, category, starts_at, reason, created_by)
+		VALUES ($1, $2, $3, $4, $5)
+		RETURNING id, created_at
+	`, freeze.UnitID, freeze.Category, freeze.StartsAt, freeze.Reason, freeze.CreatedBy,
+	).Scan(&freeze.ID, &freeze.CreatedAt)
+	if err != nil {
+		log.Println("Insert budget freeze error:", err)
+		http.Error(w, "Failed to create budget freeze", http.StatusInternalServerError)
+		return
+	}
+
+	// Freezes scheduled inside the notice window are announced right away
+	if err := s.AnnounceUpcomingFreezes(r.Context()); err != nil {
+		log.Println("Budget freeze announcement error:", err)
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(freeze)
+}
+
+func (s *Server) ListBudgetFreezes(w http.ResponseWriter, r *http.Request) {
+	queryParams := r.URL.Query()
+	q := query.From("budget_freeze", budgetFreezeColumns).
+		WhereIf(queryParams.Get("unitID") != "", "unit_id = ?", queryParams.Get("unitID")).
+		WhereIf(queryParams.Get("category") != "", "category = ?", queryParams.Get("category"))
+	if active := queryParams.Get("active"); active != "" {
+		activeBool, err := strconv.ParseBool(active)
+		if err != nil {
+			http.Error(w, "Invalid active parameter", http.StatusBadRequest)
+			return
+		}
+		if activeBool {
+			q.Where("starts_at <= NOW()")
+		} else {
+			q.Where("starts_at > NOW()")
+		}
+	}
+	statement, args := q.OrderBy("starts_at").SQL()
+
+	rows, err := s.DB.QueryContext(r.Context(), statement, args...)
+	if err != nil {
+		log.Println("ListBudgetFreezes query error:", err)
+		http.Error(w, "Database query failed", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	freezes := []BudgetFreeze{}
+	for rows.Next() {
+		f, err := scanBudgetFreeze(rows)
+		if err != nil {
+			log.Println("Row scan error:", err)
+			http.Error(w, "Failed to read budget freeze", http.StatusInternalServerError)
+			return
+		}
+		freezes = append(freezes, f)
+	}
+	if err := rows.Err(); err != nil {
+		log.Println("Row iteration error:", err)
+		http.Error(w, "Error reading results", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(freezes)
+}
+
+func (s *Server) DeleteBudgetFreeze(w http.ResponseWriter, r *http.Request) {
+	if _, ok := s.requireRole(w, r, Admin, Accounter); !ok {
+		return
+	}
+
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid ID", http.StatusBadRequest)
+		return
+	}
+
+	result, err := s.DB.ExecContext(r.Context(), "DELETE FROM budget_freeze WHERE id = $1", id)
+	if err != nil {
+		log.Println("Delete budget freeze error:", err)
+		http.Error(w, "Failed to delete budget freeze", http.StatusInternalServerError)
+		return
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		http.Error(w, "Error checking affected rows", http.StatusInternalServerError)
+		return
+	}
+	if rowsAffected == 0 {
+		http.Error(w, "Budget freeze not found", http.StatusNotFound)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
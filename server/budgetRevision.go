@@ -0,0 +1,183 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"main/money"
+	"net/http"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// BudgetRevision is one change to a budget's limit. The budget row only
+// holds the current limit; its revisions tell how it got there, so the
+// limit in force on any earlier date can be reconstructed.
+type BudgetRevision struct {
+	ID             int           `json:"id"`
+	UnitID         string        `json:"unitID"`
+	Category       string        `json:"category"`
+	Year           int           `json:"year"`
+	OldLimit       *money.Amount `json:"oldLimit"` // nil when the budget was created
+	NewLimit       *money.Amount `json:"newLimit"` // nil when the budget was deleted
+	Currency       string        `json:"currency"`
+	Reason         string        `json:"reason"`
+	ApprovedBy     int           `json:"approvedBy"`
+	ApprovedByName string        `json:"approvedByName"`
+	CreatedAt      time.Time     `json:"createdAt"`
+}
+
+func (BudgetRevision) CreateTableIfNotExists(s *Server) {
+	query := `CREATE TABLE IF NOT EXISTS budget_revision (
+		id SERIAL PRIMARY KEY,
+		unit_id VARCHAR(256) NOT NULL,
+		category VARCHAR(256) NOT NULL,
+		year INT NOT NULL,
+		old_limit NUMERIC,
+		new_limit NUMERIC,
+		currency CHAR(3) NOT NULL,
+		reason TEXT NOT NULL DEFAULT '',
+		approved_by INT NOT NULL,
+		created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+	)`
+
+	_, err := s.DB.Exec(query)
+
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// budgetChange is a budget as a client writes it, with why it changed.
+type budgetChange struct {
+	Budget
+	Reason string `json:"reason,omitempty"`
+}
+
+// pinVersion narrows the versions an update may apply to down to current,
+// the version read before it, so that its revision records the limit it
+// actually replaced.
+func pinVersion(versions []int64, current int) []int64 {
+	if versions == nil || slices.Contains(versions, int64(current)) {
+		return []int64{int64(current)}
+	}
+	return versions
+}
+
+// recordBudgetRevision records that the limit of budget key went from
+// oldLimit to newLimit. Nothing is recorded when the limit stayed the same.
+func recordBudgetRevision(ctx context.Context, db dbtx, key BudgetKey, oldLimit, newLimit *money.Amount, currency, reason string, approvedBy int) error {
+	if oldLimit != nil && newLimit != nil && *oldLimit == *newLimit {
+		return nil
+	}
+	_, err := db.ExecContext(ctx, `
+		INSERT INTO budget_revision (unit_id, category, year, old_limit, new_limit, currency, reason, approved_by)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+	`, key.UnitID, key.Category, key.Year, oldLimit, newLimit, currency, reason, approvedBy)
+	return err
+}
+
+// reviseBudget records the change from before to after made through the
+// budget endpoints. Revisions follow a budget that moved to another key.
+func (s *Server) reviseBudget(ctx context.Context, before, after Budget, reason string, approvedBy int) {
+	from := BudgetKey{before.UnitID, before.Category, before.Year}
+	to := BudgetKey{after.UnitID, after.Category, after.Year}
+	if from != to {
+		_, err := s.DB.ExecContext(ctx, `
+			UPDATE budget_revision SET unit_id = $4, category = $5, year = $6
+			WHERE unit_id = $1 AND category = $2 AND year = $3
+		`, from.UnitID, from.Category, from.Year, to.UnitID, to.Category, to.Year)
+		if err != nil {
+			log.Println("Budget revision move error:", err)
+		}
+	}
+	oldLimit := &before.BudgetLimit
+	if before.Currency != after.Currency {
+		// A limit in another currency is not the same limit
+		oldLimit = nil
+	}
+	if err := recordBudgetRevision(ctx, s.DB, to, oldLimit, &after.BudgetLimit, after.Currency, reason, approvedBy); err != nil {
+		log.Println("Budget revision insert error:", err)
+	}
+}
+
+// budgetLimitAsOf is the SQL expression for the limit the budget row alias
+// had at the time at: the latest revision up to then, or before the first
+// revision the limit it replaced. It is NULL when the budget did not exist
+// at the time. Budgets from before revisions were kept have none and keep
+// their current limit.
+func budgetLimitAsOf(alias, at string) string {
+	key := fmt.Sprintf("r.unit_id = %[1]s.unit_id AND r.category = %[1]s.expense_category AND r.year = %[1]s.year", alias)
+	return fmt.Sprintf(`(CASE
+		WHEN EXISTS (SELECT 1 FROM budget_revision r WHERE %[1]s AND r.created_at <= %[2]s) THEN
+			(SELECT r.new_limit FROM budget_revision r WHERE %[1]s AND r.created_at <= %[2]s ORDER BY r.created_at DESC, r.id DESC LIMIT 1)
+		WHEN EXISTS (SELECT 1 FROM budget_revision r WHERE %[1]s) THEN
+			(SELECT r.old_limit FROM budget_revision r WHERE %[1]s ORDER BY r.created_at, r.id LIMIT 1)
+		ELSE %[3]s.budget_limit
+	END)`, key, at, alias)
+}
+
+// asOfParam reads the optional asOf parameter, an RFC 3339 time. It writes
+// a 400 and returns false when it is invalid.
+func asOfParam(w http.ResponseWriter, r *http.Request) (*time.Time, bool) {
+	value := r.URL.Query().Get("asOf")
+	if value == "" {
+		return nil, true
+	}
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		http.Error(w, "asOf must be an RFC 3339 time such as 2025-01-31T00:00:00Z", http.StatusBadRequest)
+		return nil, false
+	}
+	return &t, true
+}
+
+// ListBudgetRevisions returns the changes to a budget's limit, oldest
+// first.
+func (s *Server) ListBudgetRevisions(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	year, err := strconv.Atoi(vars["year"])
+	if err != nil {
+		http.Error(w, "Invalid year", http.StatusBadRequest)
+		return
+	}
+
+	rows, err := s.DB.QueryContext(r.Context(), `
+		SELECT br.id, br.unit_id, br.category, br.year, br.old_limit, br.new_limit, br.currency, br.reason,
+			br.approved_by, COALESCE(u.name, ''), br.created_at
+		FROM budget_revision br
+		LEFT JOIN users u ON u.id = br.approved_by
+		WHERE br.unit_id = $1 AND br.category = $2 AND br.year = $3
+		ORDER BY br.created_at, br.id
+	`, vars["unitID"], vars["category"], year)
+	if err != nil {
+		log.Println("Budget revision query error:", err)
+		http.Error(w, "Database query failed", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	revisions := []BudgetRevision{}
+	for rows.Next() {
+		var rev BudgetRevision
+		if err := rows.Scan(&rev.ID, &rev.UnitID, &rev.Category, &rev.Year, &rev.OldLimit, &rev.NewLimit, &rev.Currency,
+			&rev.Reason, &rev.ApprovedBy, &rev.ApprovedByName, &rev.CreatedAt); err != nil {
+			log.Println("Row scan error:", err)
+			http.Error(w, "Failed to scan budget revision", http.StatusInternalServerError)
+			return
+		}
+		revisions = append(revisions, rev)
+	}
+	if err := rows.Err(); err != nil {
+		log.Println("Row iteration error:", err)
+		http.Error(w, "Row iteration error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(revisions)
+}
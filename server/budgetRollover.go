@@ -0,0 +1,278 @@
+package server
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"main/money"
+	"main/query"
+	"math"
+	"net/http"
+	"strconv"
+)
+
+// RolloverRule sets how the budgets it matches are carried into the new
+// year. The limit is raised by IncreasePercent first, then what was left
+// unspent is added to it with CarryOver. A rule with neither copies the
+// limit.
+type RolloverRule struct {
+	UnitID          string  `json:"unitID,omitempty"`   // every unit when empty
+	Category        string  `json:"category,omitempty"` // every category when empty
+	IncreasePercent float64 `json:"increasePercent"`    // negative to lower the limit
+	CarryOver       bool    `json:"carryOver"`
+	Skip            bool    `json:"skip"` // leaves the matched budgets behind
+}
+
+func (rule RolloverRule) matches(b Budget) bool {
+	return (rule.UnitID == "" || rule.UnitID == b.UnitID) && (rule.Category == "" || rule.Category == b.Category)
+}
+
+// RolloverRequest lists the rules of a rollover. Each budget follows the
+// first rule that matches it; budgets no rule matches are copied.
+type RolloverRequest struct {
+	Rules []RolloverRule `json:"rules"`
+}
+
+func (req RolloverRequest) Validate(ctx context.Context, s *Server) (FieldErrors, error) {
+	errs := FieldErrors{}
+	for i, rule := range req.Rules {
+		field := "rules[" + strconv.Itoa(i) + "]."
+		if rule.IncreasePercent <= -100 {
+			errs.add(field+"increasePercent", "must be greater than -100")
+		}
+		if rule.UnitID != "" {
+			if err := s.checkExists(ctx, errs, field+"unitID", "unit does not exist",
+				"SELECT 1 FROM unit WHERE name = $1", rule.UnitID); err != nil {
+				return nil, err
+			}
+		}
+		if rule.Category != "" {
+			if err := s.checkExists(ctx, errs, field+"category", "category does not exist",
+				"SELECT 1 FROM expense_category WHERE name = $1", rule.Category); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return errs, nil
+}
+
+// Outcomes of one budget in a rollover.
+const (
+	RolloverCreated = "created"
+	RolloverExists  = "exists" // the new year already has the budget, which is kept
+	RolloverSkipped = "skipped"
+)
+
+type RolloverItem struct {
+	UnitID    string        `json:"unitID"`
+	Category  string        `json:"category"`
+	Currency  string        `json:"currency"`
+	FromLimit money.Amount  `json:"fromLimit"`
+	Unspent   *money.Amount `json:"unspent"` // nil when no exchange rate is known to compare with the payments
+	NewLimit  money.Amount  `json:"newLimit,omitempty"`
+	Status    string        `json:"status"`
+	Note      string        `json:"note,omitempty"`
+}
+
+type RolloverResult struct {
+	FromYear int            `json:"fromYear"`
+	ToYear   int            `json:"toYear"`
+	DryRun   bool           `json:"dryRun"`
+	Created  int            `json:"created"`
+	Items    []RolloverItem `json:"items"`
+}
+
+// rolloverBudget is a budget of the year rolled over from.
+type rolloverBudget struct {
+	Budget
+	minorUnits int
+	unspent    *money.Amount
+}
+
+// rolloverBudgets reads the budgets of year with what was left of each at
+// the end of it. Payments count in the base currency, and the remainder is
+// converted back at the budget currency's rate on the last day of the
+// budget's fiscal year.
+func (s *Server) rolloverBudgets(ctx context.Context, tx *sql.Tx, year int) ([]rolloverBudget, error) {
+	limit := s.inBaseCurrency("b.budget_limit", "b.currency", "fiscal_year_end(b.year, b.unit_id)")
+	spent := `(SELECT COALESCE(SUM(` + s.inBaseCurrency("pe.amount", "pe.currency", "pe.created_at::date") + `), 0)
+		FROM paid_expense pe
+		WHERE pe.unit_id = b.unit_id AND pe.category = b.expense_category AND fiscal_year(pe.created_at, pe.unit_id) = b.year)`
+	rows, err := tx.QueryContext(ctx, `
+		SELECT `+budgetColumns+`, COALESCE(c.minor_units, 2),
+			(`+limit+` - `+spent+`) * b.budget_limit / NULLIF(`+limit+`, 0)
+		FROM budget b
+		LEFT JOIN currency c ON c.code = b.currency
+		WHERE b.year = $1
+		ORDER BY b.unit_id, b.expense_category
+		FOR UPDATE OF b
+	`, year)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var budgets []rolloverBudget
+	for rows.Next() {
+		var b rolloverBudget
+		targets := append(query.Targets(budgetFields(&b.Budget)), &b.minorUnits, &b.unspent)
+		if err := rows.Scan(targets...); err != nil {
+			return nil, err
+		}
+		budgets = append(budgets, b)
+	}
+	return budgets, rows.Err()
+}
+
+// rollOver applies the first matching rule to b and stores the result as
+// the budget of toYear.
+func rollOver(ctx context.Context, tx *sql.Tx, b rolloverBudget, rules []RolloverRule, toYear, approvedBy int) (RolloverItem, error) {
+	item := RolloverItem{UnitID: b.UnitID, Category: b.Category, Currency: b.Currency, FromLimit: b.BudgetLimit, Unspent: b.unspent}
+	rule := RolloverRule{}
+	for _, r := range rules {
+		if r.matches(b.Budget) {
+			rule = r
+			break
+		}
+	}
+	if rule.Skip {
+		item.Status, item.Note = RolloverSkipped, "skipped by rule"
+		return item, nil
+	}
+
+	limit := b.BudgetLimit.Mul(1 + rule.IncreasePercent/100)
+	if rule.CarryOver {
+		if item.Unspent == nil {
+			item.Status, item.Note = RolloverSkipped, "no exchange rate known to carry the unspent remainder"
+			return item, nil
+		}
+		limit += max(*item.Unspent, 0)
+	}
+	item.NewLimit = limit.Round(money.Amount(math.Pow10(2 - min(b.minorUnits, 2))))
+	if item.NewLimit <= 0 {
+		item.Status, item.Note = RolloverSkipped, "the new limit would not be greater than 0"
+		return item, nil
+	}
+
+	var version int
+	err := tx.QueryRowContext(ctx, `
+		INSERT INTO budget (unit_id, expense_category, year, budget_limit, threshold_ratio, currency)
+		VALUES ($1, $2, $3, $4, $5, $6)
+		ON CONFLICT (unit_id, expense_category, year) DO NOTHING
+		RETURNING version
+	`, b.UnitID, b.Category, toYear, item.NewLimit, b.ThresholdRatio, b.Currency).Scan(&version)
+	if err == sql.ErrNoRows {
+		item.Status, item.NewLimit = RolloverExists, 0
+		return item, nil
+	} else if err != nil {
+		return item, err
+	}
+	item.Status = RolloverCreated
+	key := BudgetKey{b.UnitID, b.Category, toYear}
+	reason := fmt.Sprintf("Rolled over from %d", b.Year)
+	return item, recordBudgetRevision(ctx, tx, key, nil, &item.NewLimit, b.Currency, reason, approvedBy)
+}
+
+// RolloverBudgets creates the budgets of toYear from those of fromYear,
+// keeping any the new year already has. With ?dryRun=true it reports what
+// would be created without storing it.
+func (s *Server) RolloverBudgets(w http.ResponseWriter, r *http.Request) {
+	caller, ok := s.requireRole(w, r, Accounter, Admin)
+	if !ok {
+		return
+	}
+	queryParams := r.URL.Query()
+
+	result := RolloverResult{Items: []RolloverItem{}}
+	var err error
+	if result.FromYear, err = strconv.Atoi(queryParams.Get("fromYear")); err != nil {
+		http.Error(w, "Missing or invalid fromYear parameter", http.StatusBadRequest)
+		return
+	}
+	result.ToYear = result.FromYear + 1
+	if v := queryParams.Get("toYear"); v != "" {
+		if result.ToYear, err = strconv.Atoi(v); err != nil {
+			http.Error(w, "Invalid toYear parameter", http.StatusBadRequest)
+			return
+		}
+	}
+	if v := queryParams.Get("dryRun"); v != "" {
+		if result.DryRun, err = strconv.ParseBool(v); err != nil {
+			http.Error(w, "Invalid dryRun parameter", http.StatusBadRequest)
+			return
+		}
+	}
+	if result.ToYear <= result.FromYear || result.ToYear > maxBudgetYear {
+		http.Error(w, "toYear must be after fromYear and at most 2100", http.StatusBadRequest)
+		return
+	}
+
+	// The body is optional; without one every budget is copied
+	var req RolloverRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && !errors.Is(err, io.EOF) {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+	if !s.validate(w, r, req) {
+		return
+	}
+
+	ctx := r.Context()
+	tx, err := s.DB.BeginTx(ctx, nil)
+	if err != nil {
+		log.Println("Begin transaction error:", err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	budgets, err := s.rolloverBudgets(ctx, tx, result.FromYear)
+	if err != nil {
+		log.Println("Rollover query error:", err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	// A dry run goes through the same inserts, so its preview sees the same
+	// conflicts, and is rolled back
+	for _, b := range budgets {
+		item, err := rollOver(ctx, tx, b, req.Rules, result.ToYear, caller.ID)
+		if err != nil {
+			log.Println("Rollover insert error:", err)
+			http.Error(w, "Failed to roll over budgets", http.StatusInternalServerError)
+			return
+		}
+		if item.Status == RolloverCreated {
+			result.Created++
+		}
+		result.Items = append(result.Items, item)
+	}
+
+	status := http.StatusOK
+	if !result.DryRun {
+		if err := tx.Commit(); err != nil {
+			log.Println("Commit error:", err)
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		detail := map[string]any{"fromYear": result.FromYear, "toYear": result.ToYear, "created": result.Created}
+		if err := audit(ctx, s.DB, caller.ID, "budgets.rollover", detail); err != nil {
+			log.Println("Audit error:", err)
+		}
+		for _, item := range result.Items {
+			if item.Status == RolloverCreated {
+				s.publish(Event{Type: EventBudgetChanged, UnitID: item.UnitID})
+			}
+		}
+		if result.Created > 0 {
+			status = http.StatusCreated
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(result)
+}
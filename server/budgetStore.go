@@ -0,0 +1,184 @@
+package server
+
+import (
+	"context"
+	"database/sql"
+	"main/query"
+
+	"github.com/lib/pq"
+)
+
+// BudgetKey identifies a budget: one per unit, category and year.
+type BudgetKey struct {
+	UnitID   string
+	Category string
+	Year     int
+}
+
+// BudgetFilter narrows ListBudgets. Empty fields do not filter.
+type BudgetFilter struct {
+	UnitID          string
+	IncludeSubunits bool // also the budgets of UnitID's subunits
+	Category        string
+	Year            int
+	ListOptions
+}
+
+// budgetSortable are the fields budgets can be sorted by.
+var budgetSortable = map[string]string{
+	"unitID": "unit_id", "category": "expense_category", "year": "year",
+	"budgetLimit": "budget_limit", "thresholdRatio": "threshold_ratio",
+}
+
+// BudgetStore reads and writes budgets. Writes that take versions only
+// apply to a row whose version is among them; nil versions match any.
+type BudgetStore interface {
+	Get(ctx context.Context, key BudgetKey) (Budget, error)
+	List(ctx context.Context, filter BudgetFilter) ([]Budget, error)
+	// Count is how many budgets the filter matches, ignoring its paging
+	Count(ctx context.Context, filter BudgetFilter) (int, error)
+	Create(ctx context.Context, budget Budget) (Budget, error)
+	Update(ctx context.Context, key BudgetKey, budget Budget, versions []int64) (Budget, error)
+	Patch(ctx context.Context, key BudgetKey, patch Patch, versions []int64) (Budget, error)
+	Delete(ctx context.Context, key BudgetKey) error
+}
+
+// PostgresBudgetStore keeps budgets in the budget table.
+type PostgresBudgetStore struct {
+	DB dbtx
+}
+
+const budgetVersionQuery = "SELECT version FROM budget WHERE unit_id = $1 AND expense_category = $2 AND year = $3"
+
+func (p PostgresBudgetStore) Get(ctx context.Context, key BudgetKey) (Budget, error) {
+	query := `
+		SELECT ` + budgetColumns + `
+		FROM budget
+		WHERE unit_id = $1 AND expense_category = $2 AND year = $3
+	`
+	budget, err := scanBudget(p.DB.QueryRowContext(ctx, query, key.UnitID, key.Category, key.Year))
+	if err == sql.ErrNoRows {
+		return budget, errNotFound
+	}
+	return budget, err
+}
+
+// filtered selects columns from the budgets filter matches.
+func (PostgresBudgetStore) filtered(columns string, filter BudgetFilter) *query.Select {
+	q := query.From("budget", columns)
+	if filter.UnitID != "" && filter.IncludeSubunits {
+		q.Where("unit_id IN ("+unitSubtree("?")+")", filter.UnitID)
+	} else if filter.UnitID != "" {
+		q.Where("unit_id = ?", filter.UnitID)
+	}
+	return q.WhereIf(filter.Category != "", "expense_category = ?", filter.Category).
+		WhereIf(filter.Year != 0, "year = ?", filter.Year)
+}
+
+func (p PostgresBudgetStore) List(ctx context.Context, filter BudgetFilter) ([]Budget, error) {
+	q := p.filtered(budgetColumns, filter).
+		OrderBy(filter.Sort...).OrderBy("unit_id", "expense_category", "year").
+		Page(filter.Limit, filter.Offset)
+	statement, args := q.SQL()
+
+	rows, err := p.DB.QueryContext(ctx, statement, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var budgets []Budget
+	for rows.Next() {
+		b, err := scanBudget(rows)
+		if err != nil {
+			return nil, err
+		}
+		budgets = append(budgets, b)
+	}
+	return budgets, rows.Err()
+}
+
+func (p PostgresBudgetStore) Count(ctx context.Context, filter BudgetFilter) (int, error) {
+	statement, args := p.filtered("count(*)", filter).SQL()
+	var n int
+	err := p.DB.QueryRowContext(ctx, statement, args...).Scan(&n)
+	return n, err
+}
+
+func (p PostgresBudgetStore) Create(ctx context.Context, budget Budget) (Budget, error) {
+	query := `
+		INSERT INTO budget (unit_id, expense_category, year, budget_limit, threshold_ratio, currency)
+		VALUES ($1, $2, $3, $4, $5, $6)
+		RETURNING period, version
+	`
+	err := p.DB.QueryRowContext(ctx,
+		query,
+		budget.UnitID,
+		budget.Category,
+		budget.Year,
+		budget.BudgetLimit,
+		budget.ThresholdRatio,
+		budget.Currency,
+	).Scan(&budget.Period, &budget.Version)
+	return budget, err
+}
+
+func (p PostgresBudgetStore) Update(ctx context.Context, key BudgetKey, budget Budget, versions []int64) (Budget, error) {
+	query := `
+		UPDATE budget
+		SET unit_id = $1, expense_category = $2, year = $3, budget_limit = $4, threshold_ratio = $5, currency = $6,
+			version = version + 1
+		WHERE unit_id = $7 AND expense_category = $8 AND year = $9 AND ` + versionMatches("$10") + `
+		RETURNING period, version
+	`
+	err := p.DB.QueryRowContext(ctx, query,
+		budget.UnitID,
+		budget.Category,
+		budget.Year,
+		budget.BudgetLimit,
+		budget.ThresholdRatio,
+		budget.Currency,
+		key.UnitID,
+		key.Category,
+		key.Year,
+		pq.Array(versions),
+	).Scan(&budget.Period, &budget.Version)
+	if err == sql.ErrNoRows {
+		return budget, versionMismatch(ctx, p.DB, budgetVersionQuery, key.UnitID, key.Category, key.Year)
+	}
+	return budget, err
+}
+
+func (p PostgresBudgetStore) Patch(ctx context.Context, key BudgetKey, patch Patch, versions []int64) (Budget, error) {
+	args := patch.Args
+	query := "UPDATE budget SET " + patch.Set + ", version = version + 1" +
+		" WHERE unit_id = " + args.Add(key.UnitID) +
+		" AND expense_category = " + args.Add(key.Category) +
+		" AND year = " + args.Add(key.Year) +
+		" AND " + versionMatches(args.Add(pq.Array(versions))) +
+		" RETURNING " + budgetColumns
+
+	budget, err := scanBudget(p.DB.QueryRowContext(ctx, query, args...))
+	if err == sql.ErrNoRows {
+		return budget, versionMismatch(ctx, p.DB, budgetVersionQuery, key.UnitID, key.Category, key.Year)
+	}
+	return budget, err
+}
+
+func (p PostgresBudgetStore) Delete(ctx context.Context, key BudgetKey) error {
+	result, err := p.DB.ExecContext(ctx, `
+		DELETE FROM budget
+		WHERE unit_id = $1 AND expense_category = $2 AND year = $3
+	`, key.UnitID, key.Category, key.Year)
+	if err != nil {
+		return err
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return errNotFound
+	}
+	return nil
+}
@@ -0,0 +1,184 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"main/budgetrules"
+	"main/money"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+const tickerKeepAlive = 15 * time.Second
+
+type CategoryBudgetStatus struct {
+	Category  string       `json:"category"`
+	Limit     money.Amount `json:"limit"`
+	Spent     money.Amount `json:"spent"`
+	Remaining money.Amount `json:"remaining"`
+}
+
+// BudgetTick is the payload of one "budget" event on the ticker stream.
+type BudgetTick struct {
+	UnitID       string                 `json:"unitID"`
+	Year         int                    `json:"year"`
+	BaseCurrency string                 `json:"baseCurrency"`
+	Categories   []CategoryBudgetStatus `json:"categories"`
+	At           time.Time              `json:"at"`
+}
+
+// budgetTick computes the remaining budget per category of a unit for a year.
+func (s *Server) budgetTick(ctx context.Context, unitID string, year int) (BudgetTick, error) {
+	tick := BudgetTick{UnitID: unitID, Year: year, BaseCurrency: s.BaseCurrency, Categories: []CategoryBudgetStatus{}, At: time.Now()}
+
+	// Figures are in the base currency; amounts without a known rate count as 0
+	rows, err := s.DB.QueryContext(ctx, `
+		SELECT b.expense_category,
+			COALESCE(`+s.inBaseCurrency("b.budget_limit", "b.currency", "CURRENT_DATE")+`, 0),
+			COALESCE(SUM(`+s.inBaseCurrency("pe.amount", "pe.currency", "pe.created_at::date")+`), 0)
+		FROM budget b
+		LEFT JOIN paid_expense pe
+			ON pe.unit_id = b.unit_id
+			AND pe.category = b.expense_category
+			AND fiscal_year(pe.created_at, pe.unit_id) = b.year
+		WHERE b.unit_id = $1 AND b.year = $2
+		GROUP BY b.expense_category, b.budget_limit, b.currency
+		ORDER BY b.expense_category
+	`, unitID, year)
+	if err != nil {
+		return tick, err
+	}
+	defer rows.Close()
+
+	round := s.conversionRounding(ctx).Round
+	for rows.Next() {
+		var c CategoryBudgetStatus
+		if err := rows.Scan(&c.Category, &c.Limit, &c.Spent); err != nil {
+			return tick, err
+		}
+		h := budgetrules.Compute(budgetrules.Budget{Limit: c.Limit}, c.Spent, round)
+		c.Limit, c.Spent, c.Remaining = h.Limit, h.Spent, h.Rest
+		tick.Categories = append(tick.Categories, c)
+	}
+	return tick, rows.Err()
+}
+
+// beginEventStream writes the headers of a server-sent event stream. The
+// stream outlives the server's write timeout, so the deadline is cleared.
+func beginEventStream(w http.ResponseWriter) *http.ResponseController {
+	rc := http.NewResponseController(w)
+	if err := rc.SetWriteDeadline(time.Time{}); err != nil {
+		log.Println("Event stream write deadline error:", err)
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	return rc
+}
+
+// sendKeepAlive writes a comment line so proxies do not close an idle stream.
+func sendKeepAlive(w http.ResponseWriter, rc *http.ResponseController) error {
+	if _, err := fmt.Fprint(w, ": keep-alive\n\n"); err != nil {
+		return err
+	}
+	return rc.Flush()
+}
+
+// BudgetTicker streams the unit's remaining budget per category as
+// server-sent events. A fresh figure is pushed whenever a payment or budget
+// that may affect the unit changes.
+func (s *Server) BudgetTicker(w http.ResponseWriter, r *http.Request) {
+	unitID := mux.Vars(r)["name"]
+
+	var year int
+	if yearStr := r.URL.Query().Get("year"); yearStr != "" {
+		var err error
+		if year, err = strconv.Atoi(yearStr); err != nil {
+			http.Error(w, "Invalid year", http.StatusBadRequest)
+			return
+		}
+	}
+
+	found, err := s.exists(r.Context(), "SELECT 1 FROM unit WHERE name = $1", unitID)
+	if err != nil {
+		log.Println("Unit lookup error:", err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	if !found {
+		http.Error(w, "Unit not found", http.StatusNotFound)
+		return
+	}
+
+	// The unit's current fiscal year by default
+	if year == 0 {
+		if year, err = fiscalYear(r.Context(), s.DB, time.Now(), unitID); err != nil {
+			log.Println("Fiscal year lookup error:", err)
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	if s.Events == nil {
+		http.Error(w, "Live updates are not enabled", http.StatusServiceUnavailable)
+		return
+	}
+
+	events, unsubscribe := s.Events.Subscribe()
+	defer unsubscribe()
+
+	rc := beginEventStream(w)
+
+	send := func() error {
+		tick, err := s.budgetTick(r.Context(), unitID, year)
+		if err != nil {
+			return err
+		}
+		data, err := json.Marshal(tick)
+		if err != nil {
+			return err
+		}
+		if _, err := fmt.Fprintf(w, "event: budget\ndata: %s\n\n", data); err != nil {
+			return err
+		}
+		return rc.Flush()
+	}
+
+	if err := send(); err != nil {
+		log.Println("Budget ticker error:", err)
+		return
+	}
+
+	keepAlive := time.NewTicker(tickerKeepAlive)
+	defer keepAlive.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case e := <-events:
+			if e.Type != EventPaymentChanged && e.Type != EventBudgetChanged {
+				continue
+			}
+			if e.UnitID != "" && e.UnitID != unitID {
+				continue
+			}
+			if err := send(); err != nil {
+				log.Println("Budget ticker error:", err)
+				return
+			}
+		case <-keepAlive.C:
+			if err := sendKeepAlive(w, rc); err != nil {
+				return
+			}
+		}
+	}
+}
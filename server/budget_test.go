@@ -0,0 +1,109 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+)
+
+func TestCreateBudget(t *testing.T) {
+	ts := newTestServer(t, []string{"Sales"}, []string{"Travel"})
+
+	w := serve(ts.CreateBudget, "POST", "/budgets", nil, "",
+		`{"unitID": "Sales", "category": "Travel", "year": 2025, "budgetLimit": 1000.5, "thresholdRatio": 0.1}`)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("status = %d, want %d: %s", w.Code, http.StatusCreated, w.Body)
+	}
+	var created Budget
+	if err := json.NewDecoder(w.Body).Decode(&created); err != nil {
+		t.Fatal(err)
+	}
+	want := Budget{UnitID: "Sales", Category: "Travel", Year: 2025, BudgetLimit: 100050, Currency: "EUR", ThresholdRatio: 0.1, Version: 1}
+	if created != want {
+		t.Errorf("created %+v, want %+v", created, want)
+	}
+	if got := w.Header().Get("ETag"); got != versionETag(1) {
+		t.Errorf("ETag = %s, want %s", got, versionETag(1))
+	}
+
+	w = serve(ts.GetBudget, "GET", "/budgets/Sales/Travel/2025",
+		map[string]string{"unitID": "Sales", "category": "Travel", "year": "2025"}, "", "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("get status = %d, want %d: %s", w.Code, http.StatusOK, w.Body)
+	}
+	var got Budget
+	if err := json.NewDecoder(w.Body).Decode(&got); err != nil {
+		t.Fatal(err)
+	}
+	if got != want {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+}
+
+func TestCreateBudgetValidation(t *testing.T) {
+	ts := newTestServer(t, []string{"Sales"}, []string{"Travel"})
+
+	tests := []struct {
+		name string
+		body string
+		want FieldErrors
+	}{
+		{
+			name: "out of range",
+			body: `{"unitID": "Sales", "category": "Travel", "year": 1999, "budgetLimit": 0, "thresholdRatio": 2}`,
+			want: FieldErrors{
+				"year":           "must be between 2000 and 2100",
+				"budgetLimit":    "must be greater than 0 and at most 9999999999999.99",
+				"thresholdRatio": "must be between 0 and 1",
+			},
+		},
+		{
+			name: "unknown unit, category and currency",
+			body: `{"unitID": "Nowhere", "category": "Fun", "year": 2025, "budgetLimit": 10, "currency": "XXX"}`,
+			want: FieldErrors{
+				"unitID":   "unit does not exist",
+				"category": "category does not exist",
+				"currency": "unknown currency",
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := serve(ts.CreateBudget, "POST", "/budgets", nil, "", tt.body)
+			if w.Code != http.StatusUnprocessableEntity {
+				t.Fatalf("status = %d, want %d: %s", w.Code, http.StatusUnprocessableEntity, w.Body)
+			}
+			var body struct{ Errors FieldErrors }
+			if err := json.NewDecoder(w.Body).Decode(&body); err != nil {
+				t.Fatal(err)
+			}
+			if len(body.Errors) != len(tt.want) {
+				t.Errorf("errors = %v, want %v", body.Errors, tt.want)
+			}
+			for field, message := range tt.want {
+				if body.Errors[field] != message {
+					t.Errorf("errors[%s] = %q, want %q", field, body.Errors[field], message)
+				}
+			}
+		})
+	}
+	if n, _ := ts.budgets.Count(t.Context(), BudgetFilter{}); n != 0 {
+		t.Errorf("%d budgets stored, want none", n)
+	}
+}
+
+func TestGetBudgetNotFound(t *testing.T) {
+	ts := newTestServer(t, []string{"Sales"}, []string{"Travel"})
+
+	w := serve(ts.GetBudget, "GET", "/budgets/Sales/Travel/2025",
+		map[string]string{"unitID": "Sales", "category": "Travel", "year": "2025"}, "", "")
+	if w.Code != http.StatusNotFound {
+		t.Errorf("status = %d, want %d: %s", w.Code, http.StatusNotFound, w.Body)
+	}
+
+	w = serve(ts.GetBudget, "GET", "/budgets/Sales/Travel/soon",
+		map[string]string{"unitID": "Sales", "category": "Travel", "year": "soon"}, "", "")
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("status = %d, want %d: %s", w.Code, http.StatusBadRequest, w.Body)
+	}
+}
@@ -0,0 +1,292 @@
+package server
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"log"
+	"main/money"
+	"net/http"
+	"strconv"
+)
+
+// maxBulkBudgets bounds how many budgets one bulk request may touch.
+const maxBulkBudgets = 1000
+
+// BudgetAdjustment changes the limit or threshold of an existing budget.
+// Version must be the budget's current version, as with If-Match.
+type BudgetAdjustment struct {
+	UnitID         string        `json:"unitID"`
+	Category       string        `json:"category"`
+	Year           int           `json:"year"`
+	BudgetLimit    *money.Amount `json:"budgetLimit,omitempty"`
+	ThresholdRatio *float64      `json:"thresholdRatio,omitempty"`
+	Version        int           `json:"version"`
+	Reason         string        `json:"reason,omitempty"` // recorded with the budget's revision
+}
+
+// BulkBudgetItem is the outcome for one element of a bulk request, by its
+// position in the request array.
+type BulkBudgetItem struct {
+	Index  int         `json:"index"`
+	Budget *Budget     `json:"budget,omitempty"`
+	Errors FieldErrors `json:"errors,omitempty"`
+}
+
+type BulkBudgetResult struct {
+	Succeeded int              `json:"succeeded"`
+	Failed    int              `json:"failed"`
+	Items     []BulkBudgetItem `json:"items"`
+}
+
+// bulkBudgets validates n items with check and then applies them with apply
+// in one transaction. By default it is all or nothing: any invalid or failing
+// item is reported as a 422 keyed "[index].field" and nothing is stored. With
+// ?partial=true each item runs under its own savepoint, the valid ones are
+// kept and every item's outcome is reported.
+func (s *Server) bulkBudgets(w http.ResponseWriter, r *http.Request, n, status int,
+	check func(ctx context.Context, i int) (FieldErrors, error),
+	apply func(ctx context.Context, tx *sql.Tx, i int) (Budget, FieldErrors, error),
+) {
+	partial := false
+	if v := r.URL.Query().Get("partial"); v != "" {
+		var err error
+		if partial, err = strconv.ParseBool(v); err != nil {
+			http.Error(w, "Invalid partial parameter", http.StatusBadRequest)
+			return
+		}
+	}
+	if n == 0 {
+		writeValidationErrors(w, FieldErrors{"budgets": "must list at least one budget"})
+		return
+	}
+	if n > maxBulkBudgets {
+		writeValidationErrors(w, FieldErrors{"budgets": "must list at most " + strconv.Itoa(maxBulkBudgets) + " budgets"})
+		return
+	}
+
+	ctx := r.Context()
+	result := BulkBudgetResult{Items: make([]BulkBudgetItem, n)}
+	invalid := FieldErrors{}
+	addErrors := func(i int, errs FieldErrors) {
+		result.Items[i].Errors = errs
+		for field, message := range errs {
+			invalid["["+strconv.Itoa(i)+"]."+field] = message
+		}
+	}
+	for i := range result.Items {
+		result.Items[i].Index = i
+		errs, err := check(ctx, i)
+		if err != nil {
+			log.Println("Validation query error:", err)
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		if len(errs) > 0 {
+			addErrors(i, errs)
+		}
+	}
+	if !partial && len(invalid) > 0 {
+		writeValidationErrors(w, invalid)
+		return
+	}
+
+	tx, err := s.DB.BeginTx(ctx, nil)
+	if err != nil {
+		log.Println("Begin transaction error:", err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	for i := range result.Items {
+		item := &result.Items[i]
+		if item.Errors != nil {
+			continue
+		}
+		if partial {
+			if _, err := tx.ExecContext(ctx, "SAVEPOINT bulk_budget"); err != nil {
+				log.Println("Savepoint error:", err)
+				http.Error(w, "Database error", http.StatusInternalServerError)
+				return
+			}
+		}
+
+		budget, errs, err := apply(ctx, tx, i)
+		if err != nil {
+			log.Printf("Bulk budget item %d failed: %v", i, err)
+			errs = FieldErrors{"budget": "could not be stored"}
+			if !partial {
+				http.Error(w, "Failed to store budgets", http.StatusInternalServerError)
+				return
+			}
+		}
+		if len(errs) > 0 {
+			addErrors(i, errs)
+			if !partial {
+				writeValidationErrors(w, invalid)
+				return
+			}
+			if _, err := tx.ExecContext(ctx, "ROLLBACK TO SAVEPOINT bulk_budget"); err != nil {
+				log.Println("Savepoint error:", err)
+				http.Error(w, "Database error", http.StatusInternalServerError)
+				return
+			}
+			continue
+		}
+		item.Budget = &budget
+	}
+
+	if err := tx.Commit(); err != nil {
+		log.Println("Commit error:", err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	for _, item := range result.Items {
+		if item.Budget == nil {
+			result.Failed++
+			continue
+		}
+		result.Succeeded++
+		s.publish(Event{Type: EventBudgetChanged, UnitID: item.Budget.UnitID, Data: *item.Budget})
+	}
+
+	if partial {
+		status = http.StatusOK
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(result)
+}
+
+// budgetKey identifies a budget within a bulk request.
+type budgetKey struct {
+	unitID, category string
+	year             int
+}
+
+// BulkCreateBudgets creates many budgets at once, typically at the start of
+// a year.
+func (s *Server) BulkCreateBudgets(w http.ResponseWriter, r *http.Request) {
+	caller, ok := s.requireRole(w, r, Accounter, Admin)
+	if !ok {
+		return
+	}
+
+	var budgets []Budget
+	if err := json.NewDecoder(r.Body).Decode(&budgets); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+
+	seen := map[budgetKey]bool{}
+	check := func(ctx context.Context, i int) (FieldErrors, error) {
+		b := &budgets[i]
+		b.Currency = s.currencyOrBase(b.Currency)
+		errs, err := b.Validate(ctx, s)
+		if err != nil {
+			return nil, err
+		}
+		key := budgetKey{b.UnitID, b.Category, b.Year}
+		if seen[key] {
+			errs.add("year", "budget is listed more than once")
+		}
+		seen[key] = true
+		return errs, nil
+	}
+
+	apply := func(ctx context.Context, tx *sql.Tx, i int) (Budget, FieldErrors, error) {
+		b := budgets[i]
+		err := tx.QueryRowContext(ctx, `
+			INSERT INTO budget (unit_id, expense_category, year, budget_limit, threshold_ratio, currency)
+			VALUES ($1, $2, $3, $4, $5, $6)
+			ON CONFLICT (unit_id, expense_category, year) DO NOTHING
+			RETURNING period, version
+		`, b.UnitID, b.Category, b.Year, b.BudgetLimit, b.ThresholdRatio, b.Currency).Scan(&b.Period, &b.Version)
+		if err == sql.ErrNoRows {
+			return b, FieldErrors{"year": "budget already exists"}, nil
+		} else if err != nil {
+			return b, nil, err
+		}
+		key := BudgetKey{b.UnitID, b.Category, b.Year}
+		return b, nil, recordBudgetRevision(ctx, tx, key, nil, &b.BudgetLimit, b.Currency, "", caller.ID)
+	}
+
+	s.bulkBudgets(w, r, len(budgets), http.StatusCreated, check, apply)
+}
+
+// BulkAdjustBudgets changes the limit or threshold of many budgets at once.
+func (s *Server) BulkAdjustBudgets(w http.ResponseWriter, r *http.Request) {
+	caller, ok := s.requireRole(w, r, Accounter, Admin)
+	if !ok {
+		return
+	}
+
+	var adjustments []BudgetAdjustment
+	if err := json.NewDecoder(r.Body).Decode(&adjustments); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+
+	seen := map[budgetKey]bool{}
+	check := func(ctx context.Context, i int) (FieldErrors, error) {
+		a := adjustments[i]
+		errs := FieldErrors{}
+		if a.BudgetLimit == nil && a.ThresholdRatio == nil {
+			errs.add("budgetLimit", "budgetLimit or thresholdRatio is required")
+		}
+		if a.BudgetLimit != nil && *a.BudgetLimit <= 0 {
+			errs.add("budgetLimit", "must be greater than 0")
+		}
+		if a.ThresholdRatio != nil && (*a.ThresholdRatio < 0 || *a.ThresholdRatio > 1) {
+			errs.add("thresholdRatio", "must be between 0 and 1")
+		}
+		if a.Version <= 0 {
+			errs.add("version", "is required")
+		}
+		key := budgetKey{a.UnitID, a.Category, a.Year}
+		if seen[key] {
+			errs.add("year", "budget is listed more than once")
+		}
+		seen[key] = true
+		return errs, nil
+	}
+
+	apply := func(ctx context.Context, tx *sql.Tx, i int) (Budget, FieldErrors, error) {
+		a := adjustments[i]
+		var oldLimit money.Amount
+		err := tx.QueryRowContext(ctx, `
+			SELECT budget_limit FROM budget
+			WHERE unit_id = $1 AND expense_category = $2 AND year = $3
+			FOR UPDATE
+		`, a.UnitID, a.Category, a.Year).Scan(&oldLimit)
+		if err != nil && err != sql.ErrNoRows {
+			return Budget{}, nil, err
+		}
+		budget, err := scanBudget(tx.QueryRowContext(ctx, `
+			UPDATE budget
+			SET budget_limit = COALESCE($4, budget_limit), threshold_ratio = COALESCE($5, threshold_ratio),
+				version = version + 1
+			WHERE unit_id = $1 AND expense_category = $2 AND year = $3 AND version = $6
+			RETURNING `+budgetColumns,
+			a.UnitID, a.Category, a.Year, a.BudgetLimit, a.ThresholdRatio, a.Version))
+		if err == nil {
+			key := BudgetKey{a.UnitID, a.Category, a.Year}
+			return budget, nil, recordBudgetRevision(ctx, tx, key, &oldLimit, &budget.BudgetLimit, budget.Currency, a.Reason, caller.ID)
+		} else if err != sql.ErrNoRows {
+			return budget, nil, err
+		}
+
+		var current int
+		err = tx.QueryRowContext(ctx, budgetVersionQuery, a.UnitID, a.Category, a.Year).Scan(&current)
+		if err == sql.ErrNoRows {
+			return budget, FieldErrors{"year": "budget does not exist"}, nil
+		} else if err != nil {
+			return budget, nil, err
+		}
+		return budget, FieldErrors{"version": "budget was modified; current version is " + strconv.Itoa(current)}, nil
+	}
+
+	s.bulkBudgets(w, r, len(adjustments), http.StatusOK, check, apply)
+}
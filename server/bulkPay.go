@@ -0,0 +1,260 @@
+package server
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"main/budgetrules"
+	"main/money"
+	"net/http"
+	"strconv"
+)
+
+// maxBulkPay bounds how many requests one bulk payment may cover.
+const maxBulkPay = 500
+
+type bulkPayRequest struct {
+	ExpenseIDs []int `json:"expenseIDs"`
+}
+
+// BulkPayItem is the outcome for one request of a bulk payment, or one of
+// the payments it was split into; see chargesOf.
+type BulkPayItem struct {
+	ExpenseID int          `json:"expenseID"`
+	PaymentID int          `json:"paymentID,omitempty"`
+	Amount    money.Amount `json:"amount,omitempty"`
+	Currency  string       `json:"currency,omitempty"`
+	Reason    string       `json:"reason,omitempty"` // why the request was skipped
+}
+
+type BulkPayResult struct {
+	Paid    []BulkPayItem `json:"paid"`
+	Skipped []BulkPayItem `json:"skipped"`
+}
+
+// errSkipPayment marks a request that was skipped by the payment rules, as
+// opposed to one that failed.
+type errSkipPayment struct{ reason string }
+
+func (e errSkipPayment) Error() string { return e.reason }
+
+func skipPayment(format string, args ...any) error {
+	return errSkipPayment{fmt.Sprintf(format, args...)}
+}
+
+// payExpenseInFull pays what is left of an approved request and marks it
+// paid, all in one transaction. Requests that are not payable, frozen, or
+// would take a budget over limit plus threshold are skipped.
+func (s *Server) payExpenseInFull(ctx context.Context, expenseID, callerID int) ([]PaidExpense, error) {
+	tx, err := s.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	payments, err := s.payOutstanding(ctx, tx, expenseID, callerID, "Paid in bulk")
+	if err != nil {
+		return payments, err
+	}
+	return payments, tx.Commit()
+}
+
+// payOutstanding pays what is left of an approved request and marks it paid
+// with feedback, within tx. It is one payment per category the request is
+// charged to, each checked against that category's budget; see chargesOf.
+// Payments made earlier in tx count towards the budgets. It returns an
+// errSkipPayment for requests the rules do not let it pay.
+func (s *Server) payOutstanding(ctx context.Context, tx *sql.Tx, expenseID, callerID int, feedback string) ([]PaidExpense, error) {
+	// Locking the request keeps two batches from paying it twice, and
+	// locking its budgets keeps concurrent payments from them from both
+	// passing the checks below
+	if err := lockForPayment(ctx, tx, []int{expenseID}); err != nil {
+		return nil, err
+	}
+	var req ExpenseRequest
+	var year int
+	err := tx.QueryRowContext(ctx, `
+		SELECT id, unit_id, category, amount, currency, vat_rate, fiscal_year(created_at, unit_id)
+		FROM expense_request
+		WHERE id = $1
+	`, expenseID).Scan(&req.ID, &req.UnitID, &req.Category, &req.Amount, &req.Currency, &req.VATRate, &year)
+	if err == sql.ErrNoRows {
+		return nil, skipPayment("expense request not found")
+	} else if err != nil {
+		return nil, err
+	}
+
+	var state *ExpenseState
+	var paid money.Amount
+	err = tx.QueryRowContext(ctx, `
+		SELECT
+			(SELECT current_state FROM expense_activity WHERE expense_id = $1 ORDER BY created_at DESC, id DESC LIMIT 1),
+			(SELECT COALESCE(SUM(amount), 0) FROM paid_expense WHERE expense_id = $1)
+	`, expenseID).Scan(&state, &paid)
+	if err != nil {
+		return nil, err
+	}
+	if !canTransition(state, Paid) {
+		current := "no activity"
+		if state != nil {
+			current = string(*state)
+		}
+		return nil, skipPayment("cannot pay a request in state %s", current)
+	}
+	outstanding := req.Amount - paid
+	if outstanding <= 0 {
+		return nil, skipPayment("nothing left to pay")
+	}
+
+	charges, err := chargesOf(ctx, tx, req.ID, req.Category, outstanding)
+	if err != nil {
+		return nil, err
+	}
+	for _, charge := range charges {
+		if err := s.checkCharge(ctx, tx, req, year, charge); err != nil {
+			return nil, err
+		}
+	}
+
+	payment := PaidExpense{ExpenseID: req.ID, UnitID: req.UnitID, Currency: req.Currency, VATRate: req.VATRate}
+	payments, err := s.bookPayment(ctx, tx, payment, charges)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = tx.ExecContext(ctx, `
+		INSERT INTO expense_activity (expense_id, current_state, feedback, created_by)
+		VALUES ($1, $2, $3, $4)
+	`, req.ID, Paid, feedback, callerID)
+	return payments, err
+}
+
+// checkCharge returns an errSkipPayment unless the budget of the charge's
+// category in year, which lockForPayment locked, can take the charge on
+// req: it must not be frozen and stay within limit plus threshold, and
+// within its period's allocation when it has them.
+func (s *Server) checkCharge(ctx context.Context, tx *sql.Tx, req ExpenseRequest, year int, charge lineCharge) error {
+	freeze, err := activeFreeze(ctx, tx, req.UnitID, charge.Category)
+	if err != nil {
+		return err
+	}
+	if freeze != nil {
+		return skipPayment("budget for %s is frozen since %s", charge.Category, freeze.StartsAt.Format("2006-01-02"))
+	}
+
+	// Budget position in the base currency, with this payment converted at
+	// today's rate. It is read after the budget was locked, so it includes
+	// the payments committed while this one waited for the lock
+	var limit, amount *money.Amount
+	var ratio float64
+	var spent money.Amount
+	err = tx.QueryRowContext(ctx, `
+		SELECT `+s.inBaseCurrency("b.budget_limit", "b.currency", "CURRENT_DATE")+`, b.threshold_ratio,
+			(SELECT COALESCE(SUM(`+s.inBaseCurrency("pe.amount", "pe.currency", "pe.created_at::date")+`), 0)
+				FROM paid_expense pe
+				WHERE pe.unit_id = b.unit_id AND pe.category = b.expense_category AND fiscal_year(pe.created_at, pe.unit_id) = b.year),
+			`+s.inBaseCurrency("$4::numeric", "$5::char(3)", "CURRENT_DATE")+`
+		FROM budget b
+		WHERE b.unit_id = $1 AND b.expense_category = $2 AND b.year = $3
+	`, req.UnitID, charge.Category, year, charge.Amount, req.Currency).Scan(&limit, &ratio, &spent, &amount)
+	if err == sql.ErrNoRows {
+		return skipPayment("no budget for %s in %d", charge.Category, year)
+	} else if err != nil {
+		return err
+	}
+	if limit == nil || amount == nil {
+		return skipPayment("no exchange rate known to compare with the budget")
+	}
+
+	decision := budgetrules.Decide(
+		budgetrules.Budget{Limit: *limit, ThresholdRatio: ratio},
+		budgetrules.Payment{Amount: *amount, Spent: spent},
+		s.conversionRounding(ctx).Round,
+	)
+	if !decision.Allowed {
+		return skipPayment("would spend %s of a maximum %s %s on %s", decision.After.Spent, decision.After.Max, s.BaseCurrency, charge.Category)
+	}
+
+	// A quarterly or monthly budget also caps the period the payment falls
+	// in at its allocation, with the budget's threshold
+	position, err := s.periodPositionOf(ctx, tx, BudgetKey{req.UnitID, charge.Category, year})
+	if err != nil {
+		return err
+	}
+	if position != nil {
+		if position.limit == nil {
+			return skipPayment("no exchange rate known to compare with the budget")
+		}
+		decision := budgetrules.Decide(
+			budgetrules.Budget{Limit: *position.limit, ThresholdRatio: ratio},
+			budgetrules.Payment{Amount: *amount, Spent: position.spent},
+			s.conversionRounding(ctx).Round,
+		)
+		if !decision.Allowed {
+			return skipPayment("would spend %s of a maximum %s %s on %s in %s", decision.After.Spent, decision.After.Max, s.BaseCurrency, charge.Category, position)
+		}
+	}
+	return nil
+}
+
+// BulkPay pays a batch of approved requests in full. Each request is paid in
+// its own transaction, so one that is skipped or fails does not hold back
+// the rest.
+func (s *Server) BulkPay(w http.ResponseWriter, r *http.Request) {
+	caller, ok := s.requireRole(w, r, Accounter, Admin)
+	if !ok {
+		return
+	}
+
+	var body bulkPayRequest
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+	if len(body.ExpenseIDs) == 0 {
+		writeValidationErrors(w, FieldErrors{"expenseIDs": "is required"})
+		return
+	}
+	if len(body.ExpenseIDs) > maxBulkPay {
+		writeValidationErrors(w, FieldErrors{"expenseIDs": "must list at most " + strconv.Itoa(maxBulkPay) + " requests"})
+		return
+	}
+
+	result := BulkPayResult{Paid: []BulkPayItem{}, Skipped: []BulkPayItem{}}
+	seen := map[int]bool{}
+	for _, id := range body.ExpenseIDs {
+		if seen[id] {
+			result.Skipped = append(result.Skipped, BulkPayItem{ExpenseID: id, Reason: "listed more than once"})
+			continue
+		}
+		seen[id] = true
+
+		payments, err := s.payExpenseInFull(r.Context(), id, caller.ID)
+		var skip errSkipPayment
+		if errors.As(err, &skip) {
+			result.Skipped = append(result.Skipped, BulkPayItem{ExpenseID: id, Reason: skip.reason})
+			continue
+		} else if err != nil {
+			log.Printf("Bulk pay of expense request %d failed: %v", id, err)
+			result.Skipped = append(result.Skipped, BulkPayItem{ExpenseID: id, Reason: "internal error"})
+			continue
+		}
+
+		for _, payment := range payments {
+			result.Paid = append(result.Paid, BulkPayItem{ExpenseID: id, PaymentID: payment.ID, Amount: payment.Amount, Currency: payment.Currency})
+			s.publish(Event{Type: EventPaymentChanged, UnitID: payment.UnitID, Data: payment})
+			s.emitWebhook(r.Context(), WebhookPaymentCreated, payment)
+		}
+		s.publishStateChange(r.Context(), ExpenseActivity{ExpenseID: id, CurrentState: Paid, Feedback: "Paid in bulk", CreatedBy: caller.ID})
+		s.notifyRequester(r.Context(), id, caller.ID, EmailExpenseUpdate, "was paid.")
+		for _, payment := range payments {
+			s.notifyBudgetThreshold(r.Context(), payment, caller.ID)
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(result)
+}
@@ -1,34 +1,24 @@
 package server
 
 import (
+	"database/sql"
 	"encoding/json"
 	"log"
+	"main/budgetrules"
+	"main/money"
 	"net/http"
 	"strconv"
-	"time"
 
 	"github.com/gorilla/mux"
 )
 
-// /expenses/{expense_id}/pay
-// func (s *Server) payExpense(w http.ResponseWriter, r *http.Request) {
-// fetch expense request
-// fetch budget
-// spent = fetch all paid so far for unit-category-year and sum result
-// budget - spent = rest
-// budgetMax = budget + ratio*budget
-
-// if spent < budget && spent + amount > budget && spent + amount < maxBudget
-//
-// if spent < budget && spent + amount > budget && spent + amount > maxBudget
-//
-// if spent > budget && spent + amount > budget && spent + amount < maxBudget
-//
-// if spent > budget && spent + amount > budget && spent + amount > maxBudget
-//
-// }
-
+// PayExpense reports where a recorded payment leaves its budget, for
+// Accountants and Admins. The rules themselves live in budgetrules.
 func (s *Server) PayExpense(w http.ResponseWriter, r *http.Request) {
+	if _, ok := s.requireRole(w, r, Accounter, Admin); !ok {
+		return
+	}
+
 	vars := mux.Vars(r)
 	idStr := vars["id"]
 	id, err := strconv.Atoi(idStr)
@@ -37,93 +27,97 @@ func (s *Server) PayExpense(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// 1. Fetch the PaidExpense
+	// The payment, the year of its request, the budget, what was spent from
+	// it and the conversion rounding rule come in one statement, so the sum
+	// and the budget are read from the same snapshot as the payment
 	var paid PaidExpense
-	err = s.DB.QueryRow(`
-		SELECT id, expense_id, unit_id, category, amount, created_at
-		FROM paid_expense
-		WHERE id = $1
-	`, id).Scan(
+	var year *int
+	var hasRequest, hasBudget bool
+	var limit *money.Amount
+	var thresholdRatio *float64
+	var spent money.Amount
+	var minorUnits sql.NullInt64
+	var increment sql.NullFloat64
+	var mode sql.NullString
+	err = s.DB.QueryRowContext(r.Context(), `
+		WITH paid AS (
+			SELECT pe.id, pe.expense_id, pe.unit_id, pe.category, pe.amount, pe.created_at, pe.currency,
+				er.id IS NOT NULL AS has_request, fiscal_year(er.created_at, er.unit_id) AS year
+			FROM paid_expense pe
+			LEFT JOIN expense_request er ON er.id = pe.expense_id
+			WHERE pe.id = $1
+		)
+		SELECT paid.id, paid.expense_id, paid.unit_id, paid.category, paid.amount, paid.created_at, paid.currency,
+			paid.has_request, paid.year, b.year IS NOT NULL,
+			`+s.inBaseCurrency("b.budget_limit", "b.currency", "CURRENT_DATE")+`, b.threshold_ratio,
+			(SELECT COALESCE(SUM(`+s.inBaseCurrency("pe.amount", "pe.currency", "pe.created_at::date")+`), 0)
+				FROM paid_expense pe
+				WHERE pe.unit_id = paid.unit_id AND pe.category = paid.category AND fiscal_year(pe.created_at, pe.unit_id) = paid.year),
+			c.minor_units, rr.increment, rr.mode
+		FROM paid
+		LEFT JOIN budget b ON b.unit_id = paid.unit_id AND b.expense_category = paid.category AND b.year = paid.year
+		LEFT JOIN currency c ON c.code = $2
+		LEFT JOIN rounding_rule rr ON rr.currency = $2 AND rr.kind = $3
+	`, id, s.BaseCurrency, RoundConversion).Scan(
 		&paid.ID,
 		&paid.ExpenseID,
 		&paid.UnitID,
 		&paid.Category,
 		&paid.Amount,
 		&paid.CreatedAt,
+		&paid.Currency,
+		&hasRequest,
+		&year,
+		&hasBudget,
+		&limit,
+		&thresholdRatio,
+		&spent,
+		&minorUnits,
+		&increment,
+		&mode,
 	)
 	if err != nil {
 		http.Error(w, "Paid expense not found", http.StatusNotFound)
 		log.Println("Query error:", err)
 		return
 	}
-
-	// 2. Fetch the corresponding ExpenseRequest to get year
-	var createdAt time.Time
-	err = s.DB.QueryRow(`
-		SELECT created_at
-		FROM expense_request
-		WHERE id = $1
-	`, paid.ExpenseID).Scan(&createdAt)
-	if err != nil {
+	if !hasRequest {
 		http.Error(w, "Related expense request not found", http.StatusInternalServerError)
-		log.Println("ExpenseRequest fetch error:", err)
+		log.Println("ExpenseRequest fetch error: paid expense", paid.ID, "has no expense request")
 		return
 	}
-	year := createdAt.Year()
-
-	// 3. Fetch the Budget
-	var budget Budget
-	err = s.DB.QueryRow(`
-		SELECT unit_id, expense_category AS category, year, budget_limit, threshold_ratio
-		FROM budget
-		WHERE unit_id = $1 AND expense_category = $2 AND year = $3
-	`, paid.UnitID, paid.Category, year).Scan(
-		&budget.UnitID,
-		&budget.Category,
-		&budget.Year,
-		&budget.BudgetLimit,
-		&budget.ThresholdRatio,
-	)
-	if err != nil {
+	if !hasBudget {
 		http.Error(w, "Budget not found", http.StatusInternalServerError)
-		log.Println("Budget fetch error:", err)
+		log.Println("Budget fetch error: no budget for", paid.UnitID, paid.Category, *year)
 		return
 	}
-
-	// 4. Sum all paid amounts for same unit-category-year
-	var spent float64
-	err = s.DB.QueryRow(`
-		SELECT COALESCE(SUM(amount), 0)
-		FROM paid_expense
-		WHERE unit_id = $1 AND category = $2 AND EXTRACT(YEAR FROM created_at) = $3
-	`, paid.UnitID, paid.Category, year).Scan(&spent)
-	if err != nil {
-		http.Error(w, "Failed to calculate spent amount", http.StatusInternalServerError)
-		log.Println("Spent calculation error:", err)
+	if limit == nil {
+		http.Error(w, "No exchange rate known for the budget's currency", http.StatusConflict)
 		return
 	}
+	budget := Budget{Year: *year, BudgetLimit: *limit, ThresholdRatio: *thresholdRatio}
+	rounding := roundingRuleOf(s.BaseCurrency, RoundConversion, minorUnits, increment, mode)
 
-	// 5. Compute rest and budgetMax
-	rest := budget.BudgetLimit - spent
-	budgetMax := budget.BudgetLimit + (budget.ThresholdRatio * budget.BudgetLimit)
+	headroom := budgetrules.Compute(
+		budgetrules.Budget{Limit: budget.BudgetLimit, ThresholdRatio: budget.ThresholdRatio},
+		spent,
+		rounding.Round,
+	)
 
-	// 6. Send response
 	resp := map[string]interface{}{
 		"paidExpense": paid,
 		"budget": map[string]interface{}{
 			"year":      budget.Year,
-			"limit":     budget.BudgetLimit,
+			"currency":  s.BaseCurrency,
+			"limit":     headroom.Limit,
 			"threshold": budget.ThresholdRatio,
-			"spent":     spent,
-			"rest":      rest,
-			"budgetMax": budgetMax,
+			"spent":     headroom.Spent,
+			"rest":      headroom.Rest,
+			"budgetMax": headroom.Max,
+			"status":    headroom.Status,
 		},
 	}
 
 	w.Header().Set("Content-Type", "application/json; charset=utf-8")
 	json.NewEncoder(w).Encode(resp)
 }
-
-func sendAnnouncement(senderID int, receiverID int, message string) {
-	// add entry to announcements
-}
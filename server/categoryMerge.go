@@ -0,0 +1,150 @@
+package server
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+
+	"github.com/gorilla/mux"
+)
+
+// CategoryMerge reports what merging one category into another changed.
+type CategoryMerge struct {
+	From            string `json:"from"`
+	Into            string `json:"into"`
+	BudgetsCombined int64  `json:"budgetsCombined"` // source budgets added to a target budget for the same unit and year
+	RowsMoved       int64  `json:"rowsMoved"`       // budgets, freezes, requests, payments and drafts now under the target
+}
+
+// MergeExpenseCategory folds a duplicate category into another one. Budgets
+// the target already has for the same unit and year are combined by adding
+// the limits; everything else referring to the source is moved to the
+// target and the source is deleted, all in one transaction.
+func (s *Server) MergeExpenseCategory(w http.ResponseWriter, r *http.Request) {
+	caller, ok := s.requireRole(w, r, Accounter, Admin)
+	if !ok {
+		return
+	}
+	vars := mux.Vars(r)
+	from, into := vars["name"], vars["target"]
+	if from == into {
+		writeValidationErrors(w, FieldErrors{"target": "must differ from the category being merged"})
+		return
+	}
+
+	ctx := r.Context()
+	tx, err := s.DB.BeginTx(ctx, nil)
+	if err != nil {
+		log.Printf("Begin transaction error: %v", err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	// Lock both categories so no budget is created under either meanwhile
+	var found int
+	err = tx.QueryRowContext(ctx, "SELECT COUNT(*) FROM (SELECT name FROM expense_category WHERE name IN ($1, $2) FOR UPDATE) c", from, into).Scan(&found)
+	if err != nil {
+		log.Printf("Category lookup error: %v", err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	if found != 2 {
+		http.Error(w, "Category not found", http.StatusNotFound)
+		return
+	}
+
+	var mismatched bool
+	err = tx.QueryRowContext(ctx, `
+		SELECT EXISTS(
+			SELECT 1 FROM budget src
+			JOIN budget dst ON dst.unit_id = src.unit_id AND dst.year = src.year AND dst.expense_category = $2
+			WHERE src.expense_category = $1 AND src.currency <> dst.currency
+		)`, from, into).Scan(&mismatched)
+	if err != nil {
+		log.Printf("Budget currency check error: %v", err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	if mismatched {
+		http.Error(w, "Both categories have budgets for the same unit and year in different currencies", http.StatusConflict)
+		return
+	}
+
+	// Budgets moved whole take their revisions along. A combined budget
+	// gets a revision for the limit it gained, while the history of the
+	// source budget stays under the source's name and ends there.
+	_, err = tx.ExecContext(ctx, `
+		UPDATE budget_revision r SET category = $2
+		WHERE r.category = $1 AND NOT EXISTS (
+			SELECT 1 FROM budget dst WHERE dst.expense_category = $2 AND dst.unit_id = r.unit_id AND dst.year = r.year
+		)`, from, into)
+	if err == nil {
+		_, err = tx.ExecContext(ctx, `
+			INSERT INTO budget_revision (unit_id, category, year, old_limit, new_limit, currency, reason, approved_by)
+			SELECT dst.unit_id, dst.expense_category, dst.year, dst.budget_limit, dst.budget_limit + src.budget_limit, dst.currency, $3, $5
+			FROM budget src
+			JOIN budget dst ON dst.unit_id = src.unit_id AND dst.year = src.year AND dst.expense_category = $2
+			WHERE src.expense_category = $1
+			UNION ALL
+			SELECT src.unit_id, src.expense_category, src.year, src.budget_limit, NULL, src.currency, $4, $5
+			FROM budget src
+			JOIN budget dst ON dst.unit_id = src.unit_id AND dst.year = src.year AND dst.expense_category = $2
+			WHERE src.expense_category = $1`, from, into, "Merged from "+from, "Merged into "+into, caller.ID)
+	}
+	if err != nil {
+		log.Printf("Budget revision merge error: %v", err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	merge := CategoryMerge{From: from, Into: into}
+	result, err := tx.ExecContext(ctx, `
+		UPDATE budget dst SET budget_limit = dst.budget_limit + src.budget_limit, version = dst.version + 1
+		FROM budget src
+		WHERE src.expense_category = $1 AND dst.expense_category = $2
+			AND dst.unit_id = src.unit_id AND dst.year = src.year`, from, into)
+	if err == nil {
+		merge.BudgetsCombined, err = result.RowsAffected()
+	}
+	if err == nil {
+		_, err = tx.ExecContext(ctx, `
+			DELETE FROM budget src USING budget dst
+			WHERE src.expense_category = $1 AND dst.expense_category = $2
+				AND dst.unit_id = src.unit_id AND dst.year = src.year`, from, into)
+	}
+	if err != nil {
+		log.Printf("Budget merge error: %v", err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	merge.RowsMoved, err = renameReferences(ctx, tx, expenseCategoryReferences, from, into)
+	if err != nil {
+		log.Printf("Category merge error: %v", err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	if _, err := tx.ExecContext(ctx, "DELETE FROM expense_category WHERE name = $1", from); err != nil {
+		log.Printf("Category delete error: %v", err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	if err := audit(ctx, tx, caller.ID, "expense_category.merge", merge); err != nil {
+		log.Printf("Audit log error: %v", err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		log.Printf("Commit error: %v", err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	s.invalidateReference(ctx, categoriesCacheKey)
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	if err := json.NewEncoder(w).Encode(merge); err != nil {
+		log.Printf("JSON encoding error: %v", err)
+	}
+}
@@ -0,0 +1,320 @@
+package server
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// ChangeLog records every row created, updated or deleted in the tables
+// clients keep offline copies of, for GET /changes. Triggers keep it, as
+// they keep collection_change, so imports, renames and cascades count too.
+// The audit log cannot serve here: it only records administrative actions.
+//
+// Each change carries the ID of the transaction that made it. The feed only
+// hands out changes of transactions older than every transaction still
+// running, so a change committed late never lands behind a cursor a client
+// already has.
+type ChangeLog struct{}
+
+// Change is a row created, updated or deleted. Path is where the row is read
+// from, or was before it was deleted.
+type Change struct {
+	Cursor    string            `json:"cursor"`
+	Entity    string            `json:"entity"`
+	Op        string            `json:"op"`
+	Key       map[string]string `json:"key"`
+	Path      string            `json:"path"`
+	ChangedAt time.Time         `json:"changedAt"`
+}
+
+// ChangeFeed is a page of changes, oldest first. Cursor is the since of the
+// next page, and More tells whether the page was cut off at the limit.
+type ChangeFeed struct {
+	Changes []Change `json:"changes"`
+	Cursor  string   `json:"cursor"`
+	More    bool     `json:"more"`
+}
+
+// changeLogRetention is how long changes are kept. A client that has not
+// synced for longer has to download everything again.
+const changeLogRetention = 90 * 24 * time.Hour
+
+const (
+	defaultChangeLimit = 100
+	maxChangeLimit     = 1000
+)
+
+// syncedTable is a table whose changes the feed carries. path is its API
+// path with the key columns of a row as placeholders. Rows belonging to an
+// expense request name it in request, and are only listed to those who may
+// read the request.
+type syncedTable struct {
+	table, request, path string
+}
+
+var syncedTables = []syncedTable{
+	{table: "expense_request", request: "id", path: "/expense_requests/{id}"},
+	{table: "expense_activity", request: "expense_id", path: "/expense_activities/{id}"},
+	{table: "expense_comment", request: "expense_id", path: "/expense_requests/{expense_id}/comments"},
+	{table: "expense_line", request: "expense_id", path: "/expense_requests/{expense_id}/lines/{id}"},
+	{table: "expense_attachment", request: "expense_id", path: "/expense_requests/{expense_id}/attachments/{id}"},
+	{table: "paid_expense", request: "expense_id", path: "/paid_expenses/{id}"},
+	{table: "budget", path: "/budgets/{unit_id}/{expense_category}/{year}"},
+	{table: "unit", path: "/units/{name}"},
+	{table: "expense_category", path: "/expense_categories/{name}"},
+	{table: "vendor", path: "/vendors/{id}"},
+}
+
+var pathColumnPattern = regexp.MustCompile(`\{(\w+)\}`)
+
+// keyColumns are the columns a change of the table records.
+func (t syncedTable) keyColumns() []string {
+	var columns []string
+	for _, m := range pathColumnPattern.FindAllStringSubmatch(t.path, -1) {
+		columns = append(columns, m[1])
+	}
+	return columns
+}
+
+// changePath is where the row of a change is read from.
+func changePath(entity string, key map[string]string) string {
+	for _, t := range syncedTables {
+		if t.table == entity {
+			return APIPrefix + pathColumnPattern.ReplaceAllStringFunc(t.path, func(p string) string {
+				return url.PathEscape(key[p[1:len(p)-1]])
+			})
+		}
+	}
+	return ""
+}
+
+func (ChangeLog) CreateTableIfNotExists(s *Server) {
+	// A key change, as when a unit is renamed, is recorded as the deletion
+	// of the old row and the creation of the new one. Rows of an expense
+	// request carry its owner and unit as they were at the change, since the
+	// request may be gone by the time the change is read.
+	query := `CREATE TABLE IF NOT EXISTS change_log (
+		id BIGSERIAL PRIMARY KEY,
+		tx BIGINT NOT NULL DEFAULT pg_current_xact_id()::text::bigint,
+		entity VARCHAR(64) NOT NULL,
+		op VARCHAR(8) NOT NULL,
+		key JSONB NOT NULL,
+		request_id INT,
+		owner_id INT,
+		unit_id VARCHAR(256),
+		changed_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+	);
+	CREATE INDEX IF NOT EXISTS change_log_tx_id_idx ON change_log (tx, id);
+	CREATE INDEX IF NOT EXISTS change_log_changed_at_idx ON change_log (changed_at);
+	CREATE OR REPLACE FUNCTION log_change() RETURNS trigger AS $$
+	DECLARE
+		request_column TEXT := TG_ARGV[0];
+		key_column TEXT;
+		value TEXT;
+		old_key JSONB := '{}';
+		new_key JSONB := '{}';
+		req_id INT;
+		req_owner INT;
+		req_unit TEXT;
+	BEGIN
+		FOREACH key_column IN ARRAY TG_ARGV[1:TG_NARGS - 1] LOOP
+			IF TG_OP <> 'INSERT' THEN
+				EXECUTE format('SELECT ($1).%I::text', key_column) INTO value USING OLD;
+				old_key := old_key || jsonb_build_object(key_column, value);
+			END IF;
+			IF TG_OP <> 'DELETE' THEN
+				EXECUTE format('SELECT ($1).%I::text', key_column) INTO value USING NEW;
+				new_key := new_key || jsonb_build_object(key_column, value);
+			END IF;
+		END LOOP;
+
+		IF request_column <> '' THEN
+			IF TG_OP = 'DELETE' THEN
+				EXECUTE format('SELECT ($1).%I', request_column) INTO req_id USING OLD;
+			ELSE
+				EXECUTE format('SELECT ($1).%I', request_column) INTO req_id USING NEW;
+			END IF;
+			IF TG_TABLE_NAME = 'expense_request' AND TG_OP = 'DELETE' THEN
+				req_owner := OLD.user_id;
+				req_unit := OLD.unit_id;
+			ELSE
+				SELECT user_id, unit_id INTO req_owner, req_unit FROM expense_request WHERE id = req_id;
+			END IF;
+		END IF;
+
+		IF TG_OP = 'INSERT' THEN
+			INSERT INTO change_log (entity, op, key, request_id, owner_id, unit_id)
+			VALUES (TG_TABLE_NAME, 'create', new_key, req_id, req_owner, req_unit);
+		ELSIF TG_OP = 'DELETE' THEN
+			INSERT INTO change_log (entity, op, key, request_id, owner_id, unit_id)
+			VALUES (TG_TABLE_NAME, 'delete', old_key, req_id, req_owner, req_unit);
+		ELSIF old_key = new_key THEN
+			INSERT INTO change_log (entity, op, key, request_id, owner_id, unit_id)
+			VALUES (TG_TABLE_NAME, 'update', new_key, req_id, req_owner, req_unit);
+		ELSE
+			INSERT INTO change_log (entity, op, key, request_id, owner_id, unit_id)
+			VALUES (TG_TABLE_NAME, 'delete', old_key, req_id, req_owner, req_unit),
+				(TG_TABLE_NAME, 'create', new_key, req_id, req_owner, req_unit);
+		END IF;
+		RETURN NULL;
+	END
+	$$ LANGUAGE plpgsql`
+
+	_, err := s.DB.Exec(query)
+
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	for _, t := range syncedTables {
+		args := []string{pq.QuoteLiteral(t.request)}
+		for _, column := range t.keyColumns() {
+			args = append(args, pq.QuoteLiteral(column))
+		}
+		_, err = s.DB.Exec(`CREATE OR REPLACE TRIGGER ` + t.table + `_log_change
+			AFTER INSERT OR UPDATE OR DELETE ON ` + t.table + `
+			FOR EACH ROW EXECUTE FUNCTION log_change(` + strings.Join(args, ", ") + `)`)
+
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+}
+
+// changeCursor is the position of a change in the feed, and when it was
+// made, so that cursors older than the retention can be told apart.
+type changeCursor struct {
+	tx, id int64
+	at     time.Time
+}
+
+func (c changeCursor) String() string {
+	return base64.RawURLEncoding.EncodeToString(fmt.Appendf(nil, "%d.%d.%d", c.tx, c.id, c.at.Unix()))
+}
+
+func parseChangeCursor(s string) (changeCursor, error) {
+	var c changeCursor
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return c, err
+	}
+	var at int64
+	if _, err := fmt.Sscanf(string(b), "%d.%d.%d", &c.tx, &c.id, &at); err != nil {
+		return c, err
+	}
+	c.at = time.Unix(at, 0)
+	return c, nil
+}
+
+// ListChanges lists the changes after the since cursor that the caller may
+// see. Without since it lists none and answers with the cursor of the
+// present, which a client takes before downloading everything and syncs
+// from afterwards; changes made during the download are listed again.
+func (s *Server) ListChanges(w http.ResponseWriter, r *http.Request) {
+	v, ok := s.viewerOf(w, r)
+	if !ok {
+		return
+	}
+	params := r.URL.Query()
+
+	limit := defaultChangeLimit
+	if l := params.Get("limit"); l != "" {
+		n, err := strconv.Atoi(l)
+		if err != nil || n < 1 || n > maxChangeLimit {
+			http.Error(w, "limit must be between 1 and "+strconv.Itoa(maxChangeLimit), http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+
+	// Transactions before xmin have all ended; changes of later ones wait
+	var xmin int64
+	err := s.DB.QueryRowContext(r.Context(), "SELECT pg_snapshot_xmin(pg_current_snapshot())::text::bigint").Scan(&xmin)
+	if err != nil {
+		log.Println("Change feed snapshot error:", err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	present := changeCursor{tx: xmin, at: time.Now()}
+
+	feed := ChangeFeed{Changes: []Change{}, Cursor: present.String()}
+	if params.Get("since") == "" {
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		json.NewEncoder(w).Encode(feed)
+		return
+	}
+	since, err := parseChangeCursor(params.Get("since"))
+	if err != nil {
+		http.Error(w, "Invalid since cursor", http.StatusBadRequest)
+		return
+	}
+	if since.at.Before(time.Now().Add(-changeLogRetention)) {
+		http.Error(w, "Changes since this cursor are no longer kept; download everything again", http.StatusGone)
+		return
+	}
+
+	scope := v.expenseScope()
+	all := scope == nil
+	if all {
+		scope = &ExpenseScope{}
+	}
+	rows, err := s.DB.QueryContext(r.Context(), `
+		SELECT tx, id, entity, op, key, changed_at FROM change_log
+		WHERE (tx, id) > ($1, $2) AND tx < $3
+			AND ($4 OR request_id IS NULL OR owner_id = $5 OR unit_id = ANY($6))
+		ORDER BY tx, id LIMIT $7
+	`, since.tx, since.id, xmin, all, scope.UserID, pq.Array(scope.Units), limit)
+	if err != nil {
+		log.Println("Change feed query error:", err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	last := since
+	for rows.Next() {
+		var c Change
+		var key []byte
+		if err := rows.Scan(&last.tx, &last.id, &c.Entity, &c.Op, &key, &c.ChangedAt); err != nil {
+			log.Println("Change feed scan error:", err)
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		if err := json.Unmarshal(key, &c.Key); err != nil {
+			log.Println("Change feed key error:", err)
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		last.at = c.ChangedAt
+		c.Cursor = last.String()
+		c.Path = changePath(c.Entity, c.Key)
+		feed.Changes = append(feed.Changes, c)
+	}
+	if err := rows.Err(); err != nil {
+		log.Println("Change feed rows error:", err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	switch {
+	case len(feed.Changes) == limit:
+		feed.Cursor, feed.More = last.String(), true
+	case since.tx >= xmin:
+		// Nothing new has ended since the client last synced. The cursor
+		// stays put, but is as recent as the sync, so polling keeps it valid
+		feed.Cursor = changeCursor{tx: since.tx, id: since.id, at: present.at}.String()
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(feed)
+}
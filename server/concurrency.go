@@ -0,0 +1,71 @@
+package server
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Budgets, users and expense requests carry a version that every write
+// increments. GET returns it as the ETag, and PUT and PATCH must send it back
+// in If-Match, so an edit made from a stale copy fails instead of silently
+// overwriting someone else's change. Stores report such a write as a
+// versionMismatchError; see store.go.
+
+// versionETag is the entity tag of a row version.
+func versionETag(version int) string {
+	return `"` + strconv.Itoa(version) + `"`
+}
+
+func setVersionETag(w http.ResponseWriter, version int) {
+	w.Header().Set("ETag", versionETag(version))
+}
+
+// ifMatchVersions reads the versions a write may apply to from If-Match.
+// "*" matches any version and yields nil. A missing header is answered with
+// 428 and tags that cannot be ours with 412.
+func ifMatchVersions(w http.ResponseWriter, r *http.Request) ([]int64, bool) {
+	header := strings.TrimSpace(r.Header.Get("If-Match"))
+	if header == "" {
+		http.Error(w, "If-Match with the ETag from a previous GET is required", http.StatusPreconditionRequired)
+		return nil, false
+	}
+	if header == "*" {
+		return nil, true
+	}
+
+	var versions []int64
+	for _, tag := range strings.Split(header, ",") {
+		// Weak tags never match under If-Match's strong comparison
+		tag = strings.TrimSpace(tag)
+		if len(tag) < 2 || tag[0] != '"' || tag[len(tag)-1] != '"' {
+			continue
+		}
+		if v, err := strconv.ParseInt(tag[1:len(tag)-1], 10, 64); err == nil {
+			versions = append(versions, v)
+		}
+	}
+	if len(versions) == 0 {
+		http.Error(w, "The resource has been modified; fetch it again", http.StatusPreconditionFailed)
+		return nil, false
+	}
+	return versions, true
+}
+
+// etagMatches reports whether an If-None-Match header names etag, under
+// the weak comparison it calls for.
+func etagMatches(header, etag string) bool {
+	for _, tag := range strings.Split(header, ",") {
+		tag = strings.TrimPrefix(strings.TrimSpace(tag), "W/")
+		if tag == "*" || tag == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// versionMatches is a WHERE condition on the versions from ifMatchVersions,
+// passed as pq.Array in placeholder p.
+func versionMatches(p string) string {
+	return "(" + p + "::bigint[] IS NULL OR version = ANY(" + p + "))"
+}
@@ -0,0 +1,123 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// CollectionChange records when each table listed over the API last
+// changed, for Last-Modified and If-Modified-Since on its list. Triggers
+// keep it, so that every way of writing the table counts, imports and
+// renames included.
+type CollectionChange struct{}
+
+// changeTrackedTables are the tables whose changes collection_change
+// records. The collection is named after the table.
+var changeTrackedTables = []string{"announcement", "unit", "expense_category"}
+
+func (CollectionChange) CreateTableIfNotExists(s *Server) {
+	// The time is taken once the row is locked, so a change committed
+	// after another is never recorded as older
+	query := `CREATE TABLE IF NOT EXISTS collection_change (
+		collection VARCHAR(64) PRIMARY KEY,
+		modified_at TIMESTAMPTZ NOT NULL
+	);
+	CREATE OR REPLACE FUNCTION touch_collection() RETURNS trigger AS $$
+	BEGIN
+		INSERT INTO collection_change (collection, modified_at) VALUES (TG_TABLE_NAME, clock_timestamp())
+		ON CONFLICT (collection) DO UPDATE SET modified_at = clock_timestamp();
+		RETURN NULL;
+	END
+	$$ LANGUAGE plpgsql`
+
+	_, err := s.DB.Exec(query)
+
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	for _, table := range changeTrackedTables {
+		_, err = s.DB.Exec(`CREATE OR REPLACE TRIGGER ` + table + `_touch_collection
+			AFTER INSERT OR UPDATE OR DELETE OR TRUNCATE ON ` + table + `
+			FOR EACH STATEMENT EXECUTE FUNCTION touch_collection()`)
+
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	// Collections that changed before they were tracked count as changed now
+	_, err = s.DB.Exec(`INSERT INTO collection_change (collection, modified_at)
+		SELECT unnest($1::text[]), NOW() ON CONFLICT (collection) DO NOTHING`, pq.Array(changeTrackedTables))
+
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// collectionModified is when the table collection last changed, or the
+// zero time when that is not known, as after collection_change was
+// emptied by hand.
+func (s *Server) collectionModified(ctx context.Context, collection string) (time.Time, error) {
+	var modified time.Time
+	err := s.DB.QueryRowContext(ctx, "SELECT modified_at FROM collection_change WHERE collection = $1", collection).Scan(&modified)
+	if err == sql.ErrNoRows {
+		return time.Time{}, nil
+	}
+	return modified, err
+}
+
+// setLastModified sets Last-Modified unless modified is not known.
+func setLastModified(w http.ResponseWriter, modified time.Time) {
+	if !modified.IsZero() {
+		w.Header().Set("Last-Modified", modified.UTC().Format(http.TimeFormat))
+	}
+}
+
+// notModifiedSince reports whether the request's If-Modified-Since shows
+// the client has the collection as it was last modified. It is false when
+// the request sends If-None-Match, which takes precedence.
+func notModifiedSince(r *http.Request, modified time.Time) bool {
+	header := r.Header.Get("If-Modified-Since")
+	if header == "" || modified.IsZero() || r.Header.Get("If-None-Match") != "" {
+		return false
+	}
+	since, err := http.ParseTime(header)
+	if err != nil {
+		return false
+	}
+	// HTTP dates stop at seconds
+	return !modified.Truncate(time.Second).After(since)
+}
+
+// writeConditional answers a GET with v, its ETag and the Last-Modified of
+// its collection, or with 304 when If-None-Match or If-Modified-Since show
+// the client has it already. A zero modified sends no Last-Modified.
+func writeConditional(w http.ResponseWriter, r *http.Request, v any, modified time.Time) {
+	var body bytes.Buffer
+	if err := json.NewEncoder(&body).Encode(v); err != nil {
+		log.Println("JSON encoding error:", err)
+		http.Error(w, "Failed to encode response", http.StatusInternalServerError)
+		return
+	}
+	sum := sha256.Sum256(body.Bytes())
+	etag := `"` + hex.EncodeToString(sum[:8]) + `"`
+
+	w.Header().Set("ETag", etag)
+	setLastModified(w, modified)
+	if etagMatches(r.Header.Get("If-None-Match"), etag) || notModifiedSince(r, modified) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.Write(body.Bytes())
+}
@@ -0,0 +1,88 @@
+package server
+
+import (
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// corsExposedHeaders are the response headers browser clients may read
+// besides the CORS-safelisted ones.
+var corsExposedHeaders = []string{"ETag", "Content-Disposition", "Idempotent-Replayed", "Deprecation", "Sunset", "Link", "API-Version", "Retry-After", "RateLimit-Limit", "RateLimit-Remaining"}
+
+// CORSPolicy is which cross-origin browser clients may call the API. An
+// empty Origins list turns CORS off.
+type CORSPolicy struct {
+	Origins          []string // scheme://host[:port], or * for any origin
+	Methods          []string
+	Headers          []string // request headers a client may send
+	AllowCredentials bool     // lets browsers send cookies and HTTP auth
+	MaxAge           time.Duration
+}
+
+func (p CORSPolicy) allowsOrigin(origin string) bool {
+	return slices.Contains(p.Origins, "*") || slices.Contains(p.Origins, origin)
+}
+
+// CORSMiddleware applies the server's CORS policy in front of the whole
+// router, so preflight requests are answered even for paths whose routes
+// have no OPTIONS method.
+func (s *Server) CORSMiddleware(next http.Handler) http.Handler {
+	p := s.CORS
+	if len(p.Origins) == 0 {
+		return next
+	}
+	methods := strings.Join(p.Methods, ", ")
+	headers := strings.Join(p.Headers, ", ")
+	exposed := strings.Join(corsExposedHeaders, ", ")
+	maxAge := strconv.Itoa(int(p.MaxAge.Seconds()))
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		if origin == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		h := w.Header()
+		h.Add("Vary", "Origin")
+
+		preflight := r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != ""
+		if !p.allowsOrigin(origin) {
+			if preflight {
+				// Without CORS headers the browser refuses the real request
+				w.WriteHeader(http.StatusNoContent)
+				return
+			}
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if slices.Contains(p.Origins, "*") && !p.AllowCredentials {
+			h.Set("Access-Control-Allow-Origin", "*")
+		} else {
+			h.Set("Access-Control-Allow-Origin", origin)
+		}
+		if p.AllowCredentials {
+			h.Set("Access-Control-Allow-Credentials", "true")
+		}
+
+		if !preflight {
+			h.Set("Access-Control-Expose-Headers", exposed)
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		h.Add("Vary", "Access-Control-Request-Method")
+		h.Add("Vary", "Access-Control-Request-Headers")
+		if slices.Contains(p.Methods, r.Header.Get("Access-Control-Request-Method")) {
+			h.Set("Access-Control-Allow-Methods", methods)
+			h.Set("Access-Control-Allow-Headers", headers)
+			if p.MaxAge > 0 {
+				h.Set("Access-Control-Max-Age", maxAge)
+			}
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
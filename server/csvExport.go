@@ -0,0 +1,121 @@
+package server
+
+import (
+	"encoding/csv"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// exportFlushEvery is how many rows of a CSV or NDJSON export are buffered
+// before they are sent.
+const exportFlushEvery = 500
+
+// listFormat returns "json", "csv" or "ndjson" from ?format=, writing a
+// 400 for anything else.
+func listFormat(w http.ResponseWriter, r *http.Request) (string, bool) {
+	switch format := r.URL.Query().Get("format"); format {
+	case "", "json":
+		return "json", true
+	case "csv", "ndjson":
+		return format, true
+	default:
+		http.Error(w, "format must be json, csv or ndjson", http.StatusBadRequest)
+		return "", false
+	}
+}
+
+// csvExport streams list results as CSV while the rows are being read, so a
+// large export never sits in memory. Headers are sent with the first row, so
+// errors before that can still be reported with a status code.
+type csvExport struct {
+	w        http.ResponseWriter
+	out      *csv.Writer
+	filename string
+	header   []string
+	rows     int
+}
+
+func newCSVExport(w http.ResponseWriter, name string, header []string) *csvExport {
+	return &csvExport{
+		w:        w,
+		out:      csv.NewWriter(w),
+		filename: name + "-" + time.Now().Format("2006-01-02") + ".csv",
+		header:   header,
+	}
+}
+
+func (e *csvExport) start() error {
+	e.w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	e.w.Header().Set("Content-Disposition", `attachment; filename="`+e.filename+`"`)
+	// The byte order mark makes Excel read the file as UTF-8
+	if _, err := e.w.Write([]byte("\ufeff")); err != nil {
+		return err
+	}
+	return e.out.Write(e.header)
+}
+
+func (e *csvExport) write(record []string) error {
+	if e.rows == 0 {
+		if err := e.start(); err != nil {
+			return err
+		}
+	}
+	if err := e.out.Write(record); err != nil {
+		return err
+	}
+	e.rows++
+	if e.rows%exportFlushEvery == 0 {
+		e.out.Flush()
+		http.NewResponseController(e.w).Flush()
+	}
+	return e.out.Error()
+}
+
+// close sends the header even when there were no rows and flushes the rest.
+func (e *csvExport) close() error {
+	if e.rows == 0 {
+		if err := e.start(); err != nil {
+			return err
+		}
+	}
+	e.out.Flush()
+	return e.out.Error()
+}
+
+// csvText neutralises values a spreadsheet would run as a formula.
+func csvText(s string) string {
+	if s != "" && strings.ContainsRune("=+-@\t\r", rune(s[0])) {
+		return "'" + s
+	}
+	return s
+}
+
+func csvFloat(f float64) string {
+	return strconv.FormatFloat(f, 'f', 2, 64)
+}
+
+// csvOptional formats v, or leaves the cell empty when it is missing.
+func csvOptional[T any](v *T, format func(T) string) string {
+	if v == nil {
+		return ""
+	}
+	return format(*v)
+}
+
+// csvHidden leaves the cell empty when field is hidden from the caller.
+func csvHidden(hidden []string, field, value string) string {
+	if slices.Contains(hidden, field) {
+		return ""
+	}
+	return value
+}
+
+func csvTime(t *time.Time) string {
+	if t == nil {
+		return ""
+	}
+	return t.Format(time.RFC3339)
+}
@@ -0,0 +1,339 @@
+package server
+
+import (
+	"context"
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"main/money"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+const (
+	maxImportSize = 10 << 20
+	maxImportRows = 10000
+)
+
+// ImportRowError lists what is wrong with one CSV row. Row is the line in the
+// file, counting the header as line 1.
+type ImportRowError struct {
+	Row    int         `json:"row"`
+	Errors FieldErrors `json:"errors"`
+}
+
+// ImportResult reports a CSV import. Nothing is stored when there are errors
+// or the import is a dry run.
+type ImportResult struct {
+	DryRun   bool             `json:"dryRun"`
+	Rows     int              `json:"rows"`
+	Imported int              `json:"imported"`
+	Errors   []ImportRowError `json:"errors"`
+}
+
+// csvRows is an uploaded CSV file. Columns are found by header name, so
+// they may come in any order and files from the list exports can be
+// imported again.
+type csvRows struct {
+	columns map[string]int
+	records [][]string
+}
+
+// get returns the trimmed value of column name in record i, or "" when the
+// file has no such column.
+func (c *csvRows) get(i int, name string) string {
+	col, ok := c.columns[strings.ToLower(name)]
+	if !ok {
+		return ""
+	}
+	return strings.TrimSpace(c.records[i][col])
+}
+
+// readCSVUpload reads a CSV body sent as text/csv or as the "file" field of a
+// multipart upload and checks that it has the required columns.
+func readCSVUpload(w http.ResponseWriter, r *http.Request, required ...string) (*csvRows, bool) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxImportSize)
+
+	var body io.Reader = r.Body
+	if mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mediaType == "multipart/form-data" {
+		file, _, err := r.FormFile("file")
+		if err != nil {
+			http.Error(w, "Expected a multipart upload with a \"file\" field", http.StatusBadRequest)
+			return nil, false
+		}
+		defer file.Close()
+		body = file
+	}
+
+	records, err := csv.NewReader(body).ReadAll()
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		http.Error(w, "CSV file is too large", http.StatusRequestEntityTooLarge)
+		return nil, false
+	} else if err != nil {
+		http.Error(w, "Invalid CSV: "+err.Error(), http.StatusBadRequest)
+		return nil, false
+	}
+	if len(records) == 0 {
+		http.Error(w, "CSV file is empty", http.StatusBadRequest)
+		return nil, false
+	}
+	if len(records)-1 > maxImportRows {
+		http.Error(w, "CSV file has more than "+strconv.Itoa(maxImportRows)+" rows", http.StatusRequestEntityTooLarge)
+		return nil, false
+	}
+
+	rows := &csvRows{columns: map[string]int{}, records: records[1:]}
+	for i, name := range records[0] {
+		if i == 0 {
+			// Spreadsheets, and our own exports, start the file with a byte order mark
+			name = strings.TrimPrefix(name, "\ufeff")
+		}
+		rows.columns[strings.ToLower(strings.TrimSpace(name))] = i
+	}
+	var missing []string
+	for _, name := range required {
+		if _, ok := rows.columns[strings.ToLower(name)]; !ok {
+			missing = append(missing, name)
+		}
+	}
+	if len(missing) > 0 {
+		http.Error(w, "CSV header is missing columns: "+strings.Join(missing, ", "), http.StatusBadRequest)
+		return nil, false
+	}
+	return rows, true
+}
+
+// importRows checks n parsed rows with check and, unless any row is invalid
+// or ?dryRun=true, stores them all with insert in one transaction. It
+// reports the outcome and returns true when the rows were committed.
+func (s *Server) importRows(w http.ResponseWriter, r *http.Request, n int,
+	check func(ctx context.Context, i int) (FieldErrors, error),
+	insert func(ctx context.Context, tx *sql.Tx, i int) (FieldErrors, error),
+) bool {
+	result := ImportResult{Rows: n, Errors: []ImportRowError{}}
+	if v := r.URL.Query().Get("dryRun"); v != "" {
+		var err error
+		if result.DryRun, err = strconv.ParseBool(v); err != nil {
+			http.Error(w, "Invalid dry_run parameter", http.StatusBadRequest)
+			return false
+		}
+	}
+
+	ctx := r.Context()
+	for i := 0; i < n; i++ {
+		errs, err := check(ctx, i)
+		if err != nil {
+			log.Println("Validation query error:", err)
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return false
+		}
+		if len(errs) > 0 {
+			result.Errors = append(result.Errors, ImportRowError{Row: i + 2, Errors: errs})
+		}
+	}
+
+	if len(result.Errors) == 0 && !result.DryRun {
+		tx, err := s.DB.BeginTx(ctx, nil)
+		if err != nil {
+			log.Println("Begin transaction error:", err)
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return false
+		}
+		defer tx.Rollback()
+
+		for i := 0; i < n; i++ {
+			errs, err := insert(ctx, tx, i)
+			if err != nil {
+				log.Printf("Import row %d failed: %v", i+2, err)
+				http.Error(w, "Failed to import rows", http.StatusInternalServerError)
+				return false
+			}
+			// Rows created by someone else since they were checked
+			if len(errs) > 0 {
+				result.Errors = append(result.Errors, ImportRowError{Row: i + 2, Errors: errs})
+			}
+		}
+		if len(result.Errors) == 0 {
+			if err := tx.Commit(); err != nil {
+				log.Println("Commit error:", err)
+				http.Error(w, "Database error", http.StatusInternalServerError)
+				return false
+			}
+			result.Imported = n
+		}
+	}
+
+	status := http.StatusOK
+	switch {
+	case len(result.Errors) > 0:
+		status = http.StatusUnprocessableEntity
+	case result.Imported > 0:
+		status = http.StatusCreated
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(result)
+	return result.Imported > 0
+}
+
+// parseImportFloat parses a number column, recording an error when it is
+// empty or not a number.
+func parseImportFloat(errs FieldErrors, field, value string) float64 {
+	f, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		errs.add(field, "must be a number")
+	}
+	return f
+}
+
+// parseImportAmount parses an amount column, recording an error when it is
+// empty or not a number.
+func parseImportAmount(errs FieldErrors, field, value string) money.Amount {
+	a, err := money.Parse(value)
+	if err != nil {
+		errs.add(field, "must be a number")
+	}
+	return a
+}
+
+// ImportBudgets creates budgets from a CSV file with the columns unitID,
+// category, year, budgetLimit, thresholdRatio and optionally currency.
+func (s *Server) ImportBudgets(w http.ResponseWriter, r *http.Request) {
+	caller, ok := s.requireRole(w, r, Accounter, Admin)
+	if !ok {
+		return
+	}
+
+	rows, ok := readCSVUpload(w, r, "unitID", "category", "year", "budgetLimit", "thresholdRatio")
+	if !ok {
+		return
+	}
+
+	budgets := make([]Budget, len(rows.records))
+	seen := map[budgetKey]int{}
+	check := func(ctx context.Context, i int) (FieldErrors, error) {
+		parseErrs := FieldErrors{}
+		b := Budget{
+			UnitID:         rows.get(i, "unitID"),
+			Category:       rows.get(i, "category"),
+			BudgetLimit:    parseImportAmount(parseErrs, "budgetLimit", rows.get(i, "budgetLimit")),
+			ThresholdRatio: parseImportFloat(parseErrs, "thresholdRatio", rows.get(i, "thresholdRatio")),
+			Currency:       s.currencyOrBase(strings.ToUpper(rows.get(i, "currency"))),
+		}
+		year, err := strconv.Atoi(rows.get(i, "year"))
+		if err != nil {
+			parseErrs.add("year", "must be a whole number")
+		}
+		b.Year = year
+		budgets[i] = b
+
+		errs, err := b.Validate(ctx, s)
+		if err != nil {
+			return nil, err
+		}
+		// Parse errors replace the range errors their zero values cause
+		for field, message := range parseErrs {
+			errs[field] = message
+		}
+
+		key := budgetKey{b.UnitID, b.Category, b.Year}
+		if first, ok := seen[key]; ok {
+			errs.add("year", "duplicates the budget on row "+strconv.Itoa(first+2))
+		} else {
+			seen[key] = i
+			if err := s.checkUnique(ctx, errs, "year", "budget already exists",
+				"SELECT 1 FROM budget WHERE unit_id = $1 AND expense_category = $2 AND year = $3",
+				b.UnitID, b.Category, b.Year); err != nil {
+				return nil, err
+			}
+		}
+		return errs, nil
+	}
+
+	insert := func(ctx context.Context, tx *sql.Tx, i int) (FieldErrors, error) {
+		b := &budgets[i]
+		err := tx.QueryRowContext(ctx, `
+			INSERT INTO budget (unit_id, expense_category, year, budget_limit, threshold_ratio, currency)
+			VALUES ($1, $2, $3, $4, $5, $6)
+			ON CONFLICT (unit_id, expense_category, year) DO NOTHING
+			RETURNING version
+		`, b.UnitID, b.Category, b.Year, b.BudgetLimit, b.ThresholdRatio, b.Currency).Scan(&b.Version)
+		if err == sql.ErrNoRows {
+			return FieldErrors{"year": "budget already exists"}, nil
+		} else if err != nil {
+			return nil, err
+		}
+		key := BudgetKey{b.UnitID, b.Category, b.Year}
+		return nil, recordBudgetRevision(ctx, tx, key, nil, &b.BudgetLimit, b.Currency, "Imported", caller.ID)
+	}
+
+	if !s.importRows(w, r, len(budgets), check, insert) {
+		return
+	}
+	if err := audit(r.Context(), s.DB, caller.ID, "budgets.import", map[string]int{"rows": len(budgets)}); err != nil {
+		log.Println("Audit log error:", err)
+	}
+	for _, b := range budgets {
+		s.publish(Event{Type: EventBudgetChanged, UnitID: b.UnitID, Data: b})
+	}
+}
+
+// ImportExpenseCategories creates expense categories from a CSV file with a
+// name column.
+func (s *Server) ImportExpenseCategories(w http.ResponseWriter, r *http.Request) {
+	caller, ok := s.requireRole(w, r, Accounter, Admin)
+	if !ok {
+		return
+	}
+
+	rows, ok := readCSVUpload(w, r, "name")
+	if !ok {
+		return
+	}
+
+	categories := make([]ExpenseCategory, len(rows.records))
+	seen := map[string]int{}
+	check := func(ctx context.Context, i int) (FieldErrors, error) {
+		c := ExpenseCategory{Name: rows.get(i, "name")}
+		categories[i] = c
+
+		errs, err := c.Validate(ctx, s)
+		if err != nil || c.Name == "" {
+			return errs, err
+		}
+		if first, ok := seen[c.Name]; ok {
+			errs.add("name", "duplicates the category on row "+strconv.Itoa(first+2))
+			return errs, nil
+		}
+		seen[c.Name] = i
+		err = s.checkUnique(ctx, errs, "name", "category already exists",
+			"SELECT 1 FROM expense_category WHERE name = $1", c.Name)
+		return errs, err
+	}
+
+	insert := func(ctx context.Context, tx *sql.Tx, i int) (FieldErrors, error) {
+		result, err := tx.ExecContext(ctx,
+			"INSERT INTO expense_category (name) VALUES ($1) ON CONFLICT (name) DO NOTHING", categories[i].Name)
+		if err != nil {
+			return nil, err
+		}
+		if n, err := result.RowsAffected(); err != nil || n == 0 {
+			return FieldErrors{"name": "category already exists"}, err
+		}
+		return nil, nil
+	}
+
+	if !s.importRows(w, r, len(categories), check, insert) {
+		return
+	}
+	s.invalidateReference(r.Context(), categoriesCacheKey)
+	if err := audit(r.Context(), s.DB, caller.ID, "expense_categories.import", map[string]int{"rows": len(categories)}); err != nil {
+		log.Println("Audit log error:", err)
+	}
+}
@@ -0,0 +1,369 @@
+package server
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"main/query"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/lib/pq"
+)
+
+// currencyCode matches ISO 4217 alphabetic codes.
+var currencyCode = regexp.MustCompile(`^[A-Z]{3}$`)
+
+// ValidCurrencyCode reports whether code looks like an ISO 4217 code.
+func ValidCurrencyCode(code string) bool {
+	return currencyCode.MatchString(code)
+}
+
+type Currency struct {
+	Code       string `json:"code"`
+	Name       string `json:"name"`
+	MinorUnits int    `json:"minorUnits"`
+}
+
+func (Currency) CreateTableIfNotExists(s *Server) {
+	query := `CREATE TABLE IF NOT EXISTS currency (
+		code CHAR(3) PRIMARY KEY,
+		name VARCHAR(256) NOT NULL DEFAULT '',
+		minor_units INT NOT NULL DEFAULT 2
+	)`
+
+	_, err := s.DB.Exec(query)
+
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	_, err = s.DB.Exec("INSERT INTO currency (code) VALUES ($1) ON CONFLICT (code) DO NOTHING", s.BaseCurrency)
+
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+func (c Currency) Validate(ctx context.Context, s *Server) (FieldErrors, error) {
+	errs := FieldErrors{}
+	if !ValidCurrencyCode(c.Code) {
+		errs.add("code", "must be a three-letter ISO 4217 code")
+	}
+	if c.MinorUnits < 0 || c.MinorUnits > 4 {
+		errs.add("minorUnits", "must be between 0 and 4")
+	}
+	if err := s.checkUnique(ctx, errs, "code", "currency already exists",
+		"SELECT 1 FROM currency WHERE code = $1", c.Code); err != nil {
+		return nil, err
+	}
+	return errs, nil
+}
+
+// rateSourceManual marks rates entered through the API. The sync job never
+// overwrites them.
+const rateSourceManual = "manual"
+
+// ExchangeRate is how many units of the base currency one unit of Currency
+// was worth on Date (YYYY-MM-DD). A rate stays in effect until the next one.
+// Source is "manual" or the name of the provider it was fetched from.
+type ExchangeRate struct {
+	Currency  string     `json:"currency"`
+	Date      string     `json:"date"`
+	Rate      float64    `json:"rate"`
+	Source    string     `json:"source,omitempty"`
+	UpdatedAt *time.Time `json:"updatedAt,omitempty"`
+}
+
+func (ExchangeRate) CreateTableIfNotExists(s *Server) {
+	query := `CREATE TABLE IF NOT EXISTS exchange_rate (
+		currency CHAR(3) NOT NULL,
+		rate_date DATE NOT NULL,
+		rate NUMERIC(18,8) NOT NULL,
+
+		PRIMARY KEY (currency, rate_date)
+	)`
+
+	_, err := s.DB.Exec(query)
+
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	_, err = s.DB.Exec(`ALTER TABLE exchange_rate
+		ADD COLUMN IF NOT EXISTS source VARCHAR(32) NOT NULL DEFAULT 'manual',
+		ADD COLUMN IF NOT EXISTS updated_at TIMESTAMPTZ NOT NULL DEFAULT NOW()`)
+
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// effectiveRate returns the rate in effect for currency on date: the latest
+// one recorded on or before it. The base currency always has rate 1. ok is
+// false when no rate is known yet.
+func (s *Server) effectiveRate(ctx context.Context, db dbtx, currency, date string) (rate ExchangeRate, ok bool, err error) {
+	if currency == s.BaseCurrency {
+		return ExchangeRate{Currency: currency, Date: date, Rate: 1}, true, nil
+	}
+	err = db.QueryRowContext(ctx, `
+		SELECT currency, rate_date::text, rate, source, updated_at
+		FROM exchange_rate
+		WHERE currency = $1 AND rate_date <= $2
+		ORDER BY rate_date DESC
+		LIMIT 1
+	`, currency, date).Scan(&rate.Currency, &rate.Date, &rate.Rate, &rate.Source, &rate.UpdatedAt)
+	if err == sql.ErrNoRows {
+		return rate, false, nil
+	} else if err != nil {
+		return rate, false, err
+	}
+	return rate, true, nil
+}
+
+// currencyOrBase defaults an empty currency to the base currency.
+func (s *Server) currencyOrBase(code string) string {
+	if code == "" {
+		return s.BaseCurrency
+	}
+	return code
+}
+
+// checkCurrency adds a field error when code is set but not a known currency.
+func (s *Server) checkCurrency(ctx context.Context, errs FieldErrors, field, code string) error {
+	if code == "" {
+		return nil
+	}
+	return s.checkExists(ctx, errs, field, "unknown currency",
+		"SELECT 1 FROM currency WHERE code = $1", code)
+}
+
+// inBaseCurrency returns a SQL expression converting amount, held in
+// currency, to the base currency with the rate in effect on date. It is NULL
+// when no rate is known for that date.
+func (s *Server) inBaseCurrency(amount, currency, date string) string {
+	return fmt.Sprintf(`(CASE WHEN %[2]s = %[4]s THEN %[1]s ELSE %[1]s * (
+		SELECT xr.rate FROM exchange_rate xr
+		WHERE xr.currency = %[2]s AND xr.rate_date <= %[3]s
+		ORDER BY xr.rate_date DESC
+		LIMIT 1
+	) END)`, amount, currency, date, pq.QuoteLiteral(s.BaseCurrency))
+}
+
+func (s *Server) ListCurrencies(w http.ResponseWriter, r *http.Request) {
+	rows, err := s.DB.QueryContext(r.Context(), "SELECT code, name, minor_units FROM currency ORDER BY code")
+	if err != nil {
+		log.Println("ListCurrencies query error:", err)
+		http.Error(w, "Database query failed", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	currencies := []Currency{}
+	for rows.Next() {
+		var c Currency
+		if err := rows.Scan(&c.Code, &c.Name, &c.MinorUnits); err != nil {
+			log.Println("Row scan error:", err)
+			http.Error(w, "Failed to read currency", http.StatusInternalServerError)
+			return
+		}
+		currencies = append(currencies, c)
+	}
+	if err := rows.Err(); err != nil {
+		log.Println("Row iteration error:", err)
+		http.Error(w, "Error reading results", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(currencies)
+}
+
+func (s *Server) CreateCurrency(w http.ResponseWriter, r *http.Request) {
+	if _, ok := s.requireRole(w, r, Admin); !ok {
+		return
+	}
+
+	var c Currency
+	if err := json.NewDecoder(r.Body).Decode(&c); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+	c.Code = strings.ToUpper(c.Code)
+
+	if !s.validate(w, r, c) {
+		return
+	}
+
+	_, err := s.DB.ExecContext(r.Context(),
+		"INSERT INTO currency (code, name, minor_units) VALUES ($1, $2, $3)", c.Code, c.Name, c.MinorUnits)
+	if err != nil {
+		log.Println("Insert currency error:", err)
+		http.Error(w, "Failed to create currency", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(c)
+}
+
+func (s *Server) ListExchangeRates(w http.ResponseWriter, r *http.Request) {
+	s.listExchangeRates(w, r, r.URL.Query().Get("currency"))
+}
+
+// ExchangeRateHistory lists every rate recorded for one currency, oldest
+// first, with where each came from.
+func (s *Server) ExchangeRateHistory(w http.ResponseWriter, r *http.Request) {
+	s.listExchangeRates(w, r, mux.Vars(r)["currency"])
+}
+
+func (s *Server) listExchangeRates(w http.ResponseWriter, r *http.Request, currency string) {
+	queryParams := r.URL.Query()
+	q := query.From("exchange_rate", "currency, rate_date::text, rate, source, updated_at").
+		WhereIf(currency != "", "currency = ?", strings.ToUpper(currency))
+	if from := queryParams.Get("from"); from != "" {
+		if _, err := time.Parse(time.DateOnly, from); err != nil {
+			http.Error(w, "Invalid from parameter", http.StatusBadRequest)
+			return
+		}
+		q.Where("rate_date >= ?", from)
+	}
+	if to := queryParams.Get("to"); to != "" {
+		if _, err := time.Parse(time.DateOnly, to); err != nil {
+			http.Error(w, "Invalid to parameter", http.StatusBadRequest)
+			return
+		}
+		q.Where("rate_date <= ?", to)
+	}
+	statement, args := q.OrderBy("currency", "rate_date").SQL()
+
+	rows, err := s.DB.QueryContext(r.Context(), statement, args...)
+	if err != nil {
+		log.Println("ListExchangeRates query error:", err)
+		http.Error(w, "Database query failed", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	rates := []ExchangeRate{}
+	for rows.Next() {
+		var rate ExchangeRate
+		if err := rows.Scan(&rate.Currency, &rate.Date, &rate.Rate, &rate.Source, &rate.UpdatedAt); err != nil {
+			log.Println("Row scan error:", err)
+			http.Error(w, "Failed to read exchange rate", http.StatusInternalServerError)
+			return
+		}
+		rates = append(rates, rate)
+	}
+	if err := rows.Err(); err != nil {
+		log.Println("Row iteration error:", err)
+		http.Error(w, "Error reading results", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(rates)
+}
+
+// EffectiveExchangeRate returns the rate conversions on a given day use.
+func (s *Server) EffectiveExchangeRate(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	date := vars["date"]
+	if _, err := time.Parse(time.DateOnly, date); err != nil {
+		http.Error(w, "Invalid date", http.StatusBadRequest)
+		return
+	}
+
+	rate, ok, err := s.effectiveRate(r.Context(), s.DB, strings.ToUpper(vars["currency"]), date)
+	if err != nil {
+		log.Println("Effective exchange rate query error:", err)
+		http.Error(w, "Database query failed", http.StatusInternalServerError)
+		return
+	}
+	if !ok {
+		http.Error(w, "No exchange rate known for that date", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(rate)
+}
+
+// UpsertExchangeRates stores a batch of daily rates, replacing any rate
+// already recorded for the same currency and day. Rates entered here take
+// precedence over synced ones for the same day.
+func (s *Server) UpsertExchangeRates(w http.ResponseWriter, r *http.Request) {
+	if _, ok := s.requireRole(w, r, Admin); !ok {
+		return
+	}
+
+	var rates []ExchangeRate
+	if err := json.NewDecoder(r.Body).Decode(&rates); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+
+	errs := FieldErrors{}
+	for i, rate := range rates {
+		prefix := "[" + strconv.Itoa(i) + "]."
+		rates[i].Currency = strings.ToUpper(rate.Currency)
+		if rates[i].Currency == s.BaseCurrency {
+			errs.add(prefix+"currency", "the base currency always has rate 1")
+		} else if err := s.checkExists(r.Context(), errs, prefix+"currency", "unknown currency",
+			"SELECT 1 FROM currency WHERE code = $1", rates[i].Currency); err != nil {
+			log.Println("Validation query error:", err)
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		if _, err := time.Parse(time.DateOnly, rate.Date); err != nil {
+			errs.add(prefix+"date", "must be a date such as 2025-01-31")
+		}
+		if rate.Rate <= 0 {
+			errs.add(prefix+"rate", "must be greater than 0")
+		}
+	}
+	if len(errs) > 0 {
+		writeValidationErrors(w, errs)
+		return
+	}
+
+	tx, err := s.DB.BeginTx(r.Context(), nil)
+	if err != nil {
+		log.Println("Begin transaction error:", err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	for i, rate := range rates {
+		rates[i].Source = rateSourceManual
+		err := tx.QueryRowContext(r.Context(), `
+			INSERT INTO exchange_rate (currency, rate_date, rate, source)
+			VALUES ($1, $2, $3, $4)
+			ON CONFLICT (currency, rate_date) DO UPDATE
+				SET rate = EXCLUDED.rate, source = EXCLUDED.source, updated_at = NOW()
+			RETURNING updated_at
+		`, rate.Currency, rate.Date, rate.Rate, rateSourceManual).Scan(&rates[i].UpdatedAt)
+		if err != nil {
+			log.Println("Upsert exchange rate error:", err)
+			http.Error(w, "Failed to store exchange rates", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		log.Println("Commit error:", err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(rates)
+}
@@ -0,0 +1,74 @@
+package server
+
+import (
+	"main/query"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// whereCreated adds the creation time filters of a list to q:
+// createdAfter (inclusive) and createdBefore (exclusive) as RFC 3339 times,
+// and year, month and day for a calendar period. Both become ranges on
+// column rather than expressions over it, so an index on it can be used.
+// It writes a 400 and returns false when a parameter is invalid.
+func whereCreated(w http.ResponseWriter, r *http.Request, q *query.Select, column string) bool {
+	params := r.URL.Query()
+	for _, p := range []struct{ name, op string }{{"createdAfter", ">="}, {"createdBefore", "<"}} {
+		value := params.Get(p.name)
+		if value == "" {
+			continue
+		}
+		t, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			http.Error(w, p.name+" must be an RFC 3339 time such as 2025-01-31T00:00:00Z", http.StatusBadRequest)
+			return false
+		}
+		// The columns hold local times without a zone; comparing with a
+		// timestamptz converts them in the session's zone, as NOW() stored them
+		q.Where(column+" "+p.op+" ?::timestamptz", t)
+	}
+
+	year, month, day := params.Get("year"), params.Get("month"), params.Get("day")
+	if year == "" && month == "" && day == "" {
+		return true
+	}
+	if (month != "" && year == "") || (day != "" && month == "") {
+		http.Error(w, "month needs year, and day needs month", http.StatusBadRequest)
+		return false
+	}
+
+	y, err := strconv.Atoi(year)
+	if err != nil || y < 1 || y > 9999 {
+		http.Error(w, "Invalid year parameter", http.StatusBadRequest)
+		return false
+	}
+	start := time.Date(y, time.January, 1, 0, 0, 0, 0, time.UTC)
+	end := start.AddDate(1, 0, 0)
+	if month != "" {
+		m, err := strconv.Atoi(month)
+		if err != nil || m < 1 || m > 12 {
+			http.Error(w, "Invalid month parameter", http.StatusBadRequest)
+			return false
+		}
+		start = time.Date(y, time.Month(m), 1, 0, 0, 0, 0, time.UTC)
+		end = start.AddDate(0, 1, 0)
+	}
+	if day != "" {
+		d, err := strconv.Atoi(day)
+		if err != nil || d < 1 || d > 31 {
+			http.Error(w, "Invalid day parameter", http.StatusBadRequest)
+			return false
+		}
+		start = time.Date(y, start.Month(), d, 0, 0, 0, 0, time.UTC)
+		if start.Day() != d {
+			http.Error(w, "Invalid day parameter", http.StatusBadRequest)
+			return false
+		}
+		end = start.AddDate(0, 0, 1)
+	}
+	// Calendar periods are local dates, like the columns themselves
+	q.Where(column+" >= ?::timestamp AND "+column+" < ?::timestamp",
+		start.Format(time.DateOnly), end.Format(time.DateOnly))
+	return true
+}
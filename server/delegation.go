@@ -0,0 +1,277 @@
+package server
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"log"
+	"net/http"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/lib/pq"
+)
+
+// Delegation lends a Manager's approval rights over their unit to another
+// user from StartsAt until EndsAt, e.g. while the Manager is on holiday.
+// It lapses early when it is revoked or the Manager leaves the unit.
+type Delegation struct {
+	ID         int       `json:"id"`
+	ManagerID  int       `json:"managerID"`
+	DelegateID int       `json:"delegateID"`
+	UnitID     string    `json:"unitID"`
+	StartsAt   time.Time `json:"startsAt"`
+	EndsAt     time.Time `json:"endsAt"`
+	CreatedBy  int       `json:"createdBy"`
+	CreatedAt  time.Time `json:"createdAt"`
+}
+
+func (Delegation) CreateTableIfNotExists(s *Server) {
+	query := `CREATE TABLE IF NOT EXISTS delegation (
+		id SERIAL PRIMARY KEY,
+		manager_id INT NOT NULL,
+		delegate_id INT NOT NULL,
+		unit_id VARCHAR(256) NOT NULL,
+		starts_at TIMESTAMPTZ NOT NULL,
+		ends_at TIMESTAMPTZ NOT NULL,
+		created_by INT NOT NULL,
+		created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+		revoked_at TIMESTAMPTZ
+	);
+	CREATE INDEX IF NOT EXISTS delegation_delegate_idx ON delegation (delegate_id) WHERE revoked_at IS NULL`
+
+	_, err := s.DB.Exec(query)
+
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+type delegationRequest struct {
+	DelegateID int        `json:"delegateID"`
+	StartsAt   *time.Time `json:"startsAt"` // now when left out
+	EndsAt     time.Time  `json:"endsAt"`
+}
+
+const delegationColumns = "d.id, d.manager_id, d.delegate_id, d.unit_id, d.starts_at, d.ends_at, d.created_by, d.created_at"
+
+func scanDelegation(row rowScanner) (Delegation, error) {
+	var d Delegation
+	err := row.Scan(&d.ID, &d.ManagerID, &d.DelegateID, &d.UnitID, &d.StartsAt, &d.EndsAt, &d.CreatedBy, &d.CreatedAt)
+	return d, err
+}
+
+// delegationInForce joins the Manager of delegation d and keeps delegations
+// that have not lapsed, leaving whether they have started to the caller.
+const delegationInForce = `JOIN users m ON m.id = d.manager_id AND m.role_id = 'Manager' AND m.unit_id = d.unit_id
+	WHERE d.revoked_at IS NULL AND d.ends_at > NOW()`
+
+// delegatedUnits returns the units whose approvals userID holds by an
+// active delegation.
+func delegatedUnits(ctx context.Context, db dbtx, userID int) ([]string, error) {
+	var units []string
+	err := db.QueryRowContext(ctx, `
+		SELECT COALESCE(array_agg(DISTINCT d.unit_id), '{}')
+		FROM delegation d `+delegationInForce+` AND d.starts_at <= NOW() AND d.delegate_id = $1
+	`, userID).Scan(pq.Array(&units))
+	return units, err
+}
+
+// approvalState reports whether entering state is a decision that belongs
+// to the Managers of the request's unit, and so can be delegated.
+func approvalState(state ExpenseState) bool {
+	return slices.Contains(expenseStateRoles[state], Manager)
+}
+
+// mayEnter reports whether user may move a request of unit into state.
+// Managers decide on their own unit's requests; delegated lists the units
+// whose decisions user holds by delegation.
+func mayEnter(user User, unit string, state ExpenseState, delegated []string) bool {
+	if roleMayEnter(user.RoleID, state) && (user.RoleID != Manager || user.UnitID == unit) {
+		return true
+	}
+	return approvalState(state) && slices.Contains(delegated, unit)
+}
+
+// CreateDelegation lets a Manager, or an Admin on their behalf, hand their
+// approval rights to another user for a while.
+func (s *Server) CreateDelegation(w http.ResponseWriter, r *http.Request) {
+	caller, managerID, ok := s.selfOrAdmin(w, r)
+	if !ok {
+		return
+	}
+	var req delegationRequest
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&req); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+
+	manager, err := s.Users.Get(r.Context(), managerID)
+	if err != nil {
+		writeStoreError(w, err, "User not found")
+		return
+	}
+	if manager.RoleID != Manager {
+		http.Error(w, "Only Managers can delegate approvals", http.StatusConflict)
+		return
+	}
+
+	d := Delegation{
+		ManagerID:  managerID,
+		DelegateID: req.DelegateID,
+		UnitID:     manager.UnitID,
+		StartsAt:   time.Now(),
+		EndsAt:     req.EndsAt,
+		CreatedBy:  caller.ID,
+	}
+	if req.StartsAt != nil {
+		d.StartsAt = *req.StartsAt
+	}
+
+	errs := FieldErrors{}
+	if d.DelegateID == managerID {
+		errs.add("delegateID", "must be someone else")
+	}
+	if err := s.checkExists(r.Context(), errs, "delegateID", "user does not exist",
+		"SELECT 1 FROM users WHERE id = $1", d.DelegateID); err != nil {
+		log.Println("Validation query error:", err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	switch {
+	case d.EndsAt.IsZero():
+		errs.add("endsAt", "is required")
+	case !d.EndsAt.After(d.StartsAt):
+		errs.add("endsAt", "must be after startsAt")
+	case !d.EndsAt.After(time.Now()):
+		errs.add("endsAt", "must be in the future")
+	}
+	if len(errs) > 0 {
+		writeValidationErrors(w, errs)
+		return
+	}
+
+	tx, err := s.DB.BeginTx(r.Context(), nil)
+	if err != nil {
+		log.Println("Transaction error:", err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	err = tx.QueryRowContext(r.Context(), `
+		INSERT INTO delegation (manager_id, delegate_id, unit_id, starts_at, ends_at, created_by)
+		VALUES ($1, $2, $3, $4, $5, $6)
+		RETURNING id, created_at
+	`, d.ManagerID, d.DelegateID, d.UnitID, d.StartsAt, d.EndsAt, d.CreatedBy).Scan(&d.ID, &d.CreatedAt)
+	if err != nil {
+		log.Println("Delegation insert error:", err)
+		http.Error(w, "Could not create delegation", http.StatusInternalServerError)
+		return
+	}
+	if err := audit(r.Context(), tx, caller.ID, "delegations.create", d); err != nil {
+		log.Println("Audit error:", err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		log.Println("Commit error:", err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(d)
+}
+
+// ListDelegations lists the current and upcoming delegations a user granted
+// or received, soonest first.
+func (s *Server) ListDelegations(w http.ResponseWriter, r *http.Request) {
+	_, userID, ok := s.selfOrAdmin(w, r)
+	if !ok {
+		return
+	}
+
+	rows, err := s.DB.QueryContext(r.Context(), `
+		SELECT `+delegationColumns+`
+		FROM delegation d `+delegationInForce+` AND (d.manager_id = $1 OR d.delegate_id = $1)
+		ORDER BY d.starts_at, d.id
+	`, userID)
+	if err != nil {
+		http.Error(w, "Database query failed", http.StatusInternalServerError)
+		log.Println("Query error:", err)
+		return
+	}
+	defer rows.Close()
+
+	delegations := []Delegation{}
+	for rows.Next() {
+		d, err := scanDelegation(rows)
+		if err != nil {
+			http.Error(w, "Failed to scan delegation", http.StatusInternalServerError)
+			log.Println("Scan error:", err)
+			return
+		}
+		delegations = append(delegations, d)
+	}
+	if err := rows.Err(); err != nil {
+		http.Error(w, "Row iteration error", http.StatusInternalServerError)
+		log.Println("Iteration error:", err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(delegations)
+}
+
+// RevokeDelegation ends one of a Manager's delegations before its time,
+// e.g. when they are back early.
+func (s *Server) RevokeDelegation(w http.ResponseWriter, r *http.Request) {
+	caller, managerID, ok := s.selfOrAdmin(w, r)
+	if !ok {
+		return
+	}
+	delegationID, err := strconv.Atoi(mux.Vars(r)["delegationID"])
+	if err != nil {
+		http.Error(w, "Invalid delegation ID", http.StatusBadRequest)
+		return
+	}
+
+	tx, err := s.DB.BeginTx(r.Context(), nil)
+	if err != nil {
+		log.Println("Transaction error:", err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	d, err := scanDelegation(tx.QueryRowContext(r.Context(), `
+		UPDATE delegation d SET revoked_at = NOW()
+		WHERE d.id = $1 AND d.manager_id = $2 AND d.revoked_at IS NULL AND d.ends_at > NOW()
+		RETURNING `+delegationColumns,
+		delegationID, managerID))
+	if err == sql.ErrNoRows {
+		http.Error(w, "Delegation not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		log.Println("Delegation update error:", err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	if err := audit(r.Context(), tx, caller.ID, "delegations.revoke", d); err != nil {
+		log.Println("Audit error:", err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		log.Println("Commit error:", err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,87 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"log"
+	"main/directory"
+	"main/query"
+)
+
+// errDirectoryUnavailable is returned by checkCredentials when the
+// directory could not be asked and no local account matched instead.
+var errDirectoryUnavailable = errors.New("directory unavailable")
+
+// checkCredentials returns the user a login name and password belong to.
+// With a directory configured it is asked first, and users it knows are
+// provisioned or updated from it. Users who were never provisioned, such
+// as service accounts, log in with their local password.
+func (s *Server) checkCredentials(ctx context.Context, name, password string) (User, error) {
+	var directoryErr error
+	if s.Directory != nil {
+		entry, err := s.Directory.Authenticate(ctx, name, password)
+		switch {
+		case err == nil:
+			return s.provisionDirectoryUser(ctx, name, entry)
+		case !errors.Is(err, directory.ErrInvalidCredentials):
+			log.Println("Directory error:", err)
+			directoryErr = err
+		}
+	}
+
+	// Users of the directory or an identity provider have no local password.
+	// Names need not be unique, so the password decides between users of
+	// the same name.
+	var u User
+	var hash string
+	rows, err := s.DB.QueryContext(ctx,
+		"SELECT "+userColumns+", password FROM users WHERE name = $1 AND password <> '' AND directory_dn = '' AND oidc_subject = '' ORDER BY id",
+		name,
+	)
+	if err != nil {
+		return User{}, err
+	}
+	defer rows.Close()
+
+	found := false
+	for rows.Next() {
+		if err := rows.Scan(append(query.Targets(userFields(&u)), &hash)...); err != nil {
+			return User{}, err
+		}
+		found = true
+		if passwordMatches(hash, password) {
+			return u, nil
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return User{}, err
+	}
+	if !found {
+		// Take as long as a wrong password would
+		passwordMatches("", password)
+	}
+	if directoryErr != nil {
+		return User{}, errDirectoryUnavailable
+	}
+	return User{}, errUnauthorized
+}
+
+// provisionDirectoryUser creates or updates the local user of a directory
+// entry. A local user of the same name that is not linked yet is taken
+// over, so existing users move to the directory at their first login.
+func (s *Server) provisionDirectoryUser(ctx context.Context, name string, entry directory.Entry) (User, error) {
+	rules := s.DirectoryRules
+	role, unit, err := s.roleAndUnit(ctx, rules, "Directory user "+entry.DN, entry.Groups, entry.Attributes[rules.UnitAttribute])
+	if err != nil {
+		return User{}, err
+	}
+	return s.provisionUser(ctx, externalUser{
+		column:     "directory_dn",
+		id:         entry.DN,
+		name:       name,
+		email:      entry.Email,
+		role:       role,
+		unit:       unit,
+		linkByName: true,
+	})
+}
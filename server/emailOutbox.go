@@ -0,0 +1,253 @@
+package server
+
+import (
+	"context"
+	"database/sql"
+	"log"
+	"main/mailer"
+	"strings"
+	"text/template"
+	"time"
+)
+
+const (
+	outboxInterval  = time.Minute
+	outboxBatchSize = 50
+	// outboxMaxAttempts is when a failing email is given up on. Retries back
+	// off exponentially from outboxRetryBase, so the last one is about four
+	// hours after the first.
+	outboxMaxAttempts = 8
+	outboxRetryBase   = 2 * time.Minute
+	outboxSendTimeout = 30 * time.Second
+)
+
+// Email kinds, each with a "<kind>.subject" and "<kind>.body" template.
+const (
+	EmailAnnouncement          = "announcement"
+	EmailMandatoryAnnouncement = "mandatory_announcement"
+	EmailExpenseUpdate         = "expense_update"
+	EmailExpenseRejected       = "expense_rejected"
+	EmailBudgetThreshold       = "budget_threshold"
+	EmailMention               = "mention"
+	EmailDigest                = "digest"
+)
+
+// urgentEmailKinds are sent at once. Other kinds wait for the end of the
+// receiver's quiet hours, or for their next digest if they have one.
+var urgentEmailKinds = map[string]bool{
+	EmailMandatoryAnnouncement: true,
+	EmailExpenseRejected:       true,
+}
+
+var emailTemplates = template.Must(template.New("email").Parse(`
+{{- define "announcement.subject"}}New announcement{{end}}
+{{- define "mandatory_announcement.subject"}}Important announcement{{end}}
+{{- define "expense_update.subject"}}Update on your expense request{{end}}
+{{- define "expense_rejected.subject"}}Your expense request was rejected{{end}}
+{{- define "budget_threshold.subject"}}Budget threshold crossed{{end}}
+{{- define "mention.subject"}}You were mentioned on an expense request{{end}}
+{{- define "digest.subject"}}{{len .Messages}} new notification{{if ne (len .Messages) 1}}s{{end}}{{end}}
+
+{{- define "body"}}Hello {{.Name}},
+
+{{.Message}}
+
+You can read this and earlier messages under your announcements.
+{{end}}
+{{- define "announcement.body"}}{{template "body" .}}{{end}}
+{{- define "mandatory_announcement.body"}}{{template "body" .}}{{end}}
+{{- define "expense_update.body"}}{{template "body" .}}{{end}}
+{{- define "expense_rejected.body"}}{{template "body" .}}{{end}}
+{{- define "budget_threshold.body"}}{{template "body" .}}{{end}}
+{{- define "mention.body"}}{{template "body" .}}{{end}}
+{{- define "digest.body"}}Hello {{.Name}},
+
+Here is what happened since your last update:
+{{range .Messages}}
+- {{.}}
+{{- end}}
+
+You can read these and earlier messages under your announcements.
+{{end}}
+`))
+
+type emailData struct {
+	Name     string
+	Message  string
+	Messages []string // for digests
+}
+
+// OutboxEmail is an email waiting to be, or already, delivered.
+type OutboxEmail struct {
+	ID            int
+	Recipient     string
+	Subject       string
+	Body          string
+	Attempts      int
+	LastError     string
+	NextAttemptAt *time.Time
+	SentAt        *time.Time
+	CreatedAt     time.Time
+}
+
+func (OutboxEmail) CreateTableIfNotExists(s *Server) {
+	query := `CREATE TABLE IF NOT EXISTS email_outbox (
+		id SERIAL PRIMARY KEY,
+		recipient VARCHAR(256) NOT NULL,
+		subject TEXT NOT NULL,
+		body TEXT NOT NULL,
+		attempts INT NOT NULL DEFAULT 0,
+		last_error TEXT NOT NULL DEFAULT '',
+		next_attempt_at TIMESTAMPTZ DEFAULT NOW(),
+		sent_at TIMESTAMPTZ,
+		created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+	);
+	CREATE INDEX IF NOT EXISTS email_outbox_due_idx ON email_outbox (next_attempt_at) WHERE sent_at IS NULL`
+
+	_, err := s.DB.Exec(query)
+
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// queueEmail renders an email of the given kind for a user and stores it in
+// the outbox, in the caller's transaction if db is one. Users without an
+// email address are skipped, as is everything when no mailer is configured.
+// Non-urgent kinds may be held for a digest instead; see holdNotification.
+func (s *Server) queueEmail(ctx context.Context, db dbtx, userID int, kind, message string) error {
+	if s.Settings().Mailer == nil {
+		return nil
+	}
+
+	if !urgentEmailKinds[kind] {
+		held, err := s.holdNotification(ctx, db, userID, kind, message)
+		if err != nil || held {
+			return err
+		}
+	}
+
+	var data emailData
+	var recipient string
+	err := db.QueryRowContext(ctx, "SELECT name, email FROM users WHERE id = $1", userID).Scan(&data.Name, &recipient)
+	if err == sql.ErrNoRows || (err == nil && recipient == "") {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	data.Message = message
+	return insertEmail(ctx, db, recipient, kind, data)
+}
+
+// insertEmail renders an email of the given kind into the outbox.
+func insertEmail(ctx context.Context, db dbtx, recipient, kind string, data emailData) error {
+	var subject, body strings.Builder
+	if err := emailTemplates.ExecuteTemplate(&subject, kind+".subject", data); err != nil {
+		return err
+	}
+	if err := emailTemplates.ExecuteTemplate(&body, kind+".body", data); err != nil {
+		return err
+	}
+
+	_, err := db.ExecContext(ctx,
+		"INSERT INTO email_outbox (recipient, subject, body) VALUES ($1, $2, $3)",
+		recipient, subject.String(), body.String())
+	return err
+}
+
+// DeliverOutbox sends the emails that are due. Rows are locked while they are
+// sent so several instances can share an outbox without sending twice.
+func (s *Server) DeliverOutbox(ctx context.Context) error {
+	mail := s.Settings().Mailer
+	if mail == nil {
+		return nil
+	}
+
+	for {
+		n, err := s.deliverOutboxBatch(ctx, mail)
+		if err != nil || n < outboxBatchSize {
+			return err
+		}
+	}
+}
+
+func (s *Server) deliverOutboxBatch(ctx context.Context, mail mailer.Sender) (int, error) {
+	tx, err := s.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.QueryContext(ctx, `
+		SELECT id, recipient, subject, body, attempts
+		FROM email_outbox
+		WHERE sent_at IS NULL AND next_attempt_at <= NOW()
+		ORDER BY next_attempt_at, id
+		LIMIT $1
+		FOR UPDATE SKIP LOCKED
+	`, outboxBatchSize)
+	if err != nil {
+		return 0, err
+	}
+	var due []OutboxEmail
+	for rows.Next() {
+		var e OutboxEmail
+		if err := rows.Scan(&e.ID, &e.Recipient, &e.Subject, &e.Body, &e.Attempts); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		due = append(due, e)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	for _, e := range due {
+		sendCtx, cancel := context.WithTimeout(ctx, outboxSendTimeout)
+		sendErr := mail.Send(sendCtx, mailer.Message{To: e.Recipient, Subject: e.Subject, Body: e.Body})
+		cancel()
+
+		if sendErr == nil {
+			_, err = tx.ExecContext(ctx, "UPDATE email_outbox SET sent_at = NOW(), attempts = attempts + 1, last_error = '' WHERE id = $1", e.ID)
+		} else {
+			log.Printf("Email %d to %s failed: %v", e.ID, e.Recipient, sendErr)
+			// A NULL next attempt takes the email out of the queue for good
+			var next *time.Time
+			if e.Attempts+1 < outboxMaxAttempts {
+				t := time.Now().Add(outboxRetryBase << e.Attempts)
+				next = &t
+			}
+			_, err = tx.ExecContext(ctx,
+				"UPDATE email_outbox SET attempts = attempts + 1, last_error = $2, next_attempt_at = $3 WHERE id = $1",
+				e.ID, sendErr.Error(), next)
+		}
+		if err != nil {
+			return 0, err
+		}
+	}
+	return len(due), tx.Commit()
+}
+
+// RunOutboxDeliverer delivers queued email periodically until ctx is
+// cancelled. It keeps running without a mailer, since a reload may add one.
+func (s *Server) RunOutboxDeliverer(ctx context.Context) {
+	ticker := time.NewTicker(outboxInterval)
+	defer ticker.Stop()
+
+	for {
+		// Digests go through the outbox, so they are bundled first
+		if err := s.DeliverDigests(ctx); err != nil && ctx.Err() == nil {
+			log.Println("Email digest error:", err)
+		}
+		if err := s.DeliverOutbox(ctx); err != nil && ctx.Err() == nil {
+			log.Println("Email outbox error:", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
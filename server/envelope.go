@@ -0,0 +1,176 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// envelopeFeature wraps every API response in an Envelope unless the
+// request asks otherwise with envelope=false.
+const envelopeFeature = "response_envelope"
+
+// Envelope is a JSON response with its paging metadata and links to the
+// resource itself and the resources related to it, so clients can page
+// and navigate without building URLs.
+type Envelope struct {
+	Data  json.RawMessage   `json:"data"`
+	Meta  *PageMeta         `json:"meta,omitempty"`
+	Links map[string]string `json:"links"`
+}
+
+// PageMeta describes the page of a paged list. Page is 1 and Limit 0 when
+// the whole list was returned.
+type PageMeta struct {
+	Page  int `json:"page"`
+	Limit int `json:"limit"`
+	Total int `json:"total"`
+}
+
+type envelopeKey struct{}
+
+// envelope collects what a handler adds to the Envelope of its response.
+type envelope struct {
+	r     *http.Request
+	meta  *PageMeta
+	links map[string]string
+}
+
+// envelopeOf is the envelope r's response goes out in, or nil when it is
+// sent bare. Its methods do nothing on nil, and handlers check for nil
+// only to skip work the envelope alone needs, such as counting rows.
+func envelopeOf(r *http.Request) *envelope {
+	env, _ := r.Context().Value(envelopeKey{}).(*envelope)
+	return env
+}
+
+// link adds a link to a related resource under APIPrefix.
+func (e *envelope) link(rel, path string) {
+	if e != nil {
+		e.links[rel] = APIPrefix + path
+	}
+}
+
+// page records the page opts selected out of total rows, with next and
+// prev links to the neighbouring pages.
+func (e *envelope) page(opts ListOptions, total int) {
+	if e == nil {
+		return
+	}
+	e.meta = &PageMeta{Page: 1, Limit: opts.Limit, Total: total}
+	if opts.Limit == 0 {
+		return
+	}
+	e.meta.Page = opts.Offset/opts.Limit + 1
+	if next := opts.Offset + opts.Limit; next < total {
+		e.links["next"] = e.withOffset(next)
+	}
+	if opts.Offset > 0 {
+		e.links["prev"] = e.withOffset(max(opts.Offset-opts.Limit, 0))
+	}
+}
+
+// expenseRequest links the expense request id to its activities,
+// payments, approvals, attachments and comments.
+func (e *envelope) expenseRequest(id int) {
+	self := "/expense_requests/" + strconv.Itoa(id)
+	e.link("self", self)
+	e.link("activities", "/expense_activities?expenseID="+strconv.Itoa(id))
+	e.link("payments", "/paid_expenses?expenseID="+strconv.Itoa(id))
+	e.link("approvals", self+"/approvals")
+	e.link("attachments", self+"/attachments")
+	e.link("comments", self+"/comments")
+}
+
+func (e *envelope) withOffset(offset int) string {
+	params := e.r.URL.Query()
+	params.Set("offset", strconv.Itoa(offset))
+	return e.r.URL.EscapedPath() + "?" + params.Encode()
+}
+
+// envelopeRecorder holds back a JSON response until it is complete, so it
+// can be enveloped. Other responses, such as exports streamed as CSV or
+// NDJSON, go straight through.
+type envelopeRecorder struct {
+	http.ResponseWriter
+	status      int
+	body        bytes.Buffer
+	passThrough bool
+}
+
+func (rec *envelopeRecorder) WriteHeader(status int) {
+	if rec.status != 0 {
+		return
+	}
+	rec.status = status
+	if !strings.HasPrefix(rec.Header().Get("Content-Type"), "application/json") {
+		rec.passThrough = true
+		rec.ResponseWriter.WriteHeader(status)
+	}
+}
+
+func (rec *envelopeRecorder) Write(b []byte) (int, error) {
+	rec.WriteHeader(http.StatusOK)
+	if rec.passThrough {
+		return rec.ResponseWriter.Write(b)
+	}
+	return rec.body.Write(b)
+}
+
+// Flush lets a streamed response out; a held back one waits for the end.
+func (rec *envelopeRecorder) Flush() {
+	if rec.passThrough {
+		http.NewResponseController(rec.ResponseWriter).Flush()
+	}
+}
+
+// EnvelopeMiddleware wraps successful JSON responses in an Envelope when
+// the request sends envelope=true, or when the response_envelope feature
+// is on and it does not send envelope=false. Errors and other content
+// types, such as CSV exports, are sent as they are.
+func (s *Server) EnvelopeMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		wanted := s.Settings().Features[envelopeFeature]
+		if param := r.URL.Query().Get("envelope"); param != "" {
+			b, err := strconv.ParseBool(param)
+			if err != nil {
+				http.Error(w, "envelope must be true or false", http.StatusBadRequest)
+				return
+			}
+			wanted = b
+		}
+		if !wanted {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		env := &envelope{r: r, links: map[string]string{"self": r.URL.RequestURI()}}
+		rec := &envelopeRecorder{ResponseWriter: w}
+		next.ServeHTTP(rec, r.WithContext(context.WithValue(r.Context(), envelopeKey{}, env)))
+		if rec.passThrough {
+			return
+		}
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+
+		body := rec.body.Bytes()
+		if rec.status < 200 || rec.status >= 300 || len(body) == 0 || !json.Valid(body) {
+			w.WriteHeader(rec.status)
+			w.Write(body)
+			return
+		}
+
+		w.Header().Del("Content-Length")
+		w.WriteHeader(rec.status)
+		enc := json.NewEncoder(w)
+		enc.SetEscapeHTML(false) // keeps the & in links readable
+		if err := enc.Encode(Envelope{Data: bytes.TrimSpace(body), Meta: env.meta, Links: env.links}); err != nil {
+			log.Println("JSON encoding error:", err)
+		}
+	})
+}
@@ -0,0 +1,98 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+)
+
+// eventVisibleTo reports whether a caller's /events stream carries e.
+// Announcements go to their receivers.
+// Expense state changes go to the requester, the requester's unit, and the
+// roles that act on requests across units.
+func eventVisibleTo(e Event, caller User) bool {
+	switch e.Type {
+	case EventAnnouncement:
+		if a, ok := e.Data.(Announcement); ok {
+			return a.visibleTo(caller)
+		}
+		return e.UserID == caller.ID
+	case EventExpenseStateChanged:
+		return e.UserID == caller.ID || e.UnitID == caller.UnitID ||
+			caller.RoleID == Admin || caller.RoleID == Accounter
+	default:
+		return false
+	}
+}
+
+// publishStateChange tells live streams that an activity moved a request
+// into a new state.
+func (s *Server) publishStateChange(ctx context.Context, activity ExpenseActivity) {
+	if s.Events == nil {
+		return
+	}
+	e := Event{Type: EventExpenseStateChanged, Data: activity}
+	err := s.DB.QueryRowContext(ctx, "SELECT user_id, unit_id FROM expense_request WHERE id = $1", activity.ExpenseID).
+		Scan(&e.UserID, &e.UnitID)
+	if err != nil {
+		log.Println("State change lookup error:", err)
+		return
+	}
+	s.publish(e)
+}
+
+// EventStream pushes new announcements and expense state changes relevant
+// to the caller as server-sent events. The bearer token is required like on
+// any other endpoint, so browsers need a fetch-based client rather than
+// EventSource.
+func (s *Server) EventStream(w http.ResponseWriter, r *http.Request) {
+	caller, ok := s.requireCaller(w, r)
+	if !ok {
+		return
+	}
+
+	if s.Events == nil {
+		http.Error(w, "Live updates are not enabled", http.StatusServiceUnavailable)
+		return
+	}
+
+	events, unsubscribe := s.Events.Subscribe()
+	defer unsubscribe()
+
+	rc := beginEventStream(w)
+	if err := sendKeepAlive(w, rc); err != nil {
+		return
+	}
+
+	keepAlive := time.NewTicker(tickerKeepAlive)
+	defer keepAlive.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case e := <-events:
+			if !eventVisibleTo(e, caller) {
+				continue
+			}
+			data, err := json.Marshal(e.Data)
+			if err != nil {
+				log.Println("Event stream encode error:", err)
+				continue
+			}
+			if _, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", e.Type, data); err != nil {
+				return
+			}
+			if err := rc.Flush(); err != nil {
+				return
+			}
+		case <-keepAlive.C:
+			if err := sendKeepAlive(w, rc); err != nil {
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,66 @@
+package server
+
+import (
+	"sync"
+)
+
+// Event is a change notification published after a write commits. UnitID is
+// empty when the affected unit is not known to the publisher. UserID is the
+// user the event is about or addressed to, zero for none in particular.
+type Event struct {
+	Type   string `json:"type"`
+	UnitID string `json:"unitID,omitempty"`
+	UserID int    `json:"userID,omitempty"`
+	Data   any    `json:"data,omitempty"`
+}
+
+const (
+	EventPaymentChanged      = "payment.changed"
+	EventBudgetChanged       = "budget.changed"
+	EventAnnouncement        = "announcement.created"
+	EventExpenseStateChanged = "expense_request.state_changed"
+)
+
+// EventBroker fans events out to in-process subscribers such as SSE streams.
+// Publishing never blocks: a subscriber that falls behind misses events.
+type EventBroker struct {
+	mu          sync.Mutex
+	subscribers map[chan Event]struct{}
+}
+
+func NewEventBroker() *EventBroker {
+	return &EventBroker{subscribers: map[chan Event]struct{}{}}
+}
+
+// Subscribe returns a channel of future events and a function that must be
+// called to release it.
+func (b *EventBroker) Subscribe() (<-chan Event, func()) {
+	ch := make(chan Event, 16)
+	b.mu.Lock()
+	b.subscribers[ch] = struct{}{}
+	b.mu.Unlock()
+
+	return ch, func() {
+		b.mu.Lock()
+		delete(b.subscribers, ch)
+		b.mu.Unlock()
+	}
+}
+
+func (b *EventBroker) Publish(e Event) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for ch := range b.subscribers {
+		select {
+		case ch <- e:
+		default:
+		}
+	}
+}
+
+// publish is a no-op when the server runs without a broker.
+func (s *Server) publish(e Event) {
+	if s.Events != nil {
+		s.Events.Publish(e)
+	}
+}
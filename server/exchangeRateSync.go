@@ -0,0 +1,142 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"time"
+)
+
+// exchangeRateRetry is how soon a failed sync is tried again, when that is
+// sooner than the regular interval.
+const exchangeRateRetry = time.Hour
+
+// ExchangeRateSync reports one fetch from the rate provider.
+type ExchangeRateSync struct {
+	Provider string   `json:"provider"`
+	Date     string   `json:"date"`
+	Updated  []string `json:"updated"`
+	Manual   []string `json:"manual"`  // kept because a rate was entered by hand
+	Missing  []string `json:"missing"` // not published by the provider
+}
+
+// SyncExchangeRates fetches the provider's latest rates and stores them for
+// every known currency. Rates entered by hand for the same day are kept.
+func (s *Server) SyncExchangeRates(ctx context.Context) (ExchangeRateSync, error) {
+	sync := ExchangeRateSync{Provider: s.RateProvider.Name(), Updated: []string{}, Manual: []string{}, Missing: []string{}}
+	quote, err := s.RateProvider.Latest(ctx, s.BaseCurrency)
+	if err != nil {
+		return sync, err
+	}
+	sync.Date = quote.Date.Format(time.DateOnly)
+
+	rows, err := s.DB.QueryContext(ctx, "SELECT code FROM currency WHERE code <> $1 ORDER BY code", s.BaseCurrency)
+	if err != nil {
+		return sync, err
+	}
+	var codes []string
+	for rows.Next() {
+		var code string
+		if err := rows.Scan(&code); err != nil {
+			rows.Close()
+			return sync, err
+		}
+		codes = append(codes, code)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return sync, err
+	}
+
+	tx, err := s.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return sync, err
+	}
+	defer tx.Rollback()
+
+	for _, code := range codes {
+		rate, ok := quote.Rates[code]
+		if !ok {
+			sync.Missing = append(sync.Missing, code)
+			continue
+		}
+		result, err := tx.ExecContext(ctx, `
+			INSERT INTO exchange_rate (currency, rate_date, rate, source)
+			VALUES ($1, $2, $3, $4)
+			ON CONFLICT (currency, rate_date) DO UPDATE
+				SET rate = EXCLUDED.rate, source = EXCLUDED.source, updated_at = NOW()
+				WHERE exchange_rate.source <> $5
+		`, code, sync.Date, rate, sync.Provider, rateSourceManual)
+		if err != nil {
+			return sync, err
+		}
+		n, err := result.RowsAffected()
+		if err != nil {
+			return sync, err
+		}
+		if n == 0 {
+			sync.Manual = append(sync.Manual, code)
+		} else {
+			sync.Updated = append(sync.Updated, code)
+		}
+	}
+	return sync, tx.Commit()
+}
+
+// RunExchangeRateSync fetches rates every interval until ctx is cancelled.
+// It does nothing when no provider is configured and rates are kept by hand.
+func (s *Server) RunExchangeRateSync(ctx context.Context, interval time.Duration) {
+	if s.RateProvider == nil {
+		return
+	}
+
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-timer.C:
+		}
+
+		next := interval
+		sync, err := s.SyncExchangeRates(ctx)
+		if err != nil {
+			if ctx.Err() == nil {
+				log.Println("Exchange rate sync error:", err)
+			}
+			next = min(exchangeRateRetry, interval)
+		} else if len(sync.Missing) > 0 {
+			log.Printf("Exchange rate sync: %s publishes no rate for %v", sync.Provider, sync.Missing)
+		}
+		timer.Reset(next)
+	}
+}
+
+// SyncExchangeRatesNow runs a sync without waiting for the daily job.
+func (s *Server) SyncExchangeRatesNow(w http.ResponseWriter, r *http.Request) {
+	caller, ok := s.requireRole(w, r, Admin)
+	if !ok {
+		return
+	}
+
+	if s.RateProvider == nil {
+		http.Error(w, "No exchange rate provider is configured", http.StatusServiceUnavailable)
+		return
+	}
+
+	sync, err := s.SyncExchangeRates(r.Context())
+	if err != nil {
+		log.Println("Exchange rate sync error:", err)
+		http.Error(w, "Failed to fetch exchange rates", http.StatusBadGateway)
+		return
+	}
+	if err := audit(r.Context(), s.DB, caller.ID, "exchange_rates.sync", sync); err != nil {
+		log.Println("Audit log error:", err)
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(sync)
+}
@@ -1,27 +1,121 @@
 package server
 
 import (
+	"context"
+	"database/sql"
 	"encoding/json"
+	"fmt"
 	"log"
+	"main/query"
 	"net/http"
 	"strconv"
-	"strings"
 	"time"
 
 	"github.com/gorilla/mux"
+	"github.com/lib/pq"
 )
 
 type ExpenseState string
 
 const (
+	Draft           ExpenseState = "Draft"
 	Pending         ExpenseState = "Pending"
 	Approved        ExpenseState = "Approved"
 	Rejected        ExpenseState = "Rejected"
 	CategoryChanged ExpenseState = "CategoryChanged"
-	Payed           ExpenseState = "Payed"
-	PartiallyPayed  ExpenseState = "PartiallyPayed"
+	Paid            ExpenseState = "Paid"
+	PartiallyPaid   ExpenseState = "PartiallyPaid"
+	Withdrawn       ExpenseState = "Withdrawn"
 )
 
+// legacyStates maps the misspelled states stored before Payed and
+// PartiallyPayed were renamed to their current spelling. Old rows are
+// translated when they are read, so responses and events only carry the
+// current spelling; the old one is accepted as input until
+// legacyStatesSunset.
+var legacyStates = map[ExpenseState]ExpenseState{
+	"Payed":          Paid,
+	"PartiallyPayed": PartiallyPaid,
+}
+
+var legacyStatesSunset = time.Date(2027, time.April, 1, 0, 0, 0, 0, time.UTC)
+
+// canonical is the current spelling of st.
+func (st ExpenseState) canonical() ExpenseState {
+	if current, ok := legacyStates[st]; ok {
+		return current
+	}
+	return st
+}
+
+func (st *ExpenseState) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+	*st = ExpenseState(s)
+	if time.Now().Before(legacyStatesSunset) {
+		*st = st.canonical()
+	}
+	return nil
+}
+
+// Scan reads a stored state, translating the old spelling of rows the
+// migrate-states command has not rewritten yet.
+func (st *ExpenseState) Scan(src any) error {
+	switch v := src.(type) {
+	case string:
+		*st = ExpenseState(v).canonical()
+	case []byte:
+		*st = ExpenseState(v).canonical()
+	default:
+		return fmt.Errorf("cannot scan %T into an expense state", src)
+	}
+	return nil
+}
+
+// stateSpellings lists every stored spelling of states, for SQL filters
+// that must also match rows not yet migrated.
+func stateSpellings(states ...ExpenseState) []string {
+	var spellings []string
+	for _, st := range states {
+		spellings = append(spellings, string(st))
+		for old, current := range legacyStates {
+			if current == st {
+				spellings = append(spellings, string(old))
+			}
+		}
+	}
+	return spellings
+}
+
+// MigrateLegacyStates rewrites stored activities still carrying the old
+// spelling of a state, batchSize rows per statement so the table is never
+// locked for long. It returns how many rows it rewrote.
+func MigrateLegacyStates(ctx context.Context, db *sql.DB, batchSize int) (int64, error) {
+	var migrated int64
+	for old, current := range legacyStates {
+		for {
+			result, err := db.ExecContext(ctx, `
+				UPDATE expense_activity SET current_state = $1
+				WHERE id IN (SELECT id FROM expense_activity WHERE current_state = $2 LIMIT $3)
+			`, current, old, batchSize)
+			if err != nil {
+				return migrated, err
+			}
+			n, err := result.RowsAffected()
+			if err != nil {
+				return migrated, err
+			}
+			migrated += n
+			if n < int64(batchSize) {
+				break
+			}
+		}
+	}
+	return migrated, nil
+}
+
 type ExpenseActivity struct {
 	ID           int          `json:"id,omitempty"`
 	ExpenseID    int          `json:"expenseID"`
@@ -29,6 +123,9 @@ type ExpenseActivity struct {
 	Feedback     string       `json:"feedback"`
 	CreatedBy    int          `json:"createdBy"`
 	CreatedAt    *time.Time   `json:"createdAt,omitempty"`
+
+	// Hidden lists the fields the caller may not see; see visibility.go
+	Hidden []string `json:"hidden,omitempty"`
 }
 
 func (ExpenseActivity) CreateTableIfNotExists(s *Server) {
@@ -46,6 +143,41 @@ func (ExpenseActivity) CreateTableIfNotExists(s *Server) {
 	if err != nil {
 		log.Fatal(err)
 	}
+
+	// Indexed for /search
+	_, err = s.DB.Exec(`ALTER TABLE expense_activity ADD COLUMN IF NOT EXISTS search_vector tsvector
+		GENERATED ALWAYS AS (to_tsvector('` + searchConfig + `', feedback)) STORED;
+	CREATE INDEX IF NOT EXISTS expense_activity_search_vector_idx ON expense_activity USING GIN (search_vector)`)
+
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// IsValid reports whether the state is one of the defined ExpenseState constants.
+func (st ExpenseState) IsValid() bool {
+	switch st {
+	case Draft, Pending, Approved, Rejected, CategoryChanged, Paid, PartiallyPaid, Withdrawn:
+		return true
+	}
+	return false
+}
+
+func (a ExpenseActivity) Validate(ctx context.Context, s *Server) (FieldErrors, error) {
+	errs := FieldErrors{}
+	if !a.CurrentState.IsValid() {
+		errs.add("currentState", "is not a known expense state")
+	}
+
+	if err := s.checkExists(ctx, errs, "expenseID", "expense request does not exist",
+		"SELECT 1 FROM expense_request WHERE id = $1", a.ExpenseID); err != nil {
+		return nil, err
+	}
+	if err := s.checkExists(ctx, errs, "createdBy", "user does not exist",
+		"SELECT 1 FROM users WHERE id = $1", a.CreatedBy); err != nil {
+		return nil, err
+	}
+	return errs, nil
 }
 
 func (s *Server) CreateExpenseActivity(w http.ResponseWriter, r *http.Request) {
@@ -58,6 +190,99 @@ func (s *Server) CreateExpenseActivity(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if !s.validate(w, r, expenseActivity) {
+		return
+	}
+
+	// The new state must follow from the request's latest one
+	statuses, err := s.expenseStatuses(r.Context(), []int{expenseActivity.ExpenseID})
+	if err != nil {
+		log.Println("Expense status query error:", err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	from := statuses[expenseActivity.ExpenseID].state
+	if isDraft(from) {
+		http.Error(w, "The expense request is a draft; submit it first", http.StatusConflict)
+		return
+	}
+	if !canTransition(from, expenseActivity.CurrentState) {
+		current := "no activity"
+		if from != nil {
+			current = string(*from)
+		}
+		http.Error(w, "Cannot move an expense request from "+current+" to "+string(expenseActivity.CurrentState), http.StatusConflict)
+		return
+	}
+
+	var unitID, category string
+	err = s.DB.QueryRowContext(r.Context(),
+		"SELECT unit_id, category FROM expense_request WHERE id = $1", expenseActivity.ExpenseID,
+	).Scan(&unitID, &category)
+	if err != nil {
+		log.Println("Expense request lookup error:", err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	// The author must hold the right to the decision, by role or by a
+	// Manager's delegation
+	author, err := s.Users.Get(r.Context(), expenseActivity.CreatedBy)
+	if err != nil {
+		log.Println("Author lookup error:", err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	delegated, err := delegatedUnits(r.Context(), s.DB, author.ID)
+	if err != nil {
+		log.Println("Delegation lookup error:", err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	// Approving takes a step of the request's approval chain, and pending
+	// approvers may reject it too
+	chains, err := s.approvalChains(r.Context(), s.DB, []int{expenseActivity.ExpenseID})
+	if err != nil {
+		log.Println("Approval chain query error:", err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	chain := chains[expenseActivity.ExpenseID]
+	step := chain.nextStep(&author, delegated)
+	allowed := mayEnter(author, unitID, expenseActivity.CurrentState, delegated)
+	switch expenseActivity.CurrentState {
+	case Approved:
+		allowed = step >= 0
+	case Rejected:
+		allowed = allowed || step >= 0
+	}
+	if !allowed {
+		http.Error(w, "createdBy may not move this expense request to "+string(expenseActivity.CurrentState), http.StatusForbidden)
+		return
+	}
+
+	// Approvals are blocked while the request's budget is frozen
+	if expenseActivity.CurrentState == Approved && !s.checkNotFrozen(w, r, s.DB, unitID, category) {
+		return
+	}
+
+	// The request only becomes Approved with the last approval it needs;
+	// until then the chain is the answer
+	if expenseActivity.CurrentState == Approved {
+		complete, err := recordApproval(r.Context(), s.DB, chain, step, author)
+		if err != nil {
+			log.Println("Approval insert error:", err)
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		if !complete {
+			w.Header().Set("Content-Type", "application/json; charset=utf-8")
+			w.WriteHeader(http.StatusAccepted)
+			json.NewEncoder(w).Encode(chain)
+			return
+		}
+	}
+
 	// Prepare SQL query
 	query := `
 		INSERT INTO expense_activity (expense_id, current_state, feedback, created_by)
@@ -66,7 +291,7 @@ func (s *Server) CreateExpenseActivity(w http.ResponseWriter, r *http.Request) {
 	`
 
 	// Execute query and scan the result
-	err := s.DB.QueryRow(query,
+	err = s.DB.QueryRowContext(r.Context(), query,
 		expenseActivity.ExpenseID,
 		expenseActivity.CurrentState,
 		expenseActivity.Feedback,
@@ -78,6 +303,20 @@ func (s *Server) CreateExpenseActivity(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Could not create expense activity", http.StatusInternalServerError)
 		return
 	}
+	// A rejected request that is submitted again starts a fresh chain
+	if expenseActivity.CurrentState == Rejected {
+		if _, err := s.DB.ExecContext(r.Context(),
+			"DELETE FROM expense_approval WHERE expense_id = $1", expenseActivity.ExpenseID); err != nil {
+			log.Println("Approval reset error:", err)
+		}
+	}
+	s.publishStateChange(r.Context(), expenseActivity)
+	if expenseActivity.CurrentState == Approved {
+		s.emitWebhook(r.Context(), WebhookExpenseApproved, expenseActivity)
+	}
+	if event, kind, ok := activityNotice(expenseActivity); ok {
+		s.notifyRequester(r.Context(), expenseActivity.ExpenseID, expenseActivity.CreatedBy, kind, event)
+	}
 
 	// Set response fields
 	w.Header().Set("Content-Type", "application/json; charset=utf-8")
@@ -96,9 +335,15 @@ func (s *Server) GetExpenseActivity(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Invalid ID", http.StatusBadRequest)
 		return
 	}
+	v, ok := s.viewerOf(w, r)
+	if !ok {
+		return
+	}
 	var expenseActivity ExpenseActivity
-	err = s.DB.QueryRow(`
-		SELECT id, expense_id, current_state, feedback, created_by, created_at
+	var owner int
+	var unit string
+	err = s.DB.QueryRowContext(r.Context(), `
+		SELECT id, expense_id, current_state, feedback, created_by, created_at, `+expenseOwnerColumns("expense_id")+`
 		FROM expense_activity
 		WHERE id = $1
 	`, id).Scan(
@@ -108,6 +353,8 @@ func (s *Server) GetExpenseActivity(w http.ResponseWriter, r *http.Request) {
 		&expenseActivity.Feedback,
 		&expenseActivity.CreatedBy,
 		&expenseActivity.CreatedAt,
+		&owner,
+		&unit,
 	)
 
 	if err != nil {
@@ -119,6 +366,21 @@ func (s *Server) GetExpenseActivity(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Failed to retrieve expense activity", http.StatusInternalServerError)
 		return
 	}
+	readable, err := s.mayReadExpense(r.Context(), v, expenseActivity.ExpenseID)
+	if err != nil {
+		log.Println("Expense request query error:", err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	if !readable {
+		http.Error(w, "Expense activity not found", http.StatusNotFound)
+		return
+	}
+	redactActivity(&expenseActivity, v.hidesAmountOf(owner, unit))
+
+	env := envelopeOf(r)
+	env.link("expenseRequest", "/expense_requests/"+strconv.Itoa(expenseActivity.ExpenseID))
+	env.link("payments", "/paid_expenses?expenseID="+strconv.Itoa(expenseActivity.ExpenseID))
 
 	w.Header().Set("Content-Type", "application/json; charset=utf-8")
 	if err := json.NewEncoder(w).Encode(expenseActivity); err != nil {
@@ -142,13 +404,17 @@ func (s *Server) UpdateExpenseActivity(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if !s.validate(w, r, expenseActivity) {
+		return
+	}
+
 	// Prepare the SQL UPDATE statement
 	query := `
 		UPDATE expense_activity 
 		SET expense_id = $1, current_state = $2, feedback = $3, created_by = $4
 		WHERE id = $5
 	`
-	_, err = s.DB.Exec(
+	_, err = s.DB.ExecContext(r.Context(),
 		query,
 		expenseActivity.ExpenseID,
 		expenseActivity.CurrentState,
@@ -170,6 +436,66 @@ func (s *Server) UpdateExpenseActivity(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+var expenseActivityPatchFields = map[string]patchField{
+	"expenseID":    patchAs[int]("expense_id"),
+	"currentState": patchAs[ExpenseState]("current_state"),
+	"feedback":     patchAs[string]("feedback"),
+	"createdBy":    patchAs[int]("created_by"),
+}
+
+func (s *Server) PatchExpenseActivity(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	idStr := vars["id"]
+	id, err := strconv.Atoi(idStr)
+	if err != nil {
+		http.Error(w, "Invalid ID", http.StatusBadRequest)
+		return
+	}
+
+	// Decode only the fields the client sent
+	var fields map[string]json.RawMessage
+	if err := json.NewDecoder(r.Body).Decode(&fields); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+
+	set, args, err := buildPatch(fields, expenseActivityPatchFields)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if !s.validatePatch(w, r, fields, &ExpenseActivity{}) {
+		return
+	}
+
+	query := "UPDATE expense_activity SET " + set + " WHERE id = " + args.Add(id) + `
+		RETURNING id, expense_id, current_state, feedback, created_by, created_at`
+
+	var expenseActivity ExpenseActivity
+	err = s.DB.QueryRowContext(r.Context(), query, args...).Scan(
+		&expenseActivity.ID,
+		&expenseActivity.ExpenseID,
+		&expenseActivity.CurrentState,
+		&expenseActivity.Feedback,
+		&expenseActivity.CreatedBy,
+		&expenseActivity.CreatedAt,
+	)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Expense activity not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		log.Println("patchExpenseActivity update error:", err)
+		http.Error(w, "Failed to update expense activity", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	if err := json.NewEncoder(w).Encode(expenseActivity); err != nil {
+		log.Println("patchExpenseActivity response encoding error:", err)
+	}
+}
+
 func (s *Server) DeleteExpenseActivity(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodDelete {
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
@@ -184,7 +510,7 @@ func (s *Server) DeleteExpenseActivity(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	result, err := s.DB.Exec("DELETE FROM expense_activity WHERE id = $1", id)
+	result, err := s.DB.ExecContext(r.Context(), "DELETE FROM expense_activity WHERE id = $1", id)
 	if err != nil {
 		log.Println("deleteExpenseActivity query error:", err)
 		http.Error(w, "Failed to delete expense activity", http.StatusInternalServerError)
@@ -211,54 +537,27 @@ func (s *Server) ListExpenseActivities(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	filters := []string{}
-	args := []interface{}{}
-	idx := 1
+	v, ok := s.viewerOf(w, r)
+	if !ok {
+		return
+	}
 
 	// Query param filters
-	if expenseID := r.URL.Query().Get("expense_id"); expenseID != "" {
-		filters = append(filters, "expense_id = $"+strconv.Itoa(idx))
-		args = append(args, expenseID)
-		idx++
-	}
-	if createdBy := r.URL.Query().Get("created_by"); createdBy != "" {
-		filters = append(filters, "created_by = $"+strconv.Itoa(idx))
-		args = append(args, createdBy)
-		idx++
-	}
-	if state := r.URL.Query().Get("current_state"); state != "" {
-		filters = append(filters, "current_state = $"+strconv.Itoa(idx))
-		args = append(args, state)
-		idx++
-	}
-	if year := r.URL.Query().Get("year"); year != "" {
-		filters = append(filters, "EXTRACT(YEAR FROM created_at) = $"+strconv.Itoa(idx))
-		args = append(args, year)
-		idx++
-	}
-	if month := r.URL.Query().Get("month"); month != "" {
-		filters = append(filters, "EXTRACT(MONTH FROM created_at) = $"+strconv.Itoa(idx))
-		args = append(args, month)
-		idx++
-	}
-	if day := r.URL.Query().Get("day"); day != "" {
-		filters = append(filters, "EXTRACT(DAY FROM created_at) = $"+strconv.Itoa(idx))
-		args = append(args, day)
-		idx++
-	}
-
-	// Build SQL query
-	query := `
-		SELECT id, expense_id, current_state, feedback, created_by, created_at
-		FROM expense_activity
-	`
-	if len(filters) > 0 {
-		query += " WHERE " + strings.Join(filters, " AND ")
+	params := r.URL.Query()
+	q := query.From("expense_activity", "id, expense_id, current_state, feedback, created_by, created_at, "+expenseOwnerColumns("expense_id")).
+		WhereIf(params.Get("expenseID") != "", "expense_id = ?", params.Get("expenseID")).
+		WhereIf(params.Get("createdBy") != "", "created_by = ?", params.Get("createdBy"))
+	v.scopeByExpense(q, "expense_id")
+	if state := params.Get("currentState"); state != "" {
+		q.Where("current_state = ANY(?)", pq.Array(stateSpellings(ExpenseState(state).canonical())))
+	}
+	if !whereCreated(w, r, q, "created_at") {
+		return
 	}
-	query += " ORDER BY created_at DESC"
+	statement, args := q.OrderBy("created_at DESC").SQL()
 
 	// Execute query
-	rows, err := s.DB.Query(query, args...)
+	rows, err := s.DB.QueryContext(r.Context(), statement, args...)
 	if err != nil {
 		http.Error(w, "Database query failed", http.StatusInternalServerError)
 		log.Println("ListExpenseActivities query error:", err)
@@ -270,12 +569,15 @@ func (s *Server) ListExpenseActivities(w http.ResponseWriter, r *http.Request) {
 	var allActivities []ExpenseActivity
 	for rows.Next() {
 		var ea ExpenseActivity
-		err := rows.Scan(&ea.ID, &ea.ExpenseID, &ea.CurrentState, &ea.Feedback, &ea.CreatedBy, &ea.CreatedAt)
+		var owner int
+		var unit string
+		err := rows.Scan(&ea.ID, &ea.ExpenseID, &ea.CurrentState, &ea.Feedback, &ea.CreatedBy, &ea.CreatedAt, &owner, &unit)
 		if err != nil {
 			http.Error(w, "Failed to scan expense activity", http.StatusInternalServerError)
 			log.Println("Row scan error:", err)
 			return
 		}
+		redactActivity(&ea, v.hidesAmountOf(owner, unit))
 		allActivities = append(allActivities, ea)
 	}
 	if err := rows.Err(); err != nil {
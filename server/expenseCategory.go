@@ -1,11 +1,14 @@
 package server
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"log"
 	"net/http"
 
 	"github.com/gorilla/mux"
+	"github.com/lib/pq"
 )
 
 type ExpenseCategory struct {
@@ -24,6 +27,14 @@ func (ExpenseCategory) CreateTableIfNotExists(s *Server) {
 	}
 }
 
+func (c ExpenseCategory) Validate(ctx context.Context, s *Server) (FieldErrors, error) {
+	errs := FieldErrors{}
+	if c.Name == "" {
+		errs.add("name", "is required")
+	}
+	return errs, nil
+}
+
 func (s *Server) CreateExpenseCategory(w http.ResponseWriter, r *http.Request) {
 	var expenseCategory ExpenseCategory
 	if err := json.NewDecoder(r.Body).Decode(&expenseCategory); err != nil {
@@ -31,12 +42,16 @@ func (s *Server) CreateExpenseCategory(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if !s.validate(w, r, expenseCategory) {
+		return
+	}
+
 	query := `
 		INSERT INTO expense_category (name)
 		VALUES ($1)
 	`
 
-	_, err := s.DB.Exec(query,
+	_, err := s.DB.ExecContext(r.Context(), query,
 		expenseCategory.Name,
 	)
 	if err != nil {
@@ -44,6 +59,7 @@ func (s *Server) CreateExpenseCategory(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Failed to create expense", http.StatusInternalServerError)
 		return
 	}
+	s.invalidateReference(r.Context(), categoriesCacheKey)
 
 	w.Header().Set("Content-Type", "application/json; charset=utf-8")
 	w.WriteHeader(http.StatusCreated)
@@ -57,7 +73,7 @@ func (s *Server) GetExpenseCategory(w http.ResponseWriter, r *http.Request) {
 	name := vars["name"]
 
 	var category ExpenseCategory
-	err := s.DB.QueryRow("SELECT name FROM expense_category WHERE name = $1", name).Scan(&category.Name)
+	err := s.DB.QueryRowContext(r.Context(), "SELECT name FROM expense_category WHERE name = $1", name).Scan(&category.Name)
 	if err != nil {
 		// if err == sql.ErrNoRows {
 		// 	http.Error(w, "Unit not found", http.StatusNotFound)
@@ -88,38 +104,123 @@ func (s *Server) UpdateExpenseCategory(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Ensure Name is valid
-	if category.Name == "" {
-		http.Error(w, "Missing or invalid Name", http.StatusBadRequest)
+	if !s.validate(w, r, category) {
 		return
 	}
 
-	// Check if unit exists before update
-	var exists bool
-	err := s.DB.QueryRow("SELECT EXISTS(SELECT 1 FROM expense_category WHERE name = $1)", name).Scan(&exists)
-	if err != nil {
-		log.Printf("DB error checking unit existence: %v", err)
-		http.Error(w, "Database error", http.StatusInternalServerError)
+	if !s.renameExpenseCategory(w, r, name, category.Name) {
 		return
 	}
-	if !exists {
-		http.Error(w, "Unit not found", http.StatusNotFound)
-		return
+
+	// Respond with updated unit
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	if err := json.NewEncoder(w).Encode(category); err != nil {
+		log.Printf("JSON encoding error: %v", err)
 	}
+}
 
-	// Prepare the SQL UPDATE statement
-	query := `
-		UPDATE expense_category 
-		SET name = $1 WHERE name = $2
-	`
-	_, err = s.DB.Exec(query, category.Name, name)
+// expenseCategoryReferences are the columns that refer to a category by
+// name.
+var expenseCategoryReferences = []nameReference{
+	{"budget", "expense_category"},
+	{"budget_freeze", "category"},
+	{"expense_request", "category"},
+	{"paid_expense", "category"},
+	{"expense_draft", "category"},
+	{"user_limit", "category"},
+}
+
+// renameExpenseCategory renames a category and everything referring to it
+// in one transaction, so no row is left pointing at the old name.
+func (s *Server) renameExpenseCategory(w http.ResponseWriter, r *http.Request, from, to string) bool {
+	ctx := r.Context()
+	tx, err := s.DB.BeginTx(ctx, nil)
 	if err != nil {
+		log.Printf("Begin transaction error: %v", err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return false
+	}
+	defer tx.Rollback()
+
+	result, err := tx.ExecContext(ctx, "UPDATE expense_category SET name = $1 WHERE name = $2", to, from)
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) && pqErr.Code == "23505" {
+		writeValidationErrors(w, FieldErrors{"name": "is already used by another category; merge the two instead"})
+		return false
+	} else if err != nil {
 		log.Printf("DB update error: %v", err)
 		http.Error(w, "Database error", http.StatusInternalServerError)
+		return false
+	}
+	if n, err := result.RowsAffected(); err != nil || n == 0 {
+		http.Error(w, "Category not found", http.StatusNotFound)
+		return false
+	}
+
+	if from != to {
+		_, err := renameReferences(ctx, tx, expenseCategoryReferences, from, to)
+		if errors.As(err, &pqErr) && pqErr.Code == "23505" {
+			// Rows left behind under the new name by an earlier rename
+			http.Error(w, "Budgets already exist under the category name "+to, http.StatusConflict)
+			return false
+		} else if err != nil {
+			log.Printf("Category rename error: %v", err)
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return false
+		}
+		// Revisions are kept apart from the other references, which a merge
+		// moves wholesale; see MergeExpenseCategory
+		if _, err := tx.ExecContext(ctx, "UPDATE budget_revision SET category = $1 WHERE category = $2", to, from); err != nil {
+			log.Printf("Budget revision rename error: %v", err)
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return false
+		}
+		if err := audit(ctx, tx, s.callerID(r), "expense_category.rename", map[string]string{"from": from, "to": to}); err != nil {
+			log.Printf("Audit log error: %v", err)
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return false
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		log.Printf("Commit error: %v", err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return false
+	}
+	s.invalidateReference(ctx, categoriesCacheKey)
+	return true
+}
+
+var expenseCategoryPatchFields = map[string]patchField{
+	"name": patchAs[string]("name"),
+}
+
+func (s *Server) PatchExpenseCategory(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	name := vars["name"]
+
+	// Decode only the fields the client sent
+	var fields map[string]json.RawMessage
+	if err := json.NewDecoder(r.Body).Decode(&fields); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+
+	if _, _, err := buildPatch(fields, expenseCategoryPatchFields); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var category ExpenseCategory
+	if !s.validatePatch(w, r, fields, &category) {
+		return
+	}
+
+	// The name is the only field, so every patch is a rename
+	if !s.renameExpenseCategory(w, r, name, category.Name) {
 		return
 	}
 
-	// Respond with updated unit
 	w.Header().Set("Content-Type", "application/json; charset=utf-8")
 	if err := json.NewEncoder(w).Encode(category); err != nil {
 		log.Printf("JSON encoding error: %v", err)
@@ -131,7 +232,7 @@ func (s *Server) DeleteExpenseCategory(w http.ResponseWriter, r *http.Request) {
 	name := vars["name"]
 
 	// Perform the DELETE query
-	result, err := s.DB.Exec("DELETE FROM expense_category WHERE name = $1", name)
+	result, err := s.DB.ExecContext(r.Context(), "DELETE FROM expense_category WHERE name = $1", name)
 	if err != nil {
 		http.Error(w, "Failed to delete unit", http.StatusInternalServerError)
 		log.Println("Delete error:", err)
@@ -151,42 +252,39 @@ func (s *Server) DeleteExpenseCategory(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Category not found", http.StatusNotFound)
 		return
 	}
+	s.invalidateReference(r.Context(), categoriesCacheKey)
 
 	// Return a success message (204 No Content is common for successful DELETE)
 	w.WriteHeader(http.StatusNoContent)
 }
 
-func (s *Server) ListExpenseCategories(w http.ResponseWriter, r *http.Request) {
-	// Build the SQL query
-	query := "SELECT name FROM expense_category"
-
-	rows, err := s.DB.Query(query)
+// loadExpenseCategories reads every category, for the cached list
+// ListExpenseCategories serves.
+func (s *Server) loadExpenseCategories(ctx context.Context) ([]ExpenseCategory, error) {
+	rows, err := s.DB.QueryContext(ctx, "SELECT name FROM expense_category")
 	if err != nil {
-		log.Println("Error querying categories:", err)
-		http.Error(w, "Failed to query units from database", http.StatusInternalServerError)
-		return
+		return nil, err
 	}
 	defer rows.Close()
 
-	var allCategories []ExpenseCategory
+	var categories []ExpenseCategory
 	for rows.Next() {
 		var category ExpenseCategory
 		if err := rows.Scan(&category.Name); err != nil {
-			log.Println("Error scanning category row:", err)
-			http.Error(w, "Failed to scan category data", http.StatusInternalServerError)
-			return
+			return nil, err
 		}
-		allCategories = append(allCategories, category)
+		categories = append(categories, category)
 	}
+	return categories, rows.Err()
+}
 
-	if err = rows.Err(); err != nil {
-		log.Println("Row iteration error:", err)
-		http.Error(w, "Error iterating over unit rows", http.StatusInternalServerError)
+func (s *Server) ListExpenseCategories(w http.ResponseWriter, r *http.Request) {
+	categories, err := cachedList(r.Context(), s, categoriesCacheKey, s.loadExpenseCategories)
+	if err != nil {
+		log.Println("Error querying categories:", err)
+		http.Error(w, "Failed to query categories from database", http.StatusInternalServerError)
 		return
 	}
 
-	w.Header().Set("Content-Type", "application/json; charset=utf-8")
-	if err := json.NewEncoder(w).Encode(allCategories); err != nil {
-		log.Println("JSON encoding error:", err)
-	}
+	writeReferenceList(w, r, categories.Items, categories.Modified)
 }
@@ -0,0 +1,246 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/lib/pq"
+)
+
+// maxCommentLength caps comment bodies, in characters.
+const maxCommentLength = 4000
+
+// mentionPattern finds @name and, for names with spaces, @"First Last",
+// but not the domain of an email address.
+var mentionPattern = regexp.MustCompile(`(?:^|[^\pL\pN_.-])@(?:"([^"\n]+)"|([\pL\pN_.-]+))`)
+
+// ExpenseComment is a message in the discussion of an expense request, apart
+// from the feedback its activities carry. Mentions are the users an @name
+// in the body resolved to.
+type ExpenseComment struct {
+	ID            int        `json:"id,omitempty"`
+	ExpenseID     int        `json:"expenseID"`
+	AuthorID      int        `json:"authorID"`
+	Body          string     `json:"body"`
+	AttachmentIDs []int      `json:"attachmentIDs"`
+	Mentions      []int      `json:"mentions"`
+	CreatedAt     *time.Time `json:"createdAt,omitempty"`
+}
+
+func (ExpenseComment) CreateTableIfNotExists(s *Server) {
+	query := `CREATE TABLE IF NOT EXISTS expense_comment (
+		id SERIAL PRIMARY KEY,
+		expense_id INT NOT NULL,
+		author_id INT NOT NULL,
+		body TEXT NOT NULL,
+		attachment_ids INT[] NOT NULL DEFAULT '{}',
+		mentions INT[] NOT NULL DEFAULT '{}',
+		created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+	)`
+
+	_, err := s.DB.Exec(query)
+
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+func (c ExpenseComment) Validate(ctx context.Context, s *Server) (FieldErrors, error) {
+	errs := FieldErrors{}
+	switch length := len([]rune(strings.TrimSpace(c.Body))); {
+	case length == 0:
+		errs.add("body", "is required")
+	case length > maxCommentLength:
+		errs.add("body", fmt.Sprintf("must be at most %d characters", maxCommentLength))
+	}
+	// Comments refer to receipts of their own request only
+	for i, id := range c.AttachmentIDs {
+		if err := s.checkExists(ctx, errs, "attachmentIDs."+strconv.Itoa(i), "is not an attachment of this expense request",
+			"SELECT 1 FROM expense_attachment WHERE id = $1 AND expense_id = $2", id, c.ExpenseID); err != nil {
+			return nil, err
+		}
+	}
+	return errs, nil
+}
+
+// mentionedNames returns the distinct names @mentioned in body.
+func mentionedNames(body string) []string {
+	var names []string
+	for _, match := range mentionPattern.FindAllStringSubmatch(body, -1) {
+		// A sentence may end right after a mention
+		name := match[1]
+		if name == "" {
+			name = strings.TrimRight(match[2], ".")
+		}
+		if name != "" && !slices.Contains(names, name) {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// resolveMentions returns the users named in body who may read expense.
+// Names of other users are left as text, so a mention cannot leak a request
+// to someone outside its scope.
+func (s *Server) resolveMentions(ctx context.Context, body string, expense ExpenseRequest) ([]User, error) {
+	names := mentionedNames(body)
+	if len(names) == 0 {
+		return nil, nil
+	}
+	rows, err := s.DB.QueryContext(ctx, "SELECT "+userColumns+" FROM users WHERE name = ANY($1) ORDER BY id", pq.Array(names))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var users []User
+	for rows.Next() {
+		user, err := scanUser(rows)
+		if err != nil {
+			return nil, err
+		}
+		users = append(users, user)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	var readers []User
+	for _, user := range users {
+		delegated, err := delegatedUnits(ctx, s.DB, user.ID)
+		if err != nil {
+			return nil, err
+		}
+		if (viewer{user: &user, delegated: delegated}).mayRead(expense) {
+			readers = append(readers, user)
+		}
+	}
+	return readers, nil
+}
+
+// CreateExpenseComment adds a comment to an expense request and notifies
+// the users it mentions.
+func (s *Server) CreateExpenseComment(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid ID", http.StatusBadRequest)
+		return
+	}
+	v, expense, ok := s.readExpenseRequestAs(w, r, id)
+	if !ok {
+		return
+	}
+
+	var c ExpenseComment
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&c); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+	c.ExpenseID, c.AuthorID, c.Mentions = id, v.user.ID, []int{}
+	if c.AttachmentIDs == nil {
+		c.AttachmentIDs = []int{}
+	}
+	if !s.validate(w, r, c) {
+		return
+	}
+
+	mentioned, err := s.resolveMentions(r.Context(), c.Body, expense)
+	if err != nil {
+		log.Println("Mention lookup error:", err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	for _, user := range mentioned {
+		c.Mentions = append(c.Mentions, user.ID)
+	}
+
+	err = s.DB.QueryRowContext(r.Context(), `
+		INSERT INTO expense_comment (expense_id, author_id, body, attachment_ids, mentions)
+		VALUES ($1, $2, $3, $4, $5)
+		RETURNING id, created_at
+	`, c.ExpenseID, c.AuthorID, c.Body, pq.Array(c.AttachmentIDs), pq.Array(c.Mentions)).Scan(&c.ID, &c.CreatedAt)
+	if err != nil {
+		log.Println("Insert comment error:", err)
+		http.Error(w, "Failed to create comment", http.StatusInternalServerError)
+		return
+	}
+
+	message := fmt.Sprintf("%s mentioned you on expense request #%d: %s", v.user.Name, id, c.Body)
+	for _, user := range mentioned {
+		if user.ID == c.AuthorID {
+			continue
+		}
+		if err := s.sendAnnouncement(r.Context(), s.DB, c.AuthorID, user.ID, message, EmailMention); err != nil {
+			log.Println("Notification insert error:", err)
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(c)
+}
+
+// ListExpenseComments returns the discussion of an expense request, oldest
+// first.
+func (s *Server) ListExpenseComments(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid ID", http.StatusBadRequest)
+		return
+	}
+	if !s.readableExpenseRequest(w, r, id) {
+		return
+	}
+
+	rows, err := s.DB.QueryContext(r.Context(), `
+		SELECT id, expense_id, author_id, body, attachment_ids, mentions, created_at
+		FROM expense_comment
+		WHERE expense_id = $1
+		ORDER BY created_at, id
+	`, id)
+	if err != nil {
+		log.Println("ListExpenseComments query error:", err)
+		http.Error(w, "Database query failed", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	comments := []ExpenseComment{}
+	for rows.Next() {
+		var c ExpenseComment
+		var attachmentIDs, mentions pq.Int64Array
+		if err := rows.Scan(&c.ID, &c.ExpenseID, &c.AuthorID, &c.Body, &attachmentIDs, &mentions, &c.CreatedAt); err != nil {
+			log.Println("Row scan error:", err)
+			http.Error(w, "Failed to scan comment", http.StatusInternalServerError)
+			return
+		}
+		c.AttachmentIDs, c.Mentions = intSlice(attachmentIDs), intSlice(mentions)
+		comments = append(comments, c)
+	}
+	if err := rows.Err(); err != nil {
+		log.Println("Row iteration error:", err)
+		http.Error(w, "Row iteration error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(comments)
+}
+
+func intSlice(values pq.Int64Array) []int {
+	ints := make([]int, len(values))
+	for i, v := range values {
+		ints[i] = int(v)
+	}
+	return ints
+}
@@ -0,0 +1,492 @@
+package server
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"main/money"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// maxLineDescriptionLength caps line descriptions, in characters.
+const maxLineDescriptionLength = 500
+
+// maxLineQuantity bounds the quantity of a line.
+const maxLineQuantity = 1_000_000
+
+// lineQuantityDecimals is how many decimals the quantity column keeps.
+const lineQuantityDecimals = 3
+
+// ExpenseLine is one item of an expense request, such as a night at a
+// hotel. Once a request has lines its amount is their sum, so totals, limits
+// and budget checks go by them, and each line counts against its own
+// category. Lines can only be changed while the request is a draft.
+type ExpenseLine struct {
+	ID          int          `json:"id,omitempty"`
+	ExpenseID   int          `json:"expenseID"`
+	Description string       `json:"description"`
+	Quantity    float64      `json:"quantity"`
+	UnitPrice   money.Amount `json:"unitPrice,omitempty"` // hidden along with the request's amount
+	Category    string       `json:"category"`            // the request's unless set
+	Amount      money.Amount `json:"amount,omitempty"`    // quantity times unit price, set by the database
+	CreatedAt   *time.Time   `json:"createdAt,omitempty"`
+
+	// Hidden lists the fields the caller may not see; see visibility.go
+	Hidden []string `json:"hidden,omitempty"`
+}
+
+func (ExpenseLine) CreateTableIfNotExists(s *Server) {
+	// A trigger keeps the amount of a request with lines at their sum,
+	// however the lines change. Removing the last line leaves the amount
+	// as it was
+	query := `CREATE TABLE IF NOT EXISTS expense_line (
+		id SERIAL PRIMARY KEY,
+		expense_id INT NOT NULL REFERENCES expense_request (id) ON DELETE CASCADE,
+		description TEXT NOT NULL,
+		quantity NUMERIC(12,3) NOT NULL,
+		unit_price NUMERIC(15,2) NOT NULL,
+		category VARCHAR(256) NOT NULL,
+		amount NUMERIC(15,2) GENERATED ALWAYS AS (ROUND(quantity * unit_price, 2)) STORED,
+		created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+	);
+	CREATE INDEX IF NOT EXISTS expense_line_expense_id_idx ON expense_line (expense_id);
+	CREATE OR REPLACE FUNCTION sum_expense_lines() RETURNS trigger AS $$
+	DECLARE
+		req INT;
+	BEGIN
+		IF TG_OP = 'DELETE' THEN
+			req := OLD.expense_id;
+		ELSE
+			req := NEW.expense_id;
+		END IF;
+		UPDATE expense_request er SET amount = t.total, version = er.version + 1
+		FROM (SELECT SUM(amount) AS total FROM expense_line WHERE expense_id = req) t
+		WHERE er.id = req AND t.total IS NOT NULL;
+		RETURN NULL;
+	END
+	$$ LANGUAGE plpgsql;
+	CREATE OR REPLACE TRIGGER expense_line_sum AFTER INSERT OR UPDATE OR DELETE ON expense_line
+		FOR EACH ROW EXECUTE FUNCTION sum_expense_lines()`
+
+	_, err := s.DB.Exec(query)
+
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+func (l ExpenseLine) Validate(ctx context.Context, s *Server) (FieldErrors, error) {
+	errs := FieldErrors{}
+	switch length := len([]rune(strings.TrimSpace(l.Description))); {
+	case length == 0:
+		errs.add("description", "is required")
+	case length > maxLineDescriptionLength:
+		errs.add("description", fmt.Sprintf("must be at most %d characters", maxLineDescriptionLength))
+	}
+	if l.Quantity <= 0 || l.Quantity > maxLineQuantity {
+		errs.add("quantity", fmt.Sprintf("must be greater than 0 and at most %d", maxLineQuantity))
+	} else if scale := math.Pow10(lineQuantityDecimals); math.Round(l.Quantity*scale)/scale != l.Quantity {
+		errs.add("quantity", fmt.Sprintf("must have at most %d decimals", lineQuantityDecimals))
+	}
+	validateAmount(errs, "unitPrice", l.UnitPrice)
+	if _, ok := errs["quantity"]; !ok && l.UnitPrice > 0 {
+		// The request's amount is the sum of its lines, so it has to fit too
+		var others money.Amount
+		err := s.DB.QueryRowContext(ctx, "SELECT COALESCE(SUM(amount), 0) FROM expense_line WHERE expense_id = $1 AND id <> $2",
+			l.ExpenseID, l.ID).Scan(&others)
+		if err != nil {
+			return nil, err
+		}
+		if l.UnitPrice.Mul(l.Quantity) > money.Max-others {
+			errs.add("unitPrice", "would take the request's amount over "+money.Max.String())
+		}
+	}
+	if err := s.checkExists(ctx, errs, "category", "category does not exist",
+		"SELECT 1 FROM expense_category WHERE name = $1", l.Category); err != nil {
+		return nil, err
+	}
+	return errs, nil
+}
+
+const expenseLineColumns = "id, expense_id, description, quantity, unit_price, category, amount, created_at"
+
+func scanExpenseLine(row rowScanner) (ExpenseLine, error) {
+	var l ExpenseLine
+	err := row.Scan(&l.ID, &l.ExpenseID, &l.Description, &l.Quantity, &l.UnitPrice, &l.Category, &l.Amount, &l.CreatedAt)
+	return l, err
+}
+
+// linesTotal is the sum of the lines of an expense request, or nil when it
+// has none.
+func linesTotal(ctx context.Context, db dbtx, expenseID int) (*money.Amount, error) {
+	var total *money.Amount
+	err := db.QueryRowContext(ctx, "SELECT SUM(amount) FROM expense_line WHERE expense_id = $1", expenseID).Scan(&total)
+	return total, err
+}
+
+// lineCharge is the part of a payment booked to the budget of one category.
+type lineCharge struct {
+	Category string
+	Amount   money.Amount
+}
+
+// chargesOf splits amount, paid on the request expenseID in category, over
+// the categories of its lines in proportion to what each adds up to, in
+// category order and the last taking the remainder as distribute does. A
+// request without lines is charged to its own category.
+func chargesOf(ctx context.Context, db dbtx, expenseID int, category string, amount money.Amount) ([]lineCharge, error) {
+	rows, err := db.QueryContext(ctx, `
+		SELECT category, SUM(amount) FROM expense_line WHERE expense_id = $1
+		GROUP BY category ORDER BY category
+	`, expenseID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var charges []lineCharge
+	var weights []float64
+	for rows.Next() {
+		var c lineCharge
+		if err := rows.Scan(&c.Category, &c.Amount); err != nil {
+			return nil, err
+		}
+		charges = append(charges, c)
+		weights = append(weights, c.Amount.Float64())
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if len(charges) == 0 {
+		return []lineCharge{{category, amount}}, nil
+	}
+	for i, share := range distribute(amount, len(charges), weights, 0) {
+		charges[i].Amount = share.BudgetLimit
+	}
+	return charges, nil
+}
+
+// chargedCategories is the SQL array of the categories the request id in
+// category is charged to: its own and those of its lines.
+func chargedCategories(id, category string) string {
+	return fmt.Sprintf("(ARRAY[%[2]s::text] || ARRAY(SELECT el.category::text FROM expense_line el WHERE el.expense_id = %[1]s))", id, category)
+}
+
+// chargedAmount is the SQL expression for what the request id in category
+// of amount counts towards limitCategory, all SQL expressions: the whole
+// amount for a limit on all categories, and otherwise that of its lines in
+// limitCategory, or of the request when it has none and is in
+// limitCategory itself.
+func chargedAmount(id, category, amount, limitCategory string) string {
+	return fmt.Sprintf(`(CASE
+		WHEN %[4]s = '' THEN %[3]s
+		WHEN EXISTS (SELECT 1 FROM expense_line el WHERE el.expense_id = %[1]s)
+			THEN (SELECT COALESCE(SUM(el.amount), 0) FROM expense_line el WHERE el.expense_id = %[1]s AND el.category = %[4]s)
+		WHEN %[2]s = %[4]s THEN %[3]s
+		ELSE 0
+	END)`, id, category, amount, limitCategory)
+}
+
+// lineCategories are the categories the lines of an expense request are in.
+func lineCategories(ctx context.Context, db dbtx, expenseID int) ([]string, error) {
+	rows, err := db.QueryContext(ctx, "SELECT DISTINCT category FROM expense_line WHERE expense_id = $1 ORDER BY category", expenseID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var categories []string
+	for rows.Next() {
+		var category string
+		if err := rows.Scan(&category); err != nil {
+			return nil, err
+		}
+		categories = append(categories, category)
+	}
+	return categories, rows.Err()
+}
+
+// redactLine hides the prices of a line of a request whose amount the
+// viewer may not see.
+func (v viewer) redactLine(l *ExpenseLine, expense ExpenseRequest) {
+	if v.hidesAmountOf(expense.UserID, expense.UnitID) {
+		l.UnitPrice, l.Amount = 0, 0
+		l.Hidden = []string{"unitPrice", "amount"}
+	}
+}
+
+// editableExpenseLines checks that the caller may change the lines of the
+// request the path names: it must be their own, or they an Admin. Whether it
+// is still a draft is checked under its lock; see beginLineEdit.
+func (s *Server) editableExpenseLines(w http.ResponseWriter, r *http.Request) (ExpenseRequest, bool) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid ID", http.StatusBadRequest)
+		return ExpenseRequest{}, false
+	}
+	v, expense, ok := s.readExpenseRequestAs(w, r, id)
+	if !ok {
+		return expense, false
+	}
+	if v.user.ID != expense.UserID && v.user.RoleID != Admin {
+		http.Error(w, "Only the requester may change the lines of the expense request", http.StatusForbidden)
+		return expense, false
+	}
+	return expense, true
+}
+
+// beginLineEdit starts the transaction a line of the request id is changed
+// in, holding the request's row until it ends so the request cannot be
+// submitted meanwhile, and answers 409 unless the request is a draft.
+func (s *Server) beginLineEdit(w http.ResponseWriter, r *http.Request, id int) (*sql.Tx, bool) {
+	tx, err := s.DB.BeginTx(r.Context(), nil)
+	if err != nil {
+		log.Println("Begin transaction error:", err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return nil, false
+	}
+	if err := lockDraft(r.Context(), tx, id); err != nil {
+		tx.Rollback()
+		writeStoreError(w, err, "Expense request not found")
+		return nil, false
+	}
+	return tx, true
+}
+
+// defaultLineCategory puts a line without a category in its request's.
+func (s *Server) defaultLineCategory(ctx context.Context, line *ExpenseLine) error {
+	if line.Category != "" {
+		return nil
+	}
+	return s.DB.QueryRowContext(ctx, "SELECT category FROM expense_request WHERE id = $1", line.ExpenseID).Scan(&line.Category)
+}
+
+// expenseLineID reads the line the path names.
+func expenseLineID(w http.ResponseWriter, r *http.Request) (int, bool) {
+	lineID, err := strconv.Atoi(mux.Vars(r)["lineID"])
+	if err != nil {
+		http.Error(w, "Invalid line ID", http.StatusBadRequest)
+		return 0, false
+	}
+	return lineID, true
+}
+
+func (s *Server) ListExpenseLines(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid ID", http.StatusBadRequest)
+		return
+	}
+	v, expense, ok := s.readExpenseRequestAs(w, r, id)
+	if !ok {
+		return
+	}
+
+	rows, err := s.DB.QueryContext(r.Context(),
+		"SELECT "+expenseLineColumns+" FROM expense_line WHERE expense_id = $1 ORDER BY id", id)
+	if err != nil {
+		log.Println("ListExpenseLines query error:", err)
+		http.Error(w, "Database query failed", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	lines := []ExpenseLine{}
+	for rows.Next() {
+		l, err := scanExpenseLine(rows)
+		if err != nil {
+			log.Println("Row scan error:", err)
+			http.Error(w, "Failed to scan line", http.StatusInternalServerError)
+			return
+		}
+		v.redactLine(&l, expense)
+		lines = append(lines, l)
+	}
+	if err := rows.Err(); err != nil {
+		log.Println("Row iteration error:", err)
+		http.Error(w, "Row iteration error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(lines)
+}
+
+func (s *Server) GetExpenseLine(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid ID", http.StatusBadRequest)
+		return
+	}
+	lineID, ok := expenseLineID(w, r)
+	if !ok {
+		return
+	}
+	v, expense, ok := s.readExpenseRequestAs(w, r, id)
+	if !ok {
+		return
+	}
+
+	l, err := scanExpenseLine(s.DB.QueryRowContext(r.Context(),
+		"SELECT "+expenseLineColumns+" FROM expense_line WHERE id = $1 AND expense_id = $2", lineID, id))
+	if err == sql.ErrNoRows {
+		http.Error(w, "Line not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		log.Println("GetExpenseLine query error:", err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	v.redactLine(&l, expense)
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(l)
+}
+
+// CreateExpenseLine adds a line to a draft request, whose amount becomes
+// the sum of its lines.
+func (s *Server) CreateExpenseLine(w http.ResponseWriter, r *http.Request) {
+	expense, ok := s.editableExpenseLines(w, r)
+	if !ok {
+		return
+	}
+
+	var line ExpenseLine
+	if err := json.NewDecoder(r.Body).Decode(&line); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+	line.ExpenseID = expense.ID
+	if err := s.defaultLineCategory(r.Context(), &line); err != nil {
+		log.Println("Expense request query error:", err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	tx, ok := s.beginLineEdit(w, r, expense.ID)
+	if !ok {
+		return
+	}
+	defer tx.Rollback()
+	if !s.validate(w, r, line) {
+		return
+	}
+
+	l, err := scanExpenseLine(tx.QueryRowContext(r.Context(), `
+		INSERT INTO expense_line (expense_id, description, quantity, unit_price, category)
+		VALUES ($1, $2, $3, $4, $5)
+		RETURNING `+expenseLineColumns,
+		line.ExpenseID, strings.TrimSpace(line.Description), line.Quantity, line.UnitPrice, line.Category))
+	if err != nil {
+		log.Println("Insert expense line error:", err)
+		http.Error(w, "Failed to create line", http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		log.Println("Commit error:", err)
+		http.Error(w, "Failed to create line", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(l)
+}
+
+// UpdateExpenseLine replaces a line of a draft request.
+func (s *Server) UpdateExpenseLine(w http.ResponseWriter, r *http.Request) {
+	lineID, ok := expenseLineID(w, r)
+	if !ok {
+		return
+	}
+	expense, ok := s.editableExpenseLines(w, r)
+	if !ok {
+		return
+	}
+
+	var line ExpenseLine
+	if err := json.NewDecoder(r.Body).Decode(&line); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+	line.ID, line.ExpenseID = lineID, expense.ID
+	if err := s.defaultLineCategory(r.Context(), &line); err != nil {
+		log.Println("Expense request query error:", err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	tx, ok := s.beginLineEdit(w, r, expense.ID)
+	if !ok {
+		return
+	}
+	defer tx.Rollback()
+	if !s.validate(w, r, line) {
+		return
+	}
+
+	l, err := scanExpenseLine(tx.QueryRowContext(r.Context(), `
+		UPDATE expense_line SET description = $1, quantity = $2, unit_price = $3, category = $4
+		WHERE id = $5 AND expense_id = $6
+		RETURNING `+expenseLineColumns,
+		strings.TrimSpace(line.Description), line.Quantity, line.UnitPrice, line.Category, line.ID, line.ExpenseID))
+	if err == sql.ErrNoRows {
+		http.Error(w, "Line not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		log.Println("Update expense line error:", err)
+		http.Error(w, "Failed to update line", http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		log.Println("Commit error:", err)
+		http.Error(w, "Failed to update line", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(l)
+}
+
+// DeleteExpenseLine removes a line of a draft request.
+func (s *Server) DeleteExpenseLine(w http.ResponseWriter, r *http.Request) {
+	lineID, ok := expenseLineID(w, r)
+	if !ok {
+		return
+	}
+	expense, ok := s.editableExpenseLines(w, r)
+	if !ok {
+		return
+	}
+
+	tx, ok := s.beginLineEdit(w, r, expense.ID)
+	if !ok {
+		return
+	}
+	defer tx.Rollback()
+
+	result, err := tx.ExecContext(r.Context(),
+		"DELETE FROM expense_line WHERE id = $1 AND expense_id = $2", lineID, expense.ID)
+	if err != nil {
+		log.Println("Delete expense line error:", err)
+		http.Error(w, "Failed to delete line", http.StatusInternalServerError)
+		return
+	}
+	if n, err := result.RowsAffected(); err == nil && n == 0 {
+		http.Error(w, "Line not found", http.StatusNotFound)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		log.Println("Commit error:", err)
+		http.Error(w, "Failed to delete line", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
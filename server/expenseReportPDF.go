@@ -0,0 +1,219 @@
+package server
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"main/money"
+	"main/pdf"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+type reportActivity struct {
+	ExpenseActivity
+	CreatedByName string
+}
+
+// expenseReportData is everything printed on an expense request's report.
+type expenseReportData struct {
+	Request       ExpenseRequest
+	RequesterName string
+	Vendor        *Vendor // who the request is paid to, if not the requester
+	Activities    []reportActivity
+	Payments      []PaidExpense
+}
+
+func (s *Server) loadExpenseReport(ctx context.Context, id int) (expenseReportData, error) {
+	var data expenseReportData
+	req := &data.Request
+	err := s.DB.QueryRowContext(ctx, `
+		SELECT er.id, er.user_id, er.unit_id, er.amount, er.category, er.created_at, er.is_finalized, er.currency,
+			er.doc_number, er.reference, er.external_ref, er.vendor_id, er.vat_rate, er.net_amount, er.vat_amount, COALESCE(u.name, '')
+		FROM expense_request er
+		LEFT JOIN users u ON u.id = er.user_id
+		WHERE er.id = $1
+	`, id).Scan(&req.ID, &req.UserID, &req.UnitID, &req.Amount, &req.Category, &req.CreatedAt, &req.IsFinalized,
+		&req.Currency, &req.DocNumber, &req.Reference, &req.ExternalRef, &req.VendorID, &req.VATRate, &req.NetAmount, &req.VATAmount, &data.RequesterName)
+	if err != nil {
+		return data, err
+	}
+	if req.VendorID != nil {
+		vendor, err := s.scanVendor(s.DB.QueryRowContext(ctx, "SELECT "+vendorColumns+" FROM vendor WHERE id = $1", *req.VendorID))
+		if err == nil {
+			data.Vendor = &vendor
+		} else if err != sql.ErrNoRows {
+			return data, err
+		}
+	}
+
+	rows, err := s.DB.QueryContext(ctx, `
+		SELECT ea.id, ea.expense_id, ea.current_state, ea.feedback, ea.created_by, ea.created_at,
+			COALESCE(u.name, '')
+		FROM expense_activity ea
+		LEFT JOIN users u ON u.id = ea.created_by
+		WHERE ea.expense_id = $1
+		ORDER BY ea.created_at, ea.id
+	`, id)
+	if err != nil {
+		return data, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var a reportActivity
+		if err := rows.Scan(&a.ID, &a.ExpenseID, &a.CurrentState, &a.Feedback, &a.CreatedBy, &a.CreatedAt,
+			&a.CreatedByName); err != nil {
+			return data, err
+		}
+		data.Activities = append(data.Activities, a)
+	}
+	if err := rows.Err(); err != nil {
+		return data, err
+	}
+
+	payments, err := s.DB.QueryContext(ctx, `
+		SELECT id, expense_id, unit_id, category, amount, created_at, currency
+		FROM paid_expense
+		WHERE expense_id = $1
+		ORDER BY created_at, id
+	`, id)
+	if err != nil {
+		return data, err
+	}
+	defer payments.Close()
+	for payments.Next() {
+		var p PaidExpense
+		if err := payments.Scan(&p.ID, &p.ExpenseID, &p.UnitID, &p.Category, &p.Amount, &p.CreatedAt, &p.Currency); err != nil {
+			return data, err
+		}
+		data.Payments = append(data.Payments, p)
+	}
+	return data, payments.Err()
+}
+
+func reportTime(t *time.Time) string {
+	if t == nil {
+		return ""
+	}
+	return t.Format("2006-01-02 15:04")
+}
+
+func renderExpenseReport(data expenseReportData) []byte {
+	req := data.Request
+	doc := pdf.New()
+
+	doc.Heading(fmt.Sprintf("Expense Request %s", req.Reference))
+	doc.Field("Document number", req.DocNumber)
+	if req.ExternalRef != "" {
+		doc.Field("External reference", req.ExternalRef)
+	}
+	doc.Field("Requested by", fmt.Sprintf("%s (user %d)", data.RequesterName, req.UserID))
+	if v := data.Vendor; v != nil {
+		doc.Field("Paid to", v.Name)
+		if v.TaxNumber != "" {
+			doc.Field("Tax number", v.TaxNumber)
+		}
+		if v.IBAN != "" {
+			doc.Field("IBAN", v.IBAN)
+		}
+	}
+	doc.Field("Unit", req.UnitID)
+	doc.Field("Category", req.Category)
+	doc.Field("Amount", req.Amount.String()+" "+req.Currency)
+	if req.VATRate != nil {
+		doc.Field("Net", req.NetAmount.String()+" "+req.Currency)
+		doc.Field("VAT", fmt.Sprintf("%s %s at %s%%", req.VATAmount, req.Currency,
+			strconv.FormatFloat(*req.VATRate, 'f', -1, 64)))
+	}
+	doc.Field("Submitted", reportTime(req.CreatedAt))
+	doc.Field("Finalized", strconv.FormatBool(req.IsFinalized))
+
+	var state *ExpenseState
+	if n := len(data.Activities); n > 0 {
+		state = &data.Activities[n-1].CurrentState
+	}
+	var paid money.Amount
+	for _, p := range data.Payments {
+		paid += p.Amount
+	}
+	status := "Submitted"
+	if state != nil {
+		status = string(*state)
+	}
+	doc.Field("Status", status)
+	doc.Field("Next action", string(nextExpectedAction(state, req.Amount, paid)))
+
+	doc.Subheading("Activity history")
+	if len(data.Activities) == 0 {
+		doc.Text("No activity recorded.")
+	} else {
+		rows := make([][]string, len(data.Activities))
+		for i, a := range data.Activities {
+			rows[i] = []string{reportTime(a.CreatedAt), string(a.CurrentState), a.CreatedByName, a.Feedback}
+		}
+		doc.Table([]float64{0.2, 0.18, 0.2, 0.42}, []string{"Date", "State", "By", "Feedback"}, rows)
+	}
+
+	doc.Subheading("Payments")
+	if len(data.Payments) == 0 {
+		doc.Text("No payments recorded.")
+	} else {
+		rows := make([][]string, len(data.Payments))
+		var total money.Amount
+		for i, p := range data.Payments {
+			total += p.Amount
+			rows[i] = []string{reportTime(p.CreatedAt), strconv.Itoa(p.ID), p.Amount.String() + " " + p.Currency, total.String()}
+		}
+		doc.Table([]float64{0.3, 0.2, 0.25, 0.25}, []string{"Date", "Payment", "Amount", "Paid to date"}, rows)
+	}
+
+	doc.Subheading("Approvals")
+	approved := false
+	for _, a := range data.Activities {
+		if a.CurrentState != Approved {
+			continue
+		}
+		approved = true
+		doc.SignatureLine(fmt.Sprintf("Approved by %s (user %d) on %s", a.CreatedByName, a.CreatedBy, reportTime(a.CreatedAt)))
+	}
+	if !approved {
+		doc.Text("This request has not been approved.")
+	}
+	doc.SignatureLine("Finance department")
+
+	doc.Space(20)
+	doc.Text("Generated " + time.Now().Format("2006-01-02 15:04 MST"))
+	return doc.Bytes()
+}
+
+// ExpenseRequestReportPDF renders a printable paper-trail of one request.
+func (s *Server) ExpenseRequestReportPDF(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid ID", http.StatusBadRequest)
+		return
+	}
+	if !s.readableExpenseRequest(w, r, id) {
+		return
+	}
+
+	data, err := s.loadExpenseReport(r.Context(), id)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Expense request not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		log.Println("Expense report query error:", err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	body := renderExpenseReport(data)
+	w.Header().Set("Content-Type", "application/pdf")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`inline; filename="expense-request-%d.pdf"`, id))
+	w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+	w.Write(body)
+}
@@ -1,24 +1,71 @@
 package server
 
 import (
+	"context"
 	"encoding/json"
+	"io"
 	"log"
+	"main/money"
+	"main/query"
+	"maps"
 	"net/http"
+	"slices"
 	"strconv"
 	"strings"
 	"time"
 
 	"github.com/gorilla/mux"
+	"github.com/lib/pq"
 )
 
 type ExpenseRequest struct {
-	ID          int        `json:"id,omitempty"`
-	UserID      int        `json:"userID"`
-	UnitID      string     `json:"unitID"`
-	Amount      float64    `json:"amount"`
-	Category    string     `json:"category"`
-	CreatedAt   *time.Time `json:"createdAt,omitempty"`
-	IsFinalized bool       `json:"isFinalized"`
+	ID          int          `json:"id,omitempty"`
+	UserID      int          `json:"userID"`
+	UnitID      string       `json:"unitID"`
+	Amount      money.Amount `json:"amount,omitempty"` // omitted when hidden from the caller
+	Currency    string       `json:"currency"`
+	Category    string       `json:"category"`
+	CreatedAt   *time.Time   `json:"createdAt,omitempty"`
+	IsFinalized bool         `json:"isFinalized"`
+
+	// Amount is gross. With a VATRate (percent, one of the tax rates) the
+	// database splits it into NetAmount and VATAmount; both are hidden
+	// along with the amount.
+	VATRate   *float64      `json:"vatRate,omitempty"`
+	NetAmount *money.Amount `json:"netAmount,omitempty"`
+	VATAmount *money.Amount `json:"vatAmount,omitempty"`
+
+	// How much of Amount the payments made so far cover and leave open.
+	// Only set on responses, and hidden along with the amount.
+	AmountPaid      *money.Amount `json:"amountPaid,omitempty"`
+	AmountRemaining *money.Amount `json:"amountRemaining,omitempty"`
+
+	// DocNumber is the human-facing number printed on documents, assigned
+	// by the database
+	DocNumber string `json:"docNumber,omitempty"`
+	// Reference numbers requests within the year they were created in, e.g.
+	// EXP-2025-000123. It is assigned by the database and kept with the
+	// row, so it does not change when data moves between environments.
+	Reference string `json:"reference,omitempty"`
+	// ExternalRef is an integration's own ID for the request, e.g. from an
+	// ERP. Empty when unset; unique otherwise.
+	ExternalRef string `json:"externalRef"`
+	// VendorID names the vendor the request is paid to; the requester is
+	// paid when it is unset.
+	VendorID *int `json:"vendorID,omitempty"`
+
+	// Draft creates the request as a draft, which can be edited until it is
+	// submitted; on responses it tells whether it still is one
+	Draft bool `json:"draft,omitempty"`
+
+	// Version is sent as the ETag; see concurrency.go
+	Version int `json:"version,omitempty"`
+
+	// Hidden lists the fields the caller may not see; see visibility.go
+	Hidden []string `json:"hidden,omitempty"`
+
+	// Links is only set on responses, named as HAL names them
+	Links map[string]Link `json:"_links,omitempty" naming:"external"`
 }
 
 func (ExpenseRequest) CreateTableIfNotExists(s *Server) {
@@ -26,7 +73,7 @@ func (ExpenseRequest) CreateTableIfNotExists(s *Server) {
 		id SERIAL PRIMARY KEY,
 		user_id INT NOT NULL,
 		unit_id VARCHAR(256) NOT NULL,
-		amount NUMERIC(7,2) NOT NULL,
+		amount NUMERIC(15,2) NOT NULL,
 		category VARCHAR(256) NOT NULL,
 		created_at timestamp DEFAULT NOW(),
 		is_finalized BOOLEAN
@@ -37,37 +84,234 @@ func (ExpenseRequest) CreateTableIfNotExists(s *Server) {
 	if err != nil {
 		log.Fatal(err)
 	}
+
+	// Rows from before multi-currency support are in the base currency
+	_, err = s.DB.Exec("ALTER TABLE expense_request ADD COLUMN IF NOT EXISTS currency CHAR(3) NOT NULL DEFAULT " + pq.QuoteLiteral(s.BaseCurrency))
+
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	query = `ALTER TABLE expense_request ADD COLUMN IF NOT EXISTS doc_number VARCHAR(32)
+		GENERATED ALWAYS AS ('ER-' || LPAD(id::text, 6, '0')) STORED;
+	CREATE UNIQUE INDEX IF NOT EXISTS expense_request_doc_number_key ON expense_request (doc_number);
+	ALTER TABLE expense_request ADD COLUMN IF NOT EXISTS external_ref VARCHAR(128) NOT NULL DEFAULT '';
+	CREATE UNIQUE INDEX IF NOT EXISTS expense_request_external_ref_key ON expense_request (external_ref) WHERE external_ref <> '';
+	ALTER TABLE expense_request ADD COLUMN IF NOT EXISTS version INT NOT NULL DEFAULT 1;
+	ALTER TABLE expense_request ADD COLUMN IF NOT EXISTS vendor_id INT`
+
+	_, err = s.DB.Exec(query)
+
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	widenAmountColumns(s, "expense_request", "amount")
+	addVATColumns(s, "expense_request")
+
+	// References count per year in expense_number, assigned on insert so
+	// that every way of creating a request gets one
+	query = `CREATE TABLE IF NOT EXISTS expense_number (
+		year INT PRIMARY KEY,
+		last INT NOT NULL
+	);
+	ALTER TABLE expense_request ADD COLUMN IF NOT EXISTS reference VARCHAR(32);
+	CREATE UNIQUE INDEX IF NOT EXISTS expense_request_reference_key ON expense_request (reference);
+	CREATE OR REPLACE FUNCTION assign_expense_reference() RETURNS trigger AS $$
+	DECLARE
+		y INT := EXTRACT(YEAR FROM COALESCE(NEW.created_at, NOW()))::int;
+		n INT;
+	BEGIN
+		IF NEW.reference IS NULL THEN
+			INSERT INTO expense_number (year, last) VALUES (y, 1)
+			ON CONFLICT (year) DO UPDATE SET last = expense_number.last + 1
+			RETURNING last INTO n;
+			NEW.reference := 'EXP-' || y || '-' || LPAD(n::text, GREATEST(6, LENGTH(n::text)), '0');
+		END IF;
+		RETURN NEW;
+	END
+	$$ LANGUAGE plpgsql;
+	CREATE OR REPLACE TRIGGER expense_request_reference BEFORE INSERT ON expense_request
+		FOR EACH ROW EXECUTE FUNCTION assign_expense_reference()`
+
+	_, err = s.DB.Exec(query)
+
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// Requests from before references are numbered in the order they were
+	// created, after any their year already has
+	query = `UPDATE expense_request er
+	SET reference = 'EXP-' || b.year || '-' || LPAD(b.n::text, GREATEST(6, LENGTH(b.n::text)), '0')
+	FROM (
+		SELECT t.id, t.year,
+			COALESCE((SELECT last FROM expense_number WHERE year = t.year), 0)
+				+ ROW_NUMBER() OVER (PARTITION BY t.year ORDER BY t.created_at, t.id) AS n
+		FROM (
+			SELECT id, created_at, EXTRACT(YEAR FROM COALESCE(created_at, NOW()))::int AS year
+			FROM expense_request
+			WHERE reference IS NULL
+		) t
+	) b
+	WHERE er.id = b.id;
+	INSERT INTO expense_number (year, last)
+	SELECT SUBSTRING(reference FROM 5 FOR 4)::int, MAX(SUBSTRING(reference FROM 10)::int)
+	FROM expense_request
+	GROUP BY 1
+	ON CONFLICT (year) DO UPDATE SET last = GREATEST(expense_number.last, EXCLUDED.last)`
+
+	_, err = s.DB.Exec(query)
+
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// expenseRequestFields binds the expense_request columns to the fields of e.
+func expenseRequestFields(e *ExpenseRequest) []query.Field {
+	return []query.Field{
+		{Column: "id", Target: &e.ID},
+		{Column: "user_id", Target: &e.UserID},
+		{Column: "unit_id", Target: &e.UnitID},
+		{Column: "amount", Target: &e.Amount},
+		{Column: "category", Target: &e.Category},
+		{Column: "created_at", Target: &e.CreatedAt},
+		{Column: "is_finalized", Target: &e.IsFinalized},
+		{Column: "currency", Target: &e.Currency},
+		{Column: "doc_number", Target: &e.DocNumber},
+		{Column: "reference", Target: &e.Reference},
+		{Column: "external_ref", Target: &e.ExternalRef},
+		{Column: "version", Target: &e.Version},
+		{Column: "vendor_id", Target: &e.VendorID},
+		{Column: "vat_rate", Target: &e.VATRate},
+		{Column: "net_amount", Target: &e.NetAmount},
+		{Column: "vat_amount", Target: &e.VATAmount},
+	}
+}
+
+// expenseRequestColumns is the column list every expense_request query
+// selects, in the order scanExpenseRequest expects.
+var expenseRequestColumns = query.Columns(expenseRequestFields(&ExpenseRequest{}))
+
+func scanExpenseRequest(row rowScanner) (ExpenseRequest, error) {
+	var e ExpenseRequest
+	err := row.Scan(query.Targets(expenseRequestFields(&e))...)
+	return e, err
+}
+
+// validateAmount checks an amount column against its range.
+func validateAmount(errs FieldErrors, field string, amount money.Amount) {
+	if amount <= 0 {
+		errs.add(field, "must be greater than 0")
+	} else if amount > money.Max {
+		errs.add(field, "must not exceed "+money.Max.String())
+	}
+}
+
+func (e ExpenseRequest) Validate(ctx context.Context, s *Server) (FieldErrors, error) {
+	errs := FieldErrors{}
+	validateAmount(errs, "amount", e.Amount)
+
+	if err := s.checkExists(ctx, errs, "userID", "user does not exist",
+		"SELECT 1 FROM users WHERE id = $1", e.UserID); err != nil {
+		return nil, err
+	}
+	if err := s.checkExists(ctx, errs, "unitID", "unit does not exist",
+		"SELECT 1 FROM unit WHERE name = $1", e.UnitID); err != nil {
+		return nil, err
+	}
+	if err := s.checkExists(ctx, errs, "category", "category does not exist",
+		"SELECT 1 FROM expense_category WHERE name = $1", e.Category); err != nil {
+		return nil, err
+	}
+	if err := s.checkCurrency(ctx, errs, "currency", e.Currency); err != nil {
+		return nil, err
+	}
+	if err := s.checkVATRate(ctx, errs, "vatRate", e.VATRate); err != nil {
+		return nil, err
+	}
+	if len(e.ExternalRef) > 128 {
+		errs.add("externalRef", "must be at most 128 characters")
+	} else if e.ExternalRef != "" {
+		if err := s.checkUnique(ctx, errs, "externalRef", "is already used by another expense request",
+			"SELECT 1 FROM expense_request WHERE external_ref = $1 AND id <> $2", e.ExternalRef, e.ID); err != nil {
+			return nil, err
+		}
+	}
+	if e.VendorID != nil {
+		if err := s.checkExists(ctx, errs, "vendorID", "vendor does not exist",
+			"SELECT 1 FROM vendor WHERE id = $1", *e.VendorID); err != nil {
+			return nil, err
+		}
+	}
+	// A request with lines is worth their sum; see expenseLine.go
+	if e.ID != 0 {
+		total, err := linesTotal(ctx, s.DB, e.ID)
+		if err != nil {
+			return nil, err
+		}
+		if total != nil && e.Amount != *total {
+			errs.add("amount", "must be the sum of the request's lines, "+total.String())
+		}
+	}
+	return errs, nil
+}
+
+// fileAs files a request written by caller as theirs and their unit's.
+// Only an Admin files requests for other users or units.
+func fileAs(caller User, e *ExpenseRequest) {
+	if caller.RoleID != Admin {
+		e.UserID, e.UnitID = caller.ID, caller.UnitID
+	}
+}
+
+// editableExpenseRequest checks that the caller may edit the request id:
+// it must be in their scope and their own, or they an Admin. Whether it is
+// still a draft is checked separately; see requireDraft.
+func (s *Server) editableExpenseRequest(w http.ResponseWriter, r *http.Request, id int) (User, bool) {
+	v, expense, ok := s.readExpenseRequestAs(w, r, id)
+	if !ok {
+		return User{}, false
+	}
+	if v.user.ID != expense.UserID && v.user.RoleID != Admin {
+		http.Error(w, "Only the requester may edit the expense request", http.StatusForbidden)
+		return User{}, false
+	}
+	return *v.user, true
 }
 
 func (s *Server) CreateExpenseRequest(w http.ResponseWriter, r *http.Request) {
+	// Keep the raw body around so it can be retained for dispute handling
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, "Failed to read request body", http.StatusBadRequest)
+		return
+	}
+
 	var expenseRequest ExpenseRequest
-	if err := json.NewDecoder(r.Body).Decode(&expenseRequest); err != nil {
+	if err := json.Unmarshal(body, &expenseRequest); err != nil {
 		http.Error(w, "Invalid JSON", http.StatusBadRequest)
 		return
 	}
+	caller, ok := s.requireCaller(w, r)
+	if !ok {
+		return
+	}
+	fileAs(caller, &expenseRequest)
+	expenseRequest.Currency = s.currencyOrBase(expenseRequest.Currency)
 
-	query := `
-		INSERT INTO expense_request (user_id, unit_id, amount, category, is_finalized)
-		VALUES ($1, $2, $3, $4, $5)
-		RETURNING id, created_at
-	`
-
-	err := s.DB.QueryRow(query,
-		expenseRequest.UserID,
-		expenseRequest.UnitID,
-		expenseRequest.Amount,
-		expenseRequest.Category,
-		expenseRequest.IsFinalized,
-	).Scan(
-		&expenseRequest.ID,
-		&expenseRequest.CreatedAt,
-	)
+	expenseRequest, err = s.createExpenseRequest(r.Context(), expenseRequest)
 	if err != nil {
-		log.Println("Insert error:", err)
-		http.Error(w, "Failed to create expense", http.StatusInternalServerError)
+		writeStoreError(w, err, "Expense request not found")
 		return
 	}
 
+	s.storeExpenseRequestPayload(r.Context(), expenseRequest.ID, body)
+	s.addExpenseLinks(r, &expenseRequest)
+	envelopeOf(r).expenseRequest(expenseRequest.ID)
+
+	setVersionETag(w, expenseRequest.Version)
 	w.Header().Set("Content-Type", "application/json; charset=utf-8")
 	w.WriteHeader(http.StatusCreated)
 	if err := json.NewEncoder(w).Encode(expenseRequest); err != nil {
@@ -75,6 +319,39 @@ func (s *Server) CreateExpenseRequest(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// ExpenseRequestWithActivities is a request with its activity timeline,
+// oldest first.
+type ExpenseRequestWithActivities struct {
+	ExpenseRequest
+	Activities []ExpenseActivity `json:"activities"`
+}
+
+// expenseTimeline returns the activities of a request, as read through
+// expensesAs, in the order they happened.
+func (s *Server) expenseTimeline(ctx context.Context, expense ExpenseRequest) ([]ExpenseActivity, error) {
+	rows, err := s.DB.QueryContext(ctx, `
+		SELECT id, expense_id, current_state, feedback, created_by, created_at
+		FROM expense_activity
+		WHERE expense_id = $1
+		ORDER BY created_at, id
+	`, expense.ID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	activities := []ExpenseActivity{}
+	for rows.Next() {
+		var ea ExpenseActivity
+		if err := rows.Scan(&ea.ID, &ea.ExpenseID, &ea.CurrentState, &ea.Feedback, &ea.CreatedBy, &ea.CreatedAt); err != nil {
+			return nil, err
+		}
+		redactActivity(&ea, slices.Contains(expense.Hidden, "amount"))
+		activities = append(activities, ea)
+	}
+	return activities, rows.Err()
+}
+
 func (s *Server) GetExpenseRequest(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	idStr := vars["id"]
@@ -83,36 +360,121 @@ func (s *Server) GetExpenseRequest(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Invalid ID", http.StatusBadRequest)
 		return
 	}
-	var expenseRequest ExpenseRequest
-	err = s.DB.QueryRow(`
-		SELECT id, user_id, unit_id, amount, category, created_at, is_finalized
-		FROM expense_request
-		WHERE id = $1
-	`, id).Scan(
-		&expenseRequest.ID,
-		&expenseRequest.UserID,
-		&expenseRequest.UnitID,
-		&expenseRequest.Amount,
-		&expenseRequest.Category,
-		&expenseRequest.CreatedAt,
-		&expenseRequest.IsFinalized,
-	)
+
+	expand := r.URL.Query().Get("expand")
+	if expand != "" && expand != "activities" {
+		http.Error(w, "expand must be activities", http.StatusBadRequest)
+		return
+	}
+
+	v, ok := s.viewerOf(w, r)
+	if !ok {
+		return
+	}
+
+	expenseRequest, err := s.expensesAs(v).Get(r.Context(), id)
+	if err != nil {
+		writeStoreError(w, err, "Expense request not found")
+		return
+	}
+	s.addExpenseLinks(r, &expenseRequest)
+	envelopeOf(r).expenseRequest(expenseRequest.ID)
+
+	var response any = expenseRequest
+	if expand == "activities" {
+		activities, err := s.expenseTimeline(r.Context(), expenseRequest)
+		if err != nil {
+			log.Printf("Activity query error: %v", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		response = ExpenseRequestWithActivities{ExpenseRequest: expenseRequest, Activities: activities}
+	}
+
+	setVersionETag(w, expenseRequest.Version)
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		log.Printf("JSON encode error: %v", err)
+	}
+}
+
+// GetExpenseRequestActivities returns a request together with its timeline.
+func (s *Server) GetExpenseRequestActivities(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid ID", http.StatusBadRequest)
+		return
+	}
+
+	v, ok := s.viewerOf(w, r)
+	if !ok {
+		return
+	}
+
+	expenseRequest, err := s.expensesAs(v).Get(r.Context(), id)
+	if err != nil {
+		writeStoreError(w, err, "Expense request not found")
+		return
+	}
+	s.addExpenseLinks(r, &expenseRequest)
+	envelopeOf(r).expenseRequest(expenseRequest.ID)
+
+	activities, err := s.expenseTimeline(r.Context(), expenseRequest)
 	if err != nil {
-		// if err == sql.ErrNoRows {
-		// 	http.Error(w, "Expense request not found", http.StatusNotFound)
-		// 	return
-		// }
-		log.Printf("Database error: %v", err)
+		log.Printf("Activity query error: %v", err)
 		http.Error(w, "Internal server error", http.StatusInternalServerError)
 		return
 	}
 
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	if err := json.NewEncoder(w).Encode(ExpenseRequestWithActivities{ExpenseRequest: expenseRequest, Activities: activities}); err != nil {
+		log.Printf("JSON encode error: %v", err)
+	}
+}
+
+// getExpenseRequestBy serves a single request looked up by an alternate
+// identifier.
+func (s *Server) getExpenseRequestBy(w http.ResponseWriter, r *http.Request, get func(ExpenseStore, context.Context, string) (ExpenseRequest, error), value string) {
+	v, ok := s.viewerOf(w, r)
+	if !ok {
+		return
+	}
+
+	expenseRequest, err := get(s.expensesAs(v), r.Context(), value)
+	if err != nil {
+		writeStoreError(w, err, "Expense request not found")
+		return
+	}
+	s.addExpenseLinks(r, &expenseRequest)
+	envelopeOf(r).expenseRequest(expenseRequest.ID)
+
+	setVersionETag(w, expenseRequest.Version)
 	w.Header().Set("Content-Type", "application/json; charset=utf-8")
 	if err := json.NewEncoder(w).Encode(expenseRequest); err != nil {
 		log.Printf("JSON encode error: %v", err)
 	}
 }
 
+// GetExpenseRequestByNumber looks a request up by its document number or
+// its reference, whichever is given.
+func (s *Server) GetExpenseRequestByNumber(w http.ResponseWriter, r *http.Request) {
+	number := strings.ToUpper(mux.Vars(r)["doc_number"])
+	if strings.HasPrefix(number, "EXP-") {
+		s.getExpenseRequestBy(w, r, ExpenseStore.GetByReference, number)
+		return
+	}
+	s.getExpenseRequestBy(w, r, ExpenseStore.GetByDocNumber, number)
+}
+
+func (s *Server) GetExpenseRequestByExternalRef(w http.ResponseWriter, r *http.Request) {
+	ref := mux.Vars(r)["ref"]
+	if ref == "" {
+		http.Error(w, "Invalid external reference", http.StatusBadRequest)
+		return
+	}
+	s.getExpenseRequestBy(w, r, ExpenseStore.GetByExternalRef, ref)
+}
+
 func (s *Server) UpdateExpenseRequest(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	idStr := vars["id"]
@@ -123,47 +485,123 @@ func (s *Server) UpdateExpenseRequest(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	versions, ok := ifMatchVersions(w, r)
+	if !ok {
+		return
+	}
+
+	caller, ok := s.editableExpenseRequest(w, r, id)
+	if !ok {
+		return
+	}
+	if !s.requireDraft(w, r, id) {
+		return
+	}
+
 	var expenseRequest ExpenseRequest
 	if err := json.NewDecoder(r.Body).Decode(&expenseRequest); err != nil {
 		http.Error(w, "Invalid JSON", http.StatusBadRequest)
 		return
 	}
+	fileAs(caller, &expenseRequest)
+	expenseRequest.Currency = s.currencyOrBase(expenseRequest.Currency)
+	expenseRequest.ID = id
+
+	if !s.validate(w, r, expenseRequest) {
+		return
+	}
+
+	expenseRequest, err = s.Expenses.Update(r.Context(), expenseRequest, versions)
+	if err != nil {
+		writeStoreError(w, err, "Expense request not found")
+		return
+	}
+
+	s.addExpenseLinks(r, &expenseRequest)
+	envelopeOf(r).expenseRequest(expenseRequest.ID)
+
+	setVersionETag(w, expenseRequest.Version)
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	if err := json.NewEncoder(w).Encode(expenseRequest); err != nil {
+		log.Printf("JSON encode error: %v", err)
+	}
+}
 
-	query := `
-		UPDATE expense_request
-		SET user_id = $1, unit_id = $2, amount = $3, category = $4, is_finalized = $5
-		WHERE id = $6
-	`
+var expenseRequestPatchFields = map[string]patchField{
+	"userID":      patchAs[int]("user_id"),
+	"unitID":      patchAs[string]("unit_id"),
+	"amount":      patchAs[money.Amount]("amount"),
+	"category":    patchAs[string]("category"),
+	"isFinalized": patchAs[bool]("is_finalized"),
+	"currency":    patchAs[string]("currency"),
+	"externalRef": patchAs[string]("external_ref"),
+	"vendorID":    patchAs[*int]("vendor_id"),
+	"vatRate":     patchAs[*float64]("vat_rate"),
+}
 
-	res, err := s.DB.Exec(query,
-		expenseRequest.UserID,
-		expenseRequest.UnitID,
-		expenseRequest.Amount,
-		expenseRequest.Category,
-		expenseRequest.IsFinalized,
-		id,
-	)
+// expenseRequestOwnPatchFields are the fields a requester who is not an
+// Admin patches: whose request it is and which unit it is charged to stay
+// as fileAs set them.
+var expenseRequestOwnPatchFields = func() map[string]patchField {
+	fields := maps.Clone(expenseRequestPatchFields)
+	delete(fields, "userID")
+	delete(fields, "unitID")
+	return fields
+}()
+
+func (s *Server) PatchExpenseRequest(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	idStr := vars["id"]
 
+	id, err := strconv.Atoi(idStr)
 	if err != nil {
-		log.Printf("DB update error: %v", err)
-		http.Error(w, "Database error", http.StatusInternalServerError)
+		http.Error(w, "Invalid ID", http.StatusBadRequest)
+		return
+	}
+
+	versions, ok := ifMatchVersions(w, r)
+	if !ok {
+		return
+	}
+
+	caller, ok := s.editableExpenseRequest(w, r, id)
+	if !ok {
+		return
+	}
+	if !s.requireDraft(w, r, id) {
 		return
 	}
 
-	rowsAffected, err := res.RowsAffected()
+	// Decode only the fields the client sent
+	var fields map[string]json.RawMessage
+	if err := json.NewDecoder(r.Body).Decode(&fields); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+
+	patchable := expenseRequestPatchFields
+	if caller.RoleID != Admin {
+		patchable = expenseRequestOwnPatchFields
+	}
+	set, args, err := buildPatch(fields, patchable)
 	if err != nil {
-		http.Error(w, "Error checking update result", http.StatusInternalServerError)
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
-	if rowsAffected == 0 {
-		http.Error(w, "Expense request not found", http.StatusNotFound)
+
+	if !s.validatePatch(w, r, fields, &ExpenseRequest{ID: id}) {
 		return
 	}
 
-	// // Set ID, but we can't get CreatedAt here because Exec doesn't return rows
-	// expenseRequest.ID = id
-	// Optionally: You can fetch CreatedAt separately if you want (optional step)
+	expenseRequest, err := s.Expenses.Patch(r.Context(), id, Patch{Set: set, Args: args}, versions)
+	if err != nil {
+		writeStoreError(w, err, "Expense request not found")
+		return
+	}
+	s.addExpenseLinks(r, &expenseRequest)
+	envelopeOf(r).expenseRequest(expenseRequest.ID)
 
+	setVersionETag(w, expenseRequest.Version)
 	w.Header().Set("Content-Type", "application/json; charset=utf-8")
 	if err := json.NewEncoder(w).Encode(expenseRequest); err != nil {
 		log.Printf("JSON encode error: %v", err)
@@ -180,22 +618,13 @@ func (s *Server) DeleteExpenseRequest(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	result, err := s.DB.Exec("DELETE FROM expense_request WHERE id = $1", id)
-	if err != nil {
-		http.Error(w, "Failed to delete expense request", http.StatusInternalServerError)
-		log.Printf("Delete error: %v", err)
+	if _, ok := s.requireRole(w, r, Admin); !ok {
 		return
 	}
 
-	rowsAffected, err := result.RowsAffected()
-	if err != nil {
-		http.Error(w, "Error checking affected rows", http.StatusInternalServerError)
-		log.Printf("Rows affected error: %v", err)
-		return
-	}
-
-	if rowsAffected == 0 {
-		http.Error(w, "Expense request not found", http.StatusNotFound)
+	// Refused once the request has history; see PostgresExpenseStore.Delete
+	if err := s.Expenses.Delete(r.Context(), id); err != nil {
+		writeStoreError(w, err, "Expense request not found")
 		return
 	}
 
@@ -203,110 +632,173 @@ func (s *Server) DeleteExpenseRequest(w http.ResponseWriter, r *http.Request) {
 }
 
 func (s *Server) ListExpenseRequests(w http.ResponseWriter, r *http.Request) {
+	format, ok := listFormat(w, r)
+	if !ok {
+		return
+	}
+	v, ok := s.viewerOf(w, r)
+	if !ok {
+		return
+	}
+
+	opts, ok := listOptions(w, r, expenseRequestSortable)
+	if !ok {
+		return
+	}
+
 	queryParams := r.URL.Query()
-	var filters []string
-	var args []interface{}
-	argPos := 1
-
-	// if id := queryParams.Get("id"); id != "" {
-	// 	filters = append(filters, "id = $"+strconv.Itoa(argPos))
-	// 	idInt, err := strconv.Atoi(id)
-	// 	if err != nil {
-	// 		http.Error(w, "Invalid id parameter", http.StatusBadRequest)
-	// 		return
-	// 	}
-	// 	args = append(args, idInt)
-	// 	argPos++
-	// }
-
-	if userID := queryParams.Get("user_id"); userID != "" {
-		filters = append(filters, "user_id = $"+strconv.Itoa(argPos))
+	filter := ExpenseFilter{
+		UnitID:      queryParams.Get("unitID"),
+		Category:    queryParams.Get("category"),
+		ExternalRef: queryParams.Get("externalRef"),
+		ListOptions: opts,
+	}
+
+	if userID := queryParams.Get("userID"); userID != "" {
 		userIDInt, err := strconv.Atoi(userID)
 		if err != nil {
 			http.Error(w, "Invalid userID parameter", http.StatusBadRequest)
 			return
 		}
-		args = append(args, userIDInt)
-		argPos++
+		filter.UserID = &userIDInt
 	}
-
-	if unitID := queryParams.Get("unit_id"); unitID != "" {
-		filters = append(filters, "unit_id = $"+strconv.Itoa(argPos))
-		args = append(args, unitID)
-		argPos++
+	if vendorID := queryParams.Get("vendorID"); vendorID != "" {
+		vendorIDInt, err := strconv.Atoi(vendorID)
+		if err != nil {
+			http.Error(w, "Invalid vendorID parameter", http.StatusBadRequest)
+			return
+		}
+		filter.VendorID = &vendorIDInt
 	}
 
-	if amount := queryParams.Get("amount"); amount != "" {
-		filters = append(filters, "amount = $"+strconv.Itoa(argPos))
-		amountFloat, err := strconv.ParseFloat(amount, 64)
+	amount := queryParams.Get("amount")
+	if amount != "" {
+		amountValue, err := money.Parse(amount)
 		if err != nil {
 			http.Error(w, "Invalid amount parameter", http.StatusBadRequest)
 			return
 		}
-		args = append(args, amountFloat)
-		argPos++
+		filter.Amount = &amountValue
 	}
 
-	if category := queryParams.Get("category"); category != "" {
-		filters = append(filters, "category = $"+strconv.Itoa(argPos))
-		args = append(args, category)
-		argPos++
+	// Filtering or sorting on amounts the caller cannot see would reveal them
+	sortsByAmount := slices.ContainsFunc(opts.Sort, func(term string) bool { return strings.HasPrefix(term, "amount ") })
+	if (amount != "" || sortsByAmount) && v.restricted(expenseRequestFieldRules, "amount") {
+		filter.OwnedBy = v.user.ID
 	}
 
-	if isFinalized := queryParams.Get("is_finalized"); isFinalized != "" {
-		filters = append(filters, "is_finalized = $"+strconv.Itoa(argPos))
+	if isFinalized := queryParams.Get("isFinalized"); isFinalized != "" {
 		isFinalizedBool, err := strconv.ParseBool(isFinalized)
 		if err != nil {
 			http.Error(w, "Invalid isFinalized parameter", http.StatusBadRequest)
 			return
 		}
-		args = append(args, isFinalizedBool)
-		argPos++
+		filter.IsFinalized = &isFinalizedBool
 	}
 
-	// Build the query string
-	query := `
-		SELECT id, user_id, unit_id, amount, category, created_at, is_finalized
-		FROM expense_request
-	`
-	if len(filters) > 0 {
-		query += " WHERE " + strings.Join(filters, " AND ")
+	if format != "json" {
+		s.exportExpenseRequests(w, r, v, filter, format)
+		return
 	}
 
-	rows, err := s.DB.Query(query, args...)
+	expenses, err := s.expensesAs(v).List(r.Context(), filter)
 	if err != nil {
 		http.Error(w, "Failed to fetch expense requests", http.StatusInternalServerError)
 		log.Printf("Query error: %v", err)
 		return
 	}
-	defer rows.Close()
-
-	expenses := []ExpenseRequest{}
-	for rows.Next() {
-		var expense ExpenseRequest
-		err := rows.Scan(
-			&expense.ID,
-			&expense.UserID,
-			&expense.UnitID,
-			&expense.Amount,
-			&expense.Category,
-			&expense.CreatedAt,
-			&expense.IsFinalized,
-		)
+	if env := envelopeOf(r); env != nil {
+		total, err := s.expensesAs(v).Count(r.Context(), filter)
 		if err != nil {
-			http.Error(w, "Failed to read expense request", http.StatusInternalServerError)
-			log.Printf("Scan error: %v", err)
+			http.Error(w, "Failed to fetch expense requests", http.StatusInternalServerError)
+			log.Printf("Count error: %v", err)
 			return
 		}
-		expenses = append(expenses, expense)
+		env.page(opts, total)
 	}
 
-	if err := rows.Err(); err != nil {
-		http.Error(w, "Error reading rows", http.StatusInternalServerError)
-		log.Printf("Rows error: %v", err)
-		return
+	linked := make([]*ExpenseRequest, len(expenses))
+	for i := range expenses {
+		linked[i] = &expenses[i]
 	}
+	s.addExpenseLinks(r, linked...)
 
 	w.Header().Set("Content-Type", "application/json; charset=utf-8")
 	json.NewEncoder(w).Encode(expenses)
 }
+
+// exportExpenseRequests streams the requests filter matches as CSV or
+// NDJSON while they are read. NDJSON rows carry their _links like the JSON
+// list, worked out a batch of rows at a time.
+func (s *Server) exportExpenseRequests(w http.ResponseWriter, r *http.Request, v viewer, filter ExpenseFilter, format string) {
+	var export *csvExport
+	var stream *ndjsonExport
+	if format == "csv" {
+		export = newCSVExport(w, "expense_requests",
+			[]string{"id", "docNumber", "reference", "externalRef", "userID", "unitID", "amount", "currency", "category", "createdAt", "isFinalized", "vendorID", "vatRate", "netAmount", "vatAmount"})
+	} else {
+		stream = newNDJSONExport(w)
+	}
+
+	var batch []ExpenseRequest
+	writeBatch := func() error {
+		linked := make([]*ExpenseRequest, len(batch))
+		for i := range batch {
+			linked[i] = &batch[i]
+		}
+		s.addExpenseLinks(r, linked...)
+		for _, expense := range batch {
+			if err := stream.write(expense); err != nil {
+				return err
+			}
+		}
+		batch = batch[:0]
+		return nil
+	}
+
+	err := s.expensesAs(v).Each(r.Context(), filter, func(expense ExpenseRequest) error {
+		if stream != nil {
+			batch = append(batch, expense)
+			if len(batch) == exportFlushEvery {
+				return writeBatch()
+			}
+			return nil
+		}
+		return export.write([]string{
+			strconv.Itoa(expense.ID),
+			expense.DocNumber,
+			expense.Reference,
+			csvText(expense.ExternalRef),
+			strconv.Itoa(expense.UserID),
+			csvText(expense.UnitID),
+			csvHidden(expense.Hidden, "amount", expense.Amount.String()),
+			expense.Currency,
+			csvText(expense.Category),
+			csvTime(expense.CreatedAt),
+			strconv.FormatBool(expense.IsFinalized),
+			csvOptional(expense.VendorID, strconv.Itoa),
+			csvOptional(expense.VATRate, csvFloat),
+			csvHidden(expense.Hidden, "amount", csvOptional(expense.NetAmount, money.Amount.String)),
+			csvHidden(expense.Hidden, "amount", csvOptional(expense.VATAmount, money.Amount.String)),
+		})
+	})
+	if err == nil && stream != nil {
+		err = writeBatch()
+	}
+	if err != nil {
+		log.Printf("Export error: %v", err)
+		// Once rows are out the status has been sent
+		if (export == nil || export.rows == 0) && (stream == nil || stream.rows == 0) {
+			http.Error(w, "Failed to fetch expense requests", http.StatusInternalServerError)
+		}
+		return
+	}
+
+	if export != nil {
+		if err := export.close(); err != nil {
+			log.Printf("CSV write error: %v", err)
+		}
+		return
+	}
+	stream.close()
+}
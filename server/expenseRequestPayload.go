@@ -0,0 +1,134 @@
+package server
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// redactedKeys are stripped from stored payloads wherever they appear.
+var redactedKeys = []string{"password", "token", "secret", "iban"}
+
+// ExpenseRequestPayload is the JSON a client submitted when creating an
+// expense request, kept to settle disputes about what was entered.
+type ExpenseRequestPayload struct {
+	ExpenseID int             `json:"expenseID"`
+	Payload   json.RawMessage `json:"payload"`
+	CreatedAt time.Time       `json:"createdAt"`
+}
+
+func (ExpenseRequestPayload) CreateTableIfNotExists(s *Server) {
+	query := `CREATE TABLE IF NOT EXISTS expense_request_payload (
+		expense_id INT PRIMARY KEY,
+		payload JSONB NOT NULL,
+		created_at timestamp NOT NULL DEFAULT NOW()
+	)`
+
+	_, err := s.DB.Exec(query)
+
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// redact replaces the values of sensitive keys in a decoded JSON document.
+func redact(v any) any {
+	switch value := v.(type) {
+	case map[string]any:
+		for key, inner := range value {
+			lower := strings.ToLower(key)
+			sensitive := false
+			for _, k := range redactedKeys {
+				if strings.Contains(lower, k) {
+					sensitive = true
+					break
+				}
+			}
+			if sensitive {
+				value[key] = "[REDACTED]"
+			} else {
+				value[key] = redact(inner)
+			}
+		}
+	case []any:
+		for i := range value {
+			value[i] = redact(value[i])
+		}
+	}
+	return v
+}
+
+// storeExpenseRequestPayload keeps the redacted request body for the
+// configured retention window and drops entries that have aged out. It is a
+// no-op when retention is disabled.
+func (s *Server) storeExpenseRequestPayload(ctx context.Context, expenseID int, body []byte) {
+	if s.PayloadRetention <= 0 {
+		return
+	}
+
+	var doc any
+	if err := json.Unmarshal(body, &doc); err != nil {
+		log.Println("Payload decode error:", err)
+		return
+	}
+	redacted, err := json.Marshal(redact(doc))
+	if err != nil {
+		log.Println("Payload encode error:", err)
+		return
+	}
+
+	_, err = s.DB.ExecContext(ctx, `
+		INSERT INTO expense_request_payload (expense_id, payload)
+		VALUES ($1, $2)
+		ON CONFLICT (expense_id) DO UPDATE SET payload = EXCLUDED.payload, created_at = NOW()
+	`, expenseID, redacted)
+	if err != nil {
+		log.Println("Payload insert error:", err)
+		return
+	}
+
+	cutoff := time.Now().Add(-s.PayloadRetention)
+	if _, err := s.DB.ExecContext(ctx, "DELETE FROM expense_request_payload WHERE created_at < $1", cutoff); err != nil {
+		log.Println("Payload purge error:", err)
+	}
+}
+
+func (s *Server) GetExpenseRequestPayload(w http.ResponseWriter, r *http.Request) {
+	if _, ok := s.requireRole(w, r, Admin); !ok {
+		return
+	}
+
+	vars := mux.Vars(r)
+	idStr := vars["id"]
+	id, err := strconv.Atoi(idStr)
+	if err != nil {
+		http.Error(w, "Invalid ID", http.StatusBadRequest)
+		return
+	}
+
+	var p ExpenseRequestPayload
+	cutoff := time.Now().Add(-s.PayloadRetention)
+	err = s.DB.QueryRowContext(r.Context(), `
+		SELECT expense_id, payload, created_at
+		FROM expense_request_payload
+		WHERE expense_id = $1 AND created_at >= $2
+	`, id, cutoff).Scan(&p.ExpenseID, &p.Payload, &p.CreatedAt)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Payload not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		log.Printf("Payload query error: %v", err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(p)
+}
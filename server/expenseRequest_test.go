@@ -0,0 +1,111 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"testing"
+)
+
+func TestCreateExpenseRequest(t *testing.T) {
+	ts := newTestServer(t, []string{"Sales", "Support"}, []string{"Travel"})
+	requester, requesterToken := ts.addUser(t, "requester", "Sales", FieldPersonnel)
+	_, outsiderToken := ts.addUser(t, "outsider", "Support", FieldPersonnel)
+
+	w := serve(ts.CreateExpenseRequest, "POST", "/expense_requests", nil, requesterToken,
+		`{"userID": `+strconv.Itoa(requester.ID)+`, "unitID": "Sales", "category": "Travel", "amount": 120.25}`)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("status = %d, want %d: %s", w.Code, http.StatusCreated, w.Body)
+	}
+	var created ExpenseRequest
+	if err := json.NewDecoder(w.Body).Decode(&created); err != nil {
+		t.Fatal(err)
+	}
+	if created.ID == 0 || created.UserID != requester.ID || created.Amount != 12025 || created.Currency != "EUR" {
+		t.Errorf("created %+v", created)
+	}
+	stored, err := ts.expenses.Get(t.Context(), created.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored.Amount != 12025 || stored.Category != "Travel" {
+		t.Errorf("stored %+v", stored)
+	}
+
+	id := strconv.Itoa(created.ID)
+	w = serve(ts.GetExpenseRequest, "GET", "/expense_requests/"+id, map[string]string{"id": id}, requesterToken, "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("get status = %d, want %d: %s", w.Code, http.StatusOK, w.Body)
+	}
+	var got ExpenseRequest
+	if err := json.NewDecoder(w.Body).Decode(&got); err != nil {
+		t.Fatal(err)
+	}
+	if got.ID != created.ID || got.Amount != 12025 {
+		t.Errorf("got %+v", got)
+	}
+
+	// Others file requests as themselves, in their own unit
+	outsider, _ := ts.addUser(t, "colleague", "Support", FieldPersonnel)
+	w = serve(ts.CreateExpenseRequest, "POST", "/expense_requests", nil, requesterToken,
+		`{"userID": `+strconv.Itoa(outsider.ID)+`, "unitID": "Support", "category": "Travel", "amount": 10}`)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("filing for another user: status = %d, want %d: %s", w.Code, http.StatusCreated, w.Body)
+	}
+	var filed ExpenseRequest
+	if err := json.NewDecoder(w.Body).Decode(&filed); err != nil {
+		t.Fatal(err)
+	}
+	if filed.UserID != requester.ID || filed.UnitID != "Sales" {
+		t.Errorf("filed for user %d of %s, want the caller and their unit", filed.UserID, filed.UnitID)
+	}
+	if w := serve(ts.CreateExpenseRequest, "POST", "/expense_requests", nil, "", `{"category": "Travel", "amount": 10}`); w.Code != http.StatusUnauthorized {
+		t.Errorf("without a token: status = %d, want %d", w.Code, http.StatusUnauthorized)
+	}
+
+	// Requests out of the caller's scope are not found
+	w = serve(ts.GetExpenseRequest, "GET", "/expense_requests/"+id, map[string]string{"id": id}, outsiderToken, "")
+	if w.Code != http.StatusNotFound {
+		t.Errorf("outsider: status = %d, want %d: %s", w.Code, http.StatusNotFound, w.Body)
+	}
+}
+
+func TestCreateExpenseRequestValidation(t *testing.T) {
+	ts := newTestServer(t, []string{"Sales"}, []string{"Travel"})
+	// An Admin's body is taken as it is, requester and unit included
+	_, token := ts.addUser(t, "admin", "Sales", Admin)
+
+	w := serve(ts.CreateExpenseRequest, "POST", "/expense_requests", nil, token,
+		`{"userID": 42, "unitID": "Nowhere", "category": "Fun", "amount": -5, "currency": "XXX"}`)
+	if w.Code != http.StatusUnprocessableEntity {
+		t.Fatalf("status = %d, want %d: %s", w.Code, http.StatusUnprocessableEntity, w.Body)
+	}
+	var body struct{ Errors FieldErrors }
+	if err := json.NewDecoder(w.Body).Decode(&body); err != nil {
+		t.Fatal(err)
+	}
+	for _, field := range []string{"amount", "userID", "unitID", "category", "currency"} {
+		if body.Errors[field] == "" {
+			t.Errorf("no error for %s in %v", field, body.Errors)
+		}
+	}
+	if n, _ := ts.expenses.Count(t.Context(), ExpenseFilter{}); n != 0 {
+		t.Errorf("%d expense requests stored, want none", n)
+	}
+
+	if w := serve(ts.CreateExpenseRequest, "POST", "/expense_requests", nil, token, `{"amount": "lots"`); w.Code != http.StatusBadRequest {
+		t.Errorf("invalid JSON: status = %d, want %d", w.Code, http.StatusBadRequest)
+	}
+}
+
+func TestGetExpenseRequestNotFound(t *testing.T) {
+	ts := newTestServer(t, []string{"Sales"}, []string{"Travel"})
+	_, token := ts.addUser(t, "admin", "Sales", Admin)
+
+	if w := serve(ts.GetExpenseRequest, "GET", "/expense_requests/42", map[string]string{"id": "42"}, token, ""); w.Code != http.StatusNotFound {
+		t.Errorf("status = %d, want %d: %s", w.Code, http.StatusNotFound, w.Body)
+	}
+	if w := serve(ts.GetExpenseRequest, "GET", "/expense_requests/42", map[string]string{"id": "42"}, "", ""); w.Code != http.StatusUnauthorized {
+		t.Errorf("without a token: status = %d, want %d", w.Code, http.StatusUnauthorized)
+	}
+}
@@ -0,0 +1,330 @@
+package server
+
+import (
+	"context"
+	"database/sql"
+	"main/money"
+	"main/query"
+
+	"github.com/lib/pq"
+)
+
+// ExpenseFilter narrows ListExpenseRequests. Nil and empty fields do not
+// filter.
+type ExpenseFilter struct {
+	UserID      *int
+	UnitID      string
+	Amount      *money.Amount
+	Category    string
+	ExternalRef string
+	VendorID    *int
+	IsFinalized *bool
+
+	// OwnedBy limits the list to one user's requests, so filtering or
+	// sorting on a field hidden from the caller cannot reveal it. Zero does
+	// not filter.
+	OwnedBy int
+
+	// Scope keeps the list to the requests the caller may read, whatever
+	// the filters above ask for. Nil does not limit it.
+	Scope *ExpenseScope
+
+	ListOptions
+}
+
+// ExpenseScope is a user's own requests and those of some units.
+type ExpenseScope struct {
+	UserID int
+	Units  []string
+}
+
+// expenseRequestSortable are the fields expense requests can be sorted by.
+var expenseRequestSortable = map[string]string{
+	"id": "id", "createdAt": "created_at", "amount": "amount", "userID": "user_id",
+	"unitID": "unit_id", "category": "category", "docNumber": "doc_number", "reference": "reference",
+}
+
+// ExpenseStore reads and writes expense requests. Writes that take
+// versions only apply to a row whose version is among them; nil versions
+// match any.
+type ExpenseStore interface {
+	Get(ctx context.Context, id int) (ExpenseRequest, error)
+	GetByDocNumber(ctx context.Context, docNumber string) (ExpenseRequest, error)
+	GetByReference(ctx context.Context, reference string) (ExpenseRequest, error)
+	GetByExternalRef(ctx context.Context, ref string) (ExpenseRequest, error)
+	List(ctx context.Context, filter ExpenseFilter) ([]ExpenseRequest, error)
+	// Each calls fn with each request List would return as it is read,
+	// stopping at the first error
+	Each(ctx context.Context, filter ExpenseFilter, fn func(ExpenseRequest) error) error
+	// Count is how many requests the filter matches, ignoring its paging
+	Count(ctx context.Context, filter ExpenseFilter) (int, error)
+	Create(ctx context.Context, expense ExpenseRequest) (ExpenseRequest, error)
+	Update(ctx context.Context, expense ExpenseRequest, versions []int64) (ExpenseRequest, error)
+	Patch(ctx context.Context, id int, patch Patch, versions []int64) (ExpenseRequest, error)
+	Delete(ctx context.Context, id int) error
+}
+
+// viewedExpenseStore reads expense requests as a viewer may see them:
+// requests outside the viewer's scope are not found or listed, and the
+// fields hidden from the viewer are left empty. Writes go through as they
+// are.
+type viewedExpenseStore struct {
+	ExpenseStore
+	viewer viewer
+}
+
+// expensesAs returns the expense store as v reads it. Handlers serving
+// expense requests to a caller read them through it.
+func (s *Server) expensesAs(v viewer) ExpenseStore {
+	return viewedExpenseStore{ExpenseStore: s.Expenses, viewer: v}
+}
+
+// seen is a request read from the store as the viewer may see it.
+func (vs viewedExpenseStore) seen(expense ExpenseRequest, err error) (ExpenseRequest, error) {
+	if err != nil {
+		return expense, err
+	}
+	if !vs.viewer.mayRead(expense) {
+		return ExpenseRequest{}, errNotFound
+	}
+	vs.viewer.redactExpenseRequest(&expense)
+	return expense, nil
+}
+
+func (vs viewedExpenseStore) Get(ctx context.Context, id int) (ExpenseRequest, error) {
+	return vs.seen(vs.ExpenseStore.Get(ctx, id))
+}
+
+func (vs viewedExpenseStore) GetByDocNumber(ctx context.Context, docNumber string) (ExpenseRequest, error) {
+	return vs.seen(vs.ExpenseStore.GetByDocNumber(ctx, docNumber))
+}
+
+func (vs viewedExpenseStore) GetByReference(ctx context.Context, reference string) (ExpenseRequest, error) {
+	return vs.seen(vs.ExpenseStore.GetByReference(ctx, reference))
+}
+
+func (vs viewedExpenseStore) GetByExternalRef(ctx context.Context, ref string) (ExpenseRequest, error) {
+	return vs.seen(vs.ExpenseStore.GetByExternalRef(ctx, ref))
+}
+
+// scoped is filter kept to the viewer's scope.
+func (vs viewedExpenseStore) scoped(filter ExpenseFilter) ExpenseFilter {
+	filter.Scope = vs.viewer.expenseScope()
+	return filter
+}
+
+func (vs viewedExpenseStore) List(ctx context.Context, filter ExpenseFilter) ([]ExpenseRequest, error) {
+	expenses, err := vs.ExpenseStore.List(ctx, vs.scoped(filter))
+	for i := range expenses {
+		vs.viewer.redactExpenseRequest(&expenses[i])
+	}
+	return expenses, err
+}
+
+func (vs viewedExpenseStore) Each(ctx context.Context, filter ExpenseFilter, fn func(ExpenseRequest) error) error {
+	return vs.ExpenseStore.Each(ctx, vs.scoped(filter), func(expense ExpenseRequest) error {
+		vs.viewer.redactExpenseRequest(&expense)
+		return fn(expense)
+	})
+}
+
+func (vs viewedExpenseStore) Count(ctx context.Context, filter ExpenseFilter) (int, error) {
+	return vs.ExpenseStore.Count(ctx, vs.scoped(filter))
+}
+
+// PostgresExpenseStore keeps expense requests in the expense_request table.
+type PostgresExpenseStore struct {
+	DB dbtx
+}
+
+const expenseRequestVersionQuery = "SELECT version FROM expense_request WHERE id = $1"
+
+func (p PostgresExpenseStore) getBy(ctx context.Context, column string, value any) (ExpenseRequest, error) {
+	expense, err := scanExpenseRequest(p.DB.QueryRowContext(ctx,
+		"SELECT "+expenseRequestColumns+" FROM expense_request WHERE "+column+" = $1", value))
+	if err == sql.ErrNoRows {
+		return expense, errNotFound
+	}
+	return expense, err
+}
+
+func (p PostgresExpenseStore) Get(ctx context.Context, id int) (ExpenseRequest, error) {
+	return p.getBy(ctx, "id", id)
+}
+
+func (p PostgresExpenseStore) GetByDocNumber(ctx context.Context, docNumber string) (ExpenseRequest, error) {
+	return p.getBy(ctx, "doc_number", docNumber)
+}
+
+func (p PostgresExpenseStore) GetByReference(ctx context.Context, reference string) (ExpenseRequest, error) {
+	return p.getBy(ctx, "reference", reference)
+}
+
+func (p PostgresExpenseStore) GetByExternalRef(ctx context.Context, ref string) (ExpenseRequest, error) {
+	return p.getBy(ctx, "external_ref", ref)
+}
+
+// filtered selects columns from the expense requests filter matches.
+func (PostgresExpenseStore) filtered(columns string, filter ExpenseFilter) *query.Select {
+	q := query.From("expense_request", columns)
+	if filter.UserID != nil {
+		q.Where("user_id = ?", *filter.UserID)
+	}
+	q.WhereIf(filter.UnitID != "", "unit_id = ?", filter.UnitID)
+	if filter.Amount != nil {
+		q.Where("amount = ?", *filter.Amount)
+	}
+	q.WhereIf(filter.OwnedBy != 0, "user_id = ?", filter.OwnedBy).
+		WhereIf(filter.Category != "", "category = ?", filter.Category).
+		WhereIf(filter.ExternalRef != "", "external_ref = ?", filter.ExternalRef)
+	if filter.VendorID != nil {
+		q.Where("vendor_id = ?", *filter.VendorID)
+	}
+	if filter.IsFinalized != nil {
+		q.Where("is_finalized = ?", *filter.IsFinalized)
+	}
+	if filter.Scope != nil {
+		q.Where("(user_id = ? OR unit_id = ANY(?))", filter.Scope.UserID, pq.Array(filter.Scope.Units))
+	}
+	return q
+}
+
+func (p PostgresExpenseStore) List(ctx context.Context, filter ExpenseFilter) ([]ExpenseRequest, error) {
+	expenses := []ExpenseRequest{}
+	err := p.Each(ctx, filter, func(expense ExpenseRequest) error {
+		expenses = append(expenses, expense)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return expenses, nil
+}
+
+func (p PostgresExpenseStore) Each(ctx context.Context, filter ExpenseFilter, fn func(ExpenseRequest) error) error {
+	q := p.filtered(expenseRequestColumns, filter).
+		OrderBy(filter.Sort...).OrderBy("id").
+		Page(filter.Limit, filter.Offset)
+	statement, args := q.SQL()
+
+	rows, err := p.DB.QueryContext(ctx, statement, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		expense, err := scanExpenseRequest(rows)
+		if err != nil {
+			return err
+		}
+		if err := fn(expense); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+func (p PostgresExpenseStore) Count(ctx context.Context, filter ExpenseFilter) (int, error) {
+	statement, args := p.filtered("count(*)", filter).SQL()
+	var n int
+	err := p.DB.QueryRowContext(ctx, statement, args...).Scan(&n)
+	return n, err
+}
+
+func (p PostgresExpenseStore) Create(ctx context.Context, expense ExpenseRequest) (ExpenseRequest, error) {
+	query := `
+		INSERT INTO expense_request (user_id, unit_id, amount, category, is_finalized, currency, external_ref, vendor_id, vat_rate)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
+		RETURNING id, created_at, doc_number, reference, version, net_amount, vat_amount
+	`
+	err := p.DB.QueryRowContext(ctx, query,
+		expense.UserID,
+		expense.UnitID,
+		expense.Amount,
+		expense.Category,
+		expense.IsFinalized,
+		expense.Currency,
+		expense.ExternalRef,
+		expense.VendorID,
+		expense.VATRate,
+	).Scan(
+		&expense.ID,
+		&expense.CreatedAt,
+		&expense.DocNumber,
+		&expense.Reference,
+		&expense.Version,
+		&expense.NetAmount,
+		&expense.VATAmount,
+	)
+	return expense, err
+}
+
+func (p PostgresExpenseStore) Update(ctx context.Context, expense ExpenseRequest, versions []int64) (ExpenseRequest, error) {
+	query := `
+		UPDATE expense_request
+		SET user_id = $1, unit_id = $2, amount = $3, category = $4, is_finalized = $5, currency = $6, external_ref = $7,
+			vendor_id = $8, vat_rate = $9, version = version + 1
+		WHERE id = $10 AND ` + versionMatches("$11") + `
+		RETURNING created_at, doc_number, reference, version, net_amount, vat_amount
+	`
+	err := p.DB.QueryRowContext(ctx, query,
+		expense.UserID,
+		expense.UnitID,
+		expense.Amount,
+		expense.Category,
+		expense.IsFinalized,
+		expense.Currency,
+		expense.ExternalRef,
+		expense.VendorID,
+		expense.VATRate,
+		expense.ID,
+		pq.Array(versions),
+	).Scan(&expense.CreatedAt, &expense.DocNumber, &expense.Reference, &expense.Version, &expense.NetAmount, &expense.VATAmount)
+	if err == sql.ErrNoRows {
+		return expense, versionMismatch(ctx, p.DB, expenseRequestVersionQuery, expense.ID)
+	}
+	return expense, err
+}
+
+func (p PostgresExpenseStore) Patch(ctx context.Context, id int, patch Patch, versions []int64) (ExpenseRequest, error) {
+	args := patch.Args
+	query := "UPDATE expense_request SET " + patch.Set + ", version = version + 1 WHERE id = " + args.Add(id) +
+		" AND " + versionMatches(args.Add(pq.Array(versions))) + " RETURNING " + expenseRequestColumns
+
+	expense, err := scanExpenseRequest(p.DB.QueryRowContext(ctx, query, args...))
+	if err == sql.ErrNoRows {
+		return expense, versionMismatch(ctx, p.DB, expenseRequestVersionQuery, id)
+	}
+	return expense, err
+}
+
+// Delete removes a request that has no history yet. One with activities or
+// payments, drafts included, is kept for the record and only withdrawn.
+func (p PostgresExpenseStore) Delete(ctx context.Context, id int) error {
+	result, err := p.DB.ExecContext(ctx, `DELETE FROM expense_request WHERE id = $1
+		AND NOT EXISTS (SELECT 1 FROM expense_activity WHERE expense_id = $1)
+		AND NOT EXISTS (SELECT 1 FROM paid_expense WHERE expense_id = $1)`, id)
+	if err != nil {
+		return err
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n > 0 {
+		return nil
+	}
+	var exists bool
+	if err := p.DB.QueryRowContext(ctx, "SELECT EXISTS (SELECT 1 FROM expense_request WHERE id = $1)", id).Scan(&exists); err != nil {
+		return err
+	}
+	if exists {
+		return errHasHistory
+	}
+	return errNotFound
+}
+
+// errHasHistory refuses deleting an expense request that has activities or
+// payments.
+var errHasHistory = conflictError("The expense request has activities or payments and is kept; withdraw it with POST /expense_requests/{id}/withdraw instead")
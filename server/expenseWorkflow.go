@@ -0,0 +1,505 @@
+package server
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log"
+	"main/money"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"github.com/lib/pq"
+)
+
+// expenseTransitions is the expense request state machine: the states an
+// activity may move a request into from its latest state. The empty state is
+// a request that has no activity yet. Rejected, Paid and Withdrawn are
+// final. A Draft only moves on by being submitted or withdrawn, and
+// requests are only withdrawn by their requester; see SubmitExpenseRequest
+// and WithdrawExpenseRequest.
+var expenseTransitions = map[ExpenseState][]ExpenseState{
+	"":              {Pending, Approved, Rejected, CategoryChanged, Withdrawn},
+	Draft:           {Pending, Withdrawn},
+	Pending:         {Approved, Rejected, CategoryChanged, Withdrawn},
+	CategoryChanged: {Pending, Approved, Rejected, Withdrawn},
+	Approved:        {PartiallyPaid, Paid},
+	PartiallyPaid:   {PartiallyPaid, Paid},
+}
+
+// expenseStateRoles lists the roles that may move a request into a state.
+var expenseStateRoles = map[ExpenseState][]UserRole{
+	Pending:         {Manager, Admin},
+	Approved:        {Manager, Admin},
+	Rejected:        {Manager, Admin},
+	CategoryChanged: {Manager, Admin},
+	PartiallyPaid:   {Accounter, Admin},
+	Paid:            {Accounter, Admin},
+}
+
+// canTransition reports whether a request whose latest state is from (nil
+// for none) may move to to.
+func canTransition(from *ExpenseState, to ExpenseState) bool {
+	var current ExpenseState
+	if from != nil {
+		current = *from
+	}
+	return slices.Contains(expenseTransitions[current], to)
+}
+
+// isDraft reports whether a request whose latest state is state (nil for
+// none) is a draft, which its requester may still edit.
+func isDraft(state *ExpenseState) bool {
+	return state != nil && *state == Draft
+}
+
+// statesBefore lists the states a request may move to to from, "" for a
+// request without activity.
+func statesBefore(to ExpenseState) []ExpenseState {
+	var from []ExpenseState
+	for st, next := range expenseTransitions {
+		if slices.Contains(next, to) {
+			from = append(from, st)
+		}
+	}
+	return from
+}
+
+func roleMayEnter(role UserRole, state ExpenseState) bool {
+	return slices.Contains(expenseStateRoles[state], role)
+}
+
+// Link is a hypermedia control: an action the caller may take next.
+type Link struct {
+	Href   string       `json:"href"`
+	Method string       `json:"method"`
+	State  ExpenseState `json:"state,omitempty"` // state to send in the activity body
+}
+
+// expenseLinks computes the _links of a request from its workflow status and
+// approval chain, and what the caller, with the units delegated to them, is
+// allowed to do. An anonymous caller only gets self.
+func expenseLinks(req ExpenseRequest, state *ExpenseState, paid money.Amount, chain *ApprovalChain, caller *User, delegated []string) map[string]Link {
+	self := APIPrefix + "/expense_requests/" + strconv.Itoa(req.ID)
+	links := map[string]Link{"self": {Href: self, Method: http.MethodGet}}
+	if caller == nil {
+		return links
+	}
+
+	pendingApprover := chain != nil && chain.nextStep(caller, delegated) >= 0
+	if canTransition(state, Approved) && pendingApprover {
+		links["approve"] = Link{Href: APIPrefix + "/expense_activities", Method: http.MethodPost, State: Approved}
+	}
+	if canTransition(state, Rejected) && (pendingApprover || mayEnter(*caller, req.UnitID, Rejected, delegated)) {
+		links["reject"] = Link{Href: APIPrefix + "/expense_activities", Method: http.MethodPost, State: Rejected}
+	}
+
+	if nextExpectedAction(state, req.Amount, paid) == AwaitingPayment && mayEnter(*caller, req.UnitID, Paid, delegated) {
+		links["pay"] = Link{Href: APIPrefix + "/paid_expenses", Method: http.MethodPost}
+	}
+
+	// Requests can be withdrawn by their owner until they are decided
+	owner := caller.ID == req.UserID || caller.RoleID == Admin
+	if canTransition(state, Withdrawn) && paid == 0 && owner {
+		links["cancel"] = Link{Href: self + "/withdraw", Method: http.MethodPost}
+	}
+	if isDraft(state) && owner {
+		links["edit"] = Link{Href: self, Method: http.MethodPatch}
+		links["submit"] = Link{Href: self + "/submit", Method: http.MethodPost}
+	}
+	return links
+}
+
+type expenseStatus struct {
+	state *ExpenseState
+	paid  money.Amount
+}
+
+// expenseStatuses loads the latest state and amount paid of each request.
+func (s *Server) expenseStatuses(ctx context.Context, ids []int) (map[int]expenseStatus, error) {
+	statuses := map[int]expenseStatus{}
+	if len(ids) == 0 {
+		return statuses, nil
+	}
+
+	rows, err := s.DB.QueryContext(ctx, `
+		SELECT er.id, la.current_state, COALESCE(pe.total, 0)
+		FROM expense_request er
+		LEFT JOIN LATERAL (
+			SELECT current_state
+			FROM expense_activity ea
+			WHERE ea.expense_id = er.id
+			ORDER BY ea.created_at DESC, ea.id DESC
+			LIMIT 1
+		) la ON true
+		LEFT JOIN LATERAL (
+			SELECT SUM(amount) AS total
+			FROM paid_expense
+			WHERE expense_id = er.id
+		) pe ON true
+		WHERE er.id = ANY($1)
+	`, pq.Array(ids))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var id int
+		var status expenseStatus
+		if err := rows.Scan(&id, &status.state, &status.paid); err != nil {
+			return nil, err
+		}
+		statuses[id] = status
+	}
+	return statuses, rows.Err()
+}
+
+// addExpenseLinks fills in _links and payment progress for requests about
+// to be returned. The caller is optional; a failed lookup only costs the
+// links, not the response.
+func (s *Server) addExpenseLinks(r *http.Request, requests ...*ExpenseRequest) {
+	var caller *User
+	var delegated []string
+	if user, err := s.authenticate(r); err == nil {
+		caller = &user
+		if delegated, err = delegatedUnits(r.Context(), s.DB, user.ID); err != nil {
+			log.Println("Delegation lookup error:", err)
+		}
+	} else if !errors.Is(err, errUnauthorized) {
+		log.Println("Caller lookup error:", err)
+	}
+
+	ids := make([]int, len(requests))
+	for i, req := range requests {
+		ids[i] = req.ID
+	}
+	statuses, err := s.expenseStatuses(r.Context(), ids)
+	if err != nil {
+		log.Println("Expense status query error:", err)
+		return
+	}
+	chains, err := s.approvalChains(r.Context(), s.DB, ids)
+	if err != nil {
+		log.Println("Approval chain query error:", err)
+		return
+	}
+
+	for _, req := range requests {
+		status := statuses[req.ID]
+		if !slices.Contains(req.Hidden, "amount") {
+			remaining := max(req.Amount-status.paid, 0)
+			req.AmountPaid, req.AmountRemaining = &status.paid, &remaining
+		}
+		req.Draft = isDraft(status.state)
+		req.Links = expenseLinks(*req, status.state, status.paid, chains[req.ID], caller, delegated)
+	}
+}
+
+// startDraft records the Draft state of a request just created as one.
+func (s *Server) startDraft(ctx context.Context, e ExpenseRequest) error {
+	_, err := s.DB.ExecContext(ctx,
+		"INSERT INTO expense_activity (expense_id, current_state, feedback, created_by) VALUES ($1, $2, '', $3)",
+		e.ID, Draft, e.UserID)
+	return err
+}
+
+// checkDraft returns a conflictError unless the request is a draft, as
+// requests are locked once submitted. An unknown request is left to the
+// store to report.
+func (s *Server) checkDraft(ctx context.Context, id int) error {
+	statuses, err := s.expenseStatuses(ctx, []int{id})
+	if err != nil {
+		return err
+	}
+	if status, ok := statuses[id]; ok && !isDraft(status.state) {
+		return conflictError("The expense request was submitted and can no longer be edited")
+	}
+	return nil
+}
+
+// lockDraft locks the request id until tx ends and returns a conflictError
+// unless it is a draft. recordAction takes the same lock first, so a request
+// is not submitted while something holding it is changing it.
+func lockDraft(ctx context.Context, tx *sql.Tx, id int) error {
+	var state *ExpenseState
+	err := tx.QueryRowContext(ctx, `
+		SELECT (SELECT current_state FROM expense_activity WHERE expense_id = er.id ORDER BY created_at DESC, id DESC LIMIT 1)
+		FROM expense_request er
+		WHERE er.id = $1
+		FOR UPDATE OF er
+	`, id).Scan(&state)
+	if err == sql.ErrNoRows {
+		return errNotFound
+	} else if err != nil {
+		return err
+	}
+	if !isDraft(state) {
+		return conflictError("The expense request was submitted and can no longer be edited")
+	}
+	return nil
+}
+
+// requireDraft answers 409 unless the request is a draft.
+func (s *Server) requireDraft(w http.ResponseWriter, r *http.Request, id int) bool {
+	if err := s.checkDraft(r.Context(), id); err != nil {
+		writeStoreError(w, err, "Expense request not found")
+		return false
+	}
+	return true
+}
+
+// submittable checks a request about to go to its approvers against frozen
+// budgets, those of its lines' categories too, and the requester's spending
+// limits. Only limits without an escalation approver refuse it; the others
+// add to its approval chain.
+func (s *Server) submittable(ctx context.Context, e ExpenseRequest) error {
+	if err := checkFrozen(ctx, s.DB, e.UnitID, e.Category); err != nil {
+		return err
+	}
+	categories, err := lineCategories(ctx, s.DB, e.ID)
+	if err != nil {
+		return err
+	}
+	for _, category := range categories {
+		if err := checkFrozen(ctx, s.DB, e.UnitID, category); err != nil {
+			return err
+		}
+	}
+	errs := FieldErrors{}
+	if err := s.checkUserLimits(ctx, errs, e); err != nil {
+		return err
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// checkSubmittable answers 409 or 422 unless the request is submittable.
+func (s *Server) checkSubmittable(w http.ResponseWriter, r *http.Request, e ExpenseRequest) bool {
+	if err := s.submittable(r.Context(), e); err != nil {
+		writeStoreError(w, err, "Expense request not found")
+		return false
+	}
+	return true
+}
+
+// createExpenseRequest validates and creates a request, as a draft when it
+// asks to be one; any other goes through the checks of submitting it.
+func (s *Server) createExpenseRequest(ctx context.Context, e ExpenseRequest) (ExpenseRequest, error) {
+	if err := s.checkValid(ctx, e); err != nil {
+		return e, err
+	}
+	if !e.Draft {
+		if err := s.submittable(ctx, e); err != nil {
+			return e, err
+		}
+	}
+
+	e, err := s.Expenses.Create(ctx, e)
+	if err != nil {
+		return e, err
+	}
+	if e.Draft {
+		if err := s.startDraft(ctx, e); err != nil {
+			if err := s.Expenses.Delete(ctx, e.ID); err != nil {
+				log.Println("Delete error:", err)
+			}
+			return e, err
+		}
+	}
+	s.emitWebhook(ctx, WebhookExpenseCreated, e)
+	return e, nil
+}
+
+// errStateChanged reports that a request left the states an action takes
+// it from, or was paid, before the action could be recorded.
+var errStateChanged = errors.New("expense request state changed")
+
+// recordAction records the activity of an action with an endpoint of its
+// own, such as submitting, and bumps the request's version, as copies read
+// before it are stale. The activity is only inserted while the request's
+// latest state is among from ("" for none), and with unpaid while nothing
+// is paid on it, so the action is taken once however many take it at the
+// same time.
+func (s *Server) recordAction(ctx context.Context, a *ExpenseActivity, from []ExpenseState, unpaid bool) (int, error) {
+	tx, err := s.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	// Holding the request first keeps its lines from changing meanwhile;
+	// see lockDraft
+	if _, err := tx.ExecContext(ctx, "SELECT 1 FROM expense_request WHERE id = $1 FOR UPDATE", a.ExpenseID); err != nil {
+		return 0, err
+	}
+	err = tx.QueryRowContext(ctx, `
+		INSERT INTO expense_activity (expense_id, current_state, feedback, created_by)
+		SELECT $1, $2, $3, $4
+		WHERE COALESCE((
+			SELECT current_state FROM expense_activity
+			WHERE expense_id = $1
+			ORDER BY created_at DESC, id DESC
+			LIMIT 1
+		), '') = ANY($5)
+		AND NOT ($6 AND EXISTS (SELECT 1 FROM paid_expense WHERE expense_id = $1))
+		RETURNING id, created_at
+	`, a.ExpenseID, a.CurrentState, a.Feedback, a.CreatedBy, pq.Array(stateSpellings(from...)), unpaid,
+	).Scan(&a.ID, &a.CreatedAt)
+	if err == sql.ErrNoRows {
+		return 0, errStateChanged
+	} else if err != nil {
+		return 0, err
+	}
+
+	var version int
+	err = tx.QueryRowContext(ctx,
+		"UPDATE expense_request SET version = version + 1 WHERE id = $1 RETURNING version", a.ExpenseID).Scan(&version)
+	if err != nil {
+		return 0, err
+	}
+	return version, tx.Commit()
+}
+
+// SubmitExpenseRequest sends a draft to its approvers by moving it to
+// Pending. From then on it can no longer be edited.
+func (s *Server) SubmitExpenseRequest(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid ID", http.StatusBadRequest)
+		return
+	}
+	caller, ok := s.requireCaller(w, r)
+	if !ok {
+		return
+	}
+
+	expense, err := s.Expenses.Get(r.Context(), id)
+	if err != nil {
+		writeStoreError(w, err, "Expense request not found")
+		return
+	}
+	if caller.ID != expense.UserID && caller.RoleID != Admin {
+		http.Error(w, "Only the requester may submit the expense request", http.StatusForbidden)
+		return
+	}
+	statuses, err := s.expenseStatuses(r.Context(), []int{id})
+	if err != nil {
+		log.Println("Expense status query error:", err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	if !isDraft(statuses[id].state) {
+		http.Error(w, "The expense request has already been submitted", http.StatusConflict)
+		return
+	}
+	if !s.checkSubmittable(w, r, expense) {
+		return
+	}
+
+	activity := ExpenseActivity{ExpenseID: id, CurrentState: Pending, Feedback: "Submitted", CreatedBy: caller.ID}
+	expense.Version, err = s.recordAction(r.Context(), &activity, []ExpenseState{Draft}, false)
+	if err == errStateChanged {
+		http.Error(w, "The expense request has already been submitted", http.StatusConflict)
+		return
+	} else if err != nil {
+		log.Println("Submit error:", err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	s.publishStateChange(r.Context(), activity)
+	s.addExpenseLinks(r, &expense)
+	envelopeOf(r).expenseRequest(expense.ID)
+
+	setVersionETag(w, expense.Version)
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	if err := json.NewEncoder(w).Encode(expense); err != nil {
+		log.Println("JSON encode error:", err)
+	}
+}
+
+type withdrawRequest struct {
+	Reason string `json:"reason"`
+}
+
+// WithdrawExpenseRequest lets the requester take back a request that is
+// not decided yet, recording why as a Withdrawn activity. Unlike deleting
+// it, the request and its history are kept. A request with any payment
+// cannot be withdrawn.
+func (s *Server) WithdrawExpenseRequest(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid ID", http.StatusBadRequest)
+		return
+	}
+	caller, ok := s.requireCaller(w, r)
+	if !ok {
+		return
+	}
+
+	var req withdrawRequest
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&req); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+	req.Reason = strings.TrimSpace(req.Reason)
+	if req.Reason == "" {
+		writeValidationErrors(w, FieldErrors{"reason": "is required"})
+		return
+	}
+
+	expense, err := s.Expenses.Get(r.Context(), id)
+	if err != nil {
+		writeStoreError(w, err, "Expense request not found")
+		return
+	}
+	if caller.ID != expense.UserID && caller.RoleID != Admin {
+		http.Error(w, "Only the requester may withdraw the expense request", http.StatusForbidden)
+		return
+	}
+	statuses, err := s.expenseStatuses(r.Context(), []int{id})
+	if err != nil {
+		log.Println("Expense status query error:", err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	status := statuses[id]
+	if status.paid > 0 {
+		http.Error(w, "The expense request has payments and cannot be withdrawn", http.StatusConflict)
+		return
+	}
+	if !canTransition(status.state, Withdrawn) {
+		http.Error(w, "Only requests not decided yet can be withdrawn", http.StatusConflict)
+		return
+	}
+
+	activity := ExpenseActivity{ExpenseID: id, CurrentState: Withdrawn, Feedback: req.Reason, CreatedBy: caller.ID}
+	expense.Version, err = s.recordAction(r.Context(), &activity, statesBefore(Withdrawn), true)
+	if err == errStateChanged {
+		http.Error(w, "The expense request was decided or paid meanwhile and cannot be withdrawn", http.StatusConflict)
+		return
+	} else if err != nil {
+		log.Println("Withdraw error:", err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	s.publishStateChange(r.Context(), activity)
+	s.addExpenseLinks(r, &expense)
+	envelopeOf(r).expenseRequest(expense.ID)
+
+	setVersionETag(w, expense.Version)
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	if err := json.NewEncoder(w).Encode(expense); err != nil {
+		log.Println("JSON encode error:", err)
+	}
+}
@@ -0,0 +1,156 @@
+package server
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"main/directory"
+	"main/query"
+	"strings"
+)
+
+// GroupRule maps members of a group to a role or unit. Directory groups are
+// named by their CN or DN.
+type GroupRule struct {
+	Group string
+	Value string
+}
+
+// ProvisioningRules decide the role and unit of users who log in through
+// the directory or an identity provider. They are applied at every login,
+// so group changes take effect at the next one.
+type ProvisioningRules struct {
+	Roles       []GroupRule // the first rule matching one of the user's groups wins
+	DefaultRole UserRole    // empty refuses users no role rule matches
+
+	Units []GroupRule
+	// UnitAttribute names the directory attribute or token claim holding
+	// the unit, such as department, used when no unit rule matches and the
+	// unit exists
+	UnitAttribute string
+	DefaultUnit   string
+}
+
+// matchGroup returns the value of the first rule naming one of groups.
+func matchGroup(rules []GroupRule, groups []string) string {
+	for _, rule := range rules {
+		for _, group := range groups {
+			if strings.EqualFold(rule.Group, group) || strings.EqualFold(rule.Group, directory.GroupCN(group)) {
+				return rule.Value
+			}
+		}
+	}
+	return ""
+}
+
+// roleAndUnit applies the rules to a user's groups and unit attribute. It
+// returns errUnauthorized, after logging why, when no role or no existing
+// unit results.
+func (s *Server) roleAndUnit(ctx context.Context, rules ProvisioningRules, who string, groups []string, unitAttribute string) (UserRole, string, error) {
+	role := UserRole(matchGroup(rules.Roles, groups))
+	if role == "" {
+		role = rules.DefaultRole
+	}
+	if role == "" {
+		log.Printf("%s matches no role rule, refusing the login", who)
+		return "", "", errUnauthorized
+	}
+
+	for _, unit := range []string{matchGroup(rules.Units, groups), unitAttribute, rules.DefaultUnit} {
+		if unit == "" {
+			continue
+		}
+		ok, err := s.exists(ctx, "SELECT 1 FROM unit WHERE name = $1", unit)
+		if err != nil {
+			return "", "", err
+		}
+		if ok {
+			return role, unit, nil
+		}
+	}
+	log.Printf("%s maps to no existing unit, refusing the login", who)
+	return "", "", errUnauthorized
+}
+
+// externalUser is a user vouched for by the directory or an identity
+// provider, and linked to a local user by an ID kept in column.
+type externalUser struct {
+	column string // directory_dn or oidc_subject
+	id     string
+	name   string
+	email  string
+	role   UserRole
+	unit   string
+	// linkByName takes over an unlinked local user of the same name, whose
+	// local password then stops working; otherwise such a user refuses
+	// the login
+	linkByName bool
+}
+
+// provisionUser creates or updates the local user of an external one.
+func (s *Server) provisionUser(ctx context.Context, ext externalUser) (User, error) {
+	tx, err := s.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return User{}, err
+	}
+	defer tx.Rollback()
+
+	// The linked user, or else an unlinked local one of the same name
+	var user User
+	var linked bool
+	err = tx.QueryRowContext(ctx, "SELECT "+userColumns+", "+ext.column+" = $1 FROM users "+
+		"WHERE "+ext.column+" = $1 OR (name = $2 AND directory_dn = '' AND oidc_subject = '') "+
+		"ORDER BY "+ext.column+" = $1 DESC, id LIMIT 1 FOR UPDATE",
+		ext.id, ext.name).Scan(append(query.Targets(userFields(&user)), &linked)...)
+	if err != nil && err != sql.ErrNoRows {
+		return user, err
+	}
+	found := err == nil
+	if found && !linked && !ext.linkByName {
+		log.Printf("%s %s logs in as %q, which a local user has; refusing the login", ext.column, ext.id, ext.name)
+		return User{}, errUnauthorized
+	}
+
+	// Another user may hold the address already; the login does not get
+	// to take it over
+	email := ext.email
+	var taken bool
+	if err := tx.QueryRowContext(ctx,
+		"SELECT EXISTS (SELECT 1 FROM users WHERE LOWER(email) = LOWER($1) AND id <> $2)",
+		email, user.ID).Scan(&taken); err != nil {
+		return User{}, err
+	}
+	if taken {
+		email = ""
+	}
+
+	switch {
+	case !found:
+		user = User{Name: ext.name, UnitID: ext.unit, RoleID: ext.role, Email: email}
+		err = tx.QueryRowContext(ctx, `
+			INSERT INTO users (name, unit_id, role_id, password, email, `+ext.column+`)
+			VALUES ($1, $2, $3, '', $4, $5)
+			RETURNING id, version
+		`, user.Name, user.UnitID, user.RoleID, user.Email, ext.id).Scan(&user.ID, &user.Version)
+		if err != nil {
+			return user, err
+		}
+		if err := audit(ctx, tx, user.ID, "users.provision", map[string]string{ext.column: ext.id}); err != nil {
+			return user, err
+		}
+	case !linked || user.Name != ext.name || user.UnitID != ext.unit || user.RoleID != ext.role || user.Email != email:
+		err = tx.QueryRowContext(ctx, `
+			UPDATE users SET name = $2, unit_id = $3, role_id = $4, email = $5, password = '', `+ext.column+` = $6,
+				version = version + 1
+			WHERE id = $1
+			RETURNING version
+		`, user.ID, ext.name, ext.unit, ext.role, email, ext.id).Scan(&user.Version)
+		if err != nil {
+			return user, fmt.Errorf("updating user %d from %s: %w", user.ID, ext.column, err)
+		}
+		user.Name, user.UnitID, user.RoleID, user.Email, user.Password = ext.name, ext.unit, ext.role, email, ""
+	}
+
+	return user, tx.Commit()
+}
@@ -0,0 +1,149 @@
+package server
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"io"
+	"strings"
+	"sync"
+)
+
+// fakeDB is a database/sql driver for handler tests. It answers the queries
+// handlers make next to the stores, such as validation lookups and
+// authentication, with the functions a test sets. EXISTS checks nobody
+// answered find nothing, other queries return no rows and statements
+// change nothing.
+type fakeDB struct {
+	mu      sync.Mutex
+	answers []fakeAnswer
+}
+
+// fakeAnswer answers the queries containing match with the rows of rows,
+// only the EXISTS checks with exists.
+type fakeAnswer struct {
+	match  string
+	exists bool
+	rows   func(args []driver.Value) [][]driver.Value
+}
+
+// open returns a *sql.DB running on db.
+func (db *fakeDB) open() *sql.DB {
+	return sql.OpenDB(db)
+}
+
+// answer answers the queries containing match. The first answer set wins.
+func (db *fakeDB) answer(match string, rows func(args []driver.Value) [][]driver.Value) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	db.answers = append(db.answers, fakeAnswer{match: match, rows: rows})
+}
+
+// exists answers the EXISTS checks of the queries containing match with
+// found.
+func (db *fakeDB) exists(match string, found func(args []driver.Value) bool) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	db.answers = append(db.answers, fakeAnswer{match: match, exists: true, rows: func(args []driver.Value) [][]driver.Value {
+		return [][]driver.Value{{found(args)}}
+	}})
+}
+
+// existsIn answers the EXISTS checks of the queries containing match with
+// whether their first argument is one of values.
+func (db *fakeDB) existsIn(match string, values ...string) {
+	db.exists(match, func(args []driver.Value) bool {
+		for _, v := range values {
+			if args[0] == v {
+				return true
+			}
+		}
+		return false
+	})
+}
+
+func (db *fakeDB) rows(query string, args []driver.NamedValue) [][]driver.Value {
+	values := make([]driver.Value, len(args))
+	for i, arg := range args {
+		values[i] = arg.Value
+	}
+	db.mu.Lock()
+	answers := db.answers
+	db.mu.Unlock()
+	exists := strings.HasPrefix(query, "SELECT EXISTS(")
+	for _, a := range answers {
+		if a.exists == exists && strings.Contains(query, a.match) {
+			return a.rows(values)
+		}
+	}
+	if exists {
+		return [][]driver.Value{{false}}
+	}
+	return nil
+}
+
+func (db *fakeDB) Connect(context.Context) (driver.Conn, error) { return fakeConn{db}, nil }
+func (db *fakeDB) Driver() driver.Driver                        { return fakeDriver{db} }
+
+type fakeDriver struct{ db *fakeDB }
+
+func (d fakeDriver) Open(string) (driver.Conn, error) { return fakeConn{d.db}, nil }
+
+type fakeConn struct{ db *fakeDB }
+
+func (c fakeConn) Prepare(query string) (driver.Stmt, error) { return fakeStmt{c.db, query}, nil }
+func (c fakeConn) Close() error                              { return nil }
+func (c fakeConn) Begin() (driver.Tx, error)                 { return fakeTx{}, nil }
+
+func (c fakeConn) QueryContext(_ context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	return &fakeRows{rows: c.db.rows(query, args)}, nil
+}
+
+func (c fakeConn) ExecContext(context.Context, string, []driver.NamedValue) (driver.Result, error) {
+	return driver.RowsAffected(0), nil
+}
+
+type fakeStmt struct {
+	db    *fakeDB
+	query string
+}
+
+func (s fakeStmt) Close() error  { return nil }
+func (s fakeStmt) NumInput() int { return -1 }
+
+func (s fakeStmt) Exec([]driver.Value) (driver.Result, error) { return driver.RowsAffected(0), nil }
+
+func (s fakeStmt) Query(args []driver.Value) (driver.Rows, error) {
+	named := make([]driver.NamedValue, len(args))
+	for i, v := range args {
+		named[i] = driver.NamedValue{Ordinal: i + 1, Value: v}
+	}
+	return &fakeRows{rows: s.db.rows(s.query, named)}, nil
+}
+
+type fakeTx struct{}
+
+func (fakeTx) Commit() error   { return nil }
+func (fakeTx) Rollback() error { return nil }
+
+type fakeRows struct {
+	rows [][]driver.Value
+}
+
+func (r *fakeRows) Columns() []string {
+	if len(r.rows) == 0 {
+		return nil
+	}
+	return make([]string, len(r.rows[0]))
+}
+
+func (r *fakeRows) Close() error { return nil }
+
+func (r *fakeRows) Next(dest []driver.Value) error {
+	if len(r.rows) == 0 {
+		return io.EOF
+	}
+	copy(dest, r.rows[0])
+	r.rows = r.rows[1:]
+	return nil
+}
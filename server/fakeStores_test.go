@@ -0,0 +1,413 @@
+package server
+
+import (
+	"cmp"
+	"context"
+	"database/sql/driver"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// The fake stores keep users, budgets and expense requests in memory, so
+// handlers can be tested without Postgres; see store.go. Patches are SQL
+// and not applied by them.
+
+var errFakePatch = errors.New("patches are not supported by the fake stores")
+
+// versionIn reports whether version is among versions; nil matches any.
+func versionIn(version int, versions []int64) bool {
+	return versions == nil || slices.Contains(versions, int64(version))
+}
+
+// page returns the part of items opts selects.
+func page[T any](items []T, opts ListOptions) []T {
+	items = items[min(opts.Offset, len(items)):]
+	if opts.Limit > 0 {
+		items = items[:min(opts.Limit, len(items))]
+	}
+	return items
+}
+
+type fakeUserStore struct {
+	mu     sync.Mutex
+	users  map[int]User
+	nextID int
+}
+
+func newFakeUserStore() *fakeUserStore {
+	return &fakeUserStore{users: map[int]User{}, nextID: 1}
+}
+
+func (f *fakeUserStore) Get(_ context.Context, id int) (User, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	user, ok := f.users[id]
+	if !ok {
+		return user, errNotFound
+	}
+	return user, nil
+}
+
+func (f *fakeUserStore) matching(filter UserFilter) []User {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var users []User
+	for _, u := range f.users {
+		if (filter.UnitID == "" || u.UnitID == filter.UnitID) &&
+			(filter.RoleID == "" || string(u.RoleID) == filter.RoleID) &&
+			(filter.Name == "" || strings.Contains(strings.ToLower(u.Name), strings.ToLower(filter.Name))) {
+			users = append(users, u)
+		}
+	}
+	slices.SortFunc(users, func(a, b User) int { return a.ID - b.ID })
+	return users
+}
+
+func (f *fakeUserStore) List(_ context.Context, filter UserFilter) ([]User, error) {
+	return page(f.matching(filter), filter.ListOptions), nil
+}
+
+func (f *fakeUserStore) Count(_ context.Context, filter UserFilter) (int, error) {
+	return len(f.matching(filter)), nil
+}
+
+func (f *fakeUserStore) Create(_ context.Context, user User) (User, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	user.ID, user.Version, user.Password = f.nextID, 1, ""
+	f.nextID++
+	f.users[user.ID] = user
+	return user, nil
+}
+
+func (f *fakeUserStore) Update(_ context.Context, user User, versions []int64) (User, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	current, ok := f.users[user.ID]
+	if !ok {
+		return user, errNotFound
+	}
+	if !versionIn(current.Version, versions) {
+		return user, &versionMismatchError{Version: current.Version}
+	}
+	user.Version, user.Password = current.Version+1, ""
+	f.users[user.ID] = user
+	return user, nil
+}
+
+func (f *fakeUserStore) Patch(ctx context.Context, id int, _ Patch, _ []int64) (User, error) {
+	if _, err := f.Get(ctx, id); err != nil {
+		return User{}, err
+	}
+	return User{}, errFakePatch
+}
+
+func (f *fakeUserStore) Delete(_ context.Context, id int) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if _, ok := f.users[id]; !ok {
+		return errNotFound
+	}
+	delete(f.users, id)
+	return nil
+}
+
+type fakeBudgetStore struct {
+	mu      sync.Mutex
+	budgets map[BudgetKey]Budget
+}
+
+func newFakeBudgetStore() *fakeBudgetStore {
+	return &fakeBudgetStore{budgets: map[BudgetKey]Budget{}}
+}
+
+func keyOf(b Budget) BudgetKey {
+	return BudgetKey{b.UnitID, b.Category, b.Year}
+}
+
+func (f *fakeBudgetStore) Get(_ context.Context, key BudgetKey) (Budget, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	budget, ok := f.budgets[key]
+	if !ok {
+		return budget, errNotFound
+	}
+	return budget, nil
+}
+
+func (f *fakeBudgetStore) matching(filter BudgetFilter) []Budget {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var budgets []Budget
+	for _, b := range f.budgets {
+		if (filter.UnitID == "" || b.UnitID == filter.UnitID) &&
+			(filter.Category == "" || b.Category == filter.Category) &&
+			(filter.Year == 0 || b.Year == filter.Year) {
+			budgets = append(budgets, b)
+		}
+	}
+	slices.SortFunc(budgets, func(a, b Budget) int {
+		return cmp.Or(strings.Compare(a.UnitID, b.UnitID), strings.Compare(a.Category, b.Category), a.Year-b.Year)
+	})
+	return budgets
+}
+
+func (f *fakeBudgetStore) List(_ context.Context, filter BudgetFilter) ([]Budget, error) {
+	return page(f.matching(filter), filter.ListOptions), nil
+}
+
+func (f *fakeBudgetStore) Count(_ context.Context, filter BudgetFilter) (int, error) {
+	return len(f.matching(filter)), nil
+}
+
+func (f *fakeBudgetStore) Create(_ context.Context, budget Budget) (Budget, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if _, ok := f.budgets[keyOf(budget)]; ok {
+		return budget, conflictError("The budget already exists")
+	}
+	budget.Version = 1
+	f.budgets[keyOf(budget)] = budget
+	return budget, nil
+}
+
+func (f *fakeBudgetStore) Update(_ context.Context, key BudgetKey, budget Budget, versions []int64) (Budget, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	current, ok := f.budgets[key]
+	if !ok {
+		return budget, errNotFound
+	}
+	if !versionIn(current.Version, versions) {
+		return budget, &versionMismatchError{Version: current.Version}
+	}
+	budget.Period, budget.Version = current.Period, current.Version+1
+	delete(f.budgets, key)
+	f.budgets[keyOf(budget)] = budget
+	return budget, nil
+}
+
+func (f *fakeBudgetStore) Patch(ctx context.Context, key BudgetKey, _ Patch, _ []int64) (Budget, error) {
+	if _, err := f.Get(ctx, key); err != nil {
+		return Budget{}, err
+	}
+	return Budget{}, errFakePatch
+}
+
+func (f *fakeBudgetStore) Delete(_ context.Context, key BudgetKey) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if _, ok := f.budgets[key]; !ok {
+		return errNotFound
+	}
+	delete(f.budgets, key)
+	return nil
+}
+
+type fakeExpenseStore struct {
+	mu       sync.Mutex
+	expenses map[int]ExpenseRequest
+	nextID   int
+}
+
+func newFakeExpenseStore() *fakeExpenseStore {
+	return &fakeExpenseStore{expenses: map[int]ExpenseRequest{}, nextID: 1}
+}
+
+func (f *fakeExpenseStore) Get(_ context.Context, id int) (ExpenseRequest, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	expense, ok := f.expenses[id]
+	if !ok {
+		return expense, errNotFound
+	}
+	return expense, nil
+}
+
+// by returns the first request match accepts.
+func (f *fakeExpenseStore) by(match func(ExpenseRequest) bool) (ExpenseRequest, error) {
+	for _, e := range f.matching(ExpenseFilter{}) {
+		if match(e) {
+			return e, nil
+		}
+	}
+	return ExpenseRequest{}, errNotFound
+}
+
+func (f *fakeExpenseStore) GetByDocNumber(_ context.Context, docNumber string) (ExpenseRequest, error) {
+	return f.by(func(e ExpenseRequest) bool { return e.DocNumber == docNumber })
+}
+
+func (f *fakeExpenseStore) GetByReference(_ context.Context, reference string) (ExpenseRequest, error) {
+	return f.by(func(e ExpenseRequest) bool { return e.Reference == reference })
+}
+
+func (f *fakeExpenseStore) GetByExternalRef(_ context.Context, ref string) (ExpenseRequest, error) {
+	return f.by(func(e ExpenseRequest) bool { return e.ExternalRef != "" && e.ExternalRef == ref })
+}
+
+func (f *fakeExpenseStore) matching(filter ExpenseFilter) []ExpenseRequest {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var expenses []ExpenseRequest
+	for _, e := range f.expenses {
+		if filter.UserID != nil && e.UserID != *filter.UserID ||
+			filter.UnitID != "" && e.UnitID != filter.UnitID ||
+			filter.Category != "" && e.Category != filter.Category ||
+			filter.OwnedBy != 0 && e.UserID != filter.OwnedBy ||
+			filter.Scope != nil && e.UserID != filter.Scope.UserID && !slices.Contains(filter.Scope.Units, e.UnitID) {
+			continue
+		}
+		expenses = append(expenses, e)
+	}
+	slices.SortFunc(expenses, func(a, b ExpenseRequest) int { return a.ID - b.ID })
+	return expenses
+}
+
+func (f *fakeExpenseStore) List(_ context.Context, filter ExpenseFilter) ([]ExpenseRequest, error) {
+	return page(f.matching(filter), filter.ListOptions), nil
+}
+
+func (f *fakeExpenseStore) Each(ctx context.Context, filter ExpenseFilter, fn func(ExpenseRequest) error) error {
+	expenses, _ := f.List(ctx, filter)
+	for _, e := range expenses {
+		if err := fn(e); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (f *fakeExpenseStore) Count(_ context.Context, filter ExpenseFilter) (int, error) {
+	return len(f.matching(filter)), nil
+}
+
+func (f *fakeExpenseStore) Create(_ context.Context, expense ExpenseRequest) (ExpenseRequest, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	now := time.Now()
+	expense.ID, expense.Version, expense.CreatedAt = f.nextID, 1, &now
+	f.nextID++
+	f.expenses[expense.ID] = expense
+	return expense, nil
+}
+
+func (f *fakeExpenseStore) Update(_ context.Context, expense ExpenseRequest, versions []int64) (ExpenseRequest, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	current, ok := f.expenses[expense.ID]
+	if !ok {
+		return expense, errNotFound
+	}
+	if !versionIn(current.Version, versions) {
+		return expense, &versionMismatchError{Version: current.Version}
+	}
+	expense.Version, expense.CreatedAt = current.Version+1, current.CreatedAt
+	f.expenses[expense.ID] = expense
+	return expense, nil
+}
+
+func (f *fakeExpenseStore) Patch(ctx context.Context, id int, _ Patch, _ []int64) (ExpenseRequest, error) {
+	if _, err := f.Get(ctx, id); err != nil {
+		return ExpenseRequest{}, err
+	}
+	return ExpenseRequest{}, errFakePatch
+}
+
+func (f *fakeExpenseStore) Delete(_ context.Context, id int) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if _, ok := f.expenses[id]; !ok {
+		return errNotFound
+	}
+	delete(f.expenses, id)
+	return nil
+}
+
+// testServer is a Server on the fake stores and a fakeDB, which knows the
+// users of the fake user store, the units and categories of units and
+// categories, and the currency EUR.
+type testServer struct {
+	*Server
+	db       *fakeDB
+	users    *fakeUserStore
+	budgets  *fakeBudgetStore
+	expenses *fakeExpenseStore
+}
+
+func newTestServer(t *testing.T, units, categories []string) *testServer {
+	t.Helper()
+	ts := &testServer{
+		db:       &fakeDB{},
+		users:    newFakeUserStore(),
+		budgets:  newFakeBudgetStore(),
+		expenses: newFakeExpenseStore(),
+	}
+	db := ts.db.open()
+	t.Cleanup(func() { db.Close() })
+	ts.Server = &Server{
+		DB:              db,
+		JWTSecret:       []byte("test secret"),
+		BaseCurrency:    "EUR",
+		FiscalYearStart: time.January,
+		Users:           ts.users,
+		Budgets:         ts.budgets,
+		Expenses:        ts.expenses,
+	}
+
+	// authenticate reads the caller afresh
+	ts.db.answer("session.revoked_at IS NULL", func(args []driver.Value) [][]driver.Value {
+		user, err := ts.users.Get(context.Background(), int(args[0].(int64)))
+		if err != nil {
+			return nil
+		}
+		return [][]driver.Value{{int64(user.ID), user.Name, user.UnitID, string(user.RoleID), user.Email, int64(user.Version)}}
+	})
+	// Nobody holds a delegation
+	ts.db.answer("array_agg(DISTINCT d.unit_id)", func([]driver.Value) [][]driver.Value {
+		return [][]driver.Value{{"{}"}}
+	})
+	ts.db.exists("FROM users WHERE id = $1", func(args []driver.Value) bool {
+		_, err := ts.users.Get(context.Background(), int(args[0].(int64)))
+		return err == nil
+	})
+	ts.db.existsIn("FROM unit WHERE name = $1", units...)
+	ts.db.existsIn("FROM expense_category WHERE name = $1", categories...)
+	ts.db.existsIn("FROM currency WHERE code = $1", "EUR")
+	return ts
+}
+
+// addUser puts a user in the fake store and returns them with a token.
+func (ts *testServer) addUser(t *testing.T, name, unit string, role UserRole) (User, string) {
+	t.Helper()
+	user, err := ts.users.Create(context.Background(), User{Name: name, UnitID: unit, RoleID: role})
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, err := ts.signToken(user, 0, time.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return user, token
+}
+
+// serve runs handler on a request with the path variables vars, as the
+// caller of token unless it is empty.
+func serve(handler http.HandlerFunc, method, target string, vars map[string]string, token, body string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, target, strings.NewReader(body))
+	if token != "" {
+		r.Header.Set("Authorization", "Bearer "+token)
+	}
+	r = mux.SetURLVars(r, vars)
+	w := httptest.NewRecorder()
+	handler(w, r)
+	return w
+}
@@ -0,0 +1,167 @@
+package server
+
+import (
+	"context"
+	"log"
+	"main/fieldcrypt"
+
+	"github.com/lib/pq"
+)
+
+// FieldEncryption brings the columns Server.FieldKeys encrypts up to date
+// at startup: values stored in the clear, sealed before values were bound
+// to their row, or sealed with a key that is no longer the first, are
+// sealed again with the first key. Handlers never see the difference,
+// since the columns are read through FieldKeys.Open.
+type FieldEncryption struct{}
+
+// sealedColumn is a column holding encrypted values, with the key of its
+// rows and how many rows to reseal at a time.
+type sealedColumn struct {
+	table, key, column string
+	bytes              bool
+	batch              int
+}
+
+var (
+	bankAccountIBAN = sealedColumn{table: "bank_account", key: "user_id", column: "iban", batch: 500}
+	vendorIBAN      = sealedColumn{table: "vendor", key: "id", column: "iban", batch: 500}
+	// Receipts are up to 10 MiB each
+	attachmentData = sealedColumn{table: "expense_attachment", key: "id", column: "data", bytes: true, batch: 10}
+)
+
+var sealedColumns = []sealedColumn{bankAccountIBAN, vendorIBAN, attachmentData}
+
+// field is where the value of c in the row with key row is stored, which
+// it is sealed for.
+func (c sealedColumn) field(row int) fieldcrypt.Field {
+	return fieldcrypt.Field{Table: c.table, Column: c.column, Row: row}
+}
+
+// nextID reserves the ID the next row of table gets, so that its sealed
+// values can be bound to it before it is inserted.
+func nextID(ctx context.Context, db dbtx, table string) (int, error) {
+	var id int
+	err := db.QueryRowContext(ctx, "SELECT nextval(pg_get_serial_sequence($1, 'id'))", table).Scan(&id)
+	return id, err
+}
+
+func (FieldEncryption) CreateTableIfNotExists(s *Server) {
+	for _, c := range sealedColumns {
+		if !c.bytes {
+			// Sealed values outgrow the VARCHAR the column was made with
+			_, err := s.DB.Exec(`DO $$
+			BEGIN
+				IF EXISTS (SELECT 1 FROM information_schema.columns
+					WHERE table_schema = current_schema() AND table_name = ` + pq.QuoteLiteral(c.table) + `
+					AND column_name = ` + pq.QuoteLiteral(c.column) + ` AND data_type = 'character varying') THEN
+					ALTER TABLE ` + c.table + ` ALTER COLUMN ` + c.column + ` TYPE TEXT;
+				END IF;
+			END $$`)
+
+			if err != nil {
+				log.Fatal(err)
+			}
+		}
+
+		if s.FieldKeys == nil {
+			requireClearColumn(s, c)
+			continue
+		}
+		resealColumn(s, c)
+	}
+}
+
+// requireClearColumn stops the server when a column holds sealed values
+// but no keys are configured, which would fail every read of them.
+func requireClearColumn(s *Server, c sealedColumn) {
+	var marker, unbound any = fieldcrypt.StringMarker, fieldcrypt.UnboundStringMarker
+	length, unboundLength := len(fieldcrypt.StringMarker), len(fieldcrypt.UnboundStringMarker)
+	if c.bytes {
+		marker, length = []byte(fieldcrypt.BytesMarker), len(fieldcrypt.BytesMarker)
+		unbound, unboundLength = []byte(fieldcrypt.UnboundBytesMarker), len(fieldcrypt.UnboundBytesMarker)
+	}
+	var sealed bool
+	err := s.DB.QueryRow(`SELECT EXISTS (SELECT 1 FROM `+c.table+`
+		WHERE substring(`+c.column+` from 1 for $2) = $1 OR substring(`+c.column+` from 1 for $4) = $3)`,
+		marker, length, unbound, unboundLength).Scan(&sealed)
+
+	if err != nil {
+		log.Fatal(err)
+	}
+	if sealed {
+		log.Fatalf("%s.%s holds encrypted values, but no field encryption keys are configured", c.table, c.column)
+	}
+}
+
+// resealColumn seals the values of c that are not sealed with the first key
+// yet, a batch at a time. A value changed in the meantime was written by a
+// handler, sealed already, and is left alone.
+func resealColumn(s *Server, c sealedColumn) {
+	keys := s.FieldKeys
+	var prefix any = keys.StringPrefix()
+	length := len(keys.StringPrefix())
+	if c.bytes {
+		prefix, length = keys.BytesPrefix(), len(keys.BytesPrefix())
+	}
+
+	resealed, last := 0, 0
+	for {
+		rows, err := s.DB.Query(`SELECT `+c.key+`, `+c.column+` FROM `+c.table+`
+			WHERE `+c.key+` > $1 AND octet_length(`+c.column+`) > 0 AND substring(`+c.column+` from 1 for $3) <> $2
+			ORDER BY `+c.key+` LIMIT $4`, last, prefix, length, c.batch)
+
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		type row struct {
+			key   int
+			value []byte
+		}
+		var batch []row
+		for rows.Next() {
+			var r row
+			if err := rows.Scan(&r.key, &r.value); err != nil {
+				log.Fatal(err)
+			}
+			batch = append(batch, r)
+		}
+		if err := rows.Err(); err != nil {
+			log.Fatal(err)
+		}
+		rows.Close()
+		if len(batch) == 0 {
+			break
+		}
+
+		for _, r := range batch {
+			last = r.key
+			var old, sealed any
+			var err error
+			if c.bytes {
+				old = r.value
+				sealed, err = keys.Reseal(c.field(r.key), r.value)
+			} else {
+				old = string(r.value)
+				sealed, err = keys.ResealString(c.field(r.key), string(r.value))
+			}
+			if err != nil {
+				log.Fatalf("%s.%s of %s %d: %v", c.table, c.column, c.key, r.key, err)
+			}
+
+			result, err := s.DB.Exec(`UPDATE `+c.table+` SET `+c.column+` = $1
+				WHERE `+c.key+` = $2 AND `+c.column+` = $3`, sealed, r.key, old)
+
+			if err != nil {
+				log.Fatal(err)
+			}
+			if n, _ := result.RowsAffected(); n > 0 {
+				resealed++
+			}
+		}
+	}
+	if resealed > 0 {
+		log.Printf("Encrypted %d values of %s.%s with field encryption key %s", resealed, c.table, c.column, keys.KeyID())
+	}
+}
@@ -0,0 +1,72 @@
+package server
+
+import (
+	"context"
+	"log"
+	"strconv"
+	"time"
+)
+
+// FiscalYear defines the SQL functions every query placing a payment or
+// request in a budget year goes through, so that units whose fiscal year
+// starts in another month than January are budgeted and reported by it:
+//
+//   - fiscal_year_start(unit) is the month the unit's fiscal year starts
+//     in, Server.FiscalYearStart unless the unit sets its own.
+//   - fiscal_year(at, unit) is the fiscal year a time falls in, named after
+//     the calendar year it starts in.
+//   - fiscal_year_end(year, unit) is the last day of a fiscal year.
+//
+// The organisation's start month is written into the functions at
+// startup, so changing it takes a restart.
+type FiscalYear struct{}
+
+func (FiscalYear) CreateTableIfNotExists(s *Server) {
+	start := s.FiscalYearStart
+	if start < time.January || start > time.December {
+		start = time.January
+	}
+
+	query := `CREATE OR REPLACE FUNCTION fiscal_year_start(unit_name VARCHAR) RETURNS INT AS $$
+		SELECT COALESCE((SELECT fiscal_year_start FROM unit WHERE name = unit_name), ` + strconv.Itoa(int(start)) + `)
+	$$ LANGUAGE sql STABLE;
+	CREATE OR REPLACE FUNCTION fiscal_year(moment TIMESTAMPTZ, unit_name VARCHAR) RETURNS INT AS $$
+		SELECT EXTRACT(YEAR FROM moment - make_interval(months => fiscal_year_start(unit_name) - 1))::int
+	$$ LANGUAGE sql STABLE;
+	CREATE OR REPLACE FUNCTION fiscal_year_end(fy INT, unit_name VARCHAR) RETURNS DATE AS $$
+		SELECT (make_date(fy, fiscal_year_start(unit_name), 1) + INTERVAL '1 year' - INTERVAL '1 day')::date
+	$$ LANGUAGE sql STABLE`
+
+	_, err := s.DB.Exec(query)
+
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// Payments were indexed by calendar year, which budgets no longer go by;
+	// paid_expense_budget_period_idx replaces the index
+	_, err = s.DB.Exec("DROP INDEX IF EXISTS paid_expense_budget_idx")
+
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// fiscalYear is the fiscal year of unit that at falls in. Its zone is
+// dropped, as the created_at columns hold local times without one.
+func fiscalYear(ctx context.Context, db dbtx, at time.Time, unit string) (int, error) {
+	var year int
+	err := db.QueryRowContext(ctx, "SELECT fiscal_year($1::timestamp, $2)", at, unit).Scan(&year)
+	return year, err
+}
+
+// fiscalYearBounds is when fiscal year year of unit starts, and when the
+// next one does. An empty unit stands for the organisation.
+func fiscalYearBounds(ctx context.Context, db dbtx, year int, unit string) (time.Time, time.Time, error) {
+	var month int
+	if err := db.QueryRowContext(ctx, "SELECT fiscal_year_start($1)", unit).Scan(&month); err != nil {
+		return time.Time{}, time.Time{}, err
+	}
+	start := time.Date(year, time.Month(month), 1, 0, 0, 0, 0, time.UTC)
+	return start, start.AddDate(1, 0, 0), nil
+}
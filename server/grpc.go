@@ -0,0 +1,436 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"log"
+	"main/query"
+	"main/rpc"
+	"main/tracing"
+	"net/http"
+	"slices"
+	"strings"
+)
+
+// The gRPC API of proto/ems.proto serves the users, budgets and expense
+// requests of the REST API, and paying expense requests, for internal
+// services. Methods go through the same stores and checks as the REST
+// handlers; only decoding, authentication and how errors are reported
+// differ.
+
+// grpcMethod runs one gRPC method for an authenticated caller.
+type grpcMethod func(s *Server, ctx context.Context, r *http.Request, caller User, in []byte) ([]byte, error)
+
+var grpcMethods = map[string]grpcMethod{
+	"/ems.v1.UserService/GetUser":    (*Server).grpcGetUser,
+	"/ems.v1.UserService/ListUsers":  (*Server).grpcListUsers,
+	"/ems.v1.UserService/CreateUser": (*Server).grpcCreateUser,
+	"/ems.v1.UserService/UpdateUser": (*Server).grpcUpdateUser,
+	"/ems.v1.UserService/DeleteUser": (*Server).grpcDeleteUser,
+
+	"/ems.v1.BudgetService/GetBudget":    (*Server).grpcGetBudget,
+	"/ems.v1.BudgetService/ListBudgets":  (*Server).grpcListBudgets,
+	"/ems.v1.BudgetService/CreateBudget": (*Server).grpcCreateBudget,
+	"/ems.v1.BudgetService/UpdateBudget": (*Server).grpcUpdateBudget,
+	"/ems.v1.BudgetService/DeleteBudget": (*Server).grpcDeleteBudget,
+
+	"/ems.v1.ExpenseRequestService/GetExpenseRequest":    (*Server).grpcGetExpenseRequest,
+	"/ems.v1.ExpenseRequestService/ListExpenseRequests":  (*Server).grpcListExpenseRequests,
+	"/ems.v1.ExpenseRequestService/CreateExpenseRequest": (*Server).grpcCreateExpenseRequest,
+	"/ems.v1.ExpenseRequestService/UpdateExpenseRequest": (*Server).grpcUpdateExpenseRequest,
+	"/ems.v1.ExpenseRequestService/DeleteExpenseRequest": (*Server).grpcDeleteExpenseRequest,
+	"/ems.v1.ExpenseRequestService/PayExpenseRequest":    (*Server).grpcPayExpenseRequest,
+}
+
+// GRPC returns the handler of the gRPC API, to be served over HTTP/2 on a
+// listener of its own.
+func (s *Server) GRPC() *rpc.Server {
+	g := rpc.NewServer()
+	for name, method := range grpcMethods {
+		g.Register(name, func(ctx context.Context, r *http.Request, in []byte) (out []byte, err error) {
+			ctx, span := s.Tracer.StartRemote(ctx, r.Header.Get("traceparent"), strings.TrimPrefix(name, "/"), tracing.Server)
+			span.SetAttribute("rpc.system", "grpc")
+			defer func() {
+				if err != nil {
+					span.SetError(err.Error())
+				}
+				span.End()
+			}()
+
+			// Calls carry the access token in their authorization metadata,
+			// which arrives as the header REST requests use
+			caller, err := s.authenticate(r)
+			if errors.Is(err, errUnauthorized) {
+				return nil, rpc.Errorf(rpc.Unauthenticated, "a valid access token is required")
+			} else if err != nil {
+				return nil, grpcError(name, err)
+			}
+			out, err = method(s, ctx, r, caller, in)
+			if err != nil {
+				return nil, grpcError(name, err)
+			}
+			return out, nil
+		})
+	}
+	return g
+}
+
+// grpcError reports an error as writeStoreError does over REST, with the
+// nearest gRPC status.
+func grpcError(method string, err error) error {
+	var st *rpc.Status
+	var mismatch *versionMismatchError
+	var invalid FieldErrors
+	var conflict conflictError
+	switch {
+	case errors.As(err, &st):
+		return st
+	case errors.Is(err, errNotFound):
+		return rpc.Errorf(rpc.NotFound, "not found")
+	case errors.As(err, &mismatch):
+		return rpc.Errorf(rpc.Aborted, "The resource has been modified; fetch it again (version %d)", mismatch.Version)
+	case errors.As(err, &invalid):
+		return rpc.Errorf(rpc.InvalidArgument, "%s", invalid.Error())
+	case errors.As(err, &conflict):
+		return rpc.Errorf(rpc.FailedPrecondition, "%s", string(conflict))
+	}
+	log.Printf("gRPC %s error: %v", method, err)
+	return rpc.Errorf(rpc.Internal, "Database error")
+}
+
+// invalidMessage reports a request message that could not be decoded.
+func invalidMessage(err error) error {
+	return rpc.Errorf(rpc.InvalidArgument, "malformed request message: %v", err)
+}
+
+// grpcListOptions checks the sort, limit and offset of a list call as
+// listOptions does those of a REST list.
+func grpcListOptions(opts *ListOptions, sort string, sortable map[string]string) error {
+	terms, err := query.ParseSort(sort, sortable)
+	if err != nil {
+		return rpc.Errorf(rpc.InvalidArgument, "Invalid sort: %v", err)
+	}
+	opts.Sort = terms
+	if opts.Limit < 0 || opts.Limit > maxListLimit {
+		return rpc.Errorf(rpc.InvalidArgument, "limit must be between 1 and %d, or 0 for all", maxListLimit)
+	}
+	if opts.Offset < 0 {
+		return rpc.Errorf(rpc.InvalidArgument, "offset must be a non-negative integer")
+	}
+	return nil
+}
+
+// grpcVersions are the versions a write sent with version may apply to:
+// that one, or any when it is 0.
+func grpcVersions(version int) []int64 {
+	if version == 0 {
+		return nil
+	}
+	return []int64{int64(version)}
+}
+
+func (s *Server) grpcGetUser(ctx context.Context, r *http.Request, caller User, in []byte) ([]byte, error) {
+	id, err := decodeID(in)
+	if err != nil {
+		return nil, invalidMessage(err)
+	}
+	user, err := s.Users.Get(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	viewer{user: &caller}.redactUser(&user)
+	return encodeUser(user), nil
+}
+
+func (s *Server) grpcListUsers(ctx context.Context, r *http.Request, caller User, in []byte) ([]byte, error) {
+	filter, sort, err := decodeUserFilter(in)
+	if err != nil {
+		return nil, invalidMessage(err)
+	}
+	if err := grpcListOptions(&filter.ListOptions, sort, userSortable); err != nil {
+		return nil, err
+	}
+	users, err := s.Users.List(ctx, filter)
+	if err != nil {
+		return nil, err
+	}
+	for i := range users {
+		viewer{user: &caller}.redactUser(&users[i])
+	}
+	return encodeUsers(users), nil
+}
+
+func (s *Server) grpcCreateUser(ctx context.Context, r *http.Request, caller User, in []byte) ([]byte, error) {
+	if caller.RoleID != Admin {
+		return nil, rpc.Errorf(rpc.PermissionDenied, "only an Admin can change users")
+	}
+	user, err := decodeUser(in)
+	if err != nil {
+		return nil, invalidMessage(err)
+	}
+	user.ID = 0
+	if err := s.checkValid(ctx, user); err != nil {
+		return nil, err
+	}
+	user, err = s.Users.Create(ctx, user)
+	if err != nil {
+		return nil, err
+	}
+	return encodeUser(user), nil
+}
+
+func (s *Server) grpcUpdateUser(ctx context.Context, r *http.Request, caller User, in []byte) ([]byte, error) {
+	if caller.RoleID != Admin {
+		return nil, rpc.Errorf(rpc.PermissionDenied, "only an Admin can change users")
+	}
+	user, err := decodeUser(in)
+	if err != nil {
+		return nil, invalidMessage(err)
+	}
+	if user.ID == 0 {
+		return nil, rpc.Errorf(rpc.InvalidArgument, "id is required")
+	}
+	if err := s.checkValid(ctx, user); err != nil {
+		return nil, err
+	}
+	user, err = s.Users.Update(ctx, user, grpcVersions(user.Version))
+	if err != nil {
+		return nil, err
+	}
+	return encodeUser(user), nil
+}
+
+func (s *Server) grpcDeleteUser(ctx context.Context, r *http.Request, caller User, in []byte) ([]byte, error) {
+	if caller.RoleID != Admin {
+		return nil, rpc.Errorf(rpc.PermissionDenied, "only an Admin can change users")
+	}
+	id, err := decodeID(in)
+	if err != nil {
+		return nil, invalidMessage(err)
+	}
+	if err := s.Users.Delete(ctx, id); err != nil {
+		return nil, err
+	}
+	return nil, nil
+}
+
+func (s *Server) grpcGetBudget(ctx context.Context, r *http.Request, caller User, in []byte) ([]byte, error) {
+	key, err := decodeBudgetKey(in)
+	if err != nil {
+		return nil, invalidMessage(err)
+	}
+	budget, err := s.Budgets.Get(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	return encodeBudget(budget), nil
+}
+
+func (s *Server) grpcListBudgets(ctx context.Context, r *http.Request, caller User, in []byte) ([]byte, error) {
+	filter, sort, err := decodeBudgetFilter(in)
+	if err != nil {
+		return nil, invalidMessage(err)
+	}
+	if err := grpcListOptions(&filter.ListOptions, sort, budgetSortable); err != nil {
+		return nil, err
+	}
+	budgets, err := s.Budgets.List(ctx, filter)
+	if err != nil {
+		return nil, err
+	}
+	return encodeBudgets(budgets), nil
+}
+
+func (s *Server) grpcCreateBudget(ctx context.Context, r *http.Request, caller User, in []byte) ([]byte, error) {
+	call, err := decodeCreateBudget(in)
+	if err != nil {
+		return nil, invalidMessage(err)
+	}
+	budget := call.Budget
+	budget.Currency = s.currencyOrBase(budget.Currency)
+	budget, err = s.createBudget(ctx, budget, call.Reason, caller.ID)
+	if err != nil {
+		return nil, err
+	}
+	return encodeBudget(budget), nil
+}
+
+func (s *Server) grpcUpdateBudget(ctx context.Context, r *http.Request, caller User, in []byte) ([]byte, error) {
+	call, err := decodeUpdateBudget(in)
+	if err != nil {
+		return nil, invalidMessage(err)
+	}
+	budget := call.Budget
+	budget.Currency = s.currencyOrBase(budget.Currency)
+	key := call.Key
+	if key == (BudgetKey{}) {
+		key = BudgetKey{budget.UnitID, budget.Category, budget.Year}
+	}
+	budget, err = s.updateBudget(ctx, key, budget, call.Reason, grpcVersions(budget.Version), caller.ID)
+	if err != nil {
+		return nil, err
+	}
+	return encodeBudget(budget), nil
+}
+
+func (s *Server) grpcDeleteBudget(ctx context.Context, r *http.Request, caller User, in []byte) ([]byte, error) {
+	call, err := decodeDeleteBudget(in)
+	if err != nil {
+		return nil, invalidMessage(err)
+	}
+	if err := s.deleteBudget(ctx, call.Key, call.Reason, caller.ID); err != nil {
+		return nil, err
+	}
+	return nil, nil
+}
+
+// grpcViewer is the viewer for a caller of the gRPC API; see viewerOf.
+func (s *Server) grpcViewer(ctx context.Context, caller User) (viewer, error) {
+	delegated, err := delegatedUnits(ctx, s.DB, caller.ID)
+	if err != nil {
+		return viewer{}, err
+	}
+	return viewer{user: &caller, delegated: delegated}, nil
+}
+
+func (s *Server) grpcGetExpenseRequest(ctx context.Context, r *http.Request, caller User, in []byte) ([]byte, error) {
+	lookup, err := decodeExpenseLookup(in)
+	if err != nil {
+		return nil, invalidMessage(err)
+	}
+	v, err := s.grpcViewer(ctx, caller)
+	if err != nil {
+		return nil, err
+	}
+
+	var expense ExpenseRequest
+	expenses := s.expensesAs(v)
+	switch lookup.field {
+	case 1:
+		expense, err = expenses.Get(ctx, lookup.id)
+	case 2:
+		expense, err = expenses.GetByDocNumber(ctx, strings.ToUpper(lookup.value))
+	case 3:
+		expense, err = expenses.GetByReference(ctx, strings.ToUpper(lookup.value))
+	case 4:
+		expense, err = expenses.GetByExternalRef(ctx, lookup.value)
+	default:
+		return nil, rpc.Errorf(rpc.InvalidArgument, "one of id, doc_number, reference or external_ref is required")
+	}
+	if err != nil {
+		return nil, err
+	}
+	s.addExpenseLinks(r, &expense)
+	return encodeExpenseRequest(expense), nil
+}
+
+func (s *Server) grpcListExpenseRequests(ctx context.Context, r *http.Request, caller User, in []byte) ([]byte, error) {
+	filter, sort, err := decodeExpenseFilter(in)
+	if err != nil {
+		return nil, invalidMessage(err)
+	}
+	if err := grpcListOptions(&filter.ListOptions, sort, expenseRequestSortable); err != nil {
+		return nil, err
+	}
+	v, err := s.grpcViewer(ctx, caller)
+	if err != nil {
+		return nil, err
+	}
+
+	// As over REST, filtering or sorting on amounts the caller cannot see
+	// keeps to their own requests
+	sortsByAmount := slices.ContainsFunc(filter.Sort, func(term string) bool { return strings.HasPrefix(term, "amount ") })
+	if (filter.Amount != nil || sortsByAmount) && v.restricted(expenseRequestFieldRules, "amount") {
+		filter.OwnedBy = caller.ID
+	}
+
+	expenses, err := s.expensesAs(v).List(ctx, filter)
+	if err != nil {
+		return nil, err
+	}
+	listed := make([]*ExpenseRequest, len(expenses))
+	for i := range expenses {
+		listed[i] = &expenses[i]
+	}
+	s.addExpenseLinks(r, listed...)
+	return encodeExpenseRequests(expenses), nil
+}
+
+func (s *Server) grpcCreateExpenseRequest(ctx context.Context, r *http.Request, caller User, in []byte) ([]byte, error) {
+	expense, err := decodeExpenseRequest(in)
+	if err != nil {
+		return nil, invalidMessage(err)
+	}
+	expense.ID = 0
+	fileAs(caller, &expense)
+	expense.Currency = s.currencyOrBase(expense.Currency)
+	expense, err = s.createExpenseRequest(ctx, expense)
+	if err != nil {
+		return nil, err
+	}
+	s.addExpenseLinks(r, &expense)
+	return encodeExpenseRequest(expense), nil
+}
+
+func (s *Server) grpcUpdateExpenseRequest(ctx context.Context, r *http.Request, caller User, in []byte) ([]byte, error) {
+	expense, err := decodeExpenseRequest(in)
+	if err != nil {
+		return nil, invalidMessage(err)
+	}
+	if expense.ID == 0 {
+		return nil, rpc.Errorf(rpc.InvalidArgument, "id is required")
+	}
+	v, err := s.grpcViewer(ctx, caller)
+	if err != nil {
+		return nil, err
+	}
+	current, err := s.expensesAs(v).Get(ctx, expense.ID)
+	if err != nil {
+		return nil, err
+	}
+	if caller.ID != current.UserID && caller.RoleID != Admin {
+		return nil, rpc.Errorf(rpc.PermissionDenied, "only the requester may edit the expense request")
+	}
+	if err := s.checkDraft(ctx, expense.ID); err != nil {
+		return nil, err
+	}
+	fileAs(caller, &expense)
+	expense.Currency = s.currencyOrBase(expense.Currency)
+	if err := s.checkValid(ctx, expense); err != nil {
+		return nil, err
+	}
+	expense, err = s.Expenses.Update(ctx, expense, grpcVersions(expense.Version))
+	if err != nil {
+		return nil, err
+	}
+	s.addExpenseLinks(r, &expense)
+	return encodeExpenseRequest(expense), nil
+}
+
+func (s *Server) grpcDeleteExpenseRequest(ctx context.Context, r *http.Request, caller User, in []byte) ([]byte, error) {
+	if caller.RoleID != Admin {
+		return nil, rpc.Errorf(rpc.PermissionDenied, "only an Admin can delete expense requests")
+	}
+	id, err := decodeID(in)
+	if err != nil {
+		return nil, invalidMessage(err)
+	}
+	if err := s.Expenses.Delete(ctx, id); err != nil {
+		return nil, err
+	}
+	return nil, nil
+}
+
+func (s *Server) grpcPayExpenseRequest(ctx context.Context, r *http.Request, caller User, in []byte) ([]byte, error) {
+	if caller.RoleID != Accounter && caller.RoleID != Admin {
+		return nil, rpc.Errorf(rpc.PermissionDenied, "only an Accountant or Admin can pay expense requests")
+	}
+	payment, err := decodePayment(in)
+	if err != nil {
+		return nil, invalidMessage(err)
+	}
+	if err := s.payExpense(ctx, &payment, caller.ID); err != nil {
+		return nil, err
+	}
+	return encodePayment(payment), nil
+}
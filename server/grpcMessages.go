@@ -0,0 +1,434 @@
+package server
+
+import (
+	"main/money"
+	"main/rpc"
+	"time"
+)
+
+// The messages of proto/ems.proto, encoded and decoded by hand with
+// package rpc. Field numbers must match the .proto file.
+
+func encodeTime(t *time.Time) string {
+	if t == nil {
+		return ""
+	}
+	return t.Format(time.RFC3339Nano)
+}
+
+func optionalInt(v int64) *int {
+	n := int(v)
+	return &n
+}
+
+func optionalDouble(v float64) *float64 {
+	return &v
+}
+
+// Amounts travel as doubles, as they did before money.Amount, and are
+// rounded to the cent when decoded.
+
+func optionalAmount(v float64) *money.Amount {
+	a := money.FromFloat(v)
+	return &a
+}
+
+func amountDouble(a *money.Amount) *float64 {
+	if a == nil {
+		return nil
+	}
+	return optionalDouble(a.Float64())
+}
+
+func encodeUser(u User) []byte {
+	var e rpc.Encoder
+	e.Int(1, int64(u.ID))
+	e.String(2, u.Name)
+	e.String(3, u.UnitID)
+	e.String(4, string(u.RoleID))
+	e.String(5, u.Email)
+	// The password (6) is never sent back
+	e.Int(7, int64(u.Version))
+	return e.Bytes()
+}
+
+func decodeUser(in []byte) (User, error) {
+	var u User
+	d := rpc.NewDecoder(in)
+	for d.Next() {
+		switch d.Field() {
+		case 1:
+			u.ID = int(d.Int())
+		case 2:
+			u.Name = d.String()
+		case 3:
+			u.UnitID = d.String()
+		case 4:
+			u.RoleID = UserRole(d.String())
+		case 5:
+			u.Email = d.String()
+		case 6:
+			u.Password = d.String()
+		case 7:
+			u.Version = int(d.Int())
+		}
+	}
+	return u, d.Err()
+}
+
+func encodeUsers(users []User) []byte {
+	var e rpc.Encoder
+	for _, u := range users {
+		e.Message(1, encodeUser(u))
+	}
+	return e.Bytes()
+}
+
+func decodeUserFilter(in []byte) (UserFilter, string, error) {
+	var f UserFilter
+	var sort string
+	d := rpc.NewDecoder(in)
+	for d.Next() {
+		switch d.Field() {
+		case 1:
+			f.UnitID = d.String()
+		case 2:
+			f.RoleID = d.String()
+		case 3:
+			f.Name = d.String()
+		case 4:
+			sort = d.String()
+		case 5:
+			f.Limit = int(d.Int())
+		case 6:
+			f.Offset = int(d.Int())
+		}
+	}
+	return f, sort, d.Err()
+}
+
+// decodeID reads a message whose field 1 is an ID, as GetUserRequest is.
+func decodeID(in []byte) (int, error) {
+	var id int
+	d := rpc.NewDecoder(in)
+	for d.Next() {
+		if d.Field() == 1 {
+			id = int(d.Int())
+		}
+	}
+	return id, d.Err()
+}
+
+func decodeBudgetKey(in []byte) (BudgetKey, error) {
+	var k BudgetKey
+	d := rpc.NewDecoder(in)
+	for d.Next() {
+		switch d.Field() {
+		case 1:
+			k.UnitID = d.String()
+		case 2:
+			k.Category = d.String()
+		case 3:
+			k.Year = int(d.Int())
+		}
+	}
+	return k, d.Err()
+}
+
+func encodeBudget(b Budget) []byte {
+	var e rpc.Encoder
+	e.String(1, b.UnitID)
+	e.String(2, b.Category)
+	e.Int(3, int64(b.Year))
+	e.Double(4, b.BudgetLimit.Float64())
+	e.Double(5, b.ThresholdRatio)
+	e.String(6, b.Currency)
+	e.Int(7, int64(b.Version))
+	return e.Bytes()
+}
+
+func decodeBudget(in []byte) (Budget, error) {
+	var b Budget
+	d := rpc.NewDecoder(in)
+	for d.Next() {
+		switch d.Field() {
+		case 1:
+			b.UnitID = d.String()
+		case 2:
+			b.Category = d.String()
+		case 3:
+			b.Year = int(d.Int())
+		case 4:
+			b.BudgetLimit = money.FromFloat(d.Double())
+		case 5:
+			b.ThresholdRatio = d.Double()
+		case 6:
+			b.Currency = d.String()
+		case 7:
+			b.Version = int(d.Int())
+		}
+	}
+	return b, d.Err()
+}
+
+func encodeBudgets(budgets []Budget) []byte {
+	var e rpc.Encoder
+	for _, b := range budgets {
+		e.Message(1, encodeBudget(b))
+	}
+	return e.Bytes()
+}
+
+func decodeBudgetFilter(in []byte) (BudgetFilter, string, error) {
+	var f BudgetFilter
+	var sort string
+	d := rpc.NewDecoder(in)
+	for d.Next() {
+		switch d.Field() {
+		case 1:
+			f.UnitID = d.String()
+		case 2:
+			f.IncludeSubunits = d.Bool()
+		case 3:
+			f.Category = d.String()
+		case 4:
+			f.Year = int(d.Int())
+		case 5:
+			sort = d.String()
+		case 6:
+			f.Limit = int(d.Int())
+		case 7:
+			f.Offset = int(d.Int())
+		}
+	}
+	return f, sort, d.Err()
+}
+
+// budgetCall is a CreateBudgetRequest, UpdateBudgetRequest or
+// DeleteBudgetRequest, each of which sets some of its fields.
+type budgetCall struct {
+	Key    BudgetKey
+	Budget Budget
+	Reason string
+}
+
+func decodeCreateBudget(in []byte) (budgetCall, error) {
+	var c budgetCall
+	d := rpc.NewDecoder(in)
+	for d.Next() {
+		var err error
+		switch d.Field() {
+		case 1:
+			c.Budget, err = decodeBudget(d.Message())
+		case 2:
+			c.Reason = d.String()
+		}
+		if err != nil {
+			return c, err
+		}
+	}
+	return c, d.Err()
+}
+
+func decodeUpdateBudget(in []byte) (budgetCall, error) {
+	var c budgetCall
+	d := rpc.NewDecoder(in)
+	for d.Next() {
+		var err error
+		switch d.Field() {
+		case 1:
+			c.Key, err = decodeBudgetKey(d.Message())
+		case 2:
+			c.Budget, err = decodeBudget(d.Message())
+		case 3:
+			c.Reason = d.String()
+		}
+		if err != nil {
+			return c, err
+		}
+	}
+	return c, d.Err()
+}
+
+func decodeDeleteBudget(in []byte) (budgetCall, error) {
+	var c budgetCall
+	d := rpc.NewDecoder(in)
+	for d.Next() {
+		var err error
+		switch d.Field() {
+		case 1:
+			c.Key, err = decodeBudgetKey(d.Message())
+		case 2:
+			c.Reason = d.String()
+		}
+		if err != nil {
+			return c, err
+		}
+	}
+	return c, d.Err()
+}
+
+func encodeExpenseRequest(x ExpenseRequest) []byte {
+	var e rpc.Encoder
+	e.Int(1, int64(x.ID))
+	e.Int(2, int64(x.UserID))
+	e.String(3, x.UnitID)
+	e.Double(4, x.Amount.Float64())
+	e.String(5, x.Currency)
+	e.String(6, x.Category)
+	e.String(7, encodeTime(x.CreatedAt))
+	e.String(8, x.DocNumber)
+	e.String(9, x.Reference)
+	e.String(10, x.ExternalRef)
+	e.OptionalInt(11, x.VendorID)
+	e.OptionalDouble(12, x.VATRate)
+	e.OptionalDouble(13, amountDouble(x.NetAmount))
+	e.OptionalDouble(14, amountDouble(x.VATAmount))
+	e.Int(15, int64(x.Version))
+	e.Bool(16, x.Draft)
+	e.OptionalDouble(17, amountDouble(x.AmountPaid))
+	e.OptionalDouble(18, amountDouble(x.AmountRemaining))
+	e.Strings(19, x.Hidden)
+	e.Bool(20, x.IsFinalized)
+	return e.Bytes()
+}
+
+// decodeExpenseRequest reads the fields a client may set; those assigned
+// by the server are ignored.
+func decodeExpenseRequest(in []byte) (ExpenseRequest, error) {
+	var x ExpenseRequest
+	d := rpc.NewDecoder(in)
+	for d.Next() {
+		switch d.Field() {
+		case 1:
+			x.ID = int(d.Int())
+		case 2:
+			x.UserID = int(d.Int())
+		case 3:
+			x.UnitID = d.String()
+		case 4:
+			x.Amount = money.FromFloat(d.Double())
+		case 5:
+			x.Currency = d.String()
+		case 6:
+			x.Category = d.String()
+		case 10:
+			x.ExternalRef = d.String()
+		case 11:
+			x.VendorID = optionalInt(d.Int())
+		case 12:
+			x.VATRate = optionalDouble(d.Double())
+		case 15:
+			x.Version = int(d.Int())
+		case 16:
+			x.Draft = d.Bool()
+		case 20:
+			x.IsFinalized = d.Bool()
+		}
+	}
+	return x, d.Err()
+}
+
+func encodeExpenseRequests(requests []ExpenseRequest) []byte {
+	var e rpc.Encoder
+	for _, x := range requests {
+		e.Message(1, encodeExpenseRequest(x))
+	}
+	return e.Bytes()
+}
+
+// expenseLookup is a GetExpenseRequestRequest: the one field it was sent
+// with.
+type expenseLookup struct {
+	field int
+	id    int
+	value string
+}
+
+func decodeExpenseLookup(in []byte) (expenseLookup, error) {
+	var l expenseLookup
+	d := rpc.NewDecoder(in)
+	for d.Next() {
+		switch d.Field() {
+		case 1:
+			l = expenseLookup{field: 1, id: int(d.Int())}
+		case 2, 3, 4:
+			l = expenseLookup{field: d.Field(), value: d.String()}
+		}
+	}
+	return l, d.Err()
+}
+
+func decodeExpenseFilter(in []byte) (ExpenseFilter, string, error) {
+	var f ExpenseFilter
+	var sort string
+	d := rpc.NewDecoder(in)
+	for d.Next() {
+		switch d.Field() {
+		case 1:
+			f.UserID = optionalInt(d.Int())
+		case 2:
+			f.UnitID = d.String()
+		case 3:
+			f.Amount = optionalAmount(d.Double())
+		case 4:
+			f.Category = d.String()
+		case 5:
+			f.ExternalRef = d.String()
+		case 6:
+			f.VendorID = optionalInt(d.Int())
+		case 7:
+			finalized := d.Bool()
+			f.IsFinalized = &finalized
+		case 8:
+			sort = d.String()
+		case 9:
+			f.Limit = int(d.Int())
+		case 10:
+			f.Offset = int(d.Int())
+		}
+	}
+	return f, sort, d.Err()
+}
+
+func encodePayment(p PaidExpense) []byte {
+	var e rpc.Encoder
+	e.Int(1, int64(p.ID))
+	e.Int(2, int64(p.ExpenseID))
+	e.String(3, p.UnitID)
+	e.String(4, p.Category)
+	e.Double(5, p.Amount.Float64())
+	e.String(6, p.Currency)
+	e.String(7, encodeTime(p.CreatedAt))
+	e.OptionalDouble(8, amountDouble(p.BaseAmount))
+	e.OptionalDouble(9, p.ExchangeRate)
+	e.OptionalString(10, p.RateDate)
+	e.OptionalInt(11, p.BatchID)
+	e.OptionalDouble(12, p.VATRate)
+	e.OptionalDouble(13, amountDouble(p.NetAmount))
+	e.OptionalDouble(14, amountDouble(p.VATAmount))
+	return e.Bytes()
+}
+
+// decodePayment reads the fields a client may set on a payment.
+func decodePayment(in []byte) (PaidExpense, error) {
+	var p PaidExpense
+	d := rpc.NewDecoder(in)
+	for d.Next() {
+		switch d.Field() {
+		case 2:
+			p.ExpenseID = int(d.Int())
+		case 3:
+			p.UnitID = d.String()
+		case 4:
+			p.Category = d.String()
+		case 5:
+			p.Amount = money.FromFloat(d.Double())
+		case 6:
+			p.Currency = d.String()
+		case 12:
+			p.VATRate = optionalDouble(d.Double())
+		}
+	}
+	return p, d.Err()
+}
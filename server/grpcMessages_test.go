@@ -0,0 +1,326 @@
+package server
+
+import (
+	"bufio"
+	"main/money"
+	"main/rpc"
+	"os"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// protoField is a field of a message in proto/ems.proto.
+type protoField struct {
+	name     string
+	number   int
+	typ      string // a scalar type or a message name
+	repeated bool
+}
+
+var (
+	protoMessageLine = regexp.MustCompile(`^\s*message (\w+) \{`)
+	protoFieldLine   = regexp.MustCompile(`^\s*(optional |repeated )?(\w+) (\w+) = (\d+);`)
+)
+
+// loadProto reads the fields of the messages of proto/ems.proto, which the
+// encoders and decoders must agree with.
+func loadProto(t *testing.T) map[string]map[int]protoField {
+	t.Helper()
+	f, err := os.Open("../proto/ems.proto")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	messages := map[string]map[int]protoField{}
+	var message string
+	depth := 0
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line, _, _ := strings.Cut(scanner.Text(), "//")
+		if m := protoMessageLine.FindStringSubmatch(line); m != nil && depth == 0 {
+			message = m[1]
+			messages[message] = map[int]protoField{}
+		} else if m := protoFieldLine.FindStringSubmatch(line); m != nil && message != "" {
+			number, _ := strconv.Atoi(m[4])
+			if _, ok := messages[message][number]; ok {
+				t.Fatalf("%s reuses field number %d", message, number)
+			}
+			messages[message][number] = protoField{name: m[3], number: number, typ: m[2], repeated: m[1] == "repeated "}
+		}
+		depth += strings.Count(line, "{") - strings.Count(line, "}")
+		if depth == 0 {
+			message = ""
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		t.Fatal(err)
+	}
+	return messages
+}
+
+// checkEncoding reads b as the message named message, failing on a field
+// the message does not have or one encoded with the wrong wire type.
+func checkEncoding(t *testing.T, proto map[string]map[int]protoField, message string, b []byte) {
+	t.Helper()
+	fields, ok := proto[message]
+	if !ok {
+		t.Fatalf("no message %s in ems.proto", message)
+	}
+	seen := map[int]bool{}
+	d := rpc.NewDecoder(b)
+	for d.Next() {
+		field, ok := fields[d.Field()]
+		if !ok {
+			t.Errorf("%s has no field %d", message, d.Field())
+			continue
+		}
+		if seen[field.number] && !field.repeated {
+			t.Errorf("%s.%s is written twice", message, field.name)
+		}
+		seen[field.number] = true
+		switch field.typ {
+		case "int32", "int64":
+			d.Int()
+		case "bool":
+			d.Bool()
+		case "double":
+			d.Double()
+		case "string":
+			_ = d.String()
+		default:
+			checkEncoding(t, proto, field.typ, d.Message())
+		}
+	}
+	if err := d.Err(); err != nil {
+		t.Errorf("%s: %v", message, err)
+	}
+}
+
+// fieldNumbers maps the field names of the message to their numbers.
+func fieldNumbers(t *testing.T, proto map[string]map[int]protoField, message string) func(name string) int {
+	return func(name string) int {
+		t.Helper()
+		for _, f := range proto[message] {
+			if f.name == name {
+				return f.number
+			}
+		}
+		t.Fatalf("%s has no field %s", message, name)
+		return 0
+	}
+}
+
+func ptr[T any](v T) *T {
+	return &v
+}
+
+func TestGRPCEncodersMatchProto(t *testing.T) {
+	proto := loadProto(t)
+	created := time.Date(2025, 3, 1, 9, 30, 0, 0, time.UTC)
+	user := User{ID: 1, Name: "ada", UnitID: "Sales", RoleID: Manager, Email: "ada@example.com", Password: "secret", Version: 3}
+	budget := Budget{UnitID: "Sales", Category: "Travel", Year: 2025, BudgetLimit: 100050, ThresholdRatio: 0.1, Currency: "EUR", Version: 2}
+	expense := ExpenseRequest{
+		ID: 7, UserID: 1, UnitID: "Sales", Amount: 12025, Currency: "EUR", Category: "Travel", CreatedAt: &created,
+		DocNumber: "INV-1", Reference: "EXP-2025-000007", ExternalRef: "ext-7", VendorID: ptr(3),
+		VATRate: ptr(0.2), NetAmount: ptr(money.Amount(10021)), VATAmount: ptr(money.Amount(2004)),
+		Version: 4, Draft: true, AmountPaid: ptr(money.Amount(5000)), AmountRemaining: ptr(money.Amount(7025)),
+		Hidden: []string{"amount", ""}, IsFinalized: true,
+	}
+	payment := PaidExpense{
+		ID: 9, ExpenseID: 7, UnitID: "Sales", Category: "Travel", Amount: 5000, Currency: "USD", CreatedAt: &created,
+		BaseAmount: ptr(money.Amount(4600)), ExchangeRate: ptr(0.92), RateDate: ptr("2025-03-01"), BatchID: ptr(2),
+		VATRate: ptr(0.2), NetAmount: ptr(money.Amount(4167)), VATAmount: ptr(money.Amount(833)),
+	}
+
+	tests := []struct {
+		message  string
+		b        []byte
+		unwanted string // a field never written
+	}{
+		{"User", encodeUser(user), "password"},
+		{"ListUsersResponse", encodeUsers([]User{user, user}), ""},
+		{"Budget", encodeBudget(budget), ""},
+		{"ListBudgetsResponse", encodeBudgets([]Budget{budget, budget}), ""},
+		{"ExpenseRequest", encodeExpenseRequest(expense), ""},
+		{"ListExpenseRequestsResponse", encodeExpenseRequests([]ExpenseRequest{expense, expense}), ""},
+		{"Payment", encodePayment(payment), ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.message, func(t *testing.T) {
+			checkEncoding(t, proto, tt.message, tt.b)
+
+			// Every field of the message is written when set
+			written := map[int]bool{}
+			d := rpc.NewDecoder(tt.b)
+			for d.Next() {
+				written[d.Field()] = true
+			}
+			for number, f := range proto[tt.message] {
+				if written[number] != (f.name != tt.unwanted) {
+					t.Errorf("%s.%s written: %v", tt.message, f.name, written[number])
+				}
+			}
+		})
+	}
+}
+
+func TestGRPCRoundTrip(t *testing.T) {
+	user := User{ID: 1, Name: "ada", UnitID: "Sales", RoleID: Manager, Email: "ada@example.com", Password: "secret", Version: 3}
+	gotUser, err := decodeUser(encodeUser(user))
+	if err != nil {
+		t.Fatal(err)
+	}
+	user.Password = "" // never sent back
+	if gotUser != user {
+		t.Errorf("user = %+v, want %+v", gotUser, user)
+	}
+
+	budget := Budget{UnitID: "Sales", Category: "Travel", Year: 2025, BudgetLimit: 100050, ThresholdRatio: 0.1, Currency: "EUR", Version: 2}
+	gotBudget, err := decodeBudget(encodeBudget(budget))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if gotBudget != budget {
+		t.Errorf("budget = %+v, want %+v", gotBudget, budget)
+	}
+
+	// The fields a client sets on an expense request or a payment
+	expense := ExpenseRequest{
+		ID: 7, UserID: 1, UnitID: "Sales", Amount: 12025, Currency: "EUR", Category: "Travel",
+		ExternalRef: "ext-7", VendorID: ptr(0), VATRate: ptr(0.0), Version: 4, Draft: true, IsFinalized: true,
+	}
+	gotExpense, err := decodeExpenseRequest(encodeExpenseRequest(expense))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(gotExpense, expense) {
+		t.Errorf("expense request = %+v, want %+v", gotExpense, expense)
+	}
+
+	payment := PaidExpense{ExpenseID: 7, UnitID: "Sales", Category: "Travel", Amount: 5000, Currency: "USD", VATRate: ptr(0.2)}
+	gotPayment, err := decodePayment(encodePayment(payment))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(gotPayment, payment) {
+		t.Errorf("payment = %+v, want %+v", gotPayment, payment)
+	}
+}
+
+func TestGRPCDecodersMatchProto(t *testing.T) {
+	proto := loadProto(t)
+
+	field := fieldNumbers(t, proto, "ListUsersRequest")
+	var e rpc.Encoder
+	e.String(field("unit_id"), "Sales")
+	e.String(field("role_id"), "Manager")
+	e.String(field("name"), "ad")
+	e.String(field("sort"), "-id")
+	e.Int(field("limit"), 10)
+	e.Int(field("offset"), 20)
+	users, sort, err := decodeUserFilter(e.Bytes())
+	if want := (UserFilter{UnitID: "Sales", RoleID: "Manager", Name: "ad", ListOptions: ListOptions{Limit: 10, Offset: 20}}); err != nil || sort != "-id" || !reflect.DeepEqual(users, want) {
+		t.Errorf("ListUsersRequest = %+v, %q, %v; want %+v", users, sort, err, want)
+	}
+
+	field = fieldNumbers(t, proto, "ListBudgetsRequest")
+	e = rpc.Encoder{}
+	e.String(field("unit_id"), "Sales")
+	e.Bool(field("include_subunits"), true)
+	e.String(field("category"), "Travel")
+	e.Int(field("year"), 2025)
+	e.String(field("sort"), "year")
+	e.Int(field("limit"), 5)
+	e.Int(field("offset"), 1)
+	budgets, sort, err := decodeBudgetFilter(e.Bytes())
+	if want := (BudgetFilter{UnitID: "Sales", IncludeSubunits: true, Category: "Travel", Year: 2025, ListOptions: ListOptions{Limit: 5, Offset: 1}}); err != nil || sort != "year" || !reflect.DeepEqual(budgets, want) {
+		t.Errorf("ListBudgetsRequest = %+v, %q, %v; want %+v", budgets, sort, err, want)
+	}
+
+	field = fieldNumbers(t, proto, "ListExpenseRequestsRequest")
+	e = rpc.Encoder{}
+	e.OptionalInt(field("user_id"), ptr(0))
+	e.String(field("unit_id"), "Sales")
+	e.OptionalDouble(field("amount"), ptr(120.25))
+	e.String(field("category"), "Travel")
+	e.String(field("external_ref"), "ext-7")
+	e.OptionalInt(field("vendor_id"), ptr(3))
+	e.String(field("sort"), "-createdAt")
+	e.Int(field("limit"), 50)
+	e.Int(field("offset"), 100)
+	// An optional bool set to false is a present varint 0
+	in := append(e.Bytes(), byte(field("is_finalized")<<3), 0)
+	expenses, sort, err := decodeExpenseFilter(in)
+	wantExpenses := ExpenseFilter{
+		UserID: ptr(0), UnitID: "Sales", Amount: ptr(money.Amount(12025)), Category: "Travel", ExternalRef: "ext-7",
+		VendorID: ptr(3), IsFinalized: ptr(false), ListOptions: ListOptions{Limit: 50, Offset: 100},
+	}
+	if err != nil || sort != "-createdAt" || !reflect.DeepEqual(expenses, wantExpenses) {
+		t.Errorf("ListExpenseRequestsRequest = %+v, %q, %v; want %+v", expenses, sort, err, wantExpenses)
+	}
+
+	field = fieldNumbers(t, proto, "GetExpenseRequestRequest")
+	for _, name := range []string{"doc_number", "reference", "external_ref"} {
+		e = rpc.Encoder{}
+		e.String(field(name), "X-1")
+		lookup, err := decodeExpenseLookup(e.Bytes())
+		if want := (expenseLookup{field: field(name), value: "X-1"}); err != nil || lookup != want {
+			t.Errorf("GetExpenseRequestRequest.%s = %+v, %v; want %+v", name, lookup, err, want)
+		}
+	}
+	e = rpc.Encoder{}
+	e.Int(field("id"), 7)
+	if lookup, err := decodeExpenseLookup(e.Bytes()); err != nil || lookup != (expenseLookup{field: 1, id: 7}) {
+		t.Errorf("GetExpenseRequestRequest.id = %+v, %v", lookup, err)
+	}
+
+	for _, message := range []string{"GetUserRequest", "DeleteUserRequest", "DeleteExpenseRequestRequest"} {
+		e = rpc.Encoder{}
+		e.Int(fieldNumbers(t, proto, message)("id"), 7)
+		if id, err := decodeID(e.Bytes()); err != nil || id != 7 {
+			t.Errorf("%s = %d, %v; want 7", message, id, err)
+		}
+	}
+
+	key := BudgetKey{UnitID: "Sales", Category: "Travel", Year: 2025}
+	keyField := fieldNumbers(t, proto, "BudgetKey")
+	var keyEncoder rpc.Encoder
+	keyEncoder.String(keyField("unit_id"), key.UnitID)
+	keyEncoder.String(keyField("category"), key.Category)
+	keyEncoder.Int(keyField("year"), int64(key.Year))
+	if got, err := decodeBudgetKey(keyEncoder.Bytes()); err != nil || got != key {
+		t.Errorf("BudgetKey = %+v, %v; want %+v", got, err, key)
+	}
+
+	budget := Budget{UnitID: "Sales", Category: "Travel", Year: 2025, BudgetLimit: 100050, Currency: "EUR"}
+	calls := []struct {
+		message string
+		decode  func([]byte) (budgetCall, error)
+		want    budgetCall
+	}{
+		{"CreateBudgetRequest", decodeCreateBudget, budgetCall{Budget: budget, Reason: "new"}},
+		{"UpdateBudgetRequest", decodeUpdateBudget, budgetCall{Key: key, Budget: budget, Reason: "new"}},
+		{"DeleteBudgetRequest", decodeDeleteBudget, budgetCall{Key: key, Reason: "new"}},
+	}
+	for _, tt := range calls {
+		field := fieldNumbers(t, proto, tt.message)
+		var e rpc.Encoder
+		for _, f := range proto[tt.message] {
+			switch f.name {
+			case "key":
+				e.Message(f.number, keyEncoder.Bytes())
+			case "budget":
+				e.Message(f.number, encodeBudget(budget))
+			}
+		}
+		e.String(field("reason"), "new")
+		if got, err := tt.decode(e.Bytes()); err != nil || got != tt.want {
+			t.Errorf("%s = %+v, %v; want %+v", tt.message, got, err, tt.want)
+		}
+	}
+}
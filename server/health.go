@@ -0,0 +1,153 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"main/mailer"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// healthCheckTimeout bounds each dependency check so a hanging one
+	// cannot stall the probe.
+	healthCheckTimeout = 2 * time.Second
+
+	// queueStaleAfter is how long a due email or webhook delivery may wait
+	// before its queue counts as degraded.
+	queueStaleAfter = 15 * time.Minute
+)
+
+const (
+	healthOK       = "ok"
+	healthDegraded = "degraded"
+	healthDown     = "down"
+	healthDisabled = "disabled"
+)
+
+// HealthCheck is the state of one dependency. Only critical dependencies
+// make the service unready; the others degrade it.
+type HealthCheck struct {
+	Name       string  `json:"name"`
+	Status     string  `json:"status"` // ok, degraded, down or disabled
+	Critical   bool    `json:"critical"`
+	LatencyMS  float64 `json:"latencyMS"`
+	QueueDepth *int    `json:"queueDepth,omitempty"`
+	Detail     string  `json:"detail,omitempty"`
+}
+
+// Readiness is the overall status and the checks it was derived from.
+type Readiness struct {
+	Status string        `json:"status"`
+	Checks []HealthCheck `json:"checks"`
+}
+
+// healthCheck runs a check under its own timeout and times it.
+func healthCheck(ctx context.Context, name string, critical bool, check func(ctx context.Context, c *HealthCheck) error) HealthCheck {
+	c := HealthCheck{Name: name, Status: healthOK, Critical: critical}
+	ctx, cancel := context.WithTimeout(ctx, healthCheckTimeout)
+	defer cancel()
+
+	start := time.Now()
+	err := check(ctx, &c)
+	c.LatencyMS = float64(time.Since(start).Microseconds()) / 1000
+	if err != nil {
+		log.Printf("Health check %s failed: %v", name, err)
+		c.Status = healthDown
+		if c.Detail == "" {
+			c.Detail = "check failed"
+		}
+	}
+	return c
+}
+
+// queueCheck reports the depth of a delivery queue and degrades it when the
+// oldest due item has waited longer than queueStaleAfter. pending selects
+// the queued rows' next_attempt_at.
+func (s *Server) queueCheck(pending string) func(ctx context.Context, c *HealthCheck) error {
+	return func(ctx context.Context, c *HealthCheck) error {
+		var depth int
+		var oldest *time.Time
+		err := s.DB.QueryRowContext(ctx, "SELECT COUNT(*), MIN(next_attempt_at) FROM ("+pending+") q").Scan(&depth, &oldest)
+		if err != nil {
+			return err
+		}
+		c.QueueDepth = &depth
+		if oldest != nil {
+			if waited := time.Since(*oldest); waited > queueStaleAfter {
+				c.Status = healthDegraded
+				c.Detail = "oldest item has been due for " + strconv.Itoa(int(waited.Minutes())) + " minutes"
+			}
+		}
+		return nil
+	}
+}
+
+// Healthz is the liveness probe: the process is up and serving.
+func (s *Server) Healthz(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Write([]byte("ok\n"))
+}
+
+// Readyz is the readiness probe. It answers 503 when a critical dependency
+// is down and 200 otherwise, with every dependency's status in the body.
+func (s *Server) Readyz(w http.ResponseWriter, r *http.Request) {
+	checks := []struct {
+		name     string
+		critical bool
+		run      func(ctx context.Context, c *HealthCheck) error
+	}{
+		{"database", true, func(ctx context.Context, c *HealthCheck) error {
+			return s.DB.PingContext(ctx)
+		}},
+		{"smtp", false, func(ctx context.Context, c *HealthCheck) error {
+			mail := s.Settings().Mailer
+			checker, ok := mail.(mailer.Checker)
+			if !ok {
+				c.Status = healthDisabled
+				if mail != nil {
+					// API senders are only exercised by real deliveries
+					c.Status, c.Detail = healthOK, "not an SMTP relay; see email_outbox"
+				}
+				return nil
+			}
+			return checker.Check(ctx)
+		}},
+		{"email_outbox", false, s.queueCheck(
+			"SELECT next_attempt_at FROM email_outbox WHERE sent_at IS NULL AND next_attempt_at <= NOW()")},
+		{"webhook_queue", false, s.queueCheck(
+			"SELECT next_attempt_at FROM webhook_delivery WHERE delivered_at IS NULL AND next_attempt_at <= NOW()")},
+		{"print_queue", false, s.queueCheck(
+			"SELECT next_attempt_at FROM print_job WHERE status = 'queued' AND next_attempt_at <= NOW()")},
+	}
+
+	readiness := Readiness{Status: healthOK, Checks: make([]HealthCheck, len(checks))}
+	var wg sync.WaitGroup
+	for i, check := range checks {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			readiness.Checks[i] = healthCheck(r.Context(), check.name, check.critical, check.run)
+		}()
+	}
+	wg.Wait()
+
+	status := http.StatusOK
+	for _, c := range readiness.Checks {
+		switch {
+		case c.Status == healthDown && c.Critical:
+			readiness.Status = healthDown
+			status = http.StatusServiceUnavailable
+		case (c.Status == healthDown || c.Status == healthDegraded) && readiness.Status == healthOK:
+			readiness.Status = healthDegraded
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(readiness)
+}
@@ -0,0 +1,187 @@
+package server
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	// idempotencyTTL is how long a key replays its first response. After
+	// that the key may be reused for a new request.
+	idempotencyTTL = 24 * time.Hour
+
+	maxIdempotencyKey = 255
+)
+
+type IdempotencyKey struct{}
+
+func (IdempotencyKey) CreateTableIfNotExists(s *Server) {
+	query := `CREATE TABLE IF NOT EXISTS idempotency_key (
+		key VARCHAR(255) NOT NULL,
+		scope VARCHAR(512) NOT NULL,
+		fingerprint CHAR(64) NOT NULL,
+		status_code INT,
+		content_type VARCHAR(255) NOT NULL DEFAULT '',
+		body BYTEA,
+		created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+
+		PRIMARY KEY (key, scope)
+	)`
+
+	_, err := s.DB.Exec(query)
+
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// responseRecorder copies what a handler writes so it can be replayed.
+type responseRecorder struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (rec *responseRecorder) WriteHeader(status int) {
+	if rec.status == 0 {
+		rec.status = status
+	}
+	rec.ResponseWriter.WriteHeader(status)
+}
+
+func (rec *responseRecorder) Write(b []byte) (int, error) {
+	if rec.status == 0 {
+		rec.status = http.StatusOK
+	}
+	rec.body.Write(b)
+	return rec.ResponseWriter.Write(b)
+}
+
+// IdempotencyMiddleware makes a POST safe to retry. The first request with a
+// given Idempotency-Key runs normally and its response is stored; repeats of
+// the same request within idempotencyTTL get that response back instead of
+// running again. Reusing a key for a different body is rejected, and a
+// repeat that arrives while the first is still running gets a 409.
+// Requests without the header are not affected.
+func (s *Server) IdempotencyMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get("Idempotency-Key")
+		if key == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if len(key) > maxIdempotencyKey {
+			http.Error(w, "Idempotency-Key must be at most 255 characters", http.StatusBadRequest)
+			return
+		}
+
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, "Failed to read request body", http.StatusBadRequest)
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+
+		// Keys are scoped to the endpoint and the bearer token's holder, so
+		// two clients choosing the same key do not collide
+		scope := r.Method + " " + r.URL.Path
+		if caller, err := s.authenticate(r); err == nil {
+			scope += " user:" + strconv.Itoa(caller.ID)
+		}
+		sum := sha256.Sum256(body)
+		fingerprint := hex.EncodeToString(sum[:])
+
+		ctx := r.Context()
+		// Expired keys are released first so they can be claimed again
+		_, err = s.DB.ExecContext(ctx,
+			"DELETE FROM idempotency_key WHERE key = $1 AND scope = $2 AND created_at < $3",
+			key, scope, time.Now().Add(-idempotencyTTL))
+		if err != nil {
+			log.Println("Idempotency key cleanup error:", err)
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+
+		result, err := s.DB.ExecContext(ctx, `
+			INSERT INTO idempotency_key (key, scope, fingerprint)
+			VALUES ($1, $2, $3)
+			ON CONFLICT (key, scope) DO NOTHING
+		`, key, scope, fingerprint)
+		var claimed int64
+		if err == nil {
+			claimed, err = result.RowsAffected()
+		}
+		if err != nil {
+			log.Println("Idempotency key claim error:", err)
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+
+		if claimed == 0 {
+			s.replayIdempotent(w, r, key, scope, fingerprint)
+			return
+		}
+
+		rec := &responseRecorder{ResponseWriter: w}
+		next.ServeHTTP(rec, r)
+
+		// Server errors are not final: release the key so a retry runs again.
+		// The request context may be done by now, so neither write uses it.
+		if rec.status == 0 || rec.status >= 500 {
+			if _, err := s.DB.Exec("DELETE FROM idempotency_key WHERE key = $1 AND scope = $2", key, scope); err != nil {
+				log.Println("Idempotency key release error:", err)
+			}
+			return
+		}
+		_, err = s.DB.Exec(`
+			UPDATE idempotency_key SET status_code = $3, content_type = $4, body = $5
+			WHERE key = $1 AND scope = $2
+		`, key, scope, rec.status, rec.Header().Get("Content-Type"), rec.body.Bytes())
+		if err != nil {
+			log.Println("Idempotency response store error:", err)
+		}
+	})
+}
+
+func (s *Server) replayIdempotent(w http.ResponseWriter, r *http.Request, key, scope, fingerprint string) {
+	var storedFingerprint, contentType string
+	var status sql.NullInt64
+	var body []byte
+	err := s.DB.QueryRowContext(r.Context(), `
+		SELECT fingerprint, status_code, content_type, body
+		FROM idempotency_key
+		WHERE key = $1 AND scope = $2
+	`, key, scope).Scan(&storedFingerprint, &status, &contentType, &body)
+	if err == sql.ErrNoRows {
+		// Released by a failed first attempt in the meantime
+		http.Error(w, "A request with this Idempotency-Key failed; retry it", http.StatusConflict)
+		return
+	} else if err != nil {
+		log.Println("Idempotency key lookup error:", err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	if storedFingerprint != fingerprint {
+		http.Error(w, "Idempotency-Key was already used for a different request", http.StatusUnprocessableEntity)
+		return
+	}
+	if !status.Valid {
+		http.Error(w, "A request with this Idempotency-Key is still in progress", http.StatusConflict)
+		return
+	}
+
+	if contentType != "" {
+		w.Header().Set("Content-Type", contentType)
+	}
+	w.Header().Set("Idempotent-Replayed", "true")
+	w.WriteHeader(int(status.Int64))
+	w.Write(body)
+}
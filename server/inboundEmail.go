@@ -0,0 +1,375 @@
+package server
+
+import (
+	"context"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/json"
+	"log"
+	"main/money"
+	"net/http"
+	"net/mail"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// maxInboundEmailSize bounds the webhook body; attachments arrive base64
+// encoded, so this leaves room for one full-size receipt.
+const maxInboundEmailSize = 16 << 20
+
+// amountPattern finds the first money-like number in a subject or body,
+// accepting both "45.50" and "45,50".
+var amountPattern = regexp.MustCompile(`\d+(?:[.,]\d{1,2})?`)
+
+// InboundEmail is the normalized webhook payload expected from the mail
+// provider. Attachment content is base64 encoded.
+type InboundEmail struct {
+	From        string              `json:"from"`
+	Subject     string              `json:"subject"`
+	Text        string              `json:"text"`
+	Attachments []InboundAttachment `json:"attachments"`
+}
+
+type InboundAttachment struct {
+	Filename string `json:"filename"`
+	Content  []byte `json:"content"`
+}
+
+// ExpenseDraft is an expense request proposed from an email, waiting for its
+// sender to confirm it. Amount and Category are best-effort suggestions.
+type ExpenseDraft struct {
+	ID             int           `json:"id"`
+	UserID         int           `json:"userID"`
+	Subject        string        `json:"subject"`
+	Body           string        `json:"body"`
+	Amount         *money.Amount `json:"amount"`
+	Category       *string       `json:"category"`
+	AttachmentName string        `json:"attachmentName"`
+	CreatedAt      *time.Time    `json:"createdAt,omitempty"`
+}
+
+type confirmDraftRequest struct {
+	Amount   *money.Amount `json:"amount"`
+	Category *string       `json:"category"`
+}
+
+type inboundEmailResponse struct {
+	Status  string `json:"status"`
+	DraftID int    `json:"draftID,omitempty"`
+}
+
+func (ExpenseDraft) CreateTableIfNotExists(s *Server) {
+	query := `CREATE TABLE IF NOT EXISTS expense_draft (
+		id SERIAL PRIMARY KEY,
+		user_id INT NOT NULL,
+		subject TEXT NOT NULL,
+		body TEXT NOT NULL,
+		amount NUMERIC(15,2),
+		category VARCHAR(256),
+		attachment_name VARCHAR(256) NOT NULL,
+		attachment_data BYTEA NOT NULL,
+		created_at timestamp DEFAULT NOW()
+	)`
+
+	_, err := s.DB.Exec(query)
+
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	widenAmountColumns(s, "expense_draft", "amount")
+}
+
+// suggestAmount returns the first parseable amount in the given texts.
+func suggestAmount(texts ...string) *money.Amount {
+	for _, text := range texts {
+		match := amountPattern.FindString(text)
+		if match == "" {
+			continue
+		}
+		amount, err := money.Parse(strings.Replace(match, ",", ".", 1))
+		if err == nil && amount > 0 && amount <= money.Max {
+			return &amount
+		}
+	}
+	return nil
+}
+
+// suggestCategory returns the first known category mentioned in the subject.
+func (s *Server) suggestCategory(ctx context.Context, subject string) (*string, error) {
+	var category string
+	err := s.DB.QueryRowContext(ctx, `
+		SELECT name FROM expense_category
+		WHERE POSITION(LOWER(name) IN LOWER($1)) > 0
+		ORDER BY LENGTH(name) DESC
+		LIMIT 1
+	`, subject).Scan(&category)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return &category, nil
+}
+
+func writeInboundResponse(w http.ResponseWriter, resp inboundEmailResponse) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(resp)
+}
+
+// ReceiveInboundEmail turns an email with a receipt into a draft expense
+// request for the sender. Mail that cannot be used is acknowledged anyway so
+// the provider does not keep retrying it.
+func (s *Server) ReceiveInboundEmail(w http.ResponseWriter, r *http.Request) {
+	inboundToken := s.Settings().InboundEmailToken
+	if inboundToken == "" {
+		http.Error(w, "Inbound email is not configured", http.StatusNotFound)
+		return
+	}
+	token := r.Header.Get("X-Inbound-Token")
+	if subtle.ConstantTimeCompare([]byte(token), []byte(inboundToken)) != 1 {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var email InboundEmail
+	r.Body = http.MaxBytesReader(w, r.Body, maxInboundEmailSize)
+	if err := json.NewDecoder(r.Body).Decode(&email); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+
+	from, err := mail.ParseAddress(email.From)
+	if err != nil {
+		log.Println("Inbound email with unparseable sender:", email.From)
+		writeInboundResponse(w, inboundEmailResponse{Status: "unmatched"})
+		return
+	}
+
+	var userID int
+	err = s.DB.QueryRowContext(r.Context(),
+		"SELECT id FROM users WHERE LOWER(email) = LOWER($1)", from.Address,
+	).Scan(&userID)
+	if err == sql.ErrNoRows {
+		log.Println("Inbound email from unknown sender:", from.Address)
+		writeInboundResponse(w, inboundEmailResponse{Status: "unmatched"})
+		return
+	} else if err != nil {
+		log.Println("Inbound sender lookup error:", err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	// Use the first attachment that passes the receipt checks
+	var receipt *InboundAttachment
+	for i := range email.Attachments {
+		if _, err := s.checkAttachment(email.Attachments[i].Filename, email.Attachments[i].Content); err == nil {
+			receipt = &email.Attachments[i]
+			break
+		}
+	}
+	if receipt == nil {
+		log.Println("Inbound email without a usable receipt from:", from.Address)
+		writeInboundResponse(w, inboundEmailResponse{Status: "no_receipt"})
+		return
+	}
+
+	category, err := s.suggestCategory(r.Context(), email.Subject)
+	if err != nil {
+		log.Println("Category suggestion error:", err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	var draftID int
+	err = s.DB.QueryRowContext(r.Context(), `
+		INSERT INTO expense_draft (user_id, subject, body, amount, category, attachment_name, attachment_data)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
+		RETURNING id
+	`, userID, email.Subject, email.Text, suggestAmount(email.Subject, email.Text), category,
+		receipt.Filename, receipt.Content,
+	).Scan(&draftID)
+	if err != nil {
+		log.Println("Draft insert error:", err)
+		http.Error(w, "Failed to queue draft", http.StatusInternalServerError)
+		return
+	}
+
+	writeInboundResponse(w, inboundEmailResponse{Status: "queued", DraftID: draftID})
+}
+
+func (s *Server) ListMyExpenseDrafts(w http.ResponseWriter, r *http.Request) {
+	caller, ok := s.requireCaller(w, r)
+	if !ok {
+		return
+	}
+
+	rows, err := s.DB.QueryContext(r.Context(), `
+		SELECT id, user_id, subject, body, amount, category, attachment_name, created_at
+		FROM expense_draft
+		WHERE user_id = $1
+		ORDER BY created_at DESC
+	`, caller.ID)
+	if err != nil {
+		log.Println("ListMyExpenseDrafts query error:", err)
+		http.Error(w, "Database query failed", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	drafts := []ExpenseDraft{}
+	for rows.Next() {
+		var d ExpenseDraft
+		if err := rows.Scan(&d.ID, &d.UserID, &d.Subject, &d.Body, &d.Amount, &d.Category, &d.AttachmentName, &d.CreatedAt); err != nil {
+			log.Println("Row scan error:", err)
+			http.Error(w, "Failed to scan draft", http.StatusInternalServerError)
+			return
+		}
+		drafts = append(drafts, d)
+	}
+	if err := rows.Err(); err != nil {
+		log.Println("Row iteration error:", err)
+		http.Error(w, "Row iteration error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(drafts)
+}
+
+// ConfirmExpenseDraft turns a draft into a real expense request in the
+// caller's unit, moving the receipt over in the same transaction.
+func (s *Server) ConfirmExpenseDraft(w http.ResponseWriter, r *http.Request) {
+	caller, ok := s.requireCaller(w, r)
+	if !ok {
+		return
+	}
+
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid ID", http.StatusBadRequest)
+		return
+	}
+
+	var req confirmDraftRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+
+	tx, err := s.DB.BeginTx(r.Context(), nil)
+	if err != nil {
+		log.Println("Begin transaction error:", err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	var draft ExpenseDraft
+	var data []byte
+	err = tx.QueryRowContext(r.Context(), `
+		SELECT id, amount, category, attachment_name, attachment_data
+		FROM expense_draft
+		WHERE id = $1 AND user_id = $2
+		FOR UPDATE
+	`, id, caller.ID).Scan(&draft.ID, &draft.Amount, &draft.Category, &draft.AttachmentName, &data)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Draft not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		log.Println("Draft query error:", err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	// Values sent by the user win over the suggestions parsed from the email
+	expenseRequest := ExpenseRequest{UserID: caller.ID, UnitID: caller.UnitID, Currency: s.BaseCurrency}
+	if req.Amount != nil {
+		expenseRequest.Amount = *req.Amount
+	} else if draft.Amount != nil {
+		expenseRequest.Amount = *draft.Amount
+	}
+	if req.Category != nil {
+		expenseRequest.Category = *req.Category
+	} else if draft.Category != nil {
+		expenseRequest.Category = *draft.Category
+	}
+	if !s.validate(w, r, expenseRequest) {
+		return
+	}
+	if !s.checkNotFrozen(w, r, tx, expenseRequest.UnitID, expenseRequest.Category) {
+		return
+	}
+
+	err = tx.QueryRowContext(r.Context(), `
+		INSERT INTO expense_request (user_id, unit_id, amount, category, is_finalized, currency)
+		VALUES ($1, $2, $3, $4, $5, $6)
+		RETURNING id, created_at, doc_number, reference
+	`, expenseRequest.UserID, expenseRequest.UnitID, expenseRequest.Amount, expenseRequest.Category, false, expenseRequest.Currency,
+	).Scan(&expenseRequest.ID, &expenseRequest.CreatedAt, &expenseRequest.DocNumber, &expenseRequest.Reference)
+	if err != nil {
+		log.Println("Insert error:", err)
+		http.Error(w, "Failed to create expense", http.StatusInternalServerError)
+		return
+	}
+
+	if _, err := s.saveAttachment(r.Context(), tx, expenseRequest.ID, draft.AttachmentName, data, ""); err != nil {
+		writeAttachmentError(w, err)
+		return
+	}
+
+	if _, err := tx.ExecContext(r.Context(), "DELETE FROM expense_draft WHERE id = $1", id); err != nil {
+		log.Println("Draft delete error:", err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		log.Println("Commit error:", err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	s.emitWebhook(r.Context(), WebhookExpenseCreated, expenseRequest)
+	s.addExpenseLinks(r, &expenseRequest)
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(expenseRequest)
+}
+
+func (s *Server) DiscardExpenseDraft(w http.ResponseWriter, r *http.Request) {
+	caller, ok := s.requireCaller(w, r)
+	if !ok {
+		return
+	}
+
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid ID", http.StatusBadRequest)
+		return
+	}
+
+	result, err := s.DB.ExecContext(r.Context(), "DELETE FROM expense_draft WHERE id = $1 AND user_id = $2", id, caller.ID)
+	if err != nil {
+		log.Println("Draft delete error:", err)
+		http.Error(w, "Failed to discard draft", http.StatusInternalServerError)
+		return
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		http.Error(w, "Error checking affected rows", http.StatusInternalServerError)
+		return
+	}
+	if rowsAffected == 0 {
+		http.Error(w, "Draft not found", http.StatusNotFound)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,137 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+)
+
+// QueryIndex is an index on a column list the handlers filter, join or sort
+// by. Columns is the part of CREATE INDEX after the table name.
+type QueryIndex struct {
+	Name    string `json:"name"`
+	Table   string `json:"table"`
+	Columns string `json:"columns"`
+	Serves  string `json:"serves"` // the queries that need it
+}
+
+// queryIndexes are created at startup; the unique and partial indexes that
+// enforce constraints or serve workers are created with their tables.
+var queryIndexes = []QueryIndex{
+	{"expense_activity_expense_idx", "expense_activity", "(expense_id, created_at DESC, id DESC)", "latest state and history of an expense request"},
+	{"expense_activity_created_by_idx", "expense_activity", "(created_by)", "expense activity list by createdBy"},
+	{"expense_activity_created_at_idx", "expense_activity", "(created_at)", "expense activity list by creation time"},
+	{"paid_expense_expense_idx", "paid_expense", "(expense_id)", "amount paid on an expense request"},
+	{"paid_expense_budget_period_idx", "paid_expense", "(unit_id, category, created_at)", "budget spending and thresholds"},
+	{"paid_expense_batch_idx", "paid_expense", "(batch_id)", "payments of a payment batch"},
+	{"paid_expense_created_at_idx", "paid_expense", "(created_at)", "paid expense list and reports by creation time"},
+	{"expense_request_user_idx", "expense_request", "(user_id)", "a user's expense requests"},
+	{"expense_request_unit_category_idx", "expense_request", "(unit_id, category)", "expense request list by unit and category"},
+	{"expense_request_vendor_idx", "expense_request", "(vendor_id)", "expense requests paid to a vendor"},
+	{"expense_attachment_expense_idx", "expense_attachment", "(expense_id)", "attachments of an expense request"},
+	{"expense_comment_expense_idx", "expense_comment", "(expense_id, created_at)", "discussion of an expense request"},
+	{"announcement_receiver_idx", "announcement", "(receiver_id, created_at)", "a user's announcements and unread count"},
+	{"budget_revision_budget_idx", "budget_revision", "(unit_id, category, year, created_at)", "revisions of a budget and its limit as of a date"},
+	{"budget_freeze_unit_idx", "budget_freeze", "(unit_id, category)", "freezes in force for a budget"},
+	{"users_unit_idx", "users", "(unit_id)", "user list by unit"},
+	{"unit_parent_idx", "unit", "(parent_unit)", "unit subtrees"},
+}
+
+// IndexStatus reports whether a query index is usable. An index that is
+// present but not valid is left over from a failed concurrent build.
+type IndexStatus struct {
+	QueryIndex
+	Present bool `json:"present"`
+	Valid   bool `json:"valid"`
+}
+
+// indexStatus looks up every query index in the current schema.
+func (s *Server) indexStatus(ctx context.Context) ([]IndexStatus, error) {
+	rows, err := s.DB.QueryContext(ctx, `
+		SELECT c.relname, i.indisvalid
+		FROM pg_index i
+		JOIN pg_class c ON c.oid = i.indexrelid
+		WHERE c.relnamespace = current_schema()::regnamespace
+	`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	valid := map[string]bool{}
+	for rows.Next() {
+		var name string
+		var ok bool
+		if err := rows.Scan(&name, &ok); err != nil {
+			return nil, err
+		}
+		valid[name] = ok
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	statuses := make([]IndexStatus, len(queryIndexes))
+	for i, index := range queryIndexes {
+		ok, present := valid[index.Name]
+		statuses[i] = IndexStatus{QueryIndex: index, Present: present, Valid: ok}
+	}
+	return statuses, nil
+}
+
+// CreateQueryIndexes builds the query indexes that are missing or invalid,
+// one at a time and concurrently so writes go on meanwhile, then logs any
+// that are still not usable. The queries work without them, only slower, so
+// a failure is logged rather than fatal.
+func (s *Server) CreateQueryIndexes(ctx context.Context) {
+	statuses, err := s.indexStatus(ctx)
+	if err != nil {
+		log.Println("Index check error:", err)
+		return
+	}
+
+	for _, status := range statuses {
+		if status.Valid {
+			continue
+		}
+		if status.Present {
+			if _, err := s.DB.ExecContext(ctx, "DROP INDEX CONCURRENTLY IF EXISTS "+status.Name); err != nil {
+				log.Println("Dropping invalid index", status.Name, "failed:", err)
+				continue
+			}
+		}
+		log.Println("Creating index", status.Name)
+		if _, err := s.DB.ExecContext(ctx, "CREATE INDEX CONCURRENTLY IF NOT EXISTS "+status.Name+" ON "+status.Table+" "+status.Columns); err != nil {
+			log.Println("Creating index", status.Name, "failed:", err)
+		}
+	}
+
+	statuses, err = s.indexStatus(ctx)
+	if err != nil {
+		log.Println("Index check error:", err)
+		return
+	}
+	for _, status := range statuses {
+		if !status.Valid {
+			log.Printf("Index %s on %s %s is not usable, slowing down: %s", status.Name, status.Table, status.Columns, status.Serves)
+		}
+	}
+}
+
+// AdminIndexes lists the query indexes and whether each is usable.
+func (s *Server) AdminIndexes(w http.ResponseWriter, r *http.Request) {
+	if _, ok := s.requireRole(w, r, Admin); !ok {
+		return
+	}
+
+	statuses, err := s.indexStatus(r.Context())
+	if err != nil {
+		log.Println("Index check error:", err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(statuses)
+}
@@ -0,0 +1,321 @@
+package server
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"main/query"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	jobPollInterval = 5 * time.Second
+	// jobTimeout bounds one run of a job. A job still marked running after
+	// jobLease lost its worker, e.g. to a crash, and is picked up again.
+	jobTimeout         = 5 * time.Minute
+	jobLease           = 2 * jobTimeout
+	jobMaxAttempts     = 5
+	jobRetryBase       = 30 * time.Second
+	jobListDefaultSize = 100
+)
+
+// Job states.
+const (
+	JobQueued  = "queued"
+	JobRunning = "running"
+	JobDone    = "done"
+	JobFailed  = "failed" // gave up after its max attempts
+)
+
+// Job kinds, each run by its entry in jobHandlers.
+const (
+	JobAnnouncementEmail = "announcement.email"
+	JobBudgetCheck       = "budget.check"
+)
+
+// jobHandler runs one job of a kind with its payload. A job whose handler
+// returns an error is retried with backoff, so handlers must be safe to
+// run again.
+type jobHandler func(s *Server, ctx context.Context, payload json.RawMessage) error
+
+var jobHandlers = map[string]jobHandler{
+	JobAnnouncementEmail: (*Server).runAnnouncementEmailJob,
+	JobBudgetCheck:       (*Server).runBudgetCheckJob,
+}
+
+// Job is a piece of work done in the background by the job workers, such as
+// emailing every receiver of an announcement. Jobs are kept in the database,
+// so they survive a restart and several instances share them.
+type Job struct {
+	ID          int             `json:"id"`
+	Kind        string          `json:"kind"`
+	UniqueKey   *string         `json:"uniqueKey,omitempty"` // set on jobs that must be queued only once
+	Payload     json.RawMessage `json:"payload"`
+	Status      string          `json:"status"`
+	Attempts    int             `json:"attempts"`
+	MaxAttempts int             `json:"maxAttempts"`
+	RunAt       time.Time       `json:"runAt"` // when it is due, or retried
+	LockedAt    *time.Time      `json:"lockedAt,omitempty"`
+	LastError   string          `json:"lastError,omitempty"`
+	CreatedAt   time.Time       `json:"createdAt"`
+	FinishedAt  *time.Time      `json:"finishedAt,omitempty"`
+}
+
+func (Job) CreateTableIfNotExists(s *Server) {
+	query := `CREATE TABLE IF NOT EXISTS job (
+		id SERIAL PRIMARY KEY,
+		kind VARCHAR(64) NOT NULL,
+		payload JSONB NOT NULL DEFAULT '{}',
+		status VARCHAR(16) NOT NULL DEFAULT 'queued' CHECK (status IN ('queued', 'running', 'done', 'failed')),
+		attempts INT NOT NULL DEFAULT 0,
+		max_attempts INT NOT NULL DEFAULT 5,
+		run_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+		locked_at TIMESTAMPTZ,
+		last_error TEXT NOT NULL DEFAULT '',
+		created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+		finished_at TIMESTAMPTZ
+	);
+	CREATE INDEX IF NOT EXISTS job_due_idx ON job (run_at) WHERE status = 'queued';
+	CREATE INDEX IF NOT EXISTS job_running_idx ON job (locked_at) WHERE status = 'running';
+	CREATE INDEX IF NOT EXISTS job_status_idx ON job (status, created_at)`
+
+	_, err := s.DB.Exec(query)
+
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	_, err = s.DB.Exec("ALTER TABLE job ADD COLUMN IF NOT EXISTS unique_key VARCHAR(128) UNIQUE")
+
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+func jobFields(j *Job) []query.Field {
+	return []query.Field{
+		{Column: "id", Target: &j.ID},
+		{Column: "kind", Target: &j.Kind},
+		{Column: "unique_key", Target: &j.UniqueKey},
+		{Column: "payload", Target: &j.Payload},
+		{Column: "status", Target: &j.Status},
+		{Column: "attempts", Target: &j.Attempts},
+		{Column: "max_attempts", Target: &j.MaxAttempts},
+		{Column: "run_at", Target: &j.RunAt},
+		{Column: "locked_at", Target: &j.LockedAt},
+		{Column: "last_error", Target: &j.LastError},
+		{Column: "created_at", Target: &j.CreatedAt},
+		{Column: "finished_at", Target: &j.FinishedAt},
+	}
+}
+
+var jobColumns = query.Columns(jobFields(&Job{}))
+
+func scanJob(row rowScanner) (Job, error) {
+	var j Job
+	err := row.Scan(query.Targets(jobFields(&j))...)
+	return j, err
+}
+
+// enqueueJob queues a job of kind to run at runAt, or at once when runAt is
+// zero, in the caller's transaction if db is one, so the job only exists
+// when the change that asked for it commits.
+func enqueueJob(ctx context.Context, db dbtx, kind string, payload any, runAt time.Time) (int, error) {
+	return insertJob(ctx, db, kind, nil, payload, runAt)
+}
+
+// enqueueJobOnce is enqueueJob for work that must be queued only once, such
+// as a nightly run that every instance schedules. It returns 0 when a job
+// with key was queued before, even if that job has finished since.
+func enqueueJobOnce(ctx context.Context, db dbtx, kind, key string, payload any, runAt time.Time) (int, error) {
+	id, err := insertJob(ctx, db, kind, &key, payload, runAt)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	return id, err
+}
+
+func insertJob(ctx context.Context, db dbtx, kind string, key *string, payload any, runAt time.Time) (int, error) {
+	if _, ok := jobHandlers[kind]; !ok {
+		return 0, fmt.Errorf("no handler for job kind %q", kind)
+	}
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return 0, err
+	}
+	if runAt.IsZero() {
+		runAt = time.Now()
+	}
+	var id int
+	err = db.QueryRowContext(ctx, `
+		INSERT INTO job (kind, unique_key, payload, max_attempts, run_at) VALUES ($1, $2, $3, $4, $5)
+		ON CONFLICT (unique_key) DO NOTHING
+		RETURNING id
+	`, kind, key, body, jobMaxAttempts, runAt).Scan(&id)
+	return id, err
+}
+
+// claimJob marks the next due job running and returns it, or sql.ErrNoRows
+// when none is due. Rows locked by another worker's claim are skipped, so
+// workers on several instances never run the same job twice at once.
+func (s *Server) claimJob(ctx context.Context) (Job, error) {
+	return scanJob(s.DB.QueryRowContext(ctx, `
+		UPDATE job SET status = 'running', locked_at = NOW(), attempts = attempts + 1
+		WHERE id = (
+			SELECT id FROM job
+			WHERE (status = 'queued' AND run_at <= NOW()) OR (status = 'running' AND locked_at < $1)
+			ORDER BY run_at, id
+			LIMIT 1
+			FOR UPDATE SKIP LOCKED
+		)
+		RETURNING `+jobColumns, time.Now().Add(-jobLease)))
+}
+
+// runJob runs a claimed job with its handler, turning a panic into an
+// error so that one bad job does not take its worker down.
+func (s *Server) runJob(ctx context.Context, j Job) (err error) {
+	handler, ok := jobHandlers[j.Kind]
+	if !ok {
+		return fmt.Errorf("no handler for job kind %q", j.Kind)
+	}
+	defer func() {
+		if p := recover(); p != nil {
+			err = fmt.Errorf("panic: %v", p)
+		}
+	}()
+	runCtx, cancel := context.WithTimeout(ctx, jobTimeout)
+	defer cancel()
+	return handler(s, runCtx, j.Payload)
+}
+
+// RunNextJob claims and runs the next due job. It reports whether there
+// was one, so workers can keep going while the queue is busy.
+func (s *Server) RunNextJob(ctx context.Context) (bool, error) {
+	j, err := s.claimJob(ctx)
+	if err == sql.ErrNoRows {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+
+	runErr := s.runJob(ctx, j)
+	// The outcome is stored even when shutdown cut the run short, so the job
+	// is retried without waiting out its lease
+	ctx = context.WithoutCancel(ctx)
+	if runErr == nil {
+		_, err = s.DB.ExecContext(ctx,
+			"UPDATE job SET status = 'done', last_error = '', locked_at = NULL, finished_at = NOW() WHERE id = $1", j.ID)
+		return true, err
+	}
+
+	log.Printf("Job %d (%s) failed on attempt %d: %v", j.ID, j.Kind, j.Attempts, runErr)
+	_, known := jobHandlers[j.Kind]
+	if known && j.Attempts < j.MaxAttempts {
+		next := time.Now().Add(jobRetryBase << (j.Attempts - 1))
+		_, err = s.DB.ExecContext(ctx,
+			"UPDATE job SET status = 'queued', last_error = $2, locked_at = NULL, run_at = $3 WHERE id = $1",
+			j.ID, runErr.Error(), next)
+	} else {
+		_, err = s.DB.ExecContext(ctx,
+			"UPDATE job SET status = 'failed', last_error = $2, locked_at = NULL, finished_at = NOW() WHERE id = $1",
+			j.ID, runErr.Error())
+	}
+	return true, err
+}
+
+// RunJobWorkers runs n workers that take due jobs off the queue until ctx
+// is cancelled, and returns once they all stopped. A worker that finds the
+// queue empty waits jobPollInterval before looking again.
+func (s *Server) RunJobWorkers(ctx context.Context, n int) {
+	var wg sync.WaitGroup
+	for range n {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s.runJobWorker(ctx)
+		}()
+	}
+	wg.Wait()
+}
+
+func (s *Server) runJobWorker(ctx context.Context) {
+	ticker := time.NewTicker(jobPollInterval)
+	defer ticker.Stop()
+
+	for {
+		ran, err := s.RunNextJob(ctx)
+		if err != nil && ctx.Err() == nil {
+			log.Println("Job worker error:", err)
+		}
+		if ran && err == nil {
+			continue
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// ListJobs returns background jobs, newest first, for inspecting the queue
+// and why jobs failed.
+func (s *Server) ListJobs(w http.ResponseWriter, r *http.Request) {
+	if _, ok := s.requireRole(w, r, Admin); !ok {
+		return
+	}
+	opts, ok := listOptions(w, r, nil)
+	if !ok {
+		return
+	}
+	if opts.Limit == 0 {
+		opts.Limit = jobListDefaultSize
+	}
+
+	queryParams := r.URL.Query()
+	status := queryParams.Get("status")
+	switch status {
+	case "", JobQueued, JobRunning, JobDone, JobFailed:
+	default:
+		http.Error(w, "status must be queued, running, done or failed", http.StatusBadRequest)
+		return
+	}
+	statement, args := query.From("job", jobColumns).
+		WhereIf(status != "", "status = ?", status).
+		WhereIf(queryParams.Get("kind") != "", "kind = ?", queryParams.Get("kind")).
+		OrderBy("created_at DESC", "id DESC").
+		Page(opts.Limit, opts.Offset).
+		SQL()
+
+	rows, err := s.DB.QueryContext(r.Context(), statement, args...)
+	if err != nil {
+		log.Println("ListJobs query error:", err)
+		http.Error(w, "Database query failed", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	jobs := []Job{}
+	for rows.Next() {
+		j, err := scanJob(rows)
+		if err != nil {
+			log.Println("Row scan error:", err)
+			http.Error(w, "Failed to read job", http.StatusInternalServerError)
+			return
+		}
+		jobs = append(jobs, j)
+	}
+	if err := rows.Err(); err != nil {
+		log.Println("Row iteration error:", err)
+		http.Error(w, "Error reading results", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(jobs)
+}
@@ -0,0 +1,62 @@
+package server
+
+import (
+	"log"
+	"main/naming"
+	"net/http"
+	"time"
+)
+
+// legacyNamesSunset ends the deprecation window in which the snake_case
+// query parameters used before the naming policy are still understood.
+var legacyNamesSunset = time.Date(2027, time.April, 1, 0, 0, 0, 0, time.UTC)
+
+// LegacyQueryMiddleware translates the deprecated snake_case spelling of a
+// route's query parameters, e.g. unit_id for unitID, until
+// legacyNamesSunset. Responses to requests that used one carry Deprecation
+// and Sunset headers, so clients can find out before the window closes.
+func LegacyQueryMiddleware(query []string, next http.Handler) http.Handler {
+	legacy := map[string]string{}
+	for _, name := range query {
+		if old := naming.Legacy(name); old != name {
+			legacy[old] = name
+		}
+	}
+	if len(legacy) == 0 {
+		return next
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if time.Now().After(legacyNamesSunset) || r.URL.RawQuery == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		params := r.URL.Query()
+		var used []string
+		for old, name := range legacy {
+			values, ok := params[old]
+			if !ok {
+				continue
+			}
+			used = append(used, old)
+			delete(params, old)
+			// The current name wins when a client sends both
+			if _, ok := params[name]; !ok {
+				params[name] = values
+			}
+		}
+		if len(used) == 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		log.Printf("Deprecated query parameters %v on %s %s", used, r.Method, r.URL.Path)
+		w.Header().Set("Deprecation", "true")
+		w.Header().Set("Sunset", legacyNamesSunset.Format(http.TimeFormat))
+
+		r2 := r.Clone(r.Context())
+		r2.URL.RawQuery = params.Encode()
+		next.ServeHTTP(w, r2)
+	})
+}
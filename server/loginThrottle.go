@@ -0,0 +1,364 @@
+package server
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"log"
+	"net/http"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// LoginLockoutPolicy is how many failed logins in a row lock a login name,
+// and for how long. A zero Threshold disables the lockout; the backoff
+// between attempts applies regardless.
+type LoginLockoutPolicy struct {
+	Threshold int
+	Duration  time.Duration
+}
+
+const (
+	// Failed logins are counted per login name and per client address. A
+	// streak is forgotten after loginFailureWindow without a failure.
+	loginFailureWindow = time.Hour
+
+	// After this many failures in a row each further attempt waits twice
+	// as long as the one before, from loginBackoffBase up to
+	// loginBackoffMax. Addresses get more, since users behind one proxy or
+	// NAT share theirs.
+	nameBackoffAfter    = 3
+	addressBackoffAfter = 10
+	loginBackoffBase    = time.Second
+	loginBackoffMax     = 15 * time.Minute
+
+	// addressAlertFailures failures in a row from one address, against any
+	// names, are recorded in the audit log as a likely password guessing
+	// run.
+	addressAlertFailures = 20
+)
+
+// The kinds of subject failed logins are counted against.
+const (
+	loginByName    = "name"
+	loginByAddress = "address"
+)
+
+// LoginFailure is the streak of failed logins of a name or an address.
+type LoginFailure struct {
+	Kind         string     `json:"kind"`
+	Subject      string     `json:"subject"`
+	Failures     int        `json:"failures"`
+	LastFailedAt time.Time  `json:"lastFailedAt"`
+	LockedUntil  *time.Time `json:"lockedUntil,omitempty"`
+	RetryAt      time.Time  `json:"retryAt"`
+}
+
+func (LoginFailure) CreateTableIfNotExists(s *Server) {
+	query := `CREATE TABLE IF NOT EXISTS login_failure (
+		kind VARCHAR(16) NOT NULL,
+		subject TEXT NOT NULL,
+		failures INT NOT NULL,
+		last_failed_at TIMESTAMPTZ NOT NULL,
+		locked_until TIMESTAMPTZ,
+		PRIMARY KEY (kind, subject)
+	)`
+
+	_, err := s.DB.Exec(query)
+
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// loginBackoff is how long after its last failure a name or address with
+// failures in a row has to wait before the next attempt.
+func loginBackoff(kind string, failures int) time.Duration {
+	after := nameBackoffAfter
+	if kind == loginByAddress {
+		after = addressBackoffAfter
+	}
+	if failures < after {
+		return 0
+	}
+	backoff := loginBackoffBase
+	for i := after; i < failures && backoff < loginBackoffMax; i++ {
+		backoff *= 2
+	}
+	return min(backoff, loginBackoffMax)
+}
+
+// retryAt is when the next login attempt is let through.
+func (f LoginFailure) retryAt() time.Time {
+	retry := f.LastFailedAt.Add(loginBackoff(f.Kind, f.Failures))
+	if f.LockedUntil != nil && f.LockedUntil.After(retry) {
+		return *f.LockedUntil
+	}
+	return retry
+}
+
+// loginAttempt is a login claimed by claimLoginAttempt. It counts as a
+// failure of its name and address from the moment it is claimed, so
+// attempts made at the same time see each other, until it is settled.
+type loginAttempt struct {
+	name, address   string
+	nameFailures    int
+	addressFailures int
+}
+
+// claimLoginAttempt reports how long a login of name from address has to
+// wait, and whether that is because the name is locked. When it need not
+// wait, the attempt is counted as failed before the password is checked:
+// the rows of the name and the address are locked while they are read and
+// counted, so concurrent attempts cannot all pass the same check. Settle
+// the attempt with loginFailed, loginSucceeded or releaseLoginAttempt.
+func (s *Server) claimLoginAttempt(ctx context.Context, name, address string) (loginAttempt, time.Duration, bool, error) {
+	attempt := loginAttempt{name: name, address: address}
+	tx, err := s.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return attempt, 0, false, err
+	}
+	defer tx.Rollback()
+
+	// Names are locked before addresses, so two attempts never wait on
+	// each other's rows
+	var wait time.Duration
+	var locked bool
+	now := time.Now()
+	for _, kind := range []string{loginByName, loginByAddress} {
+		subject := name
+		if kind == loginByAddress {
+			subject = address
+		}
+		f, err := scanLoginFailure(tx.QueryRowContext(ctx, `
+			INSERT INTO login_failure (kind, subject, failures, last_failed_at) VALUES ($1, $2, 0, NOW())
+			ON CONFLICT (kind, subject) DO UPDATE SET kind = login_failure.kind
+			RETURNING kind, subject, failures, last_failed_at, locked_until
+		`, kind, subject))
+		if err != nil {
+			return attempt, 0, false, err
+		}
+		if d := f.RetryAt.Sub(now); d > wait {
+			wait = d
+		}
+		if f.LockedUntil != nil && f.LockedUntil.After(now) {
+			locked = true
+		}
+	}
+	if wait > 0 {
+		// Rolled back: a turned away attempt is not counted
+		return attempt, wait, locked, nil
+	}
+
+	count := func(kind, subject string) (int, error) {
+		var failures int
+		err := tx.QueryRowContext(ctx, `
+			UPDATE login_failure SET
+				failures = CASE WHEN last_failed_at < NOW() - $3 * INTERVAL '1 second'
+					THEN 1 ELSE failures + 1 END,
+				last_failed_at = NOW()
+			WHERE kind = $1 AND subject = $2
+			RETURNING failures
+		`, kind, subject, loginFailureWindow.Seconds()).Scan(&failures)
+		return failures, err
+	}
+	if attempt.nameFailures, err = count(loginByName, name); err != nil {
+		return attempt, 0, false, err
+	}
+	if attempt.addressFailures, err = count(loginByAddress, address); err != nil {
+		return attempt, 0, false, err
+	}
+	return attempt, 0, false, tx.Commit()
+}
+
+func scanLoginFailure(row rowScanner) (LoginFailure, error) {
+	var f LoginFailure
+	var lockedUntil sql.NullTime
+	if err := row.Scan(&f.Kind, &f.Subject, &f.Failures, &f.LastFailedAt, &lockedUntil); err != nil {
+		return f, err
+	}
+	if lockedUntil.Valid {
+		f.LockedUntil = &lockedUntil.Time
+	}
+	f.RetryAt = f.retryAt()
+	return f, nil
+}
+
+// loginFailed settles an attempt whose credentials were wrong. The name is
+// locked once its streak reaches the lockout threshold, which starts the
+// streak over, and an address reaching addressAlertFailures is recorded in
+// the audit log. Entries the server records on its own have actor 0.
+func (s *Server) loginFailed(ctx context.Context, attempt loginAttempt) error {
+	tx, err := s.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if policy := s.LoginLockout; policy.Threshold > 0 && attempt.nameFailures >= policy.Threshold {
+		var lockedUntil time.Time
+		err := tx.QueryRowContext(ctx, `
+			UPDATE login_failure SET failures = 0, locked_until = NOW() + $3 * INTERVAL '1 second'
+			WHERE kind = $1 AND subject = $2
+			RETURNING locked_until
+		`, loginByName, attempt.name, policy.Duration.Seconds()).Scan(&lockedUntil)
+		if err != nil {
+			return err
+		}
+		if err := audit(ctx, tx, 0, "auth.lockout", map[string]any{
+			"name": attempt.name, "address": attempt.address, "failures": attempt.nameFailures, "lockedUntil": lockedUntil,
+		}); err != nil {
+			return err
+		}
+	}
+	if attempt.addressFailures == addressAlertFailures {
+		if err := audit(ctx, tx, 0, "auth.suspicious_address", map[string]any{
+			"address": attempt.address, "failures": attempt.addressFailures, "lastName": attempt.name,
+		}); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// loginSucceeded ends the streak of the attempt's name and takes the
+// attempt off its address. The address keeps the rest of its streak, so
+// one valid account does not let an address go on guessing the passwords
+// of others.
+func (s *Server) loginSucceeded(ctx context.Context, attempt loginAttempt) error {
+	if _, err := s.DB.ExecContext(ctx, "DELETE FROM login_failure WHERE kind = $1 AND subject = $2", loginByName, attempt.name); err != nil {
+		return err
+	}
+	return uncountLoginAttempt(ctx, s.DB, loginByAddress, attempt.address)
+}
+
+// releaseLoginAttempt takes back an attempt that ended before the
+// credentials could be judged, as when the directory is down.
+func (s *Server) releaseLoginAttempt(ctx context.Context, attempt loginAttempt) error {
+	if err := uncountLoginAttempt(ctx, s.DB, loginByName, attempt.name); err != nil {
+		return err
+	}
+	return uncountLoginAttempt(ctx, s.DB, loginByAddress, attempt.address)
+}
+
+func uncountLoginAttempt(ctx context.Context, db dbtx, kind, subject string) error {
+	_, err := db.ExecContext(ctx, `
+		UPDATE login_failure SET failures = failures - 1
+		WHERE kind = $1 AND subject = $2 AND failures > 0
+	`, kind, subject)
+	return err
+}
+
+// writeLoginBlocked answers 429 with Retry-After in seconds.
+func writeLoginBlocked(w http.ResponseWriter, wait time.Duration, locked bool) {
+	seconds := int((wait + time.Second - 1) / time.Second)
+	w.Header().Set("Retry-After", strconv.Itoa(seconds))
+	if locked {
+		http.Error(w, "Account locked after too many failed logins", http.StatusTooManyRequests)
+		return
+	}
+	http.Error(w, "Too many failed logins", http.StatusTooManyRequests)
+}
+
+// ListLoginLockouts lists the names and addresses that are locked or have
+// to wait before their next login attempt, soonest let through first.
+func (s *Server) ListLoginLockouts(w http.ResponseWriter, r *http.Request) {
+	if _, ok := s.requireRole(w, r, Admin); !ok {
+		return
+	}
+
+	// Backoffs never outlast loginBackoffMax, so older streaks have none left
+	rows, err := s.DB.QueryContext(r.Context(), `
+		SELECT kind, subject, failures, last_failed_at, locked_until FROM login_failure
+		WHERE locked_until > NOW() OR last_failed_at > NOW() - $1 * INTERVAL '1 second'
+	`, loginBackoffMax.Seconds())
+	if err != nil {
+		log.Println("Login lockout query error:", err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	lockouts := []LoginFailure{}
+	now := time.Now()
+	for rows.Next() {
+		f, err := scanLoginFailure(rows)
+		if err != nil {
+			log.Println("Login lockout scan error:", err)
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		if f.RetryAt.After(now) {
+			lockouts = append(lockouts, f)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		log.Println("Login lockout rows error:", err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	slices.SortFunc(lockouts, func(a, b LoginFailure) int { return a.RetryAt.Compare(b.RetryAt) })
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(lockouts)
+}
+
+// UnlockUser lifts the lockout and backoff of a user's login name, as after
+// the user proved who they are some other way.
+func (s *Server) UnlockUser(w http.ResponseWriter, r *http.Request) {
+	caller, ok := s.requireRole(w, r, Admin)
+	if !ok {
+		return
+	}
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid ID", http.StatusBadRequest)
+		return
+	}
+	user, err := s.Users.Get(r.Context(), id)
+	if err != nil {
+		writeStoreError(w, err, "User not found")
+		return
+	}
+
+	tx, err := s.DB.BeginTx(r.Context(), nil)
+	if err != nil {
+		log.Println("Transaction error:", err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	var failures int
+	var lockedUntil sql.NullTime
+	err = tx.QueryRowContext(r.Context(),
+		"DELETE FROM login_failure WHERE kind = $1 AND subject = $2 RETURNING failures, locked_until",
+		loginByName, user.Name).Scan(&failures, &lockedUntil)
+	if err == sql.ErrNoRows {
+		// Nothing to lift
+		w.WriteHeader(http.StatusNoContent)
+		return
+	} else if err != nil {
+		log.Println("Unlock error:", err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	detail := map[string]any{"userID": id, "failures": failures}
+	if lockedUntil.Valid {
+		detail["lockedUntil"] = lockedUntil.Time
+	}
+	if err := audit(r.Context(), tx, caller.ID, "users.unlock", detail); err != nil {
+		log.Println("Audit error:", err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		log.Println("Commit error:", err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
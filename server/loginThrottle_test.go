@@ -0,0 +1,67 @@
+package server
+
+import (
+	"database/sql/driver"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLoginBackoff(t *testing.T) {
+	tests := []struct {
+		kind     string
+		failures int
+		want     time.Duration
+	}{
+		{loginByName, 2, 0},
+		{loginByName, 3, time.Second},
+		{loginByName, 4, 2 * time.Second},
+		{loginByName, 12, 512 * time.Second},
+		{loginByName, 40, loginBackoffMax},
+		{loginByAddress, 9, 0},
+		{loginByAddress, 10, time.Second},
+		{loginByAddress, 11, 2 * time.Second},
+	}
+	for _, tt := range tests {
+		if got := loginBackoff(tt.kind, tt.failures); got != tt.want {
+			t.Errorf("loginBackoff(%s, %d) = %v, want %v", tt.kind, tt.failures, got, tt.want)
+		}
+	}
+}
+
+func TestLoginThrottled(t *testing.T) {
+	ts := newTestServer(t, []string{"Sales"}, nil)
+	now := time.Now()
+	var counted, checked bool
+	// The name has failed 4 times in a row, the last just now
+	ts.db.answer("INSERT INTO login_failure", func(args []driver.Value) [][]driver.Value {
+		failures := int64(0)
+		if args[0] == loginByName {
+			failures = 4
+		}
+		return [][]driver.Value{{args[0], args[1], failures, now, nil}}
+	})
+	ts.db.answer("UPDATE login_failure", func([]driver.Value) [][]driver.Value {
+		counted = true
+		return nil
+	})
+	ts.db.answer("FROM users", func([]driver.Value) [][]driver.Value {
+		checked = true
+		return nil
+	})
+
+	w := serve(ts.Login, "POST", "/login", nil, "", `{"name": "accountant", "password": "guess"}`)
+	if w.Code != http.StatusTooManyRequests {
+		t.Fatalf("status = %d, want %d: %s", w.Code, http.StatusTooManyRequests, w.Body)
+	}
+	if got := w.Header().Get("Retry-After"); got != "2" {
+		t.Errorf("Retry-After = %q, want 2", got)
+	}
+	if strings.Contains(w.Body.String(), "locked") {
+		t.Errorf("a backoff is reported as a lockout: %s", w.Body)
+	}
+	if counted || checked {
+		t.Errorf("a throttled attempt was counted (%v) or had its password checked (%v)", counted, checked)
+	}
+}
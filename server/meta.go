@@ -0,0 +1,78 @@
+package server
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"slices"
+)
+
+// expenseStates lists every state in workflow order.
+var expenseStates = []ExpenseState{Draft, Pending, CategoryChanged, Approved, Rejected, PartiallyPaid, Paid, Withdrawn}
+
+// expenseStateGuards names the policies checked before a request may enter a
+// state, on top of the transition table.
+var expenseStateGuards = map[ExpenseState][]string{
+	Approved: {"approval_chain", "budget_freeze"},
+}
+
+// Any role may submit and withdraw its own requests, with POST
+// /expense_requests/{id}/submit and /withdraw rather than an activity.
+var (
+	requesterRoles = []UserRole{FieldPersonnel, Manager, Accounter, Admin}
+	submitGuards   = []string{"requester", "budget_freeze", "user_limit"}
+	withdrawGuards = []string{"requester", "unpaid"}
+)
+
+type StateDefinition struct {
+	Name  ExpenseState `json:"name"`
+	Final bool         `json:"final"`
+}
+
+type TransitionDefinition struct {
+	From   ExpenseState `json:"from"` // empty for a request without activity
+	To     ExpenseState `json:"to"`
+	Roles  []UserRole   `json:"roles"`
+	Guards []string     `json:"guards,omitempty"`
+}
+
+// ExpenseStateMachine is the machine-readable form of expenseTransitions.
+type ExpenseStateMachine struct {
+	Initial     ExpenseState           `json:"initial"`
+	States      []StateDefinition      `json:"states"`
+	Transitions []TransitionDefinition `json:"transitions"`
+}
+
+func expenseStateMachine() ExpenseStateMachine {
+	machine := ExpenseStateMachine{States: []StateDefinition{}, Transitions: []TransitionDefinition{}}
+
+	for _, st := range expenseStates {
+		machine.States = append(machine.States, StateDefinition{Name: st, Final: len(expenseTransitions[st]) == 0})
+	}
+
+	for _, from := range slices.Insert(slices.Clone(expenseStates), 0, "") {
+		for _, to := range expenseTransitions[from] {
+			transition := TransitionDefinition{
+				From:   from,
+				To:     to,
+				Roles:  expenseStateRoles[to],
+				Guards: expenseStateGuards[to],
+			}
+			switch {
+			case to == Withdrawn:
+				transition.Roles, transition.Guards = requesterRoles, withdrawGuards
+			case from == Draft:
+				transition.Roles, transition.Guards = requesterRoles, submitGuards
+			}
+			machine.Transitions = append(machine.Transitions, transition)
+		}
+	}
+	return machine
+}
+
+func (s *Server) ExpenseStates(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	if err := json.NewEncoder(w).Encode(expenseStateMachine()); err != nil {
+		log.Println("JSON encoding error:", err)
+	}
+}
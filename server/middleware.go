@@ -0,0 +1,24 @@
+package server
+
+import (
+	"context"
+	"net/http"
+)
+
+// RequestTimeoutMiddleware bounds a request's context by RequestTimeout. It is
+// applied to every route except streams.
+// Handlers pass r.Context() to the database, so queries are cancelled when
+// the deadline passes or the client disconnects.
+func (s *Server) RequestTimeoutMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		timeout := s.Settings().RequestTimeout
+		if timeout <= 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(r.Context(), timeout)
+		defer cancel()
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
@@ -0,0 +1,141 @@
+package server
+
+import (
+	"encoding/json"
+	"log"
+	"main/money"
+	"net/http"
+	"time"
+)
+
+type ExpenseAction string
+
+const (
+	AwaitingSubmission ExpenseAction = "AwaitingSubmission"
+	AwaitingReview     ExpenseAction = "AwaitingReview"
+	AwaitingApproval   ExpenseAction = "AwaitingApproval"
+	AwaitingPayment    ExpenseAction = "AwaitingPayment"
+	NoAction           ExpenseAction = "None"
+)
+
+// MyExpenseRequest is one of the caller's requests with its workflow status
+// denormalized into the same row.
+type MyExpenseRequest struct {
+	ExpenseRequest
+	LatestState    *ExpenseState `json:"latestState"`
+	StateChangedAt *time.Time    `json:"stateChangedAt,omitempty"`
+	TotalPaid      money.Amount  `json:"totalPaid"`
+	NextAction     ExpenseAction `json:"nextAction"`
+}
+
+// nextExpectedAction derives what the request is waiting on from its latest
+// activity state and how much has been paid so far.
+func nextExpectedAction(state *ExpenseState, amount, paid money.Amount) ExpenseAction {
+	if state == nil {
+		return AwaitingReview
+	}
+
+	switch *state {
+	case Draft:
+		return AwaitingSubmission
+	case Pending, CategoryChanged:
+		return AwaitingApproval
+	case Approved, PartiallyPaid:
+		if paid >= amount {
+			return NoAction
+		}
+		return AwaitingPayment
+	default:
+		return NoAction
+	}
+}
+
+func (s *Server) ListMyExpenseRequests(w http.ResponseWriter, r *http.Request) {
+	caller, ok := s.requireCaller(w, r)
+	if !ok {
+		return
+	}
+	delegated, err := delegatedUnits(r.Context(), s.DB, caller.ID)
+	if err != nil {
+		log.Println("Delegation lookup error:", err)
+	}
+
+	// Latest activity and payment total per request, in one round trip
+	query := `
+		SELECT er.id, er.user_id, er.unit_id, er.amount, er.category, er.created_at, er.is_finalized, er.currency,
+			er.doc_number, er.reference, er.external_ref, la.current_state, la.created_at, COALESCE(pe.total, 0)
+		FROM expense_request er
+		LEFT JOIN LATERAL (
+			SELECT current_state, created_at
+			FROM expense_activity ea
+			WHERE ea.expense_id = er.id
+			ORDER BY ea.created_at DESC, ea.id DESC
+			LIMIT 1
+		) la ON true
+		LEFT JOIN (
+			SELECT expense_id, SUM(amount) AS total
+			FROM paid_expense
+			GROUP BY expense_id
+		) pe ON pe.expense_id = er.id
+		WHERE er.user_id = $1
+		ORDER BY er.created_at DESC
+	`
+
+	rows, err := s.DB.QueryContext(r.Context(), query, caller.ID)
+	if err != nil {
+		http.Error(w, "Failed to fetch expense requests", http.StatusInternalServerError)
+		log.Printf("Query error: %v", err)
+		return
+	}
+	defer rows.Close()
+
+	requests := []MyExpenseRequest{}
+	for rows.Next() {
+		var req MyExpenseRequest
+		err := rows.Scan(
+			&req.ID,
+			&req.UserID,
+			&req.UnitID,
+			&req.Amount,
+			&req.Category,
+			&req.CreatedAt,
+			&req.IsFinalized,
+			&req.Currency,
+			&req.DocNumber,
+			&req.Reference,
+			&req.ExternalRef,
+			&req.LatestState,
+			&req.StateChangedAt,
+			&req.TotalPaid,
+		)
+		if err != nil {
+			http.Error(w, "Failed to read expense request", http.StatusInternalServerError)
+			log.Printf("Scan error: %v", err)
+			return
+		}
+		req.NextAction = nextExpectedAction(req.LatestState, req.Amount, req.TotalPaid)
+		requests = append(requests, req)
+	}
+
+	if err := rows.Err(); err != nil {
+		http.Error(w, "Error reading rows", http.StatusInternalServerError)
+		log.Printf("Rows error: %v", err)
+		return
+	}
+
+	ids := make([]int, len(requests))
+	for i, req := range requests {
+		ids[i] = req.ID
+	}
+	chains, err := s.approvalChains(r.Context(), s.DB, ids)
+	if err != nil {
+		log.Println("Approval chain query error:", err)
+	}
+	for i := range requests {
+		req := &requests[i]
+		req.Links = expenseLinks(req.ExpenseRequest, req.LatestState, req.TotalPaid, chains[req.ID], &caller, delegated)
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(requests)
+}
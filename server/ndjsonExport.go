@@ -0,0 +1,45 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// ndjsonExport streams list results as newline-delimited JSON, one object
+// per line, while the rows are being read, so a large export never sits in
+// memory. Like csvExport it sends the headers with the first row.
+type ndjsonExport struct {
+	w    http.ResponseWriter
+	enc  *json.Encoder
+	rows int
+}
+
+func newNDJSONExport(w http.ResponseWriter) *ndjsonExport {
+	return &ndjsonExport{w: w, enc: json.NewEncoder(w)}
+}
+
+func (e *ndjsonExport) start() {
+	e.w.Header().Set("Content-Type", "application/x-ndjson")
+	e.w.WriteHeader(http.StatusOK)
+}
+
+func (e *ndjsonExport) write(v any) error {
+	if e.rows == 0 {
+		e.start()
+	}
+	if err := e.enc.Encode(v); err != nil {
+		return err
+	}
+	e.rows++
+	if e.rows%exportFlushEvery == 0 {
+		http.NewResponseController(e.w).Flush()
+	}
+	return nil
+}
+
+// close sends the headers of an export without rows.
+func (e *ndjsonExport) close() {
+	if e.rows == 0 {
+		e.start()
+	}
+}
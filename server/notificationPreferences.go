@@ -0,0 +1,284 @@
+package server
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"log"
+	"net/http"
+	"time"
+	_ "time/tzdata" // users may pick any IANA zone, whatever the host has installed
+
+	"github.com/lib/pq"
+)
+
+const (
+	minDigestMinutes = 15
+	maxDigestMinutes = 24 * 60
+)
+
+// NotificationPreferences control when a user's non-urgent notification
+// emails go out. Emails that arrive during quiet hours, or between digests,
+// are held and sent together as one digest. Announcements and the event
+// stream are never delayed.
+type NotificationPreferences struct {
+	TimeZone      string     `json:"timeZone"`             // IANA name such as Europe/Istanbul; UTC when empty
+	QuietStart    string     `json:"quietStart,omitempty"` // local HH:MM; quiet hours may span midnight
+	QuietEnd      string     `json:"quietEnd,omitempty"`
+	DigestMinutes int        `json:"digestMinutes"` // 0 sends each email as it happens
+	LastDigestAt  *time.Time `json:"lastDigestAt,omitempty"`
+}
+
+func (NotificationPreferences) CreateTableIfNotExists(s *Server) {
+	query := `CREATE TABLE IF NOT EXISTS notification_preference (
+		user_id INT PRIMARY KEY,
+		time_zone VARCHAR(64) NOT NULL DEFAULT 'UTC',
+		quiet_start VARCHAR(5) NOT NULL DEFAULT '',
+		quiet_end VARCHAR(5) NOT NULL DEFAULT '',
+		digest_minutes INT NOT NULL DEFAULT 0,
+		last_digest_at TIMESTAMPTZ
+	);
+	CREATE TABLE IF NOT EXISTS held_notification (
+		id SERIAL PRIMARY KEY,
+		user_id INT NOT NULL,
+		kind VARCHAR(64) NOT NULL,
+		message TEXT NOT NULL,
+		created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+	);
+	CREATE INDEX IF NOT EXISTS held_notification_user_idx ON held_notification (user_id, created_at)`
+
+	_, err := s.DB.Exec(query)
+
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+func (p NotificationPreferences) Validate(ctx context.Context, s *Server) (FieldErrors, error) {
+	errs := FieldErrors{}
+	if _, err := time.LoadLocation(p.TimeZone); err != nil {
+		errs.add("timeZone", "must be an IANA time zone such as Europe/Istanbul")
+	}
+	if (p.QuietStart == "") != (p.QuietEnd == "") {
+		errs.add("quietEnd", "quietStart and quietEnd must be set together")
+	}
+	if p.QuietStart != "" {
+		if _, err := time.Parse("15:04", p.QuietStart); err != nil {
+			errs.add("quietStart", "must be a time such as 22:00")
+		}
+		if _, err := time.Parse("15:04", p.QuietEnd); err != nil {
+			errs.add("quietEnd", "must be a time such as 07:00")
+		}
+		if p.QuietStart == p.QuietEnd {
+			errs.add("quietEnd", "must differ from quietStart")
+		}
+	}
+	if p.DigestMinutes != 0 && (p.DigestMinutes < minDigestMinutes || p.DigestMinutes > maxDigestMinutes) {
+		errs.add("digestMinutes", "must be 0 or between 15 and 1440")
+	}
+	return errs, nil
+}
+
+// quietAt reports whether t falls within the quiet hours.
+func (p NotificationPreferences) quietAt(t time.Time) bool {
+	if p.QuietStart == "" {
+		return false
+	}
+	if loc, err := time.LoadLocation(p.TimeZone); err == nil {
+		t = t.In(loc)
+	}
+	// Zero-padded HH:MM compares correctly as a string
+	now := t.Format("15:04")
+	if p.QuietStart < p.QuietEnd {
+		return now >= p.QuietStart && now < p.QuietEnd
+	}
+	return now >= p.QuietStart || now < p.QuietEnd
+}
+
+// digestDue reports whether held emails may be sent at t.
+func (p NotificationPreferences) digestDue(t time.Time) bool {
+	if p.quietAt(t) {
+		return false
+	}
+	return p.DigestMinutes == 0 || p.LastDigestAt == nil ||
+		t.Sub(*p.LastDigestAt) >= time.Duration(p.DigestMinutes)*time.Minute
+}
+
+// notificationPreferences returns a user's preferences, or the defaults of
+// sending everything at once when they have none.
+func notificationPreferences(ctx context.Context, db dbtx, userID int) (NotificationPreferences, error) {
+	p := NotificationPreferences{TimeZone: "UTC"}
+	err := db.QueryRowContext(ctx, `
+		SELECT time_zone, quiet_start, quiet_end, digest_minutes, last_digest_at
+		FROM notification_preference
+		WHERE user_id = $1
+	`, userID).Scan(&p.TimeZone, &p.QuietStart, &p.QuietEnd, &p.DigestMinutes, &p.LastDigestAt)
+	if err == sql.ErrNoRows {
+		return p, nil
+	}
+	return p, err
+}
+
+// holdNotification stores a non-urgent email for the user's next digest when
+// they are in quiet hours or receive digests. It reports whether it did.
+func (s *Server) holdNotification(ctx context.Context, db dbtx, userID int, kind, message string) (bool, error) {
+	p, err := notificationPreferences(ctx, db, userID)
+	if err != nil {
+		return false, err
+	}
+	if p.DigestMinutes == 0 && !p.quietAt(time.Now()) {
+		return false, nil
+	}
+	_, err = db.ExecContext(ctx,
+		"INSERT INTO held_notification (user_id, kind, message) VALUES ($1, $2, $3)", userID, kind, message)
+	return err == nil, err
+}
+
+// DeliverDigests bundles the held emails of every user whose digest is due
+// into one email each.
+func (s *Server) DeliverDigests(ctx context.Context) error {
+	rows, err := s.DB.QueryContext(ctx, "SELECT DISTINCT user_id FROM held_notification")
+	if err != nil {
+		return err
+	}
+	var users []int
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return err
+		}
+		users = append(users, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	now := time.Now()
+	for _, userID := range users {
+		p, err := notificationPreferences(ctx, s.DB, userID)
+		if err != nil {
+			return err
+		}
+		if !p.digestDue(now) {
+			continue
+		}
+		if err := s.sendDigest(ctx, userID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *Server) sendDigest(ctx context.Context, userID int) error {
+	tx, err := s.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// Skipping locked rows lets another instance finish a digest it started
+	rows, err := tx.QueryContext(ctx, `
+		SELECT id, message FROM held_notification
+		WHERE user_id = $1
+		ORDER BY created_at, id
+		FOR UPDATE SKIP LOCKED
+	`, userID)
+	if err != nil {
+		return err
+	}
+	var ids []int64
+	var data emailData
+	for rows.Next() {
+		var id int64
+		var message string
+		if err := rows.Scan(&id, &message); err != nil {
+			rows.Close()
+			return err
+		}
+		ids = append(ids, id)
+		data.Messages = append(data.Messages, message)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	if len(ids) == 0 {
+		return nil
+	}
+
+	var recipient string
+	err = tx.QueryRowContext(ctx, "SELECT name, email FROM users WHERE id = $1", userID).Scan(&data.Name, &recipient)
+	if err != nil && err != sql.ErrNoRows {
+		return err
+	}
+	// Held emails of users who were deleted or lost their address are dropped
+	if recipient != "" {
+		if err := insertEmail(ctx, tx, recipient, EmailDigest, data); err != nil {
+			return err
+		}
+	}
+
+	if _, err := tx.ExecContext(ctx, "DELETE FROM held_notification WHERE id = ANY($1)", pq.Array(ids)); err != nil {
+		return err
+	}
+	_, err = tx.ExecContext(ctx, "UPDATE notification_preference SET last_digest_at = NOW() WHERE user_id = $1", userID)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (s *Server) GetMyNotificationPreferences(w http.ResponseWriter, r *http.Request) {
+	caller, ok := s.requireCaller(w, r)
+	if !ok {
+		return
+	}
+
+	p, err := notificationPreferences(r.Context(), s.DB, caller.ID)
+	if err != nil {
+		log.Println("Notification preferences query error:", err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(p)
+}
+
+func (s *Server) PutMyNotificationPreferences(w http.ResponseWriter, r *http.Request) {
+	caller, ok := s.requireCaller(w, r)
+	if !ok {
+		return
+	}
+
+	var p NotificationPreferences
+	if err := json.NewDecoder(r.Body).Decode(&p); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+	if p.TimeZone == "" {
+		p.TimeZone = "UTC"
+	}
+
+	if !s.validate(w, r, p) {
+		return
+	}
+
+	err := s.DB.QueryRowContext(r.Context(), `
+		INSERT INTO notification_preference (user_id, time_zone, quiet_start, quiet_end, digest_minutes)
+		VALUES ($1, $2, $3, $4, $5)
+		ON CONFLICT (user_id) DO UPDATE SET time_zone = EXCLUDED.time_zone, quiet_start = EXCLUDED.quiet_start,
+			quiet_end = EXCLUDED.quiet_end, digest_minutes = EXCLUDED.digest_minutes
+		RETURNING last_digest_at
+	`, caller.ID, p.TimeZone, p.QuietStart, p.QuietEnd, p.DigestMinutes).Scan(&p.LastDigestAt)
+	if err != nil {
+		log.Println("Upsert notification preferences error:", err)
+		http.Error(w, "Failed to store notification preferences", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(p)
+}
@@ -0,0 +1,398 @@
+package server
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"main/budgetrules"
+	"main/money"
+	"main/query"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// systemSender is the created_by of announcements the server sends on its own.
+const systemSender = 0
+
+// sendAnnouncement stores a message for one receiver, pushes it to their live
+// streams and queues an email of the given kind about it. db must not be an
+// uncommitted transaction, or streams could see a message that never was.
+func (s *Server) sendAnnouncement(ctx context.Context, db dbtx, senderID int, receiverID int, message, kind string) error {
+	a := Announcement{Message: message, ReceiverID: receiverID, CreatedBy: senderID}
+	err := db.QueryRowContext(ctx,
+		"INSERT INTO announcement (message, receiver_id, created_by) VALUES ($1, $2, $3) RETURNING id, created_at",
+		message, receiverID, senderID).Scan(&a.ID, &a.CreatedAt)
+	if err != nil {
+		return err
+	}
+	s.publish(Event{Type: EventAnnouncement, UserID: receiverID, Data: a})
+	return s.queueEmail(ctx, db, receiverID, kind, message)
+}
+
+// notifyRequester tells the owner of an expense request that it changed,
+// with an email of the given kind. Failures are logged rather than returned:
+// the change itself already happened and must not be reported as failed.
+func (s *Server) notifyRequester(ctx context.Context, expenseID, senderID int, kind, event string) {
+	var req ExpenseRequest
+	err := s.DB.QueryRowContext(ctx,
+		"SELECT id, user_id, amount, category, currency FROM expense_request WHERE id = $1", expenseID,
+	).Scan(&req.ID, &req.UserID, &req.Amount, &req.Category, &req.Currency)
+	if err != nil {
+		log.Println("Notification lookup error:", err)
+		return
+	}
+	if req.UserID == senderID {
+		return
+	}
+
+	message := fmt.Sprintf("Your expense request #%d (%s, %s %s) %s", req.ID, req.Category, req.Amount, req.Currency, event)
+	if err := s.sendAnnouncement(ctx, s.DB, senderID, req.UserID, message, kind); err != nil {
+		log.Println("Notification insert error:", err)
+	}
+}
+
+// BudgetThresholdEvent is the webhook payload sent when spending uses up a
+// budget's limit or goes over limit plus threshold.
+type BudgetThresholdEvent struct {
+	UnitID   string             `json:"unitID"`
+	Category string             `json:"category"`
+	Year     int                `json:"year"`
+	Alert    budgetrules.Alert  `json:"alert"`
+	Status   budgetrules.Status `json:"status"`
+	Spent    money.Amount       `json:"spent"`
+	Limit    money.Amount       `json:"limit"`
+	Max      money.Amount       `json:"max"`
+	Currency string             `json:"currency"`
+}
+
+// notifyBudgetThreshold tells the unit's managers and the accountants when a
+// payment uses up its budget or takes it over limit plus threshold. Like
+// notifyRequester it only logs failures.
+func (s *Server) notifyBudgetThreshold(ctx context.Context, payment PaidExpense, senderID int) {
+	if payment.CreatedAt == nil {
+		return
+	}
+	year, err := fiscalYear(ctx, s.DB, *payment.CreatedAt, payment.UnitID)
+	if err != nil {
+		log.Println("Fiscal year lookup error:", err)
+		return
+	}
+	key := BudgetKey{payment.UnitID, payment.Category, year}
+
+	var limit *money.Amount
+	var ratio float64
+	var spent money.Amount
+	err = s.DB.QueryRowContext(ctx, `
+		SELECT `+s.inBaseCurrency("b.budget_limit", "b.currency", "CURRENT_DATE")+`, b.threshold_ratio,
+			COALESCE(SUM(`+s.inBaseCurrency("pe.amount", "pe.currency", "pe.created_at::date")+`), 0)
+		FROM budget b
+		LEFT JOIN paid_expense pe
+			ON pe.unit_id = b.unit_id
+			AND pe.category = b.expense_category
+			AND fiscal_year(pe.created_at, pe.unit_id) = b.year
+		WHERE b.unit_id = $1 AND b.expense_category = $2 AND b.year = $3
+		GROUP BY b.budget_limit, b.currency, b.threshold_ratio
+	`, key.UnitID, key.Category, key.Year).Scan(&limit, &ratio, &spent)
+	if err == sql.ErrNoRows || (err == nil && limit == nil) {
+		// No budget, or no rate to compare against
+		return
+	} else if err != nil {
+		log.Println("Budget threshold lookup error:", err)
+		return
+	}
+
+	headroom := budgetrules.Compute(
+		budgetrules.Budget{Limit: *limit, ThresholdRatio: ratio},
+		spent,
+		s.conversionRounding(ctx).Round,
+	)
+	if err := s.raiseBudgetAlerts(ctx, key, headroom, senderID); err != nil {
+		log.Println("Budget alert error:", err)
+	}
+}
+
+// activityNotice is the text and email kind sent to the requester when an
+// activity moves their request into a state. States without an entry are
+// not notified.
+func activityNotice(a ExpenseActivity) (event, kind string, ok bool) {
+	kind = EmailExpenseUpdate
+	switch a.CurrentState {
+	case Approved:
+		event = "was approved."
+	case Rejected:
+		event = "was rejected."
+		kind = EmailExpenseRejected
+	case PartiallyPaid:
+		event = "was partially paid."
+	case Paid:
+		event = "was paid."
+	default:
+		return "", "", false
+	}
+	if a.Feedback != "" {
+		event += " Feedback: " + a.Feedback
+	}
+	return event, kind, true
+}
+
+// callerID is the authenticated caller's ID, or systemSender.
+func (s *Server) callerID(r *http.Request) int {
+	if caller, err := s.authenticate(r); err == nil {
+		return caller.ID
+	}
+	return systemSender
+}
+
+// AnnouncementRead records that a user read an announcement. Announcements
+// to a unit, a role or everyone are read by each receiver separately.
+type AnnouncementRead struct {
+	AnnouncementID int       `json:"announcementID"`
+	UserID         int       `json:"userID"`
+	ReadAt         time.Time `json:"readAt"`
+}
+
+func (AnnouncementRead) CreateTableIfNotExists(s *Server) {
+	query := `CREATE TABLE IF NOT EXISTS announcement_read (
+		announcement_id INT NOT NULL REFERENCES announcement (id) ON DELETE CASCADE,
+		user_id INT NOT NULL,
+		read_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+
+		PRIMARY KEY (user_id, announcement_id)
+	)`
+
+	_, err := s.DB.Exec(query)
+
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// Announcements kept their receiver's read time before they could have
+	// more than one receiver
+	_, err = s.DB.Exec(`DO $$
+	BEGIN
+		IF EXISTS (SELECT 1 FROM information_schema.columns
+			WHERE table_schema = current_schema() AND table_name = 'announcement' AND column_name = 'read_at') THEN
+			INSERT INTO announcement_read (announcement_id, user_id, read_at)
+			SELECT id, receiver_id, read_at FROM announcement WHERE read_at IS NOT NULL AND receiver_id <> 0
+			ON CONFLICT DO NOTHING;
+			ALTER TABLE announcement DROP COLUMN read_at;
+		END IF;
+	END $$`)
+
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// visibleToCaller is the condition for the announcements row a that the
+// caller, whose ID, unit and role are $1 to $3, receives.
+var visibleToCaller = announcementVisibleTo("a", "$1", "$2", "$3")
+
+func (s *Server) ListMyAnnouncements(w http.ResponseWriter, r *http.Request) {
+	caller, ok := s.requireCaller(w, r)
+	if !ok {
+		return
+	}
+
+	statement := "SELECT " + announcementColumns + `, ar.read_at
+		FROM announcement a
+		LEFT JOIN announcement_read ar ON ar.announcement_id = a.id AND ar.user_id = $1
+		WHERE ` + visibleToCaller
+	switch r.URL.Query().Get("unread") {
+	case "", "false":
+	case "true":
+		statement += " AND ar.read_at IS NULL"
+	default:
+		http.Error(w, "unread must be true or false", http.StatusBadRequest)
+		return
+	}
+	statement += " ORDER BY a.created_at DESC, a.id DESC"
+
+	rows, err := s.DB.QueryContext(r.Context(), statement, caller.ID, caller.UnitID, caller.RoleID)
+	if err != nil {
+		log.Println("ListMyAnnouncements query error:", err)
+		http.Error(w, "Database query failed", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	announcements := []Announcement{}
+	for rows.Next() {
+		var a Announcement
+		if err := rows.Scan(append(query.Targets(announcementFields(&a)), &a.ReadAt)...); err != nil {
+			log.Println("Row scan error:", err)
+			http.Error(w, "Failed to read announcement", http.StatusInternalServerError)
+			return
+		}
+		announcements = append(announcements, a)
+	}
+	if err := rows.Err(); err != nil {
+		log.Println("Row iteration error:", err)
+		http.Error(w, "Error reading results", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(announcements)
+}
+
+type UnreadCount struct {
+	Unread int `json:"unread"`
+}
+
+func (s *Server) UnreadAnnouncementCount(w http.ResponseWriter, r *http.Request) {
+	caller, ok := s.requireCaller(w, r)
+	if !ok {
+		return
+	}
+
+	var count UnreadCount
+	err := s.DB.QueryRowContext(r.Context(), `
+		SELECT COUNT(*) FROM announcement a
+		WHERE `+visibleToCaller+`
+			AND NOT EXISTS (SELECT 1 FROM announcement_read ar WHERE ar.announcement_id = a.id AND ar.user_id = $1)
+	`, caller.ID, caller.UnitID, caller.RoleID).Scan(&count.Unread)
+	if err != nil {
+		log.Println("Unread count query error:", err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(count)
+}
+
+// MarkAnnouncementRead marks one of the caller's announcements as read.
+// Marking an already read announcement keeps its original read time.
+func (s *Server) MarkAnnouncementRead(w http.ResponseWriter, r *http.Request) {
+	caller, ok := s.requireCaller(w, r)
+	if !ok {
+		return
+	}
+
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid ID", http.StatusBadRequest)
+		return
+	}
+
+	visible, err := s.exists(r.Context(),
+		"SELECT 1 FROM announcement a WHERE "+visibleToCaller+" AND a.id = $4", caller.ID, caller.UnitID, caller.RoleID, id)
+	if err != nil {
+		log.Println("Mark announcement read error:", err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	if !visible {
+		http.Error(w, "Announcement not found", http.StatusNotFound)
+		return
+	}
+	_, err = s.DB.ExecContext(r.Context(), `
+		INSERT INTO announcement_read (announcement_id, user_id) VALUES ($1, $2)
+		ON CONFLICT DO NOTHING
+	`, id, caller.ID)
+	if err != nil {
+		log.Println("Mark announcement read error:", err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) MarkAllAnnouncementsRead(w http.ResponseWriter, r *http.Request) {
+	caller, ok := s.requireCaller(w, r)
+	if !ok {
+		return
+	}
+
+	_, err := s.DB.ExecContext(r.Context(), `
+		INSERT INTO announcement_read (announcement_id, user_id)
+		SELECT a.id, $1 FROM announcement a WHERE `+visibleToCaller+`
+		ON CONFLICT DO NOTHING
+	`, caller.ID, caller.UnitID, caller.RoleID)
+	if err != nil {
+		log.Println("Mark all announcements read error:", err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// AnnouncementReceipt is one receiver of an announcement and when they read
+// it, nil while unread.
+type AnnouncementReceipt struct {
+	UserID int        `json:"userID"`
+	Name   string     `json:"name"`
+	ReadAt *time.Time `json:"readAt"`
+}
+
+// ListAnnouncementReceipts tells its sender, or an Admin, which receivers
+// of an announcement have read it. Receivers through a unit or role are
+// its current members.
+func (s *Server) ListAnnouncementReceipts(w http.ResponseWriter, r *http.Request) {
+	caller, ok := s.requireCaller(w, r)
+	if !ok {
+		return
+	}
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid ID", http.StatusBadRequest)
+		return
+	}
+
+	var createdBy int
+	err = s.DB.QueryRowContext(r.Context(), "SELECT created_by FROM announcement WHERE id = $1", id).Scan(&createdBy)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Announcement not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		log.Println("Announcement lookup error:", err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	if caller.ID != createdBy && caller.RoleID != Admin {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	rows, err := s.DB.QueryContext(r.Context(), `
+		SELECT u.id, u.name, ar.read_at
+		FROM announcement a
+		JOIN users u ON `+announcementVisibleTo("a", "u.id", "u.unit_id", "u.role_id")+`
+		LEFT JOIN announcement_read ar ON ar.announcement_id = a.id AND ar.user_id = u.id
+		WHERE a.id = $1
+		ORDER BY ar.read_at NULLS LAST, u.name, u.id
+	`, id)
+	if err != nil {
+		log.Println("Announcement receipts query error:", err)
+		http.Error(w, "Database query failed", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	receipts := []AnnouncementReceipt{}
+	for rows.Next() {
+		var receipt AnnouncementReceipt
+		if err := rows.Scan(&receipt.UserID, &receipt.Name, &receipt.ReadAt); err != nil {
+			log.Println("Row scan error:", err)
+			http.Error(w, "Failed to read receipt", http.StatusInternalServerError)
+			return
+		}
+		receipts = append(receipts, receipt)
+	}
+	if err := rows.Err(); err != nil {
+		log.Println("Row iteration error:", err)
+		http.Error(w, "Error reading results", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(receipts)
+}
@@ -0,0 +1,192 @@
+package server
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log"
+	"main/oidc"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// oidcLoginTTL is how long a user has to sign in at the provider after
+// GET /oidc/login.
+const oidcLoginTTL = 10 * time.Minute
+
+// OIDCMapping says how the claims of an ID token become a user.
+type OIDCMapping struct {
+	NameClaim   string // the login name, e.g. preferred_username
+	GroupsClaim string // the values Rules match, e.g. groups or realm_access.roles
+	// Rules map groups to roles and units; their UnitAttribute names a claim
+	Rules ProvisioningRules
+	// PostLoginURL is where the browser goes after signing in, with the
+	// tokens in the URL fragment. Empty answers the callback with JSON.
+	PostLoginURL string
+}
+
+// OIDCLoginState is a sign-in in progress at the provider. Only a hash of
+// the state is kept, as the state is all the callback presents.
+type OIDCLoginState struct{}
+
+func (OIDCLoginState) CreateTableIfNotExists(s *Server) {
+	query := `CREATE TABLE IF NOT EXISTS oidc_login (
+		state_hash CHAR(64) PRIMARY KEY,
+		nonce VARCHAR(64) NOT NULL,
+		code_verifier VARCHAR(128) NOT NULL,
+		created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+	)`
+
+	_, err := s.DB.Exec(query)
+
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// OIDCLogin sends the browser to the provider to sign in.
+func (s *Server) OIDCLogin(w http.ResponseWriter, r *http.Request) {
+	if s.OIDC == nil {
+		http.Error(w, "Single sign-on is not configured", http.StatusNotFound)
+		return
+	}
+
+	var values [3]string
+	for i := range values {
+		value, err := newOpaqueToken()
+		if err != nil {
+			log.Println("Token error:", err)
+			http.Error(w, "Failed to start sign-in", http.StatusInternalServerError)
+			return
+		}
+		values[i] = value
+	}
+	state, nonce, verifier := values[0], values[1], values[2]
+
+	target, err := s.OIDC.AuthCodeURL(r.Context(), state, nonce, verifier)
+	if err != nil {
+		log.Println("OIDC provider error:", err)
+		http.Error(w, "Identity provider unavailable", http.StatusServiceUnavailable)
+		return
+	}
+	_, err = s.DB.ExecContext(r.Context(),
+		"INSERT INTO oidc_login (state_hash, nonce, code_verifier) VALUES ($1, $2, $3)",
+		hashToken(state), nonce, verifier)
+	if err != nil {
+		log.Println("OIDC login error:", err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, r, target, http.StatusFound)
+}
+
+// OIDCCallback completes a sign-in: it redeems the code the provider sent
+// the browser back with, provisions the user from the ID token and starts
+// a session like Login does.
+func (s *Server) OIDCCallback(w http.ResponseWriter, r *http.Request) {
+	if s.OIDC == nil {
+		http.Error(w, "Single sign-on is not configured", http.StatusNotFound)
+		return
+	}
+	query := r.URL.Query()
+	if reason := query.Get("error"); reason != "" {
+		log.Println("OIDC sign-in refused:", reason, query.Get("error_description"))
+		http.Error(w, "Sign-in refused by the identity provider", http.StatusUnauthorized)
+		return
+	}
+	state, code := query.Get("state"), query.Get("code")
+	if state == "" || code == "" {
+		http.Error(w, "Missing state or code", http.StatusBadRequest)
+		return
+	}
+
+	// Each state is good for one callback
+	var nonce, verifier string
+	err := s.DB.QueryRowContext(r.Context(), `
+		DELETE FROM oidc_login
+		WHERE state_hash = $1 AND created_at > NOW() - $2 * INTERVAL '1 second'
+		RETURNING nonce, code_verifier
+	`, hashToken(state), oidcLoginTTL.Seconds()).Scan(&nonce, &verifier)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Unknown or expired sign-in, please start again", http.StatusBadRequest)
+		return
+	} else if err != nil {
+		log.Println("OIDC login error:", err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	claims, err := s.OIDC.Exchange(r.Context(), code, nonce, verifier)
+	if err != nil {
+		log.Println("OIDC token error:", err)
+		http.Error(w, "Sign-in failed", http.StatusUnauthorized)
+		return
+	}
+	user, err := s.provisionOIDCUser(r.Context(), claims)
+	if errors.Is(err, errUnauthorized) {
+		http.Error(w, "Invalid credentials", http.StatusUnauthorized)
+		return
+	} else if err != nil {
+		log.Println("OIDC provisioning error:", err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	response, err := s.issueLogin(r, user, "")
+	if err != nil {
+		log.Println("Login error:", err)
+		http.Error(w, "Failed to issue token", http.StatusInternalServerError)
+		return
+	}
+
+	if s.OIDCMapping.PostLoginURL != "" {
+		// The fragment never reaches servers or their logs
+		fragment := url.Values{
+			"token":            {response.Token},
+			"expiresAt":        {response.ExpiresAt.Format(time.RFC3339)},
+			"refreshToken":     {response.RefreshToken},
+			"refreshExpiresAt": {response.RefreshExpiresAt.Format(time.RFC3339)},
+			"sessionID":        {strconv.Itoa(response.SessionID)},
+		}
+		http.Redirect(w, r, s.OIDCMapping.PostLoginURL+"#"+fragment.Encode(), http.StatusFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(response)
+}
+
+// provisionOIDCUser creates or updates the local user of an ID token. Users
+// are linked by issuer and subject; a local user who already has the name
+// is not taken over, since providers let users pick their own names.
+func (s *Server) provisionOIDCUser(ctx context.Context, claims oidc.Claims) (User, error) {
+	mapping := s.OIDCMapping
+	subject := claims.String("iss") + "|" + claims.String("sub")
+	name := claims.String(mapping.NameClaim)
+	if name == "" {
+		log.Printf("OIDC user %s has no %s claim, refusing the login", subject, mapping.NameClaim)
+		return User{}, errUnauthorized
+	}
+	// Only addresses the provider checked are taken; Azure AD leaves
+	// email_verified out
+	email := claims.String("email")
+	if verified, ok := claims["email_verified"].(bool); ok && !verified {
+		email = ""
+	}
+
+	role, unit, err := s.roleAndUnit(ctx, mapping.Rules, "OIDC user "+subject,
+		claims.Strings(mapping.GroupsClaim), claims.String(mapping.Rules.UnitAttribute))
+	if err != nil {
+		return User{}, err
+	}
+	return s.provisionUser(ctx, externalUser{
+		column: "oidc_subject",
+		id:     subject,
+		name:   name,
+		email:  email,
+		role:   role,
+		unit:   unit,
+	})
+}
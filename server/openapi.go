@@ -0,0 +1,266 @@
+package server
+
+import (
+	_ "embed"
+	"encoding/json"
+	"log"
+	"main/money"
+	"main/naming"
+	"net/http"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//go:embed docs.html
+var docsPage []byte
+
+// pathParam matches mux path variables, optionally carrying a pattern such
+// as {id:[0-9]+}.
+var pathParam = regexp.MustCompile(`\{([^}:]+)(?::([^}]+))?\}`)
+
+var timeType = reflect.TypeOf(time.Time{})
+
+// amountType is sent as a number with at most two decimals.
+var amountType = reflect.TypeOf(money.Amount(0))
+
+// openAPIDocument builds the OpenAPI 3 document from the route table.
+func openAPIDocument(routes []Route) map[string]any {
+	components := map[string]any{}
+	paths := map[string]map[string]any{}
+
+	for _, route := range routes {
+		params := []any{}
+		for _, match := range pathParam.FindAllStringSubmatch(route.Path, -1) {
+			schema := map[string]any{"type": "string"}
+			if match[2] != "" {
+				schema["pattern"] = "^" + match[2] + "$"
+			}
+			params = append(params, map[string]any{
+				"name":     match[1],
+				"in":       "path",
+				"required": true,
+				"schema":   schema,
+			})
+		}
+		for _, name := range route.Query {
+			params = append(params, map[string]any{
+				"name":   name,
+				"in":     "query",
+				"schema": map[string]any{"type": "string"},
+			})
+			if old := naming.Legacy(name); old != name {
+				params = append(params, map[string]any{
+					"name":        old,
+					"in":          "query",
+					"deprecated":  true,
+					"description": "Old spelling of " + name + ", accepted until " + legacyNamesSunset.Format(time.DateOnly),
+					"schema":      map[string]any{"type": "string"},
+				})
+			}
+		}
+		if !route.Unversioned && !route.Stream {
+			params = append(params, map[string]any{
+				"name":        "envelope",
+				"in":          "query",
+				"description": "true wraps a JSON response as {data, meta, links}, with paging metadata and links to related resources",
+				"schema":      map[string]any{"type": "boolean"},
+			})
+		}
+		if route.Versioned {
+			params = append(params, map[string]any{
+				"name":        "If-Match",
+				"in":          "header",
+				"required":    true,
+				"description": "ETag from a previous GET; a stale one fails with 412",
+				"schema":      map[string]any{"type": "string"},
+			})
+		}
+		if route.Conditional {
+			params = append(params, map[string]any{
+				"name":        "If-None-Match",
+				"in":          "header",
+				"description": "ETag from a previous GET; answered with 304 while it is current",
+				"schema":      map[string]any{"type": "string"},
+			}, map[string]any{
+				"name":        "If-Modified-Since",
+				"in":          "header",
+				"description": "Last-Modified from a previous GET; answered with 304 while nothing has changed since. If-None-Match takes precedence",
+				"schema":      map[string]any{"type": "string"},
+			})
+		}
+		if route.Idempotent {
+			params = append(params, map[string]any{
+				"name":        "Idempotency-Key",
+				"in":          "header",
+				"description": "Retries with the same key within 24 hours replay the first response",
+				"schema":      map[string]any{"type": "string", "maxLength": maxIdempotencyKey},
+			})
+		}
+
+		status := route.Status
+		if status == 0 {
+			status = http.StatusOK
+		}
+		success := map[string]any{"description": http.StatusText(status)}
+		if route.Response != nil {
+			contentType := "application/json"
+			if route.Stream {
+				contentType = "text/event-stream"
+			}
+			success["content"] = map[string]any{
+				contentType: map[string]any{
+					"schema": schemaFor(reflect.TypeOf(route.Response), components),
+				},
+			}
+		}
+
+		responses := map[string]any{
+			strconv.Itoa(status): success,
+			"default": map[string]any{
+				"description": "Error message",
+				"content": map[string]any{
+					"text/plain": map[string]any{"schema": map[string]any{"type": "string"}},
+				},
+			},
+		}
+		if route.Conditional {
+			responses[strconv.Itoa(http.StatusNotModified)] = map[string]any{"description": http.StatusText(http.StatusNotModified)}
+		}
+
+		operation := map[string]any{
+			"summary":    route.Summary,
+			"tags":       []string{route.Tag},
+			"parameters": params,
+			"responses":  responses,
+		}
+		if route.Request != nil {
+			operation["requestBody"] = map[string]any{
+				"required": true,
+				"content": map[string]any{
+					"application/json": map[string]any{
+						"schema": schemaFor(reflect.TypeOf(route.Request), components),
+					},
+				},
+			}
+		}
+		if route.Auth {
+			security := []any{map[string]any{"bearerAuth": []string{}}}
+			if acceptsAPIKeys(route) {
+				security = append(security, map[string]any{"apiKeyAuth": []string{}})
+			}
+			operation["security"] = security
+		}
+
+		path := pathParam.ReplaceAllString(route.Path, "{$1}")
+		if !route.Unversioned {
+			path = APIPrefix + path
+		}
+		if paths[path] == nil {
+			paths[path] = map[string]any{}
+		}
+		paths[path][strings.ToLower(route.Method)] = operation
+	}
+
+	return map[string]any{
+		"openapi": "3.0.3",
+		"info": map[string]any{
+			"title":   "EMS Backend",
+			"version": "1.0.0",
+		},
+		"paths": paths,
+		"components": map[string]any{
+			"schemas": components,
+			"securitySchemes": map[string]any{
+				"bearerAuth": map[string]any{"type": "http", "scheme": "bearer", "bearerFormat": "JWT"},
+				"apiKeyAuth": map[string]any{"type": "apiKey", "in": "header", "name": "X-API-Key"},
+			},
+		},
+	}
+}
+
+// schemaFor derives a JSON schema from a Go type using its json tags. Named
+// structs are registered once under components and referenced by $ref.
+func schemaFor(t reflect.Type, components map[string]any) map[string]any {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+
+	switch {
+	case t == timeType:
+		return map[string]any{"type": "string", "format": "date-time"}
+	case t == amountType:
+		return map[string]any{"type": "number", "multipleOf": 0.01}
+	case t.Kind() == reflect.Struct:
+		if t.Name() == "" {
+			return structSchema(t, components)
+		}
+		if _, ok := components[t.Name()]; !ok {
+			// Reserve the name first so recursive types terminate
+			components[t.Name()] = map[string]any{}
+			components[t.Name()] = structSchema(t, components)
+		}
+		return map[string]any{"$ref": "#/components/schemas/" + t.Name()}
+	case t.Kind() == reflect.Slice || t.Kind() == reflect.Array:
+		return map[string]any{"type": "array", "items": schemaFor(t.Elem(), components)}
+	case t.Kind() == reflect.Map:
+		return map[string]any{"type": "object", "additionalProperties": schemaFor(t.Elem(), components)}
+	case t.Kind() == reflect.Bool:
+		return map[string]any{"type": "boolean"}
+	case t.Kind() >= reflect.Int && t.Kind() <= reflect.Uint64:
+		return map[string]any{"type": "integer"}
+	case t.Kind() == reflect.Float32 || t.Kind() == reflect.Float64:
+		return map[string]any{"type": "number"}
+	case t.Kind() == reflect.String:
+		return map[string]any{"type": "string"}
+	default:
+		return map[string]any{}
+	}
+}
+
+func structSchema(t reflect.Type, components map[string]any) map[string]any {
+	properties := map[string]any{}
+	addStructFields(t, properties, components)
+	return map[string]any{"type": "object", "properties": properties}
+}
+
+// addStructFields collects the JSON properties of t, flattening embedded
+// structs the same way encoding/json does.
+func addStructFields(t reflect.Type, properties map[string]any, components map[string]any) {
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		tag := field.Tag.Get("json")
+		if tag == "-" || (!field.IsExported() && !field.Anonymous) {
+			continue
+		}
+		name, _, _ := strings.Cut(tag, ",")
+		if field.Anonymous && name == "" {
+			embedded := field.Type
+			for embedded.Kind() == reflect.Pointer {
+				embedded = embedded.Elem()
+			}
+			if embedded.Kind() == reflect.Struct {
+				addStructFields(embedded, properties, components)
+				continue
+			}
+		}
+		if name == "" {
+			name = field.Name
+		}
+		properties[name] = schemaFor(field.Type, components)
+	}
+}
+
+func (s *Server) OpenAPI(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	if err := json.NewEncoder(w).Encode(openAPIDocument(s.Routes())); err != nil {
+		log.Println("OpenAPI encoding error:", err)
+	}
+}
+
+func (s *Server) Docs(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Write(docsPage)
+}
@@ -0,0 +1,69 @@
+package server
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+)
+
+// minAdminPasswordLength is the shortest password CreateAdmin accepts.
+const minAdminPasswordLength = 8
+
+// operatorTokenTTL is how long a token issued by OperatorToken stays valid.
+// It is only used in-process by a command that runs a request at once.
+const operatorTokenTTL = 5 * time.Minute
+
+// ErrNoAdmin is returned by OperatorToken when no Admin user exists yet.
+var ErrNoAdmin = errors.New("there is no Admin user; create one with create-admin or POST /setup")
+
+// CreateAdmin creates a user with the Admin role, for the create-admin
+// command. Field errors are returned with a nil error; the user is only
+// created when there are none.
+func (s *Server) CreateAdmin(ctx context.Context, user User) (User, FieldErrors, error) {
+	user.ID = 0
+	user.RoleID = Admin
+	errs, err := s.validateAdmin(ctx, user)
+	if err != nil || len(errs) > 0 {
+		return user, errs, err
+	}
+
+	user, err = s.Users.Create(ctx, user)
+	return user, nil, err
+}
+
+// validateAdmin validates a new Admin. Unlike the users API it requires a
+// name no other user has, since that is what Login looks users up by, and
+// a password of at least minAdminPasswordLength characters.
+func (s *Server) validateAdmin(ctx context.Context, user User) (FieldErrors, error) {
+	errs, err := user.Validate(ctx, s)
+	if err != nil {
+		return nil, err
+	}
+	if user.Name != "" {
+		if err := s.checkUnique(ctx, errs, "name", "is already in use",
+			"SELECT 1 FROM users WHERE name = $1", user.Name); err != nil {
+			return nil, err
+		}
+	}
+	if user.Password != "" && len([]rune(user.Password)) < minAdminPasswordLength {
+		errs.add("password", "must be at least 8 characters")
+	}
+	return errs, nil
+}
+
+// OperatorToken issues a short-lived token for the oldest Admin user who
+// can log in, as adminExists counts them, so commands can run API requests
+// in-process with the same authorization checks as clients.
+func (s *Server) OperatorToken(ctx context.Context) (string, error) {
+	var id int
+	err := s.DB.QueryRowContext(ctx, `SELECT id FROM users WHERE role_id = $1
+		AND (password <> '' OR directory_dn <> '' OR oidc_subject <> '') ORDER BY id LIMIT 1`, Admin).Scan(&id)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", ErrNoAdmin
+	}
+	if err != nil {
+		return "", err
+	}
+	return s.signToken(User{ID: id, RoleID: Admin}, 0, time.Now().Add(operatorTokenTTL))
+}
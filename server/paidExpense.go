@@ -1,23 +1,53 @@
 package server
 
 import (
+	"context"
+	"database/sql"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"log"
+	"main/money"
+	"main/query"
 	"net/http"
 	"strconv"
-	"strings"
 	"time"
 
 	"github.com/gorilla/mux"
+	"github.com/lib/pq"
 )
 
 type PaidExpense struct {
-	ID        int        `json:"id"`
-	ExpenseID int        `json:"expenseID"`
-	UnitID    string     `json:"unitID"`
-	Category  string     `json:"category"`
-	Amount    float64    `json:"amount"`
-	CreatedAt *time.Time `json:"createdAt,omitempty"`
+	ID        int          `json:"id"`
+	ExpenseID int          `json:"expenseID"`
+	UnitID    string       `json:"unitID"`
+	Category  string       `json:"category"`
+	Amount    money.Amount `json:"amount"`
+	Currency  string       `json:"currency"` // defaults to the expense request's currency
+	CreatedAt *time.Time   `json:"createdAt,omitempty"`
+
+	// The amount in the base currency and the rate used to convert it, as
+	// recorded when the payment was made. Nil when no rate was known.
+	BaseAmount   *money.Amount `json:"baseAmount,omitempty"`
+	ExchangeRate *float64      `json:"exchangeRate,omitempty"`
+	RateDate     *string       `json:"rateDate,omitempty"`
+
+	// BatchID is the payment batch the payment was made in, if any
+	BatchID *int `json:"batchID,omitempty"`
+
+	// VATRate defaults to the expense request's; the net and VAT amounts
+	// are split from Amount by the database
+	VATRate   *float64      `json:"vatRate,omitempty"`
+	NetAmount *money.Amount `json:"netAmount,omitempty"`
+	VATAmount *money.Amount `json:"vatAmount,omitempty"`
+
+	// Split lists the payments a payment was booked as when the lines of
+	// its request are in several categories, one per category; the payment
+	// itself then has no ID. See chargesOf
+	Split []PaidExpense `json:"split,omitempty"`
+
+	// Hidden lists the fields the caller may not see; see visibility.go
+	Hidden []string `json:"hidden,omitempty"`
 }
 
 func (PaidExpense) CreateTableIfNotExists(s *Server) {
@@ -26,7 +56,7 @@ func (PaidExpense) CreateTableIfNotExists(s *Server) {
 		expense_id INT NOT NULL,
 		unit_id VARCHAR(256) NOT NULL,
 		category VARCHAR(256) NOT NULL,
-		amount NUMERIC(7,2) NOT NULL,
+		amount NUMERIC(15,2) NOT NULL,
 		created_at timestamp DEFAULT NOW()
 	)`
 
@@ -35,9 +65,309 @@ func (PaidExpense) CreateTableIfNotExists(s *Server) {
 	if err != nil {
 		log.Fatal(err)
 	}
+
+	_, err = s.DB.Exec("ALTER TABLE paid_expense ADD COLUMN IF NOT EXISTS currency CHAR(3) NOT NULL DEFAULT " + pq.QuoteLiteral(s.BaseCurrency))
+
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	_, err = s.DB.Exec(`ALTER TABLE paid_expense
+		ADD COLUMN IF NOT EXISTS base_amount NUMERIC(15,2),
+		ADD COLUMN IF NOT EXISTS exchange_rate NUMERIC(18,8),
+		ADD COLUMN IF NOT EXISTS rate_date DATE`)
+
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	_, err = s.DB.Exec("ALTER TABLE paid_expense ADD COLUMN IF NOT EXISTS batch_id INT")
+
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	widenAmountColumns(s, "paid_expense", "amount", "base_amount")
+	addVATColumns(s, "paid_expense")
+}
+
+const paidExpenseColumns = "id, expense_id, unit_id, category, amount, created_at, currency, base_amount, exchange_rate, rate_date::text, batch_id, vat_rate, net_amount, vat_amount"
+
+// paidExpenseTargets are the fields of pe in the order of paidExpenseColumns.
+func paidExpenseTargets(pe *PaidExpense) []any {
+	return []any{&pe.ID, &pe.ExpenseID, &pe.UnitID, &pe.Category, &pe.Amount, &pe.CreatedAt, &pe.Currency,
+		&pe.BaseAmount, &pe.ExchangeRate, &pe.RateDate, &pe.BatchID, &pe.VATRate, &pe.NetAmount, &pe.VATAmount}
+}
+
+func scanPaidExpense(row rowScanner) (PaidExpense, error) {
+	var pe PaidExpense
+	err := row.Scan(paidExpenseTargets(&pe)...)
+	return pe, err
+}
+
+// viewedPaidExpenseColumns are paidExpenseColumns with what
+// scanPaidExpenseAs redacts payments by.
+var viewedPaidExpenseColumns = paidExpenseColumns + ", " + expenseOwnerColumns("paid_expense.expense_id")
+
+// scanPaidExpenseAs scans a payment selected with viewedPaidExpenseColumns
+// as v may see it.
+func scanPaidExpenseAs(row rowScanner, v viewer) (PaidExpense, error) {
+	var pe PaidExpense
+	var owner int
+	var unit string
+	err := row.Scan(append(paidExpenseTargets(&pe), &owner, &unit)...)
+	v.redactPayment(&pe, owner, unit)
+	return pe, err
+}
+
+// recordConversion converts a payment to the base currency with the rate in
+// effect on the day it was made and stores both on the payment, so later
+// corrections to the rate table do not change what was booked.
+func (s *Server) recordConversion(ctx context.Context, db dbtx, p *PaidExpense) error {
+	day := time.Now()
+	if p.CreatedAt != nil {
+		day = *p.CreatedAt
+	}
+	rate, ok, err := s.effectiveRate(ctx, db, p.Currency, day.Format(time.DateOnly))
+	if err != nil {
+		return err
+	}
+
+	p.BaseAmount, p.ExchangeRate, p.RateDate = nil, nil, nil
+	if ok {
+		base := s.conversionRounding(ctx).Round(p.Amount.Mul(rate.Rate))
+		p.BaseAmount, p.ExchangeRate, p.RateDate = &base, &rate.Rate, &rate.Date
+	}
+	_, err = db.ExecContext(ctx,
+		"UPDATE paid_expense SET base_amount = $2, exchange_rate = $3, rate_date = $4 WHERE id = $1",
+		p.ID, p.BaseAmount, p.ExchangeRate, p.RateDate)
+	return err
+}
+
+func (p PaidExpense) Validate(ctx context.Context, s *Server) (FieldErrors, error) {
+	errs := FieldErrors{}
+	validateAmount(errs, "amount", p.Amount)
+
+	if err := s.checkExists(ctx, errs, "expenseID", "expense request does not exist",
+		"SELECT 1 FROM expense_request WHERE id = $1", p.ExpenseID); err != nil {
+		return nil, err
+	}
+	if err := s.checkExists(ctx, errs, "unitID", "unit does not exist",
+		"SELECT 1 FROM unit WHERE name = $1", p.UnitID); err != nil {
+		return nil, err
+	}
+	if err := s.checkExists(ctx, errs, "category", "category does not exist",
+		"SELECT 1 FROM expense_category WHERE name = $1", p.Category); err != nil {
+		return nil, err
+	}
+	if err := s.checkCurrency(ctx, errs, "currency", p.Currency); err != nil {
+		return nil, err
+	}
+	if err := s.checkVATRate(ctx, errs, "vatRate", p.VATRate); err != nil {
+		return nil, err
+	}
+	return errs, nil
+}
+
+// paymentState is the state a request of amount moves into once paid in
+// total.
+func paymentState(amount, paid money.Amount) ExpenseState {
+	if paid >= amount {
+		return Paid
+	}
+	return PartiallyPaid
+}
+
+// lockForPayment locks the expense requests with the given IDs, in ID
+// order, and then the budgets they are paid from, their own category's and
+// those of their lines, in key order, until tx ends. Everything that pays
+// takes its locks this way, so concurrent payments from one budget wait for
+// each other rather than deadlock, and a budget check in a later statement
+// of tx sees what they paid.
+func lockForPayment(ctx context.Context, tx *sql.Tx, expenseIDs []int) error {
+	_, err := tx.ExecContext(ctx, "SELECT 1 FROM expense_request WHERE id = ANY($1) ORDER BY id FOR UPDATE", pq.Array(expenseIDs))
+	if err != nil {
+		return err
+	}
+	_, err = tx.ExecContext(ctx, `
+		SELECT 1
+		FROM budget b
+		JOIN expense_request er ON er.unit_id = b.unit_id AND fiscal_year(er.created_at, er.unit_id) = b.year
+		WHERE er.id = ANY($1) AND b.expense_category = ANY`+chargedCategories("er.id", "er.category")+`
+		ORDER BY b.unit_id, b.expense_category, b.year
+		FOR UPDATE OF b
+	`, pq.Array(expenseIDs))
+	return err
 }
 
+// payExpense validates and records a payment on an expense request, which
+// moves on to PartiallyPaid or Paid with it, and tells the requester, the
+// event stream and the webhooks. The payment is in the request's unit,
+// category and currency, so what is paid adds up against its amount and
+// its budget, and takes its VAT rate unless it names its own. On a request
+// with lines it is booked to their categories instead of its own, split
+// when there are several; see chargesOf. Each charge must pass the budget
+// checks of a bulk payment; see checkCharge.
+func (s *Server) payExpense(ctx context.Context, expense *PaidExpense, sender int) error {
+	if err := s.checkValid(ctx, *expense); err != nil {
+		return err
+	}
+
+	tx, err := s.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// Locking the request and its budgets keeps concurrent payments from
+	// both taking what is left of it, or of a budget
+	if err := lockForPayment(ctx, tx, []int{expense.ExpenseID}); err != nil {
+		return err
+	}
+	var req ExpenseRequest
+	var year int
+	var state *ExpenseState
+	var paid money.Amount
+	err = tx.QueryRowContext(ctx, `
+		SELECT er.id, er.unit_id, er.category, er.amount, er.currency, er.vat_rate, fiscal_year(er.created_at, er.unit_id),
+			(SELECT current_state FROM expense_activity WHERE expense_id = er.id ORDER BY created_at DESC, id DESC LIMIT 1),
+			(SELECT COALESCE(SUM(amount), 0) FROM paid_expense WHERE expense_id = er.id)
+		FROM expense_request er
+		WHERE er.id = $1
+	`, expense.ExpenseID).Scan(&req.ID, &req.UnitID, &req.Category, &req.Amount, &req.Currency, &req.VATRate, &year, &state, &paid)
+	if err == sql.ErrNoRows {
+		return errNotFound
+	} else if err != nil {
+		return err
+	}
+	amount, currency := req.Amount, req.Currency
+
+	// The payment is booked where the request is, which is also what was
+	// locked and is checked below
+	errs := FieldErrors{}
+	if expense.UnitID != req.UnitID {
+		errs.add("unitID", "must be the request's unit, "+req.UnitID)
+	}
+	if expense.Category != req.Category {
+		errs.add("category", "must be the request's category, "+req.Category)
+	}
+	if expense.Currency == "" {
+		expense.Currency = currency
+	} else if expense.Currency != currency {
+		errs.add("currency", "must be the request's currency, "+currency)
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+	if expense.VATRate == nil {
+		expense.VATRate = req.VATRate
+	}
+	if !canTransition(state, PartiallyPaid) {
+		current := "no activity"
+		if state != nil {
+			current = string(*state)
+		}
+		return conflictError("Cannot pay an expense request in state " + current)
+	}
+	if paid+expense.Amount > amount {
+		return FieldErrors{"amount": fmt.Sprintf("exceeds the %s %s left to pay", amount-paid, currency)}
+	}
+
+	// Each charge is held to its budget as a bulk payment's is
+	charges, err := chargesOf(ctx, tx, expense.ExpenseID, expense.Category, expense.Amount)
+	if err != nil {
+		return err
+	}
+	for _, charge := range charges {
+		err := s.checkCharge(ctx, tx, req, year, charge)
+		var skip errSkipPayment
+		if errors.As(err, &skip) {
+			return FieldErrors{"amount": skip.reason}
+		} else if err != nil {
+			return err
+		}
+	}
+	payments, err := s.bookPayment(ctx, tx, *expense, charges)
+	if err != nil {
+		return err
+	}
+	if len(payments) == 1 {
+		*expense = payments[0]
+	} else {
+		expense.ID, expense.Category, expense.CreatedAt, expense.Split = 0, "", payments[0].CreatedAt, payments
+	}
+
+	// The request follows its payments into PartiallyPaid and then Paid
+	paid += expense.Amount
+	activity := ExpenseActivity{
+		ExpenseID:    expense.ExpenseID,
+		CurrentState: paymentState(amount, paid),
+		Feedback:     fmt.Sprintf("Payment of %s %s", expense.Amount, expense.Currency),
+		CreatedBy:    sender,
+	}
+	err = tx.QueryRowContext(ctx, `
+		INSERT INTO expense_activity (expense_id, current_state, feedback, created_by)
+		VALUES ($1, $2, $3, $4)
+		RETURNING id, created_at
+	`, activity.ExpenseID, activity.CurrentState, activity.Feedback, activity.CreatedBy).Scan(&activity.ID, &activity.CreatedAt)
+	if err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	for _, payment := range payments {
+		s.publish(Event{Type: EventPaymentChanged, UnitID: payment.UnitID, Data: payment})
+		s.emitWebhook(ctx, WebhookPaymentCreated, payment)
+	}
+	s.publishStateChange(ctx, activity)
+	event := fmt.Sprintf("received a payment of %s %s.", expense.Amount, expense.Currency)
+	if activity.CurrentState == Paid {
+		event += " It is paid in full."
+	} else {
+		event += fmt.Sprintf(" %s %s remain to be paid.", amount-paid, currency)
+	}
+	s.notifyRequester(ctx, expense.ExpenseID, sender, EmailExpenseUpdate, event)
+	for _, payment := range payments {
+		s.notifyBudgetThreshold(ctx, payment, sender)
+	}
+	return nil
+}
+
+// bookPayment records payment within tx as one payment per charge, each
+// converted to the base currency.
+func (s *Server) bookPayment(ctx context.Context, tx *sql.Tx, payment PaidExpense, charges []lineCharge) ([]PaidExpense, error) {
+	payments := make([]PaidExpense, len(charges))
+	for i, charge := range charges {
+		p := payment
+		p.Category, p.Amount = charge.Category, charge.Amount
+		err := tx.QueryRowContext(ctx, `
+			INSERT INTO paid_expense (expense_id, unit_id, category, amount, currency, vat_rate)
+			VALUES ($1, $2, $3, $4, $5, $6)
+			RETURNING id, created_at, net_amount, vat_amount
+		`, p.ExpenseID, p.UnitID, p.Category, p.Amount, p.Currency, p.VATRate).
+			Scan(&p.ID, &p.CreatedAt, &p.NetAmount, &p.VATAmount)
+		if err != nil {
+			return nil, err
+		}
+		if err := s.recordConversion(ctx, tx, &p); err != nil {
+			return nil, err
+		}
+		payments[i] = p
+	}
+	return payments, nil
+}
+
+// Payments are recorded and corrected by Accountants and Admins. Everyone
+// else reads those of the expense requests in their scope.
+
 func (s *Server) CreatePaidExpense(w http.ResponseWriter, r *http.Request) {
+	caller, ok := s.requireRole(w, r, Accounter, Admin)
+	if !ok {
+		return
+	}
+
 	// Decode the paid expense data from the request body
 	var expense PaidExpense
 	if err := json.NewDecoder(r.Body).Decode(&expense); err != nil {
@@ -45,18 +375,8 @@ func (s *Server) CreatePaidExpense(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Prepare the SQL query with RETURNING to get the generated ID and created_at
-	query := `
-        INSERT INTO paid_expense (expense_id, unit_id, category, amount)
-        VALUES ($1, $2, $3, $4)
-        RETURNING id, created_at
-    `
-
-	// Execute the query and retrieve the generated ID and created_at
-	err := s.DB.QueryRow(query, expense.ExpenseID, expense.UnitID, expense.Category, expense.Amount).Scan(&expense.ID, &expense.CreatedAt)
-	if err != nil {
-		http.Error(w, "Failed to create paid expense", http.StatusInternalServerError)
-		log.Println("Insert error:", err)
+	if err := s.payExpense(r.Context(), &expense, caller.ID); err != nil {
+		writeStoreError(w, err, "Expense request not found")
 		return
 	}
 
@@ -75,22 +395,32 @@ func (s *Server) GetPaidExpense(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Invalid ID", http.StatusBadRequest)
 		return
 	}
+	v, ok := s.viewerOf(w, r)
+	if !ok {
+		return
+	}
 
 	// Query the database for the paid expense
-	var expense PaidExpense
-	err = s.DB.QueryRow("SELECT id, expense_id, unit_id, category, amount, created_at FROM paid_expense WHERE id = $1", id).Scan(
-		&expense.ID,
-		&expense.ExpenseID,
-		&expense.UnitID,
-		&expense.Category,
-		&expense.Amount,
-		&expense.CreatedAt,
-	)
+	expense, err := scanPaidExpenseAs(s.DB.QueryRowContext(r.Context(), "SELECT "+viewedPaidExpenseColumns+" FROM paid_expense WHERE id = $1", id), v)
 	if err != nil {
 		http.Error(w, "Paid expense not found", http.StatusNotFound)
 		log.Println("Query error:", err)
 		return
 	}
+	readable, err := s.mayReadExpense(r.Context(), v, expense.ExpenseID)
+	if err != nil {
+		log.Println("Expense request query error:", err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	if !readable {
+		http.Error(w, "Paid expense not found", http.StatusNotFound)
+		return
+	}
+
+	env := envelopeOf(r)
+	env.link("expenseRequest", "/expense_requests/"+strconv.Itoa(expense.ExpenseID))
+	env.link("activities", "/expense_activities?expenseID="+strconv.Itoa(expense.ExpenseID))
 
 	// Respond with the JSON-encoded paid expense
 	w.Header().Set("Content-Type", "application/json; charset=utf-8")
@@ -98,6 +428,10 @@ func (s *Server) GetPaidExpense(w http.ResponseWriter, r *http.Request) {
 }
 
 func (s *Server) UpdatePaidExpense(w http.ResponseWriter, r *http.Request) {
+	if _, ok := s.requireRole(w, r, Accounter, Admin); !ok {
+		return
+	}
+
 	// Extract ID from URL
 	vars := mux.Vars(r)
 	idStr := vars["id"]
@@ -114,6 +448,10 @@ func (s *Server) UpdatePaidExpense(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if !s.validate(w, r, expense) {
+		return
+	}
+
 	// Ensure expense ID is set
 	if expense.ID == 0 {
 		http.Error(w, "Missing or invalid ID in body", http.StatusBadRequest)
@@ -122,7 +460,7 @@ func (s *Server) UpdatePaidExpense(w http.ResponseWriter, r *http.Request) {
 
 	// Check if the paid expense exists
 	var exists bool
-	err = s.DB.QueryRow("SELECT EXISTS(SELECT 1 FROM paid_expense WHERE id = $1)", id).Scan(&exists)
+	err = s.DB.QueryRowContext(r.Context(), "SELECT EXISTS(SELECT 1 FROM paid_expense WHERE id = $1)", id).Scan(&exists)
 	if err != nil {
 		log.Printf("DB error checking paid expense existence: %v", err)
 		http.Error(w, "Database error", http.StatusInternalServerError)
@@ -136,15 +474,24 @@ func (s *Server) UpdatePaidExpense(w http.ResponseWriter, r *http.Request) {
 	// Perform the update (we do not update created_at)
 	query := `
 		UPDATE paid_expense
-		SET expense_id = $1, unit_id = $2, category = $3, amount = $4
-		WHERE id = $5
+		SET expense_id = $1, unit_id = $2, category = $3, amount = $4,
+			currency = COALESCE(NULLIF($5, ''), (SELECT currency FROM expense_request WHERE id = $1)),
+			vat_rate = COALESCE($6, (SELECT vat_rate FROM expense_request WHERE id = $1))
+		WHERE id = $7
+		RETURNING id, currency, created_at, vat_rate, net_amount, vat_amount
 	`
-	_, err = s.DB.Exec(query, expense.ExpenseID, expense.UnitID, expense.Category, expense.Amount, id)
+	err = s.DB.QueryRowContext(r.Context(), query, expense.ExpenseID, expense.UnitID, expense.Category, expense.Amount, expense.Currency, expense.VATRate, id).
+		Scan(&expense.ID, &expense.Currency, &expense.CreatedAt, &expense.VATRate, &expense.NetAmount, &expense.VATAmount)
 	if err != nil {
 		log.Printf("DB update error: %v", err)
 		http.Error(w, "Database error", http.StatusInternalServerError)
 		return
 	}
+	if err := s.recordConversion(r.Context(), s.DB, &expense); err != nil {
+		log.Println("Record conversion error:", err)
+	}
+	// The payment may have moved between units, so leave the unit open
+	s.publish(Event{Type: EventPaymentChanged, Data: expense})
 
 	// Respond with the updated paid expense
 	w.Header().Set("Content-Type", "application/json; charset=utf-8")
@@ -153,7 +500,79 @@ func (s *Server) UpdatePaidExpense(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+var paidExpensePatchFields = map[string]patchField{
+	"expenseID": patchAs[int]("expense_id"),
+	"unitID":    patchAs[string]("unit_id"),
+	"category":  patchAs[string]("category"),
+	"amount":    patchAs[money.Amount]("amount"),
+	"currency":  patchAs[string]("currency"),
+	"vatRate":   patchAs[*float64]("vat_rate"),
+}
+
+func (s *Server) PatchPaidExpense(w http.ResponseWriter, r *http.Request) {
+	if _, ok := s.requireRole(w, r, Accounter, Admin); !ok {
+		return
+	}
+
+	// Extract ID from URL
+	vars := mux.Vars(r)
+	idStr := vars["id"]
+	id, err := strconv.Atoi(idStr)
+	if err != nil {
+		http.Error(w, "Invalid ID", http.StatusBadRequest)
+		return
+	}
+
+	// Decode only the fields the client sent
+	var fields map[string]json.RawMessage
+	if err := json.NewDecoder(r.Body).Decode(&fields); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+
+	set, args, err := buildPatch(fields, paidExpensePatchFields)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if !s.validatePatch(w, r, fields, &PaidExpense{}) {
+		return
+	}
+
+	// created_at is never patchable, same as the full update
+	query := "UPDATE paid_expense SET " + set + " WHERE id = " + args.Add(id) +
+		" RETURNING " + paidExpenseColumns
+
+	expense, err := scanPaidExpense(s.DB.QueryRowContext(r.Context(), query, args...))
+	if err == sql.ErrNoRows {
+		http.Error(w, "Paid expense not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		log.Printf("DB patch error: %v", err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	_, amountChanged := fields["amount"]
+	_, currencyChanged := fields["currency"]
+	if amountChanged || currencyChanged {
+		if err := s.recordConversion(r.Context(), s.DB, &expense); err != nil {
+			log.Println("Record conversion error:", err)
+		}
+	}
+	s.publish(Event{Type: EventPaymentChanged, Data: expense})
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	if err := json.NewEncoder(w).Encode(expense); err != nil {
+		log.Printf("JSON encoding error: %v", err)
+	}
+}
+
 func (s *Server) DeletePaidExpense(w http.ResponseWriter, r *http.Request) {
+	if _, ok := s.requireRole(w, r, Accounter, Admin); !ok {
+		return
+	}
+
 	// Extract ID from URL
 	vars := mux.Vars(r)
 	idStr := vars["id"]
@@ -164,7 +583,7 @@ func (s *Server) DeletePaidExpense(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Perform the DELETE query
-	result, err := s.DB.Exec("DELETE FROM paid_expense WHERE id = $1", id)
+	result, err := s.DB.ExecContext(r.Context(), "DELETE FROM paid_expense WHERE id = $1", id)
 	if err != nil {
 		http.Error(w, "Failed to delete paid expense", http.StatusInternalServerError)
 		log.Println("Delete error:", err)
@@ -183,6 +602,7 @@ func (s *Server) DeletePaidExpense(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Paid expense not found", http.StatusNotFound)
 		return
 	}
+	s.publish(Event{Type: EventPaymentChanged, Data: map[string]int{"id": id}})
 
 	// Return 204 No Content on successful deletion
 	w.WriteHeader(http.StatusNoContent)
@@ -194,58 +614,34 @@ func (s *Server) ListPaidExpenses(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	filters := []string{}
-	args := []any{}
-	idx := 1
-
-	// Optional query parameters
-	if expenseID := r.URL.Query().Get("expense_id"); expenseID != "" {
-		filters = append(filters, "expense_id = $"+strconv.Itoa(idx))
-		args = append(args, expenseID)
-		idx++
-	}
-	if unitID := r.URL.Query().Get("unit_id"); unitID != "" {
-		filters = append(filters, "unit_id = $"+strconv.Itoa(idx))
-		args = append(args, unitID)
-		idx++
-	}
-	if category := r.URL.Query().Get("category"); category != "" {
-		filters = append(filters, "category = $"+strconv.Itoa(idx))
-		args = append(args, category)
-		idx++
-	}
-	if minAmount := r.URL.Query().Get("min_amount"); minAmount != "" {
-		filters = append(filters, "amount >= $"+strconv.Itoa(idx))
-		args = append(args, minAmount)
-		idx++
-	}
-	if maxAmount := r.URL.Query().Get("max_amount"); maxAmount != "" {
-		filters = append(filters, "amount <= $"+strconv.Itoa(idx))
-		args = append(args, maxAmount)
-		idx++
-	}
-	if year := r.URL.Query().Get("year"); year != "" {
-		filters = append(filters, "EXTRACT(YEAR FROM created_at) = $"+strconv.Itoa(idx))
-		args = append(args, year)
-		idx++
-	}
-	if month := r.URL.Query().Get("month"); month != "" {
-		filters = append(filters, "EXTRACT(MONTH FROM created_at) = $"+strconv.Itoa(idx))
-		args = append(args, month)
-		idx++
+	format, ok := listFormat(w, r)
+	if !ok {
+		return
 	}
-	if day := r.URL.Query().Get("day"); day != "" {
-		filters = append(filters, "EXTRACT(DAY FROM created_at) = $"+strconv.Itoa(idx))
-		args = append(args, day)
-		idx++
+	v, ok := s.viewerOf(w, r)
+	if !ok {
+		return
 	}
 
-	query := "SELECT id, expense_id, unit_id, category, amount, created_at FROM paid_expense"
-	if len(filters) > 0 {
-		query += " WHERE " + strings.Join(filters, " AND ")
+	// Optional query parameters
+	params := r.URL.Query()
+	if unit := params.Get("unitID"); unit != "" && unit != v.user.UnitID && !v.mayReadUnit(unit) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+	q := query.From("paid_expense", viewedPaidExpenseColumns).
+		WhereIf(params.Get("expenseID") != "", "expense_id = ?", params.Get("expenseID")).
+		WhereIf(params.Get("unitID") != "", "unit_id = ?", params.Get("unitID")).
+		WhereIf(params.Get("category") != "", "category = ?", params.Get("category")).
+		WhereIf(params.Get("minAmount") != "", "amount >= ?", params.Get("minAmount")).
+		WhereIf(params.Get("maxAmount") != "", "amount <= ?", params.Get("maxAmount"))
+	v.scopeByExpense(q, "expense_id")
+	if !whereCreated(w, r, q, "created_at") {
+		return
 	}
+	statement, args := q.SQL()
 
-	rows, err := s.DB.Query(query, args...)
+	rows, err := s.DB.QueryContext(r.Context(), statement, args...)
 	if err != nil {
 		http.Error(w, "Database query failed", http.StatusInternalServerError)
 		log.Println("ListPaidExpenses query error:", err)
@@ -253,14 +649,53 @@ func (s *Server) ListPaidExpenses(w http.ResponseWriter, r *http.Request) {
 	}
 	defer rows.Close()
 
+	var export *csvExport
+	var stream *ndjsonExport
+	switch format {
+	case "csv":
+		export = newCSVExport(w, "paid_expenses",
+			[]string{"id", "expenseID", "unitID", "category", "amount", "currency", "createdAt", "baseAmount", "exchangeRate", "rateDate", "vatRate", "netAmount", "vatAmount"})
+	case "ndjson":
+		stream = newNDJSONExport(w)
+	}
+
 	var expenses []PaidExpense
 	for rows.Next() {
-		var pe PaidExpense
-		if err := rows.Scan(&pe.ID, &pe.ExpenseID, &pe.UnitID, &pe.Category, &pe.Amount, &pe.CreatedAt); err != nil {
+		pe, err := scanPaidExpenseAs(rows, v)
+		if err != nil {
 			http.Error(w, "Failed to scan paid expense", http.StatusInternalServerError)
 			log.Println("Row scan error:", err)
 			return
 		}
+		if export != nil {
+			err := export.write([]string{
+				strconv.Itoa(pe.ID),
+				strconv.Itoa(pe.ExpenseID),
+				csvText(pe.UnitID),
+				csvText(pe.Category),
+				csvHidden(pe.Hidden, "amount", pe.Amount.String()),
+				pe.Currency,
+				csvTime(pe.CreatedAt),
+				csvOptional(pe.BaseAmount, money.Amount.String),
+				csvOptional(pe.ExchangeRate, func(f float64) string { return strconv.FormatFloat(f, 'f', -1, 64) }),
+				csvOptional(pe.RateDate, csvText),
+				csvOptional(pe.VATRate, csvFloat),
+				csvOptional(pe.NetAmount, money.Amount.String),
+				csvOptional(pe.VATAmount, money.Amount.String),
+			})
+			if err != nil {
+				log.Println("CSV write error:", err)
+				return
+			}
+			continue
+		}
+		if stream != nil {
+			if err := stream.write(pe); err != nil {
+				log.Println("NDJSON write error:", err)
+				return
+			}
+			continue
+		}
 		expenses = append(expenses, pe)
 	}
 
@@ -270,6 +705,17 @@ func (s *Server) ListPaidExpenses(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if export != nil {
+		if err := export.close(); err != nil {
+			log.Println("CSV write error:", err)
+		}
+		return
+	}
+	if stream != nil {
+		stream.close()
+		return
+	}
+
 	w.Header().Set("Content-Type", "application/json; charset=utf-8")
 	if err := json.NewEncoder(w).Encode(expenses); err != nil {
 		http.Error(w, "JSON encoding failed", http.StatusInternalServerError)
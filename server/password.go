@@ -0,0 +1,125 @@
+package server
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Local passwords are stored as bcrypt hashes and never leave the users
+// table: userFields does not select the column, so no response can carry
+// it. An empty password stays empty, meaning the user has no local login.
+
+// maxPasswordBytes is the longest password bcrypt hashes in full.
+const maxPasswordBytes = 72
+
+// dummyPasswordHash is compared against when no user has the login name, so
+// a failed login takes as long whether or not the name exists.
+var dummyPasswordHash, _ = bcrypt.GenerateFromPassword([]byte("no such user"), bcrypt.DefaultCost)
+
+// hashPassword returns the bcrypt hash password is stored as.
+func hashPassword(password string) (string, error) {
+	if password == "" {
+		return "", nil
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	return string(hash), err
+}
+
+// passwordMatches reports whether password is the one hash was made from.
+// An empty hash matches nothing.
+func passwordMatches(hash, password string) bool {
+	if hash == "" {
+		bcrypt.CompareHashAndPassword(dummyPasswordHash, []byte(password))
+		return false
+	}
+	return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil
+}
+
+// hashStoredPasswords replaces the plaintext passwords older versions
+// stored with their hashes.
+func hashStoredPasswords(ctx context.Context, db *sql.DB) (int, error) {
+	rows, err := db.QueryContext(ctx, "SELECT id, password FROM users WHERE password <> '' AND password NOT LIKE '$2_$%'")
+	if err != nil {
+		return 0, err
+	}
+	plaintext := map[int]string{}
+	for rows.Next() {
+		var id int
+		var password string
+		if err := rows.Scan(&id, &password); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		plaintext[id] = password
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	for id, password := range plaintext {
+		hash, err := hashPassword(password)
+		if err != nil {
+			return 0, err
+		}
+		// Only if it is still the plaintext read above
+		if _, err := db.ExecContext(ctx, "UPDATE users SET password = $1 WHERE id = $2 AND password = $3", hash, id, password); err != nil {
+			return 0, err
+		}
+	}
+	return len(plaintext), nil
+}
+
+// disableDefaultLogin clears the password of the users named admin whose
+// password is still the old default, "password", and returns how many
+// there were. They keep their rows, but no longer log in.
+func disableDefaultLogin(ctx context.Context, db *sql.DB) (int, error) {
+	rows, err := db.QueryContext(ctx, "SELECT id, password FROM users WHERE name = 'admin' AND password <> ''")
+	if err != nil {
+		return 0, err
+	}
+	defaults := map[int]string{}
+	for rows.Next() {
+		var id int
+		var hash string
+		if err := rows.Scan(&id, &hash); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		if passwordMatches(hash, "password") {
+			defaults[id] = hash
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	for id, hash := range defaults {
+		// Only if the password was not changed since
+		if _, err := db.ExecContext(ctx, "UPDATE users SET password = '' WHERE id = $1 AND password = $2", id, hash); err != nil {
+			return 0, err
+		}
+	}
+	return len(defaults), nil
+}
+
+// patchPassword declares the patchable password column, stored hashed.
+func patchPassword(column string) patchField {
+	return patchField{
+		column: column,
+		decode: func(raw json.RawMessage) (any, error) {
+			var v string
+			if err := json.Unmarshal(raw, &v); err != nil {
+				return nil, err
+			}
+			if len(v) > maxPasswordBytes {
+				return nil, bcrypt.ErrPasswordTooLong
+			}
+			return hashPassword(v)
+		},
+	}
+}
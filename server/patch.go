@@ -0,0 +1,93 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"main/query"
+	"sort"
+	"strings"
+)
+
+// patchField describes a JSON field that a PATCH handler accepts and the
+// column it is written to.
+type patchField struct {
+	column string
+	decode func(json.RawMessage) (any, error)
+}
+
+// patchAs declares a patchable column whose JSON value decodes into T.
+func patchAs[T any](column string) patchField {
+	return patchField{
+		column: column,
+		decode: func(raw json.RawMessage) (any, error) {
+			var v T
+			err := json.Unmarshal(raw, &v)
+			return v, err
+		},
+	}
+}
+
+// patchEmptyAsNull declares a patchable string column that an empty string
+// clears.
+func patchEmptyAsNull(column string) patchField {
+	return patchField{
+		column: column,
+		decode: func(raw json.RawMessage) (any, error) {
+			var v string
+			if err := json.Unmarshal(raw, &v); err != nil || v == "" {
+				return nil, err
+			}
+			return v, nil
+		},
+	}
+}
+
+// patchZeroAsNull declares a patchable integer column that 0 clears.
+func patchZeroAsNull(column string) patchField {
+	return patchField{
+		column: column,
+		decode: func(raw json.RawMessage) (any, error) {
+			var v int
+			if err := json.Unmarshal(raw, &v); err != nil || v == 0 {
+				return nil, err
+			}
+			return v, nil
+		},
+	}
+}
+
+// buildPatch turns a partial JSON object into a SET clause that only touches
+// the provided columns. Placeholders start at $1; the caller adds the
+// arguments of its WHERE clause to args after them.
+func buildPatch(body map[string]json.RawMessage, fields map[string]patchField) (string, query.Args, error) {
+	// Sort keys so the generated statement is stable between requests
+	keys := make([]string, 0, len(body))
+	for key := range body {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	sets := []string{}
+	var args query.Args
+	for _, key := range keys {
+		field, ok := fields[key]
+		if !ok {
+			return "", nil, fmt.Errorf("Unknown or read-only field %q", key)
+		}
+		raw := body[key]
+		if bytes.Equal(bytes.TrimSpace(raw), []byte("null")) {
+			return "", nil, fmt.Errorf("Field %q cannot be null", key)
+		}
+		value, err := field.decode(raw)
+		if err != nil {
+			return "", nil, fmt.Errorf("Invalid value for field %q", key)
+		}
+		sets = append(sets, field.column+" = "+args.Add(value))
+	}
+
+	if len(sets) == 0 {
+		return "", nil, fmt.Errorf("No fields to update")
+	}
+	return strings.Join(sets, ", "), args, nil
+}
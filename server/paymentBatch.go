@@ -0,0 +1,337 @@
+package server
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"main/money"
+	"main/pdf"
+	"maps"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/lib/pq"
+)
+
+// PaymentBatch is a set of approved requests paid in full together, e.g. one
+// payment run of the finance department. Unlike a bulk payment, a batch is
+// made whole or not at all.
+type PaymentBatch struct {
+	ID            int                `json:"id"`
+	CreatedBy     int                `json:"createdBy"`
+	CreatedByName string             `json:"createdByName"`
+	CreatedAt     time.Time          `json:"createdAt"`
+	Items         []PaymentBatchItem `json:"items"`
+	Totals        []PaymentTotal     `json:"totals"` // by currency
+}
+
+// PaymentBatchItem is one payment of a batch with what a paper summary
+// needs to know about its request.
+type PaymentBatchItem struct {
+	PaidExpense
+	DocNumber     string `json:"docNumber"`
+	RequesterID   int    `json:"requesterID"`
+	RequesterName string `json:"requesterName"`
+	// The vendor the request is paid to instead of its requester, if any
+	VendorID   *int   `json:"vendorID,omitempty"`
+	VendorName string `json:"vendorName,omitempty"`
+}
+
+// payee names who a batch item is paid to.
+func (item PaymentBatchItem) payee() string {
+	if item.VendorID != nil {
+		return item.VendorName
+	}
+	return item.RequesterName
+}
+
+type PaymentTotal struct {
+	Currency string       `json:"currency"`
+	Amount   money.Amount `json:"amount"`
+	Count    int          `json:"count"`
+}
+
+func (PaymentBatch) CreateTableIfNotExists(s *Server) {
+	query := `CREATE TABLE IF NOT EXISTS payment_batch (
+		id SERIAL PRIMARY KEY,
+		created_by INT NOT NULL,
+		created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+	)`
+
+	_, err := s.DB.Exec(query)
+
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+type paymentBatchRequest struct {
+	ExpenseIDs []int `json:"expenseIDs"`
+}
+
+// loadPaymentBatch returns batch id with its payments in the order they
+// were made.
+func (s *Server) loadPaymentBatch(ctx context.Context, id int) (PaymentBatch, error) {
+	batch := PaymentBatch{ID: id, Items: []PaymentBatchItem{}, Totals: []PaymentTotal{}}
+	err := s.DB.QueryRowContext(ctx, `
+		SELECT pb.created_by, COALESCE(u.name, ''), pb.created_at
+		FROM payment_batch pb
+		LEFT JOIN users u ON u.id = pb.created_by
+		WHERE pb.id = $1
+	`, id).Scan(&batch.CreatedBy, &batch.CreatedByName, &batch.CreatedAt)
+	if err != nil {
+		return batch, err
+	}
+
+	rows, err := s.DB.QueryContext(ctx, `
+		SELECT pe.id, pe.expense_id, pe.unit_id, pe.category, pe.amount, pe.created_at, pe.currency,
+			pe.base_amount, pe.exchange_rate, pe.rate_date::text, pe.batch_id,
+			pe.vat_rate, pe.net_amount, pe.vat_amount,
+			er.doc_number, er.user_id, COALESCE(u.name, ''), er.vendor_id, COALESCE(v.name, '')
+		FROM paid_expense pe
+		JOIN expense_request er ON er.id = pe.expense_id
+		LEFT JOIN users u ON u.id = er.user_id
+		LEFT JOIN vendor v ON v.id = er.vendor_id
+		WHERE pe.batch_id = $1
+		ORDER BY pe.id
+	`, id)
+	if err != nil {
+		return batch, err
+	}
+	defer rows.Close()
+	totals := map[string]*PaymentTotal{}
+	for rows.Next() {
+		var item PaymentBatchItem
+		pe := &item.PaidExpense
+		if err := rows.Scan(&pe.ID, &pe.ExpenseID, &pe.UnitID, &pe.Category, &pe.Amount, &pe.CreatedAt, &pe.Currency,
+			&pe.BaseAmount, &pe.ExchangeRate, &pe.RateDate, &pe.BatchID,
+			&pe.VATRate, &pe.NetAmount, &pe.VATAmount,
+			&item.DocNumber, &item.RequesterID, &item.RequesterName, &item.VendorID, &item.VendorName); err != nil {
+			return batch, err
+		}
+		batch.Items = append(batch.Items, item)
+		total, ok := totals[pe.Currency]
+		if !ok {
+			total = &PaymentTotal{Currency: pe.Currency}
+			totals[pe.Currency] = total
+		}
+		total.Amount += pe.Amount
+		total.Count++
+	}
+	if err := rows.Err(); err != nil {
+		return batch, err
+	}
+	for _, total := range totals {
+		batch.Totals = append(batch.Totals, *total)
+	}
+	slices.SortFunc(batch.Totals, func(a, b PaymentTotal) int { return strings.Compare(a.Currency, b.Currency) })
+	return batch, nil
+}
+
+// CreatePaymentBatch pays the listed requests in full in one transaction.
+// Every request is checked against the same rules as a bulk payment, with
+// the batch's earlier payments counting towards each budget; if any of them
+// fails, nothing is paid and the reasons are returned per request.
+func (s *Server) CreatePaymentBatch(w http.ResponseWriter, r *http.Request) {
+	caller, ok := s.requireRole(w, r, Accounter, Admin)
+	if !ok {
+		return
+	}
+
+	var body paymentBatchRequest
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&body); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+	errs := FieldErrors{}
+	switch {
+	case len(body.ExpenseIDs) == 0:
+		errs.add("expenseIDs", "is required")
+	case len(body.ExpenseIDs) > maxBulkPay:
+		errs.add("expenseIDs", "must list at most "+strconv.Itoa(maxBulkPay)+" requests")
+	}
+	position := map[int]int{}
+	for i, id := range body.ExpenseIDs {
+		if _, seen := position[id]; seen {
+			errs.add("expenseIDs."+strconv.Itoa(i), "is listed more than once")
+			continue
+		}
+		position[id] = i
+	}
+	if len(errs) > 0 {
+		writeValidationErrors(w, errs)
+		return
+	}
+
+	tx, err := s.DB.BeginTx(r.Context(), nil)
+	if err != nil {
+		log.Println("Transaction error:", err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	var batchID int
+	if err := tx.QueryRowContext(r.Context(),
+		"INSERT INTO payment_batch (created_by) VALUES ($1) RETURNING id", caller.ID).Scan(&batchID); err != nil {
+		log.Println("Payment batch insert error:", err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	// Requests and then their budgets are locked in order up front, so
+	// overlapping batches cannot deadlock
+	ids := slices.Sorted(maps.Keys(position))
+	if err := lockForPayment(r.Context(), tx, ids); err != nil {
+		log.Println("Payment batch lock error:", err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	feedback := fmt.Sprintf("Paid in batch %d", batchID)
+	var payments []PaidExpense
+	for _, id := range ids {
+		paid, err := s.payOutstanding(r.Context(), tx, id, caller.ID, feedback)
+		var skip errSkipPayment
+		if errors.As(err, &skip) {
+			errs.add("expenseIDs."+strconv.Itoa(position[id]), skip.reason)
+			continue
+		} else if err != nil {
+			log.Printf("Payment batch of expense request %d failed: %v", id, err)
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		payments = append(payments, paid...)
+	}
+	if len(errs) > 0 {
+		writeValidationErrors(w, errs)
+		return
+	}
+
+	paymentIDs := make([]int, len(payments))
+	for i, p := range payments {
+		paymentIDs[i] = p.ID
+	}
+	if _, err := tx.ExecContext(r.Context(),
+		"UPDATE paid_expense SET batch_id = $1 WHERE id = ANY($2)", batchID, pq.Array(paymentIDs)); err != nil {
+		log.Println("Payment batch update error:", err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	if err := audit(r.Context(), tx, caller.ID, "payment_batches.create", map[string]any{"id": batchID, "expenseIDs": ids}); err != nil {
+		log.Println("Audit error:", err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		log.Println("Commit error:", err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	for i, payment := range payments {
+		payment.BatchID = &batchID
+		s.publish(Event{Type: EventPaymentChanged, UnitID: payment.UnitID, Data: payment})
+		s.emitWebhook(r.Context(), WebhookPaymentCreated, payment)
+		// A request split over several categories was paid once
+		if i == 0 || payments[i-1].ExpenseID != payment.ExpenseID {
+			s.publishStateChange(r.Context(), ExpenseActivity{ExpenseID: payment.ExpenseID, CurrentState: Paid, Feedback: feedback, CreatedBy: caller.ID})
+			s.notifyRequester(r.Context(), payment.ExpenseID, caller.ID, EmailExpenseUpdate, "was paid.")
+		}
+		s.notifyBudgetThreshold(r.Context(), payment, caller.ID)
+	}
+
+	batch, err := s.loadPaymentBatch(r.Context(), batchID)
+	if err != nil {
+		log.Println("Payment batch query error:", err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(batch)
+}
+
+// paymentBatchFromPath loads the batch named in the path for Accountants and
+// Admins, writing the error response when it cannot.
+func (s *Server) paymentBatchFromPath(w http.ResponseWriter, r *http.Request) (PaymentBatch, bool) {
+	if _, ok := s.requireRole(w, r, Accounter, Admin); !ok {
+		return PaymentBatch{}, false
+	}
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid ID", http.StatusBadRequest)
+		return PaymentBatch{}, false
+	}
+	batch, err := s.loadPaymentBatch(r.Context(), id)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Payment batch not found", http.StatusNotFound)
+		return batch, false
+	} else if err != nil {
+		log.Println("Payment batch query error:", err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return batch, false
+	}
+	return batch, true
+}
+
+func (s *Server) GetPaymentBatch(w http.ResponseWriter, r *http.Request) {
+	batch, ok := s.paymentBatchFromPath(w, r)
+	if !ok {
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(batch)
+}
+
+func renderPaymentBatch(batch PaymentBatch) []byte {
+	doc := pdf.New()
+
+	doc.Heading(fmt.Sprintf("Payment Batch %d", batch.ID))
+	doc.Field("Prepared by", fmt.Sprintf("%s (user %d)", batch.CreatedByName, batch.CreatedBy))
+	doc.Field("Paid", reportTime(&batch.CreatedAt))
+	doc.Field("Payments", strconv.Itoa(len(batch.Items)))
+
+	doc.Subheading("Payments")
+	rows := make([][]string, len(batch.Items))
+	for i, item := range batch.Items {
+		rows[i] = []string{item.DocNumber, item.payee(), item.UnitID, item.Category,
+			item.Amount.String() + " " + item.Currency}
+	}
+	doc.Table([]float64{0.16, 0.22, 0.2, 0.2, 0.22}, []string{"Request", "Paid to", "Unit", "Category", "Amount"}, rows)
+
+	doc.Subheading("Totals")
+	rows = make([][]string, len(batch.Totals))
+	for i, total := range batch.Totals {
+		rows[i] = []string{total.Currency, strconv.Itoa(total.Count), total.Amount.String()}
+	}
+	doc.Table([]float64{0.3, 0.3, 0.4}, []string{"Currency", "Payments", "Amount"}, rows)
+
+	doc.SignatureLine("Prepared by " + batch.CreatedByName)
+	doc.SignatureLine("Finance department")
+
+	doc.Space(20)
+	doc.Text("Generated " + time.Now().Format("2006-01-02 15:04 MST"))
+	return doc.Bytes()
+}
+
+// PaymentBatchSummaryPDF renders a batch for signing and filing.
+func (s *Server) PaymentBatchSummaryPDF(w http.ResponseWriter, r *http.Request) {
+	batch, ok := s.paymentBatchFromPath(w, r)
+	if !ok {
+		return
+	}
+	body := renderPaymentBatch(batch)
+	w.Header().Set("Content-Type", "application/pdf")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`inline; filename="payment-batch-%d.pdf"`, batch.ID))
+	w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+	w.Write(body)
+}
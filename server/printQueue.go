@@ -0,0 +1,260 @@
+package server
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"main/printer"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	printInterval    = 30 * time.Second
+	printBatchSize   = 10
+	printTimeout     = 2 * time.Minute
+	printMaxAttempts = 6
+	printRetryBase   = time.Minute
+)
+
+// Print job states.
+const (
+	PrintQueued  = "queued"
+	PrintPrinted = "printed"
+	PrintFailed  = "failed" // gave up after printMaxAttempts
+)
+
+// PrintJob is a request's dossier queued for the archive printer. The
+// dossier is rendered when the job is printed, so the paper copy has the
+// history as of printing.
+type PrintJob struct {
+	ID          int        `json:"id"`
+	ExpenseID   int        `json:"expenseID"`
+	RequestedBy int        `json:"requestedBy"`
+	Status      string     `json:"status"`
+	Attempts    int        `json:"attempts"`
+	LastError   string     `json:"lastError,omitempty"`
+	CreatedAt   time.Time  `json:"createdAt"`
+	PrintedAt   *time.Time `json:"printedAt,omitempty"`
+}
+
+func (PrintJob) CreateTableIfNotExists(s *Server) {
+	query := `CREATE TABLE IF NOT EXISTS print_job (
+		id SERIAL PRIMARY KEY,
+		expense_id INT NOT NULL REFERENCES expense_request(id) ON DELETE CASCADE,
+		requested_by INT NOT NULL,
+		status VARCHAR(16) NOT NULL DEFAULT 'queued' CHECK (status IN ('queued', 'printed', 'failed')),
+		attempts INT NOT NULL DEFAULT 0,
+		last_error TEXT NOT NULL DEFAULT '',
+		next_attempt_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+		created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+		printed_at TIMESTAMPTZ
+	);
+	CREATE INDEX IF NOT EXISTS print_job_due_idx ON print_job (next_attempt_at) WHERE status = 'queued';
+	CREATE INDEX IF NOT EXISTS print_job_expense_idx ON print_job (expense_id)`
+
+	_, err := s.DB.Exec(query)
+
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+const printJobColumns = "id, expense_id, requested_by, status, attempts, last_error, created_at, printed_at"
+
+func scanPrintJob(row rowScanner) (PrintJob, error) {
+	var j PrintJob
+	err := row.Scan(&j.ID, &j.ExpenseID, &j.RequestedBy, &j.Status, &j.Attempts, &j.LastError, &j.CreatedAt, &j.PrintedAt)
+	return j, err
+}
+
+// PrintExpenseRequest queues a request's dossier for the archive printer.
+func (s *Server) PrintExpenseRequest(w http.ResponseWriter, r *http.Request) {
+	caller, ok := s.requireRole(w, r, Accounter, Admin)
+	if !ok {
+		return
+	}
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid ID", http.StatusBadRequest)
+		return
+	}
+	if s.Settings().Printer == nil {
+		http.Error(w, "No printer is configured", http.StatusNotImplemented)
+		return
+	}
+
+	exists, err := s.exists(r.Context(), "SELECT 1 FROM expense_request WHERE id = $1", id)
+	if err != nil {
+		log.Println("Expense request lookup error:", err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	if !exists {
+		http.Error(w, "Expense request not found", http.StatusNotFound)
+		return
+	}
+
+	job, err := scanPrintJob(s.DB.QueryRowContext(r.Context(),
+		"INSERT INTO print_job (expense_id, requested_by) VALUES ($1, $2) RETURNING "+printJobColumns, id, caller.ID))
+	if err != nil {
+		log.Println("Insert print job error:", err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(http.StatusAccepted)
+	if err := json.NewEncoder(w).Encode(job); err != nil {
+		log.Println("JSON encoding error:", err)
+	}
+}
+
+// ListPrintJobs returns a request's print jobs, newest first.
+func (s *Server) ListPrintJobs(w http.ResponseWriter, r *http.Request) {
+	if _, ok := s.requireRole(w, r, Accounter, Admin); !ok {
+		return
+	}
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid ID", http.StatusBadRequest)
+		return
+	}
+
+	rows, err := s.DB.QueryContext(r.Context(),
+		"SELECT "+printJobColumns+" FROM print_job WHERE expense_id = $1 ORDER BY created_at DESC, id DESC", id)
+	if err != nil {
+		log.Println("Print job query error:", err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	jobs := []PrintJob{}
+	for rows.Next() {
+		job, err := scanPrintJob(rows)
+		if err != nil {
+			log.Println("Print job scan error:", err)
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		jobs = append(jobs, job)
+	}
+	if err := rows.Err(); err != nil {
+		log.Println("Row iteration error:", err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	if err := json.NewEncoder(w).Encode(jobs); err != nil {
+		log.Println("JSON encoding error:", err)
+	}
+}
+
+// PrintQueued prints the jobs that are due. Like the email outbox, rows are
+// locked while they print so several instances can share the queue.
+func (s *Server) PrintQueued(ctx context.Context) error {
+	p := s.Settings().Printer
+	if p == nil {
+		return nil
+	}
+
+	tx, err := s.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.QueryContext(ctx, `
+		SELECT pj.id, pj.expense_id, pj.attempts, COALESCE(u.name, '')
+		FROM print_job pj
+		LEFT JOIN users u ON u.id = pj.requested_by
+		WHERE pj.status = 'queued' AND pj.next_attempt_at <= NOW()
+		ORDER BY pj.next_attempt_at, pj.id
+		LIMIT $1
+		FOR UPDATE OF pj SKIP LOCKED
+	`, printBatchSize)
+	if err != nil {
+		return err
+	}
+	type dueJob struct {
+		id, expenseID, attempts int
+		user                    string
+	}
+	var due []dueJob
+	for rows.Next() {
+		var j dueJob
+		if err := rows.Scan(&j.id, &j.expenseID, &j.attempts, &j.user); err != nil {
+			rows.Close()
+			return err
+		}
+		due = append(due, j)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, j := range due {
+		printErr := s.printDossier(ctx, p, j.id, j.expenseID, j.user)
+		if printErr == nil {
+			_, err = tx.ExecContext(ctx,
+				"UPDATE print_job SET status = 'printed', printed_at = NOW(), attempts = attempts + 1, last_error = '' WHERE id = $1", j.id)
+		} else {
+			log.Printf("Print job %d failed: %v", j.id, printErr)
+			status := PrintQueued
+			if j.attempts+1 >= printMaxAttempts {
+				status = PrintFailed
+			}
+			_, err = tx.ExecContext(ctx,
+				"UPDATE print_job SET status = $2, attempts = attempts + 1, last_error = $3, next_attempt_at = $4 WHERE id = $1",
+				j.id, status, printErr.Error(), time.Now().Add(printRetryBase<<j.attempts))
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (s *Server) printDossier(ctx context.Context, p printer.Printer, jobID, expenseID int, user string) error {
+	data, err := s.loadExpenseReport(ctx, expenseID)
+	if err == sql.ErrNoRows {
+		return fmt.Errorf("expense request %d no longer exists", expenseID)
+	} else if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, printTimeout)
+	defer cancel()
+	return p.Print(ctx, printer.Job{
+		Name:     fmt.Sprintf("expense-request-%s-%d", data.Request.DocNumber, jobID),
+		User:     user,
+		Document: renderExpenseReport(data),
+	})
+}
+
+// RunPrintQueue prints queued dossiers periodically until ctx is cancelled.
+// It keeps running without a printer, since a reload may add one.
+func (s *Server) RunPrintQueue(ctx context.Context) {
+	ticker := time.NewTicker(printInterval)
+	defer ticker.Stop()
+
+	for {
+		if err := s.PrintQueued(ctx); err != nil && ctx.Err() == nil {
+			log.Println("Print queue error:", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,168 @@
+package server
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// deliveryLogRetention is how long finished emails, webhook deliveries and
+// background jobs are kept for troubleshooting.
+const deliveryLogRetention = 30 * 24 * time.Hour
+
+// purgeRule names rows that may be deleted once they are older than the
+// rule's retention. where takes the cutoff as $1.
+type purgeRule struct {
+	name      string
+	table     string
+	where     string
+	retention func(s *Server) time.Duration
+}
+
+var purgeRules = []purgeRule{
+	{
+		// With retention disabled no payload should be kept at all
+		name:      "expense_request_payloads",
+		table:     "expense_request_payload",
+		where:     "created_at < $1",
+		retention: func(s *Server) time.Duration { return s.PayloadRetention },
+	},
+	{
+		name:      "sent_emails",
+		table:     "email_outbox",
+		where:     "(sent_at IS NOT NULL OR next_attempt_at IS NULL) AND created_at < $1",
+		retention: func(*Server) time.Duration { return deliveryLogRetention },
+	},
+	{
+		name:      "webhook_deliveries",
+		table:     "webhook_delivery",
+		where:     "(delivered_at IS NOT NULL OR next_attempt_at IS NULL) AND created_at < $1",
+		retention: func(*Server) time.Duration { return deliveryLogRetention },
+	},
+	{
+		name:      "finished_jobs",
+		table:     "job",
+		where:     "finished_at < $1",
+		retention: func(*Server) time.Duration { return deliveryLogRetention },
+	},
+	{
+		name:      "idempotency_keys",
+		table:     "idempotency_key",
+		where:     "created_at < $1",
+		retention: func(*Server) time.Duration { return idempotencyTTL },
+	},
+	{
+		name:      "ended_sessions",
+		table:     "session",
+		where:     "COALESCE(revoked_at, expires_at) < $1",
+		retention: func(*Server) time.Duration { return sessionRetention },
+	},
+	{
+		name:      "expired_changes",
+		table:     "change_log",
+		where:     "changed_at < $1",
+		retention: func(*Server) time.Duration { return changeLogRetention },
+	},
+	{
+		name:      "forgotten_login_failures",
+		table:     "login_failure",
+		where:     "last_failed_at < $1 AND (locked_until IS NULL OR locked_until < $1)",
+		retention: func(*Server) time.Duration { return loginFailureWindow },
+	},
+	{
+		name:      "abandoned_oidc_logins",
+		table:     "oidc_login",
+		where:     "created_at < $1",
+		retention: func(*Server) time.Duration { return oidcLoginTTL },
+	},
+	{
+		name:      "table_stats",
+		table:     "table_stat",
+		where:     "collected_at < $1",
+		retention: func(*Server) time.Duration { return tableStatRetention },
+	},
+}
+
+// PurgeResult is what one retention rule removed, or would remove.
+type PurgeResult struct {
+	Rule      string    `json:"rule"`
+	Table     string    `json:"table"`
+	Retention string    `json:"retention"`
+	Cutoff    time.Time `json:"cutoff"`
+	Rows      int64     `json:"rows"`
+}
+
+type PurgeReport struct {
+	DryRun  bool          `json:"dryRun"`
+	Results []PurgeResult `json:"results"`
+}
+
+// purge applies every rule in one transaction, counting instead of deleting
+// on a dry run. A real run is recorded in the audit log with its results.
+func (s *Server) purge(ctx context.Context, actorID int, dryRun bool) (PurgeReport, error) {
+	report := PurgeReport{DryRun: dryRun, Results: []PurgeResult{}}
+	tx, err := s.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return report, err
+	}
+	defer tx.Rollback()
+
+	now := time.Now()
+	for _, rule := range purgeRules {
+		retention := rule.retention(s)
+		result := PurgeResult{Rule: rule.name, Table: rule.table, Retention: retention.String(), Cutoff: now.Add(-retention)}
+		if dryRun {
+			err = tx.QueryRowContext(ctx, "SELECT COUNT(*) FROM "+rule.table+" WHERE "+rule.where, result.Cutoff).Scan(&result.Rows)
+		} else {
+			var res sql.Result
+			res, err = tx.ExecContext(ctx, "DELETE FROM "+rule.table+" WHERE "+rule.where, result.Cutoff)
+			if err == nil {
+				result.Rows, err = res.RowsAffected()
+			}
+		}
+		if err != nil {
+			return report, err
+		}
+		report.Results = append(report.Results, result)
+	}
+
+	if dryRun {
+		return report, nil
+	}
+	if err := audit(ctx, tx, actorID, "admin.purge", report.Results); err != nil {
+		return report, err
+	}
+	return report, tx.Commit()
+}
+
+// AdminPurge permanently deletes rows past their retention period.
+// ?dryRun=true reports what would be deleted without deleting it.
+func (s *Server) AdminPurge(w http.ResponseWriter, r *http.Request) {
+	caller, ok := s.requireRole(w, r, Admin)
+	if !ok {
+		return
+	}
+
+	dryRun := false
+	if v := r.URL.Query().Get("dryRun"); v != "" {
+		var err error
+		if dryRun, err = strconv.ParseBool(v); err != nil {
+			http.Error(w, "Invalid dry_run parameter", http.StatusBadRequest)
+			return
+		}
+	}
+
+	report, err := s.purge(r.Context(), caller.ID, dryRun)
+	if err != nil {
+		log.Println("Purge error:", err)
+		http.Error(w, "Purge failed", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(report)
+}
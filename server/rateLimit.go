@@ -0,0 +1,77 @@
+package server
+
+import (
+	"log"
+	"main/ratelimit"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// RateLimits are the token buckets every client gets, one for reads and
+// one for writes, so a client polling lists cannot starve its own writes.
+// A zero Rate lifts that limit.
+type RateLimits struct {
+	Read  ratelimit.Limit
+	Write ratelimit.Limit
+}
+
+// rateLimitClient identifies who a request counts against: its API key, the
+// user of a valid bearer token, or else the address it came from. The token
+// is only checked, not looked up, so a flood of requests never reaches the
+// database.
+func (s *Server) rateLimitClient(r *http.Request) string {
+	if key, ok := requestAPIKey(r); ok {
+		return "key:" + strconv.Itoa(key.ID)
+	}
+	if token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+		if claims, err := s.parseToken(token); err == nil {
+			return "user:" + claims.Subject
+		}
+	}
+	return "ip:" + clientAddress(r)
+}
+
+// clientAddress is the address a request came from, without its port.
+func clientAddress(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// RateLimitMiddleware answers 429 with Retry-After once the caller's read
+// or write bucket is empty. If the store cannot be reached requests are let
+// through, so an outage of Redis does not take the API down with it.
+func (s *Server) RateLimitMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		limits := s.Settings().RateLimits
+		limit, class := limits.Write, "write"
+		if r.Method == http.MethodGet || r.Method == http.MethodHead {
+			limit, class = limits.Read, "read"
+		}
+		if s.RateLimiter == nil || limit.Rate <= 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		result, err := s.RateLimiter.Take(r.Context(), s.rateLimitClient(r)+":"+class, limit)
+		if err != nil {
+			log.Println("Rate limiter error:", err)
+			next.ServeHTTP(w, r)
+			return
+		}
+		w.Header().Set("RateLimit-Limit", strconv.Itoa(limit.Burst))
+		w.Header().Set("RateLimit-Remaining", strconv.Itoa(result.Remaining))
+		if !result.Allowed {
+			seconds := int((result.RetryAfter + time.Second - 1) / time.Second)
+			w.Header().Set("Retry-After", strconv.Itoa(seconds))
+			http.Error(w, "Too many requests", http.StatusTooManyRequests)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
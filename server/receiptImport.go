@@ -0,0 +1,202 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	receiptFetchTimeout = 15 * time.Second
+	receiptMaxRedirects = 3
+	receiptDefaultName  = "receipt"
+)
+
+var errReceiptURL = errors.New("URL is not allowed")
+
+type importReceiptRequest struct {
+	URL string `json:"url"`
+}
+
+// hostAllowed reports whether host equals or is a subdomain of an entry in
+// the configured allowlist. An empty allowlist allows nothing.
+func (s *Server) hostAllowed(host string) bool {
+	host = strings.ToLower(host)
+	for _, allowed := range s.Settings().ReceiptHosts {
+		allowed = strings.ToLower(allowed)
+		if host == allowed || strings.HasSuffix(host, "."+allowed) {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *Server) checkReceiptURL(u *url.URL) error {
+	if u.Scheme != "https" || u.User != nil || !s.hostAllowed(u.Hostname()) {
+		return errReceiptURL
+	}
+	return nil
+}
+
+// specialPrefixes are ranges net/netip counts as global unicast that are
+// not reachable public hosts: "this network", carrier-grade NAT (RFC 6598),
+// IETF protocol assignments, benchmarking, the reserved 240/4 and NAT64,
+// which can translate to any IPv4 address.
+var specialPrefixes = []netip.Prefix{
+	netip.MustParsePrefix("0.0.0.0/8"),
+	netip.MustParsePrefix("100.64.0.0/10"),
+	netip.MustParsePrefix("192.0.0.0/24"),
+	netip.MustParsePrefix("198.18.0.0/15"),
+	netip.MustParsePrefix("240.0.0.0/4"),
+	netip.MustParsePrefix("64:ff9b::/96"),
+	netip.MustParsePrefix("64:ff9b:1::/48"),
+}
+
+// publicAddress reports whether ip is a global unicast address outside the
+// private and special-purpose ranges.
+func publicAddress(ip netip.Addr) bool {
+	ip = ip.Unmap()
+	if !ip.IsGlobalUnicast() || ip.IsPrivate() {
+		return false
+	}
+	for _, prefix := range specialPrefixes {
+		if prefix.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+// publicOnlyControl refuses connections to anything but public unicast
+// addresses, such as loopback, private, carrier-grade NAT and link-local
+// ones. It runs after DNS resolution, so a public name resolving to an
+// internal address is still blocked.
+func publicOnlyControl(network, address string, _ syscall.RawConn) error {
+	addrPort, err := netip.ParseAddrPort(address)
+	if err != nil {
+		return err
+	}
+	if !publicAddress(addrPort.Addr()) {
+		return fmt.Errorf("%w: refusing to connect to %s", errReceiptURL, addrPort.Addr())
+	}
+	return nil
+}
+
+// receiptClient is an HTTP client hardened for fetching user-supplied URLs.
+func (s *Server) receiptClient() *http.Client {
+	dialer := &net.Dialer{Timeout: 5 * time.Second, Control: publicOnlyControl}
+	transport := &http.Transport{
+		// No proxy: the dialer must see the real destination address
+		Proxy:                 nil,
+		DialContext:           dialer.DialContext,
+		TLSHandshakeTimeout:   5 * time.Second,
+		ResponseHeaderTimeout: 10 * time.Second,
+	}
+
+	return &http.Client{
+		Timeout:   receiptFetchTimeout,
+		Transport: transport,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) >= receiptMaxRedirects {
+				return errors.New("too many redirects")
+			}
+			return s.checkReceiptURL(req.URL)
+		},
+	}
+}
+
+// fetchReceipt downloads at most maxAttachmentSize+1 bytes so the attachment
+// pipeline can reject oversized files without buffering them whole.
+func (s *Server) fetchReceipt(ctx context.Context, u *url.URL) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := s.receiptClient().Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("remote server responded with %s", resp.Status)
+	}
+	if resp.ContentLength > maxAttachmentSize {
+		return nil, errAttachmentTooLarge
+	}
+	return io.ReadAll(io.LimitReader(resp.Body, maxAttachmentSize+1))
+}
+
+// ImportAttachmentFromURL makes the server fetch a URL, so only the
+// requester or an Admin may point it at one.
+func (s *Server) ImportAttachmentFromURL(w http.ResponseWriter, r *http.Request) {
+	expenseID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid ID", http.StatusBadRequest)
+		return
+	}
+	v, expense, ok := s.readExpenseRequestAs(w, r, expenseID)
+	if !ok {
+		return
+	}
+	if v.user.ID != expense.UserID && v.user.RoleID != Admin {
+		http.Error(w, "Only the requester may import receipts into the expense request", http.StatusForbidden)
+		return
+	}
+
+	var req importReceiptRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+
+	u, err := url.Parse(req.URL)
+	if err != nil {
+		writeValidationErrors(w, FieldErrors{"url": "is not a valid URL"})
+		return
+	}
+	if err := s.checkReceiptURL(u); err != nil {
+		writeValidationErrors(w, FieldErrors{"url": "must be an https URL on an allowed host"})
+		return
+	}
+
+	data, err := s.fetchReceipt(r.Context(), u)
+	if errors.Is(err, errAttachmentTooLarge) {
+		http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+		return
+	} else if err != nil {
+		log.Println("Receipt fetch error:", err)
+		http.Error(w, "Failed to fetch receipt", http.StatusBadGateway)
+		return
+	}
+
+	filename := path.Base(u.Path)
+	if filename == "/" || filename == "." {
+		filename = receiptDefaultName
+	}
+
+	a, err := s.saveAttachment(r.Context(), s.DB, expenseID, filename, data, u.String())
+	if err != nil {
+		writeAttachmentError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(a)
+}
@@ -0,0 +1,98 @@
+package server
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"testing"
+)
+
+func TestPublicAddress(t *testing.T) {
+	tests := []struct {
+		addr   string
+		public bool
+	}{
+		{"93.184.216.34", true},
+		{"2606:2800:220:1:248:1893:25c8:1946", true},
+		{"::ffff:93.184.216.34", true},
+		{"100.63.255.255", true},
+		{"100.128.0.0", true},
+		{"127.0.0.1", false},
+		{"10.1.2.3", false},
+		{"172.16.0.1", false},
+		{"192.168.1.1", false},
+		{"100.64.0.1", false},
+		{"100.127.255.254", false},
+		{"::ffff:100.64.0.1", false},
+		{"169.254.169.254", false},
+		{"0.0.0.0", false},
+		{"0.1.2.3", false},
+		{"192.0.0.8", false},
+		{"198.18.0.1", false},
+		{"240.0.0.1", false},
+		{"255.255.255.255", false},
+		{"224.0.0.1", false},
+		{"::1", false},
+		{"::", false},
+		{"fe80::1", false},
+		{"fd00::1", false},
+		{"ff02::1", false},
+		{"64:ff9b::a00:1", false},
+	}
+	for _, tt := range tests {
+		if got := publicAddress(netip.MustParseAddr(tt.addr)); got != tt.public {
+			t.Errorf("publicAddress(%s) = %v, want %v", tt.addr, got, tt.public)
+		}
+	}
+
+	if err := publicOnlyControl("tcp", "[fe80::1%eth0]:443", nil); !errors.Is(err, errReceiptURL) {
+		t.Errorf("link-local with a zone: %v", err)
+	}
+	if err := publicOnlyControl("tcp", "93.184.216.34:443", nil); err != nil {
+		t.Errorf("public address: %v", err)
+	}
+}
+
+func TestImportAttachmentFromURLAccess(t *testing.T) {
+	ts := newTestServer(t, []string{"Sales"}, []string{"Travel"})
+	requester, requesterToken := ts.addUser(t, "requester", "Sales", FieldPersonnel)
+	_, colleagueToken := ts.addUser(t, "colleague", "Sales", FieldPersonnel)
+	_, managerToken := ts.addUser(t, "manager", "Sales", Manager)
+	_, adminToken := ts.addUser(t, "admin", "Sales", Admin)
+	expense, err := ts.expenses.Create(t.Context(), ExpenseRequest{UserID: requester.ID, UnitID: "Sales", Category: "Travel", Amount: 1000, Currency: "EUR"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts.db.answer("SELECT user_id, unit_id FROM expense_request WHERE id = $1", func(args []driver.Value) [][]driver.Value {
+		e, err := ts.expenses.Get(context.Background(), int(args[0].(int64)))
+		if err != nil {
+			return nil
+		}
+		return [][]driver.Value{{int64(e.UserID), e.UnitID}}
+	})
+
+	id := strconv.Itoa(expense.ID)
+	target := "/expense_requests/" + id + "/attachments/from_url"
+	body := `{"url": "http://169.254.169.254/latest/meta-data/"}`
+	tests := []struct {
+		name  string
+		token string
+		want  int
+	}{
+		{"anonymous", "", http.StatusUnauthorized},
+		{"outside the request's scope", colleagueToken, http.StatusNotFound},
+		{"reader who is not the requester", managerToken, http.StatusForbidden},
+		// Both get as far as the URL check
+		{"requester", requesterToken, http.StatusUnprocessableEntity},
+		{"Admin", adminToken, http.StatusUnprocessableEntity},
+	}
+	for _, tt := range tests {
+		w := serve(ts.ImportAttachmentFromURL, "POST", target, map[string]string{"id": id}, tt.token, body)
+		if w.Code != tt.want {
+			t.Errorf("%s: status = %d, want %d: %s", tt.name, w.Code, tt.want, w.Body)
+		}
+	}
+}
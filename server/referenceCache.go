@@ -0,0 +1,98 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Units and expense categories are read by clients on nearly every screen
+// and change rarely, so their lists are served from s.Cache. Every write to
+// either table drops the cached list. With the in-memory cache the other
+// instances keep theirs until ReferenceCacheTTL passes, which a shared
+// Redis cache avoids; so does a list read while a write commits.
+//
+// The keys are the tables' names, which are also their collections in
+// collection_change.
+const (
+	unitsCacheKey      = "unit"
+	categoriesCacheKey = "expense_category"
+)
+
+// referenceMaxAge is how long clients may reuse a reference list before
+// asking again with its ETag.
+const referenceMaxAge = time.Minute
+
+// referenceList is a cached reference list and when its table last
+// changed.
+type referenceList[T any] struct {
+	Modified time.Time `json:"modified"`
+	Items    []T       `json:"items"`
+}
+
+// cachedList returns the list under key from s.Cache, reading it with load
+// when it is not cached. A cache that fails is logged and bypassed.
+func cachedList[T any](ctx context.Context, s *Server, key string, load func(context.Context) ([]T, error)) (referenceList[T], error) {
+	var list referenceList[T]
+	if s.Cache != nil {
+		data, ok, err := s.Cache.Get(ctx, key)
+		if err != nil {
+			log.Println("Cache read error:", err)
+		} else if ok {
+			if err := json.Unmarshal(data, &list); err == nil {
+				return list, nil
+			}
+			log.Println("Cached", key, "list is corrupt; reading it again")
+		}
+	}
+
+	// Read before the rows, so a change committed in between makes the
+	// list look older rather than newer than it is
+	modified, err := s.collectionModified(ctx, key)
+	if err != nil {
+		log.Println("Collection change lookup error:", err)
+	}
+	items, err := load(ctx)
+	if err != nil {
+		return list, err
+	}
+	list = referenceList[T]{Modified: modified, Items: items}
+	if s.Cache == nil {
+		return list, nil
+	}
+	data, err := json.Marshal(list)
+	if err != nil {
+		return list, err
+	}
+	if err := s.Cache.Set(ctx, key, data, s.ReferenceCacheTTL); err != nil {
+		log.Println("Cache write error:", err)
+	}
+	return list, nil
+}
+
+// invalidateReference drops the cached lists under keys after a write to
+// their tables.
+func (s *Server) invalidateReference(ctx context.Context, keys ...string) {
+	if s.Cache == nil {
+		return
+	}
+	if err := s.Cache.Delete(ctx, keys...); err != nil {
+		log.Println("Cache invalidation error:", err)
+	}
+}
+
+// DropReferenceCache drops every cached reference list, for writes made
+// outside the handlers, such as seeding demo data.
+func (s *Server) DropReferenceCache(ctx context.Context) {
+	s.invalidateReference(ctx, unitsCacheKey, categoriesCacheKey)
+}
+
+// writeReferenceList answers with a reference list and how long it may be
+// reused, or with 304 when the client has it already; see writeConditional.
+func writeReferenceList(w http.ResponseWriter, r *http.Request, items any, modified time.Time) {
+	w.Header().Set("Cache-Control", "private, max-age="+strconv.Itoa(int(referenceMaxAge.Seconds())))
+	writeConditional(w, r, items, modified)
+}
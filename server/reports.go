@@ -0,0 +1,242 @@
+package server
+
+import (
+	"encoding/json"
+	"log"
+	"main/money"
+	"main/query"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+type ExpenseReportRow struct {
+	Month    int          `json:"month,omitempty"`
+	Category string       `json:"category,omitempty"`
+	Spent    money.Amount `json:"spent"`
+	Budget   money.Amount `json:"budget"`
+	Variance money.Amount `json:"variance"`
+}
+
+// ExpenseReport aggregates paid expenses for a fiscal year and compares them with
+// the budgets. Variance is budget minus spent, so negative means overspent.
+// All amounts are in the base currency; payments and budgets in a currency
+// with no known exchange rate are left out and counted in Unconverted.
+// Each payment and budget is converted to the cent and summed as NUMERIC,
+// so the totals are exactly the sums of the rows.
+type ExpenseReport struct {
+	UnitID          string             `json:"unitID,omitempty"`
+	IncludeSubunits bool               `json:"includeSubunits,omitempty"` // UnitID's sub-units are included
+	Year            int                `json:"year"`
+	GroupBy         string             `json:"groupBy"`
+	AsOf            *time.Time         `json:"asOf,omitempty"`
+	BaseCurrency    string             `json:"baseCurrency"`
+	Unconverted     int                `json:"unconverted"`
+	TotalSpent      money.Amount       `json:"totalSpent"`
+	TotalBudget     money.Amount       `json:"totalBudget"`
+	Variance        money.Amount       `json:"variance"`
+	Rows            []ExpenseReportRow `json:"rows"`
+}
+
+func (s *Server) ExpenseReport(w http.ResponseWriter, r *http.Request) {
+	queryParams := r.URL.Query()
+
+	year, err := strconv.Atoi(queryParams.Get("year"))
+	if err != nil {
+		http.Error(w, "Missing or invalid year parameter", http.StatusBadRequest)
+		return
+	}
+
+	groupBy := queryParams.Get("groupBy")
+	if groupBy == "" {
+		groupBy = "category"
+	}
+	if groupBy != "category" && groupBy != "month" {
+		http.Error(w, "group_by must be month or category", http.StatusBadRequest)
+		return
+	}
+
+	subunits, ok := includeSubunits(w, r)
+	if !ok {
+		return
+	}
+	if !s.readableUnit(w, r, queryParams.Get("unitID")) {
+		return
+	}
+
+	report := ExpenseReport{
+		UnitID:          queryParams.Get("unitID"),
+		IncludeSubunits: subunits,
+		Year:            year,
+		GroupBy:         groupBy,
+		BaseCurrency:    s.BaseCurrency,
+		Rows:            []ExpenseReportRow{},
+	}
+
+	// Filters shared by the paid_expense and budget sides
+	var args query.Args
+	yearArg := args.Add(year)
+	paidFilter := "fiscal_year(pe.created_at, pe.unit_id) = " + yearArg
+	budgetFilter := "b.year = " + yearArg
+	if report.UnitID != "" && subunits {
+		unit := args.Add(report.UnitID)
+		paidFilter += " AND pe.unit_id IN (" + unitSubtree(unit) + ")"
+		budgetFilter += " AND b.unit_id IN (" + unitSubtree(unit) + ")"
+	} else if report.UnitID != "" {
+		unit := args.Add(report.UnitID)
+		paidFilter += " AND pe.unit_id = " + unit
+		budgetFilter += " AND b.unit_id = " + unit
+	}
+
+	// With asOf, the report is the one that could have been drawn then:
+	// payments made up to that time, against the limits budgets had
+	budgetLimit := "b.budget_limit"
+	asOf, ok := asOfParam(w, r)
+	if !ok {
+		return
+	}
+	if asOf != nil {
+		report.AsOf = asOf
+		at := args.Add(*asOf)
+		paidFilter += " AND pe.created_at <= " + at + "::timestamptz"
+		budgetLimit = budgetLimitAsOf("b", at)
+		budgetFilter += " AND " + budgetLimit + " IS NOT NULL"
+	}
+
+	// Payments convert at the rate of their day, budgets at the latest rate
+	paidAmount := "ROUND(" + s.inBaseCurrency("pe.amount", "pe.currency", "pe.created_at::date") + ", 2)"
+	budgetAmount := "ROUND(" + s.inBaseCurrency(budgetLimit, "b.currency", "CURRENT_DATE") + ", 2)"
+
+	if groupBy == "category" {
+		query := `
+			WITH spent AS (
+				SELECT category, SUM(converted) AS spent, COUNT(*) - COUNT(converted) AS unconverted
+				FROM (
+					SELECT pe.category, ` + paidAmount + ` AS converted
+					FROM paid_expense pe
+					WHERE ` + paidFilter + `
+				) p
+				GROUP BY category
+			), budgeted AS (
+				SELECT category, SUM(converted) AS budget, COUNT(*) - COUNT(converted) AS unconverted
+				FROM (
+					SELECT b.expense_category AS category, ` + budgetAmount + ` AS converted
+					FROM budget b
+					WHERE ` + budgetFilter + `
+				) b
+				GROUP BY category
+			)
+			SELECT COALESCE(s.category, b.category), COALESCE(s.spent, 0), COALESCE(b.budget, 0),
+				COALESCE(s.unconverted, 0) + COALESCE(b.unconverted, 0)
+			FROM spent s
+			FULL OUTER JOIN budgeted b ON b.category = s.category
+			ORDER BY 1
+		`
+
+		rows, err := s.DB.QueryContext(r.Context(), query, args...)
+		if err != nil {
+			log.Println("ExpenseReport query error:", err)
+			http.Error(w, "Database query failed", http.StatusInternalServerError)
+			return
+		}
+		defer rows.Close()
+
+		for rows.Next() {
+			var row ExpenseReportRow
+			var unconverted int
+			if err := rows.Scan(&row.Category, &row.Spent, &row.Budget, &unconverted); err != nil {
+				log.Println("Row scan error:", err)
+				http.Error(w, "Failed to read report data", http.StatusInternalServerError)
+				return
+			}
+			row.Variance = row.Budget - row.Spent
+			report.Unconverted += unconverted
+			report.TotalBudget += row.Budget
+			report.TotalSpent += row.Spent
+			report.Rows = append(report.Rows, row)
+		}
+		if err := rows.Err(); err != nil {
+			log.Println("Row iteration error:", err)
+			http.Error(w, "Error reading results", http.StatusInternalServerError)
+			return
+		}
+	} else {
+		err := s.DB.QueryRowContext(r.Context(), `
+			SELECT COALESCE(SUM(converted), 0), COUNT(*) - COUNT(converted)
+			FROM (SELECT `+budgetAmount+` AS converted FROM budget b WHERE `+budgetFilter+`) b
+		`, args...).Scan(&report.TotalBudget, &report.Unconverted)
+		if err != nil {
+			log.Println("ExpenseReport budget query error:", err)
+			http.Error(w, "Database query failed", http.StatusInternalServerError)
+			return
+		}
+
+		rows, err := s.DB.QueryContext(r.Context(), `
+			SELECT month, COALESCE(SUM(converted), 0), COUNT(*) - COUNT(converted)
+			FROM (
+				SELECT EXTRACT(MONTH FROM pe.created_at)::int AS month, `+paidAmount+` AS converted
+				FROM paid_expense pe
+				WHERE `+paidFilter+`
+			) p
+			GROUP BY month
+		`, args...)
+		if err != nil {
+			log.Println("ExpenseReport query error:", err)
+			http.Error(w, "Database query failed", http.StatusInternalServerError)
+			return
+		}
+		defer rows.Close()
+
+		// Every month is reported, in the order of the fiscal year of the unit
+		// or the organisation, with the annual budget spread evenly as
+		// DistributeBudget spreads it, the last month taking the remainder
+		start, _, err := fiscalYearBounds(r.Context(), s.DB, year, report.UnitID)
+		if err != nil {
+			log.Println("Fiscal year lookup error:", err)
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		monthly := make([]ExpenseReportRow, 12)
+		for i, share := range distribute(report.TotalBudget, 12, nil, 0) {
+			monthly[i] = ExpenseReportRow{Month: int(start.AddDate(0, i, 0).Month()), Budget: share.BudgetLimit}
+		}
+		for rows.Next() {
+			var month, unconverted int
+			var spent money.Amount
+			if err := rows.Scan(&month, &spent, &unconverted); err != nil {
+				log.Println("Row scan error:", err)
+				http.Error(w, "Failed to read report data", http.StatusInternalServerError)
+				return
+			}
+			i := (month - int(start.Month()) + 12) % 12
+			monthly[i].Spent = spent
+			report.TotalSpent += spent
+			report.Unconverted += unconverted
+		}
+		if err := rows.Err(); err != nil {
+			log.Println("Row iteration error:", err)
+			http.Error(w, "Error reading results", http.StatusInternalServerError)
+			return
+		}
+
+		for i := range monthly {
+			monthly[i].Variance = monthly[i].Budget - monthly[i].Spent
+		}
+		report.Rows = monthly
+	}
+
+	// Converted figures follow the base currency's rounding rule
+	round := s.conversionRounding(r.Context()).Round
+	for i := range report.Rows {
+		row := &report.Rows[i]
+		row.Spent, row.Budget = round(row.Spent), round(row.Budget)
+		row.Variance = row.Budget - row.Spent
+	}
+	report.TotalSpent, report.TotalBudget = round(report.TotalSpent), round(report.TotalBudget)
+	report.Variance = report.TotalBudget - report.TotalSpent
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	if err := json.NewEncoder(w).Encode(report); err != nil {
+		log.Println("JSON encoding error:", err)
+	}
+}
@@ -0,0 +1,202 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// latencyBuckets are the upper bounds, in seconds, of the request latency
+// histogram.
+var latencyBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// businessCounters maps the webhook events counted as business metrics to
+// their metric names.
+var businessCounters = map[string]string{
+	WebhookExpenseCreated:          "ems_expenses_created_total",
+	WebhookExpenseApproved:         "ems_expenses_approved_total",
+	WebhookPaymentCreated:          "ems_payments_total",
+	WebhookBudgetThresholdExceeded: "ems_budget_thresholds_exceeded_total",
+}
+
+type requestKey struct {
+	method, route string
+	status        int
+}
+
+type routeKey struct {
+	method, route string
+}
+
+type latencyHistogram struct {
+	counts []uint64 // per bucket, not cumulative
+	sum    float64
+	count  uint64
+}
+
+// requestMetrics counts requests and business events since the process
+// started. The zero value is ready to use.
+type requestMetrics struct {
+	mu       sync.Mutex
+	requests map[requestKey]uint64
+	latency  map[routeKey]*latencyHistogram
+	events   map[string]uint64
+}
+
+func (m *requestMetrics) observe(method, route string, status int, elapsed time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.requests == nil {
+		m.requests = map[requestKey]uint64{}
+		m.latency = map[routeKey]*latencyHistogram{}
+	}
+	m.requests[requestKey{method, route, status}]++
+
+	h := m.latency[routeKey{method, route}]
+	if h == nil {
+		h = &latencyHistogram{counts: make([]uint64, len(latencyBuckets))}
+		m.latency[routeKey{method, route}] = h
+	}
+	seconds := elapsed.Seconds()
+	h.sum += seconds
+	h.count++
+	if i := sort.SearchFloat64s(latencyBuckets, seconds); i < len(latencyBuckets) {
+		h.counts[i]++
+	}
+}
+
+func (m *requestMetrics) event(event string) {
+	if _, ok := businessCounters[event]; !ok {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.events == nil {
+		m.events = map[string]uint64{}
+	}
+	m.events[event]++
+}
+
+// statusRecorder remembers the status a handler answered with.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (rec *statusRecorder) WriteHeader(status int) {
+	if rec.status == 0 {
+		rec.status = status
+	}
+	rec.ResponseWriter.WriteHeader(status)
+}
+
+func (rec *statusRecorder) Write(b []byte) (int, error) {
+	if rec.status == 0 {
+		rec.status = http.StatusOK
+	}
+	return rec.ResponseWriter.Write(b)
+}
+
+// Unwrap lets http.ResponseController reach the connection, which event
+// streams need to flush.
+func (rec *statusRecorder) Unwrap() http.ResponseWriter {
+	return rec.ResponseWriter
+}
+
+// template is the route's path with its variables' patterns left out, as
+// in /expense_requests/{id}.
+func (route Route) template() string {
+	return pathParam.ReplaceAllString(route.Path, "{$1}")
+}
+
+// MetricsMiddleware counts a route's requests by status and times them.
+// Requests are labelled with the route's path template rather than the
+// requested path, so IDs do not multiply the series.
+func (s *Server) MetricsMiddleware(route Route, next http.Handler) http.Handler {
+	template := route.template()
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(rec, r)
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+		s.metrics.observe(route.Method, template, rec.status, time.Since(start))
+	})
+}
+
+// writeRequestMetrics renders the request, connection pool and business
+// metrics in the Prometheus text format.
+func (s *Server) writeRequestMetrics(b *strings.Builder) {
+	m := &s.metrics
+	m.mu.Lock()
+	requests := make([]requestKey, 0, len(m.requests))
+	for k := range m.requests {
+		requests = append(requests, k)
+	}
+	sort.Slice(requests, func(i, j int) bool {
+		a, c := requests[i], requests[j]
+		if a.route != c.route {
+			return a.route < c.route
+		}
+		if a.method != c.method {
+			return a.method < c.method
+		}
+		return a.status < c.status
+	})
+	fmt.Fprint(b, "# HELP ems_http_requests_total Requests served per route and status code.\n# TYPE ems_http_requests_total counter\n")
+	for _, k := range requests {
+		fmt.Fprintf(b, "ems_http_requests_total{method=%q,route=%q,code=\"%d\"} %d\n", k.method, k.route, k.status, m.requests[k])
+	}
+
+	routes := make([]routeKey, 0, len(m.latency))
+	for k := range m.latency {
+		routes = append(routes, k)
+	}
+	sort.Slice(routes, func(i, j int) bool {
+		if routes[i].route != routes[j].route {
+			return routes[i].route < routes[j].route
+		}
+		return routes[i].method < routes[j].method
+	})
+	fmt.Fprint(b, "# HELP ems_http_request_duration_seconds Time taken to serve requests per route.\n# TYPE ems_http_request_duration_seconds histogram\n")
+	for _, k := range routes {
+		h := m.latency[k]
+		labels := fmt.Sprintf("method=%q,route=%q", k.method, k.route)
+		var cumulative uint64
+		for i, bound := range latencyBuckets {
+			cumulative += h.counts[i]
+			fmt.Fprintf(b, "ems_http_request_duration_seconds_bucket{%s,le=%q} %d\n", labels, strconv.FormatFloat(bound, 'g', -1, 64), cumulative)
+		}
+		fmt.Fprintf(b, "ems_http_request_duration_seconds_bucket{%s,le=\"+Inf\"} %d\n", labels, h.count)
+		fmt.Fprintf(b, "ems_http_request_duration_seconds_sum{%s} %g\n", labels, h.sum)
+		fmt.Fprintf(b, "ems_http_request_duration_seconds_count{%s} %d\n", labels, h.count)
+	}
+
+	events := make([]string, 0, len(businessCounters))
+	for event := range businessCounters {
+		events = append(events, event)
+	}
+	sort.Strings(events)
+	for _, event := range events {
+		name := businessCounters[event]
+		fmt.Fprintf(b, "# HELP %s Count of %s events since the server started.\n# TYPE %s counter\n%s %d\n",
+			name, event, name, name, m.events[event])
+	}
+	m.mu.Unlock()
+
+	stats := s.DB.Stats()
+	gauge := func(name, help string, value float64) {
+		fmt.Fprintf(b, "# HELP %s %s\n# TYPE %s gauge\n%s %g\n", name, help, name, name, value)
+	}
+	gauge("ems_db_connections_open", "Open database connections.", float64(stats.OpenConnections))
+	gauge("ems_db_connections_in_use", "Database connections in use.", float64(stats.InUse))
+	gauge("ems_db_connections_idle", "Idle database connections.", float64(stats.Idle))
+	gauge("ems_db_connections_max_open", "Maximum open database connections, 0 for unlimited.", float64(stats.MaxOpenConnections))
+	fmt.Fprintf(b, "# HELP ems_db_connection_waits_total Times a query waited for a free connection.\n# TYPE ems_db_connection_waits_total counter\nems_db_connection_waits_total %d\n", stats.WaitCount)
+	fmt.Fprintf(b, "# HELP ems_db_connection_wait_seconds_total Time spent waiting for a free connection.\n# TYPE ems_db_connection_wait_seconds_total counter\nems_db_connection_wait_seconds_total %g\n", stats.WaitDuration.Seconds())
+}
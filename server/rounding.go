@@ -0,0 +1,273 @@
+package server
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"log"
+	"main/money"
+	"math"
+	"net/http"
+	"slices"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"github.com/lib/pq"
+)
+
+// RoundingKind names a kind of server-computed amount.
+type RoundingKind string
+
+const (
+	RoundConversion RoundingKind = "conversion" // amounts converted to the base currency
+	RoundPerDiem    RoundingKind = "per_diem"
+	RoundMileage    RoundingKind = "mileage"
+)
+
+var roundingKinds = []RoundingKind{RoundConversion, RoundPerDiem, RoundMileage}
+
+type RoundingMode string
+
+const (
+	RoundNearest RoundingMode = "nearest" // halves round away from zero
+	RoundUp      RoundingMode = "up"
+	RoundDown    RoundingMode = "down"
+)
+
+// RoundingRule rounds computed amounts of one kind in one currency to a
+// multiple of Increment, e.g. 0.5 for per-diems. Without a stored rule an
+// amount is rounded to the nearest minor unit of its currency.
+type RoundingRule struct {
+	Currency  string       `json:"currency"`
+	Kind      RoundingKind `json:"kind"`
+	Increment float64      `json:"increment"`
+	Mode      RoundingMode `json:"mode"`
+	Default   bool         `json:"default"`
+}
+
+func (RoundingRule) CreateTableIfNotExists(s *Server) {
+	query := `CREATE TABLE IF NOT EXISTS rounding_rule (
+		currency CHAR(3) NOT NULL,
+		kind VARCHAR(32) NOT NULL,
+		increment NUMERIC(12,6) NOT NULL,
+		mode VARCHAR(16) NOT NULL,
+
+		PRIMARY KEY (currency, kind)
+	)`
+
+	_, err := s.DB.Exec(query)
+
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+func (rule RoundingRule) Validate(ctx context.Context, s *Server) (FieldErrors, error) {
+	errs := FieldErrors{}
+	if !slices.Contains(roundingKinds, rule.Kind) {
+		errs.add("kind", "must be one of conversion, per_diem, mileage")
+	}
+	if rule.Increment <= 0 {
+		errs.add("increment", "must be greater than 0")
+	}
+	switch rule.Mode {
+	case RoundNearest, RoundUp, RoundDown:
+	default:
+		errs.add("mode", "must be one of nearest, up, down")
+	}
+	if err := s.checkExists(ctx, errs, "currency", "unknown currency",
+		"SELECT 1 FROM currency WHERE code = $1", rule.Currency); err != nil {
+		return nil, err
+	}
+	return errs, nil
+}
+
+// Apply rounds v according to the rule.
+func (rule RoundingRule) Apply(v float64) float64 {
+	if rule.Increment <= 0 {
+		return v
+	}
+	// The epsilon keeps values that are exact multiples in binary noise from
+	// being pushed to the next step
+	steps := v / rule.Increment
+	switch rule.Mode {
+	case RoundUp:
+		steps = math.Ceil(steps - 1e-9)
+	case RoundDown:
+		steps = math.Floor(steps + 1e-9)
+	default:
+		steps = math.Round(steps)
+	}
+	return math.Round(steps*rule.Increment*1e6) / 1e6
+}
+
+// Round rounds an amount according to the rule, and to the cent.
+func (rule RoundingRule) Round(a money.Amount) money.Amount {
+	return money.FromFloat(rule.Apply(a.Float64()))
+}
+
+func defaultRoundingRule(currency string, kind RoundingKind, minorUnits int) RoundingRule {
+	return RoundingRule{
+		Currency:  currency,
+		Kind:      kind,
+		Increment: math.Pow10(-minorUnits),
+		Mode:      RoundNearest,
+		Default:   true,
+	}
+}
+
+// roundingRule returns the rule in effect for a currency and kind.
+func (s *Server) roundingRule(ctx context.Context, currency string, kind RoundingKind) (RoundingRule, error) {
+	var minorUnits sql.NullInt64
+	var increment sql.NullFloat64
+	var mode sql.NullString
+	err := s.DB.QueryRowContext(ctx, `
+		SELECT c.minor_units, rr.increment, rr.mode
+		FROM currency c
+		LEFT JOIN rounding_rule rr ON rr.currency = c.code AND rr.kind = $2
+		WHERE c.code = $1
+	`, currency, kind).Scan(&minorUnits, &increment, &mode)
+	if err != nil && err != sql.ErrNoRows {
+		return RoundingRule{Currency: currency, Kind: kind}, err
+	}
+	return roundingRuleOf(currency, kind, minorUnits, increment, mode), nil
+}
+
+// roundingRuleOf is the rule for a currency's minor units and its
+// rounding_rule row, as read by a query that joins them; an unknown
+// currency rounds to cents.
+func roundingRuleOf(currency string, kind RoundingKind, minorUnits sql.NullInt64, increment sql.NullFloat64, mode sql.NullString) RoundingRule {
+	if !increment.Valid {
+		units := 2
+		if minorUnits.Valid {
+			units = int(minorUnits.Int64)
+		}
+		return defaultRoundingRule(currency, kind, units)
+	}
+	return RoundingRule{Currency: currency, Kind: kind, Increment: increment.Float64, Mode: RoundingMode(mode.String)}
+}
+
+// conversionRounding is the rule for figures reported in the base currency.
+// Lookup failures fall back to cents so a report is never lost to them.
+func (s *Server) conversionRounding(ctx context.Context) RoundingRule {
+	rule, err := s.roundingRule(ctx, s.BaseCurrency, RoundConversion)
+	if err != nil {
+		log.Println("Rounding rule lookup error:", err)
+		return defaultRoundingRule(s.BaseCurrency, RoundConversion, 2)
+	}
+	return rule
+}
+
+// ListRoundingRules returns the effective rule for every currency and kind,
+// so clients can round exactly like the server.
+func (s *Server) ListRoundingRules(w http.ResponseWriter, r *http.Request) {
+	rows, err := s.DB.QueryContext(r.Context(), `
+		SELECT c.code, k.kind, c.minor_units, rr.increment, rr.mode
+		FROM currency c
+		CROSS JOIN unnest($1::text[]) AS k(kind)
+		LEFT JOIN rounding_rule rr ON rr.currency = c.code AND rr.kind = k.kind
+		ORDER BY c.code, k.kind
+	`, pq.Array(roundingKindStrings()))
+	if err != nil {
+		log.Println("ListRoundingRules query error:", err)
+		http.Error(w, "Database query failed", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	rules := []RoundingRule{}
+	for rows.Next() {
+		var currency string
+		var kind RoundingKind
+		var minorUnits int
+		var increment sql.NullFloat64
+		var mode sql.NullString
+		if err := rows.Scan(&currency, &kind, &minorUnits, &increment, &mode); err != nil {
+			log.Println("Row scan error:", err)
+			http.Error(w, "Failed to read rounding rule", http.StatusInternalServerError)
+			return
+		}
+		if increment.Valid {
+			rules = append(rules, RoundingRule{Currency: currency, Kind: kind, Increment: increment.Float64, Mode: RoundingMode(mode.String)})
+		} else {
+			rules = append(rules, defaultRoundingRule(currency, kind, minorUnits))
+		}
+	}
+	if err := rows.Err(); err != nil {
+		log.Println("Row iteration error:", err)
+		http.Error(w, "Error reading results", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(rules)
+}
+
+func roundingKindStrings() []string {
+	kinds := make([]string, len(roundingKinds))
+	for i, kind := range roundingKinds {
+		kinds[i] = string(kind)
+	}
+	return kinds
+}
+
+func (s *Server) PutRoundingRule(w http.ResponseWriter, r *http.Request) {
+	if _, ok := s.requireRole(w, r, Admin); !ok {
+		return
+	}
+
+	var rule RoundingRule
+	if err := json.NewDecoder(r.Body).Decode(&rule); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+	vars := mux.Vars(r)
+	rule.Currency = strings.ToUpper(vars["currency"])
+	rule.Kind = RoundingKind(vars["kind"])
+	rule.Default = false
+
+	if !s.validate(w, r, rule) {
+		return
+	}
+
+	_, err := s.DB.ExecContext(r.Context(), `
+		INSERT INTO rounding_rule (currency, kind, increment, mode)
+		VALUES ($1, $2, $3, $4)
+		ON CONFLICT (currency, kind) DO UPDATE SET increment = EXCLUDED.increment, mode = EXCLUDED.mode
+	`, rule.Currency, rule.Kind, rule.Increment, rule.Mode)
+	if err != nil {
+		log.Println("Upsert rounding rule error:", err)
+		http.Error(w, "Failed to store rounding rule", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(rule)
+}
+
+// DeleteRoundingRule reverts a currency and kind to the default rule.
+func (s *Server) DeleteRoundingRule(w http.ResponseWriter, r *http.Request) {
+	if _, ok := s.requireRole(w, r, Admin); !ok {
+		return
+	}
+
+	vars := mux.Vars(r)
+	result, err := s.DB.ExecContext(r.Context(),
+		"DELETE FROM rounding_rule WHERE currency = $1 AND kind = $2", strings.ToUpper(vars["currency"]), vars["kind"])
+	if err != nil {
+		log.Println("Delete rounding rule error:", err)
+		http.Error(w, "Failed to delete rounding rule", http.StatusInternalServerError)
+		return
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		http.Error(w, "Error checking affected rows", http.StatusInternalServerError)
+		return
+	}
+	if rowsAffected == 0 {
+		http.Error(w, "Rounding rule not found", http.StatusNotFound)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,275 @@
+package server
+
+import (
+	"net/http"
+)
+
+// Route describes one HTTP endpoint. Both the mux router and the OpenAPI
+// document are built from Routes, so an endpoint cannot exist without being
+// documented.
+type Route struct {
+	Method  string
+	Path    string
+	Handler http.HandlerFunc
+
+	// Documentation used by the OpenAPI generator
+	Tag      string
+	Summary  string
+	Query    []string // optional query parameters
+	Request  any      // example value of the JSON request body
+	Response any      // example value of the JSON response body
+	Status   int      // success status, defaults to 200
+	Auth     bool     // requires a bearer token
+	Stream   bool     // long-lived text/event-stream, exempt from the request timeout
+
+	// Unlimited routes are exempt from rate limiting, for probes and scrapers
+	Unlimited bool
+	// Unversioned routes are served at the root only, outside APIPrefix:
+	// probes, docs, and URLs registered with other systems
+	Unversioned bool
+
+	// Idempotent routes accept an Idempotency-Key header and replay the
+	// first response to retries carrying the same key
+	Idempotent bool
+	// Versioned writes require If-Match with the ETag of a previous GET
+	Versioned bool
+	// Conditional reads answer If-None-Match and If-Modified-Since with 304
+	// when the client's copy is current
+	Conditional bool
+	// Scope is the narrowest API key scope that may call the route. It
+	// defaults to APIKeyRead for reads and APIKeyFull for writes;
+	// APIKeyNone keeps the route to people
+	Scope APIKeyScope
+}
+
+func (s *Server) Routes() []Route {
+	return []Route{
+		// /login
+		{Method: "POST", Path: "/login", Handler: s.Login, Tag: "auth", Summary: "Exchange credentials for an access token", Request: loginRequest{}, Response: loginResponse{}, Scope: APIKeyNone},
+		{Method: "POST", Path: "/token/refresh", Handler: s.RefreshToken, Tag: "auth", Summary: "Exchange a refresh token for a new access token and refresh token", Request: refreshRequest{}, Response: loginResponse{}, Scope: APIKeyNone},
+		{Method: "POST", Path: "/logout", Handler: s.Logout, Tag: "auth", Summary: "End the caller's session; its access and refresh tokens stop working", Status: http.StatusNoContent, Auth: true, Scope: APIKeyNone},
+
+		// /setup
+		{Method: "GET", Path: "/oidc/login", Handler: s.OIDCLogin, Tag: "auth", Summary: "Redirect the browser to the OpenID Connect provider to sign in", Status: http.StatusFound, Scope: APIKeyNone},
+		{Method: "GET", Path: "/oidc/callback", Handler: s.OIDCCallback, Tag: "auth", Summary: "Complete an OpenID Connect sign-in; redirects to the post-login URL with the tokens in the fragment, or answers with them", Query: []string{"code", "state"}, Response: loginResponse{}, Unversioned: true, Scope: APIKeyNone},
+		{Method: "POST", Path: "/setup", Handler: s.Setup, Tag: "auth", Summary: "Create the first Admin with the one-time setup token from the startup log; refused once an Admin exists", Request: setupRequest{}, Response: User{}, Status: http.StatusCreated, Scope: APIKeyNone},
+
+		// /me
+		{Method: "GET", Path: "/me/expense_requests", Handler: s.ListMyExpenseRequests, Tag: "me", Summary: "List the caller's expense requests with their workflow status", Response: []MyExpenseRequest{}, Auth: true},
+
+		{Method: "GET", Path: "/me/announcements", Handler: s.ListMyAnnouncements, Tag: "me", Summary: "List announcements the caller receives, with when the caller read them", Query: []string{"unread"}, Response: []Announcement{}, Auth: true},
+		{Method: "GET", Path: "/me/announcements/unread_count", Handler: s.UnreadAnnouncementCount, Tag: "me", Summary: "Number of unread announcements for the caller", Response: UnreadCount{}, Auth: true},
+		{Method: "POST", Path: "/me/announcements/{id:[0-9]+}/read", Handler: s.MarkAnnouncementRead, Tag: "me", Summary: "Mark one of the caller's announcements as read", Status: http.StatusNoContent, Auth: true},
+		{Method: "POST", Path: "/me/announcements/read", Handler: s.MarkAllAnnouncementsRead, Tag: "me", Summary: "Mark all of the caller's announcements as read", Status: http.StatusNoContent, Auth: true},
+		{Method: "GET", Path: "/me/notification_preferences", Handler: s.GetMyNotificationPreferences, Tag: "me", Summary: "The caller's quiet hours and digest settings for notification email", Response: NotificationPreferences{}, Auth: true},
+		{Method: "PUT", Path: "/me/notification_preferences", Handler: s.PutMyNotificationPreferences, Tag: "me", Summary: "Set quiet hours and digest settings; rejections and mandatory announcements are always sent at once", Request: NotificationPreferences{}, Response: NotificationPreferences{}, Auth: true},
+		{Method: "GET", Path: "/events", Handler: s.EventStream, Tag: "me", Summary: "Stream new announcements and expense state changes relevant to the caller", Response: Event{}, Auth: true, Stream: true},
+		{Method: "GET", Path: "/me/expense_drafts", Handler: s.ListMyExpenseDrafts, Tag: "me", Summary: "List expense drafts created from the caller's emails", Response: []ExpenseDraft{}, Auth: true},
+		{Method: "POST", Path: "/me/expense_drafts/{id:[0-9]+}/confirm", Handler: s.ConfirmExpenseDraft, Tag: "me", Summary: "Turn an emailed draft into an expense request", Request: confirmDraftRequest{}, Response: ExpenseRequest{}, Status: http.StatusCreated, Auth: true},
+		{Method: "DELETE", Path: "/me/expense_drafts/{id:[0-9]+}", Handler: s.DiscardExpenseDraft, Tag: "me", Summary: "Discard an emailed draft", Status: http.StatusNoContent, Auth: true},
+
+		// /inbound
+		{Method: "POST", Path: "/inbound/email", Handler: s.ReceiveInboundEmail, Tag: "inbound", Summary: "Mail provider webhook (X-Inbound-Token) turning receipts into drafts", Request: InboundEmail{}, Response: inboundEmailResponse{}, Status: http.StatusAccepted, Unversioned: true},
+
+		// /user
+		{Method: "GET", Path: "/users", Handler: s.ListUsers, Tag: "users", Summary: "List users (sort=name,-id; limit and offset page the list); emails only for the user themselves or an Admin", Query: []string{"unitID", "roleID", "name", "sort", "limit", "offset"}, Response: []User{}},
+		{Method: "POST", Path: "/users", Handler: s.CreateUser, Tag: "users", Summary: "Create a user (Admin)", Request: User{}, Response: User{}, Status: http.StatusCreated, Auth: true},
+		{Method: "GET", Path: "/users/{id:[0-9]+}", Handler: s.GetUser, Tag: "users", Summary: "Get a user; the email only for the user themselves or an Admin", Response: User{}},
+		{Method: "PUT", Path: "/users/{id:[0-9]+}", Handler: s.UpdateUser, Tag: "users", Summary: "Replace a user (Admin)", Request: User{}, Response: User{}, Versioned: true, Auth: true},
+		{Method: "PATCH", Path: "/users/{id:[0-9]+}", Handler: s.PatchUser, Tag: "users", Summary: "Partially update a user (Admin)", Request: User{}, Response: User{}, Versioned: true, Auth: true},
+		{Method: "DELETE", Path: "/users/{id:[0-9]+}", Handler: s.DeleteUser, Tag: "users", Summary: "Delete a user (Admin)", Status: http.StatusNoContent, Auth: true},
+		{Method: "GET", Path: "/users/{id:[0-9]+}/sessions", Handler: s.ListUserSessions, Tag: "users", Summary: "List a user's active login sessions per device (the user, Admin)", Response: []Session{}, Auth: true},
+		{Method: "DELETE", Path: "/users/{id:[0-9]+}/sessions", Handler: s.RevokeUserSessions, Tag: "users", Summary: "Log a user out on every device (the user, Admin)", Status: http.StatusNoContent, Auth: true},
+		{Method: "DELETE", Path: "/users/{id:[0-9]+}/lockout", Handler: s.UnlockUser, Tag: "users", Summary: "Lift the lockout and login backoff of a user's login name (Admin)", Status: http.StatusNoContent, Auth: true},
+		{Method: "DELETE", Path: "/users/{id:[0-9]+}/sessions/{sessionID:[0-9]+}", Handler: s.RevokeUserSession, Tag: "users", Summary: "Log one of a user's sessions out (the user, Admin)", Status: http.StatusNoContent, Auth: true},
+		{Method: "GET", Path: "/users/{id:[0-9]+}/bank_account", Handler: s.GetBankAccount, Tag: "users", Summary: "Get the account a user's expenses are paid to (the user, Admin)", Response: BankAccount{}, Auth: true},
+		{Method: "PUT", Path: "/users/{id:[0-9]+}/bank_account", Handler: s.PutBankAccount, Tag: "users", Summary: "Set the account a user's expenses are paid to (the user, Admin)", Request: BankAccount{}, Response: BankAccount{}, Auth: true},
+		{Method: "POST", Path: "/users/{id:[0-9]+}/delegations", Handler: s.CreateDelegation, Tag: "users", Summary: "Hand a Manager's approval rights over their unit to another user until endsAt (the Manager, Admin)", Request: delegationRequest{}, Response: Delegation{}, Status: http.StatusCreated, Auth: true},
+		{Method: "GET", Path: "/users/{id:[0-9]+}/delegations", Handler: s.ListDelegations, Tag: "users", Summary: "List the current and upcoming delegations a user granted or received (the user, Admin)", Response: []Delegation{}, Auth: true},
+		{Method: "DELETE", Path: "/users/{id:[0-9]+}/delegations/{delegationID:[0-9]+}", Handler: s.RevokeDelegation, Tag: "users", Summary: "End one of a Manager's delegations early (the Manager, Admin)", Status: http.StatusNoContent, Auth: true},
+
+		// /unit
+		{Method: "GET", Path: "/units", Handler: s.ListUnits, Tag: "units", Summary: "List units", Query: []string{"name", "managerID", "parentUnit"}, Response: []Unit{}, Conditional: true},
+		{Method: "GET", Path: "/units/tree", Handler: s.GetUnitTree, Tag: "units", Summary: "All units arranged under their parent units", Response: []UnitNode{}},
+		{Method: "POST", Path: "/units", Handler: s.CreateUnit, Tag: "units", Summary: "Create a unit", Request: Unit{}, Response: Unit{}},
+		{Method: "GET", Path: "/units/{name}", Handler: s.GetUnit, Tag: "units", Summary: "Get a unit", Response: Unit{}},
+		{Method: "PUT", Path: "/units/{name}", Handler: s.UpdateUnit, Tag: "units", Summary: "Replace a unit; a new name is carried over to its users, budgets, freezes, requests and payments", Request: Unit{}, Response: Unit{}},
+		{Method: "PATCH", Path: "/units/{name}", Handler: s.PatchUnit, Tag: "units", Summary: "Partially update a unit; a new name is carried over as with PUT", Request: Unit{}, Response: Unit{}},
+		{Method: "DELETE", Path: "/units/{name}", Handler: s.DeleteUnit, Tag: "units", Summary: "Delete a unit", Status: http.StatusNoContent},
+		{Method: "GET", Path: "/units/{name}/rollup", Handler: s.GetUnitRollup, Tag: "units", Summary: "A year's budgets and spending for a unit and every unit below it, with totals rolled up (Managers of the unit, Accountant, Admin)", Query: []string{"year"}, Response: UnitRollup{}, Auth: true},
+		{Method: "GET", Path: "/units/{name}/budget_ticker", Handler: s.BudgetTicker, Tag: "units", Summary: "Stream remaining budget per category as server-sent events", Query: []string{"year"}, Response: BudgetTick{}, Stream: true},
+
+		// /tax_rates
+		{Method: "GET", Path: "/tax_rates", Handler: s.ListTaxRates, Tag: "tax rates", Summary: "List the VAT rates expenses may be booked at", Response: []TaxRate{}},
+		{Method: "POST", Path: "/tax_rates", Handler: s.CreateTaxRate, Tag: "tax rates", Summary: "Create a VAT rate (Accountant, Admin)", Request: TaxRate{}, Response: TaxRate{}, Status: http.StatusCreated, Auth: true},
+		{Method: "PUT", Path: "/tax_rates/{code}", Handler: s.UpdateTaxRate, Tag: "tax rates", Summary: "Change a VAT rate; what was booked at the old rate keeps it (Accountant, Admin)", Request: TaxRate{}, Response: TaxRate{}, Auth: true},
+		{Method: "DELETE", Path: "/tax_rates/{code}", Handler: s.DeleteTaxRate, Tag: "tax rates", Summary: "Delete a VAT rate (Accountant, Admin)", Status: http.StatusNoContent, Auth: true},
+
+		// /vendors
+		{Method: "GET", Path: "/vendors", Handler: s.ListVendors, Tag: "vendors", Summary: "List the vendors expenses may be paid to (name matches part of the name)", Query: []string{"name"}, Response: []Vendor{}, Auth: true},
+		{Method: "POST", Path: "/vendors", Handler: s.CreateVendor, Tag: "vendors", Summary: "Create a vendor (Accountant, Admin)", Request: Vendor{}, Response: Vendor{}, Status: http.StatusCreated, Auth: true},
+		{Method: "GET", Path: "/vendors/{id:[0-9]+}", Handler: s.GetVendor, Tag: "vendors", Summary: "Get a vendor", Response: Vendor{}, Auth: true},
+		{Method: "PUT", Path: "/vendors/{id:[0-9]+}", Handler: s.UpdateVendor, Tag: "vendors", Summary: "Replace a vendor (Accountant, Admin)", Request: Vendor{}, Response: Vendor{}, Auth: true},
+		{Method: "DELETE", Path: "/vendors/{id:[0-9]+}", Handler: s.DeleteVendor, Tag: "vendors", Summary: "Delete a vendor no expense request refers to (Accountant, Admin)", Status: http.StatusNoContent, Auth: true},
+
+		// /expense_category
+		{Method: "GET", Path: "/expense_categories", Handler: s.ListExpenseCategories, Tag: "expense categories", Summary: "List expense categories", Response: []ExpenseCategory{}, Conditional: true},
+		{Method: "POST", Path: "/expense_categories", Handler: s.CreateExpenseCategory, Tag: "expense categories", Summary: "Create an expense category", Request: ExpenseCategory{}, Response: ExpenseCategory{}, Status: http.StatusCreated},
+		{Method: "POST", Path: "/expense_categories/import", Handler: s.ImportExpenseCategories, Tag: "expense categories", Summary: "Create expense categories from a CSV file with a name column; dryRun=true only reports row errors (Accountant, Admin)", Query: []string{"dryRun"}, Response: ImportResult{}, Status: http.StatusCreated, Auth: true},
+		{Method: "GET", Path: "/expense_categories/{name}", Handler: s.GetExpenseCategory, Tag: "expense categories", Summary: "Get an expense category", Response: ExpenseCategory{}},
+		{Method: "PUT", Path: "/expense_categories/{name}", Handler: s.UpdateExpenseCategory, Tag: "expense categories", Summary: "Rename an expense category", Request: ExpenseCategory{}, Response: ExpenseCategory{}},
+		{Method: "PATCH", Path: "/expense_categories/{name}", Handler: s.PatchExpenseCategory, Tag: "expense categories", Summary: "Partially update an expense category", Request: ExpenseCategory{}, Response: ExpenseCategory{}},
+		{Method: "POST", Path: "/expense_categories/{name}/merge_into/{target}", Handler: s.MergeExpenseCategory, Tag: "expense categories", Summary: "Merge a duplicate category into another, adding up budgets for the same unit and year (Accountant, Admin)", Response: CategoryMerge{}, Auth: true},
+		{Method: "DELETE", Path: "/expense_categories/{name}", Handler: s.DeleteExpenseCategory, Tag: "expense categories", Summary: "Delete an expense category", Status: http.StatusNoContent},
+
+		// /expense_request
+		{Method: "GET", Path: "/expense_requests", Handler: s.ListExpenseRequests, Tag: "expense requests", Summary: "List the expense requests the caller may read: Personnel their own, Managers their unit's, Accountants and Admins all (format=csv for a spreadsheet export, format=ndjson to stream one JSON object per line)", Query: []string{"userID", "unitID", "amount", "category", "externalRef", "vendorID", "isFinalized", "format", "sort", "limit", "offset"}, Response: []ExpenseRequest{}, Auth: true},
+		{Method: "POST", Path: "/expense_requests", Handler: s.CreateExpenseRequest, Tag: "expense requests", Summary: "Create an expense request; only an Admin files one for another user or unit", Request: ExpenseRequest{}, Response: ExpenseRequest{}, Status: http.StatusCreated, Idempotent: true, Auth: true},
+		{Method: "GET", Path: "/expense_requests/{id:[0-9]+}", Handler: s.GetExpenseRequest, Tag: "expense requests", Summary: "Get an expense request (expand=activities adds its timeline)", Query: []string{"expand"}, Response: ExpenseRequestWithActivities{}, Auth: true},
+		{Method: "GET", Path: "/expense_requests/by_number/{doc_number}", Handler: s.GetExpenseRequestByNumber, Tag: "expense requests", Summary: "Get an expense request by its document number, e.g. ER-000123, or its reference, e.g. EXP-2025-000123", Response: ExpenseRequest{}, Auth: true},
+		{Method: "GET", Path: "/expense_requests/by_external_ref/{ref}", Handler: s.GetExpenseRequestByExternalRef, Tag: "expense requests", Summary: "Get an expense request by the reference an integration gave it", Response: ExpenseRequest{}, Auth: true},
+		{Method: "GET", Path: "/expense_requests/{id:[0-9]+}/activities", Handler: s.GetExpenseRequestActivities, Tag: "expense requests", Summary: "Get an expense request with its ordered activity timeline", Response: ExpenseRequestWithActivities{}, Auth: true},
+		{Method: "GET", Path: "/expense_requests/{id:[0-9]+}/approvals", Handler: s.GetExpenseApprovals, Tag: "expense requests", Summary: "The approvals a request needs under its approval policy, taken and pending", Response: ApprovalChain{}, Auth: true},
+		{Method: "PUT", Path: "/expense_requests/{id:[0-9]+}", Handler: s.UpdateExpenseRequest, Tag: "expense requests", Summary: "Replace a draft expense request (requester, Admin)", Request: ExpenseRequest{}, Response: ExpenseRequest{}, Versioned: true, Auth: true},
+		{Method: "PATCH", Path: "/expense_requests/{id:[0-9]+}", Handler: s.PatchExpenseRequest, Tag: "expense requests", Summary: "Partially update a draft expense request; userID and unitID only by an Admin (requester, Admin)", Request: ExpenseRequest{}, Response: ExpenseRequest{}, Versioned: true, Auth: true},
+		{Method: "POST", Path: "/expense_requests/{id:[0-9]+}/submit", Handler: s.SubmitExpenseRequest, Tag: "expense requests", Summary: "Submit a draft to its approvers; it can no longer be edited (requester, Admin)", Response: ExpenseRequest{}, Auth: true},
+		{Method: "POST", Path: "/expense_requests/{id:[0-9]+}/withdraw", Handler: s.WithdrawExpenseRequest, Tag: "expense requests", Summary: "Withdraw a request not decided yet, keeping its history; refused once paid (requester, Admin)", Request: withdrawRequest{}, Response: ExpenseRequest{}, Auth: true},
+		{Method: "GET", Path: "/expense_requests/{id:[0-9]+}/payload", Handler: s.GetExpenseRequestPayload, Tag: "expense requests", Summary: "Get the retained submission payload (Admin)", Response: ExpenseRequestPayload{}, Auth: true},
+		{Method: "GET", Path: "/expense_requests/{id:[0-9]+}/attachments", Handler: s.ListAttachments, Tag: "attachments", Summary: "List the receipts attached to an expense request", Response: []Attachment{}, Auth: true},
+		{Method: "POST", Path: "/expense_requests/{id:[0-9]+}/attachments", Handler: s.UploadAttachment, Tag: "attachments", Summary: "Upload a receipt (multipart field \"file\"; the requester or an Admin)", Response: Attachment{}, Status: http.StatusCreated, Auth: true},
+		{Method: "POST", Path: "/expense_requests/{id:[0-9]+}/attachments/from_url", Handler: s.ImportAttachmentFromURL, Tag: "attachments", Summary: "Import a receipt from an allowlisted https URL", Request: importReceiptRequest{}, Response: Attachment{}, Status: http.StatusCreated, Auth: true},
+		{Method: "GET", Path: "/expense_requests/{id:[0-9]+}/comments", Handler: s.ListExpenseComments, Tag: "expense requests", Summary: "The discussion of an expense request, oldest first", Response: []ExpenseComment{}, Auth: true},
+		{Method: "POST", Path: "/expense_requests/{id:[0-9]+}/comments", Handler: s.CreateExpenseComment, Tag: "expense requests", Summary: "Comment on an expense request as the caller, notifying the @mentioned users who may read it", Request: ExpenseComment{}, Response: ExpenseComment{}, Status: http.StatusCreated, Auth: true},
+		{Method: "GET", Path: "/expense_requests/{id:[0-9]+}/lines", Handler: s.ListExpenseLines, Tag: "expense requests", Summary: "The line items of an expense request, whose amount is their sum once it has any", Response: []ExpenseLine{}, Auth: true},
+		{Method: "POST", Path: "/expense_requests/{id:[0-9]+}/lines", Handler: s.CreateExpenseLine, Tag: "expense requests", Summary: "Add a line item to a draft; category defaults to the request's (requester, Admin)", Request: ExpenseLine{}, Response: ExpenseLine{}, Status: http.StatusCreated, Auth: true},
+		{Method: "GET", Path: "/expense_requests/{id:[0-9]+}/lines/{lineID:[0-9]+}", Handler: s.GetExpenseLine, Tag: "expense requests", Summary: "Get a line item of an expense request", Response: ExpenseLine{}, Auth: true},
+		{Method: "PUT", Path: "/expense_requests/{id:[0-9]+}/lines/{lineID:[0-9]+}", Handler: s.UpdateExpenseLine, Tag: "expense requests", Summary: "Replace a line item of a draft (requester, Admin)", Request: ExpenseLine{}, Response: ExpenseLine{}, Auth: true},
+		{Method: "DELETE", Path: "/expense_requests/{id:[0-9]+}/lines/{lineID:[0-9]+}", Handler: s.DeleteExpenseLine, Tag: "expense requests", Summary: "Remove a line item of a draft; removing the last one leaves the amount as it was (requester, Admin)", Status: http.StatusNoContent, Auth: true},
+		{Method: "GET", Path: "/expense_requests/{id:[0-9]+}/attachments/{attachmentID:[0-9]+}", Handler: s.DownloadAttachment, Tag: "attachments", Summary: "Download a receipt", Auth: true},
+		{Method: "POST", Path: "/expense_requests/{id:[0-9]+}/print", Handler: s.PrintExpenseRequest, Tag: "reports", Summary: "Queue the request's PDF dossier for the archive printer (Accountant, Admin)", Response: PrintJob{}, Status: http.StatusAccepted, Auth: true},
+		{Method: "GET", Path: "/expense_requests/{id:[0-9]+}/print_jobs", Handler: s.ListPrintJobs, Tag: "reports", Summary: "Print jobs of a request with their status, newest first (Accountant, Admin)", Response: []PrintJob{}, Auth: true},
+		{Method: "GET", Path: "/expense_requests/{id:[0-9]+}/report.pdf", Handler: s.ExpenseRequestReportPDF, Tag: "reports", Summary: "Printable PDF with details, activity history, payments and approvals", Auth: true},
+		{Method: "DELETE", Path: "/expense_requests/{id:[0-9]+}", Handler: s.DeleteExpenseRequest, Tag: "expense requests", Summary: "Delete an expense request without activities or payments; withdraw the others (Admin)", Status: http.StatusNoContent, Auth: true},
+
+		// /expense_activity
+		{Method: "GET", Path: "/expense_activities", Handler: s.ListExpenseActivities, Tag: "expense activities", Summary: "List the expense activities of the requests the caller may read (createdAfter and createdBefore are RFC 3339 times; month needs year and day needs month)", Query: []string{"expenseID", "createdBy", "currentState", "createdAfter", "createdBefore", "year", "month", "day"}, Response: []ExpenseActivity{}, Auth: true},
+		{Method: "POST", Path: "/expense_activities", Handler: s.CreateExpenseActivity, Tag: "expense activities", Summary: "Create an expense activity; an approval that leaves others pending answers 202 with the approval chain instead", Request: ExpenseActivity{}, Response: ExpenseActivity{}, Status: http.StatusCreated},
+		{Method: "GET", Path: "/approval_policies", Handler: s.ListApprovalPolicies, Tag: "expense activities", Summary: "List the approval policies that decide who must approve requests of which units and amounts", Response: []ApprovalPolicy{}},
+		{Method: "POST", Path: "/approval_policies", Handler: s.CreateApprovalPolicy, Tag: "expense activities", Summary: "Require approvers (unitManager, unit:<unit>, role:<role>) for requests of a unit, or every unit, from minAmount on (Admin)", Request: ApprovalPolicy{}, Response: ApprovalPolicy{}, Status: http.StatusCreated, Auth: true},
+		{Method: "DELETE", Path: "/approval_policies/{id:[0-9]+}", Handler: s.DeleteApprovalPolicy, Tag: "expense activities", Summary: "Delete an approval policy (Admin)", Status: http.StatusNoContent, Auth: true},
+		{Method: "GET", Path: "/user_limits", Handler: s.ListUserLimits, Tag: "expense activities", Summary: "List the per-user and per-role spending limits", Query: []string{"userID", "role"}, Response: []UserLimit{}, Auth: true},
+		{Method: "POST", Path: "/user_limits", Handler: s.CreateUserLimit, Tag: "expense activities", Summary: "Cap what a user, or each holder of a role, may request per month, quarter or year in a category or all of them; requests over it need the escalation approver, or are refused without one (Admin)", Request: UserLimit{}, Response: UserLimit{}, Status: http.StatusCreated, Auth: true},
+		{Method: "DELETE", Path: "/user_limits/{id:[0-9]+}", Handler: s.DeleteUserLimit, Tag: "expense activities", Summary: "Delete a spending limit (Admin)", Status: http.StatusNoContent, Auth: true},
+		{Method: "GET", Path: "/expense_activities/{id:[0-9]+}", Handler: s.GetExpenseActivity, Tag: "expense activities", Summary: "Get an expense activity", Response: ExpenseActivity{}, Auth: true},
+		{Method: "PUT", Path: "/expense_activities/{id:[0-9]+}", Handler: s.UpdateExpenseActivity, Tag: "expense activities", Summary: "Replace an expense activity", Request: ExpenseActivity{}, Response: ExpenseActivity{}},
+		{Method: "PATCH", Path: "/expense_activities/{id:[0-9]+}", Handler: s.PatchExpenseActivity, Tag: "expense activities", Summary: "Partially update an expense activity", Request: ExpenseActivity{}, Response: ExpenseActivity{}},
+		{Method: "DELETE", Path: "/expense_activities/{id:[0-9]+}", Handler: s.DeleteExpenseActivity, Tag: "expense activities", Summary: "Delete an expense activity", Status: http.StatusNoContent},
+
+		// /paid_expense
+		{Method: "GET", Path: "/paid_expenses", Handler: s.ListPaidExpenses, Tag: "paid expenses", Summary: "List the payments of the requests the caller may read (format=csv for a spreadsheet export, format=ndjson to stream one JSON object per line; createdAfter and createdBefore are RFC 3339 times; month needs year and day needs month)", Query: []string{"expenseID", "unitID", "category", "minAmount", "maxAmount", "createdAfter", "createdBefore", "year", "month", "day", "format"}, Response: []PaidExpense{}, Auth: true},
+		{Method: "POST", Path: "/paid_expenses", Handler: s.CreatePaidExpense, Tag: "paid expenses", Summary: "Create a paid expense (Accountant, Admin)", Request: PaidExpense{}, Response: PaidExpense{}, Status: http.StatusCreated, Auth: true, Idempotent: true, Scope: APIKeyPayments},
+		{Method: "GET", Path: "/paid_expenses/{id:[0-9]+}", Handler: s.GetPaidExpense, Tag: "paid expenses", Summary: "Get a paid expense", Response: PaidExpense{}, Auth: true},
+		{Method: "PUT", Path: "/paid_expenses/{id:[0-9]+}", Handler: s.UpdatePaidExpense, Tag: "paid expenses", Summary: "Replace a paid expense (Accountant, Admin)", Request: PaidExpense{}, Response: PaidExpense{}, Auth: true, Scope: APIKeyPayments},
+		{Method: "PATCH", Path: "/paid_expenses/{id:[0-9]+}", Handler: s.PatchPaidExpense, Tag: "paid expenses", Summary: "Partially update a paid expense (Accountant, Admin)", Request: PaidExpense{}, Response: PaidExpense{}, Auth: true, Scope: APIKeyPayments},
+		{Method: "DELETE", Path: "/paid_expenses/{id:[0-9]+}", Handler: s.DeletePaidExpense, Tag: "paid expenses", Summary: "Delete a paid expense (Accountant, Admin)", Status: http.StatusNoContent, Auth: true, Scope: APIKeyPayments},
+		{Method: "POST", Path: "/payment_batches", Handler: s.CreatePaymentBatch, Tag: "paid expenses", Summary: "Pay approved expense requests in full as one batch, all or none: a request that cannot be paid fails the whole batch with 422 (Accountant, Admin)", Request: paymentBatchRequest{}, Response: PaymentBatch{}, Status: http.StatusCreated, Auth: true, Idempotent: true, Scope: APIKeyPayments},
+		{Method: "GET", Path: "/payment_batches/{id:[0-9]+}", Handler: s.GetPaymentBatch, Tag: "paid expenses", Summary: "Get a payment batch with its payments and totals per currency (Accountant, Admin)", Response: PaymentBatch{}, Auth: true},
+		{Method: "GET", Path: "/payment_batches/{id:[0-9]+}/export", Handler: s.ExportPaymentBatch, Tag: "paid expenses", Summary: "Bank file paying a batch to its requesters' accounts: SEPA pain.001 XML, or CSV in the configured layout with format=csv (Accountant, Admin)", Query: []string{"format"}, Auth: true},
+		{Method: "GET", Path: "/payment_batches/{id:[0-9]+}/summary.pdf", Handler: s.PaymentBatchSummaryPDF, Tag: "reports", Summary: "Printable PDF of a payment batch for signing (Accountant, Admin)", Auth: true},
+		{Method: "POST", Path: "/payments/bulk_pay", Handler: s.BulkPay, Tag: "paid expenses", Summary: "Pay approved expense requests in full, skipping those that would breach their budget (Accountant, Admin)", Request: bulkPayRequest{}, Response: BulkPayResult{}, Auth: true, Idempotent: true, Scope: APIKeyPayments},
+
+		// /budget
+		{Method: "GET", Path: "/budgets", Handler: s.ListBudgets, Tag: "budgets", Summary: "List budgets (includeSubunits=true adds the budgets of units below unitID; sort=-budgetLimit; limit and offset page the list)", Query: []string{"unitID", "includeSubunits", "category", "year", "sort", "limit", "offset"}, Response: []Budget{}},
+		{Method: "POST", Path: "/budgets", Handler: s.CreateBudget, Tag: "budgets", Summary: "Create a budget; reason is kept with its first revision", Request: budgetChange{}, Response: Budget{}, Status: http.StatusCreated},
+		{Method: "POST", Path: "/budgets/bulk", Handler: s.BulkCreateBudgets, Tag: "budgets", Summary: "Create many budgets, all or nothing unless partial=true (Accountant, Admin)", Query: []string{"partial"}, Request: []Budget{}, Response: BulkBudgetResult{}, Status: http.StatusCreated, Auth: true},
+		{Method: "PUT", Path: "/budgets/bulk", Handler: s.BulkAdjustBudgets, Tag: "budgets", Summary: "Adjust the limit or threshold of many budgets, all or nothing unless partial=true (Accountant, Admin)", Query: []string{"partial"}, Request: []BudgetAdjustment{}, Response: BulkBudgetResult{}, Auth: true},
+		{Method: "POST", Path: "/budgets/import", Handler: s.ImportBudgets, Tag: "budgets", Summary: "Create budgets from a CSV file (unitID, category, year, budgetLimit, thresholdRatio, currency); dryRun=true only reports row errors (Accountant, Admin)", Query: []string{"dryRun"}, Response: ImportResult{}, Status: http.StatusCreated, Auth: true},
+		{Method: "POST", Path: "/budgets/rollover", Handler: s.RolloverBudgets, Tag: "budgets", Summary: "Create the budgets of toYear (by default the year after) from those of fromYear, copying each limit, raising it by a percent or carrying the unspent remainder by rule; dryRun=true previews (Accountant, Admin)", Query: []string{"fromYear", "toYear", "dryRun"}, Request: RolloverRequest{}, Response: RolloverResult{}, Status: http.StatusCreated, Auth: true},
+		{Method: "GET", Path: "/budgets/{unitID}/{category}/{year:[0-9]+}", Handler: s.GetBudget, Tag: "budgets", Summary: "Get a budget (asOf returns its limit at that time)", Query: []string{"asOf"}, Response: Budget{}},
+		{Method: "GET", Path: "/budgets/{unitID}/{category}/{year:[0-9]+}/revisions", Handler: s.ListBudgetRevisions, Tag: "budgets", Summary: "List the changes to a budget's limit, oldest first", Response: []BudgetRevision{}},
+		{Method: "GET", Path: "/budgets/{unitID}/{category}/{year:[0-9]+}/allocations", Handler: s.GetBudgetAllocations, Tag: "budgets", Summary: "How a budget's limit is split across the quarters or months of its fiscal year; empty for an annual budget", Response: BudgetAllocations{}},
+		{Method: "PUT", Path: "/budgets/{unitID}/{category}/{year:[0-9]+}/allocations", Handler: s.PutBudgetAllocations, Tag: "budgets", Summary: "Split a budget's limit across its fiscal quarters or months (period=quarter or month), adding up to the limit; payments are then also capped per period (Accountant, Admin)", Request: BudgetAllocations{}, Response: BudgetAllocations{}, Auth: true},
+		{Method: "POST", Path: "/budgets/{unitID}/{category}/{year:[0-9]+}/allocations/distribute", Handler: s.DistributeBudget, Tag: "budgets", Summary: "Split a budget's limit across its fiscal quarters or months evenly, or by weights, the rounding remainder going to the last period (Accountant, Admin)", Request: budgetDistribution{}, Response: BudgetAllocations{}, Auth: true},
+		{Method: "DELETE", Path: "/budgets/{unitID}/{category}/{year:[0-9]+}/allocations", Handler: s.DeleteBudgetAllocations, Tag: "budgets", Summary: "Make a budget annual again, dropping its split (Accountant, Admin)", Status: http.StatusNoContent, Auth: true},
+		{Method: "GET", Path: "/budget_alerts", Handler: s.ListBudgetAlerts, Tag: "budgets", Summary: "Budgets whose limit is used up (exhausted) or whose spending is over limit plus threshold (over_threshold), as last announced, newest first", Query: []string{"unitID", "category", "year"}, Response: []BudgetAlert{}},
+		{Method: "GET", Path: "/budgets/{unitID}/{category}/{year:[0-9]+}/forecast", Handler: s.GetBudgetForecast, Tag: "budgets", Summary: "Project a budget's spending to the end of its fiscal year from its monthly run rate, with 80% and 95% bands and whether it is expected to overrun", Response: BudgetForecast{}},
+		{Method: "PUT", Path: "/budgets/{unitID}/{category}/{year:[0-9]+}", Handler: s.UpdateBudget, Tag: "budgets", Summary: "Replace a budget; reason is kept with the revision", Request: budgetChange{}, Response: Budget{}, Versioned: true},
+		{Method: "PATCH", Path: "/budgets/{unitID}/{category}/{year:[0-9]+}", Handler: s.PatchBudget, Tag: "budgets", Summary: "Partially update a budget; reason is kept with the revision", Request: budgetChange{}, Response: Budget{}, Versioned: true},
+		{Method: "DELETE", Path: "/budgets/{unitID}/{category}/{year:[0-9]+}", Handler: s.DeleteBudget, Tag: "budgets", Summary: "Delete a budget", Query: []string{"reason"}, Status: http.StatusNoContent},
+
+		// /search
+		{Method: "GET", Path: "/changes", Handler: s.ListChanges, Tag: "sync", Summary: "Rows created, updated and deleted after the since cursor, oldest first, for incremental sync; without since, the cursor to sync from after a full download; 410 once since is past retention", Query: []string{"since", "limit"}, Response: ChangeFeed{}, Auth: true},
+		{Method: "GET", Path: "/search", Handler: s.Search, Tag: "search", Summary: "Full-text search of user names, announcements and the feedback on expense requests the caller reads (type=user,announcement,expenseActivity; limit up to 100)", Query: []string{"q", "type", "limit"}, Response: []SearchHit{}, Auth: true},
+
+		// /announcement
+		{Method: "GET", Path: "/announcements", Handler: s.ListAnnouncements, Tag: "announcements", Summary: "List announcements (visibleTo lists those a user receives directly, through their unit or role, or by broadcast)", Query: []string{"receiverID", "receiverUnit", "receiverRole", "visibleTo", "createdBy", "message"}, Response: []Announcement{}, Conditional: true},
+		{Method: "POST", Path: "/announcements", Handler: s.CreateAnnouncement, Tag: "announcements", Summary: "Create an announcement for one receiver, a unit, a role, a role within a unit, or everyone with broadcast", Request: Announcement{}, Response: Announcement{}},
+		{Method: "GET", Path: "/announcements/{id:[0-9]+}", Handler: s.GetAnnouncement, Tag: "announcements", Summary: "Get an announcement", Response: Announcement{}},
+		{Method: "PUT", Path: "/announcements/{id:[0-9]+}", Handler: s.UpdateAnnouncement, Tag: "announcements", Summary: "Replace an announcement", Request: Announcement{}, Status: http.StatusNoContent},
+		{Method: "PATCH", Path: "/announcements/{id:[0-9]+}", Handler: s.PatchAnnouncement, Tag: "announcements", Summary: "Partially update an announcement", Request: Announcement{}, Response: Announcement{}},
+		{Method: "GET", Path: "/announcements/unread_count", Handler: s.UnreadAnnouncementCount, Tag: "announcements", Summary: "Number of announcements the caller has not read, for a badge; the same as /me/announcements/unread_count", Response: UnreadCount{}, Auth: true},
+		{Method: "POST", Path: "/announcements/{id:[0-9]+}/read", Handler: s.MarkAnnouncementRead, Tag: "announcements", Summary: "Record that the caller read an announcement they receive; the same as /me/announcements/{id}/read", Status: http.StatusNoContent, Auth: true},
+		{Method: "GET", Path: "/announcements/{id:[0-9]+}/reads", Handler: s.ListAnnouncementReceipts, Tag: "announcements", Summary: "List the receivers of an announcement with when each read it, unread last (its sender, Admin)", Response: []AnnouncementReceipt{}, Auth: true},
+		{Method: "DELETE", Path: "/announcements/{id:[0-9]+}", Handler: s.DeleteAnnouncement, Tag: "announcements", Summary: "Delete an announcement", Status: http.StatusNoContent},
+
+		// /budget_freezes
+		{Method: "GET", Path: "/budget_freezes", Handler: s.ListBudgetFreezes, Tag: "budget freezes", Summary: "List scheduled and active budget freezes", Query: []string{"unitID", "category", "active"}, Response: []BudgetFreeze{}},
+		{Method: "POST", Path: "/budget_freezes", Handler: s.CreateBudgetFreeze, Tag: "budget freezes", Summary: "Schedule a freeze on new requests, approvals and payments (Admin, Accountant)", Request: BudgetFreeze{}, Response: BudgetFreeze{}, Status: http.StatusCreated, Auth: true},
+		{Method: "DELETE", Path: "/budget_freezes/{id:[0-9]+}", Handler: s.DeleteBudgetFreeze, Tag: "budget freezes", Summary: "Cancel a budget freeze (Admin, Accountant)", Status: http.StatusNoContent, Auth: true},
+
+		// /currencies
+		{Method: "GET", Path: "/currencies", Handler: s.ListCurrencies, Tag: "currencies", Summary: "List known currencies", Response: []Currency{}},
+		{Method: "POST", Path: "/currencies", Handler: s.CreateCurrency, Tag: "currencies", Summary: "Add a currency (Admin)", Request: Currency{}, Response: Currency{}, Status: http.StatusCreated, Auth: true},
+		{Method: "GET", Path: "/exchange_rates", Handler: s.ListExchangeRates, Tag: "currencies", Summary: "List daily exchange rates to the base currency", Query: []string{"currency", "from", "to"}, Response: []ExchangeRate{}},
+		{Method: "PUT", Path: "/exchange_rates", Handler: s.UpsertExchangeRates, Tag: "currencies", Summary: "Insert or replace daily exchange rates (Admin)", Request: []ExchangeRate{}, Response: []ExchangeRate{}, Auth: true},
+		{Method: "POST", Path: "/exchange_rates/sync", Handler: s.SyncExchangeRatesNow, Tag: "currencies", Summary: "Fetch the latest rates from the configured provider now (Admin)", Response: ExchangeRateSync{}, Auth: true},
+		{Method: "GET", Path: "/exchange_rates/{currency}", Handler: s.ExchangeRateHistory, Tag: "currencies", Summary: "History of a currency's rates and where each came from", Query: []string{"from", "to"}, Response: []ExchangeRate{}},
+		{Method: "GET", Path: "/exchange_rates/{currency}/{date}", Handler: s.EffectiveExchangeRate, Tag: "currencies", Summary: "The rate conversions on a given day use", Response: ExchangeRate{}},
+
+		// /meta
+		{Method: "GET", Path: "/meta/rounding_rules", Handler: s.ListRoundingRules, Tag: "meta", Summary: "Effective rounding rule for every currency and kind of computed amount", Response: []RoundingRule{}},
+		{Method: "PUT", Path: "/rounding_rules/{currency}/{kind}", Handler: s.PutRoundingRule, Tag: "currencies", Summary: "Set the rounding rule for a currency and kind (Admin)", Request: RoundingRule{}, Response: RoundingRule{}, Auth: true},
+		{Method: "DELETE", Path: "/rounding_rules/{currency}/{kind}", Handler: s.DeleteRoundingRule, Tag: "currencies", Summary: "Revert a rounding rule to the currency default (Admin)", Status: http.StatusNoContent, Auth: true},
+		{Method: "GET", Path: "/meta/features", Handler: s.Features, Tag: "meta", Summary: "Optional features switched on in the configuration", Response: []string{}},
+		{Method: "GET", Path: "/meta/expense_states", Handler: s.ExpenseStates, Tag: "meta", Summary: "Expense request states, allowed transitions and who may perform them", Response: ExpenseStateMachine{}},
+
+		// /reports
+		{Method: "GET", Path: "/reports/expenses", Handler: s.ExpenseReport, Tag: "reports", Summary: "Paid expenses per month or category compared with budgets (includeSubunits=true rolls up the units below unitID; asOf reports payments and limits as they stood then; Managers read their unit's, Accountants and Admins any)", Query: []string{"unitID", "includeSubunits", "year", "groupBy", "asOf"}, Response: ExpenseReport{}, Auth: true},
+		{Method: "GET", Path: "/reports/vat", Handler: s.GetVATReport, Tag: "reports", Summary: "A year's payments by quarter (period=month for months) and VAT rate, with gross, net and VAT in the base currency (Accountant, Admin)", Query: []string{"year", "period"}, Response: VATReport{}, Auth: true},
+		{Method: "GET", Path: "/reports/accruals", Handler: s.AccrualsReport, Tag: "reports", Summary: "Approved but unpaid requests at year end per unit and category, for booking accruals (Accountant, Admin; format=csv for a spreadsheet, format=ndjson for one line per request)", Query: []string{"year", "unitID", "format"}, Response: AccrualReport{}, Auth: true},
+		{Method: "GET", Path: "/reports/aging", Handler: s.GetAgingReport, Tag: "reports", Summary: "Approved but unpaid requests per unit, bucketed by days since their latest approval (0-7, 8-30, 31+), with what they owe in the base currency (Accountant, Admin)", Query: []string{"unitID"}, Response: AgingReport{}, Auth: true},
+
+		// Business logic
+		{Method: "POST", Path: "/expense_requests/{id}/pay", Handler: s.PayExpense, Tag: "business logic", Summary: "Report the budget position of a paid expense (Accountant, Admin)", Response: map[string]any{}, Auth: true},
+
+		// /api_keys
+		{Method: "GET", Path: "/api_keys", Handler: s.ListAPIKeys, Tag: "api keys", Summary: "List API keys, revoked ones included, newest first (Admin)", Response: []APIKey{}, Auth: true, Scope: APIKeyNone},
+		{Method: "POST", Path: "/api_keys", Handler: s.CreateAPIKey, Tag: "api keys", Summary: "Issue an API key acting as a user with a scope of read, payments or full; the key is only returned here (Admin)", Request: APIKey{}, Response: APIKey{}, Status: http.StatusCreated, Auth: true, Scope: APIKeyNone},
+		{Method: "DELETE", Path: "/api_keys/{id:[0-9]+}", Handler: s.RevokeAPIKey, Tag: "api keys", Summary: "Revoke an API key (Admin)", Status: http.StatusNoContent, Auth: true, Scope: APIKeyNone},
+
+		// /webhooks
+		{Method: "GET", Path: "/webhooks", Handler: s.ListWebhooks, Tag: "webhooks", Summary: "List webhooks (Admin)", Response: []Webhook{}, Auth: true},
+		{Method: "POST", Path: "/webhooks", Handler: s.CreateWebhook, Tag: "webhooks", Summary: "Register a callback URL for events; the signing secret is only returned here (Admin)", Request: Webhook{}, Response: Webhook{}, Status: http.StatusCreated, Auth: true},
+		{Method: "GET", Path: "/webhooks/{id:[0-9]+}", Handler: s.GetWebhook, Tag: "webhooks", Summary: "Get a webhook (Admin)", Response: Webhook{}, Auth: true},
+		{Method: "PATCH", Path: "/webhooks/{id:[0-9]+}", Handler: s.SetWebhookActive, Tag: "webhooks", Summary: "Pause or resume a webhook (Admin)", Request: webhookActivePatch{}, Response: Webhook{}, Auth: true},
+		{Method: "DELETE", Path: "/webhooks/{id:[0-9]+}", Handler: s.DeleteWebhook, Tag: "webhooks", Summary: "Delete a webhook and its delivery log (Admin)", Status: http.StatusNoContent, Auth: true},
+		{Method: "GET", Path: "/webhooks/{id:[0-9]+}/deliveries", Handler: s.ListWebhookDeliveries, Tag: "webhooks", Summary: "Delivery log of a webhook, newest first (Admin)", Query: []string{"status"}, Response: []WebhookDelivery{}, Auth: true},
+
+		// Operations
+		{Method: "GET", Path: "/admin/usage", Handler: s.AdminUsage, Tag: "admin", Summary: "Latest row count, size and daily growth of every table (Admin)", Response: []TableUsage{}, Auth: true},
+		{Method: "GET", Path: "/admin/indexes", Handler: s.AdminIndexes, Tag: "admin", Summary: "Indexes the queries rely on and whether each is present and valid (Admin)", Response: []IndexStatus{}, Auth: true},
+		{Method: "POST", Path: "/admin/purge", Handler: s.AdminPurge, Tag: "admin", Summary: "Permanently delete rows past their retention period; dryRun=true only counts them (Admin)", Query: []string{"dryRun"}, Response: PurgeReport{}, Auth: true},
+		{Method: "POST", Path: "/admin/config/reload", Handler: s.ReloadConfig, Tag: "admin", Summary: "Reload the email, printer, feature, rate limit, request timeout, receipt host, inbound email and freeze notice settings without a restart, as SIGHUP does (Admin)", Response: SettingsReload{}, Auth: true},
+		{Method: "POST", Path: "/admin/budget_check", Handler: s.CheckBudgets, Tag: "admin", Summary: "Queue the nightly budget check to run now, alerting on budgets newly used up or over limit plus threshold (Admin)", Response: Job{}, Status: http.StatusAccepted, Auth: true},
+		{Method: "GET", Path: "/admin/jobs", Handler: s.ListJobs, Tag: "admin", Summary: "Background jobs with their status, attempts and last error, newest first (Admin)", Query: []string{"status", "kind", "limit", "offset"}, Response: []Job{}, Auth: true},
+		{Method: "GET", Path: "/admin/lockouts", Handler: s.ListLoginLockouts, Tag: "admin", Summary: "Login names and addresses locked or waiting out a backoff after failed logins (Admin)", Response: []LoginFailure{}, Auth: true},
+		{Method: "GET", Path: "/admin/audit_log", Handler: s.ListAuditLog, Tag: "admin", Summary: "Administrative actions, newest first (Admin)", Query: []string{"action", "actorID"}, Response: []AuditEntry{}, Auth: true},
+		{Method: "GET", Path: "/healthz", Handler: s.Healthz, Tag: "admin", Summary: "Liveness probe", Unlimited: true, Unversioned: true},
+		{Method: "GET", Path: "/readyz", Handler: s.Readyz, Tag: "admin", Summary: "Readiness probe with the status and latency of the database, SMTP relay and delivery queues; 503 when the database is down", Response: Readiness{}, Unlimited: true, Unversioned: true},
+		{Method: "GET", Path: "/metrics", Handler: s.Metrics, Tag: "admin", Summary: "Request counts and latencies per route, database pool, business and table metrics in the Prometheus text format", Unlimited: true, Unversioned: true},
+
+		// Documentation
+		{Method: "GET", Path: "/openapi.json", Handler: s.OpenAPI, Tag: "docs", Summary: "OpenAPI document for this API", Response: map[string]any{}, Unversioned: true},
+		{Method: "GET", Path: "/docs", Handler: s.Docs, Tag: "docs", Summary: "Swagger UI", Unversioned: true},
+	}
+}
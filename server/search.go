@@ -0,0 +1,150 @@
+package server
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/lib/pq"
+)
+
+// searchConfig is the text search configuration of the search_vector
+// columns. It does no stemming, as messages and names mix languages.
+const searchConfig = "simple"
+
+// SearchHit is a row matching a /search query. Snippet is the matching text
+// with the matched words wrapped in <b></b>.
+type SearchHit struct {
+	Type    string  `json:"type"` // user, announcement or expenseActivity
+	ID      int     `json:"id"`
+	Link    string  `json:"link"`
+	Snippet string  `json:"snippet"`
+	Rank    float64 `json:"rank"`
+}
+
+// searchSources are the searchable entities by hit type: the table, the
+// indexed text, the path of a row, and for what hangs off an expense
+// request the column of its ID, by which hits are scoped and redacted.
+var searchSources = []struct {
+	Type, Table, Text, Path, Expense string
+}{
+	{"user", "users", "name", APIPrefix + "/users/", ""},
+	{"announcement", "announcement", "message", APIPrefix + "/announcements/", ""},
+	{"expenseActivity", "expense_activity", "feedback", APIPrefix + "/expense_activities/", "expense_id"},
+}
+
+const (
+	defaultSearchLimit = 20
+	maxSearchLimit     = 100
+)
+
+// Search runs a full-text search over user names, announcement messages and
+// expense activity feedback, best matches first. q takes web search syntax:
+// "quoted phrases", OR between words, and -word to exclude a word. type
+// limits the hits to a comma list of hit types. Activities are found only
+// on the requests the caller reads, and payment activities not at all
+// where the request's amount is hidden from them, as their feedback names
+// it.
+func (s *Server) Search(w http.ResponseWriter, r *http.Request) {
+	v, ok := s.viewerOf(w, r)
+	if !ok {
+		return
+	}
+	params := r.URL.Query()
+	q := strings.TrimSpace(params.Get("q"))
+	if q == "" {
+		http.Error(w, "Missing q parameter", http.StatusBadRequest)
+		return
+	}
+
+	limit := defaultSearchLimit
+	if l := params.Get("limit"); l != "" {
+		n, err := strconv.Atoi(l)
+		if err != nil || n < 1 || n > maxSearchLimit {
+			http.Error(w, "limit must be between 1 and "+strconv.Itoa(maxSearchLimit), http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+
+	types := map[string]bool{}
+	if t := params.Get("type"); t != "" {
+		for _, name := range strings.Split(t, ",") {
+			types[strings.TrimSpace(name)] = true
+		}
+	}
+
+	args := []any{q}
+	scope := v.expenseScope()
+	var selects []string
+	for _, source := range searchSources {
+		if len(types) > 0 && !types[source.Type] {
+			continue
+		}
+		delete(types, source.Type)
+		expense, where := "NULL::text, 0, ''", ""
+		if source.Expense != "" {
+			expense = "current_state::text, " + expenseOwnerColumns(source.Expense)
+			if scope != nil {
+				where = " AND " + source.Expense + " IN (SELECT id FROM expense_request WHERE user_id = $2 OR unit_id = ANY($3))"
+				if len(args) == 1 {
+					args = append(args, scope.UserID, pq.Array(scope.Units))
+				}
+			}
+		}
+		selects = append(selects, `
+			SELECT '`+source.Type+`', id, '`+source.Path+`' || id,
+				ts_headline('`+searchConfig+`', `+source.Text+`, tsq),
+				ts_rank(search_vector, tsq), `+expense+`
+			FROM `+source.Table+`, websearch_to_tsquery('`+searchConfig+`', $1) tsq
+			WHERE search_vector @@ tsq`+where)
+	}
+	for name := range types {
+		http.Error(w, "Unknown type "+name+"; use user, announcement or expenseActivity", http.StatusBadRequest)
+		return
+	}
+
+	// Hits the caller may not see are dropped as they are read, so the
+	// rows are not limited in the query
+	query := strings.Join(selects, " UNION ALL ") + " ORDER BY 5 DESC, 1, 2"
+	rows, err := s.DB.QueryContext(r.Context(), query, args...)
+	if err != nil {
+		http.Error(w, "Database query failed", http.StatusInternalServerError)
+		log.Println("Search error:", err)
+		return
+	}
+	defer rows.Close()
+
+	hits := []SearchHit{}
+	for len(hits) < limit && rows.Next() {
+		var h SearchHit
+		var state *ExpenseState
+		var owner int
+		var unit string
+		if err := rows.Scan(&h.Type, &h.ID, &h.Link, &h.Snippet, &h.Rank, &state, &owner, &unit); err != nil {
+			http.Error(w, "Failed to scan search hit", http.StatusInternalServerError)
+			log.Println("Scan error:", err)
+			return
+		}
+		if state != nil {
+			a := ExpenseActivity{CurrentState: *state, Feedback: h.Snippet}
+			if redactActivity(&a, v.hidesAmountOf(owner, unit)); len(a.Hidden) > 0 {
+				continue
+			}
+		}
+		hits = append(hits, h)
+	}
+	if err := rows.Err(); err != nil {
+		http.Error(w, "Row iteration error", http.StatusInternalServerError)
+		log.Println("Iteration error:", err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	if err := json.NewEncoder(w).Encode(hits); err != nil {
+		http.Error(w, "Encoding error", http.StatusInternalServerError)
+		log.Println("Encoding error:", err)
+	}
+}
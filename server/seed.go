@@ -0,0 +1,259 @@
+package server
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"main/money"
+	"math/rand/v2"
+	"strings"
+	"time"
+)
+
+// ErrNotEmpty is returned by SeedDemo for a database that already has
+// expense requests.
+var ErrNotEmpty = errors.New("the database already has expense requests")
+
+// DemoSummary counts the rows SeedDemo created.
+type DemoSummary struct {
+	Units           int
+	Users           int
+	Budgets         int
+	ExpenseRequests int
+	Activities      int
+	Payments        int
+}
+
+var demoUnits = []struct{ Name, Parent string }{
+	{"Finance", "Executive Management"},
+	{"Engineering", "Executive Management"},
+	{"Sales", "Executive Management"},
+	{"Field Sales", "Sales"},
+	{"Customer Support", "Sales"},
+}
+
+var demoCategories = []string{"Travel", "Meals", "Accommodation", "Equipment", "Software", "Training", "Office Supplies"}
+
+// demoPeople are the users of each unit: its manager first, then its staff.
+// Finance's staff are accountants, everyone else's are personnel.
+var demoPeople = map[string][]string{
+	"Finance":          {"Elif Yildiz", "Can Ozturk", "Zeynep Kaya"},
+	"Engineering":      {"Mehmet Demir", "Ayse Sahin", "Burak Celik", "Deniz Arslan", "Emre Dogan"},
+	"Sales":            {"Selin Aydin", "Kerem Koc", "Ece Kurt", "Onur Polat"},
+	"Field Sales":      {"Hakan Erdem", "Merve Tas", "Baris Gunes", "Ceren Aksoy"},
+	"Customer Support": {"Gizem Yilmaz", "Tolga Cetin", "Irem Bulut"},
+}
+
+var demoFeedback = map[ExpenseState][]string{
+	Pending:         {"Please attach the receipt", "Waiting for the trip report", "Which project is this for?"},
+	Approved:        {"Approved", "OK, within policy", "Approved, thanks"},
+	Rejected:        {"Not covered by the travel policy", "Duplicate of an earlier request", "Personal expense"},
+	CategoryChanged: {"This belongs under Equipment", "Moved to the right category"},
+	PartiallyPaid:   {"First instalment paid", "Paid the receipted part"},
+	Paid:            {"Paid in full", "Transferred with the monthly run"},
+}
+
+// demoRequests is how many expense requests SeedDemo creates, spread over
+// the last eighteen months.
+const demoRequests = 300
+
+// SeedDemo fills an empty database with demo data for frontend development:
+// units, a manager and staff per unit, categories, budgets for this year
+// and last, and expense requests in every state with their activities and
+// payments, and an Admin named "Demo Admin" when there is none. Every
+// user's password is "demo". The data is the same on every run apart from
+// dates, which are relative to now. It writes nothing and returns
+// ErrNotEmpty when there are expense requests already.
+func SeedDemo(ctx context.Context, db *sql.DB) (DemoSummary, error) {
+	var summary DemoSummary
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return summary, err
+	}
+	defer tx.Rollback()
+
+	var exists bool
+	if err := tx.QueryRowContext(ctx, "SELECT EXISTS (SELECT 1 FROM expense_request)").Scan(&exists); err != nil {
+		return summary, err
+	}
+	if exists {
+		return summary, ErrNotEmpty
+	}
+
+	// Every demo user shares one password, hashed once
+	demoPassword, err := hashPassword("demo")
+	if err != nil {
+		return summary, err
+	}
+
+	// The announcements are from the oldest Admin, or a demo one when the
+	// database has none yet
+	var adminID int
+	err = tx.QueryRowContext(ctx, "SELECT id FROM users WHERE role_id = 'Admin' ORDER BY id LIMIT 1").Scan(&adminID)
+	if errors.Is(err, sql.ErrNoRows) {
+		err = tx.QueryRowContext(ctx, `
+			INSERT INTO users (name, unit_id, role_id, password, email)
+			VALUES ('Demo Admin', 'Executive Management', 'Admin', $1, 'demo.admin@example.com') RETURNING id
+		`, demoPassword).Scan(&adminID)
+		summary.Users++
+	}
+	if err != nil {
+		return summary, err
+	}
+
+	for _, category := range demoCategories {
+		if _, err := tx.ExecContext(ctx, "INSERT INTO expense_category (name) VALUES ($1) ON CONFLICT DO NOTHING", category); err != nil {
+			return summary, err
+		}
+	}
+
+	// Staff by unit, and the user who decides on each unit's requests
+	staff := map[string][]int{}
+	managers := map[string]int{}
+	var accountants []int
+	for _, unit := range demoUnits {
+		result, err := tx.ExecContext(ctx, "INSERT INTO unit (name, manager_id, parent_unit) VALUES ($1, 0, $2) ON CONFLICT DO NOTHING",
+			unit.Name, unit.Parent)
+		if err != nil {
+			return summary, err
+		}
+		if n, err := result.RowsAffected(); err == nil {
+			summary.Units += int(n)
+		}
+
+		for i, name := range demoPeople[unit.Name] {
+			role := FieldPersonnel
+			switch {
+			case i == 0:
+				role = Manager
+			case unit.Name == "Finance":
+				role = Accounter
+			}
+			email := strings.ToLower(strings.ReplaceAll(name, " ", ".")) + "@example.com"
+			var id int
+			if err := tx.QueryRowContext(ctx,
+				"INSERT INTO users (name, unit_id, role_id, password, email) VALUES ($1, $2, $3, $4, $5) RETURNING id",
+				name, unit.Name, role, demoPassword, email).Scan(&id); err != nil {
+				return summary, err
+			}
+			summary.Users++
+
+			switch role {
+			case Manager:
+				managers[unit.Name] = id
+			case Accounter:
+				accountants = append(accountants, id)
+			}
+			// Managers file expenses too
+			staff[unit.Name] = append(staff[unit.Name], id)
+		}
+		if _, err := tx.ExecContext(ctx, "UPDATE unit SET manager_id = $2 WHERE name = $1", unit.Name, managers[unit.Name]); err != nil {
+			return summary, err
+		}
+	}
+
+	rng := rand.New(rand.NewPCG(4303, 1))
+	now := time.Now()
+	thisYear, err := fiscalYear(ctx, tx, now, "")
+	if err != nil {
+		return summary, err
+	}
+	for _, year := range []int{thisYear - 1, thisYear} {
+		for _, unit := range demoUnits {
+			for _, category := range demoCategories {
+				limit := money.Amount(2000+500*rng.IntN(17)) * 100
+				threshold := []float64{0.1, 0.15, 0.2}[rng.IntN(3)]
+				result, err := tx.ExecContext(ctx, `
+					INSERT INTO budget (unit_id, expense_category, year, budget_limit, threshold_ratio)
+					VALUES ($1, $2, $3, $4, $5) ON CONFLICT DO NOTHING
+				`, unit.Name, category, year, limit, threshold)
+				if err != nil {
+					return summary, err
+				}
+				if n, err := result.RowsAffected(); err == nil {
+					summary.Budgets += int(n)
+				}
+			}
+		}
+	}
+
+	for range demoRequests {
+		unit := demoUnits[rng.IntN(len(demoUnits))].Name
+		userID := staff[unit][rng.IntN(len(staff[unit]))]
+		category := demoCategories[rng.IntN(len(demoCategories))]
+		amount := money.FromFloat(20 + rng.Float64()*2980)
+		at := now.Add(-time.Duration(rng.IntN(540*24)) * time.Hour)
+
+		// The states the request went through, ending in its current one
+		var states []ExpenseState
+		switch p := rng.Float64(); {
+		case p < 0.2:
+		case p < 0.3:
+			states = []ExpenseState{Pending}
+		case p < 0.4:
+			states = []ExpenseState{Rejected}
+		case p < 0.45:
+			states = []ExpenseState{CategoryChanged}
+		case p < 0.6:
+			states = []ExpenseState{Approved}
+		case p < 0.72:
+			states = []ExpenseState{Approved, PartiallyPaid}
+		default:
+			states = []ExpenseState{Approved, Paid}
+		}
+		final := len(states) > 0 && (states[len(states)-1] == Rejected || states[len(states)-1] == Paid)
+
+		var expenseID int
+		if err := tx.QueryRowContext(ctx, `
+			INSERT INTO expense_request (user_id, unit_id, amount, category, is_finalized, created_at)
+			VALUES ($1, $2, $3, $4, $5, $6) RETURNING id
+		`, userID, unit, amount, category, final, at).Scan(&expenseID); err != nil {
+			return summary, err
+		}
+		summary.ExpenseRequests++
+
+		var paid money.Amount
+		for _, state := range states {
+			if next := at.Add(time.Duration(1+rng.IntN(72)) * time.Hour); next.Before(now) {
+				at = next
+			}
+
+			decidedBy := managers[unit]
+			if state == PartiallyPaid || state == Paid {
+				decidedBy = accountants[rng.IntN(len(accountants))]
+				payment := amount - paid
+				if state == PartiallyPaid {
+					payment = amount.Mul(0.3 + 0.4*rng.Float64())
+				}
+				if _, err := tx.ExecContext(ctx, `
+					INSERT INTO paid_expense (expense_id, unit_id, category, amount, created_at, base_amount, exchange_rate, rate_date)
+					VALUES ($1, $2, $3, $4, $5, $4, 1, $5::date)
+				`, expenseID, unit, category, payment, at); err != nil {
+					return summary, err
+				}
+				paid += payment
+				summary.Payments++
+			}
+
+			feedback := demoFeedback[state][rng.IntN(len(demoFeedback[state]))]
+			if _, err := tx.ExecContext(ctx, `
+				INSERT INTO expense_activity (expense_id, current_state, feedback, created_by, created_at)
+				VALUES ($1, $2, $3, $4, $5)
+			`, expenseID, state, feedback, decidedBy, at); err != nil {
+				return summary, err
+			}
+			summary.Activities++
+		}
+	}
+
+	for _, message := range []string{
+		"Welcome to the expense system. Your demo password is \"demo\".",
+		"Travel claims for last month close on Friday.",
+	} {
+		if _, err := tx.ExecContext(ctx, "INSERT INTO announcement (message, receiver_id, broadcast, created_by) VALUES ($1, 0, TRUE, $2)", message, adminID); err != nil {
+			return summary, err
+		}
+	}
+
+	return summary, tx.Commit()
+}
@@ -1,9 +1,118 @@
 package server
 
+// json tags follow the naming policy in package naming
+//go:generate go run ../cmd/jsontags .
+
 import (
+	"context"
 	"database/sql"
+	"main/bankfile"
+	"main/cache"
+	"main/directory"
+	"main/fieldcrypt"
+	"main/fxrates"
+	"main/oidc"
+	"main/ratelimit"
+	"main/tracing"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
 type Server struct {
 	DB *sql.DB
+
+	// JWTSecret signs the access tokens issued by Login.
+	JWTSecret []byte
+
+	// SessionTTL is how long a login session, and so its refresh token,
+	// lasts before the user has to log in again.
+	SessionTTL time.Duration
+
+	// LoginLockout locks login names after repeated failed logins; see
+	// loginThrottle.go.
+	LoginLockout LoginLockoutPolicy
+
+	// Directory checks passwords against LDAP or Active Directory before
+	// local ones, and DirectoryRules map its users to roles and units. Nil
+	// disables it.
+	Directory      directory.Authenticator
+	DirectoryRules ProvisioningRules
+
+	// OIDC signs users in through an OpenID Connect provider, and
+	// OIDCMapping turns its ID tokens into users. Nil disables it.
+	OIDC        oidc.Flow
+	OIDCMapping OIDCMapping
+
+	// FieldKeys encrypts bank account numbers and receipt files in the
+	// database. Nil stores them in the clear.
+	FieldKeys *fieldcrypt.Keyring
+
+	// PayloadRetention is how long raw expense request payloads are kept.
+	// Zero disables payload storage.
+	PayloadRetention time.Duration
+
+	// Scanner inspects attachments before they are stored.
+	Scanner AttachmentScanner
+
+	// Events carries change notifications to live streams. Nil disables them.
+	Events *EventBroker
+
+	// BaseCurrency is the ISO 4217 code amounts are reported in. Amounts
+	// without a currency are assumed to be in it.
+	BaseCurrency string
+
+	// FiscalYearStart is the month fiscal years start in, for units that do
+	// not set their own. Budgets and reports of year Y cover the twelve
+	// months from the start in Y.
+	FiscalYearStart time.Month
+
+	// PaymentDebtor is the account payment batches are paid from, named in
+	// their bank files, and PaymentCSVColumns the layout of their CSV
+	// export; see bankfile.Columns.
+	PaymentDebtor     bankfile.Account
+	PaymentCSVColumns []string
+
+	// RateProvider supplies daily exchange rates. Nil means rates are only
+	// entered by hand.
+	RateProvider fxrates.Provider
+
+	// Users, Budgets and Expenses hold the entities of the same name; see
+	// store.go.
+	Users    UserStore
+	Budgets  BudgetStore
+	Expenses ExpenseStore
+
+	// CORS is which browser origins may call the API.
+	CORS CORSPolicy
+
+	// RateLimiter keeps the rate limit buckets. Nil disables rate limiting.
+	RateLimiter ratelimit.Store
+
+	// Cache holds units and expense categories for ReferenceCacheTTL. Nil
+	// reads them from the database every time.
+	Cache             cache.Store
+	ReferenceCacheTTL time.Duration
+
+	// Tracer records a span for each request, which the queries it runs
+	// hang under when DB is opened with tracing.Connector. Nil disables
+	// tracing.
+	Tracer *tracing.Tracer
+
+	// LoadSettings reads the reloadable settings again, for SIGHUP and
+	// POST /admin/config/reload. Nil disables reloading.
+	LoadSettings func() (Settings, error)
+
+	settings atomic.Pointer[Settings]
+	reloadMu sync.Mutex
+
+	metrics requestMetrics
+}
+
+// dbtx is implemented by both *sql.DB and *sql.Tx, so helpers can run either
+// standalone or inside a caller's transaction.
+type dbtx interface {
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+	QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
 }
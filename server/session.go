@@ -0,0 +1,308 @@
+package server
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// sessionRetention is how long ended sessions are kept, so an Admin can
+// still tell which terminal a user was logged in on.
+const sessionRetention = 30 * 24 * time.Hour
+
+// maxDeviceLength is how much of the device name or User-Agent a session
+// keeps.
+const maxDeviceLength = 256
+
+// Session is a login on one device. Its refresh token renews the access
+// token until the session expires or is logged out; access tokens of a
+// session that ended are refused too.
+type Session struct {
+	ID         int       `json:"id"`
+	UserID     int       `json:"userID"`
+	Device     string    `json:"device"`
+	IPAddress  string    `json:"ipAddress"`
+	CreatedAt  time.Time `json:"createdAt"`
+	LastUsedAt time.Time `json:"lastUsedAt"` // last login or refresh
+	ExpiresAt  time.Time `json:"expiresAt"`
+	Current    bool      `json:"current"` // the session of the calling token
+}
+
+func (Session) CreateTableIfNotExists(s *Server) {
+	query := `CREATE TABLE IF NOT EXISTS session (
+		id SERIAL PRIMARY KEY,
+		user_id INT NOT NULL,
+		refresh_hash CHAR(64) NOT NULL UNIQUE,
+		device VARCHAR(256) NOT NULL DEFAULT '',
+		ip_address VARCHAR(64) NOT NULL DEFAULT '',
+		created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+		last_used_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+		expires_at TIMESTAMPTZ NOT NULL,
+		revoked_at TIMESTAMPTZ
+	);
+	CREATE INDEX IF NOT EXISTS session_user_idx ON session (user_id) WHERE revoked_at IS NULL`
+
+	_, err := s.DB.Exec(query)
+
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+type refreshRequest struct {
+	RefreshToken string `json:"refreshToken"`
+}
+
+// startSession records a login from the request and returns the session
+// with its refresh token.
+func (s *Server) startSession(r *http.Request, userID int, device string) (Session, string, error) {
+	if device == "" {
+		device = r.UserAgent()
+	}
+	if runes := []rune(device); len(runes) > maxDeviceLength {
+		device = string(runes[:maxDeviceLength])
+	}
+	address := clientAddress(r)
+
+	token, err := newOpaqueToken()
+	if err != nil {
+		return Session{}, "", err
+	}
+	session := Session{UserID: userID, Device: device, IPAddress: address}
+	err = s.DB.QueryRowContext(r.Context(), `
+		INSERT INTO session (user_id, refresh_hash, device, ip_address, expires_at)
+		VALUES ($1, $2, $3, $4, NOW() + $5 * INTERVAL '1 second')
+		RETURNING id, created_at, last_used_at, expires_at
+	`, userID, hashToken(token), device, address, s.SessionTTL.Seconds()).
+		Scan(&session.ID, &session.CreatedAt, &session.LastUsedAt, &session.ExpiresAt)
+	return session, token, err
+}
+
+// RefreshToken exchanges a refresh token for a new access token. The
+// refresh token is replaced by a new one every time, so a copy left on a
+// shared terminal stops working once the session has been renewed.
+func (s *Server) RefreshToken(w http.ResponseWriter, r *http.Request) {
+	var req refreshRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+	if req.RefreshToken == "" {
+		http.Error(w, "Invalid refresh token", http.StatusUnauthorized)
+		return
+	}
+
+	token, err := newOpaqueToken()
+	if err != nil {
+		log.Println("Token error:", err)
+		http.Error(w, "Failed to issue token", http.StatusInternalServerError)
+		return
+	}
+	var sessionID, userID int
+	var refreshExpiresAt time.Time
+	err = s.DB.QueryRowContext(r.Context(), `
+		UPDATE session SET refresh_hash = $2, last_used_at = NOW()
+		WHERE refresh_hash = $1 AND revoked_at IS NULL AND expires_at > NOW()
+		RETURNING id, user_id, expires_at
+	`, hashToken(req.RefreshToken), hashToken(token)).Scan(&sessionID, &userID, &refreshExpiresAt)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Invalid refresh token", http.StatusUnauthorized)
+		return
+	} else if err != nil {
+		log.Println("Session error:", err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	user, err := s.Users.Get(r.Context(), userID)
+	if errors.Is(err, errNotFound) {
+		http.Error(w, "Invalid refresh token", http.StatusUnauthorized)
+		return
+	} else if err != nil {
+		log.Println("User query error:", err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	expiresAt := time.Now().Add(tokenTTL)
+	accessToken, err := s.signToken(user, sessionID, expiresAt)
+	if err != nil {
+		log.Println("Token signing error:", err)
+		http.Error(w, "Failed to issue token", http.StatusInternalServerError)
+		return
+	}
+
+	// Never echo the password back
+	user.Password = ""
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(loginResponse{
+		Token:            accessToken,
+		ExpiresAt:        expiresAt,
+		RefreshToken:     token,
+		RefreshExpiresAt: refreshExpiresAt,
+		SessionID:        sessionID,
+		User:             user,
+	})
+}
+
+// Logout ends the session of the calling token, so neither its access
+// token nor its refresh token work any more.
+func (s *Server) Logout(w http.ResponseWriter, r *http.Request) {
+	if _, ok := s.requireCaller(w, r); !ok {
+		return
+	}
+	claims, err := s.bearerClaims(r)
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	if claims.SessionID != 0 {
+		if _, err := s.revokeSessions(r.Context(), "id = $1", claims.SessionID); err != nil {
+			log.Println("Session error:", err)
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// revokeSessions ends the active sessions matching where, which takes its
+// arguments from $1, and returns how many there were.
+func (s *Server) revokeSessions(ctx context.Context, where string, args ...any) (int64, error) {
+	result, err := s.DB.ExecContext(ctx,
+		"UPDATE session SET revoked_at = NOW() WHERE revoked_at IS NULL AND expires_at > NOW() AND "+where, args...)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+// selfOrAdmin authenticates a request below /users/{id} and returns the
+// user ID in the path, for what users may manage of their own and Admins of
+// everyone's, such as sessions.
+func (s *Server) selfOrAdmin(w http.ResponseWriter, r *http.Request) (caller User, userID int, ok bool) {
+	userID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid ID", http.StatusBadRequest)
+		return caller, 0, false
+	}
+	caller, ok = s.requireCaller(w, r)
+	if !ok {
+		return caller, 0, false
+	}
+	if caller.ID != userID && caller.RoleID != Admin {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return caller, 0, false
+	}
+	return caller, userID, true
+}
+
+// ListUserSessions lists a user's active sessions, most recently used
+// first.
+func (s *Server) ListUserSessions(w http.ResponseWriter, r *http.Request) {
+	_, userID, ok := s.selfOrAdmin(w, r)
+	if !ok {
+		return
+	}
+	var current int
+	if claims, err := s.bearerClaims(r); err == nil {
+		current = claims.SessionID
+	}
+
+	rows, err := s.DB.QueryContext(r.Context(), `
+		SELECT id, user_id, device, ip_address, created_at, last_used_at, expires_at
+		FROM session
+		WHERE user_id = $1 AND revoked_at IS NULL AND expires_at > NOW()
+		ORDER BY last_used_at DESC, id DESC
+	`, userID)
+	if err != nil {
+		http.Error(w, "Database query failed", http.StatusInternalServerError)
+		log.Println("Query error:", err)
+		return
+	}
+	defer rows.Close()
+
+	sessions := []Session{}
+	for rows.Next() {
+		var session Session
+		if err := rows.Scan(&session.ID, &session.UserID, &session.Device, &session.IPAddress,
+			&session.CreatedAt, &session.LastUsedAt, &session.ExpiresAt); err != nil {
+			http.Error(w, "Failed to scan session", http.StatusInternalServerError)
+			log.Println("Scan error:", err)
+			return
+		}
+		session.Current = session.ID == current
+		sessions = append(sessions, session)
+	}
+	if err := rows.Err(); err != nil {
+		http.Error(w, "Row iteration error", http.StatusInternalServerError)
+		log.Println("Iteration error:", err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(sessions)
+}
+
+// RevokeUserSessions logs a user out everywhere, e.g. when an Admin forces
+// a logout after a shared terminal was left signed in.
+func (s *Server) RevokeUserSessions(w http.ResponseWriter, r *http.Request) {
+	caller, userID, ok := s.selfOrAdmin(w, r)
+	if !ok {
+		return
+	}
+
+	revoked, err := s.revokeSessions(r.Context(), "user_id = $1", userID)
+	if err != nil {
+		log.Println("Session error:", err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	if caller.ID != userID {
+		if err := audit(r.Context(), s.DB, caller.ID, "sessions.revoke",
+			map[string]any{"userID": userID, "sessions": revoked}); err != nil {
+			log.Println("Audit error:", err)
+		}
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// RevokeUserSession logs one of a user's sessions out.
+func (s *Server) RevokeUserSession(w http.ResponseWriter, r *http.Request) {
+	caller, userID, ok := s.selfOrAdmin(w, r)
+	if !ok {
+		return
+	}
+	sessionID, err := strconv.Atoi(mux.Vars(r)["sessionID"])
+	if err != nil {
+		http.Error(w, "Invalid session ID", http.StatusBadRequest)
+		return
+	}
+
+	revoked, err := s.revokeSessions(r.Context(), "id = $1 AND user_id = $2", sessionID, userID)
+	if err != nil {
+		log.Println("Session error:", err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	if revoked == 0 {
+		http.Error(w, "Session not found", http.StatusNotFound)
+		return
+	}
+	if caller.ID != userID {
+		if err := audit(r.Context(), s.DB, caller.ID, "sessions.revoke",
+			map[string]any{"userID": userID, "sessionID": sessionID}); err != nil {
+			log.Println("Audit error:", err)
+		}
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,159 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"main/mailer"
+	"main/printer"
+	"maps"
+	"net/http"
+	"slices"
+	"time"
+)
+
+// Settings is the configuration that can change while the server runs.
+// Requests read it once through Server.Settings, so a reload never changes
+// it under a request halfway through.
+type Settings struct {
+	// ReceiptHosts lists the hosts receipts may be imported from by URL.
+	ReceiptHosts []string
+
+	// RequestTimeout bounds the context of every request. Zero disables it.
+	RequestTimeout time.Duration
+
+	// InboundEmailToken authenticates the mail provider's inbound webhook.
+	// Empty disables the email-in gateway.
+	InboundEmailToken string
+
+	// FreezeNotice is how long before a budget freeze starts the affected
+	// users are told about it.
+	FreezeNotice time.Duration
+
+	// Mailer delivers notification emails from the outbox. Nil disables
+	// email.
+	Mailer mailer.Sender
+
+	// Printer prints expense request dossiers for the paper archive. Nil
+	// disables printing.
+	Printer printer.Printer
+
+	// Features holds the optional features switched on by name.
+	Features map[string]bool
+
+	// RateLimits bounds how fast each user or address may call the API.
+	RateLimits RateLimits
+}
+
+// errReloadDisabled is returned by ReloadSettings when the server was not
+// given a way to load settings.
+var errReloadDisabled = errors.New("settings cannot be reloaded")
+
+// Settings returns the settings in effect.
+func (s *Server) Settings() *Settings {
+	if settings := s.settings.Load(); settings != nil {
+		return settings
+	}
+	return &Settings{}
+}
+
+// ApplySettings puts settings into effect for every request that starts
+// from now on, and returns the names of the settings that changed.
+func (s *Server) ApplySettings(settings Settings) []string {
+	s.reloadMu.Lock()
+	defer s.reloadMu.Unlock()
+
+	old := s.Settings()
+	changed := []string{}
+	if !slices.Equal(old.ReceiptHosts, settings.ReceiptHosts) {
+		changed = append(changed, "receiptHosts")
+	}
+	if old.RequestTimeout != settings.RequestTimeout {
+		changed = append(changed, "requestTimeout")
+	}
+	if old.InboundEmailToken != settings.InboundEmailToken {
+		changed = append(changed, "inboundEmailToken")
+	}
+	if old.FreezeNotice != settings.FreezeNotice {
+		changed = append(changed, "freezeNotice")
+	}
+	// Senders and printers are plain structs, so they compare by value
+	if old.Mailer != settings.Mailer {
+		changed = append(changed, "mailer")
+	}
+	if old.Printer != settings.Printer {
+		changed = append(changed, "printer")
+	}
+	if !maps.Equal(old.Features, settings.Features) {
+		changed = append(changed, "features")
+	}
+	if old.RateLimits != settings.RateLimits {
+		changed = append(changed, "rateLimits")
+	}
+
+	s.settings.Store(&settings)
+	return changed
+}
+
+// ReloadSettings loads the settings again through LoadSettings and applies
+// them. Settings that fail to load leave the current ones in effect.
+func (s *Server) ReloadSettings() ([]string, error) {
+	if s.LoadSettings == nil {
+		return nil, errReloadDisabled
+	}
+	settings, err := s.LoadSettings()
+	if err != nil {
+		return nil, err
+	}
+	return s.ApplySettings(settings), nil
+}
+
+// Features lists the optional features switched on, so clients can adapt
+// to them.
+func (s *Server) Features(w http.ResponseWriter, r *http.Request) {
+	features := slices.Sorted(maps.Keys(s.Settings().Features))
+	if features == nil {
+		features = []string{}
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	if err := json.NewEncoder(w).Encode(features); err != nil {
+		log.Println("JSON encoding error:", err)
+	}
+}
+
+// SettingsReload lists the settings a reload changed.
+type SettingsReload struct {
+	Changed []string `json:"changed"`
+}
+
+// ReloadConfig reloads the server's settings without a restart, as SIGHUP
+// does. In-flight requests finish with the settings they started with.
+func (s *Server) ReloadConfig(w http.ResponseWriter, r *http.Request) {
+	caller, ok := s.requireRole(w, r, Admin)
+	if !ok {
+		return
+	}
+
+	changed, err := s.ReloadSettings()
+	if errors.Is(err, errReloadDisabled) {
+		http.Error(w, "Configuration reload is not available", http.StatusNotImplemented)
+		return
+	} else if err != nil {
+		log.Println("Configuration reload error:", err)
+		// The message names the offending setting and never a secret
+		http.Error(w, "Configuration not reloaded: "+err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+	log.Println("Configuration reloaded, changed:", changed)
+
+	reload := SettingsReload{Changed: changed}
+	if err := audit(context.WithoutCancel(r.Context()), s.DB, caller.ID, "config.reload", reload); err != nil {
+		log.Println("Audit log error:", err)
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	if err := json.NewEncoder(w).Encode(reload); err != nil {
+		log.Println("JSON encoding error:", err)
+	}
+}
@@ -0,0 +1,170 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+)
+
+// SetupToken is the one-time token POST /setup takes to create the first
+// Admin. Only its SHA-256 is stored, so the token itself is only ever in
+// the startup log.
+type SetupToken struct{}
+
+func (SetupToken) CreateTableIfNotExists(s *Server) {
+	query := `CREATE TABLE IF NOT EXISTS setup_token (
+		token_hash CHAR(64) PRIMARY KEY,
+		created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+	)`
+
+	_, err := s.DB.Exec(query)
+
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+type setupRequest struct {
+	Token    string `json:"token"`
+	Name     string `json:"name"`
+	UnitID   string `json:"unitID"` // defaults to the root unit
+	Email    string `json:"email"`
+	Password string `json:"password"`
+}
+
+// adminExists reports whether any user with the Admin role can log in:
+// with a local password, or through the directory or an identity
+// provider. The old default admin, whose password CreateTableIfNotExists
+// clears, does not count.
+func (s *Server) adminExists(ctx context.Context, db dbtx) (bool, error) {
+	var ok bool
+	err := db.QueryRowContext(ctx, `SELECT EXISTS (SELECT 1 FROM users WHERE role_id = $1
+		AND (password <> '' OR directory_dn <> '' OR oidc_subject <> ''))`, Admin).Scan(&ok)
+	return ok, err
+}
+
+// BootstrapSetup issues a new setup token while there is no Admin yet and
+// returns it for the caller to show the operator, replacing any earlier
+// one. Once an Admin exists it removes any leftover token and returns "".
+func (s *Server) BootstrapSetup(ctx context.Context) (string, error) {
+	tx, err := s.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, "DELETE FROM setup_token"); err != nil {
+		return "", err
+	}
+	exists, err := s.adminExists(ctx, tx)
+	if err != nil {
+		return "", err
+	}
+	if exists {
+		return "", tx.Commit()
+	}
+
+	token, err := newOpaqueToken()
+	if err != nil {
+		return "", err
+	}
+	if _, err := tx.ExecContext(ctx, "INSERT INTO setup_token (token_hash) VALUES ($1)", hashToken(token)); err != nil {
+		return "", err
+	}
+	return token, tx.Commit()
+}
+
+// Setup creates the first Admin with the setup token logged at startup. It
+// is refused once any Admin exists, and the token works only once.
+func (s *Server) Setup(w http.ResponseWriter, r *http.Request) {
+	var req setupRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+
+	ctx := r.Context()
+	exists, err := s.adminExists(ctx, s.DB)
+	if err != nil {
+		log.Println("Setup query error:", err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	if exists {
+		http.Error(w, "Setup is complete; an Admin already exists", http.StatusConflict)
+		return
+	}
+
+	hash := hashToken(req.Token)
+	valid, err := s.exists(ctx, "SELECT 1 FROM setup_token WHERE token_hash = $1", hash)
+	if err != nil {
+		log.Println("Setup query error:", err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	if req.Token == "" || !valid {
+		http.Error(w, "Invalid setup token", http.StatusUnauthorized)
+		return
+	}
+
+	user := User{Name: req.Name, UnitID: req.UnitID, RoleID: Admin, Email: req.Email, Password: req.Password}
+	if user.UnitID == "" {
+		user.UnitID = "Executive Management"
+	}
+	errs, err := s.validateAdmin(ctx, user)
+	if err != nil {
+		log.Println("Validation query error:", err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	if len(errs) > 0 {
+		writeValidationErrors(w, errs)
+		return
+	}
+
+	tx, err := s.DB.BeginTx(ctx, nil)
+	if err != nil {
+		log.Println("Setup transaction error:", err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	// Deleting the token claims it, so of two concurrent requests only one
+	// gets past here
+	result, err := tx.ExecContext(ctx, "DELETE FROM setup_token WHERE token_hash = $1", hash)
+	if err != nil {
+		log.Println("Setup token error:", err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	if n, err := result.RowsAffected(); err != nil || n == 0 {
+		http.Error(w, "Invalid setup token", http.StatusUnauthorized)
+		return
+	}
+
+	user, err = PostgresUserStore{DB: tx}.Create(ctx, user)
+	if err != nil {
+		log.Println("Insert error:", err)
+		http.Error(w, "Failed to create user", http.StatusInternalServerError)
+		return
+	}
+	if err := audit(ctx, tx, user.ID, "users.setup", map[string]string{"name": user.Name}); err != nil {
+		log.Println("Audit error:", err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		log.Println("Setup commit error:", err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	// Never echo the password back
+	user.Password = ""
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(user)
+}
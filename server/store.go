@@ -0,0 +1,126 @@
+package server
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"log"
+	"main/query"
+	"net/http"
+	"strconv"
+)
+
+// Users, budgets and expense requests are read and written through stores,
+// so their handlers only deal with HTTP: decoding, validation, status codes
+// and encoding. The Postgres stores run on a dbtx, so the same code works
+// inside a transaction, and handlers can be exercised against a fake.
+
+// errNotFound is returned by a store when the row does not exist.
+var errNotFound = errors.New("not found")
+
+// versionMismatchError is returned by a versioned store write when the row
+// exists but its version is not one of those the caller sent in If-Match.
+type versionMismatchError struct {
+	Version int // the row's current version
+}
+
+func (e *versionMismatchError) Error() string {
+	return "version mismatch, current version " + versionETag(e.Version)
+}
+
+// conflictError refuses a change the current state of what it changes does
+// not allow, such as paying a rejected request. It is the message shown to
+// the caller.
+type conflictError string
+
+func (e conflictError) Error() string {
+	return string(e)
+}
+
+// maxListLimit is the largest page a list endpoint returns.
+const maxListLimit = 1000
+
+// ListOptions orders and pages a list. Sort holds ORDER BY terms from
+// query.ParseSort; a zero Limit returns every row.
+type ListOptions struct {
+	Sort   []string
+	Limit  int
+	Offset int
+}
+
+// listOptions reads ?sort=, ?limit= and ?offset=, writing a 400 when one is
+// invalid. sortable maps the names clients may sort by to columns.
+func listOptions(w http.ResponseWriter, r *http.Request, sortable map[string]string) (ListOptions, bool) {
+	var opts ListOptions
+	params := r.URL.Query()
+
+	sort, err := query.ParseSort(params.Get("sort"), sortable)
+	if err != nil {
+		http.Error(w, "Invalid sort: "+err.Error(), http.StatusBadRequest)
+		return opts, false
+	}
+	opts.Sort = sort
+
+	if limit := params.Get("limit"); limit != "" {
+		n, err := strconv.Atoi(limit)
+		if err != nil || n < 1 || n > maxListLimit {
+			http.Error(w, "limit must be between 1 and "+strconv.Itoa(maxListLimit), http.StatusBadRequest)
+			return opts, false
+		}
+		opts.Limit = n
+	}
+	if offset := params.Get("offset"); offset != "" {
+		n, err := strconv.Atoi(offset)
+		if err != nil || n < 0 {
+			http.Error(w, "offset must be a non-negative integer", http.StatusBadRequest)
+			return opts, false
+		}
+		opts.Offset = n
+	}
+	return opts, true
+}
+
+// Patch is a partial update as built by buildPatch: a SET clause whose
+// placeholders start at $1, and their values.
+type Patch struct {
+	Set  string
+	Args query.Args
+}
+
+// versionMismatch explains a versioned write that changed no row. It
+// returns errNotFound when the row is gone and a *versionMismatchError with
+// its version otherwise. versionQuery selects the row's version.
+func versionMismatch(ctx context.Context, db dbtx, versionQuery string, args ...any) error {
+	var version int
+	err := db.QueryRowContext(ctx, versionQuery, args...).Scan(&version)
+	if err == sql.ErrNoRows {
+		return errNotFound
+	} else if err != nil {
+		return err
+	}
+	return &versionMismatchError{Version: version}
+}
+
+// writeStoreError answers a failed store call, or a failed operation built
+// on the stores: 404 with notFound when the row does not exist, 412 with
+// the current ETag when its version did not match, 422 for FieldErrors,
+// 409 for a conflictError and 500 for anything else.
+func writeStoreError(w http.ResponseWriter, err error, notFound string) {
+	var mismatch *versionMismatchError
+	var invalid FieldErrors
+	var conflict conflictError
+	switch {
+	case errors.Is(err, errNotFound):
+		http.Error(w, notFound, http.StatusNotFound)
+	case errors.As(err, &mismatch):
+		setVersionETag(w, mismatch.Version)
+		http.Error(w, "The resource has been modified; fetch it again", http.StatusPreconditionFailed)
+	case errors.As(err, &invalid):
+		writeValidationErrors(w, invalid)
+	case errors.As(err, &conflict):
+		http.Error(w, string(conflict), http.StatusConflict)
+	default:
+		log.Println("Store error:", err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+	}
+}
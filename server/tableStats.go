@@ -0,0 +1,213 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	// tableStatRetention is how long snapshots are kept.
+	tableStatRetention = 30 * 24 * time.Hour
+
+	// A table's growth is abnormal when it gained at least growthAlertMinRows
+	// rows in a day and more than growthAlertRatio times its size a day ago,
+	// e.g. a client stuck in a loop posting activities.
+	growthAlertMinRows = 10000
+	growthAlertRatio   = 1.0
+)
+
+// TableStat is one snapshot of a table's size.
+type TableStat struct {
+	Table       string    `json:"table"`
+	Rows        int64     `json:"rows"`
+	Bytes       int64     `json:"bytes"`
+	CollectedAt time.Time `json:"collectedAt"`
+}
+
+func (TableStat) CreateTableIfNotExists(s *Server) {
+	query := `CREATE TABLE IF NOT EXISTS table_stat (
+		table_name VARCHAR(128) NOT NULL,
+		collected_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+		row_count BIGINT NOT NULL,
+		total_bytes BIGINT NOT NULL,
+
+		PRIMARY KEY (table_name, collected_at)
+	)`
+
+	_, err := s.DB.Exec(query)
+
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// TableUsage is the latest snapshot of a table and how it grew over the
+// preceding day. Growth is unknown until a day of snapshots exists.
+type TableUsage struct {
+	TableStat
+	RowsDayAgo *int64 `json:"rowsDayAgo,omitempty"`
+	GrowthRows *int64 `json:"growthRows,omitempty"`
+	Alert      bool   `json:"alert"`
+}
+
+func growthAbnormal(before, after int64) bool {
+	growth := after - before
+	return growth >= growthAlertMinRows && float64(growth) > float64(before)*growthAlertRatio
+}
+
+// CollectTableStats snapshots the row count and on-disk size of every table.
+// Row counts are the planner's estimates, which avoids scanning large tables.
+func (s *Server) CollectTableStats(ctx context.Context) error {
+	_, err := s.DB.ExecContext(ctx, `
+		INSERT INTO table_stat (table_name, row_count, total_bytes)
+		SELECT relname, n_live_tup, pg_total_relation_size(relid)
+		FROM pg_stat_user_tables
+		WHERE schemaname = current_schema()
+	`)
+	if err != nil {
+		return err
+	}
+
+	_, err = s.DB.ExecContext(ctx,
+		"DELETE FROM table_stat WHERE collected_at < NOW() - $1 * INTERVAL '1 second'", tableStatRetention.Seconds())
+	return err
+}
+
+// tableUsage returns the latest snapshot of every table.
+func (s *Server) tableUsage(ctx context.Context) ([]TableUsage, error) {
+	rows, err := s.DB.QueryContext(ctx, `
+		SELECT cur.table_name, cur.row_count, cur.total_bytes, cur.collected_at, prev.row_count
+		FROM (
+			SELECT DISTINCT ON (table_name) table_name, row_count, total_bytes, collected_at
+			FROM table_stat
+			ORDER BY table_name, collected_at DESC
+		) cur
+		LEFT JOIN LATERAL (
+			SELECT row_count
+			FROM table_stat p
+			WHERE p.table_name = cur.table_name AND p.collected_at <= cur.collected_at - INTERVAL '1 day'
+			ORDER BY p.collected_at DESC
+			LIMIT 1
+		) prev ON true
+		ORDER BY cur.table_name
+	`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	usage := []TableUsage{}
+	for rows.Next() {
+		var u TableUsage
+		if err := rows.Scan(&u.Table, &u.Rows, &u.Bytes, &u.CollectedAt, &u.RowsDayAgo); err != nil {
+			return nil, err
+		}
+		if u.RowsDayAgo != nil {
+			growth := u.Rows - *u.RowsDayAgo
+			u.GrowthRows = &growth
+			u.Alert = growthAbnormal(*u.RowsDayAgo, u.Rows)
+		}
+		usage = append(usage, u)
+	}
+	return usage, rows.Err()
+}
+
+// RunTableStatsCollector snapshots table sizes every interval until ctx is
+// cancelled, logging tables whose growth looks abnormal.
+func (s *Server) RunTableStatsCollector(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		if err := s.collectAndCheckTableStats(ctx); err != nil && ctx.Err() == nil {
+			log.Println("Table stats collection error:", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (s *Server) collectAndCheckTableStats(ctx context.Context) error {
+	if err := s.CollectTableStats(ctx); err != nil {
+		return err
+	}
+	usage, err := s.tableUsage(ctx)
+	if err != nil {
+		return err
+	}
+	for _, u := range usage {
+		if u.Alert {
+			log.Printf("Abnormal growth in table %s: %d rows, up %d in a day", u.Table, u.Rows, *u.GrowthRows)
+		}
+	}
+	return nil
+}
+
+func (s *Server) AdminUsage(w http.ResponseWriter, r *http.Request) {
+	if _, ok := s.requireRole(w, r, Admin); !ok {
+		return
+	}
+
+	usage, err := s.tableUsage(r.Context())
+	if err != nil {
+		log.Println("Table usage query error:", err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(usage)
+}
+
+// Metrics exposes request, connection pool and business metrics and the
+// latest table snapshot in the Prometheus text format. Table metrics are
+// left out while the database cannot be queried.
+func (s *Server) Metrics(w http.ResponseWriter, r *http.Request) {
+	var b strings.Builder
+	s.writeRequestMetrics(&b)
+
+	usage, err := s.tableUsage(r.Context())
+	if err != nil {
+		log.Println("Table usage query error:", err)
+		usage = nil
+	}
+
+	gauge := func(name, help string, value func(TableUsage) (int64, bool)) {
+		fmt.Fprintf(&b, "# HELP %s %s\n# TYPE %s gauge\n", name, help, name)
+		for _, u := range usage {
+			if v, ok := value(u); ok {
+				fmt.Fprintf(&b, "%s{table=%q} %d\n", name, u.Table, v)
+			}
+		}
+	}
+	gauge("ems_table_rows", "Estimated live rows per table.", func(u TableUsage) (int64, bool) {
+		return u.Rows, true
+	})
+	gauge("ems_table_bytes", "Size of each table including indexes and TOAST.", func(u TableUsage) (int64, bool) {
+		return u.Bytes, true
+	})
+	gauge("ems_table_growth_rows", "Rows gained per table over the last day.", func(u TableUsage) (int64, bool) {
+		if u.GrowthRows == nil {
+			return 0, false
+		}
+		return *u.GrowthRows, true
+	})
+	gauge("ems_table_growth_alert", "1 when a table's growth over the last day is abnormal.", func(u TableUsage) (int64, bool) {
+		if u.Alert {
+			return 1, true
+		}
+		return 0, true
+	})
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	w.Write([]byte(b.String()))
+}
@@ -0,0 +1,350 @@
+package server
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+	"github.com/lib/pq"
+)
+
+// TaxRate is a VAT rate expenses may be booked at, e.g. "standard" at 19%.
+// Requests and payments keep the rate itself, so changing or deleting a
+// rate does not rewrite what was booked at it.
+type TaxRate struct {
+	Code        string  `json:"code"`
+	Rate        float64 `json:"rate"` // percent
+	Description string  `json:"description"`
+}
+
+func (TaxRate) CreateTableIfNotExists(s *Server) {
+	query := `CREATE TABLE IF NOT EXISTS tax_rate (
+		code VARCHAR(32) PRIMARY KEY,
+		rate NUMERIC(5,2) NOT NULL UNIQUE,
+		description VARCHAR(256) NOT NULL DEFAULT ''
+	)`
+
+	_, err := s.DB.Exec(query)
+
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+func (t TaxRate) Validate(ctx context.Context, s *Server) (FieldErrors, error) {
+	errs := FieldErrors{}
+	switch {
+	case t.Code == "":
+		errs.add("code", "is required")
+	case len(t.Code) > 32:
+		errs.add("code", "must be at most 32 characters")
+	}
+	if t.Rate < 0 || t.Rate >= 100 {
+		errs.add("rate", "must be at least 0 and below 100")
+	} else if err := s.checkUnique(ctx, errs, "rate", "is already configured under another code",
+		"SELECT 1 FROM tax_rate WHERE rate = $1 AND code <> $2", t.Rate, t.Code); err != nil {
+		return nil, err
+	}
+	if len(t.Description) > 256 {
+		errs.add("description", "must be at most 256 characters")
+	}
+	return errs, nil
+}
+
+// netAmount is the SQL expression for the net of a gross amount column at
+// the vat_rate column of the same row. Both are NULL without a rate.
+func netAmount(gross string) string {
+	return fmt.Sprintf("ROUND(%[1]s * 100 / (100 + vat_rate), 2)", gross)
+}
+
+// widenAmountColumns retypes columns of table to NUMERIC(15,2), which holds
+// up to money.Max, where a database from before is narrower. The net and
+// VAT amounts are generated from amount, which Postgres cannot retype under
+// them, so they are dropped with it for addVATColumns to add again.
+func widenAmountColumns(s *Server, table string, columns ...string) {
+	for _, column := range columns {
+		generated := ""
+		if column == "amount" {
+			generated = "ALTER TABLE " + table + " DROP COLUMN IF EXISTS net_amount, DROP COLUMN IF EXISTS vat_amount;"
+		}
+		_, err := s.DB.Exec(`DO $$
+		BEGIN
+			IF EXISTS (SELECT 1 FROM information_schema.columns
+				WHERE table_schema = current_schema() AND table_name = ` + pq.QuoteLiteral(table) + `
+				AND column_name = ` + pq.QuoteLiteral(column) + ` AND numeric_precision < 15) THEN
+				` + generated + `
+				ALTER TABLE ` + table + ` ALTER COLUMN ` + column + ` TYPE NUMERIC(15,2);
+			END IF;
+		END $$`)
+
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+}
+
+// addVATColumns adds the VAT rate a table's amount is booked at, with the
+// net and VAT amounts it splits into.
+func addVATColumns(s *Server, table string) {
+	_, err := s.DB.Exec("ALTER TABLE " + table + " ADD COLUMN IF NOT EXISTS vat_rate NUMERIC(5,2)")
+
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	net := netAmount("amount")
+	_, err = s.DB.Exec(`ALTER TABLE ` + table + `
+		ADD COLUMN IF NOT EXISTS net_amount NUMERIC(15,2) GENERATED ALWAYS AS (` + net + `) STORED,
+		ADD COLUMN IF NOT EXISTS vat_amount NUMERIC(15,2) GENERATED ALWAYS AS (amount - ` + net + `) STORED`)
+
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// checkVATRate adds a field error unless rate is nil or configured.
+func (s *Server) checkVATRate(ctx context.Context, errs FieldErrors, field string, rate *float64) error {
+	if rate == nil {
+		return nil
+	}
+	return s.checkExists(ctx, errs, field, "is not a configured tax rate",
+		"SELECT 1 FROM tax_rate WHERE rate = $1", *rate)
+}
+
+func (s *Server) ListTaxRates(w http.ResponseWriter, r *http.Request) {
+	rows, err := s.DB.QueryContext(r.Context(), "SELECT code, rate, description FROM tax_rate ORDER BY rate, code")
+	if err != nil {
+		log.Println("ListTaxRates query error:", err)
+		http.Error(w, "Database query failed", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	rates := []TaxRate{}
+	for rows.Next() {
+		var t TaxRate
+		if err := rows.Scan(&t.Code, &t.Rate, &t.Description); err != nil {
+			log.Println("Row scan error:", err)
+			http.Error(w, "Failed to scan tax rate", http.StatusInternalServerError)
+			return
+		}
+		rates = append(rates, t)
+	}
+	if err := rows.Err(); err != nil {
+		log.Println("Row iteration error:", err)
+		http.Error(w, "Row iteration error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(rates)
+}
+
+func (s *Server) CreateTaxRate(w http.ResponseWriter, r *http.Request) {
+	caller, ok := s.requireRole(w, r, Accounter, Admin)
+	if !ok {
+		return
+	}
+
+	var t TaxRate
+	if err := json.NewDecoder(r.Body).Decode(&t); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+	if !s.validate(w, r, t) {
+		return
+	}
+
+	_, err := s.DB.ExecContext(r.Context(),
+		"INSERT INTO tax_rate (code, rate, description) VALUES ($1, $2, $3)", t.Code, t.Rate, t.Description)
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) && pqErr.Code == "23505" {
+		writeValidationErrors(w, FieldErrors{"code": "is already in use"})
+		return
+	} else if err != nil {
+		log.Println("Insert tax rate error:", err)
+		http.Error(w, "Failed to create tax rate", http.StatusInternalServerError)
+		return
+	}
+	if err := audit(r.Context(), s.DB, caller.ID, "tax_rates.create", t); err != nil {
+		log.Println("Audit error:", err)
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(t)
+}
+
+// UpdateTaxRate changes the rate or description under a code. Requests and
+// payments booked before keep the old rate.
+func (s *Server) UpdateTaxRate(w http.ResponseWriter, r *http.Request) {
+	caller, ok := s.requireRole(w, r, Accounter, Admin)
+	if !ok {
+		return
+	}
+
+	var t TaxRate
+	if err := json.NewDecoder(r.Body).Decode(&t); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+	t.Code = mux.Vars(r)["code"]
+	if !s.validate(w, r, t) {
+		return
+	}
+
+	result, err := s.DB.ExecContext(r.Context(),
+		"UPDATE tax_rate SET rate = $2, description = $3 WHERE code = $1", t.Code, t.Rate, t.Description)
+	if err != nil {
+		log.Println("Update tax rate error:", err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	if n, err := result.RowsAffected(); err != nil || n == 0 {
+		http.Error(w, "Tax rate not found", http.StatusNotFound)
+		return
+	}
+	if err := audit(r.Context(), s.DB, caller.ID, "tax_rates.update", t); err != nil {
+		log.Println("Audit error:", err)
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(t)
+}
+
+func (s *Server) DeleteTaxRate(w http.ResponseWriter, r *http.Request) {
+	caller, ok := s.requireRole(w, r, Accounter, Admin)
+	if !ok {
+		return
+	}
+
+	var t TaxRate
+	err := s.DB.QueryRowContext(r.Context(),
+		"DELETE FROM tax_rate WHERE code = $1 RETURNING code, rate, description", mux.Vars(r)["code"],
+	).Scan(&t.Code, &t.Rate, &t.Description)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Tax rate not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		log.Println("Delete tax rate error:", err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	if err := audit(r.Context(), s.DB, caller.ID, "tax_rates.delete", t); err != nil {
+		log.Println("Audit error:", err)
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+type VATReportRow struct {
+	Period   string  `json:"period"` // 2025-Q1, or 2025-01 by month
+	VATRate  float64 `json:"vatRate"`
+	Payments int     `json:"payments"`
+	Gross    float64 `json:"gross"`
+	Net      float64 `json:"net"`
+	VAT      float64 `json:"vat"`
+}
+
+// VATReport sums a year's payments by period and VAT rate for filing. All
+// amounts are in the base currency; payments without a VAT rate, or in a
+// currency with no known exchange rate, are left out and counted.
+type VATReport struct {
+	Year         int            `json:"year"`
+	Period       string         `json:"period"`
+	BaseCurrency string         `json:"baseCurrency"`
+	Untaxed      int            `json:"untaxed"`
+	Unconverted  int            `json:"unconverted"`
+	Rows         []VATReportRow `json:"rows"`
+}
+
+func (s *Server) GetVATReport(w http.ResponseWriter, r *http.Request) {
+	if _, ok := s.requireRole(w, r, Accounter, Admin); !ok {
+		return
+	}
+	queryParams := r.URL.Query()
+
+	year, err := strconv.Atoi(queryParams.Get("year"))
+	if err != nil {
+		http.Error(w, "Missing or invalid year parameter", http.StatusBadRequest)
+		return
+	}
+	period := queryParams.Get("period")
+	var label string
+	switch period {
+	case "", "quarter":
+		period, label = "quarter", `'Q' || EXTRACT(QUARTER FROM pe.created_at)::int`
+	case "month":
+		label = `LPAD(EXTRACT(MONTH FROM pe.created_at)::int::text, 2, '0')`
+	default:
+		http.Error(w, "period must be quarter or month", http.StatusBadRequest)
+		return
+	}
+
+	report := VATReport{Year: year, Period: period, BaseCurrency: s.BaseCurrency, Rows: []VATReportRow{}}
+
+	// Payments convert at the rate of their day, as in the expense report
+	date := "pe.created_at::date"
+	rows, err := s.DB.QueryContext(r.Context(), `
+		SELECT period, vat_rate, COUNT(*), COALESCE(SUM(gross), 0), COALESCE(SUM(net), 0),
+			COUNT(*) - COUNT(gross)
+		FROM (
+			SELECT `+label+` AS period, pe.vat_rate,
+				`+s.inBaseCurrency("pe.amount", "pe.currency", date)+` AS gross,
+				`+s.inBaseCurrency("pe.net_amount", "pe.currency", date)+` AS net
+			FROM paid_expense pe
+			WHERE EXTRACT(YEAR FROM pe.created_at) = $1 AND pe.vat_rate IS NOT NULL
+		) p
+		GROUP BY period, vat_rate
+		ORDER BY period, vat_rate
+	`, year)
+	if err != nil {
+		log.Println("VATReport query error:", err)
+		http.Error(w, "Database query failed", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	round := s.conversionRounding(r.Context()).Apply
+	for rows.Next() {
+		var row VATReportRow
+		var within string
+		var unconverted int
+		if err := rows.Scan(&within, &row.VATRate, &row.Payments, &row.Gross, &row.Net, &unconverted); err != nil {
+			log.Println("Row scan error:", err)
+			http.Error(w, "Failed to read report data", http.StatusInternalServerError)
+			return
+		}
+		row.Period = strconv.Itoa(year) + "-" + within
+		row.Payments -= unconverted
+		row.Gross, row.Net = round(row.Gross), round(row.Net)
+		row.VAT = round(row.Gross - row.Net)
+		report.Unconverted += unconverted
+		report.Rows = append(report.Rows, row)
+	}
+	if err := rows.Err(); err != nil {
+		log.Println("Row iteration error:", err)
+		http.Error(w, "Error reading results", http.StatusInternalServerError)
+		return
+	}
+
+	err = s.DB.QueryRowContext(r.Context(), `
+		SELECT COUNT(*) FROM paid_expense pe
+		WHERE EXTRACT(YEAR FROM pe.created_at) = $1 AND pe.vat_rate IS NULL
+	`, year).Scan(&report.Untaxed)
+	if err != nil {
+		log.Println("VATReport query error:", err)
+		http.Error(w, "Database query failed", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	if err := json.NewEncoder(w).Encode(report); err != nil {
+		log.Println("JSON encoding error:", err)
+	}
+}
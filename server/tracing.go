@@ -0,0 +1,39 @@
+package server
+
+import (
+	"main/tracing"
+	"net/http"
+	"strconv"
+)
+
+// TracingMiddleware records a server span for each request to a route,
+// named after its method and path template and continuing the caller's
+// trace when it sends a traceparent header. The queries the handler runs
+// become its children.
+func (s *Server) TracingMiddleware(route Route, next http.Handler) http.Handler {
+	if s.Tracer == nil {
+		return next
+	}
+	template := route.template()
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx, span := s.Tracer.StartRemote(r.Context(), r.Header.Get("traceparent"), route.Method+" "+template, tracing.Server)
+		if span == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		defer span.End()
+		span.SetAttribute("http.request.method", route.Method)
+		span.SetAttribute("http.route", template)
+		span.SetAttribute("url.path", r.URL.Path)
+
+		rec := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(rec, r.WithContext(ctx))
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+		span.SetAttribute("http.response.status_code", rec.status)
+		if rec.status >= 500 {
+			span.SetError(strconv.Itoa(rec.status) + " " + http.StatusText(rec.status))
+		}
+	})
+}
@@ -1,18 +1,37 @@
 package server
 
 import (
+	"context"
+	"database/sql"
 	"encoding/json"
+	"errors"
 	"log"
+	"main/query"
 	"net/http"
 	"strconv"
-	"strings"
 
 	"github.com/gorilla/mux"
+	"github.com/lib/pq"
 )
 
 type Unit struct {
 	Name      string `json:"name"`
 	ManagerID int    `json:"managerID"`
+	// ParentUnit is the unit this one reports to; empty for a top-level unit
+	ParentUnit string `json:"parentUnit,omitempty"`
+	// FiscalYearStart is the month the unit's fiscal year starts in, 1 for
+	// January; 0 for the organisation's
+	FiscalYearStart int `json:"fiscalYearStart,omitempty"`
+}
+
+// unitColumns is the column list every unit query selects, in the order
+// scanUnit expects.
+const unitColumns = "name, manager_id, COALESCE(parent_unit, ''), COALESCE(fiscal_year_start, 0)"
+
+func scanUnit(row rowScanner) (Unit, error) {
+	var u Unit
+	err := row.Scan(&u.Name, &u.ManagerID, &u.ParentUnit, &u.FiscalYearStart)
+	return u, err
 }
 
 func (Unit) CreateTableIfNotExists(s *Server) {
@@ -26,6 +45,20 @@ func (Unit) CreateTableIfNotExists(s *Server) {
 		log.Fatal(err)
 	}
 
+	// Renaming a unit carries its sub-units along
+	_, err = s.DB.Exec("ALTER TABLE unit ADD COLUMN IF NOT EXISTS parent_unit VARCHAR(256) REFERENCES unit (name) ON UPDATE CASCADE")
+
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// Units without one follow the organisation's fiscal year
+	_, err = s.DB.Exec("ALTER TABLE unit ADD COLUMN IF NOT EXISTS fiscal_year_start INT")
+
+	if err != nil {
+		log.Fatal(err)
+	}
+
 	insertQuery := `INSERT INTO unit (name, manager_id)
 	            SELECT 'Executive Management', 0
 	            WHERE NOT EXISTS (SELECT 1 FROM unit WHERE name = 'Executive Management')`
@@ -37,6 +70,28 @@ func (Unit) CreateTableIfNotExists(s *Server) {
 	}
 }
 
+func (u Unit) Validate(ctx context.Context, s *Server) (FieldErrors, error) {
+	errs := FieldErrors{}
+	if u.Name == "" {
+		errs.add("name", "is required")
+	}
+	if u.ManagerID < 0 {
+		errs.add("managerID", "must not be negative")
+	}
+	if u.FiscalYearStart < 0 || u.FiscalYearStart > 12 {
+		errs.add("fiscalYearStart", "must be a month from 1 to 12, or 0 for the organisation's")
+	}
+	if u.ParentUnit != "" {
+		if u.ParentUnit == u.Name {
+			errs.add("parentUnit", "must not be the unit itself")
+		} else if err := s.checkExists(ctx, errs, "parentUnit", "unit does not exist",
+			"SELECT 1 FROM unit WHERE name = $1", u.ParentUnit); err != nil {
+			return nil, err
+		}
+	}
+	return errs, nil
+}
+
 func (s *Server) CreateUnit(w http.ResponseWriter, r *http.Request) {
 	var unit Unit
 	if err := json.NewDecoder(r.Body).Decode(&unit); err != nil {
@@ -44,17 +99,22 @@ func (s *Server) CreateUnit(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if !s.validate(w, r, unit) {
+		return
+	}
+
 	query := `
-        INSERT INTO unit (name, manager_id)
-        VALUES ($1, $2)
+        INSERT INTO unit (name, manager_id, parent_unit, fiscal_year_start)
+        VALUES ($1, $2, NULLIF($3, ''), NULLIF($4, 0))
     `
 
-	_, err := s.DB.Exec(query, unit.Name, unit.ManagerID)
+	_, err := s.DB.ExecContext(r.Context(), query, unit.Name, unit.ManagerID, unit.ParentUnit, unit.FiscalYearStart)
 	if err != nil {
 		log.Println("Failed to insert unit:", err)
 		http.Error(w, "Failed to create unit", http.StatusInternalServerError)
 		return
 	}
+	s.invalidateReference(r.Context(), unitsCacheKey)
 
 	w.Header().Set("Content-Type", "application/json; charset=utf-8")
 	if err := json.NewEncoder(w).Encode(unit); err != nil {
@@ -68,8 +128,7 @@ func (s *Server) GetUnit(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	name := vars["name"]
 
-	var unit Unit
-	err := s.DB.QueryRow("SELECT name, manager_id FROM unit WHERE name = $1", name).Scan(&unit.Name, &unit.ManagerID)
+	unit, err := scanUnit(s.DB.QueryRowContext(r.Context(), "SELECT "+unitColumns+" FROM unit WHERE name = $1", name))
 	if err != nil {
 		// if err == sql.ErrNoRows {
 		// 	http.Error(w, "Unit not found", http.StatusNotFound)
@@ -100,15 +159,13 @@ func (s *Server) UpdateUnit(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Ensure Name is valid
-	if unit.Name == "" {
-		http.Error(w, "Missing or invalid Name", http.StatusBadRequest)
+	if !s.validate(w, r, unit) {
 		return
 	}
 
 	// Check if unit exists before update
 	var exists bool
-	err := s.DB.QueryRow("SELECT EXISTS(SELECT 1 FROM unit WHERE name = $1)", name).Scan(&exists)
+	err := s.DB.QueryRowContext(r.Context(), "SELECT EXISTS(SELECT 1 FROM unit WHERE name = $1)", name).Scan(&exists)
 	if err != nil {
 		log.Printf("DB error checking unit existence: %v", err)
 		http.Error(w, "Database error", http.StatusInternalServerError)
@@ -119,20 +176,159 @@ func (s *Server) UpdateUnit(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if !s.checkUnitParent(w, r, name, unit.ParentUnit) {
+		return
+	}
+
 	// Prepare the SQL UPDATE statement
 	query := `
 		UPDATE unit 
-		SET name = $1, manager_id = $2
-		WHERE name = $3
-	`
-	_, err = s.DB.Exec(query, unit.Name, unit.ManagerID, name)
+		SET name = $1, manager_id = $2, parent_unit = NULLIF($3, ''), fiscal_year_start = NULLIF($4, 0)
+		WHERE name = $5
+		RETURNING ` + unitColumns
+	unit, ok := s.updateUnit(w, r, name, query, unit.Name, unit.ManagerID, unit.ParentUnit, unit.FiscalYearStart, name)
+	if !ok {
+		return
+	}
+
+	// Respond with updated unit
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	if err := json.NewEncoder(w).Encode(unit); err != nil {
+		log.Printf("JSON encoding error: %v", err)
+	}
+}
+
+// nameReference is a column that refers to a row of another table by name,
+// without a foreign key.
+type nameReference struct{ table, column string }
+
+// unitReferences are the columns that refer to a unit by name. Sub-units
+// follow a rename through their foreign key.
+var unitReferences = []nameReference{
+	{"users", "unit_id"},
+	{"announcement", "receiver_unit"},
+	{"budget", "unit_id"},
+	{"budget_revision", "unit_id"},
+	{"budget_freeze", "unit_id"},
+	{"expense_request", "unit_id"},
+	{"paid_expense", "unit_id"},
+}
+
+// renameReferences points every row referring to from at to instead.
+func renameReferences(ctx context.Context, tx *sql.Tx, refs []nameReference, from, to string) (int64, error) {
+	var renamed int64
+	for _, ref := range refs {
+		result, err := tx.ExecContext(ctx, "UPDATE "+ref.table+" SET "+ref.column+" = $1 WHERE "+ref.column+" = $2", to, from)
+		if err != nil {
+			return renamed, err
+		}
+		n, err := result.RowsAffected()
+		if err != nil {
+			return renamed, err
+		}
+		renamed += n
+	}
+	return renamed, nil
+}
+
+// updateUnit runs an UPDATE of unit name that returns unitColumns. When it
+// renames the unit, everything referring to the unit is renamed with it in
+// the same transaction, so no row is left pointing at the old name.
+func (s *Server) updateUnit(w http.ResponseWriter, r *http.Request, name, query string, args ...any) (Unit, bool) {
+	ctx := r.Context()
+	tx, err := s.DB.BeginTx(ctx, nil)
 	if err != nil {
+		log.Printf("Begin transaction error: %v", err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return Unit{}, false
+	}
+	defer tx.Rollback()
+
+	unit, err := scanUnit(tx.QueryRowContext(ctx, query, args...))
+	var pqErr *pq.Error
+	if err == sql.ErrNoRows {
+		http.Error(w, "Unit not found", http.StatusNotFound)
+		return unit, false
+	} else if errors.As(err, &pqErr) && pqErr.Code == "23505" {
+		writeValidationErrors(w, FieldErrors{"name": "is already used by another unit"})
+		return unit, false
+	} else if err != nil {
 		log.Printf("DB update error: %v", err)
 		http.Error(w, "Database error", http.StatusInternalServerError)
+		return unit, false
+	}
+
+	if unit.Name != name {
+		_, err := renameReferences(ctx, tx, unitReferences, name, unit.Name)
+		if errors.As(err, &pqErr) && pqErr.Code == "23505" {
+			// Rows left behind under the new name by an earlier rename
+			http.Error(w, "Budgets already exist under the unit name "+unit.Name, http.StatusConflict)
+			return unit, false
+		} else if err != nil {
+			log.Printf("Unit rename error: %v", err)
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return unit, false
+		}
+		if err := audit(ctx, tx, s.callerID(r), "unit.rename", map[string]string{"from": name, "to": unit.Name}); err != nil {
+			log.Printf("Audit log error: %v", err)
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return unit, false
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		log.Printf("Commit error: %v", err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return unit, false
+	}
+	s.invalidateReference(ctx, unitsCacheKey)
+	return unit, true
+}
+
+var unitPatchFields = map[string]patchField{
+	"name":            patchAs[string]("name"),
+	"managerID":       patchAs[int]("manager_id"),
+	"parentUnit":      patchEmptyAsNull("parent_unit"),
+	"fiscalYearStart": patchZeroAsNull("fiscal_year_start"),
+}
+
+func (s *Server) PatchUnit(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	name := vars["name"]
+
+	// Decode only the fields the client sent
+	var fields map[string]json.RawMessage
+	if err := json.NewDecoder(r.Body).Decode(&fields); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+
+	set, args, err := buildPatch(fields, unitPatchFields)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if !s.validatePatch(w, r, fields, &Unit{}) {
+		return
+	}
+
+	if raw, ok := fields["parentUnit"]; ok {
+		var parent string
+		json.Unmarshal(raw, &parent)
+		if !s.checkUnitParent(w, r, name, parent) {
+			return
+		}
+	}
+
+	query := "UPDATE unit SET " + set + " WHERE name = " + args.Add(name) +
+		" RETURNING " + unitColumns
+
+	unit, ok := s.updateUnit(w, r, name, query, args...)
+	if !ok {
 		return
 	}
 
-	// Respond with updated unit
 	w.Header().Set("Content-Type", "application/json; charset=utf-8")
 	if err := json.NewEncoder(w).Encode(unit); err != nil {
 		log.Printf("JSON encoding error: %v", err)
@@ -143,8 +339,19 @@ func (s *Server) DeleteUnit(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	name := vars["name"]
 
+	hasChildren, err := s.exists(r.Context(), "SELECT 1 FROM unit WHERE parent_unit = $1", name)
+	if err != nil {
+		log.Println("Sub-unit lookup error:", err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	if hasChildren {
+		http.Error(w, "Unit has sub-units; move or delete them first", http.StatusConflict)
+		return
+	}
+
 	// Perform the DELETE query
-	result, err := s.DB.Exec("DELETE FROM unit WHERE name = $1", name)
+	result, err := s.DB.ExecContext(r.Context(), "DELETE FROM unit WHERE name = $1", name)
 	if err != nil {
 		http.Error(w, "Failed to delete unit", http.StatusInternalServerError)
 		log.Println("Delete error:", err)
@@ -164,62 +371,51 @@ func (s *Server) DeleteUnit(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Unit not found", http.StatusNotFound)
 		return
 	}
+	s.invalidateReference(r.Context(), unitsCacheKey)
 
 	// Return a success message (204 No Content is common for successful DELETE)
 	w.WriteHeader(http.StatusNoContent)
 }
 
-func (s *Server) ListUnits(w http.ResponseWriter, r *http.Request) {
-	// Parse query params for filtering (e.g., ?name=foo&managerID=123)
-	queryParams := r.URL.Query()
-	var filters []string
-	var args []any
-	argPos := 1
-
-	if name := queryParams.Get("name"); name != "" {
-		filters = append(filters, "name = $"+strconv.Itoa(argPos))
-		args = append(args, name)
-		argPos++
-	}
-	if managerID := queryParams.Get("manager_id"); managerID != "" {
-		filters = append(filters, "manager_id = $"+strconv.Itoa(argPos))
-		args = append(args, managerID)
-		argPos++
+// loadUnits reads every unit, for the cached list ListUnits filters.
+func (s *Server) loadUnits(ctx context.Context) ([]Unit, error) {
+	statement, args := query.From("unit", unitColumns).SQL()
+	rows, err := s.DB.QueryContext(ctx, statement, args...)
+	if err != nil {
+		return nil, err
 	}
+	defer rows.Close()
 
-	// Build the SQL query
-	query := "SELECT name, manager_id FROM unit"
-	if len(filters) > 0 {
-		query += " WHERE " + strings.Join(filters, " AND ")
+	var units []Unit
+	for rows.Next() {
+		unit, err := scanUnit(rows)
+		if err != nil {
+			return nil, err
+		}
+		units = append(units, unit)
 	}
+	return units, rows.Err()
+}
 
-	rows, err := s.DB.Query(query, args...)
+func (s *Server) ListUnits(w http.ResponseWriter, r *http.Request) {
+	units, err := cachedList(r.Context(), s, unitsCacheKey, s.loadUnits)
 	if err != nil {
 		log.Println("Error querying units:", err)
 		http.Error(w, "Failed to query units from database", http.StatusInternalServerError)
 		return
 	}
-	defer rows.Close()
 
+	// Filter the cached list by the query params (e.g., ?name=foo&managerID=123)
+	queryParams := r.URL.Query()
+	name, managerID, parentUnit := queryParams.Get("name"), queryParams.Get("managerID"), queryParams.Get("parentUnit")
 	var allUnits []Unit
-	for rows.Next() {
-		var unit Unit
-		if err := rows.Scan(&unit.Name, &unit.ManagerID); err != nil {
-			log.Println("Error scanning unit row:", err)
-			http.Error(w, "Failed to scan unit data", http.StatusInternalServerError)
-			return
+	for _, unit := range units.Items {
+		if (name == "" || unit.Name == name) &&
+			(managerID == "" || strconv.Itoa(unit.ManagerID) == managerID) &&
+			(parentUnit == "" || unit.ParentUnit == parentUnit) {
+			allUnits = append(allUnits, unit)
 		}
-		allUnits = append(allUnits, unit)
-	}
-
-	if err = rows.Err(); err != nil {
-		log.Println("Row iteration error:", err)
-		http.Error(w, "Error iterating over unit rows", http.StatusInternalServerError)
-		return
 	}
 
-	w.Header().Set("Content-Type", "application/json; charset=utf-8")
-	if err := json.NewEncoder(w).Encode(allUnits); err != nil {
-		log.Println("JSON encoding error:", err)
-	}
+	writeReferenceList(w, r, allUnits, units.Modified)
 }
@@ -0,0 +1,232 @@
+package server
+
+import (
+	"encoding/json"
+	"log"
+	"main/money"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+)
+
+// unitSubtree selects the names of a unit and every unit below it, with
+// the unit's name in placeholder param. UNION stops at a cycle should one
+// ever be stored.
+func unitSubtree(param string) string {
+	return `WITH RECURSIVE subtree AS (
+		SELECT name FROM unit WHERE name = ` + param + `
+		UNION
+		SELECT u.name FROM unit u JOIN subtree t ON u.parent_unit = t.name
+	) SELECT name FROM subtree`
+}
+
+// includeSubunits reads ?includeSubunits=, writing a 400 when it is not a
+// boolean.
+func includeSubunits(w http.ResponseWriter, r *http.Request) (bool, bool) {
+	v := r.URL.Query().Get("includeSubunits")
+	if v == "" {
+		return false, true
+	}
+	include, err := strconv.ParseBool(v)
+	if err != nil {
+		http.Error(w, "Invalid include_subunits parameter", http.StatusBadRequest)
+		return false, false
+	}
+	return include, true
+}
+
+// checkUnitParent writes a 422 when making parent the parent of unit name
+// would put the unit below itself.
+func (s *Server) checkUnitParent(w http.ResponseWriter, r *http.Request, name, parent string) bool {
+	if parent == "" {
+		return true
+	}
+	cycle, err := s.exists(r.Context(), "SELECT 1 FROM ("+unitSubtree("$1")+") t WHERE name = $2", name, parent)
+	if err != nil {
+		log.Println("Unit hierarchy query error:", err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return false
+	}
+	if cycle {
+		writeValidationErrors(w, FieldErrors{"parentUnit": "must not be the unit itself or one of its sub-units"})
+		return false
+	}
+	return true
+}
+
+// UnitNode is a unit with the units reporting to it.
+type UnitNode struct {
+	Unit
+	Children []*UnitNode `json:"children"`
+}
+
+// GetUnitTree returns every unit arranged under its parent.
+func (s *Server) GetUnitTree(w http.ResponseWriter, r *http.Request) {
+	rows, err := s.DB.QueryContext(r.Context(), "SELECT "+unitColumns+" FROM unit ORDER BY name")
+	if err != nil {
+		log.Println("Error querying units:", err)
+		http.Error(w, "Failed to query units from database", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	var units []*UnitNode
+	byName := map[string]*UnitNode{}
+	for rows.Next() {
+		unit, err := scanUnit(rows)
+		if err != nil {
+			log.Println("Error scanning unit row:", err)
+			http.Error(w, "Failed to scan unit data", http.StatusInternalServerError)
+			return
+		}
+		node := &UnitNode{Unit: unit, Children: []*UnitNode{}}
+		units = append(units, node)
+		byName[unit.Name] = node
+	}
+	if err := rows.Err(); err != nil {
+		log.Println("Row iteration error:", err)
+		http.Error(w, "Error iterating over unit rows", http.StatusInternalServerError)
+		return
+	}
+
+	roots := []*UnitNode{}
+	for _, node := range units {
+		if parent, ok := byName[node.ParentUnit]; ok {
+			parent.Children = append(parent.Children, node)
+		} else {
+			roots = append(roots, node)
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	if err := json.NewEncoder(w).Encode(roots); err != nil {
+		log.Println("JSON encoding error:", err)
+	}
+}
+
+// UnitRollup is a unit's budget and spending for a year, on its own and
+// together with everything below it. Amounts are in the base currency;
+// budgets and payments with no known exchange rate are counted in
+// Unconverted instead.
+type UnitRollup struct {
+	Unit        string        `json:"unit"`
+	Budget      money.Amount  `json:"budget"`
+	Spent       money.Amount  `json:"spent"`
+	TotalBudget money.Amount  `json:"totalBudget"`
+	TotalSpent  money.Amount  `json:"totalSpent"`
+	Variance    money.Amount  `json:"variance"` // totalBudget minus totalSpent
+	Unconverted int           `json:"unconverted"`
+	Children    []*UnitRollup `json:"children"`
+}
+
+// GetUnitRollup rolls a year's budgets and payments up the hierarchy below
+// a unit, so a directorate sees the totals across its sub-units. It is read
+// by those who may read the unit's reports.
+func (s *Server) GetUnitRollup(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["name"]
+	year, err := strconv.Atoi(r.URL.Query().Get("year"))
+	if err != nil {
+		http.Error(w, "Missing or invalid year parameter", http.StatusBadRequest)
+		return
+	}
+	if !s.readableUnit(w, r, name) {
+		return
+	}
+
+	// Payments convert at the rate of their day, budgets at the latest rate,
+	// each to the cent, and are summed as NUMERIC
+	paidAmount := "ROUND(" + s.inBaseCurrency("pe.amount", "pe.currency", "pe.created_at::date") + ", 2)"
+	budgetAmount := "ROUND(" + s.inBaseCurrency("b.budget_limit", "b.currency", "CURRENT_DATE") + ", 2)"
+
+	rows, err := s.DB.QueryContext(r.Context(), `
+		WITH RECURSIVE subtree AS (
+			SELECT name, parent_unit FROM unit WHERE name = $1
+			UNION
+			SELECT u.name, u.parent_unit FROM unit u JOIN subtree t ON u.parent_unit = t.name
+		), spent AS (
+			SELECT unit_id, SUM(converted) AS spent, COUNT(*) - COUNT(converted) AS unconverted
+			FROM (
+				SELECT pe.unit_id, `+paidAmount+` AS converted
+				FROM paid_expense pe
+				WHERE pe.unit_id IN (SELECT name FROM subtree) AND fiscal_year(pe.created_at, pe.unit_id) = $2
+			) p
+			GROUP BY unit_id
+		), budgeted AS (
+			SELECT unit_id, SUM(converted) AS budget, COUNT(*) - COUNT(converted) AS unconverted
+			FROM (
+				SELECT b.unit_id, `+budgetAmount+` AS converted
+				FROM budget b
+				WHERE b.unit_id IN (SELECT name FROM subtree) AND b.year = $2
+			) b
+			GROUP BY unit_id
+		)
+		SELECT t.name, COALESCE(t.parent_unit, ''), COALESCE(b.budget, 0), COALESCE(s.spent, 0),
+			COALESCE(s.unconverted, 0) + COALESCE(b.unconverted, 0)
+		FROM subtree t
+		LEFT JOIN spent s ON s.unit_id = t.name
+		LEFT JOIN budgeted b ON b.unit_id = t.name
+		ORDER BY t.name
+	`, name, year)
+	if err != nil {
+		log.Println("Unit rollup query error:", err)
+		http.Error(w, "Database query failed", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	type unitRow struct {
+		node   *UnitRollup
+		parent string
+	}
+	var units []unitRow
+	byName := map[string]*UnitRollup{}
+	for rows.Next() {
+		node := &UnitRollup{Children: []*UnitRollup{}}
+		var parent string
+		if err := rows.Scan(&node.Unit, &parent, &node.Budget, &node.Spent, &node.Unconverted); err != nil {
+			log.Println("Row scan error:", err)
+			http.Error(w, "Failed to read report data", http.StatusInternalServerError)
+			return
+		}
+		units = append(units, unitRow{node, parent})
+		byName[node.Unit] = node
+	}
+	if err := rows.Err(); err != nil {
+		log.Println("Row iteration error:", err)
+		http.Error(w, "Error reading results", http.StatusInternalServerError)
+		return
+	}
+
+	root, ok := byName[name]
+	if !ok {
+		http.Error(w, "Unit not found", http.StatusNotFound)
+		return
+	}
+	for _, u := range units {
+		if parent, ok := byName[u.parent]; ok && u.node != root {
+			parent.Children = append(parent.Children, u.node)
+		}
+	}
+
+	round := s.conversionRounding(r.Context()).Round
+	var total func(n *UnitRollup)
+	total = func(n *UnitRollup) {
+		n.TotalBudget, n.TotalSpent = n.Budget, n.Spent
+		for _, child := range n.Children {
+			total(child)
+			n.TotalBudget += child.TotalBudget
+			n.TotalSpent += child.TotalSpent
+			n.Unconverted += child.Unconverted
+		}
+		n.Budget, n.Spent = round(n.Budget), round(n.Spent)
+		n.TotalBudget, n.TotalSpent = round(n.TotalBudget), round(n.TotalSpent)
+		n.Variance = n.TotalBudget - n.TotalSpent
+	}
+	total(root)
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	if err := json.NewEncoder(w).Encode(root); err != nil {
+		log.Println("JSON encoding error:", err)
+	}
+}
@@ -1,11 +1,13 @@
 package server
 
 import (
+	"context"
 	"encoding/json"
 	"log"
+	"main/query"
 	"net/http"
+	"net/mail"
 	"strconv"
-	"strings"
 
 	"github.com/gorilla/mux"
 )
@@ -24,7 +26,37 @@ type User struct {
 	Name     string   `json:"name"`
 	UnitID   string   `json:"unitID"`
 	RoleID   UserRole `json:"roleID"`
-	Password string   `json:"password"`
+	Password string   `json:"password,omitempty"` // only ever sent, never returned
+	Email    string   `json:"email"`              // empty unless the caller is the user or an Admin
+	Version  int      `json:"version,omitempty"`  // sent as the ETag; see concurrency.go
+}
+
+// userFields binds the users columns to the fields of u. The password is
+// not among them; see password.go.
+func userFields(u *User) []query.Field {
+	return []query.Field{
+		{Column: "id", Target: &u.ID},
+		{Column: "name", Target: &u.Name},
+		{Column: "unit_id", Target: &u.UnitID},
+		{Column: "role_id", Target: &u.RoleID},
+		{Column: "email", Target: &u.Email},
+		{Column: "version", Target: &u.Version},
+	}
+}
+
+// userColumns is the column list every users query selects, in the order
+// scanUser expects.
+var userColumns = query.Columns(userFields(&User{}))
+
+// rowScanner is satisfied by both *sql.Row and *sql.Rows.
+type rowScanner interface {
+	Scan(dest ...any) error
+}
+
+func scanUser(row rowScanner) (User, error) {
+	var u User
+	err := row.Scan(query.Targets(userFields(&u))...)
+	return u, err
 }
 
 func (User) CreateTableIfNotExists(s *Server) {
@@ -42,20 +74,124 @@ func (User) CreateTableIfNotExists(s *Server) {
 		log.Fatal(err)
 	}
 
-	query = `INSERT INTO users (name, unit_id, role_id, password)
-	SELECT 'admin', 'ExecutiveManagement', 'admin', 'password'
-	WHERE NOT EXISTS (
-		SELECT 1 FROM users WHERE name = 'admin' AND role_id = 'admin'
-	)`
+	// Email is used to match inbound mail to its sender
+	query = `ALTER TABLE users ADD COLUMN IF NOT EXISTS email VARCHAR(256) NOT NULL DEFAULT '';
+	CREATE UNIQUE INDEX IF NOT EXISTS users_email_key ON users (LOWER(email)) WHERE email <> ''`
 
 	_, err = s.DB.Exec(query)
 
 	if err != nil {
 		log.Fatal(err)
 	}
+
+	_, err = s.DB.Exec("ALTER TABLE users ADD COLUMN IF NOT EXISTS version INT NOT NULL DEFAULT 1")
+
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// Indexed for /search
+	_, err = s.DB.Exec(`ALTER TABLE users ADD COLUMN IF NOT EXISTS search_vector tsvector
+		GENERATED ALWAYS AS (to_tsvector('` + searchConfig + `', name)) STORED;
+	CREATE INDEX IF NOT EXISTS users_search_vector_idx ON users USING GIN (search_vector)`)
+
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// Users provisioned from the directory are linked by their DN, those
+	// of an OpenID Connect provider by issuer and subject; neither have a
+	// local password
+	_, err = s.DB.Exec(`ALTER TABLE users ADD COLUMN IF NOT EXISTS directory_dn VARCHAR(512) NOT NULL DEFAULT '';
+	CREATE UNIQUE INDEX IF NOT EXISTS users_directory_dn_key ON users (directory_dn) WHERE directory_dn <> '';
+	ALTER TABLE users ADD COLUMN IF NOT EXISTS oidc_subject VARCHAR(512) NOT NULL DEFAULT '';
+	CREATE UNIQUE INDEX IF NOT EXISTS users_oidc_subject_key ON users (oidc_subject) WHERE oidc_subject <> ''`)
+
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// Older versions stored passwords in plaintext
+	n, err := hashStoredPasswords(context.Background(), s.DB)
+
+	if err != nil {
+		log.Fatal(err)
+	}
+	if n > 0 {
+		log.Printf("Hashed the plaintext passwords of %d users", n)
+	}
+
+	// The server used to create admin/password on every start. That login
+	// is disabled rather than kept, so the first Admin comes from POST
+	// /setup or the create-admin command; see adminExists.
+	n, err = disableDefaultLogin(context.Background(), s.DB)
+
+	if err != nil {
+		log.Fatal(err)
+	}
+	if n > 0 {
+		log.Println("Disabled the old admin/password login; create the first Admin with POST /setup or create-admin")
+	}
+
+	// Older databases seeded the admin with roles and units that do not
+	// pass validation. One whose password was changed is a real account,
+	// so bring it in line with the defined constants.
+	query = `UPDATE users SET role_id = 'Admin', unit_id = 'Executive Management'
+	WHERE name = 'admin' AND role_id = 'admin' AND password <> ''`
+
+	_, err = s.DB.Exec(query)
+
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// IsValid reports whether the role is one of the defined UserRole constants.
+func (r UserRole) IsValid() bool {
+	switch r {
+	case Admin, FieldPersonnel, Manager, Accounter:
+		return true
+	}
+	return false
 }
 
+func (u User) Validate(ctx context.Context, s *Server) (FieldErrors, error) {
+	errs := FieldErrors{}
+	if u.Name == "" {
+		errs.add("name", "is required")
+	}
+	if u.Password == "" {
+		errs.add("password", "is required")
+	} else if len(u.Password) > maxPasswordBytes {
+		errs.add("password", "must be at most 72 bytes")
+	}
+	if !u.RoleID.IsValid() {
+		errs.add("roleID", "must be one of Admin, Personnel, Manager, Accountant")
+	}
+	if u.Email != "" {
+		if addr, err := mail.ParseAddress(u.Email); err != nil || addr.Address != u.Email {
+			errs.add("email", "must be a plain email address")
+		} else if err := s.checkUnique(ctx, errs, "email", "is already in use",
+			"SELECT 1 FROM users WHERE LOWER(email) = LOWER($1) AND id <> $2", u.Email, u.ID); err != nil {
+			return nil, err
+		}
+	}
+	if u.UnitID == "" {
+		errs.add("unitID", "is required")
+	} else if err := s.checkExists(ctx, errs, "unitID", "unit does not exist",
+		"SELECT 1 FROM unit WHERE name = $1", u.UnitID); err != nil {
+		return nil, err
+	}
+	return errs, nil
+}
+
+// Only an Admin creates, changes or deletes users, since the body decides
+// their role.
 func (s *Server) CreateUser(w http.ResponseWriter, r *http.Request) {
+	if _, ok := s.requireRole(w, r, Admin); !ok {
+		return
+	}
+
 	// Decode the user data from the request body
 	var user User
 	if err := json.NewDecoder(r.Body).Decode(&user); err != nil {
@@ -63,16 +199,11 @@ func (s *Server) CreateUser(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Prepare the SQL query with RETURNING to get the generated ID
-	query := `
-        INSERT INTO users (name, unit_id, role_id, password)
-        VALUES ($1, $2, $3, $4)
-        RETURNING id
-    `
+	if !s.validate(w, r, user) {
+		return
+	}
 
-	// Execute the query and retrieve the generated ID
-	// var id int
-	err := s.DB.QueryRow(query, user.Name, user.UnitID, user.RoleID, user.Password).Scan(&user.ID)
+	user, err := s.Users.Create(r.Context(), user)
 	if err != nil {
 		http.Error(w, "Failed to create user", http.StatusInternalServerError)
 		log.Println("Insert error:", err)
@@ -93,23 +224,29 @@ func (s *Server) GetUser(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Invalid ID", http.StatusBadRequest)
 		return
 	}
-	var user User
-	err = s.DB.QueryRow("SELECT * FROM users WHERE id = $1", id).Scan(
-		&user.ID,
-		&user.Name,
-		&user.UnitID,
-		&user.RoleID,
-		&user.Password,
-	)
+	v, ok := s.optionalViewerOf(w, r)
+	if !ok {
+		return
+	}
+	user, err := s.Users.Get(r.Context(), id)
 	if err != nil {
-		http.Error(w, "User not found", http.StatusNotFound)
+		writeStoreError(w, err, "User not found")
 		return
 	}
+	v.redactUser(&user)
+	env := envelopeOf(r)
+	env.link("expenseRequests", "/expense_requests?userID="+idStr)
+	env.link("sessions", "/users/"+idStr+"/sessions")
+	setVersionETag(w, user.Version)
 	w.Header().Set("Content-Type", "application/json; charset=utf-8")
 	json.NewEncoder(w).Encode(user)
 }
 
 func (s *Server) UpdateUser(w http.ResponseWriter, r *http.Request) {
+	if _, ok := s.requireRole(w, r, Admin); !ok {
+		return
+	}
+
 	vars := mux.Vars(r)
 	idStr := vars["id"]
 	id, err := strconv.Atoi(idStr)
@@ -118,6 +255,11 @@ func (s *Server) UpdateUser(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	versions, ok := ifMatchVersions(w, r)
+	if !ok {
+		return
+	}
+
 	var user User
 
 	// Decode JSON body into user
@@ -126,46 +268,44 @@ func (s *Server) UpdateUser(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Ensure ID is valid
-	if id == 0 {
-		http.Error(w, "Missing or invalid ID", http.StatusBadRequest)
+	// The path decides which user is updated, not the body
+	user.ID = id
+	if !s.validate(w, r, user) {
 		return
 	}
 
-	// Check if user exists before update
-	var exists bool
-	err = s.DB.QueryRow("SELECT EXISTS(SELECT 1 FROM users WHERE id = $1)", id).Scan(&exists)
-	if err != nil {
-		log.Printf("DB error checking user existence: %v", err)
-		http.Error(w, "Database error", http.StatusInternalServerError)
-		return
-	}
-	if !exists {
-		http.Error(w, "User not found", http.StatusNotFound)
+	// Ensure ID is valid
+	if id == 0 {
+		http.Error(w, "Missing or invalid ID", http.StatusBadRequest)
 		return
 	}
 
-	// Prepare the SQL UPDATE statement
-	query := `
-		UPDATE users
-		SET name = $1, unit_id = $2, role_id = $3, password = $4
-		WHERE id = $5
-	`
-	_, err = s.DB.Exec(query, user.Name, user.UnitID, user.RoleID, user.Password, id)
+	user, err = s.Users.Update(r.Context(), user, versions)
 	if err != nil {
-		log.Printf("DB update error: %v", err)
-		http.Error(w, "Database error", http.StatusInternalServerError)
+		writeStoreError(w, err, "User not found")
 		return
 	}
-	user.ID = id
 	// Respond with updated user
+	setVersionETag(w, user.Version)
 	w.Header().Set("Content-Type", "application/json; charset=utf-8")
 	if err := json.NewEncoder(w).Encode(user); err != nil {
 		log.Printf("JSON encoding error: %v", err)
 	}
 }
 
-func (s *Server) DeleteUser(w http.ResponseWriter, r *http.Request) {
+var userPatchFields = map[string]patchField{
+	"name":     patchAs[string]("name"),
+	"unitID":   patchAs[string]("unit_id"),
+	"roleID":   patchAs[UserRole]("role_id"),
+	"password": patchPassword("password"),
+	"email":    patchAs[string]("email"),
+}
+
+func (s *Server) PatchUser(w http.ResponseWriter, r *http.Request) {
+	if _, ok := s.requireRole(w, r, Admin); !ok {
+		return
+	}
+
 	vars := mux.Vars(r)
 	idStr := vars["id"]
 	id, err := strconv.Atoi(idStr)
@@ -174,25 +314,56 @@ func (s *Server) DeleteUser(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Perform the DELETE query
-	result, err := s.DB.Exec("DELETE FROM users WHERE id = $1", id)
+	versions, ok := ifMatchVersions(w, r)
+	if !ok {
+		return
+	}
+
+	// Decode only the fields the client sent
+	var fields map[string]json.RawMessage
+	if err := json.NewDecoder(r.Body).Decode(&fields); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+
+	set, args, err := buildPatch(fields, userPatchFields)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if !s.validatePatch(w, r, fields, &User{ID: id}) {
+		return
+	}
+
+	user, err := s.Users.Patch(r.Context(), id, Patch{Set: set, Args: args}, versions)
 	if err != nil {
-		http.Error(w, "Failed to delete user", http.StatusInternalServerError)
-		log.Println("Delete error:", err)
+		writeStoreError(w, err, "User not found")
+		return
+	}
+
+	setVersionETag(w, user.Version)
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	if err := json.NewEncoder(w).Encode(user); err != nil {
+		log.Printf("JSON encoding error: %v", err)
+	}
+}
+
+func (s *Server) DeleteUser(w http.ResponseWriter, r *http.Request) {
+	if _, ok := s.requireRole(w, r, Admin); !ok {
 		return
 	}
 
-	// Check if any rows were affected (i.e., if the user exists)
-	rowsAffected, err := result.RowsAffected()
+	vars := mux.Vars(r)
+	idStr := vars["id"]
+	id, err := strconv.Atoi(idStr)
 	if err != nil {
-		http.Error(w, "Error checking affected rows", http.StatusInternalServerError)
-		log.Println("Rows affected error:", err)
+		http.Error(w, "Invalid ID", http.StatusBadRequest)
 		return
 	}
 
-	// If no rows were affected, return 404 (User not found)
-	if rowsAffected == 0 {
-		http.Error(w, "User not found", http.StatusNotFound)
+	if err := s.Users.Delete(r.Context(), id); err != nil {
+		writeStoreError(w, err, "User not found")
 		return
 	}
 
@@ -206,55 +377,40 @@ func (s *Server) ListUsers(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	filters := []string{}
-	args := []interface{}{}
-	idx := 1
-
-	// Optional query parameters
-	if unitID := r.URL.Query().Get("unit_id"); unitID != "" {
-		filters = append(filters, "unit_id = $"+strconv.Itoa(idx))
-		args = append(args, unitID)
-		idx++
-	}
-	if roleID := r.URL.Query().Get("role_id"); roleID != "" {
-		filters = append(filters, "role_id = $"+strconv.Itoa(idx))
-		args = append(args, roleID)
-		idx++
+	opts, ok := listOptions(w, r, userSortable)
+	if !ok {
+		return
 	}
-	if name := r.URL.Query().Get("name"); name != "" {
-		filters = append(filters, "name ILIKE $"+strconv.Itoa(idx)) // Case-insensitive search
-		args = append(args, "%"+name+"%")
-		idx++
+	v, ok := s.optionalViewerOf(w, r)
+	if !ok {
+		return
 	}
 
-	query := "SELECT id, name, unit_id, role_id, password FROM users"
-	if len(filters) > 0 {
-		query += " WHERE " + strings.Join(filters, " AND ")
+	// Optional query parameters
+	params := r.URL.Query()
+	filter := UserFilter{
+		UnitID:      params.Get("unitID"),
+		RoleID:      params.Get("roleID"),
+		Name:        params.Get("name"),
+		ListOptions: opts,
 	}
-
-	rows, err := s.DB.Query(query, args...)
+	allUsers, err := s.Users.List(r.Context(), filter)
 	if err != nil {
 		http.Error(w, "Database query failed", http.StatusInternalServerError)
 		log.Println("ListUsers query error:", err)
 		return
 	}
-	defer rows.Close()
-
-	var allUsers []User
-	for rows.Next() {
-		var u User
-		if err := rows.Scan(&u.ID, &u.Name, &u.UnitID, &u.RoleID, &u.Password); err != nil {
-			http.Error(w, "Failed to scan user", http.StatusInternalServerError)
-			log.Println("Row scan error:", err)
+	for i := range allUsers {
+		v.redactUser(&allUsers[i])
+	}
+	if env := envelopeOf(r); env != nil {
+		total, err := s.Users.Count(r.Context(), filter)
+		if err != nil {
+			http.Error(w, "Database query failed", http.StatusInternalServerError)
+			log.Println("ListUsers count error:", err)
 			return
 		}
-		allUsers = append(allUsers, u)
-	}
-
-	if err := rows.Err(); err != nil {
-		http.Error(w, "Row iteration error", http.StatusInternalServerError)
-		log.Println("Row iteration error:", err)
-		return
+		env.page(opts, total)
 	}
 
 	w.Header().Set("Content-Type", "application/json; charset=utf-8")
@@ -0,0 +1,346 @@
+package server
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"main/money"
+	"main/query"
+	"net/http"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/lib/pq"
+)
+
+// Periods a user limit counts spending over.
+const (
+	LimitMonth   = "month"
+	LimitQuarter = "quarter"
+	LimitYear    = "year"
+)
+
+var limitPeriods = []string{LimitMonth, LimitQuarter, LimitYear}
+
+// UserLimit caps what one user, or each holder of a role, may request in a
+// category, or in all categories, per calendar period. MaxAmount is in the
+// base currency. A request that takes its requester over the limit needs
+// the Escalation approver on top of its usual chain; without one it is
+// refused. A user's own limit replaces their role's for the same category
+// and period.
+type UserLimit struct {
+	ID         int          `json:"id,omitempty"`
+	UserID     *int         `json:"userID,omitempty"`
+	Role       UserRole     `json:"role,omitempty"`
+	Category   string       `json:"category"` // every category when empty
+	Period     string       `json:"period"`   // month, quarter or year
+	MaxAmount  money.Amount `json:"maxAmount"`
+	Escalation string       `json:"escalation"` // unitManager, unit:<unit> or role:<role>
+	CreatedAt  *time.Time   `json:"createdAt,omitempty"`
+}
+
+func (UserLimit) CreateTableIfNotExists(s *Server) {
+	query := `CREATE TABLE IF NOT EXISTS user_limit (
+		id SERIAL PRIMARY KEY,
+		user_id INT REFERENCES users (id) ON DELETE CASCADE,
+		role VARCHAR(64) NOT NULL DEFAULT '',
+		category VARCHAR(256) NOT NULL DEFAULT '',
+		period VARCHAR(16) NOT NULL CHECK (period IN ('month', 'quarter', 'year')),
+		max_amount NUMERIC(15,2) NOT NULL,
+		escalation VARCHAR(300) NOT NULL DEFAULT '',
+		created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+		CHECK ((user_id IS NULL) <> (role = ''))
+	);
+	CREATE INDEX IF NOT EXISTS user_limit_user_idx ON user_limit (user_id);
+	CREATE INDEX IF NOT EXISTS user_limit_role_idx ON user_limit (role) WHERE role <> ''`
+
+	_, err := s.DB.Exec(query)
+
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	widenAmountColumns(s, "user_limit", "max_amount")
+}
+
+func userLimitFields(l *UserLimit) []query.Field {
+	return []query.Field{
+		{Column: "id", Target: &l.ID},
+		{Column: "user_id", Target: &l.UserID},
+		{Column: "role", Target: &l.Role},
+		{Column: "category", Target: &l.Category},
+		{Column: "period", Target: &l.Period},
+		{Column: "max_amount", Target: &l.MaxAmount},
+		{Column: "escalation", Target: &l.Escalation},
+		{Column: "created_at", Target: &l.CreatedAt},
+	}
+}
+
+var userLimitColumns = query.Columns(userLimitFields(&UserLimit{}))
+
+func scanUserLimit(row rowScanner) (UserLimit, error) {
+	var l UserLimit
+	err := row.Scan(query.Targets(userLimitFields(&l))...)
+	return l, err
+}
+
+func (l UserLimit) Validate(ctx context.Context, s *Server) (FieldErrors, error) {
+	errs := FieldErrors{}
+	switch {
+	case l.UserID == nil && l.Role == "":
+		errs.add("userID", "userID or role is required")
+	case l.UserID != nil && l.Role != "":
+		errs.add("role", "cannot be combined with userID")
+	case l.UserID != nil:
+		if err := s.checkExists(ctx, errs, "userID", "user does not exist",
+			"SELECT 1 FROM users WHERE id = $1", *l.UserID); err != nil {
+			return nil, err
+		}
+	case !l.Role.IsValid():
+		errs.add("role", "must be a known role")
+	}
+	if l.Category != "" {
+		if err := s.checkExists(ctx, errs, "category", "category does not exist",
+			"SELECT 1 FROM expense_category WHERE name = $1", l.Category); err != nil {
+			return nil, err
+		}
+	}
+	if !slices.Contains(limitPeriods, l.Period) {
+		errs.add("period", "must be month, quarter or year")
+	}
+	if l.MaxAmount <= 0 || l.MaxAmount > money.Max {
+		errs.add("maxAmount", "must be greater than 0 and at most "+money.Max.String())
+	}
+	if l.Escalation != "" {
+		if err := s.checkApprover(ctx, errs, "escalation", l.Escalation); err != nil {
+			return nil, err
+		}
+	}
+	return errs, nil
+}
+
+// applicableLimits is a lateral subquery over the limits of the user user
+// for requests charged to categories, both SQL expressions, the second an
+// array as chargedCategories builds: per category and period, the user's
+// own limit or else the lowest of their role's.
+func applicableLimits(user, categories string) string {
+	return fmt.Sprintf(`(
+		SELECT DISTINCT ON (ul.category, ul.period) ul.id, ul.category, ul.period, ul.max_amount, ul.escalation
+		FROM user_limit ul, users lu
+		WHERE lu.id = %[1]s
+			AND (ul.user_id = lu.id OR (ul.user_id IS NULL AND ul.role = lu.role_id))
+			AND (ul.category = '' OR ul.category = ANY(%[2]s))
+		ORDER BY ul.category, ul.period, ul.user_id NULLS LAST, ul.max_amount
+	) l`, user, categories)
+}
+
+// limitSpent is the SQL expression for what user requested in the limit
+// l's category and period around the time at, in the base currency, over
+// the requests that also meet condition. Requests with lines count what
+// their lines in the category add up to. Rejected and withdrawn requests
+// and drafts do not count, and amounts with no known exchange rate count
+// as they are.
+// excluded is the placeholder of those states' spellings.
+func (s *Server) limitSpent(user, at, condition, excluded string) string {
+	charged := chargedAmount("o.id", "o.category", "o.amount", "l.category")
+	return fmt.Sprintf(`(
+		SELECT COALESCE(SUM(COALESCE(%[5]s, %[6]s)), 0)
+		FROM expense_request o
+		WHERE o.user_id = %[1]s
+			AND (l.category = '' OR o.category = l.category
+				OR EXISTS (SELECT 1 FROM expense_line el WHERE el.expense_id = o.id AND el.category = l.category))
+			AND date_trunc(l.period, o.created_at) = date_trunc(l.period, %[2]s)
+			AND %[3]s
+			AND COALESCE((
+				SELECT ea.current_state FROM expense_activity ea
+				WHERE ea.expense_id = o.id
+				ORDER BY ea.created_at DESC, ea.id DESC
+				LIMIT 1
+			), '') <> ALL(%[4]s)
+	)`, user, at, condition, excluded, s.inBaseCurrency(charged, "o.currency", "o.created_at::date"), charged)
+}
+
+// checkUserLimits adds a field error when a new request would take its
+// requester over a limit that has no escalation approver. Limits with one
+// add their approver to the request's chain instead; see limitEscalations.
+// A request with lines counts them against the limits of their categories.
+func (s *Server) checkUserLimits(ctx context.Context, errs FieldErrors, e ExpenseRequest) error {
+	charged := chargedAmount("$6::int", "$2::text", "$3::numeric", "l.category")
+	rows, err := s.DB.QueryContext(ctx, `
+		SELECT l.category, l.period, l.max_amount,
+			`+s.limitSpent("$1", "LOCALTIMESTAMP", "TRUE", "$5")+`,
+			COALESCE(`+s.inBaseCurrency(charged, "$4::text", "CURRENT_DATE")+`, `+charged+`)
+		FROM `+applicableLimits("$1", chargedCategories("$6::int", "$2::text"))+`
+		WHERE l.escalation = ''
+		ORDER BY l.max_amount
+	`, e.UserID, e.Category, e.Amount, e.Currency, pq.Array(stateSpellings(Rejected, Withdrawn, Draft)), e.ID)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	round := s.conversionRounding(ctx).Round
+	for rows.Next() {
+		var category, period string
+		var limit, spent, amount money.Amount
+		if err := rows.Scan(&category, &period, &limit, &spent, &amount); err != nil {
+			return err
+		}
+		if spent+amount > limit {
+			if category == "" {
+				category = "all categories"
+			}
+			errs.add("amount", fmt.Sprintf("would take the requester over their limit of %s %s per %s for %s, with %s requested so far",
+				limit, s.BaseCurrency, period, category, round(spent)))
+			break
+		}
+	}
+	return rows.Err()
+}
+
+// limitEscalations returns the escalation approvers the given requests need
+// because each took its requester over a limit. A request only counts the
+// requests of the period submitted before it, so later ones do not change
+// its chain.
+func (s *Server) limitEscalations(ctx context.Context, db dbtx, ids []int) (map[int][]string, error) {
+	rows, err := db.QueryContext(ctx, `
+		SELECT er.id, l.escalation
+		FROM expense_request er
+		CROSS JOIN LATERAL `+applicableLimits("er.user_id", chargedCategories("er.id", "er.category"))+`
+		WHERE er.id = ANY($1) AND l.escalation <> ''
+			AND `+s.limitSpent("er.user_id", "er.created_at", "o.id <= er.id", "$2")+` > l.max_amount
+		ORDER BY er.id, l.id
+	`, pq.Array(ids), pq.Array(stateSpellings(Rejected, Withdrawn, Draft)))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	escalations := map[int][]string{}
+	for rows.Next() {
+		var id int
+		var approver string
+		if err := rows.Scan(&id, &approver); err != nil {
+			return nil, err
+		}
+		if !slices.Contains(escalations[id], approver) {
+			escalations[id] = append(escalations[id], approver)
+		}
+	}
+	return escalations, rows.Err()
+}
+
+// ListUserLimits returns the spending limits, those of one user or role
+// with ?userID= or ?role=.
+func (s *Server) ListUserLimits(w http.ResponseWriter, r *http.Request) {
+	if _, ok := s.requireCaller(w, r); !ok {
+		return
+	}
+
+	queryParams := r.URL.Query()
+	q := query.From("user_limit", userLimitColumns).
+		WhereIf(queryParams.Get("role") != "", "role = ?", queryParams.Get("role"))
+	if userID := queryParams.Get("userID"); userID != "" {
+		id, err := strconv.Atoi(userID)
+		if err != nil {
+			http.Error(w, "Invalid userID parameter", http.StatusBadRequest)
+			return
+		}
+		q.Where("user_id = ?", id)
+	}
+	statement, args := q.OrderBy("user_id NULLS FIRST", "role", "category", "period", "id").SQL()
+
+	rows, err := s.DB.QueryContext(r.Context(), statement, args...)
+	if err != nil {
+		log.Println("ListUserLimits query error:", err)
+		http.Error(w, "Database query failed", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	limits := []UserLimit{}
+	for rows.Next() {
+		l, err := scanUserLimit(rows)
+		if err != nil {
+			log.Println("Row scan error:", err)
+			http.Error(w, "Failed to scan user limit", http.StatusInternalServerError)
+			return
+		}
+		limits = append(limits, l)
+	}
+	if err := rows.Err(); err != nil {
+		log.Println("Row iteration error:", err)
+		http.Error(w, "Row iteration error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(limits)
+}
+
+func (s *Server) CreateUserLimit(w http.ResponseWriter, r *http.Request) {
+	caller, ok := s.requireRole(w, r, Admin)
+	if !ok {
+		return
+	}
+
+	var l UserLimit
+	if err := json.NewDecoder(r.Body).Decode(&l); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+	if !s.validate(w, r, l) {
+		return
+	}
+
+	l, err := scanUserLimit(s.DB.QueryRowContext(r.Context(), `
+		INSERT INTO user_limit (user_id, role, category, period, max_amount, escalation)
+		VALUES ($1, $2, $3, $4, $5, $6)
+		RETURNING `+userLimitColumns,
+		l.UserID, l.Role, l.Category, l.Period, l.MaxAmount, l.Escalation))
+	if err != nil {
+		log.Println("Insert user limit error:", err)
+		http.Error(w, "Failed to create user limit", http.StatusInternalServerError)
+		return
+	}
+	if err := audit(r.Context(), s.DB, caller.ID, "user_limits.create", l); err != nil {
+		log.Println("Audit error:", err)
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(l)
+}
+
+// DeleteUserLimit lifts a limit. Requests it escalated lose the extra
+// approval they still needed.
+func (s *Server) DeleteUserLimit(w http.ResponseWriter, r *http.Request) {
+	caller, ok := s.requireRole(w, r, Admin)
+	if !ok {
+		return
+	}
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid ID", http.StatusBadRequest)
+		return
+	}
+
+	l, err := scanUserLimit(s.DB.QueryRowContext(r.Context(),
+		"DELETE FROM user_limit WHERE id = $1 RETURNING "+userLimitColumns, id))
+	if err == sql.ErrNoRows {
+		http.Error(w, "User limit not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		log.Println("Delete user limit error:", err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	if err := audit(r.Context(), s.DB, caller.ID, "user_limits.delete", l); err != nil {
+		log.Println("Audit error:", err)
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,149 @@
+package server
+
+import (
+	"context"
+	"database/sql"
+	"main/query"
+
+	"github.com/lib/pq"
+)
+
+// UserFilter narrows ListUsers. Empty fields do not filter.
+type UserFilter struct {
+	UnitID string
+	RoleID string
+	Name   string // case-insensitive substring
+	ListOptions
+}
+
+// userSortable are the fields users can be sorted by.
+var userSortable = map[string]string{"id": "id", "name": "name", "unitID": "unit_id", "roleID": "role_id"}
+
+// UserStore reads and writes users. Writes that take versions only apply
+// to a row whose version is among them; nil versions match any.
+type UserStore interface {
+	Get(ctx context.Context, id int) (User, error)
+	List(ctx context.Context, filter UserFilter) ([]User, error)
+	// Count is how many users the filter matches, ignoring its paging
+	Count(ctx context.Context, filter UserFilter) (int, error)
+	Create(ctx context.Context, user User) (User, error)
+	Update(ctx context.Context, user User, versions []int64) (User, error)
+	Patch(ctx context.Context, id int, patch Patch, versions []int64) (User, error)
+	Delete(ctx context.Context, id int) error
+}
+
+// PostgresUserStore keeps users in the users table.
+type PostgresUserStore struct {
+	DB dbtx
+}
+
+const userVersionQuery = "SELECT version FROM users WHERE id = $1"
+
+func (p PostgresUserStore) Get(ctx context.Context, id int) (User, error) {
+	user, err := scanUser(p.DB.QueryRowContext(ctx, "SELECT "+userColumns+" FROM users WHERE id = $1", id))
+	if err == sql.ErrNoRows {
+		return user, errNotFound
+	}
+	return user, err
+}
+
+// filtered selects columns from the users filter matches.
+func (PostgresUserStore) filtered(columns string, filter UserFilter) *query.Select {
+	return query.From("users", columns).
+		WhereIf(filter.UnitID != "", "unit_id = ?", filter.UnitID).
+		WhereIf(filter.RoleID != "", "role_id = ?", filter.RoleID).
+		WhereIf(filter.Name != "", "name ILIKE ?", "%"+filter.Name+"%") // Case-insensitive search
+}
+
+func (p PostgresUserStore) List(ctx context.Context, filter UserFilter) ([]User, error) {
+	q := p.filtered(userColumns, filter).
+		OrderBy(filter.Sort...).OrderBy("id").
+		Page(filter.Limit, filter.Offset)
+	statement, args := q.SQL()
+
+	rows, err := p.DB.QueryContext(ctx, statement, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var users []User
+	for rows.Next() {
+		u, err := scanUser(rows)
+		if err != nil {
+			return nil, err
+		}
+		users = append(users, u)
+	}
+	return users, rows.Err()
+}
+
+func (p PostgresUserStore) Count(ctx context.Context, filter UserFilter) (int, error) {
+	statement, args := p.filtered("count(*)", filter).SQL()
+	var n int
+	err := p.DB.QueryRowContext(ctx, statement, args...).Scan(&n)
+	return n, err
+}
+
+// Create and Update store the user's password hashed and return the user
+// without it.
+func (p PostgresUserStore) Create(ctx context.Context, user User) (User, error) {
+	hash, err := hashPassword(user.Password)
+	if err != nil {
+		return user, err
+	}
+	user.Password = ""
+	query := `
+        INSERT INTO users (name, unit_id, role_id, password, email)
+        VALUES ($1, $2, $3, $4, $5)
+        RETURNING id, version
+    `
+	err = p.DB.QueryRowContext(ctx, query, user.Name, user.UnitID, user.RoleID, hash, user.Email).Scan(&user.ID, &user.Version)
+	return user, err
+}
+
+func (p PostgresUserStore) Update(ctx context.Context, user User, versions []int64) (User, error) {
+	hash, err := hashPassword(user.Password)
+	if err != nil {
+		return user, err
+	}
+	user.Password = ""
+	query := `
+		UPDATE users
+		SET name = $1, unit_id = $2, role_id = $3, password = $4, email = $5, version = version + 1
+		WHERE id = $6 AND ` + versionMatches("$7") + `
+		RETURNING version
+	`
+	err = p.DB.QueryRowContext(ctx, query, user.Name, user.UnitID, user.RoleID, hash, user.Email, user.ID, pq.Array(versions)).Scan(&user.Version)
+	if err == sql.ErrNoRows {
+		return user, versionMismatch(ctx, p.DB, userVersionQuery, user.ID)
+	}
+	return user, err
+}
+
+func (p PostgresUserStore) Patch(ctx context.Context, id int, patch Patch, versions []int64) (User, error) {
+	args := patch.Args
+	query := "UPDATE users SET " + patch.Set + ", version = version + 1 WHERE id = " + args.Add(id) +
+		" AND " + versionMatches(args.Add(pq.Array(versions))) + " RETURNING " + userColumns
+
+	user, err := scanUser(p.DB.QueryRowContext(ctx, query, args...))
+	if err == sql.ErrNoRows {
+		return user, versionMismatch(ctx, p.DB, userVersionQuery, id)
+	}
+	return user, err
+}
+
+func (p PostgresUserStore) Delete(ctx context.Context, id int) error {
+	result, err := p.DB.ExecContext(ctx, "DELETE FROM users WHERE id = $1", id)
+	if err != nil {
+		return err
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return errNotFound
+	}
+	return nil
+}
@@ -0,0 +1,130 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestCreateUser(t *testing.T) {
+	ts := newTestServer(t, []string{"Sales"}, nil)
+	_, adminToken := ts.addUser(t, "admin", "Sales", Admin)
+	_, personnelToken := ts.addUser(t, "personnel", "Sales", FieldPersonnel)
+	body := `{"name": "manager", "unitID": "Sales", "roleID": "Manager", "password": "manager-pw", "email": "manager@example.com"}`
+
+	if w := serve(ts.CreateUser, "POST", "/users", nil, "", body); w.Code != http.StatusUnauthorized {
+		t.Errorf("without a token: status = %d, want %d", w.Code, http.StatusUnauthorized)
+	}
+	if w := serve(ts.CreateUser, "POST", "/users", nil, personnelToken, body); w.Code != http.StatusForbidden {
+		t.Errorf("as Personnel: status = %d, want %d", w.Code, http.StatusForbidden)
+	}
+
+	w := serve(ts.CreateUser, "POST", "/users", nil, adminToken, body)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("status = %d, want %d: %s", w.Code, http.StatusCreated, w.Body)
+	}
+	if strings.Contains(w.Body.String(), "password") {
+		t.Errorf("the response carries the password: %s", w.Body)
+	}
+	var created User
+	if err := json.NewDecoder(w.Body).Decode(&created); err != nil {
+		t.Fatal(err)
+	}
+	want := User{ID: created.ID, Name: "manager", UnitID: "Sales", RoleID: Manager, Email: "manager@example.com", Version: 1}
+	if created.ID == 0 || created != want {
+		t.Errorf("created %+v, want %+v", created, want)
+	}
+
+	// The email is the user's own and the Admins' to see
+	anonymous := want
+	anonymous.Email = ""
+	for _, tc := range []struct {
+		name  string
+		token string
+		want  User
+	}{
+		{"without a token", "", anonymous},
+		{"as Personnel", personnelToken, anonymous},
+		{"as Admin", adminToken, want},
+	} {
+		w = serve(ts.GetUser, "GET", "/users/"+strconv.Itoa(created.ID), map[string]string{"id": strconv.Itoa(created.ID)}, tc.token, "")
+		if w.Code != http.StatusOK {
+			t.Fatalf("%s: get status = %d, want %d: %s", tc.name, w.Code, http.StatusOK, w.Body)
+		}
+		var got User
+		if err := json.NewDecoder(w.Body).Decode(&got); err != nil {
+			t.Fatal(err)
+		}
+		if got != tc.want {
+			t.Errorf("%s: got %+v, want %+v", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestCreateUserValidation(t *testing.T) {
+	ts := newTestServer(t, []string{"Sales"}, nil)
+	_, adminToken := ts.addUser(t, "admin", "Sales", Admin)
+
+	tests := []struct {
+		name string
+		body string
+		want FieldErrors
+	}{
+		{
+			name: "missing fields",
+			body: `{}`,
+			want: FieldErrors{
+				"name":     "is required",
+				"password": "is required",
+				"roleID":   "must be one of Admin, Personnel, Manager, Accountant",
+				"unitID":   "is required",
+			},
+		},
+		{
+			name: "invalid fields",
+			body: `{"name": "x", "unitID": "Nowhere", "roleID": "Boss", "email": "X <x@example.com>", "password": "` + strings.Repeat("p", 73) + `"}`,
+			want: FieldErrors{
+				"password": "must be at most 72 bytes",
+				"roleID":   "must be one of Admin, Personnel, Manager, Accountant",
+				"email":    "must be a plain email address",
+				"unitID":   "unit does not exist",
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := serve(ts.CreateUser, "POST", "/users", nil, adminToken, tt.body)
+			if w.Code != http.StatusUnprocessableEntity {
+				t.Fatalf("status = %d, want %d: %s", w.Code, http.StatusUnprocessableEntity, w.Body)
+			}
+			var body struct{ Errors FieldErrors }
+			if err := json.NewDecoder(w.Body).Decode(&body); err != nil {
+				t.Fatal(err)
+			}
+			if len(body.Errors) != len(tt.want) {
+				t.Errorf("errors = %v, want %v", body.Errors, tt.want)
+			}
+			for field, message := range tt.want {
+				if body.Errors[field] != message {
+					t.Errorf("errors[%s] = %q, want %q", field, body.Errors[field], message)
+				}
+			}
+		})
+	}
+	if n, _ := ts.users.Count(t.Context(), UserFilter{}); n != 1 {
+		t.Errorf("%d users stored, want only the Admin", n)
+	}
+}
+
+func TestGetUserNotFound(t *testing.T) {
+	ts := newTestServer(t, []string{"Sales"}, nil)
+
+	if w := serve(ts.GetUser, "GET", "/users/42", map[string]string{"id": "42"}, "", ""); w.Code != http.StatusNotFound {
+		t.Errorf("status = %d, want %d: %s", w.Code, http.StatusNotFound, w.Body)
+	}
+	if w := serve(ts.GetUser, "GET", "/users/me", map[string]string{"id": "me"}, "", ""); w.Code != http.StatusBadRequest {
+		t.Errorf("status = %d, want %d: %s", w.Code, http.StatusBadRequest, w.Body)
+	}
+}
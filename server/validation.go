@@ -0,0 +1,134 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"maps"
+	"net/http"
+	"slices"
+	"strings"
+)
+
+// FieldErrors maps a JSON field name to what is wrong with its value.
+type FieldErrors map[string]string
+
+// add records the first problem found for a field.
+func (e FieldErrors) add(field, message string) {
+	if _, ok := e[field]; !ok {
+		e[field] = message
+	}
+}
+
+// Error lists the problems by field, so FieldErrors can be returned where
+// an error is expected.
+func (e FieldErrors) Error() string {
+	fields := slices.Sorted(maps.Keys(e))
+	problems := make([]string, len(fields))
+	for i, field := range fields {
+		problems[i] = field + ": " + e[field]
+	}
+	return strings.Join(problems, "; ")
+}
+
+// validator is implemented by every entity accepted in Create/Update bodies.
+// Validate may consult the database for referential checks.
+type validator interface {
+	Validate(ctx context.Context, s *Server) (FieldErrors, error)
+}
+
+// exists reports whether the given SELECT returns at least one row.
+func (s *Server) exists(ctx context.Context, query string, args ...any) (bool, error) {
+	var ok bool
+	err := s.DB.QueryRowContext(ctx, "SELECT EXISTS("+query+")", args...).Scan(&ok)
+	return ok, err
+}
+
+// checkExists adds a field error when the referenced row is missing.
+func (s *Server) checkExists(ctx context.Context, errs FieldErrors, field, message, query string, args ...any) error {
+	ok, err := s.exists(ctx, query, args...)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		errs.add(field, message)
+	}
+	return nil
+}
+
+// checkUnique adds a field error when a conflicting row already exists.
+func (s *Server) checkUnique(ctx context.Context, errs FieldErrors, field, message, query string, args ...any) error {
+	taken, err := s.exists(ctx, query, args...)
+	if err != nil {
+		return err
+	}
+	if taken {
+		errs.add(field, message)
+	}
+	return nil
+}
+
+func writeValidationErrors(w http.ResponseWriter, errs FieldErrors) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(http.StatusUnprocessableEntity)
+	json.NewEncoder(w).Encode(map[string]any{"errors": errs})
+}
+
+// checkValid runs v.Validate for operations that report problems as an
+// error: the FieldErrors when there are any.
+func (s *Server) checkValid(ctx context.Context, v validator) error {
+	errs, err := v.Validate(ctx, s)
+	if err != nil {
+		return err
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// validate runs v.Validate and writes a 422 with per-field errors when it
+// fails. It returns false when the handler should stop.
+func (s *Server) validate(w http.ResponseWriter, r *http.Request, v validator) bool {
+	errs, err := v.Validate(r.Context(), s)
+	if err != nil {
+		log.Println("Validation query error:", err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return false
+	}
+	if len(errs) > 0 {
+		writeValidationErrors(w, errs)
+		return false
+	}
+	return true
+}
+
+// validatePatch applies the PATCH body to an empty entity and validates only
+// the fields the client actually sent.
+func (s *Server) validatePatch(w http.ResponseWriter, r *http.Request, fields map[string]json.RawMessage, v validator) bool {
+	body, err := json.Marshal(fields)
+	if err == nil {
+		err = json.Unmarshal(body, v)
+	}
+	if err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return false
+	}
+
+	errs, err := v.Validate(r.Context(), s)
+	if err != nil {
+		log.Println("Validation query error:", err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return false
+	}
+	for field := range errs {
+		if _, ok := fields[field]; !ok {
+			delete(errs, field)
+		}
+	}
+	if len(errs) > 0 {
+		writeValidationErrors(w, errs)
+		return false
+	}
+	return true
+}
@@ -0,0 +1,327 @@
+package server
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"log"
+	"main/bankfile"
+	"main/query"
+	"net/http"
+	"net/mail"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Vendor is an external supplier an expense request may be paid to instead
+// of its requester.
+type Vendor struct {
+	ID           int        `json:"id,omitempty"`
+	Name         string     `json:"name"`
+	TaxNumber    string     `json:"taxNumber"` // unique when set
+	IBAN         string     `json:"iban"`      // required to pay the vendor by bank file
+	BIC          string     `json:"bic"`
+	ContactName  string     `json:"contactName"`
+	ContactEmail string     `json:"contactEmail"`
+	ContactPhone string     `json:"contactPhone"`
+	CreatedAt    *time.Time `json:"createdAt,omitempty"`
+}
+
+func (Vendor) CreateTableIfNotExists(s *Server) {
+	query := `CREATE TABLE IF NOT EXISTS vendor (
+		id SERIAL PRIMARY KEY,
+		name VARCHAR(140) NOT NULL,
+		tax_number VARCHAR(32) NOT NULL DEFAULT '',
+		iban TEXT NOT NULL DEFAULT '',
+		bic VARCHAR(11) NOT NULL DEFAULT '',
+		contact_name VARCHAR(140) NOT NULL DEFAULT '',
+		contact_email VARCHAR(256) NOT NULL DEFAULT '',
+		contact_phone VARCHAR(32) NOT NULL DEFAULT '',
+		created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+	);
+	CREATE UNIQUE INDEX IF NOT EXISTS vendor_tax_number_key ON vendor (tax_number) WHERE tax_number <> ''`
+
+	_, err := s.DB.Exec(query)
+
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// vendorFields binds the vendor columns to the fields of v, the IBAN as it
+// is stored to iban.
+func vendorFields(v *Vendor, iban *string) []query.Field {
+	return []query.Field{
+		{Column: "id", Target: &v.ID},
+		{Column: "name", Target: &v.Name},
+		{Column: "tax_number", Target: &v.TaxNumber},
+		{Column: "iban", Target: iban},
+		{Column: "bic", Target: &v.BIC},
+		{Column: "contact_name", Target: &v.ContactName},
+		{Column: "contact_email", Target: &v.ContactEmail},
+		{Column: "contact_phone", Target: &v.ContactPhone},
+		{Column: "created_at", Target: &v.CreatedAt},
+	}
+}
+
+var vendorColumns = query.Columns(vendorFields(&Vendor{}, nil))
+
+// scanVendor scans a vendor selected with vendorColumns, opening its IBAN
+// once its ID is known.
+func (s *Server) scanVendor(row rowScanner) (Vendor, error) {
+	var v Vendor
+	var iban string
+	if err := row.Scan(query.Targets(vendorFields(&v, &iban))...); err != nil {
+		return v, err
+	}
+	var err error
+	v.IBAN, err = s.FieldKeys.DecryptString(vendorIBAN.field(v.ID), iban)
+	return v, err
+}
+
+func (v Vendor) Validate(ctx context.Context, s *Server) (FieldErrors, error) {
+	errs := FieldErrors{}
+	switch {
+	case strings.TrimSpace(v.Name) == "":
+		errs.add("name", "is required")
+	case len(v.Name) > 140:
+		errs.add("name", "must be at most 140 characters")
+	}
+	if len(v.TaxNumber) > 32 {
+		errs.add("taxNumber", "must be at most 32 characters")
+	} else if v.TaxNumber != "" {
+		if err := s.checkUnique(ctx, errs, "taxNumber", "is already used by another vendor",
+			"SELECT 1 FROM vendor WHERE tax_number = $1 AND id <> $2", v.TaxNumber, v.ID); err != nil {
+			return nil, err
+		}
+	}
+	if v.IBAN != "" && !bankfile.ValidIBAN(v.IBAN) {
+		errs.add("iban", "is not a valid IBAN")
+	}
+	if v.BIC != "" && !bankfile.ValidBIC(v.BIC) {
+		errs.add("bic", "must be an 8 or 11 character BIC")
+	}
+	if len(v.ContactName) > 140 {
+		errs.add("contactName", "must be at most 140 characters")
+	}
+	if v.ContactEmail != "" {
+		if addr, err := mail.ParseAddress(v.ContactEmail); err != nil || addr.Address != v.ContactEmail {
+			errs.add("contactEmail", "must be a plain email address")
+		}
+	}
+	if len(v.ContactPhone) > 32 {
+		errs.add("contactPhone", "must be at most 32 characters")
+	}
+	return errs, nil
+}
+
+// decodeVendor reads a vendor from the request body with its account
+// numbers in the form they are stored in.
+func decodeVendor(w http.ResponseWriter, r *http.Request) (Vendor, bool) {
+	var v Vendor
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&v); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return v, false
+	}
+	v.IBAN = bankfile.NormalizeIBAN(v.IBAN)
+	v.BIC = strings.ToUpper(strings.TrimSpace(v.BIC))
+	return v, true
+}
+
+func vendorID(w http.ResponseWriter, r *http.Request) (int, bool) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid ID", http.StatusBadRequest)
+		return 0, false
+	}
+	return id, true
+}
+
+func (s *Server) ListVendors(w http.ResponseWriter, r *http.Request) {
+	if _, ok := s.requireCaller(w, r); !ok {
+		return
+	}
+
+	q := "SELECT " + vendorColumns + " FROM vendor"
+	var args []any
+	if name := r.URL.Query().Get("name"); name != "" {
+		q += " WHERE name ILIKE $1"
+		args = append(args, "%"+name+"%")
+	}
+	rows, err := s.DB.QueryContext(r.Context(), q+" ORDER BY name, id", args...)
+	if err != nil {
+		log.Println("Vendor query error:", err)
+		http.Error(w, "Database query failed", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	vendors := []Vendor{}
+	for rows.Next() {
+		v, err := s.scanVendor(rows)
+		if err != nil {
+			log.Println("Row scan error:", err)
+			http.Error(w, "Failed to scan vendor", http.StatusInternalServerError)
+			return
+		}
+		vendors = append(vendors, v)
+	}
+	if err := rows.Err(); err != nil {
+		log.Println("Row iteration error:", err)
+		http.Error(w, "Row iteration error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(vendors)
+}
+
+func (s *Server) CreateVendor(w http.ResponseWriter, r *http.Request) {
+	caller, ok := s.requireRole(w, r, Accounter, Admin)
+	if !ok {
+		return
+	}
+	v, ok := decodeVendor(w, r)
+	if !ok {
+		return
+	}
+	v.ID = 0
+	if !s.validate(w, r, v) {
+		return
+	}
+
+	// The IBAN is sealed for the vendor's row, so its ID comes first
+	var err error
+	if v.ID, err = nextID(r.Context(), s.DB, "vendor"); err != nil {
+		log.Println("Vendor ID error:", err)
+		http.Error(w, "Failed to create vendor", http.StatusInternalServerError)
+		return
+	}
+	err = s.DB.QueryRowContext(r.Context(), `
+		INSERT INTO vendor (id, name, tax_number, iban, bic, contact_name, contact_email, contact_phone)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+		RETURNING created_at
+	`, v.ID, v.Name, v.TaxNumber, s.FieldKeys.Seal(vendorIBAN.field(v.ID), v.IBAN), v.BIC, v.ContactName, v.ContactEmail, v.ContactPhone).Scan(&v.CreatedAt)
+	if err != nil {
+		log.Println("Insert vendor error:", err)
+		http.Error(w, "Failed to create vendor", http.StatusInternalServerError)
+		return
+	}
+	if err := audit(r.Context(), s.DB, caller.ID, "vendors.create", map[string]any{"id": v.ID, "name": v.Name}); err != nil {
+		log.Println("Audit error:", err)
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(v)
+}
+
+func (s *Server) GetVendor(w http.ResponseWriter, r *http.Request) {
+	if _, ok := s.requireCaller(w, r); !ok {
+		return
+	}
+	id, ok := vendorID(w, r)
+	if !ok {
+		return
+	}
+
+	v, err := s.scanVendor(s.DB.QueryRowContext(r.Context(), "SELECT "+vendorColumns+" FROM vendor WHERE id = $1", id))
+	if err == sql.ErrNoRows {
+		http.Error(w, "Vendor not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		log.Println("Vendor query error:", err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(v)
+}
+
+// UpdateVendor replaces a vendor. Requests already paid keep the payments
+// made to its old account.
+func (s *Server) UpdateVendor(w http.ResponseWriter, r *http.Request) {
+	caller, ok := s.requireRole(w, r, Accounter, Admin)
+	if !ok {
+		return
+	}
+	id, ok := vendorID(w, r)
+	if !ok {
+		return
+	}
+	v, ok := decodeVendor(w, r)
+	if !ok {
+		return
+	}
+	v.ID = id
+	if !s.validate(w, r, v) {
+		return
+	}
+
+	err := s.DB.QueryRowContext(r.Context(), `
+		UPDATE vendor
+		SET name = $1, tax_number = $2, iban = $3, bic = $4, contact_name = $5, contact_email = $6, contact_phone = $7
+		WHERE id = $8
+		RETURNING created_at
+	`, v.Name, v.TaxNumber, s.FieldKeys.Seal(vendorIBAN.field(v.ID), v.IBAN), v.BIC, v.ContactName, v.ContactEmail, v.ContactPhone, v.ID).Scan(&v.CreatedAt)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Vendor not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		log.Println("Update vendor error:", err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	// As with bank accounts, the audit trail does not keep the account
+	detail := map[string]any{"id": v.ID, "name": v.Name, "iban": maskIBAN(v.IBAN)}
+	if err := audit(r.Context(), s.DB, caller.ID, "vendors.update", detail); err != nil {
+		log.Println("Audit error:", err)
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(v)
+}
+
+// DeleteVendor removes a vendor no expense request refers to.
+func (s *Server) DeleteVendor(w http.ResponseWriter, r *http.Request) {
+	caller, ok := s.requireRole(w, r, Accounter, Admin)
+	if !ok {
+		return
+	}
+	id, ok := vendorID(w, r)
+	if !ok {
+		return
+	}
+
+	referenced, err := s.exists(r.Context(), "SELECT 1 FROM expense_request WHERE vendor_id = $1", id)
+	if err != nil {
+		log.Println("Vendor reference query error:", err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	if referenced {
+		http.Error(w, "Vendor is referenced by expense requests", http.StatusConflict)
+		return
+	}
+
+	var name string
+	err = s.DB.QueryRowContext(r.Context(), "DELETE FROM vendor WHERE id = $1 RETURNING name", id).Scan(&name)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Vendor not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		log.Println("Delete vendor error:", err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	if err := audit(r.Context(), s.DB, caller.ID, "vendors.delete", map[string]any{"id": id, "name": name}); err != nil {
+		log.Println("Audit error:", err)
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,268 @@
+package server
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"log"
+	"main/query"
+	"net/http"
+	"slices"
+
+	"github.com/lib/pq"
+)
+
+// Some fields are too close to pay to show to everyone. A fieldRule names
+// the roles that may see such a field on any row; everyone else only sees it
+// on their own rows. Rules are applied where rows are read, so every handler
+// reading the same entity hides the same fields.
+type fieldRule struct {
+	Field string // JSON name
+	Roles []UserRole
+}
+
+var expenseRequestFieldRules = []fieldRule{
+	{Field: "amount", Roles: []UserRole{Manager, Accounter, Admin}},
+}
+
+// Users' email addresses are for Admins, and for the users themselves.
+var userFieldRules = []fieldRule{
+	{Field: "email", Roles: []UserRole{Admin}},
+}
+
+// viewer is who a response is for. The zero viewer sees none of the
+// restricted fields and none of the scoped rows.
+type viewer struct {
+	user      *User
+	delegated []string // units whose approvals the user holds by delegation
+}
+
+// viewerOf identifies the caller of a read endpoint. Which rows a caller
+// may read depends on who they are, so requests without a token are a 401.
+func (s *Server) viewerOf(w http.ResponseWriter, r *http.Request) (viewer, bool) {
+	user, ok := s.requireCaller(w, r)
+	if !ok {
+		return viewer{}, false
+	}
+	delegated, err := delegatedUnits(r.Context(), s.DB, user.ID)
+	if err != nil {
+		log.Println("Delegation lookup error:", err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return viewer{}, false
+	}
+	return viewer{user: &user, delegated: delegated}, true
+}
+
+// optionalViewerOf identifies the caller of a read endpoint open to
+// everyone. Without a valid token it is the zero viewer.
+func (s *Server) optionalViewerOf(w http.ResponseWriter, r *http.Request) (viewer, bool) {
+	user, err := s.authenticate(r)
+	if errors.Is(err, errUnauthorized) {
+		return viewer{}, true
+	} else if err != nil {
+		log.Println("Authentication error:", err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return viewer{}, false
+	}
+	return viewer{user: &user}, true
+}
+
+// hidden lists the fields of a row owned by ownerID the viewer may not see.
+func (v viewer) hidden(rules []fieldRule, ownerID int) []string {
+	var fields []string
+	for _, rule := range rules {
+		if v.user != nil && (v.user.ID == ownerID || slices.Contains(rule.Roles, v.user.RoleID)) {
+			continue
+		}
+		fields = append(fields, rule.Field)
+	}
+	return fields
+}
+
+// restricted reports whether field is hidden from the viewer on rows of other
+// users.
+func (v viewer) restricted(rules []fieldRule, field string) bool {
+	// No user has ID 0, so only the viewer's role counts
+	return slices.Contains(v.hidden(rules, 0), field)
+}
+
+// hiddenIn lists the fields of a row owned by ownerID in unit the viewer
+// may not see. Delegates see the rows of the units they decide on as the
+// unit's Managers do.
+func (v viewer) hiddenIn(rules []fieldRule, ownerID int, unit string) []string {
+	if v.user != nil && v.user.RoleID == FieldPersonnel && slices.Contains(v.delegated, unit) {
+		asManager := *v.user
+		asManager.RoleID = Manager
+		v.user = &asManager
+	}
+	return v.hidden(rules, ownerID)
+}
+
+// redactExpenseRequest leaves the fields of e the viewer may not see empty
+// and lists them in Hidden. ExpenseStore reads made through expensesAs are
+// already redacted.
+func (v viewer) redactExpenseRequest(e *ExpenseRequest) {
+	e.Hidden = v.hiddenIn(expenseRequestFieldRules, e.UserID, e.UnitID)
+	for _, field := range e.Hidden {
+		switch field {
+		case "amount":
+			e.Amount = 0
+			e.NetAmount, e.VATAmount = nil, nil
+		}
+	}
+}
+
+// redactUser leaves the fields of u the viewer may not see empty. Users
+// are compared by value, so unlike requests they do not list them.
+func (v viewer) redactUser(u *User) {
+	for _, field := range v.hidden(userFieldRules, u.ID) {
+		switch field {
+		case "email":
+			u.Email = ""
+		}
+	}
+}
+
+// What hangs off a request is redacted as the request is: payments and
+// lines lose their amounts, and payment activities their feedback, which
+// names the amount paid, wherever the request's amount is hidden.
+
+// expenseOwnerColumns selects the owner and unit of the expense request
+// whose ID is in column, for redacting what hangs off it. They are 0 and empty
+// once the request is gone.
+func expenseOwnerColumns(column string) string {
+	return "COALESCE((SELECT user_id FROM expense_request WHERE id = " + column + "), 0), " +
+		"COALESCE((SELECT unit_id FROM expense_request WHERE id = " + column + "), '')"
+}
+
+// hidesAmountOf reports whether the viewer may not see the amount of a
+// request owned by ownerID in unit.
+func (v viewer) hidesAmountOf(ownerID int, unit string) bool {
+	return slices.Contains(v.hiddenIn(expenseRequestFieldRules, ownerID, unit), "amount")
+}
+
+// redactPayment leaves the amounts of a payment on a request owned by
+// ownerID in unit empty when the viewer may not see the request's amount.
+func (v viewer) redactPayment(p *PaidExpense, ownerID int, unit string) {
+	if !v.hidesAmountOf(ownerID, unit) {
+		return
+	}
+	p.Amount = 0
+	p.BaseAmount, p.NetAmount, p.VATAmount = nil, nil, nil
+	p.Hidden = []string{"amount"}
+}
+
+// redactActivity leaves the feedback of a payment activity empty when the
+// request's amount is hidden.
+func redactActivity(a *ExpenseActivity, hidesAmount bool) {
+	if hidesAmount && (a.CurrentState == Paid || a.CurrentState == PartiallyPaid) {
+		a.Feedback = ""
+		a.Hidden = []string{"feedback"}
+	}
+}
+
+// Rows are scoped by role as well: Personnel read their own expense
+// requests, Managers those of their unit, and Accountants and Admins all of
+// them. Delegates also read the requests of the units they decide on.
+// Requests outside the scope are answered as if they did not exist.
+
+// expenseScope returns the scope of a viewer who may not read every
+// request, or nil.
+func (v viewer) expenseScope() *ExpenseScope {
+	switch {
+	case v.user == nil:
+		return &ExpenseScope{}
+	case v.user.RoleID == Accounter || v.user.RoleID == Admin:
+		return nil
+	}
+	scope := &ExpenseScope{UserID: v.user.ID, Units: slices.Clone(v.delegated)}
+	if v.user.RoleID == Manager {
+		scope.Units = append(scope.Units, v.user.UnitID)
+	}
+	return scope
+}
+
+// mayRead reports whether the expense request is in the viewer's scope.
+func (v viewer) mayRead(e ExpenseRequest) bool {
+	scope := v.expenseScope()
+	return scope == nil || e.UserID == scope.UserID || slices.Contains(scope.Units, e.UnitID)
+}
+
+// scopeByExpense keeps q to the rows whose expense request, the ID in
+// column, is in the viewer's scope, for what hangs off expense requests
+// such as their payments and activities.
+func (v viewer) scopeByExpense(q *query.Select, column string) {
+	if scope := v.expenseScope(); scope != nil {
+		q.Where(column+" IN (SELECT id FROM expense_request WHERE user_id = ? OR unit_id = ANY(?))",
+			scope.UserID, pq.Array(scope.Units))
+	}
+}
+
+// mayReadExpense reports whether expense request id is in the viewer's
+// scope. Requests that do not exist are outside of it unless the viewer
+// reads every request.
+func (s *Server) mayReadExpense(ctx context.Context, v viewer, id int) (bool, error) {
+	scope := v.expenseScope()
+	if scope == nil {
+		return true, nil
+	}
+	return s.exists(ctx, "SELECT 1 FROM expense_request WHERE id = $1 AND (user_id = $2 OR unit_id = ANY($3))",
+		id, scope.UserID, pq.Array(scope.Units))
+}
+
+// Totals of a unit, such as its reports and rollup, are read by whoever
+// reads all of the unit's requests and their amounts: Accountants and
+// Admins any unit, and Managers and delegates the units in their scope,
+// with the units below them.
+
+// mayReadUnit reports whether the viewer may read the totals of unit, or
+// of every unit when unit is empty.
+func (v viewer) mayReadUnit(unit string) bool {
+	scope := v.expenseScope()
+	if scope != nil && (unit == "" || !slices.Contains(scope.Units, unit)) {
+		return false
+	}
+	return !v.hidesAmountOf(0, unit)
+}
+
+// readableUnit writes a 403 unless the caller may read the totals of unit,
+// or of every unit when unit is empty.
+func (s *Server) readableUnit(w http.ResponseWriter, r *http.Request, unit string) bool {
+	v, ok := s.viewerOf(w, r)
+	if !ok {
+		return false
+	}
+	if !v.mayReadUnit(unit) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
+// readableExpenseRequest writes a 404 unless the caller may read expense
+// request id, for endpoints serving what belongs to one.
+func (s *Server) readableExpenseRequest(w http.ResponseWriter, r *http.Request, id int) bool {
+	_, _, ok := s.readExpenseRequestAs(w, r, id)
+	return ok
+}
+
+// readExpenseRequestAs is readableExpenseRequest for endpoints that also
+// need the caller and the request's owner, ID and unit.
+func (s *Server) readExpenseRequestAs(w http.ResponseWriter, r *http.Request, id int) (viewer, ExpenseRequest, bool) {
+	v, ok := s.viewerOf(w, r)
+	if !ok {
+		return v, ExpenseRequest{}, false
+	}
+	expense := ExpenseRequest{ID: id}
+	err := s.DB.QueryRowContext(r.Context(), "SELECT user_id, unit_id FROM expense_request WHERE id = $1", id).
+		Scan(&expense.UserID, &expense.UnitID)
+	if err == sql.ErrNoRows || (err == nil && !v.mayRead(expense)) {
+		http.Error(w, "Expense request not found", http.StatusNotFound)
+		return v, expense, false
+	} else if err != nil {
+		log.Println("Expense request query error:", err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return v, expense, false
+	}
+	return v, expense, true
+}
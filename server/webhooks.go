@@ -0,0 +1,527 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/lib/pq"
+)
+
+// Events integrations can subscribe to.
+const (
+	WebhookExpenseCreated          = "expense_request.created"
+	WebhookExpenseApproved         = "expense_request.approved"
+	WebhookPaymentCreated          = "paid_expense.created"
+	WebhookBudgetThresholdExceeded = "budget.threshold_exceeded"
+)
+
+var webhookEvents = []string{WebhookExpenseCreated, WebhookExpenseApproved, WebhookPaymentCreated, WebhookBudgetThresholdExceeded}
+
+const (
+	webhookInterval    = 15 * time.Second
+	webhookBatchSize   = 50
+	webhookTimeout     = 10 * time.Second
+	webhookMaxAttempts = 8
+	webhookRetryBase   = time.Minute
+)
+
+var webhookClient = &http.Client{Timeout: webhookTimeout}
+
+// Webhook is a callback URL registered for some events. Payloads are signed
+// with Secret, which is only shown when the webhook is created.
+type Webhook struct {
+	ID        int       `json:"id,omitempty"`
+	URL       string    `json:"url"`
+	Events    []string  `json:"events"`
+	Secret    string    `json:"secret,omitempty"`
+	Active    bool      `json:"active"`
+	CreatedBy int       `json:"createdBy"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+func (Webhook) CreateTableIfNotExists(s *Server) {
+	query := `CREATE TABLE IF NOT EXISTS webhook (
+		id SERIAL PRIMARY KEY,
+		url TEXT NOT NULL,
+		events TEXT[] NOT NULL,
+		secret VARCHAR(128) NOT NULL,
+		active BOOLEAN NOT NULL DEFAULT TRUE,
+		created_by INT NOT NULL,
+		created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+	)`
+
+	_, err := s.DB.Exec(query)
+
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+func (h Webhook) Validate(ctx context.Context, s *Server) (FieldErrors, error) {
+	errs := FieldErrors{}
+	if u, err := url.Parse(h.URL); err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+		errs.add("url", "must be an absolute http or https URL")
+	}
+	if len(h.Events) == 0 {
+		errs.add("events", "is required")
+	}
+	for _, event := range h.Events {
+		if !slices.Contains(webhookEvents, event) {
+			errs.add("events", "unknown event "+event)
+			break
+		}
+	}
+	return errs, nil
+}
+
+// WebhookDelivery is one event queued for a webhook and how sending it went.
+type WebhookDelivery struct {
+	ID            int             `json:"id"`
+	WebhookID     int             `json:"webhookID"`
+	Event         string          `json:"event"`
+	Payload       json.RawMessage `json:"payload"`
+	Attempts      int             `json:"attempts"`
+	StatusCode    *int            `json:"statusCode,omitempty"`
+	LastError     string          `json:"lastError,omitempty"`
+	NextAttemptAt *time.Time      `json:"nextAttemptAt,omitempty"`
+	DeliveredAt   *time.Time      `json:"deliveredAt,omitempty"`
+	CreatedAt     time.Time       `json:"createdAt"`
+}
+
+func (WebhookDelivery) CreateTableIfNotExists(s *Server) {
+	query := `CREATE TABLE IF NOT EXISTS webhook_delivery (
+		id SERIAL PRIMARY KEY,
+		webhook_id INT NOT NULL REFERENCES webhook (id) ON DELETE CASCADE,
+		event VARCHAR(64) NOT NULL,
+		payload JSONB NOT NULL,
+		attempts INT NOT NULL DEFAULT 0,
+		status_code INT,
+		last_error TEXT NOT NULL DEFAULT '',
+		next_attempt_at TIMESTAMPTZ DEFAULT NOW(),
+		delivered_at TIMESTAMPTZ,
+		created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+	);
+	CREATE INDEX IF NOT EXISTS webhook_delivery_due_idx ON webhook_delivery (next_attempt_at) WHERE delivered_at IS NULL`
+
+	_, err := s.DB.Exec(query)
+
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// webhookPayload is the body POSTed to a webhook.
+type webhookPayload struct {
+	Event      string    `json:"event"`
+	OccurredAt time.Time `json:"occurredAt"`
+	Data       any       `json:"data"`
+}
+
+// emitWebhook queues event for every active webhook subscribed to it. The
+// change it describes already happened, so failures are only logged.
+func (s *Server) emitWebhook(ctx context.Context, event string, data any) {
+	s.metrics.event(event)
+
+	payload, err := json.Marshal(webhookPayload{Event: event, OccurredAt: time.Now(), Data: data})
+	if err != nil {
+		log.Println("Webhook payload error:", err)
+		return
+	}
+	_, err = s.DB.ExecContext(ctx, `
+		INSERT INTO webhook_delivery (webhook_id, event, payload)
+		SELECT id, $1, $2 FROM webhook WHERE active AND $1 = ANY(events)
+	`, event, payload)
+	if err != nil {
+		log.Println("Webhook queue error:", err)
+	}
+}
+
+// signWebhook returns the hex HMAC-SHA256 of "timestamp.body". Receivers
+// recompute it and reject stale timestamps to stop replays.
+func signWebhook(secret, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// postWebhook sends one delivery and returns the response status, if any.
+func postWebhook(ctx context.Context, target, secret, event string, deliveryID int, body []byte) (int, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, target, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-EMS-Event", event)
+	req.Header.Set("X-EMS-Delivery", strconv.Itoa(deliveryID))
+	req.Header.Set("X-EMS-Timestamp", timestamp)
+	req.Header.Set("X-EMS-Signature", "sha256="+signWebhook(secret, timestamp, body))
+
+	resp, err := webhookClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return resp.StatusCode, errWebhookStatus(resp.Status)
+	}
+	return resp.StatusCode, nil
+}
+
+type errWebhookStatus string
+
+func (e errWebhookStatus) Error() string { return "unexpected response " + string(e) }
+
+// DeliverWebhooks sends the deliveries that are due, retrying failures with
+// exponential backoff until webhookMaxAttempts.
+func (s *Server) DeliverWebhooks(ctx context.Context) error {
+	for {
+		n, err := s.deliverWebhookBatch(ctx)
+		if err != nil || n < webhookBatchSize {
+			return err
+		}
+	}
+}
+
+func (s *Server) deliverWebhookBatch(ctx context.Context) (int, error) {
+	tx, err := s.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.QueryContext(ctx, `
+		SELECT d.id, d.event, d.payload, d.attempts, w.url, w.secret
+		FROM webhook_delivery d
+		JOIN webhook w ON w.id = d.webhook_id
+		WHERE d.delivered_at IS NULL AND d.next_attempt_at <= NOW()
+		ORDER BY d.next_attempt_at, d.id
+		LIMIT $1
+		FOR UPDATE OF d SKIP LOCKED
+	`, webhookBatchSize)
+	if err != nil {
+		return 0, err
+	}
+	type due struct {
+		id          int
+		event       string
+		payload     []byte
+		attempts    int
+		url, secret string
+	}
+	var batch []due
+	for rows.Next() {
+		var d due
+		if err := rows.Scan(&d.id, &d.event, &d.payload, &d.attempts, &d.url, &d.secret); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		batch = append(batch, d)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	for _, d := range batch {
+		status, sendErr := postWebhook(ctx, d.url, d.secret, d.event, d.id, d.payload)
+		var code *int
+		if status != 0 {
+			code = &status
+		}
+
+		if sendErr == nil {
+			_, err = tx.ExecContext(ctx, `
+				UPDATE webhook_delivery
+				SET delivered_at = NOW(), attempts = attempts + 1, status_code = $2, last_error = ''
+				WHERE id = $1
+			`, d.id, code)
+		} else {
+			// A NULL next attempt takes the delivery out of the queue for good
+			var next *time.Time
+			if d.attempts+1 < webhookMaxAttempts {
+				t := time.Now().Add(webhookRetryBase << d.attempts)
+				next = &t
+			}
+			_, err = tx.ExecContext(ctx, `
+				UPDATE webhook_delivery
+				SET attempts = attempts + 1, status_code = $2, last_error = $3, next_attempt_at = $4
+				WHERE id = $1
+			`, d.id, code, sendErr.Error(), next)
+		}
+		if err != nil {
+			return 0, err
+		}
+	}
+	return len(batch), tx.Commit()
+}
+
+// RunWebhookDeliverer delivers queued webhook events periodically until ctx
+// is cancelled.
+func (s *Server) RunWebhookDeliverer(ctx context.Context) {
+	ticker := time.NewTicker(webhookInterval)
+	defer ticker.Stop()
+
+	for {
+		if err := s.DeliverWebhooks(ctx); err != nil && ctx.Err() == nil {
+			log.Println("Webhook delivery error:", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (s *Server) CreateWebhook(w http.ResponseWriter, r *http.Request) {
+	caller, ok := s.requireRole(w, r, Admin)
+	if !ok {
+		return
+	}
+
+	var h Webhook
+	if err := json.NewDecoder(r.Body).Decode(&h); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+	h.CreatedBy = caller.ID
+	h.Active = true
+
+	if !s.validate(w, r, h) {
+		return
+	}
+
+	if h.Secret == "" {
+		secret := make([]byte, 32)
+		rand.Read(secret)
+		h.Secret = hex.EncodeToString(secret)
+	}
+
+	err := s.DB.QueryRowContext(r.Context(), `
+		INSERT INTO webhook (url, events, secret, created_by)
+		VALUES ($1, $2, $3, $4)
+		RETURNING id, created_at
+	`, h.URL, pq.Array(h.Events), h.Secret, h.CreatedBy).Scan(&h.ID, &h.CreatedAt)
+	if err != nil {
+		log.Println("Insert webhook error:", err)
+		http.Error(w, "Failed to create webhook", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(h)
+}
+
+const webhookColumns = "id, url, events, active, created_by, created_at"
+
+func scanWebhook(row rowScanner) (Webhook, error) {
+	var h Webhook
+	err := row.Scan(&h.ID, &h.URL, pq.Array(&h.Events), &h.Active, &h.CreatedBy, &h.CreatedAt)
+	return h, err
+}
+
+func (s *Server) ListWebhooks(w http.ResponseWriter, r *http.Request) {
+	if _, ok := s.requireRole(w, r, Admin); !ok {
+		return
+	}
+
+	rows, err := s.DB.QueryContext(r.Context(), "SELECT "+webhookColumns+" FROM webhook ORDER BY id")
+	if err != nil {
+		log.Println("ListWebhooks query error:", err)
+		http.Error(w, "Database query failed", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	webhooks := []Webhook{}
+	for rows.Next() {
+		h, err := scanWebhook(rows)
+		if err != nil {
+			log.Println("Row scan error:", err)
+			http.Error(w, "Failed to read webhook", http.StatusInternalServerError)
+			return
+		}
+		webhooks = append(webhooks, h)
+	}
+	if err := rows.Err(); err != nil {
+		log.Println("Row iteration error:", err)
+		http.Error(w, "Error reading results", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(webhooks)
+}
+
+func (s *Server) GetWebhook(w http.ResponseWriter, r *http.Request) {
+	if _, ok := s.requireRole(w, r, Admin); !ok {
+		return
+	}
+
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid ID", http.StatusBadRequest)
+		return
+	}
+
+	h, err := scanWebhook(s.DB.QueryRowContext(r.Context(), "SELECT "+webhookColumns+" FROM webhook WHERE id = $1", id))
+	if err == sql.ErrNoRows {
+		http.Error(w, "Webhook not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		log.Println("GetWebhook error:", err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(h)
+}
+
+type webhookActivePatch struct {
+	Active bool `json:"active"`
+}
+
+// SetWebhookActive pauses or resumes a webhook. Events raised while it is
+// paused are not queued for it.
+func (s *Server) SetWebhookActive(w http.ResponseWriter, r *http.Request) {
+	if _, ok := s.requireRole(w, r, Admin); !ok {
+		return
+	}
+
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid ID", http.StatusBadRequest)
+		return
+	}
+
+	var body webhookActivePatch
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+
+	h, err := scanWebhook(s.DB.QueryRowContext(r.Context(),
+		"UPDATE webhook SET active = $1 WHERE id = $2 RETURNING "+webhookColumns, body.Active, id))
+	if err == sql.ErrNoRows {
+		http.Error(w, "Webhook not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		log.Println("SetWebhookActive error:", err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(h)
+}
+
+func (s *Server) DeleteWebhook(w http.ResponseWriter, r *http.Request) {
+	if _, ok := s.requireRole(w, r, Admin); !ok {
+		return
+	}
+
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid ID", http.StatusBadRequest)
+		return
+	}
+
+	result, err := s.DB.ExecContext(r.Context(), "DELETE FROM webhook WHERE id = $1", id)
+	if err != nil {
+		log.Println("DeleteWebhook error:", err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		http.Error(w, "Error checking affected rows", http.StatusInternalServerError)
+		return
+	}
+	if rowsAffected == 0 {
+		http.Error(w, "Webhook not found", http.StatusNotFound)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// ListWebhookDeliveries is the delivery log of one webhook, newest first.
+func (s *Server) ListWebhookDeliveries(w http.ResponseWriter, r *http.Request) {
+	if _, ok := s.requireRole(w, r, Admin); !ok {
+		return
+	}
+
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid ID", http.StatusBadRequest)
+		return
+	}
+
+	query := `
+		SELECT id, webhook_id, event, payload, attempts, status_code, last_error, next_attempt_at, delivered_at, created_at
+		FROM webhook_delivery
+		WHERE webhook_id = $1`
+	switch r.URL.Query().Get("status") {
+	case "":
+	case "pending":
+		query += " AND delivered_at IS NULL AND next_attempt_at IS NOT NULL"
+	case "delivered":
+		query += " AND delivered_at IS NOT NULL"
+	case "failed":
+		query += " AND delivered_at IS NULL AND next_attempt_at IS NULL"
+	default:
+		http.Error(w, "status must be pending, delivered or failed", http.StatusBadRequest)
+		return
+	}
+	query += " ORDER BY created_at DESC, id DESC LIMIT 200"
+
+	rows, err := s.DB.QueryContext(r.Context(), query, id)
+	if err != nil {
+		log.Println("ListWebhookDeliveries query error:", err)
+		http.Error(w, "Database query failed", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	deliveries := []WebhookDelivery{}
+	for rows.Next() {
+		var d WebhookDelivery
+		var payload []byte
+		if err := rows.Scan(&d.ID, &d.WebhookID, &d.Event, &payload, &d.Attempts, &d.StatusCode, &d.LastError,
+			&d.NextAttemptAt, &d.DeliveredAt, &d.CreatedAt); err != nil {
+			log.Println("Row scan error:", err)
+			http.Error(w, "Failed to read delivery", http.StatusInternalServerError)
+			return
+		}
+		d.Payload = payload
+		deliveries = append(deliveries, d)
+	}
+	if err := rows.Err(); err != nil {
+		log.Println("Row iteration error:", err)
+		http.Error(w, "Error reading results", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(deliveries)
+}
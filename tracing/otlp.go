@@ -0,0 +1,245 @@
+package tracing
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	queueSize     = 2048 // spans waiting for export; more are dropped
+	batchSize     = 512
+	flushInterval = 5 * time.Second
+)
+
+// exporter posts finished spans to a collector in batches, as OTLP/HTTP
+// with JSON bodies.
+type exporter struct {
+	url     string
+	headers map[string]string
+	client  *http.Client
+
+	queue    chan *Span
+	dropped  atomic.Int64
+	stop     chan struct{}
+	stopOnce sync.Once
+	done     chan struct{}
+}
+
+func (e *exporter) start(url string, headers map[string]string) {
+	e.url, e.headers = url, headers
+	e.client = &http.Client{Timeout: 10 * time.Second}
+	e.queue = make(chan *Span, queueSize)
+	e.stop = make(chan struct{})
+	e.done = make(chan struct{})
+	go e.run()
+}
+
+// enqueue never blocks the request that ended the span.
+func (e *exporter) enqueue(s *Span) {
+	select {
+	case e.queue <- s:
+	default:
+		e.dropped.Add(1)
+	}
+}
+
+func (e *exporter) run() {
+	defer close(e.done)
+	ticker := time.NewTicker(flushInterval)
+	defer ticker.Stop()
+
+	var batch []*Span
+	for {
+		select {
+		case s := <-e.queue:
+			if batch = append(batch, s); len(batch) >= batchSize {
+				e.export(batch)
+				batch = nil
+			}
+		case <-ticker.C:
+			e.export(batch)
+			batch = nil
+		case <-e.stop:
+			for {
+				select {
+				case s := <-e.queue:
+					batch = append(batch, s)
+				default:
+					e.export(batch)
+					return
+				}
+			}
+		}
+	}
+}
+
+// Shutdown exports the spans still queued, waiting until ctx is done at
+// the most. Spans ended afterwards are dropped.
+func (t *Tracer) Shutdown(ctx context.Context) error {
+	if t == nil {
+		return nil
+	}
+	t.stopOnce.Do(func() { close(t.stop) })
+	select {
+	case <-t.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (e *exporter) export(batch []*Span) {
+	if n := e.dropped.Swap(0); n > 0 {
+		log.Printf("Tracing dropped %d spans, the export queue was full", n)
+	}
+	if len(batch) == 0 {
+		return
+	}
+	body, err := json.Marshal(traceRequest(batch))
+	if err != nil {
+		log.Println("Trace encoding error:", err)
+		return
+	}
+	if err := e.post(body); err != nil {
+		log.Println("Trace export error:", err)
+	}
+}
+
+func (e *exporter) post(body []byte) error {
+	req, err := http.NewRequest(http.MethodPost, e.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for key, value := range e.headers {
+		req.Header.Set(key, value)
+	}
+	resp, err := e.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("collector answered %s", resp.Status)
+	}
+	return nil
+}
+
+// The OTLP JSON encoding: IDs in hex, 64-bit integers as strings.
+
+type otlpRequest struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+type otlpResourceSpans struct {
+	Resource   otlpResource     `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpResource struct {
+	Attributes []otlpAttribute `json:"attributes"`
+}
+
+type otlpScopeSpans struct {
+	Scope otlpScope  `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpScope struct {
+	Name string `json:"name"`
+}
+
+type otlpSpan struct {
+	TraceID           string          `json:"traceId"`
+	SpanID            string          `json:"spanId"`
+	ParentSpanID      string          `json:"parentSpanId,omitempty"`
+	Name              string          `json:"name"`
+	Kind              Kind            `json:"kind"`
+	StartTimeUnixNano string          `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string          `json:"endTimeUnixNano"`
+	Attributes        []otlpAttribute `json:"attributes,omitempty"`
+	Status            otlpStatus      `json:"status"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code"` // 0 unset, 2 error
+	Message string `json:"message,omitempty"`
+}
+
+type otlpAttribute struct {
+	Key   string         `json:"key"`
+	Value map[string]any `json:"value"`
+}
+
+func otlpValue(v any) map[string]any {
+	switch v := v.(type) {
+	case string:
+		return map[string]any{"stringValue": v}
+	case int:
+		return map[string]any{"intValue": strconv.Itoa(v)}
+	case int64:
+		return map[string]any{"intValue": strconv.FormatInt(v, 10)}
+	case bool:
+		return map[string]any{"boolValue": v}
+	case float64:
+		return map[string]any{"doubleValue": v}
+	}
+	return map[string]any{"stringValue": fmt.Sprint(v)}
+}
+
+// traceRequest groups a batch by the tracer that started it; in practice
+// there is one.
+func traceRequest(batch []*Span) otlpRequest {
+	var req otlpRequest
+	index := map[*Tracer]int{}
+	for _, s := range batch {
+		i, ok := index[s.tracer]
+		if !ok {
+			i = len(req.ResourceSpans)
+			index[s.tracer] = i
+			req.ResourceSpans = append(req.ResourceSpans, otlpResourceSpans{
+				Resource: otlpResource{Attributes: []otlpAttribute{
+					{Key: "service.name", Value: otlpValue(s.tracer.service)},
+				}},
+				ScopeSpans: []otlpScopeSpans{{Scope: otlpScope{Name: "main/tracing"}}},
+			})
+		}
+		scope := &req.ResourceSpans[i].ScopeSpans[0]
+		scope.Spans = append(scope.Spans, s.otlp())
+	}
+	return req
+}
+
+func (s *Span) otlp() otlpSpan {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	span := otlpSpan{
+		TraceID:           hex.EncodeToString(s.traceID[:]),
+		SpanID:            hex.EncodeToString(s.spanID[:]),
+		Name:              s.name,
+		Kind:              s.kind,
+		StartTimeUnixNano: strconv.FormatInt(s.start.UnixNano(), 10),
+		EndTimeUnixNano:   strconv.FormatInt(s.end.UnixNano(), 10),
+	}
+	if s.parentID != [8]byte{} {
+		span.ParentSpanID = hex.EncodeToString(s.parentID[:])
+	}
+	for _, a := range s.attributes {
+		span.Attributes = append(span.Attributes, otlpAttribute{Key: a.key, Value: otlpValue(a.value)})
+	}
+	if s.failed {
+		span.Status = otlpStatus{Code: 2, Message: s.message}
+	}
+	return span
+}
@@ -0,0 +1,138 @@
+package tracing
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestOTLPPayload(t *testing.T) {
+	tracer := testTracer(1)
+	start := time.Unix(1700000000, 5)
+	span := &Span{
+		tracer:   tracer,
+		traceID:  [16]byte{0x4b, 0xf9, 15: 0x36},
+		spanID:   [8]byte{0x00, 0xf0, 7: 0xb7},
+		parentID: [8]byte{0x01, 7: 0x02},
+		name:     "GET /users/{id}",
+		kind:     Server,
+		start:    start,
+		end:      start.Add(1500 * time.Millisecond),
+	}
+	span.SetAttribute("http.request.method", "GET")
+	span.SetAttribute("http.response.status_code", 404)
+	span.SetAttribute("db.rows", int64(1)<<40)
+	span.SetAttribute("retried", false)
+	span.SetAttribute("ratio", 0.25)
+	span.SetAttribute("path", []string{"users"})
+	span.SetError("not found")
+	root := &Span{tracer: tracer, traceID: [16]byte{1}, spanID: [8]byte{2}, name: "root", kind: Internal, start: start, end: start}
+
+	body, err := json.Marshal(traceRequest([]*Span{span, root}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got any
+	if err := json.Unmarshal(body, &got); err != nil {
+		t.Fatal(err)
+	}
+	var want any
+	if err := json.Unmarshal([]byte(`{"resourceSpans": [{
+		"resource": {"attributes": [{"key": "service.name", "value": {"stringValue": "test"}}]},
+		"scopeSpans": [{"scope": {"name": "main/tracing"}, "spans": [
+			{
+				"traceId": "4bf90000000000000000000000000036",
+				"spanId": "00f00000000000b7",
+				"parentSpanId": "0100000000000002",
+				"name": "GET /users/{id}",
+				"kind": 2,
+				"startTimeUnixNano": "1700000000000000005",
+				"endTimeUnixNano": "1700000001500000005",
+				"attributes": [
+					{"key": "http.request.method", "value": {"stringValue": "GET"}},
+					{"key": "http.response.status_code", "value": {"intValue": "404"}},
+					{"key": "db.rows", "value": {"intValue": "1099511627776"}},
+					{"key": "retried", "value": {"boolValue": false}},
+					{"key": "ratio", "value": {"doubleValue": 0.25}},
+					{"key": "path", "value": {"stringValue": "[users]"}}
+				],
+				"status": {"code": 2, "message": "not found"}
+			},
+			{
+				"traceId": "01000000000000000000000000000000",
+				"spanId": "0200000000000000",
+				"name": "root",
+				"kind": 1,
+				"startTimeUnixNano": "1700000000000000005",
+				"endTimeUnixNano": "1700000000000000005",
+				"status": {"code": 0}
+			}
+		]}]
+	}]}`), &want); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("payload\n%s\nwant\n%v", body, want)
+	}
+}
+
+func TestExport(t *testing.T) {
+	requests := make(chan *http.Request, 1)
+	bodies := make(chan []byte, 1)
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		requests <- r
+		bodies <- body
+	}))
+	defer collector.Close()
+
+	tracer := New(Options{Endpoint: collector.URL + "/", Headers: map[string]string{"Api-Key": "secret"}, ServiceName: "ems", SampleRatio: 1})
+	ctx, span := tracer.StartRemote(context.Background(), "", "GET /users", Server)
+	_, child := Start(ctx, "SELECT", Client)
+	child.End()
+	span.End()
+	span.End() // counted once
+
+	shutdown, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := tracer.Shutdown(shutdown); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case r := <-requests:
+		if r.Method != http.MethodPost || r.URL.Path != "/v1/traces" {
+			t.Errorf("exported with %s %s", r.Method, r.URL.Path)
+		}
+		if r.Header.Get("Content-Type") != "application/json" || r.Header.Get("Api-Key") != "secret" {
+			t.Errorf("headers %v", r.Header)
+		}
+	default:
+		t.Fatal("nothing exported on shutdown")
+	}
+	var req otlpRequest
+	if err := json.Unmarshal(<-bodies, &req); err != nil {
+		t.Fatal(err)
+	}
+	if len(req.ResourceSpans) != 1 || len(req.ResourceSpans[0].ScopeSpans[0].Spans) != 2 {
+		t.Fatalf("exported %+v", req)
+	}
+	spans := req.ResourceSpans[0].ScopeSpans[0].Spans
+	if spans[0].Name != "SELECT" || spans[1].Name != "GET /users" || spans[0].ParentSpanID != spans[1].SpanID {
+		t.Errorf("spans %+v", spans)
+	}
+
+	// Spans ended after shutdown are dropped, not sent
+	_, late := tracer.StartRemote(context.Background(), "", "late", Server)
+	late.End()
+	select {
+	case <-requests:
+		t.Error("a span is exported after shutdown")
+	case <-time.After(50 * time.Millisecond):
+	}
+}
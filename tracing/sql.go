@@ -0,0 +1,201 @@
+package tracing
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"strings"
+)
+
+// Connector wraps a database driver's connector so that every query run
+// with the context of a traced request gets a client span, tagged with
+// its statement. Statements keep their placeholders, so the spans carry no
+// query arguments. A query's span ends once the database has answered,
+// before its rows are read.
+func Connector(c driver.Connector) driver.Connector {
+	return connector{c}
+}
+
+type connector struct {
+	driver.Connector
+}
+
+func (c connector) Connect(ctx context.Context) (driver.Conn, error) {
+	cn, err := c.Connector.Connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &conn{cn}, nil
+}
+
+// startQuery starts the span of a statement, named after its operation as
+// in SELECT or INSERT.
+func startQuery(ctx context.Context, query string) *Span {
+	_, span := Start(ctx, "", Client)
+	if span == nil {
+		return nil
+	}
+	statement := strings.Join(strings.Fields(query), " ")
+	operation, _, _ := strings.Cut(statement, " ")
+	span.name = strings.ToUpper(operation)
+	span.SetAttribute("db.system.name", "postgresql")
+	span.SetAttribute("db.operation.name", strings.ToUpper(operation))
+	span.SetAttribute("db.query.text", statement)
+	return span
+}
+
+// endQuery ends span with the outcome of its statement. driver.ErrSkip only
+// asks database/sql to run the statement another way, which is traced in
+// turn.
+func endQuery(span *Span, err error) {
+	if err != nil && !errors.Is(err, driver.ErrSkip) {
+		span.SetError(err.Error())
+	}
+	span.End()
+}
+
+// conn passes everything on to the driver's connection, answering
+// driver.ErrSkip where it lacks a method, as database/sql expects.
+type conn struct {
+	driver.Conn
+}
+
+func (c *conn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	execer, ok := c.Conn.(driver.ExecerContext)
+	if !ok {
+		return nil, driver.ErrSkip
+	}
+	span := startQuery(ctx, query)
+	result, err := execer.ExecContext(ctx, query, args)
+	endQuery(span, err)
+	return result, err
+}
+
+func (c *conn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	queryer, ok := c.Conn.(driver.QueryerContext)
+	if !ok {
+		return nil, driver.ErrSkip
+	}
+	span := startQuery(ctx, query)
+	rows, err := queryer.QueryContext(ctx, query, args)
+	endQuery(span, err)
+	return rows, err
+}
+
+func (c *conn) PrepareContext(ctx context.Context, query string) (driver.Stmt, error) {
+	var st driver.Stmt
+	var err error
+	if preparer, ok := c.Conn.(driver.ConnPrepareContext); ok {
+		st, err = preparer.PrepareContext(ctx, query)
+	} else {
+		st, err = c.Conn.Prepare(query)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &stmt{Stmt: st, query: query}, nil
+}
+
+func (c *conn) BeginTx(ctx context.Context, opts driver.TxOptions) (driver.Tx, error) {
+	span := startQuery(ctx, "BEGIN")
+	var t driver.Tx
+	var err error
+	if beginner, ok := c.Conn.(driver.ConnBeginTx); ok {
+		t, err = beginner.BeginTx(ctx, opts)
+	} else {
+		t, err = c.Conn.Begin()
+	}
+	endQuery(span, err)
+	if err != nil {
+		return nil, err
+	}
+	return &tx{Tx: t, ctx: ctx}, nil
+}
+
+func (c *conn) Ping(ctx context.Context) error {
+	if pinger, ok := c.Conn.(driver.Pinger); ok {
+		return pinger.Ping(ctx)
+	}
+	return nil
+}
+
+func (c *conn) ResetSession(ctx context.Context) error {
+	if resetter, ok := c.Conn.(driver.SessionResetter); ok {
+		return resetter.ResetSession(ctx)
+	}
+	return nil
+}
+
+func (c *conn) IsValid() bool {
+	if validator, ok := c.Conn.(driver.Validator); ok {
+		return validator.IsValid()
+	}
+	return true
+}
+
+// tx traces the end of a transaction under the context it began with.
+type tx struct {
+	driver.Tx
+	ctx context.Context
+}
+
+func (t *tx) Commit() error {
+	span := startQuery(t.ctx, "COMMIT")
+	err := t.Tx.Commit()
+	endQuery(span, err)
+	return err
+}
+
+func (t *tx) Rollback() error {
+	span := startQuery(t.ctx, "ROLLBACK")
+	err := t.Tx.Rollback()
+	endQuery(span, err)
+	return err
+}
+
+type stmt struct {
+	driver.Stmt
+	query string
+}
+
+func (s *stmt) ExecContext(ctx context.Context, args []driver.NamedValue) (driver.Result, error) {
+	span := startQuery(ctx, s.query)
+	var result driver.Result
+	var err error
+	if execer, ok := s.Stmt.(driver.StmtExecContext); ok {
+		result, err = execer.ExecContext(ctx, args)
+	} else if values, convErr := positional(args); convErr != nil {
+		err = convErr
+	} else {
+		result, err = s.Stmt.Exec(values)
+	}
+	endQuery(span, err)
+	return result, err
+}
+
+func (s *stmt) QueryContext(ctx context.Context, args []driver.NamedValue) (driver.Rows, error) {
+	span := startQuery(ctx, s.query)
+	var rows driver.Rows
+	var err error
+	if queryer, ok := s.Stmt.(driver.StmtQueryContext); ok {
+		rows, err = queryer.QueryContext(ctx, args)
+	} else if values, convErr := positional(args); convErr != nil {
+		err = convErr
+	} else {
+		rows, err = s.Stmt.Query(values)
+	}
+	endQuery(span, err)
+	return rows, err
+}
+
+// positional passes arguments to statements from before named arguments.
+func positional(args []driver.NamedValue) ([]driver.Value, error) {
+	values := make([]driver.Value, len(args))
+	for i, arg := range args {
+		if arg.Name != "" {
+			return nil, errors.New("tracing: the driver does not take named arguments")
+		}
+		values[i] = arg.Value
+	}
+	return values, nil
+}
@@ -0,0 +1,197 @@
+// Package tracing records OpenTelemetry spans and exports them over OTLP,
+// the protocol collectors such as the OpenTelemetry Collector, Jaeger and
+// Tempo take. It covers what the server needs: server spans for requests,
+// client spans for queries under them, W3C trace context from callers and
+// a sample ratio, without the OpenTelemetry SDK.
+package tracing
+
+import (
+	"context"
+	"encoding/hex"
+	"math/rand/v2"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Kind is what a span stands for, numbered as OTLP numbers them.
+type Kind int
+
+const (
+	Internal Kind = 1
+	Server   Kind = 2 // a request the process answers
+	Client   Kind = 3 // a call the process makes, such as a query
+)
+
+// Options configure a Tracer.
+type Options struct {
+	// Endpoint is the collector's OTLP/HTTP base URL, e.g.
+	// http://localhost:4318; spans are posted to its /v1/traces
+	Endpoint string
+	// Headers are sent with every export, e.g. for an API key
+	Headers map[string]string
+	// ServiceName names the process in the collector
+	ServiceName string
+	// SampleRatio is the share of traces started here that are recorded,
+	// from 0 to 1. Traces a caller started follow the caller's decision.
+	SampleRatio float64
+}
+
+// Tracer starts root spans and exports finished spans in the background. A
+// nil Tracer records nothing.
+type Tracer struct {
+	service string
+	ratio   float64
+	exporter
+}
+
+// New starts a tracer exporting to opts.Endpoint. Shutdown stops it.
+func New(opts Options) *Tracer {
+	t := &Tracer{service: opts.ServiceName, ratio: opts.SampleRatio}
+	t.exporter.start(strings.TrimSuffix(opts.Endpoint, "/")+"/v1/traces", opts.Headers)
+	return t
+}
+
+// Span is one timed operation of a trace. Its methods do nothing on a nil
+// Span, which is what unsampled operations get.
+type Span struct {
+	tracer   *Tracer
+	traceID  [16]byte
+	spanID   [8]byte
+	parentID [8]byte // zero for a root span
+	name     string
+	kind     Kind
+	start    time.Time
+
+	mu         sync.Mutex
+	end        time.Time
+	attributes []attribute
+	failed     bool
+	message    string
+}
+
+type attribute struct {
+	key   string
+	value any // string, int, int64, bool or float64
+}
+
+type spanKey struct{}
+
+// FromContext returns the span ctx carries, or nil.
+func FromContext(ctx context.Context) *Span {
+	span, _ := ctx.Value(spanKey{}).(*Span)
+	return span
+}
+
+// StartRemote starts a span for a request the process answers, continuing
+// the trace in the caller's traceparent header when it has a valid one and
+// starting a new trace otherwise.
+func (t *Tracer) StartRemote(ctx context.Context, traceparent string, name string, kind Kind) (context.Context, *Span) {
+	if t == nil {
+		return ctx, nil
+	}
+	span := &Span{tracer: t, name: name, kind: kind, start: time.Now()}
+	traceID, parentID, sampled, ok := parseTraceParent(traceparent)
+	if ok {
+		span.traceID, span.parentID = traceID, parentID
+	} else {
+		sampled = rand.Float64() < t.ratio
+		putRandom(span.traceID[:])
+	}
+	if !sampled {
+		return ctx, nil
+	}
+	putRandom(span.spanID[:])
+	return context.WithValue(ctx, spanKey{}, span), span
+}
+
+// Start starts a child of the span ctx carries. Without one, or when its
+// trace is not sampled, it returns ctx and a nil span, so work outside a
+// traced request is not recorded.
+func Start(ctx context.Context, name string, kind Kind) (context.Context, *Span) {
+	parent := FromContext(ctx)
+	if parent == nil {
+		return ctx, nil
+	}
+	span := &Span{tracer: parent.tracer, traceID: parent.traceID, parentID: parent.spanID, name: name, kind: kind, start: time.Now()}
+	putRandom(span.spanID[:])
+	return context.WithValue(ctx, spanKey{}, span), span
+}
+
+// SetAttribute records a key and a string, int, int64, bool or float64
+// value, named after the OpenTelemetry semantic conventions.
+func (s *Span) SetAttribute(key string, value any) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.attributes = append(s.attributes, attribute{key, value})
+}
+
+// SetError marks the span as failed with a message.
+func (s *Span) SetError(message string) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.failed, s.message = true, message
+}
+
+// End finishes the span and queues it for export. Only the first call
+// counts.
+func (s *Span) End() {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	if !s.end.IsZero() {
+		s.mu.Unlock()
+		return
+	}
+	s.end = time.Now()
+	s.mu.Unlock()
+	s.tracer.enqueue(s)
+}
+
+// parseTraceParent reads a W3C traceparent header such as
+// 00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01. Its fields are
+// lowercase hex; later versions may append fields, which are ignored.
+func parseTraceParent(header string) (traceID [16]byte, parentID [8]byte, sampled bool, ok bool) {
+	parts := strings.Split(strings.TrimSpace(header), "-")
+	if len(parts) < 4 || !lowerHex(parts[0], 2) || parts[0] == "ff" || (parts[0] == "00" && len(parts) != 4) {
+		return traceID, parentID, false, false
+	}
+	if !lowerHex(parts[1], 32) || !lowerHex(parts[2], 16) || !lowerHex(parts[3], 2) {
+		return traceID, parentID, false, false
+	}
+	var flags [1]byte
+	hex.Decode(traceID[:], []byte(parts[1]))
+	hex.Decode(parentID[:], []byte(parts[2]))
+	hex.Decode(flags[:], []byte(parts[3]))
+	if traceID == [16]byte{} || parentID == [8]byte{} {
+		return traceID, parentID, false, false
+	}
+	return traceID, parentID, flags[0]&1 == 1, true
+}
+
+// lowerHex reports whether s is n lowercase hex digits.
+func lowerHex(s string, n int) bool {
+	if len(s) != n {
+		return false
+	}
+	for i := 0; i < len(s); i++ {
+		if (s[i] < '0' || s[i] > '9') && (s[i] < 'a' || s[i] > 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+// putRandom fills b with random bytes; IDs need to be unique, not secret.
+func putRandom(b []byte) {
+	for i := range b {
+		b[i] = byte(rand.Uint32())
+	}
+}
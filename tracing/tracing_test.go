@@ -0,0 +1,110 @@
+package tracing
+
+import (
+	"context"
+	"encoding/hex"
+	"testing"
+)
+
+func TestParseTraceParent(t *testing.T) {
+	const (
+		traceID = "4bf92f3577b34da6a3ce929d0e0e4736"
+		spanID  = "00f067aa0ba902b7"
+	)
+	tests := []struct {
+		name    string
+		header  string
+		ok      bool
+		sampled bool
+	}{
+		{"sampled", "00-" + traceID + "-" + spanID + "-01", true, true},
+		{"not sampled", "00-" + traceID + "-" + spanID + "-00", true, false},
+		{"other flags", "00-" + traceID + "-" + spanID + "-03", true, true},
+		{"surrounding spaces", " 00-" + traceID + "-" + spanID + "-01 ", true, true},
+		{"later version with more fields", "cc-" + traceID + "-" + spanID + "-01-what-the-future-holds", true, true},
+		{"version 00 with more fields", "00-" + traceID + "-" + spanID + "-01-extra", false, false},
+		{"version ff", "ff-" + traceID + "-" + spanID + "-01", false, false},
+		{"version not hex", "0g-" + traceID + "-" + spanID + "-01", false, false},
+		{"uppercase trace ID", "00-4BF92F3577B34DA6A3CE929D0E0E4736-" + spanID + "-01", false, false},
+		{"uppercase flags", "00-" + traceID + "-" + spanID + "-0A", false, false},
+		{"zero trace ID", "00-00000000000000000000000000000000-" + spanID + "-01", false, false},
+		{"zero parent ID", "00-" + traceID + "-0000000000000000-01", false, false},
+		{"short trace ID", "00-" + traceID[1:] + "-" + spanID + "-01", false, false},
+		{"short parent ID", "00-" + traceID + "-" + spanID[1:] + "-01", false, false},
+		{"trace ID not hex", "00-" + traceID[:31] + "x-" + spanID + "-01", false, false},
+		{"missing flags", "00-" + traceID + "-" + spanID, false, false},
+		{"empty", "", false, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			gotTrace, gotParent, sampled, ok := parseTraceParent(tt.header)
+			if ok != tt.ok || sampled != tt.sampled {
+				t.Fatalf("ok, sampled = %v, %v; want %v, %v", ok, sampled, tt.ok, tt.sampled)
+			}
+			if ok && (hex.EncodeToString(gotTrace[:]) != traceID || hex.EncodeToString(gotParent[:]) != spanID) {
+				t.Errorf("IDs = %x, %x", gotTrace, gotParent)
+			}
+		})
+	}
+}
+
+// testTracer is a tracer whose spans are not exported.
+func testTracer(ratio float64) *Tracer {
+	return &Tracer{service: "test", ratio: ratio}
+}
+
+func TestStartRemote(t *testing.T) {
+	const header = "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+
+	// A caller's trace is continued whatever the ratio
+	ctx, span := testTracer(0).StartRemote(context.Background(), header, "GET /users", Server)
+	if span == nil {
+		t.Fatal("a sampled caller's trace is not recorded")
+	}
+	if got := hex.EncodeToString(span.traceID[:]); got != "4bf92f3577b34da6a3ce929d0e0e4736" {
+		t.Errorf("trace ID = %s", got)
+	}
+	if got := hex.EncodeToString(span.parentID[:]); got != "00f067aa0ba902b7" {
+		t.Errorf("parent ID = %s", got)
+	}
+	if span.spanID == [8]byte{} || FromContext(ctx) != span {
+		t.Errorf("span ID %x, context span %p", span.spanID, FromContext(ctx))
+	}
+
+	unsampled := header[:len(header)-1] + "0"
+	if _, span := testTracer(1).StartRemote(context.Background(), unsampled, "GET /users", Server); span != nil {
+		t.Error("an unsampled caller's trace is recorded")
+	}
+
+	// Without a valid header, a new trace is sampled by the ratio
+	_, span = testTracer(1).StartRemote(context.Background(), "garbage", "GET /users", Server)
+	if span == nil || span.traceID == [16]byte{} || span.parentID != [8]byte{} {
+		t.Errorf("new trace = %+v", span)
+	}
+	if _, span := testTracer(0).StartRemote(context.Background(), "", "GET /users", Server); span != nil {
+		t.Error("a trace is recorded at ratio 0")
+	}
+
+	var nilTracer *Tracer
+	if ctx, span := nilTracer.StartRemote(context.Background(), header, "GET /users", Server); span != nil || FromContext(ctx) != nil {
+		t.Error("a nil tracer records a span")
+	}
+}
+
+func TestStart(t *testing.T) {
+	if ctx, span := Start(context.Background(), "SELECT", Client); span != nil || FromContext(ctx) != nil {
+		t.Error("a span is started outside a trace")
+	}
+
+	ctx, parent := testTracer(1).StartRemote(context.Background(), "", "GET /users", Server)
+	_, child := Start(ctx, "SELECT", Client)
+	if child == nil || child.traceID != parent.traceID || child.parentID != parent.spanID || child.spanID == parent.spanID {
+		t.Errorf("child %+v of %+v", child, parent)
+	}
+
+	// The methods of a nil span do nothing
+	var span *Span
+	span.SetAttribute("k", "v")
+	span.SetError("failed")
+	span.End()
+}